@@ -29,6 +29,8 @@ For SQLite/bolt providers the database file will be auto-created if missing.
 For PostgreSQL and MySQL providers you need to create the configured database,
 this command will create/update the required tables as needed.
 
+For MongoDB provider this command will create the required indexes.
+
 To initialize/update the data provider from the configuration directory simply use:
 
 $ sftpgo initprovider
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/drakkan/sftpgo/config"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+var (
+	rotateSecretsDryRun bool
+	rotateSecretsCmd    = &cobra.Command{
+		Use:   "rotatesecrets",
+		Short: "Encrypts again the secrets stored inside the data provider",
+		Long: `This command decrypts the secrets stored inside the configured data provider,
+such as the cloud storage credentials and the TOTP secrets, and encrypts them
+again using the configured secret provider ("kms" section).
+
+Using the local secret provider new random encryption keys are generated, if a
+different secret provider is configured the existing secrets are migrated to it.
+The secrets referencing an external secrets store are not modified.
+
+All the secrets are decrypted and encrypted again before updating the data
+provider, if a secret cannot be decrypted nothing is changed. If an update fails
+the already updated users and groups are restored.
+
+It is better to stop SFTPGo, or to avoid any users and groups change, while the
+rotation is in progress, the secrets can also be rotated invoking the REST API
+on a running instance.
+
+To check that all the secrets can be rotated without changing anything:
+
+$ sftpgo rotatesecrets --dry-run
+
+Please take a look at the usage below to customize the options.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.DisableLogger()
+			logger.EnableConsoleLogger(zerolog.DebugLevel)
+			configDir = utils.CleanDirInput(configDir)
+			err := config.LoadConfig(configDir, configFile)
+			if err != nil {
+				logger.WarnToConsole("Unable to rotate secrets, config load error: %v", err)
+				os.Exit(1)
+			}
+			httpConfig := config.GetHTTPConfig()
+			httpConfig.Initialize(configDir)
+			kmsConfig := config.GetKMSConfig()
+			if err := kmsConfig.Initialize(); err != nil {
+				logger.WarnToConsole("Unable to initialize the secret provider: %v", err)
+				os.Exit(1)
+			}
+			providerConf := config.GetProviderConf()
+			if providerConf.Driver == dataprovider.MemoryDataProviderName {
+				logger.WarnToConsole("Unable to rotate secrets, the memory provider is not persistent")
+				os.Exit(1)
+			}
+			logger.InfoToConsole("Rotating secrets, provider: %#v config file: %#v dry run: %v", providerConf.Driver,
+				viper.ConfigFileUsed(), rotateSecretsDryRun)
+			err = dataprovider.Initialize(providerConf, configDir)
+			if err != nil {
+				logger.WarnToConsole("Unable to initialize the data provider: %v", err)
+				os.Exit(1)
+			}
+			result, err := dataprovider.RotateSecrets(rotateSecretsDryRun)
+			if err != nil {
+				logger.WarnToConsole("Unable to rotate secrets: %v", err)
+				os.Exit(1)
+			}
+			if result.DryRun {
+				logger.InfoToConsole("Dry run completed, secrets to rotate: %v, users: %v, deleted users: %v, groups: %v, "+
+					"external references: %v", result.Secrets, result.Users, result.DeletedUsers, result.Groups, result.References)
+				return
+			}
+			logger.InfoToConsole("Secrets successfully rotated: %v, users: %v, deleted users: %v, groups: %v, "+
+				"external references: %v", result.Secrets, result.Users, result.DeletedUsers, result.Groups, result.References)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(rotateSecretsCmd)
+	addConfigFlags(rotateSecretsCmd)
+	rotateSecretsCmd.Flags().BoolVar(&rotateSecretsDryRun, "dry-run", false, `Check that all the secrets can be
+decrypted without updating the data provider`)
+}
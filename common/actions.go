@@ -28,7 +28,7 @@ var (
 
 // ProtocolActions defines the action to execute on file operations and SSH commands
 type ProtocolActions struct {
-	// Valid values are download, upload, pre-delete, delete, rename, ssh_cmd. Empty slice to disable
+	// Valid values are download, upload, pre-delete, delete, rename, ssh_cmd, quarantine. Empty slice to disable
 	ExecuteOn []string `json:"execute_on" mapstructure:"execute_on"`
 	// Absolute path to an external program or an HTTP URL
 	Hook string `json:"hook" mapstructure:"hook"`
@@ -57,17 +57,20 @@ type ActionHandler interface {
 
 // ActionNotification defines a notification for a Protocol Action.
 type ActionNotification struct {
-	Action     string `json:"action"`
-	Username   string `json:"username"`
-	Path       string `json:"path"`
-	TargetPath string `json:"target_path,omitempty"`
-	SSHCmd     string `json:"ssh_cmd,omitempty"`
-	FileSize   int64  `json:"file_size,omitempty"`
-	FsProvider int    `json:"fs_provider"`
-	Bucket     string `json:"bucket,omitempty"`
-	Endpoint   string `json:"endpoint,omitempty"`
-	Status     int    `json:"status"`
-	Protocol   string `json:"protocol"`
+	Action     string            `json:"action"`
+	Username   string            `json:"username"`
+	Path       string            `json:"path"`
+	TargetPath string            `json:"target_path,omitempty"`
+	SSHCmd     string            `json:"ssh_cmd,omitempty"`
+	FileSize   int64             `json:"file_size,omitempty"`
+	FsProvider int               `json:"fs_provider"`
+	Bucket     string            `json:"bucket,omitempty"`
+	Endpoint   string            `json:"endpoint,omitempty"`
+	Status     int               `json:"status"`
+	Protocol   string            `json:"protocol"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Elapsed    int64             `json:"elapsed,omitempty"`
+	Partial    bool              `json:"partial,omitempty"`
 }
 
 func newActionNotification(
@@ -91,6 +94,11 @@ func newActionNotification(
 		} else {
 			endpoint = user.FsConfig.AzBlobConfig.Endpoint
 		}
+	} else if user.FsConfig.Provider == dataprovider.B2FilesystemProvider {
+		bucket = user.FsConfig.B2Config.Bucket
+		endpoint = user.FsConfig.B2Config.Endpoint
+	} else if user.FsConfig.Provider == dataprovider.SFTPFilesystemProvider {
+		endpoint = user.FsConfig.SFTPConfig.Endpoint
 	}
 
 	if err == ErrQuotaExceeded {
@@ -111,6 +119,7 @@ func newActionNotification(
 		Endpoint:   endpoint,
 		Status:     status,
 		Protocol:   protocol,
+		Metadata:   user.Metadata,
 	}
 }
 
@@ -145,19 +154,23 @@ func (h defaultActionHandler) handleHTTP(notification ActionNotification) error
 	startTime := time.Now()
 	respCode := 0
 
-	httpClient := httpclient.GetHTTPClient()
-
 	var b bytes.Buffer
 	_ = json.NewEncoder(&b).Encode(notification)
 
-	resp, err := httpClient.Post(u.String(), "application/json", &b)
-	if err == nil {
-		respCode = resp.StatusCode
-		resp.Body.Close()
-
-		if respCode != http.StatusOK {
-			err = errUnexpectedHTTResponse
+	if notification.Action == operationPreDelete {
+		// the pre-delete hook result is needed now, it makes no sense to retry it later
+		httpClient := httpclient.GetHTTPClient()
+		var resp *http.Response
+		resp, err = httpClient.Post(u.String(), "application/json", &b)
+		if err == nil {
+			respCode = resp.StatusCode
+			resp.Body.Close()
 		}
+	} else {
+		respCode, err = httpclient.PostJSON(notification.Protocol, u.String(), b.Bytes())
+	}
+	if respCode > 0 && respCode != http.StatusOK {
+		err = errUnexpectedHTTResponse
 	}
 
 	logger.Debug(notification.Protocol, "", "notified operation %#v to URL: %v status code: %v, elapsed: %v err: %v", notification.Action, u.String(), respCode, time.Since(startTime), err)
@@ -189,6 +202,10 @@ func (h defaultActionHandler) handleCommand(notification ActionNotification) err
 }
 
 func notificationAsEnvVars(notification ActionNotification) []string {
+	var metadata []byte
+	if len(notification.Metadata) > 0 {
+		metadata, _ = json.Marshal(notification.Metadata)
+	}
 	return []string{
 		fmt.Sprintf("SFTPGO_ACTION=%v", notification.Action),
 		fmt.Sprintf("SFTPGO_ACTION_USERNAME=%v", notification.Username),
@@ -201,5 +218,8 @@ func notificationAsEnvVars(notification ActionNotification) []string {
 		fmt.Sprintf("SFTPGO_ACTION_ENDPOINT=%v", notification.Endpoint),
 		fmt.Sprintf("SFTPGO_ACTION_STATUS=%v", notification.Status),
 		fmt.Sprintf("SFTPGO_ACTION_PROTOCOL=%v", notification.Protocol),
+		fmt.Sprintf("SFTPGO_ACTION_METADATA=%v", string(metadata)),
+		fmt.Sprintf("SFTPGO_ACTION_ELAPSED=%v", notification.Elapsed),
+		fmt.Sprintf("SFTPGO_ACTION_PARTIAL=%v", notification.Partial),
 	}
 }
@@ -4,15 +4,20 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/httpclient"
 	"github.com/drakkan/sftpgo/vfs"
 )
 
@@ -91,6 +96,100 @@ func TestActionHTTP(t *testing.T) {
 	Config.Actions = actionsCopy
 }
 
+func TestActionHTTPRetryQueue(t *testing.T) {
+	actionsCopy := Config.Actions
+
+	var requests, failures int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	queueDir := filepath.Join(os.TempDir(), "hooks_queue")
+	httpConfig := httpclient.Config{
+		Timeout: 5,
+		RetryQueue: httpclient.RetryQueueConfig{
+			MaxAttempts: 3,
+			BaseDelay:   1,
+			MaxDelay:    1,
+			Path:        queueDir,
+		},
+	}
+	httpConfig.Initialize(configDir)
+
+	Config.Actions = ProtocolActions{
+		ExecuteOn: []string{operationUpload, operationPreDelete},
+		Hook:      ts.URL,
+	}
+	user := &dataprovider.User{
+		Username: "username",
+	}
+	getPending := func() []string {
+		matches, err := filepath.Glob(filepath.Join(queueDir, "*.json"))
+		assert.NoError(t, err)
+		return matches
+	}
+	// the first attempt fails, the notification is delivered on retry
+	atomic.StoreInt32(&failures, 1)
+	a := newActionNotification(user, operationUpload, "path", "", "", ProtocolSFTP, 123, nil)
+	err := actionHandler.Handle(a)
+	assert.Error(t, err)
+	assert.Len(t, getPending(), 1)
+	assert.Eventually(t, func() bool {
+		return len(getPending()) == 0
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	// pre-delete notifications are never retried
+	atomic.StoreInt32(&failures, 1)
+	a = newActionNotification(user, operationPreDelete, "path", "", "", ProtocolSFTP, 123, nil)
+	err = actionHandler.Handle(a)
+	assert.EqualError(t, err, errUnexpectedHTTResponse.Error())
+	assert.Len(t, getPending(), 0)
+	// permanently failed notifications are saved to the dead letter log
+	atomic.StoreInt32(&failures, 100)
+	a = newActionNotification(user, operationUpload, "dead_letter_path", "", "", ProtocolSFTP, 123, nil)
+	err = actionHandler.Handle(a)
+	assert.Error(t, err)
+	deadLetterPath := filepath.Join(queueDir, "dead_letter.log")
+	assert.Eventually(t, func() bool {
+		return len(getPending()) == 0
+	}, 5*time.Second, 100*time.Millisecond)
+	content, err := ioutil.ReadFile(deadLetterPath)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(content), "dead_letter_path")
+	}
+	// pending notifications survive a restart
+	atomic.StoreInt32(&failures, 0)
+	atomic.StoreInt32(&requests, 0)
+	pendingEvent := fmt.Sprintf(`{"id":"pending","sender":"SFTP","url":%q,"body":{"action":"upload"},"attempts":1,"next_attempt":0}`,
+		ts.URL)
+	err = ioutil.WriteFile(filepath.Join(queueDir, "pending.json"), []byte(pendingEvent), os.ModePerm)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(queueDir, "invalid.json"), []byte("{"), os.ModePerm)
+	assert.NoError(t, err)
+	httpConfig.Initialize(configDir)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&requests) == 1
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(queueDir, "pending.json"))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	err = os.RemoveAll(queueDir)
+	assert.NoError(t, err)
+	httpConfig = httpclient.Config{
+		Timeout: 5,
+	}
+	httpConfig.Initialize(configDir)
+	Config.Actions = actionsCopy
+}
+
 func TestActionCMD(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
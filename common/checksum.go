@@ -0,0 +1,192 @@
+package common
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// ChecksumSidecarSuffix is the suffix for the sidecar files containing the expected
+// SHA-256 checksum for an upload. The sidecar for "file.zip" is "file.zip.sha256"
+const ChecksumSidecarSuffix = ".sha256"
+
+// ErrChecksumMismatch is returned if the checksum of an uploaded file does not match the expected one
+var ErrChecksumMismatch = errors.New("the uploaded file checksum does not match the expected one")
+
+// uploadChecksum computes the checksum while the file is uploaded.
+// The checksum can be computed on the fly only if the file is written sequentially,
+// otherwise it is computed reading back the uploaded file
+type uploadChecksum struct {
+	sync.Mutex
+	expected   string
+	hasher     hash.Hash
+	offset     int64
+	sequential bool
+}
+
+// ParseSHA256Checksum validates the given SHA-256 checksum as hex string and returns it lower cased
+func ParseSHA256Checksum(checksum string) (string, error) {
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	decoded, err := hex.DecodeString(checksum)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 checksum %#v", checksum)
+	}
+	return checksum, nil
+}
+
+// SetExpectedChecksum sets the expected SHA-256 checksum, as hex string, for an upload.
+// The upload fails and the file is deleted if the checksum does not match
+func (t *BaseTransfer) SetExpectedChecksum(checksum string) error {
+	if t.transferType != TransferUpload {
+		return errors.New("checksum verification is only supported for uploads")
+	}
+	expected, err := ParseSHA256Checksum(checksum)
+	if err != nil {
+		return err
+	}
+	t.checksum = &uploadChecksum{
+		expected:   expected,
+		hasher:     sha256.New(),
+		sequential: t.MinWriteOffset == 0,
+	}
+	t.Connection.Log(logger.LevelDebug, "expected SHA-256 checksum for upload %#v: %v", t.requestPath, expected)
+	return nil
+}
+
+// UpdateChecksum adds the bytes written at the specified offset to the upload checksum, if any
+func (t *BaseTransfer) UpdateChecksum(p []byte, off int64) {
+	if t.checksum == nil {
+		return
+	}
+	t.checksum.Lock()
+	defer t.checksum.Unlock()
+
+	if !t.checksum.sequential {
+		return
+	}
+	if off != t.checksum.offset {
+		t.checksum.sequential = false
+		return
+	}
+	t.checksum.hasher.Write(p) //nolint:errcheck
+	t.checksum.offset += int64(len(p))
+}
+
+// loadSidecarChecksum reads the expected checksum from the sidecar file, if any
+func (t *BaseTransfer) loadSidecarChecksum() {
+	if !Config.UploadChecksumSidecar || t.Fs == nil || strings.HasSuffix(t.requestPath, ChecksumSidecarSuffix) {
+		return
+	}
+	sidecarPath, err := t.Fs.ResolvePath(t.requestPath + ChecksumSidecarSuffix)
+	if err != nil {
+		return
+	}
+	info, err := t.Fs.Stat(sidecarPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	checksum, err := readChecksumSidecar(t.Fs, sidecarPath)
+	if err == nil {
+		err = t.SetExpectedChecksum(checksum)
+	}
+	if err != nil {
+		t.Connection.Log(logger.LevelWarn, "unable to load the checksum sidecar for upload %#v: %v", t.requestPath, err)
+	}
+}
+
+// verifyChecksum returns ErrChecksumMismatch if the uploaded file, stored at fsPath,
+// does not match the expected checksum
+func (t *BaseTransfer) verifyChecksum(fsPath string) error {
+	if t.checksum == nil {
+		return nil
+	}
+	t.checksum.Lock()
+	defer t.checksum.Unlock()
+
+	var actual string
+	if t.checksum.sequential {
+		actual = hex.EncodeToString(t.checksum.hasher.Sum(nil))
+	} else {
+		// the file was not written sequentially or the upload was resumed
+		var err error
+		actual, err = GetFileSHA256(t.Fs, fsPath)
+		if err != nil {
+			t.Connection.Log(logger.LevelWarn, "unable to compute the checksum for upload %#v: %v", t.requestPath, err)
+			return ErrChecksumMismatch
+		}
+	}
+	if actual != t.checksum.expected {
+		t.Connection.Log(logger.LevelWarn, "checksum mismatch for upload %#v, expected: %v, actual: %v",
+			t.requestPath, t.checksum.expected, actual)
+		return ErrChecksumMismatch
+	}
+	t.Connection.Log(logger.LevelDebug, "checksum verified for upload %#v", t.requestPath)
+	return nil
+}
+
+// GetFileSHA256 returns the SHA-256 checksum, as hex string, for the file at fsPath
+func GetFileSHA256(fs vfs.Fs, fsPath string) (string, error) {
+	reader, closeFn, err := openFileForReading(fs, fsPath)
+	if err != nil {
+		return "", err
+	}
+	defer closeFn()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// readChecksumSidecar reads the checksum from a sidecar file. The first word is used,
+// so the sha256sum output format is supported
+func readChecksumSidecar(fs vfs.Fs, fsPath string) (string, error) {
+	reader, closeFn, err := openFileForReading(fs, fsPath)
+	if err != nil {
+		return "", err
+	}
+	defer closeFn()
+
+	line, err := bufio.NewReader(io.LimitReader(reader, 4096)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", errors.New("the checksum sidecar is empty")
+	}
+	return fields[0], nil
+}
+
+// openFileForReading opens the file at fsPath for sequential reading, the returned
+// function must be called to release the resources
+func openFileForReading(fs vfs.Fs, fsPath string) (io.Reader, func(), error) {
+	file, r, cancelFn, err := fs.Open(fsPath, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	closeFn := func() {
+		if file != nil {
+			file.Close()
+		} else {
+			r.Close()
+		}
+		if cancelFn != nil {
+			cancelFn()
+		}
+	}
+	if file != nil {
+		return file, closeFn, nil
+	}
+	return r, closeFn, nil
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 // constants
@@ -45,6 +46,7 @@ const (
 	operationPreDelete       = "pre-delete"
 	operationRename          = "rename"
 	operationSSHCmd          = "ssh_cmd"
+	operationQuarantine      = "quarantine"
 	chtimesFormat            = "2006-01-02T15:04:05" // YYYY-MM-DDTHH:MM:SS
 	idleTimeoutCheckInterval = 3 * time.Minute
 )
@@ -79,17 +81,35 @@ const (
 	UploadModeAtomicWithResume
 )
 
+// Symlinks modes
+const (
+	SymlinksModeAsLink = iota
+	SymlinksModeAsTarget
+)
+
 // errors definitions
 var (
-	ErrPermissionDenied     = errors.New("permission denied")
-	ErrNotExist             = errors.New("no such file or directory")
-	ErrOpUnsupported        = errors.New("operation unsupported")
-	ErrGenericFailure       = errors.New("failure")
-	ErrQuotaExceeded        = errors.New("denying write due to space limit")
-	ErrSkipPermissionsCheck = errors.New("permission check skipped")
-	ErrConnectionDenied     = errors.New("You are not allowed to connect")
-	errNoTransfer           = errors.New("requested transfer not found")
-	errTransferMismatch     = errors.New("transfer mismatch")
+	ErrPermissionDenied       = errors.New("permission denied")
+	ErrNotExist               = errors.New("no such file or directory")
+	ErrOpUnsupported          = errors.New("operation unsupported")
+	ErrGenericFailure         = errors.New("failure")
+	ErrQuotaExceeded          = errors.New("denying write due to space limit")
+	ErrSkipPermissionsCheck   = errors.New("permission check skipped")
+	ErrConnectionDenied       = errors.New("You are not allowed to connect")
+	ErrDownloadLimitReached   = errors.New("download limit reached")
+	ErrRecursionLimit         = errors.New("recursion limit exceeded, the operation involves too many files or directories")
+	ErrTooManyOpenFiles       = errors.New("too many open files, try again later")
+	ErrTooManyUploads         = errors.New("too many concurrent uploads, try again later")
+	ErrTooManyDownloads       = errors.New("too many concurrent downloads, try again later")
+	ErrDownloadSizeExceeded   = errors.New("denying download: the file exceeds the maximum allowed download size")
+	ErrUploadDurationExceeded = errors.New("upload aborted: the maximum allowed upload duration was exceeded")
+	ErrPathSchemaMismatch     = errors.New("the path does not match the directory structure required for this folder")
+	ErrDownloadDenied         = errors.New("download denied")
+	ErrUploadRejected         = errors.New("upload rejected by the post-upload scan")
+	ErrDirectoryFilesLimit    = errors.New("denying write: the maximum number of files allowed in the directory was reached")
+	ErrInsufficientDiskSpace  = errors.New("denying write: insufficient space on the storage device")
+	errNoTransfer             = errors.New("requested transfer not found")
+	errTransferMismatch       = errors.New("transfer mismatch")
 )
 
 var (
@@ -109,9 +129,12 @@ func Initialize(c Configuration) {
 	Config = c
 	Config.idleLoginTimeout = 2 * time.Minute
 	Config.idleTimeoutAsDuration = time.Duration(Config.IdleTimeout) * time.Minute
-	if Config.IdleTimeout > 0 {
-		startIdleTimeoutTicker(idleTimeoutCheckInterval)
-	}
+	vfs.SetBackendTimeouts(Config.BackendTimeouts)
+	vfs.SetUploadIntegrityCheck(Config.UploadIntegrityCheck)
+	metrics.SetPerUserMetrics(Config.PerUserMetrics)
+	Config.DiskSpaceChecks = getValidDiskSpaceChecks(Config.DiskSpaceChecks)
+	// the ticker is always started, users can have their own idle timeout
+	startIdleTimeoutTicker(idleTimeoutCheckInterval)
 }
 
 func startIdleTimeoutTicker(duration time.Duration) {
@@ -159,6 +182,8 @@ type ActiveConnection interface {
 	GetProtocol() string
 	GetConnectionTime() time.Time
 	GetLastActivity() time.Time
+	GetIdleTimeout() time.Duration
+	IsOutsideAccessTimes(t time.Time) bool
 	GetCommand() string
 	Disconnect() error
 	AddTransfer(t ActiveTransfer)
@@ -246,7 +271,55 @@ type Configuration struct {
 	// Absolute path to an external program or an HTTP URL to invoke after a user connects
 	// and before he tries to login. It allows you to reject the connection based on the source
 	// ip address. Leave empty do disable.
-	PostConnectHook       string `json:"post_connect_hook" mapstructure:"post_connect_hook"`
+	PostConnectHook string `json:"post_connect_hook" mapstructure:"post_connect_hook"`
+	// SymlinksMode defines how symlinks are reported in directory listings.
+	// 0 means symlinks are reported as links.
+	// 1 means symlinks are reported using the type, size and times of their target.
+	// Dangling symlinks, symlinks pointing outside the user home and symlinks pointing
+	// to the listed directory or to one of its parents are always reported as links,
+	// this way recursive clients cannot loop endlessly.
+	// This setting applies to the local filesystem only
+	SymlinksMode int `json:"symlinks_mode" mapstructure:"symlinks_mode"`
+	// BackendTimeouts defines the timeouts for Cloud Storage backends operations
+	BackendTimeouts vfs.BackendTimeouts `json:"backend_timeouts" mapstructure:"backend_timeouts"`
+	// UploadIntegrityCheck enables the post-upload integrity check for Cloud Storage backends.
+	// The hash computed while uploading is compared with the one reported by the backend
+	// and the upload fails, and the object is removed, if they don't match
+	UploadIntegrityCheck bool `json:"upload_integrity_check" mapstructure:"upload_integrity_check"`
+	// MaxOpenFiles defines the maximum number of files that can be open at the same time
+	// within a single session. It can be overridden per user. 0 means unlimited
+	MaxOpenFiles int `json:"max_open_files" mapstructure:"max_open_files"`
+	// Absolute path to an external program or an HTTP URL to invoke before a download starts.
+	// The download is allowed only if the hook allows it. Leave empty to disable
+	PreDownloadHook string `json:"pre_download_hook" mapstructure:"pre_download_hook"`
+	// Maximum time, as seconds, allowed for the pre-download hook. 0 means the default, 30 seconds
+	PreDownloadHookTimeout int `json:"pre_download_hook_timeout" mapstructure:"pre_download_hook_timeout"`
+	// By default a download is denied if the pre-download hook fails, for example on timeout,
+	// set to true to allow it
+	PreDownloadHookAllowOnFailure bool `json:"pre_download_hook_allow_on_failure" mapstructure:"pre_download_hook_allow_on_failure"`
+	// Absolute path to an external program or an HTTP URL to invoke synchronously after each
+	// completed upload, for example to scan the uploaded file for viruses. Files that the hook
+	// does not accept are moved to PostUploadScanQuarantine or deleted. Leave empty to disable
+	PostUploadScanHook string `json:"post_upload_scan_hook" mapstructure:"post_upload_scan_hook"`
+	// Maximum time, as seconds, allowed for the post-upload scan hook. 0 means the default, 60 seconds
+	PostUploadScanHookTimeout int `json:"post_upload_scan_hook_timeout" mapstructure:"post_upload_scan_hook_timeout"`
+	// By default an uploaded file is rejected if the post-upload scan hook fails, for example on
+	// timeout, set to true to accept it
+	PostUploadScanAllowOnFailure bool `json:"post_upload_scan_allow_on_failure" mapstructure:"post_upload_scan_allow_on_failure"`
+	// Where to move the rejected files. For local filesystems and SFTP backends this is an absolute
+	// path, for Cloud Storage backends this is a prefix inside the user's bucket or container.
+	// Empty means that the rejected files are deleted
+	PostUploadScanQuarantine string `json:"post_upload_scan_quarantine" mapstructure:"post_upload_scan_quarantine"`
+	// If enabled, the expected SHA-256 checksum for an upload is read from a sidecar file, if any,
+	// with the same name as the uploaded file and the ".sha256" suffix. The sidecar must be
+	// uploaded before the file. Uploads that don't match the checksum are rejected and deleted
+	UploadChecksumSidecar bool `json:"upload_checksum_sidecar" mapstructure:"upload_checksum_sidecar"`
+	// PerUserMetrics enables the Prometheus metrics labeled by username.
+	// Each user adds new time series so this is disabled by default
+	PerUserMetrics bool `json:"per_user_metrics" mapstructure:"per_user_metrics"`
+	// Free disk space checks for the uploads to the local filesystem. An upload to a directory
+	// matching a check is denied before the transfer starts if there is not enough free space
+	DiskSpaceChecks       []DiskSpaceCheck `json:"disk_space_checks" mapstructure:"disk_space_checks"`
 	idleTimeoutAsDuration time.Duration
 	idleLoginTimeout      time.Duration
 }
@@ -289,6 +362,17 @@ func (c *Configuration) GetProxyListener(listener net.Listener) (*proxyproto.Lis
 	return proxyListener, nil
 }
 
+// GetUsernameForLoginMetrics returns the username to use for the per-user login metrics.
+// An empty username is returned if the user does not exist, this way login attempts
+// using random usernames cannot add new time series
+func GetUsernameForLoginMetrics(username string, err error) string {
+	var errNotFound *dataprovider.RecordNotFoundError
+	if errors.As(err, &errNotFound) {
+		return ""
+	}
+	return username
+}
+
 // ExecutePostConnectHook executes the post connect hook if defined
 func (c *Configuration) ExecutePostConnectHook(remoteAddr, protocol string) error {
 	if len(c.PostConnectHook) == 0 {
@@ -398,6 +482,33 @@ func (conns *ActiveConnections) GetActiveSessions(username string) int {
 	return numSessions
 }
 
+// getActiveTransfers returns the number of transfers of the given type for all the
+// connections of the specified user. The transfer with the given ID, within the
+// connection with the given ID, is not counted
+func (conns *ActiveConnections) getActiveTransfers(username string, transferType int, connectionID string,
+	transferID uint64) int {
+	operationType := operationUpload
+	if transferType == TransferDownload {
+		operationType = operationDownload
+	}
+	conns.RLock()
+	defer conns.RUnlock()
+
+	numTransfers := 0
+	for _, c := range conns.connections {
+		if c.GetUsername() != username {
+			continue
+		}
+		for _, t := range c.GetTransfers() {
+			if t.OperationType != operationType || (c.GetID() == connectionID && t.ID == transferID) {
+				continue
+			}
+			numTransfers++
+		}
+	}
+	return numTransfers
+}
+
 // Add adds a new connection to the active ones
 func (conns *ActiveConnections) Add(c ActiveConnection) {
 	conns.Lock()
@@ -405,6 +516,8 @@ func (conns *ActiveConnections) Add(c ActiveConnection) {
 
 	conns.connections = append(conns.connections, c)
 	metrics.UpdateActiveConnectionsSize(len(conns.connections))
+	metrics.AddActiveConnection(c.GetProtocol(), c.GetUsername())
+	publishConnectionEvent(ConnectionEventOpen, c)
 	logger.Debug(c.GetProtocol(), c.GetID(), "connection added, num open connections: %v", len(conns.connections))
 }
 
@@ -418,6 +531,11 @@ func (conns *ActiveConnections) Swap(c ActiveConnection) error {
 
 	for idx, conn := range conns.connections {
 		if conn.GetID() == c.GetID() {
+			if conn.GetUsername() != c.GetUsername() {
+				metrics.RemoveActiveConnection(conn.GetProtocol(), conn.GetUsername())
+				metrics.AddActiveConnection(c.GetProtocol(), c.GetUsername())
+				publishConnectionEvent(ConnectionEventUpdate, c)
+			}
 			conn = nil
 			conns.connections[idx] = c
 			return nil
@@ -438,6 +556,8 @@ func (conns *ActiveConnections) Remove(connectionID string) {
 			conns.connections[lastIdx] = nil
 			conns.connections = conns.connections[:lastIdx]
 			metrics.UpdateActiveConnectionsSize(lastIdx)
+			metrics.RemoveActiveConnection(conn.GetProtocol(), conn.GetUsername())
+			publishConnectionEvent(ConnectionEventClose, conn)
 			logger.Debug(conn.GetProtocol(), conn.GetID(), "connection removed, num open connections: %v", lastIdx)
 			return
 		}
@@ -498,7 +618,7 @@ func (conns *ActiveConnections) checkIdles() {
 
 	for _, sshConn := range conns.sshConnections {
 		idleTime := time.Since(sshConn.GetLastActivity())
-		if idleTime > Config.idleTimeoutAsDuration {
+		if Config.idleTimeoutAsDuration > 0 && idleTime > Config.idleTimeoutAsDuration {
 			// we close the an ssh connection if it has no active connections associated
 			idToMatch := fmt.Sprintf("_%v_", sshConn.GetID())
 			toClose := true
@@ -520,13 +640,15 @@ func (conns *ActiveConnections) checkIdles() {
 
 	for _, c := range conns.connections {
 		idleTime := time.Since(c.GetLastActivity())
+		idleTimeout := c.GetIdleTimeout()
 		isUnauthenticatedFTPUser := (c.GetProtocol() == ProtocolFTP && len(c.GetUsername()) == 0)
 
-		if idleTime > Config.idleTimeoutAsDuration || (isUnauthenticatedFTPUser && idleTime > Config.idleLoginTimeout) {
+		if (idleTimeout > 0 && idleTime > idleTimeout) ||
+			(isUnauthenticatedFTPUser && Config.idleTimeoutAsDuration > 0 && idleTime > Config.idleLoginTimeout) {
 			defer func(conn ActiveConnection, isFTPNoAuth bool) {
 				err := conn.Disconnect()
-				logger.Debug(conn.GetProtocol(), conn.GetID(), "close idle connection, idle time: %v, username: %#v close err: %v",
-					time.Since(conn.GetLastActivity()), conn.GetUsername(), err)
+				logger.Info(conn.GetProtocol(), conn.GetID(), "close idle connection, reason: idle timeout %v exceeded, idle time: %v, username: %#v close err: %v",
+					idleTimeout, time.Since(conn.GetLastActivity()), conn.GetUsername(), err)
 				if isFTPNoAuth {
 					ip := utils.GetIPFromRemoteAddress(c.GetRemoteAddress())
 					logger.ConnectionFailedLog("", ip, dataprovider.LoginMethodNoAuthTryed, c.GetProtocol(), "client idle")
@@ -535,6 +657,12 @@ func (conns *ActiveConnections) checkIdles() {
 						dataprovider.ErrNoAuthTryed)
 				}
 			}(c, isUnauthenticatedFTPUser)
+		} else if c.IsOutsideAccessTimes(time.Now()) {
+			defer func(conn ActiveConnection) {
+				err := conn.Disconnect()
+				logger.Info(conn.GetProtocol(), conn.GetID(), "close connection, reason: outside the allowed access times, username: %#v close err: %v",
+					conn.GetUsername(), err)
+			}(c)
 		}
 	}
 
@@ -559,6 +687,7 @@ func (conns *ActiveConnections) GetStats() []ConnectionStatus {
 			Command:        c.GetCommand(),
 			Transfers:      c.GetTransfers(),
 		}
+		stat.OpenFiles = len(stat.Transfers)
 		stats = append(stats, stat)
 	}
 	return stats
@@ -582,6 +711,8 @@ type ConnectionStatus struct {
 	Protocol string `json:"protocol"`
 	// active uploads/downloads
 	Transfers []ConnectionTransfer `json:"active_transfers,omitempty"`
+	// number of files currently open within this session
+	OpenFiles int `json:"open_files"`
 	// SSH command or WebDAV method
 	Command string `json:"command,omitempty"`
 }
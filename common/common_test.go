@@ -1,11 +1,16 @@
 package common
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync/atomic"
@@ -303,6 +308,93 @@ func TestIdleConnections(t *testing.T) {
 	Config = configCopy
 }
 
+func TestUserIdleTimeout(t *testing.T) {
+	configCopy := Config
+
+	Config.IdleTimeout = 0
+	Initialize(Config)
+
+	user := dataprovider.User{
+		Username: "idle_user",
+	}
+	user.Filters.IdleTimeout = 1
+	c1 := NewBaseConnection("idle_id1", ProtocolSFTP, user, nil)
+	assert.Equal(t, time.Minute, c1.GetIdleTimeout())
+	c1.lastActivity = time.Now().Add(-2 * time.Minute).UnixNano()
+	c2 := NewBaseConnection("idle_id2", ProtocolSFTP, dataprovider.User{Username: "service_user"}, nil)
+	assert.Equal(t, time.Duration(0), c2.GetIdleTimeout())
+	c2.lastActivity = c1.lastActivity
+	Connections.Add(&fakeConnection{
+		BaseConnection: c1,
+	})
+	Connections.Add(&fakeConnection{
+		BaseConnection: c2,
+	})
+	assert.Len(t, Connections.GetStats(), 2)
+
+	startIdleTimeoutTicker(100 * time.Millisecond)
+	assert.Eventually(t, func() bool { return len(Connections.GetStats()) == 1 }, 1*time.Second, 200*time.Millisecond)
+	stopIdleTimeoutTicker()
+	stats := Connections.GetStats()
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, c2.GetID(), stats[0].ConnectionID)
+	}
+	// the user setting overrides the global one
+	Config.IdleTimeout = 10
+	Initialize(Config)
+	assert.Equal(t, time.Minute, c1.GetIdleTimeout())
+	assert.Equal(t, 10*time.Minute, c2.GetIdleTimeout())
+	Connections.Remove(c2.GetID())
+	assert.Len(t, Connections.GetStats(), 0)
+
+	Config = configCopy
+	Initialize(Config)
+}
+
+func TestAccessTimesDisconnect(t *testing.T) {
+	now := time.Now()
+	otherDay := (int(now.Weekday()) + 1) % 7
+	user := dataprovider.User{
+		Username: "access_times_user",
+	}
+	user.Filters.AccessTimes = []dataprovider.AccessTimeFilter{
+		{
+			WeekDays: []int{otherDay},
+			Start:    "00:00",
+			End:      "24:00",
+		},
+	}
+	c1 := NewBaseConnection("access_id1", ProtocolSFTP, user, nil)
+	assert.False(t, c1.IsOutsideAccessTimes(now))
+	user.Filters.DisconnectOutsideAccessTimes = true
+	c2 := NewBaseConnection("access_id2", ProtocolFTP, user, nil)
+	assert.True(t, c2.IsOutsideAccessTimes(now))
+	user.Filters.AccessTimes = append(user.Filters.AccessTimes, dataprovider.AccessTimeFilter{
+		Start:    "00:00",
+		End:      "24:00",
+		TimeZone: "UTC",
+	})
+	c3 := NewBaseConnection("access_id3", ProtocolWebDAV, user, nil)
+	assert.False(t, c3.IsOutsideAccessTimes(now))
+	for _, c := range []*BaseConnection{c1, c2, c3} {
+		Connections.Add(&fakeConnection{
+			BaseConnection: c,
+		})
+	}
+	assert.Len(t, Connections.GetStats(), 3)
+
+	startIdleTimeoutTicker(100 * time.Millisecond)
+	assert.Eventually(t, func() bool { return len(Connections.GetStats()) == 2 }, 1*time.Second, 200*time.Millisecond)
+	stopIdleTimeoutTicker()
+	for _, stat := range Connections.GetStats() {
+		assert.NotEqual(t, c2.GetID(), stat.ConnectionID)
+	}
+	Connections.Remove(c1.GetID())
+	Connections.Remove(c3.GetID())
+	assert.Len(t, Connections.GetStats(), 0)
+	startIdleTimeoutTicker(idleTimeoutCheckInterval)
+}
+
 func TestCloseConnection(t *testing.T) {
 	c := NewBaseConnection("id", ProtocolSFTP, dataprovider.User{}, nil)
 	fakeConn := &fakeConnection{
@@ -345,6 +437,82 @@ func TestSwapConnection(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestConnectionEvents(t *testing.T) {
+	receiveEvent := func(s *ConnectionEventsSubscription) *ConnectionEvent {
+		select {
+		case ev := <-s.Events():
+			return ev
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	user := dataprovider.User{
+		Username: userTestUsername,
+	}
+	fs := vfs.NewOsFs("", os.TempDir(), nil)
+	subscription := SubscribeConnectionEvents(ConnectionEventsFilter{Username: userTestUsername}, 0)
+	protocolSubscription := SubscribeConnectionEvents(ConnectionEventsFilter{Protocol: ProtocolFTP}, 0)
+	defer UnsubscribeConnectionEvents(protocolSubscription)
+
+	c := NewBaseConnection("id", ProtocolSFTP, user, fs)
+	fakeConn := &fakeConnection{
+		BaseConnection: c,
+	}
+	Connections.Add(fakeConn)
+	ev := receiveEvent(subscription)
+	if assert.NotNil(t, ev) {
+		assert.Equal(t, ConnectionEventOpen, ev.Event)
+		assert.Equal(t, c.GetID(), ev.ConnectionID)
+		assert.Equal(t, ProtocolSFTP, ev.Protocol)
+		assert.Greater(t, ev.ID, uint64(0))
+		assert.Greater(t, ev.Timestamp, int64(0))
+	}
+	transfer := NewBaseTransfer(nil, c, nil, "/p", "/r", TransferDownload, 0, 0, 0, false, fs)
+	ev = receiveEvent(subscription)
+	if assert.NotNil(t, ev) {
+		assert.Equal(t, ConnectionEventTransferStart, ev.Event)
+		assert.Equal(t, transfer.GetID(), ev.TransferID)
+		if assert.NotNil(t, ev.Transfer) {
+			assert.Equal(t, operationDownload, ev.Transfer.OperationType)
+			assert.Equal(t, "/r", ev.Transfer.VirtualPath)
+		}
+	}
+	transfer.BytesSent = 100
+	progress := Connections.GetTransfersProgress(ConnectionEventsFilter{Username: userTestUsername})
+	if assert.Len(t, progress, 1) {
+		assert.Equal(t, ConnectionEventTransferProgress, progress[0].Event)
+		assert.Equal(t, uint64(0), progress[0].ID)
+		assert.Equal(t, int64(100), progress[0].Transfer.Size)
+	}
+	assert.Len(t, Connections.GetTransfersProgress(ConnectionEventsFilter{Protocol: ProtocolFTP}), 0)
+	transfer.TransferError(errors.New("transfer error"))
+	err := transfer.Close()
+	assert.Error(t, err)
+	ev = receiveEvent(subscription)
+	if assert.NotNil(t, ev) {
+		assert.Equal(t, ConnectionEventTransferEnd, ev.Event)
+		assert.Equal(t, "transfer error", ev.Error)
+		assert.Equal(t, int64(100), ev.Transfer.Size)
+	}
+	lastEventID := ev.ID
+	Connections.Remove(c.GetID())
+	ev = receiveEvent(subscription)
+	if assert.NotNil(t, ev) {
+		assert.Equal(t, ConnectionEventClose, ev.Event)
+	}
+	// events not matching the filter are not delivered
+	assert.Nil(t, receiveEvent(protocolSubscription))
+	UnsubscribeConnectionEvents(subscription)
+	// the events after the last received one are replayed
+	subscription = SubscribeConnectionEvents(ConnectionEventsFilter{Username: userTestUsername}, lastEventID)
+	ev = receiveEvent(subscription)
+	if assert.NotNil(t, ev) {
+		assert.Equal(t, ConnectionEventClose, ev.Event)
+	}
+	assert.Nil(t, receiveEvent(subscription))
+	UnsubscribeConnectionEvents(subscription)
+}
+
 func TestAtomicUpload(t *testing.T) {
 	configCopy := Config
 
@@ -534,3 +702,94 @@ func TestPostConnectHook(t *testing.T) {
 
 	Config.PostConnectHook = ""
 }
+
+func TestPreDownloadHook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req preDownloadRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Username != "user" || req.Path != "/file" || req.FileSize != 5 || req.IP != "127.0.0.1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/deny":
+			w.WriteHeader(http.StatusForbidden)
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/slow":
+			time.Sleep(1200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	testFile := filepath.Join(os.TempDir(), "pre_download_file")
+	err := ioutil.WriteFile(testFile, []byte("hello"), os.ModePerm)
+	assert.NoError(t, err)
+	user := dataprovider.User{
+		Username: "user",
+		HomeDir:  os.TempDir(),
+	}
+	fs := vfs.NewOsFs("", os.TempDir(), nil)
+	conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+	remoteAddr := "127.0.0.1:1234"
+
+	assert.NoError(t, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	Config.PreDownloadHook = server.URL
+	assert.NoError(t, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	assert.Equal(t, ErrDownloadDenied, conn.CheckPreDownloadHook(testFile, "/file", "10.1.1.1:1234", nil))
+	err = conn.CheckPreDownloadHook(testFile+"missing", "/file", remoteAddr, nil)
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrDownloadDenied, err)
+	Config.PreDownloadHook = server.URL + "/deny"
+	assert.Equal(t, ErrDownloadDenied, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	Config.PreDownloadHook = server.URL + "/fail"
+	assert.Equal(t, ErrDownloadDenied, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	Config.PreDownloadHookTimeout = 1
+	Config.PreDownloadHook = server.URL + "/slow"
+	assert.Equal(t, ErrDownloadDenied, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	// failures can be configured to allow the downloads, explicit denials are always respected
+	Config.PreDownloadHookAllowOnFailure = true
+	assert.NoError(t, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	Config.PreDownloadHook = server.URL + "/fail"
+	assert.NoError(t, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	Config.PreDownloadHook = "http://foo\x7f.com/"
+	assert.NoError(t, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	Config.PreDownloadHook = server.URL + "/deny"
+	assert.Equal(t, ErrDownloadDenied, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	Config.PreDownloadHookAllowOnFailure = false
+	Config.PreDownloadHook = "relative"
+	assert.Equal(t, ErrDownloadDenied, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+
+	if runtime.GOOS != osWindows {
+		hookPath := filepath.Join(os.TempDir(), "pre_download_hook.sh")
+		Config.PreDownloadHook = hookPath
+		err = ioutil.WriteFile(hookPath, []byte("#!/bin/sh\n\nif [ \"$SFTPGO_DOWNLOAD_PATH\" = \"/file\" ]; then exit 0; fi\nexit 1\n"), os.ModePerm)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+		assert.Equal(t, ErrDownloadDenied, conn.CheckPreDownloadHook(testFile, "/other", remoteAddr, nil))
+		err = ioutil.WriteFile(hookPath, []byte("#!/bin/sh\n\nsleep 2\n"), os.ModePerm)
+		assert.NoError(t, err)
+		assert.Equal(t, ErrDownloadDenied, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+		Config.PreDownloadHookAllowOnFailure = true
+		assert.NoError(t, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+		Config.PreDownloadHookAllowOnFailure = false
+		err = os.Remove(hookPath)
+		assert.NoError(t, err)
+		// the hook cannot be executed
+		assert.Equal(t, ErrDownloadDenied, conn.CheckPreDownloadHook(testFile, "/file", remoteAddr, nil))
+	}
+
+	Config.PreDownloadHook = ""
+	Config.PreDownloadHookTimeout = 0
+	err = os.Remove(testFile)
+	assert.NoError(t, err)
+}
+
+func TestGetUsernameForLoginMetrics(t *testing.T) {
+	assert.Equal(t, "user", GetUsernameForLoginMetrics("user", nil))
+	assert.Equal(t, "user", GetUsernameForLoginMetrics("user", ErrPermissionDenied))
+	_, err := dataprovider.UserExists("missing_user")
+	assert.Error(t, err)
+	assert.Equal(t, "", GetUsernameForLoginMetrics("missing_user", err))
+	assert.Equal(t, "", GetUsernameForLoginMetrics("missing_user", fmt.Errorf("login failed: %w", err)))
+}
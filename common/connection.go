@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -41,6 +42,7 @@ func NewBaseConnection(ID, protocol string, user dataprovider.User, fs vfs.Fs) *
 	if utils.IsStringInSlice(protocol, supportedProtocols) {
 		connID = fmt.Sprintf("%v_%v", protocol, ID)
 	}
+	user.Permissions = user.GetPermissionsForProtocol(getUserProtocol(protocol))
 	return &BaseConnection{
 		ID:           connID,
 		User:         user,
@@ -52,6 +54,19 @@ func NewBaseConnection(ID, protocol string, user dataprovider.User, fs vfs.Fs) *
 	}
 }
 
+// getUserProtocol returns the protocol, as defined in the user filters,
+// for the given connection protocol. SFTP, SCP and SSH commands are all
+// handled as SSH, the protocol for SSH exec requests is not yet known when
+// the connection is created
+func getUserProtocol(protocol string) string {
+	switch protocol {
+	case ProtocolFTP, ProtocolWebDAV:
+		return protocol
+	default:
+		return ProtocolSSH
+	}
+}
+
 // Log outputs a log entry to the configured logger
 func (c *BaseConnection) Log(level logger.LogLevel, format string, v ...interface{}) {
 	logger.Log(level, c.protocol, c.ID, format, v...)
@@ -100,6 +115,21 @@ func (c *BaseConnection) GetLastActivity() time.Time {
 	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
 }
 
+// GetIdleTimeout returns the idle timeout for this connection.
+// The user setting, if any, overrides the global one. 0 means disabled
+func (c *BaseConnection) GetIdleTimeout() time.Duration {
+	if c.User.Filters.IdleTimeout > 0 {
+		return time.Duration(c.User.Filters.IdleTimeout) * time.Minute
+	}
+	return Config.idleTimeoutAsDuration
+}
+
+// IsOutsideAccessTimes returns true if the connection must be closed since, at the given
+// time, it is outside the access times allowed for the user
+func (c *BaseConnection) IsOutsideAccessTimes(t time.Time) bool {
+	return c.User.Filters.DisconnectOutsideAccessTimes && !c.User.IsAccessTimeAllowed(t)
+}
+
 // AddTransfer associates a new transfer to this connection
 func (c *BaseConnection) AddTransfer(t ActiveTransfer) {
 	c.Lock()
@@ -138,25 +168,29 @@ func (c *BaseConnection) GetTransfers() []ConnectionTransfer {
 
 	transfers := make([]ConnectionTransfer, 0, len(c.activeTransfers))
 	for _, t := range c.activeTransfers {
-		var operationType string
-		switch t.GetType() {
-		case TransferDownload:
-			operationType = operationDownload
-		case TransferUpload:
-			operationType = operationUpload
-		}
-		transfers = append(transfers, ConnectionTransfer{
-			ID:            t.GetID(),
-			OperationType: operationType,
-			StartTime:     utils.GetTimeAsMsSinceEpoch(t.GetStartTime()),
-			Size:          t.GetSize(),
-			VirtualPath:   t.GetVirtualPath(),
-		})
+		transfers = append(transfers, getConnectionTransfer(t))
 	}
 
 	return transfers
 }
 
+func getConnectionTransfer(t ActiveTransfer) ConnectionTransfer {
+	var operationType string
+	switch t.GetType() {
+	case TransferDownload:
+		operationType = operationDownload
+	case TransferUpload:
+		operationType = operationUpload
+	}
+	return ConnectionTransfer{
+		ID:            t.GetID(),
+		OperationType: operationType,
+		StartTime:     utils.GetTimeAsMsSinceEpoch(t.GetStartTime()),
+		Size:          t.GetSize(),
+		VirtualPath:   t.GetVirtualPath(),
+	}
+}
+
 // SignalTransfersAbort signals to the active transfers to exit as soon as possible
 func (c *BaseConnection) SignalTransfersAbort() error {
 	c.RLock()
@@ -208,9 +242,111 @@ func (c *BaseConnection) ListDir(fsPath, virtualPath string) ([]os.FileInfo, err
 		c.Log(logger.LevelWarn, "error listing directory: %+v", err)
 		return nil, c.GetFsError(err)
 	}
+	if Config.SymlinksMode == SymlinksModeAsTarget && vfs.IsLocalOsFs(c.Fs) {
+		files = c.resolveSymlinks(files, virtualPath)
+	}
 	return c.User.AddVirtualDirs(files, virtualPath), nil
 }
 
+// ListDirPages is like ListDir but the directory entries are returned, as they are fetched
+// from the storage backend, calling fn for each page. The virtual directories are returned
+// within the first page. The listing stops if fn returns false.
+// The permissions must be checked before calling this method
+func (c *BaseConnection) ListDirPages(fsPath, virtualPath string, fn func(page []os.FileInfo) bool) error {
+	virtualDirs := c.User.AddVirtualDirs(nil, virtualPath)
+	if len(virtualDirs) > 0 && !fn(virtualDirs) {
+		return nil
+	}
+	err := vfs.ReadDirPages(c.Fs, fsPath, func(page []os.FileInfo) bool {
+		if len(virtualDirs) > 0 {
+			// virtual directories hide the entries with the same name
+			files := make([]os.FileInfo, 0, len(page))
+			for _, fi := range page {
+				if !isNameInList(fi.Name(), virtualDirs) {
+					files = append(files, fi)
+				}
+			}
+			page = files
+		}
+		if Config.SymlinksMode == SymlinksModeAsTarget && vfs.IsLocalOsFs(c.Fs) {
+			page = c.resolveSymlinks(page, virtualPath)
+		}
+		if len(page) == 0 {
+			return true
+		}
+		return fn(page)
+	})
+	if err != nil {
+		c.Log(logger.LevelWarn, "error listing directory: %+v", err)
+		return c.GetFsError(err)
+	}
+	return nil
+}
+
+func isNameInList(name string, list []os.FileInfo) bool {
+	for _, fi := range list {
+		if fi.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSymlinks replaces the symlinks inside the given list with their targets.
+// Symlinks that cannot be resolved inside the user home or that point to the listed
+// directory or to one of its parents are left untouched to break cycles
+func (c *BaseConnection) resolveSymlinks(files []os.FileInfo, virtualPath string) []os.FileInfo {
+	var visited []string
+	for idx, fi := range files {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if visited == nil {
+			visited = c.getRealPathsForParentDirs(virtualPath)
+		}
+		linkPath := path.Join(virtualPath, fi.Name())
+		fsLinkPath, err := c.Fs.ResolvePath(linkPath)
+		if err != nil {
+			c.Log(logger.LevelDebug, "unable to resolve symlink %#v: %v", linkPath, err)
+			continue
+		}
+		target, err := filepath.EvalSymlinks(fsLinkPath)
+		if err != nil {
+			c.Log(logger.LevelDebug, "unable to evaluate symlink %#v: %v", linkPath, err)
+			continue
+		}
+		if utils.IsStringInSlice(target, visited) {
+			c.Log(logger.LevelDebug, "symlink %#v points to a parent directory, it will be reported as link", linkPath)
+			continue
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			continue
+		}
+		files[idx] = &symlinkTargetInfo{
+			FileInfo: info,
+			name:     fi.Name(),
+		}
+	}
+	return files
+}
+
+func (c *BaseConnection) getRealPathsForParentDirs(virtualPath string) []string {
+	var result []string
+	for _, dir := range utils.GetDirsForSFTPPath(virtualPath) {
+		fsPath, err := c.Fs.ResolvePath(dir)
+		if err != nil {
+			continue
+		}
+		realPath, err := filepath.EvalSymlinks(fsPath)
+		if err != nil {
+			continue
+		}
+		result = append(result, realPath)
+	}
+	return result
+}
+
 // CreateDir creates a new directory at the specified fsPath
 func (c *BaseConnection) CreateDir(fsPath, virtualPath string) error {
 	if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(virtualPath)) {
@@ -220,6 +356,9 @@ func (c *BaseConnection) CreateDir(fsPath, virtualPath string) error {
 		c.Log(logger.LevelWarn, "mkdir not allowed %#v is a virtual folder", virtualPath)
 		return c.GetPermissionDeniedError()
 	}
+	if err := c.IsPathSchemaAllowed(virtualPath, true); err != nil {
+		return err
+	}
 	if err := c.Fs.Mkdir(fsPath); err != nil {
 		c.Log(logger.LevelWarn, "error creating dir: %#v error: %+v", fsPath, err)
 		return c.GetFsError(err)
@@ -232,7 +371,7 @@ func (c *BaseConnection) CreateDir(fsPath, virtualPath string) error {
 
 // IsRemoveFileAllowed returns an error if removing this file is not allowed
 func (c *BaseConnection) IsRemoveFileAllowed(fsPath, virtualPath string) error {
-	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(virtualPath)) {
+	if !c.User.HasFilePerm(dataprovider.PermDelete, virtualPath) {
 		return c.GetPermissionDeniedError()
 	}
 	if !c.User.IsFileAllowed(virtualPath) {
@@ -242,12 +381,320 @@ func (c *BaseConnection) IsRemoveFileAllowed(fsPath, virtualPath string) error {
 	return nil
 }
 
+// CheckUploadDir returns an error if the parent directory for the specified upload virtual
+// path does not exist. If automatic directory creation is enabled for the parent directory
+// the missing directories are created, the create dirs permission is required for each of them.
+// The check is done for all the filesystems so Cloud Storage backends, where a directory
+// is not required to upload a file, behave like the local one
+func (c *BaseConnection) CheckUploadDir(virtualPath string) error {
+	virtualDir := path.Dir(virtualPath)
+	if virtualDir == "/" || c.User.IsVirtualFolder(virtualDir) {
+		return nil
+	}
+	fsDir, err := c.Fs.ResolvePath(virtualDir)
+	if err != nil {
+		return c.GetFsError(err)
+	}
+	info, err := c.Fs.Stat(fsDir)
+	if err == nil {
+		if !info.IsDir() {
+			c.Log(logger.LevelWarn, "unable to upload %#v, %#v is not a directory", virtualPath, virtualDir)
+			return c.GetGenericError(nil)
+		}
+		return nil
+	}
+	if !c.Fs.IsNotExist(err) {
+		return c.GetFsError(err)
+	}
+	if !c.User.IsAutoCreateDirsEnabled(virtualDir) {
+		c.Log(logger.LevelDebug, "unable to upload %#v, directory %#v does not exist", virtualPath, virtualDir)
+		return c.GetNotExistError()
+	}
+	return c.createMissingDirs(virtualDir)
+}
+
+// checkRenameTargetDir returns a not exist error if the parent directory for the specified
+// rename target does not exist. For Cloud Storage backends a directory exists if there is
+// a placeholder object for it or at least an object inside it
+func (c *BaseConnection) checkRenameTargetDir(virtualTargetPath string) error {
+	virtualDir := path.Dir(virtualTargetPath)
+	if virtualDir == "/" || c.User.IsVirtualFolder(virtualDir) {
+		return nil
+	}
+	fsDir, err := c.Fs.ResolvePath(virtualDir)
+	if err != nil {
+		return c.GetFsError(err)
+	}
+	info, err := c.Fs.Stat(fsDir)
+	if err != nil {
+		if c.Fs.IsNotExist(err) {
+			c.Log(logger.LevelDebug, "unable to rename to %#v, directory %#v does not exist", virtualTargetPath, virtualDir)
+			return c.GetNotExistError()
+		}
+		return c.GetFsError(err)
+	}
+	if !info.IsDir() {
+		c.Log(logger.LevelWarn, "unable to rename to %#v, %#v is not a directory", virtualTargetPath, virtualDir)
+		return c.GetNotExistError()
+	}
+	return nil
+}
+
+// createMissingDirs creates the specified virtual directory and any missing parent directory
+func (c *BaseConnection) createMissingDirs(virtualDir string) error {
+	var missingDirs []string
+	for dir := virtualDir; dir != "/" && !c.User.IsVirtualFolder(dir); dir = path.Dir(dir) {
+		fsDir, err := c.Fs.ResolvePath(dir)
+		if err != nil {
+			return c.GetFsError(err)
+		}
+		info, err := c.Fs.Stat(fsDir)
+		if err == nil {
+			if !info.IsDir() {
+				c.Log(logger.LevelWarn, "unable to create missing dirs for %#v, %#v is not a directory", virtualDir, dir)
+				return c.GetGenericError(nil)
+			}
+			break
+		}
+		if !c.Fs.IsNotExist(err) {
+			return c.GetFsError(err)
+		}
+		missingDirs = append(missingDirs, dir)
+	}
+	for idx := len(missingDirs) - 1; idx >= 0; idx-- {
+		fsDir, err := c.Fs.ResolvePath(missingDirs[idx])
+		if err != nil {
+			return c.GetFsError(err)
+		}
+		if err = c.CreateDir(fsDir, missingDirs[idx]); err != nil {
+			return err
+		}
+		c.Log(logger.LevelDebug, "missing directory %#v created for upload", missingDirs[idx])
+	}
+	return nil
+}
+
+// IsUploadOrderAllowed returns an error if the upload order rule defined for the
+// parent directory of the specified virtual path does not allow this upload.
+// A directory is locked once its sentinel file is present, the sentinel file
+// can be uploaded only after all the required files are present
+func (c *BaseConnection) IsUploadOrderAllowed(virtualPath string) error {
+	virtualDir := path.Dir(virtualPath)
+	filter, ok := c.User.GetUploadOrderFilter(virtualDir)
+	if !ok {
+		return nil
+	}
+	fileName := path.Base(virtualPath)
+	if fileName == filter.SentinelFile {
+		for _, name := range filter.RequiredFiles {
+			exists, err := c.isUploadOrderFilePresent(path.Join(virtualDir, name))
+			if err != nil {
+				return err
+			}
+			if !exists {
+				c.Log(logger.LevelInfo, "upload of sentinel file %#v denied, required file %#v is missing",
+					virtualPath, name)
+				return c.GetPermissionDeniedError()
+			}
+		}
+		return nil
+	}
+	locked, err := c.isUploadOrderFilePresent(path.Join(virtualDir, filter.SentinelFile))
+	if err != nil {
+		return err
+	}
+	if locked {
+		c.Log(logger.LevelInfo, "upload of %#v denied, directory %#v is locked by the sentinel file %#v",
+			virtualPath, virtualDir, filter.SentinelFile)
+		return c.GetPermissionDeniedError()
+	}
+	return nil
+}
+
+// IsWriteModeAllowed returns an error if the write mode filters do not allow to open
+// the existing file with the specified virtual path using the requested mode.
+// isAppend must be true if the existing data will be preserved
+func (c *BaseConnection) IsWriteModeAllowed(virtualPath string, isAppend bool) error {
+	switch c.User.GetWriteMode(virtualPath) {
+	case dataprovider.WriteModeAppendOnly:
+		if !isAppend {
+			c.Log(logger.LevelInfo, "overwriting file %#v denied, the file is append-only", virtualPath)
+			return c.GetPermissionDeniedError()
+		}
+	case dataprovider.WriteModeOverwriteOnly:
+		if isAppend {
+			c.Log(logger.LevelInfo, "appending to file %#v denied, the file is overwrite-only", virtualPath)
+			return c.GetPermissionDeniedError()
+		}
+	}
+	return nil
+}
+
+// IsPathSchemaAllowed returns an error if the specified virtual path, to create, does not
+// match the path schema defined for its parent directories. isDir must be true for directories
+func (c *BaseConnection) IsPathSchemaAllowed(virtualPath string, isDir bool) error {
+	if err := c.User.CheckPathSchema(virtualPath, isDir); err != nil {
+		c.Log(logger.LevelInfo, "path schema check failed: %v", err)
+		return c.GetGenericError(ErrPathSchemaMismatch)
+	}
+	return nil
+}
+
+// CheckDirectoryFilesLimit returns an error if a new file cannot be created at the specified
+// virtual path since its parent directory already contains the maximum allowed number of files.
+// Overwriting an existing file is always allowed
+func (c *BaseConnection) CheckDirectoryFilesLimit(virtualPath string) error {
+	virtualDir := path.Dir(virtualPath)
+	maxFiles := c.User.GetDirectoryFilesLimit(virtualDir)
+	if maxFiles == 0 {
+		return nil
+	}
+	fsPath, err := c.Fs.ResolvePath(virtualPath)
+	if err != nil {
+		return c.GetFsError(err)
+	}
+	if _, err := c.Fs.Lstat(fsPath); err == nil {
+		return nil
+	}
+	fsDirPath, err := c.Fs.ResolvePath(virtualDir)
+	if err != nil {
+		return c.GetFsError(err)
+	}
+	numFiles, err := c.countDirectoryFiles(fsDirPath, maxFiles)
+	if err != nil {
+		return err
+	}
+	if numFiles >= maxFiles {
+		c.Log(logger.LevelInfo, "denying write to %#v, the directory %#v already contains %v files, max allowed: %v",
+			virtualPath, virtualDir, numFiles, maxFiles)
+		return c.GetGenericError(ErrDirectoryFilesLimit)
+	}
+	return nil
+}
+
+// checkRenameDirectoryFilesLimit checks the files limit for the rename target directory.
+// Renaming a file inside the same directory does not change the number of files.
+// For directories the files directly inside the renamed directory are checked against
+// the limit defined for the target path
+func (c *BaseConnection) checkRenameDirectoryFilesLimit(fsSourcePath, virtualSourcePath, virtualTargetPath string,
+	srcInfo os.FileInfo) error {
+	if !srcInfo.IsDir() {
+		if path.Dir(virtualSourcePath) == path.Dir(virtualTargetPath) {
+			return nil
+		}
+		return c.CheckDirectoryFilesLimit(virtualTargetPath)
+	}
+	maxFiles := c.User.GetDirectoryFilesLimit(virtualTargetPath)
+	if maxFiles == 0 {
+		return nil
+	}
+	numFiles, err := c.countDirectoryFiles(fsSourcePath, maxFiles+1)
+	if err != nil {
+		return err
+	}
+	if numFiles > maxFiles {
+		c.Log(logger.LevelInfo, "denying rename of %#v to %#v, the directory contains more than %v files",
+			virtualSourcePath, virtualTargetPath, maxFiles)
+		return c.GetGenericError(ErrDirectoryFilesLimit)
+	}
+	return nil
+}
+
+// countDirectoryFiles returns the number of files, directories are not counted, directly
+// inside the specified directory. The listing stops as soon as limit files are found
+func (c *BaseConnection) countDirectoryFiles(fsDirPath string, limit int) (int, error) {
+	numFiles := 0
+	err := vfs.ReadDirPages(c.Fs, fsDirPath, func(page []os.FileInfo) bool {
+		for _, fi := range page {
+			if !fi.IsDir() {
+				numFiles++
+			}
+		}
+		return numFiles < limit
+	})
+	if err != nil {
+		if c.Fs.IsNotExist(err) {
+			return 0, nil
+		}
+		c.Log(logger.LevelWarn, "unable to list %#v to check the directory files limit: %v", fsDirPath, err)
+		return 0, c.GetFsError(err)
+	}
+	return numFiles, nil
+}
+
+func (c *BaseConnection) isUploadOrderFilePresent(virtualPath string) (bool, error) {
+	fsPath, err := c.Fs.ResolvePath(virtualPath)
+	if err != nil {
+		return false, c.GetFsError(err)
+	}
+	info, err := c.Fs.Stat(fsPath)
+	if err != nil {
+		if c.Fs.IsNotExist(err) {
+			return false, nil
+		}
+		c.Log(logger.LevelWarn, "unable to stat %#v to check the upload order: %v", fsPath, err)
+		return false, c.GetFsError(err)
+	}
+	return info.Mode().IsRegular(), nil
+}
+
+// checkRenameUploadOrder returns an error if the rename does not respect the upload order
+// rules. A file moved inside a directory is handled as an upload. A moved directory
+// cannot overwrite an existing one, so the directories created by the move are not
+// locked: the moved contents must be a valid state, this means that a sentinel file
+// can be moved only together with all the required files
+func (c *BaseConnection) checkRenameUploadOrder(virtualSourcePath, virtualTargetPath string, srcInfo os.FileInfo) error {
+	if len(c.User.Filters.UploadOrder) == 0 {
+		return nil
+	}
+	if !srcInfo.IsDir() {
+		if !srcInfo.Mode().IsRegular() {
+			return nil
+		}
+		virtualDir := path.Dir(virtualTargetPath)
+		if filter, ok := c.User.GetUploadOrderFilter(virtualDir); ok && path.Dir(virtualSourcePath) == virtualDir &&
+			path.Base(virtualTargetPath) == filter.SentinelFile &&
+			utils.IsStringInSlice(path.Base(virtualSourcePath), filter.RequiredFiles) {
+			c.Log(logger.LevelInfo, "rename %#v -> %#v denied, the required file would be missing", virtualSourcePath,
+				virtualTargetPath)
+			return c.GetPermissionDeniedError()
+		}
+		return c.IsUploadOrderAllowed(virtualTargetPath)
+	}
+	for _, filter := range c.User.Filters.UploadOrder {
+		if filter.Path != virtualTargetPath && !strings.HasPrefix(filter.Path, virtualTargetPath+"/") {
+			continue
+		}
+		sourceDir := path.Join(virtualSourcePath, strings.TrimPrefix(filter.Path, virtualTargetPath))
+		hasSentinel, err := c.isUploadOrderFilePresent(path.Join(sourceDir, filter.SentinelFile))
+		if err != nil {
+			return err
+		}
+		if !hasSentinel {
+			continue
+		}
+		for _, name := range filter.RequiredFiles {
+			exists, err := c.isUploadOrderFilePresent(path.Join(sourceDir, name))
+			if err != nil {
+				return err
+			}
+			if !exists {
+				c.Log(logger.LevelInfo, "rename %#v -> %#v denied, the sentinel file for %#v would be moved without "+
+					"the required file %#v", virtualSourcePath, virtualTargetPath, filter.Path, name)
+				return c.GetPermissionDeniedError()
+			}
+		}
+	}
+	return nil
+}
+
 // RemoveFile removes a file at the specified fsPath
 func (c *BaseConnection) RemoveFile(fsPath, virtualPath string, info os.FileInfo) error {
 	if err := c.IsRemoveFileAllowed(fsPath, virtualPath); err != nil {
 		return err
 	}
 	size := info.Size()
+	quotaSize := vfs.GetSizeForQuota(info)
 	action := newActionNotification(&c.User, operationPreDelete, fsPath, "", "", c.protocol, size, nil)
 	actionErr := actionHandler.Handle(action)
 	if actionErr == nil {
@@ -263,12 +710,12 @@ func (c *BaseConnection) RemoveFile(fsPath, virtualPath string, info os.FileInfo
 	if info.Mode()&os.ModeSymlink == 0 {
 		vfolder, err := c.User.GetVirtualFolderForPath(path.Dir(virtualPath))
 		if err == nil {
-			dataprovider.UpdateVirtualFolderQuota(vfolder.BaseVirtualFolder, -1, -size, false) //nolint:errcheck
+			dataprovider.UpdateVirtualFolderQuota(vfolder.BaseVirtualFolder, -1, -quotaSize, false) //nolint:errcheck
 			if vfolder.IsIncludedInUserQuota() {
-				dataprovider.UpdateUserQuota(c.User, -1, -size, false) //nolint:errcheck
+				dataprovider.UpdateUserQuota(c.User, -1, -quotaSize, false) //nolint:errcheck
 			}
 		} else {
-			dataprovider.UpdateUserQuota(c.User, -1, -size, false) //nolint:errcheck
+			dataprovider.UpdateUserQuota(c.User, -1, -quotaSize, false) //nolint:errcheck
 		}
 	}
 	if actionErr != nil {
@@ -349,6 +796,20 @@ func (c *BaseConnection) Rename(fsSourcePath, fsTargetPath, virtualSourcePath, v
 	if !c.isRenamePermitted(fsSourcePath, virtualSourcePath, virtualTargetPath, srcInfo) {
 		return c.GetPermissionDeniedError()
 	}
+	if err := c.IsPathSchemaAllowed(virtualTargetPath, srcInfo.IsDir()); err != nil {
+		return err
+	}
+	if err := c.checkRenameDirectoryFilesLimit(fsSourcePath, virtualSourcePath, virtualTargetPath, srcInfo); err != nil {
+		return err
+	}
+	if c.User.Filters.RequireRenameTargetDir {
+		if err := c.checkRenameTargetDir(virtualTargetPath); err != nil {
+			return err
+		}
+	}
+	if err := c.checkRenameUploadOrder(virtualSourcePath, virtualTargetPath, srcInfo); err != nil {
+		return err
+	}
 	initialSize := int64(-1)
 	if dstInfo, err := c.Fs.Lstat(fsTargetPath); err == nil {
 		if dstInfo.IsDir() {
@@ -358,9 +819,9 @@ func (c *BaseConnection) Rename(fsSourcePath, fsTargetPath, virtualSourcePath, v
 		}
 		// we are overwriting an existing file/symlink
 		if dstInfo.Mode().IsRegular() {
-			initialSize = dstInfo.Size()
+			initialSize = vfs.GetSizeForQuota(dstInfo)
 		}
-		if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(virtualTargetPath)) {
+		if !c.User.HasFilePerm(dataprovider.PermOverwrite, virtualTargetPath) {
 			c.Log(logger.LevelDebug, "renaming is not allowed, %#v -> %#v. Target exists but the user "+
 				"has no overwrite permission", virtualSourcePath, virtualTargetPath)
 			return c.GetPermissionDeniedError()
@@ -410,6 +871,12 @@ func (c *BaseConnection) CreateSymlink(fsSourcePath, fsTargetPath, virtualSource
 	if !c.User.HasPerm(dataprovider.PermCreateSymlinks, path.Dir(virtualTargetPath)) {
 		return c.GetPermissionDeniedError()
 	}
+	if err := c.IsPathSchemaAllowed(virtualTargetPath, false); err != nil {
+		return err
+	}
+	if err := c.CheckDirectoryFilesLimit(virtualTargetPath); err != nil {
+		return err
+	}
 	if c.isCrossFoldersRequest(virtualSourcePath, virtualTargetPath) {
 		c.Log(logger.LevelWarn, "cross folder symlink is not supported, src: %v dst: %v", virtualSourcePath, virtualTargetPath)
 		return c.GetOpUnsupportedError()
@@ -530,6 +997,11 @@ func (c *BaseConnection) SetStat(fsPath, virtualPath string, attributes *StatAtt
 		if !c.User.HasPerm(dataprovider.PermOverwrite, pathForPerms) {
 			return c.GetPermissionDeniedError()
 		}
+		// append-only files cannot be truncated
+		if c.User.GetWriteMode(virtualPath) == dataprovider.WriteModeAppendOnly {
+			c.Log(logger.LevelInfo, "truncating file %#v denied, the file is append-only", virtualPath)
+			return c.GetPermissionDeniedError()
+		}
 
 		if err := c.truncateFile(fsPath, virtualPath, attributes.Size); err != nil {
 			c.Log(logger.LevelWarn, "failed to truncate path %#v, size: %v, err: %+v", fsPath, attributes.Size, err)
@@ -572,6 +1044,121 @@ func (c *BaseConnection) truncateFile(fsPath, virtualPath string, size int64) er
 	return err
 }
 
+// GetMaxOpenFiles returns the maximum number of files that can be open at the same time
+// within this session. The user setting, if any, overrides the global one. 0 means unlimited
+func (c *BaseConnection) GetMaxOpenFiles() int {
+	if c.User.Filters.MaxOpenFiles > 0 {
+		return c.User.Filters.MaxOpenFiles
+	}
+	return Config.MaxOpenFiles
+}
+
+// CheckOpenFilesLimit returns ErrTooManyOpenFiles if no other file can be opened within
+// this session. Each open file is tracked as a transfer and it is removed when the file is
+// closed, this happens for abnormal session termination too
+func (c *BaseConnection) CheckOpenFilesLimit() error {
+	maxOpenFiles := c.GetMaxOpenFiles()
+	if maxOpenFiles <= 0 {
+		return nil
+	}
+	c.RLock()
+	openFiles := len(c.activeTransfers)
+	c.RUnlock()
+
+	if openFiles >= maxOpenFiles {
+		c.Log(logger.LevelInfo, "denying file open, open files: %v, limit: %v", openFiles, maxOpenFiles)
+		return ErrTooManyOpenFiles
+	}
+	return nil
+}
+
+// CheckConcurrentTransfersLimit returns ErrTooManyUploads or ErrTooManyDownloads if the user
+// cannot start another transfer of the given type. The limits apply to the transfers of all
+// the user's sessions
+func (c *BaseConnection) CheckConcurrentTransfersLimit(transferType int) error {
+	return c.checkConcurrentTransfersLimit(transferType, 0)
+}
+
+func (c *BaseConnection) checkConcurrentTransfersLimit(transferType int, transferID uint64) error {
+	limit := c.User.Filters.MaxConcurrentUploads
+	limitErr := ErrTooManyUploads
+	if transferType == TransferDownload {
+		limit = c.User.Filters.MaxConcurrentDownloads
+		limitErr = ErrTooManyDownloads
+	}
+	if limit <= 0 {
+		return nil
+	}
+	transfers := Connections.getActiveTransfers(c.User.Username, transferType, c.GetID(), transferID)
+	if transfers >= limit {
+		c.Log(logger.LevelInfo, "denying transfer, type: %v, active transfers: %v, limit: %v", transferType,
+			transfers, limit)
+		return limitErr
+	}
+	return nil
+}
+
+// Walk walks the file tree rooted at fsPath calling walkFn for each file or directory.
+// All the recursive operations must use this method: the recursion limits defined for
+// the user are enforced here and ErrRecursionLimit is returned if they are exceeded
+func (c *BaseConnection) Walk(fsPath string, walkFn filepath.WalkFunc) error {
+	if !c.User.HasRecursionLimits() {
+		return c.Fs.Walk(fsPath, walkFn)
+	}
+	maxDepth := c.User.Filters.MaxRecursionDepth
+	maxEntries := c.User.Filters.MaxRecursionEntries
+	rootPath := c.Fs.GetRelativePath(fsPath)
+	entries := 0
+	// the Cloud Storage backends do not return the walkFn errors, so we track the limit error here
+	var limitErr error
+
+	err := c.Fs.Walk(fsPath, func(walkedPath string, info os.FileInfo, err error) error {
+		if limitErr != nil {
+			return limitErr
+		}
+		if err == nil && walkedPath != fsPath {
+			entries++
+			if maxEntries > 0 && entries > maxEntries {
+				c.Log(logger.LevelInfo, "recursion for %#v stopped, max entries %v exceeded", rootPath, maxEntries)
+				limitErr = ErrRecursionLimit
+				return limitErr
+			}
+			if maxDepth > 0 && getWalkDepth(rootPath, c.Fs.GetRelativePath(walkedPath)) > maxDepth {
+				c.Log(logger.LevelInfo, "recursion for %#v stopped, max depth %v exceeded, path %#v", rootPath,
+					maxDepth, walkedPath)
+				limitErr = ErrRecursionLimit
+				return limitErr
+			}
+		}
+		return walkFn(walkedPath, info, err)
+	})
+	if limitErr != nil {
+		return limitErr
+	}
+	return err
+}
+
+// CheckRecursionLimits returns ErrRecursionLimit if a recursive operation on the
+// directory fsPath exceeds the recursion limits defined for the user
+func (c *BaseConnection) CheckRecursionLimits(fsPath string) error {
+	if !c.User.HasRecursionLimits() {
+		return nil
+	}
+	return c.Walk(fsPath, func(walkedPath string, info os.FileInfo, err error) error {
+		return err
+	})
+}
+
+// getWalkDepth returns the depth of virtualPath relative to rootPath.
+// The direct children of rootPath have depth 1
+func getWalkDepth(rootPath, virtualPath string) int {
+	relPath := strings.Trim(strings.TrimPrefix(virtualPath, rootPath), "/")
+	if relPath == "" {
+		return 0
+	}
+	return strings.Count(relPath, "/") + 1
+}
+
 func (c *BaseConnection) checkRecursiveRenameDirPermissions(sourcePath, targetPath string) error {
 	dstPerms := []string{
 		dataprovider.PermCreateDirs,
@@ -579,7 +1166,7 @@ func (c *BaseConnection) checkRecursiveRenameDirPermissions(sourcePath, targetPa
 		dataprovider.PermCreateSymlinks,
 	}
 
-	err := c.Fs.Walk(sourcePath, func(walkedPath string, info os.FileInfo, err error) error {
+	err := c.Walk(sourcePath, func(walkedPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -594,7 +1181,7 @@ func (c *BaseConnection) checkRecursiveRenameDirPermissions(sourcePath, targetPa
 				c.User.HasPerm(dataprovider.PermRename, path.Dir(virtualDstPath)) {
 				return ErrSkipPermissionsCheck
 			}
-			if c.User.HasPerm(dataprovider.PermDelete, path.Dir(virtualSrcPath)) &&
+			if !c.User.Filters.RequireRenamePermission && c.User.HasPerm(dataprovider.PermDelete, path.Dir(virtualSrcPath)) &&
 				c.User.HasPerms(dstPerms, path.Dir(virtualDstPath)) {
 				return ErrSkipPermissionsCheck
 			}
@@ -621,28 +1208,47 @@ func (c *BaseConnection) isRenamePermitted(fsSourcePath, virtualSourcePath, virt
 		c.Log(logger.LevelWarn, "renaming a virtual folder is not allowed")
 		return false
 	}
-	if !c.User.IsFileAllowed(virtualSourcePath) || !c.User.IsFileAllowed(virtualTargetPath) {
+	if !c.User.IsFileAllowed(virtualSourcePath) || !c.User.IsFileAllowed(virtualTargetPath) ||
+		!c.User.IsUploadNameAllowed(virtualTargetPath) {
 		if fi != nil && fi.Mode().IsRegular() {
 			c.Log(logger.LevelDebug, "renaming file is not allowed, source: %#v target: %#v",
 				virtualSourcePath, virtualTargetPath)
 			return false
 		}
 	}
-	if c.User.HasPerm(dataprovider.PermRename, path.Dir(virtualSourcePath)) &&
-		c.User.HasPerm(dataprovider.PermRename, path.Dir(virtualTargetPath)) {
+	if c.User.IsUploadOnlyPath(path.Dir(virtualSourcePath)) {
+		c.Log(logger.LevelDebug, "renaming from the upload only directory %#v is not allowed", path.Dir(virtualSourcePath))
+		return false
+	}
+	// the permissions defined using patterns apply to files, so they are checked against the source
+	// and the target file paths: renaming a file must not allow to escape a restrictive pattern
+	isDir := fi != nil && fi.IsDir()
+	hasPerm := func(permission, virtualPath string) bool {
+		if isDir {
+			return c.User.HasPerm(permission, path.Dir(virtualPath))
+		}
+		return c.User.HasFilePerm(permission, virtualPath)
+	}
+	if hasPerm(dataprovider.PermRename, virtualSourcePath) && hasPerm(dataprovider.PermRename, virtualTargetPath) {
 		return true
 	}
-	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(virtualSourcePath)) {
+	if c.User.Filters.RequireRenamePermission {
+		c.Log(logger.LevelDebug, "renaming %#v -> %#v is not allowed, the rename permission is required for the source "+
+			"and the target directories", virtualSourcePath, virtualTargetPath)
 		return false
 	}
-	if fi != nil {
-		if fi.IsDir() {
-			return c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(virtualTargetPath))
-		} else if fi.Mode()&os.ModeSymlink != 0 {
-			return c.User.HasPerm(dataprovider.PermCreateSymlinks, path.Dir(virtualTargetPath))
-		}
+	// moving an item inside a drop box directory is like uploading it there,
+	// the source must be removable
+	if !hasPerm(dataprovider.PermDelete, virtualSourcePath) {
+		return false
 	}
-	return c.User.HasPerm(dataprovider.PermUpload, path.Dir(virtualTargetPath))
+	if isDir {
+		return hasPerm(dataprovider.PermCreateDirs, virtualTargetPath)
+	}
+	if fi != nil && fi.Mode()&os.ModeSymlink != 0 {
+		return hasPerm(dataprovider.PermCreateSymlinks, virtualTargetPath)
+	}
+	return hasPerm(dataprovider.PermUpload, virtualTargetPath)
 }
 
 func (c *BaseConnection) hasSpaceForRename(virtualSourcePath, virtualTargetPath string, initialSize int64,
@@ -909,7 +1515,7 @@ func (c *BaseConnection) updateQuotaAfterRename(virtualSourcePath, virtualTarget
 				return err
 			}
 		} else {
-			filesSize = fi.Size()
+			filesSize = vfs.GetSizeForQuota(fi)
 		}
 	} else {
 		c.Log(logger.LevelWarn, "failed to update quota after rename, file %#v stat error: %+v", targetPath, err)
@@ -927,6 +1533,50 @@ func (c *BaseConnection) updateQuotaAfterRename(virtualSourcePath, virtualTarget
 	return nil
 }
 
+// CheckDownloadVolumeLimit returns ErrDownloadLimitReached if the user cannot download
+// more data in the current download volume period
+func (c *BaseConnection) CheckDownloadVolumeLimit() error {
+	if downloadVolumes.isLimitReached(c.User) {
+		c.Log(logger.LevelInfo, "denying download, download volume limit reached")
+		return ErrDownloadLimitReached
+	}
+	return nil
+}
+
+// CheckDownloadFileSize returns ErrDownloadSizeExceeded if the file at fsPath exceeds
+// the maximum download size defined for its virtual path. The file is stat'ed only if
+// a limit is defined and info is nil
+func (c *BaseConnection) CheckDownloadFileSize(fsPath, virtualPath string, info os.FileInfo) error {
+	maxSize := c.User.GetMaxDownloadFileSize(virtualPath)
+	if maxSize <= 0 {
+		return nil
+	}
+	if info == nil {
+		var err error
+		info, err = c.Fs.Stat(fsPath)
+		if err != nil {
+			return c.GetFsError(err)
+		}
+	}
+	if info.Size() > maxSize {
+		c.Log(logger.LevelInfo, "denying download of %#v, size %v exceeds the limit %v", virtualPath, info.Size(), maxSize)
+		return ErrDownloadSizeExceeded
+	}
+	return nil
+}
+
+// getTextTransformFile wraps the specified upload file if a text transform is defined
+// for its virtual path, otherwise the file is returned unchanged
+func (c *BaseConnection) getTextTransformFile(file vfs.File, virtualPath string) vfs.File {
+	filter, ok := c.User.GetTextTransform(virtualPath)
+	if !ok {
+		return file
+	}
+	c.Log(logger.LevelDebug, "applying text transform to upload %#v, line endings: %#v, strip BOM: %v",
+		virtualPath, filter.LineEndings, filter.StripBOM)
+	return vfs.NewTextTransformFile(file, filter.LineEndings, filter.StripBOM)
+}
+
 // GetPermissionDeniedError returns an appropriate permission denied error for the connection protocol
 func (c *BaseConnection) GetPermissionDeniedError() error {
 	switch c.protocol {
@@ -965,9 +1615,19 @@ func (c *BaseConnection) GetOpUnsupportedError() error {
 func (c *BaseConnection) GetGenericError(err error) error {
 	switch c.protocol {
 	case ProtocolSFTP:
+		if err == ErrRecursionLimit || err == ErrTooManyOpenFiles || err == ErrTooManyUploads ||
+			err == ErrTooManyDownloads || err == ErrDownloadSizeExceeded ||
+			err == ErrPathSchemaMismatch || err == ErrDownloadDenied || err == ErrUploadRejected ||
+			err == ErrDirectoryFilesLimit || err == ErrInsufficientDiskSpace {
+			return err
+		}
 		return sftp.ErrSSHFxFailure
 	default:
-		if err == ErrPermissionDenied || err == ErrNotExist || err == ErrOpUnsupported || err == ErrQuotaExceeded {
+		if err == ErrPermissionDenied || err == ErrNotExist || err == ErrOpUnsupported || err == ErrQuotaExceeded ||
+			err == ErrDownloadLimitReached || err == ErrRecursionLimit || err == ErrTooManyOpenFiles ||
+			err == ErrTooManyUploads || err == ErrTooManyDownloads ||
+			err == ErrDownloadSizeExceeded || err == ErrPathSchemaMismatch || err == ErrDownloadDenied ||
+			err == ErrUploadRejected || err == ErrDirectoryFilesLimit || err == ErrInsufficientDiskSpace {
 			return err
 		}
 		return ErrGenericFailure
@@ -987,3 +1647,14 @@ func (c *BaseConnection) GetFsError(err error) error {
 	}
 	return nil
 }
+
+// symlinkTargetInfo exposes the FileInfo of a symlink target using the symlink name
+type symlinkTargetInfo struct {
+	os.FileInfo
+	name string
+}
+
+// Name returns the symlink name
+func (fi *symlinkTargetInfo) Name() string {
+	return fi.name
+}
@@ -1,19 +1,43 @@
 package common
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/eikenb/pipeat"
 	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
 )
 
@@ -44,6 +68,186 @@ func newMockOsFs(hasVirtualFolders bool, connectionID, rootDir string) vfs.Fs {
 	}
 }
 
+// mockCloudFs emulates a Cloud Storage Fs, using pipes, on top of the local filesystem.
+// The object metadata are kept in memory and, as for S3, the listings do not include them
+type mockCloudFs struct {
+	vfs.Fs
+	rootDir  string
+	mu       sync.Mutex
+	metadata map[string]map[string]string
+}
+
+type mockCloudFileInfo struct {
+	os.FileInfo
+	metadata map[string]string
+}
+
+func (fi *mockCloudFileInfo) Metadata() map[string]string {
+	return fi.metadata
+}
+
+func (fs *mockCloudFs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	metadata := make(map[string]string)
+	for k, v := range fs.metadata[name] {
+		metadata[k] = v
+	}
+	return &mockCloudFileInfo{FileInfo: info, metadata: metadata}, nil
+}
+
+func (fs *mockCloudFs) SetObjectMetadata(name string, metadata map[string]string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.metadata == nil {
+		fs.metadata = make(map[string]map[string]string)
+	}
+	if fs.metadata[name] == nil {
+		fs.metadata[name] = make(map[string]string)
+	}
+	for k, v := range metadata {
+		fs.metadata[name][k] = v
+	}
+	return nil
+}
+
+func (fs *mockCloudFs) Rename(source, target string) error {
+	if err := fs.Fs.Rename(source, target); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if metadata, ok := fs.metadata[source]; ok {
+		fs.metadata[target] = metadata
+		delete(fs.metadata, source)
+	}
+	return nil
+}
+
+func (fs *mockCloudFs) Remove(name string, isDir bool) error {
+	fs.mu.Lock()
+	delete(fs.metadata, name)
+	fs.mu.Unlock()
+
+	return fs.Fs.Remove(name, isDir)
+}
+
+func (fs *mockCloudFs) Name() string {
+	return "mockCloudFs"
+}
+
+func (fs *mockCloudFs) Open(name string, offset int64) (vfs.File, *pipeat.PipeReaderAt, func(), error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.rootDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	go func() {
+		defer f.Close()
+		_, err := f.Seek(offset, io.SeekStart)
+		if err == nil {
+			_, err = io.Copy(w, f)
+		}
+		w.CloseWithError(err) //nolint:errcheck
+	}()
+	return nil, r, func() {}, nil
+}
+
+func (fs *mockCloudFs) Create(name string, flag int) (vfs.File, *vfs.PipeWriter, func(), error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// an upload replaces the object and its metadata
+	fs.mu.Lock()
+	delete(fs.metadata, name)
+	fs.mu.Unlock()
+
+	r, w, err := pipeat.PipeInDir(fs.rootDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	p := vfs.NewPipeWriter(w)
+	go func() {
+		_, err := io.Copy(f, r)
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+	}()
+	return nil, p, func() {}, nil
+}
+
+type mockCountingCloudFs struct {
+	mockCloudFs
+	sync.Mutex
+	opens int
+}
+
+func (fs *mockCountingCloudFs) Open(name string, offset int64) (vfs.File, *pipeat.PipeReaderAt, func(), error) {
+	fs.Lock()
+	fs.opens++
+	fs.Unlock()
+	return fs.mockCloudFs.Open(name, offset)
+}
+
+func (fs *mockCountingCloudFs) getOpens() int {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.opens
+}
+
+func TestProtocolPermissions(t *testing.T) {
+	user := dataprovider.User{
+		Username: userTestUsername,
+		Permissions: map[string][]string{
+			"/": {dataprovider.PermAny},
+		},
+		Filters: dataprovider.UserFilters{
+			ProtocolPermissions: []dataprovider.ProtocolPermissionsFilter{
+				{
+					Protocol: ProtocolSSH,
+					Permissions: map[string][]string{
+						"/": {dataprovider.PermListItems},
+					},
+				},
+				{
+					Protocol: ProtocolWebDAV,
+					Permissions: map[string][]string{
+						"/": {dataprovider.PermDownload},
+					},
+				},
+			},
+		},
+	}
+	for _, protocol := range []string{ProtocolSFTP, ProtocolSCP, ProtocolSSH, "sshd_exec"} {
+		conn := NewBaseConnection("", protocol, user, nil)
+		assert.True(t, conn.User.HasPerm(dataprovider.PermListItems, "/"), protocol)
+		assert.False(t, conn.User.HasPerm(dataprovider.PermUpload, "/"), protocol)
+	}
+	conn := NewBaseConnection("", ProtocolWebDAV, user, nil)
+	assert.True(t, conn.User.HasPerm(dataprovider.PermDownload, "/"))
+	assert.False(t, conn.User.HasPerm(dataprovider.PermListItems, "/"))
+	conn = NewBaseConnection("", ProtocolFTP, user, nil)
+	assert.True(t, conn.User.HasPerm(dataprovider.PermUpload, "/"))
+	assert.True(t, conn.User.HasPerm(dataprovider.PermListItems, "/"))
+	// the base permissions are not modified
+	assert.Equal(t, []string{dataprovider.PermAny}, user.Permissions["/"])
+}
+
 func TestListDir(t *testing.T) {
 	user := dataprovider.User{
 		Username: userTestUsername,
@@ -86,6 +290,93 @@ func TestListDir(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestListDirSymlinks(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  filepath.Join(os.TempDir(), "home"),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	err := os.MkdirAll(filepath.Join(user.HomeDir, "a"), os.ModePerm)
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(user.HomeDir, "b"), os.ModePerm)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(user.HomeDir, "b", "file"), []byte("content"), os.ModePerm)
+	require.NoError(t, err)
+	// a/tob -> b and b/toa -> a is a cycle, a/self points to its parent
+	err = os.Symlink(filepath.Join(user.HomeDir, "b"), filepath.Join(user.HomeDir, "a", "tob"))
+	require.NoError(t, err)
+	err = os.Symlink(filepath.Join(user.HomeDir, "a"), filepath.Join(user.HomeDir, "b", "toa"))
+	require.NoError(t, err)
+	err = os.Symlink(filepath.Join(user.HomeDir, "a"), filepath.Join(user.HomeDir, "a", "self"))
+	require.NoError(t, err)
+	err = os.Symlink(filepath.Join(user.HomeDir, "b", "file"), filepath.Join(user.HomeDir, "a", "tofile"))
+	require.NoError(t, err)
+	err = os.Symlink(os.TempDir(), filepath.Join(user.HomeDir, "a", "outside"))
+	require.NoError(t, err)
+	err = os.Symlink(filepath.Join(user.HomeDir, "missing"), filepath.Join(user.HomeDir, "a", "dangling"))
+	require.NoError(t, err)
+
+	fs := vfs.NewOsFs("", user.HomeDir, nil)
+	conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+	listDir := func(virtualPath string) map[string]os.FileInfo {
+		fsPath, err := fs.ResolvePath(virtualPath)
+		require.NoError(t, err)
+		files, err := conn.ListDir(fsPath, virtualPath)
+		require.NoError(t, err)
+		result := make(map[string]os.FileInfo)
+		for _, fi := range files {
+			result[fi.Name()] = fi
+		}
+		return result
+	}
+	files := listDir("/a")
+	for _, name := range []string{"tob", "self", "tofile", "outside", "dangling"} {
+		assert.NotZero(t, files[name].Mode()&os.ModeSymlink, name)
+	}
+
+	savedMode := Config.SymlinksMode
+	Config.SymlinksMode = SymlinksModeAsTarget
+	files = listDir("/a")
+	assert.True(t, files["tob"].IsDir())
+	assert.True(t, files["tofile"].Mode().IsRegular())
+	assert.Equal(t, int64(7), files["tofile"].Size())
+	assert.NotZero(t, files["self"].Mode()&os.ModeSymlink)
+	assert.NotZero(t, files["outside"].Mode()&os.ModeSymlink)
+	assert.NotZero(t, files["dangling"].Mode()&os.ModeSymlink)
+	files = listDir("/a/tob")
+	assert.True(t, files["file"].Mode().IsRegular())
+	assert.NotZero(t, files["toa"].Mode()&os.ModeSymlink)
+	// a recursive client following the listed directories must terminate
+	var walk func(virtualPath string, depth int) int
+	walk = func(virtualPath string, depth int) int {
+		require.Less(t, depth, 10, "recursive listing does not terminate")
+		visited := 1
+		for name, fi := range listDir(virtualPath) {
+			if fi.IsDir() {
+				visited += walk(path.Join(virtualPath, name), depth+1)
+			}
+		}
+		return visited
+	}
+	// "/", "/a", "/a/tob", "/b", "/b/toa"
+	assert.Equal(t, 5, walk("/", 0))
+	Config.SymlinksMode = savedMode
+	// server side recursive operations do not follow symlinks
+	numFiles, size, err := fs.ScanRootDirContents()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numFiles)
+	assert.Equal(t, int64(7), size)
+	err = conn.checkRecursiveRenameDirPermissions(filepath.Join(user.HomeDir, "a"), filepath.Join(user.HomeDir, "c"))
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(user.HomeDir)
+	assert.NoError(t, err)
+}
+
 func TestCreateDir(t *testing.T) {
 	user := dataprovider.User{
 		Username: userTestUsername,
@@ -783,6 +1074,15 @@ func TestRenamePermission(t *testing.T) {
 	request = sftp.NewRequest("Rename", "/dir2/testfile")
 	request.Target = "/dir3/testfile"
 	assert.False(t, conn.isRenamePermitted("", request.Filepath, request.Target, nil))
+	conn.User.Filters.RequireRenamePermission = true
+	request = sftp.NewRequest("Rename", "/dir3/testfile")
+	request.Target = "/dir2/testfile"
+	// delete on Source and Upload on Target are not enough if the rename permission is required
+	assert.False(t, conn.isRenamePermitted("", request.Filepath, request.Target, nil))
+	request = sftp.NewRequest("Rename", "/testfile")
+	request.Target = "/dir1/testfile"
+	assert.True(t, conn.isRenamePermitted("", request.Filepath, request.Target, nil))
+	conn.User.Filters.RequireRenamePermission = false
 	tmpDir := filepath.Join(os.TempDir(), "dir")
 	tmpDirLink := filepath.Join(os.TempDir(), "link")
 	err = os.Mkdir(tmpDir, os.ModePerm)
@@ -867,6 +1167,53 @@ func TestRenamePermission(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRenamePatternPermissions(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "rename_patterns")
+	user := dataprovider.User{
+		Username: userTestUsername,
+		Permissions: map[string][]string{
+			"/":            {dataprovider.PermAny},
+			"/docs/*.pdf":  {dataprovider.PermListItems},
+			"/drop/*.csv":  {dataprovider.PermListItems, dataprovider.PermDelete, dataprovider.PermUpload},
+			"/drop":        {dataprovider.PermListItems, dataprovider.PermUpload},
+			"/other/*.pdf": {dataprovider.PermListItems, dataprovider.PermRename},
+		},
+		HomeDir: homeDir,
+	}
+	err := os.MkdirAll(filepath.Join(homeDir, "docs"), os.ModePerm)
+	assert.NoError(t, err)
+	testFile := filepath.Join(homeDir, "docs", "a.pdf")
+	err = ioutil.WriteFile(testFile, []byte("data"), os.ModePerm)
+	assert.NoError(t, err)
+	info, err := os.Stat(testFile)
+	assert.NoError(t, err)
+	fs, err := user.GetFilesystem("123")
+	assert.NoError(t, err)
+	conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+	// the pattern denies the download for pdf files, renaming them to another extension must be denied too
+	assert.False(t, conn.isRenamePermitted(testFile, "/docs/a.pdf", "/docs/a.txt", info))
+	assert.False(t, conn.isRenamePermitted(testFile, "/docs/a.txt", "/docs/b.pdf", info))
+	assert.True(t, conn.isRenamePermitted(testFile, "/docs/a.txt", "/docs/b.txt", info))
+	// the rename permission is granted for the source and the target file
+	assert.True(t, conn.isRenamePermitted(testFile, "/other/a.pdf", "/other/b.pdf", info))
+	assert.False(t, conn.isRenamePermitted(testFile, "/docs/a.pdf", "/other/b.pdf", info))
+	// the delete permission for the source file and the upload permission for the target file are granted
+	assert.True(t, conn.isRenamePermitted(testFile, "/drop/a.csv", "/drop/b.csv", info))
+	assert.False(t, conn.isRenamePermitted(testFile, "/drop/a.txt", "/drop/b.csv", info))
+	// the patterns apply to the files inside a renamed directory too
+	err = conn.checkRecursiveRenameDirPermissions(filepath.Join(homeDir, "docs"), filepath.Join(homeDir, "docs1"))
+	assert.EqualError(t, err, os.ErrPermission.Error())
+	err = os.Remove(testFile)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(homeDir, "docs", "a.txt"), []byte("data"), os.ModePerm)
+	assert.NoError(t, err)
+	err = conn.checkRecursiveRenameDirPermissions(filepath.Join(homeDir, "docs"), filepath.Join(homeDir, "docs1"))
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
+
 func TestHasSpaceForRename(t *testing.T) {
 	err := closeDataprovider()
 	assert.NoError(t, err)
@@ -1235,3 +1582,2366 @@ func TestMaxWriteSize(t *testing.T) {
 	assert.EqualError(t, err, ErrOpUnsupported.Error())
 	assert.Equal(t, int64(0), size)
 }
+
+func TestCompressedFs(t *testing.T) {
+	rootDir := filepath.Join(os.TempDir(), "compressedfs")
+	err := os.MkdirAll(rootDir, os.ModePerm)
+	require.NoError(t, err)
+	config := vfs.CompressionConfig{
+		Extensions: []string{".TXT", " .csv", ""},
+	}
+	err = vfs.ValidateCompressionConfig(&config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{".txt", ".csv"}, config.Extensions)
+	err = vfs.ValidateCompressionConfig(&vfs.CompressionConfig{Extensions: []string{"*.txt"}})
+	assert.Error(t, err)
+	// the compression metadata cannot be stored on the local filesystem
+	_, _, _, err = vfs.NewCompressedFs(vfs.NewOsFs("", rootDir, nil), rootDir, config).Create(
+		filepath.Join(rootDir, "file.txt"), 0)
+	assert.EqualError(t, err, vfs.ErrVfsUnsupported.Error())
+
+	cloudFs := &mockCountingCloudFs{
+		mockCloudFs: mockCloudFs{
+			Fs:      vfs.NewOsFs("", rootDir, nil),
+			rootDir: rootDir,
+		},
+	}
+	fs := vfs.NewCompressedFs(cloudFs, rootDir, config)
+	content := bytes.Repeat([]byte("compressible content "), 4096)
+	for _, name := range []string{"file.txt", "file.bin"} {
+		filePath := filepath.Join(rootDir, name)
+		_, w, _, err := fs.Create(filePath, 0)
+		require.NoError(t, err)
+		for off := 0; off < len(content); off += 1000 {
+			end := off + 1000
+			if end > len(content) {
+				end = len(content)
+			}
+			_, err = w.WriteAt(content[off:end], int64(off))
+			require.NoError(t, err)
+		}
+		err = w.Close()
+		require.NoError(t, err)
+
+		info, err := fs.Stat(filePath)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)), info.Size())
+		diskInfo, err := os.Stat(filePath)
+		require.NoError(t, err)
+		if name == "file.txt" {
+			assert.Less(t, diskInfo.Size(), int64(len(content)))
+			assert.Equal(t, map[string]string{
+				"sftpgo_compression":       "gzip",
+				"sftpgo_uncompressed_size": strconv.Itoa(len(content)),
+			}, cloudFs.metadata[filePath])
+		} else {
+			assert.Equal(t, int64(len(content)), diskInfo.Size())
+			assert.Nil(t, cloudFs.metadata[filePath])
+		}
+
+		for _, offset := range []int64{0, 12345} {
+			_, r, _, err := fs.Open(filePath, offset)
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, content[offset:], data)
+			err = r.Close()
+			assert.NoError(t, err)
+		}
+	}
+	// the uncompressed size is read from the object metadata
+	opens := cloudFs.getOpens()
+	entries, err := fs.ReadDir(rootDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	for _, info := range entries {
+		assert.Equal(t, int64(len(content)), info.Size())
+	}
+	_, err = fs.Stat(filepath.Join(rootDir, "file.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, opens, cloudFs.getOpens())
+	// a file not compressed by SFTPGo is served as it is
+	plainPath := filepath.Join(rootDir, "plain.csv")
+	err = ioutil.WriteFile(plainPath, content, os.ModePerm)
+	require.NoError(t, err)
+	info, err := fs.Stat(plainPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+	_, r, _, err := fs.Open(plainPath, 10)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content[10:], data)
+	// a compressed file cannot lose its compressed extension
+	err = fs.Rename(filepath.Join(rootDir, "file.txt"), filepath.Join(rootDir, "file.dat"))
+	assert.EqualError(t, err, vfs.ErrVfsUnsupported.Error())
+	err = fs.Rename(filepath.Join(rootDir, "file.txt"), filepath.Join(rootDir, "file1.csv"))
+	assert.NoError(t, err)
+	info, err = fs.Stat(filepath.Join(rootDir, "file1.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+	// files not compressed by SFTPGo can be renamed
+	err = fs.Rename(plainPath, filepath.Join(rootDir, "plain.dat"))
+	assert.NoError(t, err)
+	err = fs.Rename(filepath.Join(rootDir, "file.bin"), filepath.Join(rootDir, "file.txt"))
+	assert.NoError(t, err)
+	_, r, _, err = fs.Open(filepath.Join(rootDir, "file.txt"), 0)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	err = os.RemoveAll(rootDir)
+	assert.NoError(t, err)
+}
+
+func TestCompressedFsQuotaBasis(t *testing.T) {
+	rootDir := filepath.Join(os.TempDir(), "compressedfsquota")
+	content := bytes.Repeat([]byte("compressible content "), 4096)
+	for _, quotaBasis := range []int{vfs.CompressionQuotaBasisLogical, vfs.CompressionQuotaBasisPhysical} {
+		err := os.MkdirAll(rootDir, os.ModePerm)
+		require.NoError(t, err)
+		fs := vfs.NewCompressedFs(&mockCloudFs{
+			Fs:      vfs.NewOsFs("", rootDir, nil),
+			rootDir: rootDir,
+		}, rootDir, vfs.CompressionConfig{
+			Extensions: []string{".txt"},
+			QuotaBasis: quotaBasis,
+		})
+		expectedSize := int64(0)
+		for _, name := range []string{"file.txt", "file.bin"} {
+			filePath := filepath.Join(rootDir, name)
+			_, w, _, err := fs.Create(filePath, 0)
+			require.NoError(t, err)
+			_, err = w.WriteAt(content, 0)
+			require.NoError(t, err)
+			err = w.Close()
+			require.NoError(t, err)
+
+			info, err := fs.Stat(filePath)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(content)), info.Size())
+			diskInfo, err := os.Stat(filePath)
+			require.NoError(t, err)
+			if quotaBasis == vfs.CompressionQuotaBasisPhysical {
+				assert.Equal(t, diskInfo.Size(), vfs.GetSizeForQuota(info))
+			} else {
+				assert.Equal(t, info.Size(), vfs.GetSizeForQuota(info))
+			}
+			expectedSize += vfs.GetSizeForQuota(info)
+		}
+		// a quota scan must use the same basis as the incremental updates
+		numFiles, size, err := fs.ScanRootDirContents()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, numFiles)
+		assert.Equal(t, expectedSize, size)
+
+		err = os.RemoveAll(rootDir)
+		assert.NoError(t, err)
+	}
+	err := vfs.ValidateCompressionConfig(&vfs.CompressionConfig{
+		Extensions: []string{".txt"},
+		QuotaBasis: 2,
+	})
+	assert.Error(t, err)
+}
+
+func TestCompressedFsPaths(t *testing.T) {
+	rootDir := filepath.Join(os.TempDir(), "compressedfspaths")
+	err := os.MkdirAll(filepath.Join(rootDir, "logs", "sub"), os.ModePerm)
+	require.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(rootDir, "logs1"), os.ModePerm)
+	require.NoError(t, err)
+	config := vfs.CompressionConfig{
+		Extensions: []string{".txt"},
+		Paths:      []string{"relative"},
+	}
+	assert.Error(t, vfs.ValidateCompressionConfig(&config))
+	config.Paths = []string{" /logs/ ", ""}
+	require.NoError(t, vfs.ValidateCompressionConfig(&config))
+	assert.Equal(t, []string{"/logs"}, config.Paths)
+
+	cloudFs := &mockCloudFs{
+		Fs:      vfs.NewOsFs("", rootDir, nil),
+		rootDir: rootDir,
+	}
+	fs := vfs.NewCompressedFs(cloudFs, rootDir, config)
+	content := bytes.Repeat([]byte("compressible content "), 1024)
+	for name, compressed := range map[string]bool{
+		"file.txt":                            false,
+		filepath.Join("logs1", "a.txt"):       false,
+		filepath.Join("logs", "a.txt"):        true,
+		filepath.Join("logs", "sub", "b.txt"): true,
+	} {
+		filePath := filepath.Join(rootDir, name)
+		_, w, _, err := fs.Create(filePath, 0)
+		require.NoError(t, err)
+		_, err = w.WriteAt(content, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		diskInfo, err := os.Stat(filePath)
+		require.NoError(t, err)
+		assert.Equal(t, compressed, diskInfo.Size() < int64(len(content)), name)
+		info, err := fs.Stat(filePath)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)), info.Size())
+	}
+	// a compressed file cannot be moved outside the compressed folders
+	err = fs.Rename(filepath.Join(rootDir, "logs", "a.txt"), filepath.Join(rootDir, "a.txt"))
+	assert.EqualError(t, err, vfs.ErrVfsUnsupported.Error())
+	err = fs.Rename(filepath.Join(rootDir, "logs", "a.txt"), filepath.Join(rootDir, "logs", "sub", "a.txt"))
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(rootDir)
+	assert.NoError(t, err)
+}
+
+func TestCachedFs(t *testing.T) {
+	rootDir := filepath.Join(os.TempDir(), "cachedfs")
+	cacheDir := filepath.Join(os.TempDir(), "cachedfs_cache")
+	err := os.MkdirAll(rootDir, os.ModePerm)
+	require.NoError(t, err)
+	content := bytes.Repeat([]byte("cacheable content "), 1024)
+	config := vfs.CacheConfig{
+		Path:    "relative",
+		MaxSize: int64(2 * len(content)),
+	}
+	assert.Error(t, vfs.ValidateCacheConfig(&config))
+	config.Path = cacheDir
+	config.MaxFileSize = config.MaxSize + 1
+	assert.Error(t, vfs.ValidateCacheConfig(&config))
+	config.MaxFileSize = 0
+	require.NoError(t, vfs.ValidateCacheConfig(&config))
+
+	cloudFs := &mockCountingCloudFs{
+		mockCloudFs: mockCloudFs{
+			Fs:      vfs.NewOsFs("", rootDir, nil),
+			rootDir: rootDir,
+		},
+	}
+	fs, err := vfs.NewCachedFs(cloudFs, rootDir, config)
+	require.NoError(t, err)
+	getCachedFiles := func() int {
+		files, err := filepath.Glob(filepath.Join(cacheDir, "*.sftpgocache"))
+		assert.NoError(t, err)
+		return len(files)
+	}
+	readFile := func(name string, offset int64) []byte {
+		_, r, _, err := fs.Open(name, offset)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		return data
+	}
+	filePath := filepath.Join(rootDir, "file.txt")
+	err = ioutil.WriteFile(filePath, content, os.ModePerm)
+	require.NoError(t, err)
+	assert.Equal(t, content[100:], readFile(filePath, 100))
+	assert.Eventually(t, func() bool { return getCachedFiles() == 1 }, 1*time.Second, 50*time.Millisecond)
+	assert.Equal(t, content, readFile(filePath, 0))
+	assert.Equal(t, content[200:], readFile(filePath, 200))
+	assert.Equal(t, 1, cloudFs.getOpens())
+	// a file modified outside SFTPGo is detected as stale
+	newContent := append(content, []byte("modified")...)
+	err = ioutil.WriteFile(filePath, newContent, os.ModePerm)
+	require.NoError(t, err)
+	assert.Equal(t, newContent, readFile(filePath, 0))
+	assert.Equal(t, 2, cloudFs.getOpens())
+	assert.Eventually(t, func() bool { return getCachedFiles() == 1 }, 1*time.Second, 50*time.Millisecond)
+	// a write invalidates the cached file
+	_, w, _, err := fs.Create(filePath, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, getCachedFiles())
+	_, err = w.WriteAt(content, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, content, readFile(filePath, 0))
+	assert.Equal(t, 3, cloudFs.getOpens())
+	assert.Eventually(t, func() bool { return getCachedFiles() == 1 }, 1*time.Second, 50*time.Millisecond)
+	// the least recently used file is evicted
+	for _, name := range []string{"file1.txt", "file2.txt"} {
+		err = ioutil.WriteFile(filepath.Join(rootDir, name), content, os.ModePerm)
+		require.NoError(t, err)
+		assert.Equal(t, content, readFile(filepath.Join(rootDir, name), 0))
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Eventually(t, func() bool { return getCachedFiles() == 2 }, 1*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 5, cloudFs.getOpens())
+	assert.Equal(t, content, readFile(filePath, 0))
+	assert.Equal(t, 6, cloudFs.getOpens())
+	// files bigger than the max file size are not cached
+	bigFilePath := filepath.Join(rootDir, "big.txt")
+	err = ioutil.WriteFile(bigFilePath, bytes.Repeat(content, 3), os.ModePerm)
+	require.NoError(t, err)
+	readFile(bigFilePath, 0)
+	readFile(bigFilePath, 0)
+	assert.Equal(t, 8, cloudFs.getOpens())
+	err = fs.Remove(filePath, false)
+	assert.NoError(t, err)
+	_, _, _, err = fs.Open(filePath, 0)
+	assert.True(t, fs.IsNotExist(err))
+
+	err = os.RemoveAll(rootDir)
+	assert.NoError(t, err)
+	err = os.RemoveAll(cacheDir)
+	assert.NoError(t, err)
+}
+
+func TestCachedFsTTL(t *testing.T) {
+	rootDir := filepath.Join(os.TempDir(), "cachedfs_ttl")
+	cacheDir := filepath.Join(os.TempDir(), "cachedfs_ttl_cache")
+	err := os.MkdirAll(rootDir, os.ModePerm)
+	require.NoError(t, err)
+	content := []byte("small metadata file")
+	config := vfs.CacheConfig{
+		Path:    cacheDir,
+		MaxSize: 1048576,
+		TTL:     -1,
+	}
+	assert.Error(t, vfs.ValidateCacheConfig(&config))
+	config.TTL = 1
+	require.NoError(t, vfs.ValidateCacheConfig(&config))
+
+	cloudFs := &mockCountingCloudFs{
+		mockCloudFs: mockCloudFs{
+			Fs:      vfs.NewOsFs("", rootDir, nil),
+			rootDir: rootDir,
+		},
+	}
+	fs, err := vfs.NewCachedFs(cloudFs, rootDir, config)
+	require.NoError(t, err)
+	readFile := func(name string) []byte {
+		_, r, _, err := fs.Open(name, 0)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		return data
+	}
+	isCached := func() bool {
+		files, err := filepath.Glob(filepath.Join(cacheDir, "*.sftpgocache"))
+		return err == nil && len(files) == 1
+	}
+	filePath := filepath.Join(rootDir, "meta.json")
+	err = ioutil.WriteFile(filePath, content, os.ModePerm)
+	require.NoError(t, err)
+	assert.Equal(t, content, readFile(filePath))
+	assert.Eventually(t, isCached, 1*time.Second, 50*time.Millisecond)
+	// within the TTL a change made outside SFTPGo is not detected
+	newContent := []byte("modified metadata file")
+	err = ioutil.WriteFile(filePath, newContent, os.ModePerm)
+	require.NoError(t, err)
+	assert.Equal(t, content, readFile(filePath))
+	assert.Equal(t, 1, cloudFs.getOpens())
+	// after the TTL the cached object is validated again
+	time.Sleep(1100 * time.Millisecond)
+	assert.Equal(t, newContent, readFile(filePath))
+	assert.Equal(t, 2, cloudFs.getOpens())
+	assert.Eventually(t, isCached, 1*time.Second, 50*time.Millisecond)
+	assert.Equal(t, newContent, readFile(filePath))
+	assert.Equal(t, 2, cloudFs.getOpens())
+	// an object read while it is uploaded is not cached, the upload invalidates it again when it ends
+	_, w, _, err := fs.Create(filePath, 0)
+	require.NoError(t, err)
+	assert.Empty(t, readFile(filePath))
+	assert.Equal(t, 3, cloudFs.getOpens())
+	assert.Never(t, isCached, 300*time.Millisecond, 50*time.Millisecond)
+	uploadedContent := []byte("uploaded metadata file")
+	_, err = w.WriteAt(uploadedContent, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	assert.Equal(t, uploadedContent, readFile(filePath))
+	assert.Equal(t, 4, cloudFs.getOpens())
+	assert.Eventually(t, isCached, 1*time.Second, 50*time.Millisecond)
+	assert.Equal(t, uploadedContent, readFile(filePath))
+	assert.Equal(t, 4, cloudFs.getOpens())
+	// a rename using SFTPGo invalidates the cached object even within the TTL
+	err = fs.Rename(filePath, filePath+".bak")
+	assert.NoError(t, err)
+	_, _, _, err = fs.Open(filePath, 0)
+	assert.True(t, fs.IsNotExist(err))
+
+	err = os.RemoveAll(rootDir)
+	assert.NoError(t, err)
+	err = os.RemoveAll(cacheDir)
+	assert.NoError(t, err)
+}
+
+func TestHomeMarker(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case http.MethodHead:
+			if objects[r.URL.Path] {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			_, _ = ioutil.ReadAll(r.Body)
+			objects[r.URL.Path] = true
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "access_key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "access_secret")
+	defer func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	}()
+
+	fs, err := vfs.NewS3Fs("", os.TempDir(), vfs.S3FsConfig{
+		Bucket:    "bucket",
+		Region:    "us-east-1",
+		Endpoint:  server.URL,
+		KeyPrefix: "home/",
+	})
+	require.NoError(t, err)
+
+	assert.NoError(t, vfs.CheckHomeMarker(fs, vfs.HomeMarkerDisabled))
+	err = vfs.CheckHomeMarker(fs, vfs.HomeMarkerRequired)
+	assert.EqualError(t, err, vfs.ErrHomeMarkerNotFound.Error())
+	assert.NoError(t, vfs.CheckHomeMarker(fs, vfs.HomeMarkerCreate))
+	mu.Lock()
+	assert.True(t, objects["/bucket/home/"])
+	mu.Unlock()
+	assert.NoError(t, vfs.CheckHomeMarker(fs, vfs.HomeMarkerRequired))
+	// the check is a no-op for the local filesystem
+	assert.NoError(t, vfs.CheckHomeMarker(vfs.NewOsFs("", os.TempDir(), nil), vfs.HomeMarkerRequired))
+}
+
+func TestS3RequesterPays(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "access_key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "access_secret")
+	defer func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	}()
+
+	for _, requesterPays := range []bool{true, false} {
+		var mu sync.Mutex
+		// request payer header received for each operation
+		headers := make(map[string][]string)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			operation := r.Method
+			if _, ok := r.URL.Query()["list-type"]; ok {
+				operation = "LIST"
+			}
+			headers[operation] = append(headers[operation], r.Header.Get("X-Amz-Request-Payer"))
+			switch operation {
+			case http.MethodHead:
+				w.Header().Set("Content-Length", "5")
+				w.Header().Set("Last-Modified", "Fri, 01 Jan 2021 00:00:00 GMT")
+				w.WriteHeader(http.StatusOK)
+			case "LIST":
+				_, _ = w.Write([]byte(`<ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>` +
+					`<Contents><Key>file</Key><Size>5</Size><LastModified>2021-01-01T00:00:00.000Z</LastModified></Contents>` +
+					`</ListBucketResult>`))
+			case http.MethodGet:
+				w.Header().Set("Content-Length", "5")
+				_, _ = w.Write([]byte("hello"))
+			case http.MethodPut:
+				data, _ := ioutil.ReadAll(r.Body)
+				w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+				w.WriteHeader(http.StatusOK)
+			default:
+				w.WriteHeader(http.StatusNotImplemented)
+			}
+		}))
+
+		fs, err := vfs.NewS3Fs("", os.TempDir(), vfs.S3FsConfig{
+			Bucket:        "bucket",
+			Region:        "us-east-1",
+			Endpoint:      server.URL,
+			RequesterPays: requesterPays,
+		})
+		require.NoError(t, err)
+
+		_, err = fs.Stat("file")
+		assert.NoError(t, err)
+		_, err = fs.ReadDir("/")
+		assert.NoError(t, err)
+		_, r, cancelFn, err := fs.Open("file", 0)
+		if assert.NoError(t, err) {
+			data, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("hello"), data)
+			cancelFn()
+		}
+		_, w, cancelFn, err := fs.Create("upload", 0)
+		if assert.NoError(t, err) {
+			_, err = w.Write([]byte("hello"))
+			assert.NoError(t, err)
+			assert.NoError(t, w.Close())
+			cancelFn()
+		}
+		server.Close()
+
+		expected := ""
+		if requesterPays {
+			expected = "requester"
+		}
+		mu.Lock()
+		for _, operation := range []string{http.MethodHead, "LIST", http.MethodGet, http.MethodPut} {
+			if assert.NotEmpty(t, headers[operation], operation) {
+				for _, value := range headers[operation] {
+					assert.Equal(t, expected, value, "operation %v, requester pays %v", operation, requesterPays)
+				}
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func TestUploadIntegrityCheck(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	parts := make(map[string]map[int][]byte)
+	corrupt := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		data, _ := ioutil.ReadAll(r.Body)
+		if corrupt && len(data) > 0 {
+			data[0]++
+		}
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodHead:
+			etag, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost && query.Get("uploadId") == "":
+			_, _ = w.Write([]byte(`<InitiateMultipartUploadResult><UploadId>upload-id</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == http.MethodPut && query.Get("uploadId") != "":
+			sum := md5.Sum(data)
+			// parts are uploaded concurrently, they must be combined using the part number order
+			partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+			if _, ok := parts[r.URL.Path]; !ok {
+				parts[r.URL.Path] = make(map[int][]byte)
+			}
+			parts[r.URL.Path][partNumber] = sum[:]
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum))
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost:
+			h := md5.New()
+			for idx := 1; idx <= len(parts[r.URL.Path]); idx++ {
+				h.Write(parts[r.URL.Path][idx]) //nolint:errcheck
+			}
+			objects[r.URL.Path] = fmt.Sprintf(`"%x-%v"`, h.Sum(nil), len(parts[r.URL.Path]))
+			delete(parts, r.URL.Path)
+			_, _ = w.Write([]byte(`<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`))
+		case r.Method == http.MethodPut:
+			objects[r.URL.Path] = fmt.Sprintf(`"%x"`, md5.Sum(data))
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "access_key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "access_secret")
+	defer func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	}()
+	vfs.SetUploadIntegrityCheck(true)
+	defer vfs.SetUploadIntegrityCheck(false)
+
+	fs, err := vfs.NewS3Fs("", os.TempDir(), vfs.S3FsConfig{
+		Bucket:         "bucket",
+		Region:         "us-east-1",
+		Endpoint:       server.URL,
+		UploadPartSize: 5,
+	})
+	require.NoError(t, err)
+
+	upload := func(name string, size int) error {
+		_, w, _, err := fs.Create(name, 0)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bytes.Repeat([]byte("a"), size))
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	}
+	// single part upload
+	err = upload("/file", 100)
+	assert.NoError(t, err)
+	// multipart upload
+	err = upload("/multipart", 5*1024*1024+100)
+	assert.NoError(t, err)
+
+	mu.Lock()
+	corrupt = true
+	mu.Unlock()
+	err = upload("/corrupted", 100)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), vfs.ErrIntegrityCheckFailed.Error())
+	}
+	err = upload("/corrupted_multipart", 5*1024*1024+100)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), vfs.ErrIntegrityCheckFailed.Error())
+	}
+	mu.Lock()
+	assert.Contains(t, objects, "/bucket/file")
+	assert.Contains(t, objects, "/bucket/multipart")
+	assert.NotContains(t, objects, "/bucket/corrupted")
+	assert.NotContains(t, objects, "/bucket/corrupted_multipart")
+	mu.Unlock()
+}
+
+func TestS3ServerSideEncryption(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	var sseHeaders []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		_, _ = ioutil.ReadAll(r.Body)
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodHead:
+			etag, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Content-Length", "0")
+			w.Header().Set("Last-Modified", "Fri, 01 Jan 2021 00:00:00 GMT")
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost && query.Get("uploadId") == "":
+			sseHeaders = append(sseHeaders, r.Header.Get("X-Amz-Server-Side-Encryption")+" "+
+				r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+			_, _ = w.Write([]byte(`<InitiateMultipartUploadResult><UploadId>upload-id</UploadId></InitiateMultipartUploadResult>`))
+		case r.Method == http.MethodPut && query.Get("uploadId") != "":
+			w.Header().Set("ETag", `"0123456789abcdef0123456789abcdef"`)
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost:
+			// the ETag of SSE-KMS encrypted objects is not an MD5 digest of their data
+			objects[r.URL.Path] = `"0123456789abcdef0123456789abcdef-2"`
+			_, _ = w.Write([]byte(`<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`))
+		case r.Method == http.MethodPut:
+			sseHeaders = append(sseHeaders, r.Header.Get("X-Amz-Server-Side-Encryption")+" "+
+				r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+			objects[r.URL.Path] = `"0123456789abcdef0123456789abcdef"`
+			if r.Header.Get("X-Amz-Copy-Source") != "" {
+				_, _ = w.Write([]byte(`<CopyObjectResult><LastModified>2021-01-01T00:00:00.000Z</LastModified><ETag>"etag"</ETag></CopyObjectResult>`))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "access_key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "access_secret")
+	defer func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	}()
+	// the integrity check is skipped for SSE-KMS
+	vfs.SetUploadIntegrityCheck(true)
+	defer vfs.SetUploadIntegrityCheck(false)
+
+	config := vfs.S3FsConfig{
+		Bucket:         "bucket",
+		Region:         "us-east-1",
+		Endpoint:       server.URL,
+		UploadPartSize: 5,
+		SSEEncryption:  vfs.S3SSEKMS,
+	}
+	_, err := vfs.NewS3Fs("", os.TempDir(), config)
+	assert.Error(t, err)
+	config.SSEKMSKeyID = "alias/sftpgo"
+	fs, err := vfs.NewS3Fs("", os.TempDir(), config)
+	require.NoError(t, err)
+
+	upload := func(name string, size int) error {
+		_, w, _, err := fs.Create(name, 0)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bytes.Repeat([]byte("a"), size))
+		if err != nil {
+			return err
+		}
+		return w.Close()
+	}
+	err = upload("/file", 100)
+	assert.NoError(t, err)
+	err = upload("/multipart", 5*1024*1024+100)
+	assert.NoError(t, err)
+	err = fs.Rename("/file", "/renamed")
+	assert.NoError(t, err)
+	mu.Lock()
+	assert.Equal(t, []string{"aws:kms alias/sftpgo", "aws:kms alias/sftpgo", "aws:kms alias/sftpgo"}, sseHeaders)
+	assert.Contains(t, objects, "/bucket/renamed")
+	sseHeaders = nil
+	mu.Unlock()
+
+	config.SSEEncryption = vfs.S3SSEAES256
+	config.SSEKMSKeyID = ""
+	fs, err = vfs.NewS3Fs("", os.TempDir(), config)
+	require.NoError(t, err)
+	vfs.SetUploadIntegrityCheck(false)
+	err = upload("/file", 100)
+	assert.NoError(t, err)
+	mu.Lock()
+	assert.Equal(t, []string{"AES256 "}, sseHeaders)
+	mu.Unlock()
+}
+
+func TestBackendTimeouts(t *testing.T) {
+	done := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "" {
+			// send some data and then stall
+			w.Header().Set("Content-Length", "100")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("0123456789"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer func() {
+		close(done)
+		server.Close()
+	}()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "access_key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "access_secret")
+	defer func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	}()
+	vfs.SetBackendTimeouts(vfs.BackendTimeouts{
+		Metadata:     1,
+		LongMetadata: 1,
+		TransferIdle: 1,
+	})
+	defer vfs.SetBackendTimeouts(Config.BackendTimeouts)
+
+	fs, err := vfs.NewS3Fs("", os.TempDir(), vfs.S3FsConfig{
+		Bucket:   "bucket",
+		Region:   "us-east-1",
+		Endpoint: server.URL,
+	})
+	require.NoError(t, err)
+
+	startTime := time.Now()
+	_, err = fs.Stat("/file")
+	assert.Error(t, err)
+	_, err = fs.ReadDir("/")
+	assert.Error(t, err)
+	_, _, err = fs.ScanRootDirContents()
+	assert.Error(t, err)
+	assert.Less(t, time.Since(startTime).Seconds(), float64(10))
+
+	startTime = time.Now()
+	_, r, cancelFn, err := fs.Open("/file", 0)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.EqualError(t, err, vfs.ErrTransferStalled.Error())
+	assert.Less(t, time.Since(startTime).Seconds(), float64(10))
+	cancelFn()
+	err = r.Close()
+	assert.NoError(t, err)
+}
+
+func TestUploadAutoCreateDirs(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case http.MethodHead:
+			if objects[strings.TrimPrefix(r.URL.Path, "/bucket/")] {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			_, _ = ioutil.ReadAll(r.Body)
+			objects[strings.TrimPrefix(r.URL.Path, "/bucket/")] = true
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			prefix := r.URL.Query().Get("prefix")
+			delimiter := r.URL.Query().Get("delimiter")
+			var contents, prefixes []string
+			for key := range objects {
+				if !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				rest := strings.TrimPrefix(key, prefix)
+				if idx := strings.Index(rest, "/"); delimiter != "" && idx >= 0 {
+					commonPrefix := prefix + rest[:idx+1]
+					if !utils.IsStringInSlice(commonPrefix, prefixes) {
+						prefixes = append(prefixes, commonPrefix)
+					}
+					continue
+				}
+				contents = append(contents, key)
+			}
+			var sb strings.Builder
+			sb.WriteString(`<ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>`)
+			for _, key := range contents {
+				sb.WriteString(fmt.Sprintf(`<Contents><Key>%v</Key><Size>0</Size><LastModified>2021-01-01T00:00:00.000Z</LastModified></Contents>`,
+					key))
+			}
+			for _, p := range prefixes {
+				sb.WriteString(fmt.Sprintf(`<CommonPrefixes><Prefix>%v</Prefix></CommonPrefixes>`, p))
+			}
+			sb.WriteString(`</ListBucketResult>`)
+			_, _ = w.Write([]byte(sb.String()))
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "access_key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "access_secret")
+	defer func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	}()
+
+	localHome := filepath.Join(os.TempDir(), "autocreatedirs")
+	err := os.MkdirAll(localHome, os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(localHome)
+
+	s3Fs, err := vfs.NewS3Fs("", os.TempDir(), vfs.S3FsConfig{
+		Bucket:   "bucket",
+		Region:   "us-east-1",
+		Endpoint: server.URL,
+	})
+	require.NoError(t, err)
+
+	for _, fs := range []vfs.Fs{vfs.NewOsFs("", localHome, nil), s3Fs} {
+		user := dataprovider.User{
+			Username: userTestUsername,
+			HomeDir:  localHome,
+		}
+		user.Permissions = make(map[string][]string)
+		user.Permissions["/"] = []string{dataprovider.PermAny}
+		user.Permissions["/denied"] = []string{dataprovider.PermListItems, dataprovider.PermUpload}
+		conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+		// the parent directory exists
+		assert.NoError(t, conn.CheckUploadDir("/file"))
+		// auto creation is disabled
+		err = conn.CheckUploadDir("/incoming/sub1/sub2/file")
+		assert.Equal(t, sftp.ErrSSHFxNoSuchFile, err, "fs: %v", fs.Name())
+
+		conn.User.Filters.AutoCreateDirs = []string{"/incoming", "/denied"}
+		err = conn.CheckUploadDir("/other/file")
+		assert.Equal(t, sftp.ErrSSHFxNoSuchFile, err, "fs: %v", fs.Name())
+		err = conn.CheckUploadDir("/incoming/sub1/sub2/file")
+		assert.NoError(t, err, "fs: %v", fs.Name())
+		for _, dir := range []string{"/incoming", "/incoming/sub1", "/incoming/sub1/sub2"} {
+			fsPath, err := fs.ResolvePath(dir)
+			assert.NoError(t, err)
+			info, err := fs.Stat(fsPath)
+			if assert.NoError(t, err, "fs: %v, dir: %v", fs.Name(), dir) {
+				assert.True(t, info.IsDir())
+			}
+		}
+		assert.NoError(t, conn.CheckUploadDir("/incoming/sub1/sub2/file"))
+		// the create dirs permission is required
+		err = conn.CheckUploadDir("/denied/sub/file")
+		assert.Equal(t, sftp.ErrSSHFxPermissionDenied, err, "fs: %v", fs.Name())
+	}
+}
+
+func TestRecursionLimits(t *testing.T) {
+	assert.Equal(t, 0, getWalkDepth("/", "/"))
+	assert.Equal(t, 1, getWalkDepth("/", "/a"))
+	assert.Equal(t, 2, getWalkDepth("/", "/a/b"))
+	assert.Equal(t, 1, getWalkDepth("/a", "/a/b"))
+	assert.Equal(t, 3, getWalkDepth("/a", "/a/b/c/d"))
+
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  filepath.Join(os.TempDir(), "recursionhome"),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	err := os.MkdirAll(filepath.Join(user.GetHomeDir(), "a", "b", "c"), os.ModePerm)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), "a", "file"), []byte("data"), os.ModePerm)
+	assert.NoError(t, err)
+	fs := vfs.NewOsFs("", user.GetHomeDir(), nil)
+	c := NewBaseConnection("", ProtocolSFTP, user, fs)
+	visited := 0
+	walkFn := func(walkedPath string, info os.FileInfo, err error) error {
+		visited++
+		return err
+	}
+	// no limits
+	err = c.Walk(user.GetHomeDir(), walkFn)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, visited)
+	assert.NoError(t, c.CheckRecursionLimits(user.GetHomeDir()))
+
+	c.User.Filters.MaxRecursionDepth = 2
+	err = c.Walk(user.GetHomeDir(), walkFn)
+	assert.Equal(t, ErrRecursionLimit, err)
+	assert.Equal(t, ErrRecursionLimit, c.CheckRecursionLimits(user.GetHomeDir()))
+	assert.NoError(t, c.CheckRecursionLimits(filepath.Join(user.GetHomeDir(), "a")))
+
+	c.User.Filters.MaxRecursionDepth = 0
+	c.User.Filters.MaxRecursionEntries = 3
+	assert.Equal(t, ErrRecursionLimit, c.CheckRecursionLimits(user.GetHomeDir()))
+	assert.NoError(t, c.CheckRecursionLimits(filepath.Join(user.GetHomeDir(), "a")))
+	// the limit error is returned to the SFTP clients too
+	assert.Equal(t, ErrRecursionLimit, c.GetFsError(ErrRecursionLimit))
+	c.protocol = ProtocolFTP
+	assert.Equal(t, ErrRecursionLimit, c.GetFsError(ErrRecursionLimit))
+
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	oldMaxOpenFiles := Config.MaxOpenFiles
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  os.TempDir(),
+	}
+	fs := vfs.NewOsFs("", user.GetHomeDir(), nil)
+	c := NewBaseConnection("", ProtocolFTP, user, fs)
+	assert.Equal(t, 0, c.GetMaxOpenFiles())
+	assert.NoError(t, c.CheckOpenFilesLimit())
+	Config.MaxOpenFiles = 1
+	assert.Equal(t, 1, c.GetMaxOpenFiles())
+	assert.NoError(t, c.CheckOpenFilesLimit())
+	transfer := NewBaseTransfer(nil, c, nil, filepath.Join(os.TempDir(), "file"), "/file", TransferDownload,
+		0, 0, 0, false, fs)
+	assert.Equal(t, ErrTooManyOpenFiles, c.CheckOpenFilesLimit())
+	// the user setting overrides the global one
+	c.User.Filters.MaxOpenFiles = 2
+	assert.Equal(t, 2, c.GetMaxOpenFiles())
+	assert.NoError(t, c.CheckOpenFilesLimit())
+	c.User.Filters.MaxOpenFiles = 0
+	assert.Equal(t, ErrTooManyOpenFiles, c.GetGenericError(c.CheckOpenFilesLimit()))
+	err := transfer.Close()
+	assert.NoError(t, err)
+	assert.NoError(t, c.CheckOpenFilesLimit())
+
+	Config.MaxOpenFiles = oldMaxOpenFiles
+}
+
+func TestMaxConcurrentTransfers(t *testing.T) {
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  os.TempDir(),
+	}
+	user.Filters.MaxConcurrentUploads = 1
+	user.Filters.MaxConcurrentDownloads = 2
+	fs := vfs.NewOsFs("", user.GetHomeDir(), nil)
+	c1 := NewBaseConnection("id1", ProtocolSFTP, user, fs)
+	c2 := NewBaseConnection("id2", ProtocolFTP, user, fs)
+	Connections.Add(&fakeConnection{BaseConnection: c1})
+	Connections.Add(&fakeConnection{BaseConnection: c2})
+	otherUser := user
+	otherUser.Username = "other_user"
+	c3 := NewBaseConnection("id3", ProtocolSFTP, otherUser, fs)
+	Connections.Add(&fakeConnection{BaseConnection: c3})
+
+	assert.NoError(t, c1.CheckConcurrentTransfersLimit(TransferUpload))
+	assert.NoError(t, c1.CheckConcurrentTransfersLimit(TransferDownload))
+	upload := NewBaseTransfer(nil, c1, nil, filepath.Join(os.TempDir(), "file"), "/file", TransferUpload,
+		0, 0, 0, false, fs)
+	// the limit applies to all the user sessions and the uploads and downloads are independent
+	assert.Equal(t, ErrTooManyUploads, c1.CheckConcurrentTransfersLimit(TransferUpload))
+	assert.Equal(t, ErrTooManyUploads, c2.GetGenericError(c2.CheckConcurrentTransfersLimit(TransferUpload)))
+	assert.NoError(t, c3.CheckConcurrentTransfersLimit(TransferUpload))
+	assert.NoError(t, c2.CheckConcurrentTransfersLimit(TransferDownload))
+	download1 := NewBaseTransfer(nil, c2, nil, filepath.Join(os.TempDir(), "file1"), "/file1", TransferDownload,
+		0, 0, 0, false, fs)
+	assert.NoError(t, c1.CheckConcurrentTransfersLimit(TransferDownload))
+	download2 := NewBaseTransfer(nil, c1, nil, filepath.Join(os.TempDir(), "file2"), "/file2", TransferDownload,
+		0, 0, 0, false, fs)
+	assert.Equal(t, ErrTooManyDownloads, c1.CheckConcurrentTransfersLimit(TransferDownload))
+	assert.Equal(t, ErrTooManyDownloads, c2.CheckConcurrentTransfersLimit(TransferDownload))
+	// an already created transfer does not count itself
+	assert.NoError(t, download2.CheckConcurrentTransfersLimit())
+	assert.NoError(t, upload.CheckConcurrentTransfersLimit())
+	err := download1.Close()
+	assert.NoError(t, err)
+	assert.NoError(t, c2.CheckConcurrentTransfersLimit(TransferDownload))
+	// 0 means unlimited
+	c1.User.Filters.MaxConcurrentUploads = 0
+	assert.NoError(t, c1.CheckConcurrentTransfersLimit(TransferUpload))
+	err = download2.Close()
+	assert.NoError(t, err)
+	err = upload.Close()
+	assert.NoError(t, err)
+	assert.NoError(t, c2.CheckConcurrentTransfersLimit(TransferUpload))
+
+	Connections.Remove(c1.GetID())
+	Connections.Remove(c2.GetID())
+	Connections.Remove(c3.GetID())
+	assert.Len(t, Connections.GetStats(), 0)
+}
+
+func TestTextTransforms(t *testing.T) {
+	bom := "\xEF\xBB\xBF"
+	testCases := []struct {
+		lineEndings string
+		stripBOM    bool
+		input       string
+		expected    string
+	}{
+		{vfs.TextLineEndingsLF, false, "a\r\nb\r\nc\rd\n", "a\nb\nc\rd\n"},
+		{vfs.TextLineEndingsLF, false, "a\r\n\r\n\r", "a\n\n\r"},
+		{vfs.TextLineEndingsCRLF, false, "a\nb\r\nc\rd\n\n", "a\r\nb\r\nc\rd\r\n\r\n"},
+		{vfs.TextLineEndingsLF, true, bom + "a\r\nb", "a\nb"},
+		{vfs.TextLineEndingsCRLF, true, bom + "a\nb", "a\r\nb"},
+		{"", true, bom + "a\r\nb\n", "a\r\nb\n"},
+		{"", true, bom[:2], bom[:2]},
+		{"", true, "a" + bom, "a" + bom},
+		{vfs.TextLineEndingsLF, false, bom + "a\r\n", bom + "a\n"},
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	for idx, tc := range testCases {
+		// small chunks test the sequences spanning two writes too
+		for _, chunkSize := range []int{1, 2, 1024} {
+			f, err := os.Create(filepath.Join(dir, fmt.Sprintf("file%v.txt", idx)))
+			require.NoError(t, err)
+			file := vfs.NewTextTransformFile(f, tc.lineEndings, tc.stripBOM)
+			input := []byte(tc.input)
+			for i := 0; i < len(input); i += chunkSize {
+				end := i + chunkSize
+				if end > len(input) {
+					end = len(input)
+				}
+				n, err := file.Write(input[i:end])
+				assert.NoError(t, err)
+				assert.Equal(t, end-i, n)
+			}
+			err = file.Close()
+			assert.NoError(t, err)
+			data, err := ioutil.ReadFile(f.Name())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, string(data), "test case %v, chunk size %v", idx, chunkSize)
+		}
+	}
+	// out of order writes
+	f, err := os.Create(filepath.Join(dir, "file.txt"))
+	require.NoError(t, err)
+	file := vfs.NewTextTransformFile(f, vfs.TextLineEndingsCRLF, false)
+	_, err = file.WriteAt([]byte("c\n"), 4)
+	assert.NoError(t, err)
+	_, err = file.WriteAt([]byte("b\n"), 2)
+	assert.NoError(t, err)
+	offset, err := file.Seek(0, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+	_, err = file.WriteAt([]byte("a\n"), 0)
+	assert.NoError(t, err)
+	offset, err = file.Seek(0, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), offset)
+	_, err = file.WriteAt([]byte("a"), 0)
+	assert.Error(t, err)
+	_, err = file.Seek(0, io.SeekStart)
+	assert.Equal(t, vfs.ErrVfsUnsupported, err)
+	assert.Equal(t, vfs.ErrVfsUnsupported, file.Truncate(0))
+	err = file.Close()
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "a\r\nb\r\nc\r\n", string(data))
+	// a missing chunk must be reported
+	f, err = os.Create(filepath.Join(dir, "file.txt"))
+	require.NoError(t, err)
+	file = vfs.NewTextTransformFile(f, vfs.TextLineEndingsLF, false)
+	_, err = file.WriteAt([]byte("b\r\n"), 3)
+	assert.NoError(t, err)
+	err = file.Close()
+	assert.Error(t, err)
+
+	err = os.RemoveAll(dir)
+	assert.NoError(t, err)
+}
+
+func TestTextTransformFilter(t *testing.T) {
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  os.TempDir(),
+	}
+	user.Filters.TextTransforms = []dataprovider.TextTransformFilter{
+		{
+			Path:        "/",
+			Extensions:  []string{".txt"},
+			LineEndings: vfs.TextLineEndingsLF,
+		},
+		{
+			Path:        "/edi",
+			Extensions:  []string{".edi"},
+			LineEndings: vfs.TextLineEndingsCRLF,
+			StripBOM:    true,
+		},
+	}
+	filter, ok := user.GetTextTransform("/file.TXT")
+	assert.True(t, ok)
+	assert.Equal(t, vfs.TextLineEndingsLF, filter.LineEndings)
+	filter, ok = user.GetTextTransform("/edi/sub/file.edi")
+	assert.True(t, ok)
+	assert.Equal(t, vfs.TextLineEndingsCRLF, filter.LineEndings)
+	assert.True(t, filter.StripBOM)
+	// the most specific directory wins
+	_, ok = user.GetTextTransform("/edi/file.txt")
+	assert.False(t, ok)
+	_, ok = user.GetTextTransform("/file.bin")
+	assert.False(t, ok)
+
+	fs := vfs.NewOsFs("", user.GetHomeDir(), nil)
+	c := NewBaseConnection("", ProtocolSFTP, user, fs)
+	binaryData := []byte("\xEF\xBB\xBF\x00\x01\r\n\x02\n\xff")
+	for _, name := range []string{"file.bin", "file.txt"} {
+		fsPath := filepath.Join(user.GetHomeDir(), name)
+		f, err := os.Create(fsPath)
+		require.NoError(t, err)
+		transfer := NewBaseTransfer(f, c, nil, fsPath, "/"+name, TransferUpload, 0, 0, 0, true, fs)
+		_, err = transfer.File.WriteAt(binaryData, 0)
+		assert.NoError(t, err)
+		err = transfer.File.Close()
+		assert.NoError(t, err)
+		err = transfer.Close()
+		assert.NoError(t, err)
+		data, err := ioutil.ReadFile(fsPath)
+		assert.NoError(t, err)
+		if name == "file.bin" {
+			// files with other extensions are not touched
+			assert.Equal(t, binaryData, data)
+		} else {
+			assert.Equal(t, []byte("\xEF\xBB\xBF\x00\x01\n\x02\n\xff"), data)
+		}
+		err = os.Remove(fsPath)
+		assert.NoError(t, err)
+	}
+	// resumed uploads are not converted
+	fsPath := filepath.Join(user.GetHomeDir(), "file.txt")
+	f, err := os.Create(fsPath)
+	require.NoError(t, err)
+	transfer := NewBaseTransfer(f, c, nil, fsPath, "/file.txt", TransferUpload, 10, 10, 0, false, fs)
+	assert.Equal(t, f, transfer.File)
+	err = f.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.NoError(t, err)
+	err = os.Remove(fsPath)
+	assert.NoError(t, err)
+}
+
+// renameTestObjectStore is a minimal in memory object store, it can be served using the S3
+// or the Azure Blob protocol. Keys are mapped to their content type
+type renameTestObjectStore struct {
+	sync.Mutex
+	objects map[string]string
+}
+
+func (s *renameTestObjectStore) list(prefix, delimiter string) ([]string, []string) {
+	var contents, prefixes []string
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if idx := strings.Index(rest, "/"); delimiter != "" && idx >= 0 {
+			commonPrefix := prefix + rest[:idx+1]
+			if !utils.IsStringInSlice(commonPrefix, prefixes) {
+				prefixes = append(prefixes, commonPrefix)
+			}
+			continue
+		}
+		contents = append(contents, key)
+	}
+	return contents, prefixes
+}
+
+func (s *renameTestObjectStore) serveS3(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch r.Method {
+	case http.MethodHead:
+		contentType, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Last-Modified", "Fri, 01 Jan 2021 00:00:00 GMT")
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		_, _ = ioutil.ReadAll(r.Body)
+		if copySource := r.Header.Get("X-Amz-Copy-Source"); copySource != "" {
+			source, err := url.PathUnescape(copySource)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			s.objects[key] = s.objects[strings.TrimPrefix(source, "bucket/")]
+			_, _ = w.Write([]byte(`<CopyObjectResult><LastModified>2021-01-01T00:00:00.000Z</LastModified><ETag>"etag"</ETag></CopyObjectResult>`))
+			return
+		}
+		s.objects[key] = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		contents, prefixes := s.list(r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+		var sb strings.Builder
+		sb.WriteString(`<ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>`)
+		for _, key := range contents {
+			sb.WriteString(fmt.Sprintf(`<Contents><Key>%v</Key><Size>0</Size><LastModified>2021-01-01T00:00:00.000Z</LastModified></Contents>`,
+				key))
+		}
+		for _, p := range prefixes {
+			sb.WriteString(fmt.Sprintf(`<CommonPrefixes><Prefix>%v</Prefix></CommonPrefixes>`, p))
+		}
+		sb.WriteString(`</ListBucketResult>`)
+		_, _ = w.Write([]byte(sb.String()))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (s *renameTestObjectStore) serveAzure(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/container/")
+	switch r.Method {
+	case http.MethodHead:
+		contentType, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Last-Modified", "Fri, 01 Jan 2021 00:00:00 GMT")
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		_, _ = ioutil.ReadAll(r.Body)
+		copySource := r.Header.Get("x-ms-copy-source")
+		if copySource == "" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		u, err := url.Parse(copySource)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = s.objects[strings.TrimPrefix(u.Path, "/container/")]
+		w.Header().Set("x-ms-copy-id", "copyid")
+		w.Header().Set("x-ms-copy-status", "success")
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodGet:
+		prefix := r.URL.Query().Get("prefix")
+		contents, prefixes := s.list(prefix, r.URL.Query().Get("delimiter"))
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="container"><Prefix>%v</Prefix><Blobs>`,
+			prefix))
+		for _, key := range contents {
+			sb.WriteString(fmt.Sprintf(`<Blob><Name>%v</Name><Properties><Content-Length>0</Content-Length><Content-Type>%v</Content-Type></Properties></Blob>`,
+				key, s.objects[key]))
+		}
+		for _, p := range prefixes {
+			sb.WriteString(fmt.Sprintf(`<BlobPrefix><Name>%v</Name></BlobPrefix>`, p))
+		}
+		sb.WriteString(`</Blobs><NextMarker /></EnumerationResults>`)
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(sb.String()))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestRenameRequireTargetDir(t *testing.T) {
+	s3Store := &renameTestObjectStore{
+		objects: map[string]string{
+			"file.txt":            "text/plain",
+			"placeholder/":        "inode/directory",
+			"withchild/child.txt": "text/plain",
+		},
+	}
+	s3Server := httptest.NewServer(http.HandlerFunc(s3Store.serveS3))
+	defer s3Server.Close()
+
+	azStore := &renameTestObjectStore{
+		objects: map[string]string{
+			"file.txt":            "text/plain",
+			"placeholder":         "inode/directory",
+			"withchild/child.txt": "text/plain",
+		},
+	}
+	azServer := httptest.NewServer(http.HandlerFunc(azStore.serveAzure))
+	defer azServer.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "access_key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "access_secret")
+	defer func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	}()
+
+	localHome := filepath.Join(os.TempDir(), "renametargetdir")
+	err := os.MkdirAll(filepath.Join(localHome, "placeholder"), os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(localHome)
+	err = os.MkdirAll(filepath.Join(localHome, "withchild"), os.ModePerm)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localHome, "withchild", "child.txt"), []byte("child"), os.ModePerm)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localHome, "file.txt"), []byte("file"), os.ModePerm)
+	require.NoError(t, err)
+
+	s3Fs, err := vfs.NewS3Fs("", os.TempDir(), vfs.S3FsConfig{
+		Bucket:   "bucket",
+		Region:   "us-east-1",
+		Endpoint: s3Server.URL,
+	})
+	require.NoError(t, err)
+	azFs, err := vfs.NewAzBlobFs("", os.TempDir(), vfs.AzBlobFsConfig{
+		SASURL: azServer.URL + "/container?sv=2019-12-12&sig=signature",
+	})
+	require.NoError(t, err)
+
+	rename := func(conn *BaseConnection, source, target string) error {
+		fsSource, err := conn.Fs.ResolvePath(source)
+		require.NoError(t, err)
+		fsTarget, err := conn.Fs.ResolvePath(target)
+		require.NoError(t, err)
+		return conn.Rename(fsSource, fsTarget, source, target)
+	}
+
+	for _, fs := range []vfs.Fs{vfs.NewOsFs("", localHome, nil), s3Fs, azFs} {
+		user := dataprovider.User{
+			Username: userTestUsername,
+			HomeDir:  localHome,
+		}
+		user.Permissions = make(map[string][]string)
+		user.Permissions["/"] = []string{dataprovider.PermAny}
+		user.Filters.RequireRenameTargetDir = true
+		conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+
+		err = rename(conn, "/file.txt", "/missing/file.txt")
+		if assert.Error(t, err, fs.Name()) {
+			assert.EqualError(t, err, sftp.ErrSSHFxNoSuchFile.Error(), fs.Name())
+		}
+		err = rename(conn, "/file.txt", "/placeholder/file.txt")
+		assert.NoError(t, err, fs.Name())
+		err = rename(conn, "/placeholder/file.txt", "/withchild/file.txt")
+		assert.NoError(t, err, fs.Name())
+		_, isOsFs := fs.(*vfs.OsFs)
+		if !isOsFs {
+			// the target parent is a file, the local filesystem already fails while resolving the path
+			err = rename(conn, "/withchild/child.txt", "/withchild/file.txt/child.txt")
+			if assert.Error(t, err, fs.Name()) {
+				assert.EqualError(t, err, sftp.ErrSSHFxNoSuchFile.Error(), fs.Name())
+			}
+		}
+		err = rename(conn, "/withchild/file.txt", "/file.txt")
+		assert.NoError(t, err, fs.Name())
+
+		conn.User.Filters.RequireRenameTargetDir = false
+		err = rename(conn, "/file.txt", "/missing/file.txt")
+		if isOsFs {
+			// the local filesystem never creates missing directories on rename
+			assert.Error(t, err)
+		} else {
+			// Cloud Storage backends have no real directories, so the rename succeeds
+			assert.NoError(t, err, fs.Name())
+		}
+	}
+}
+
+func TestPathSchema(t *testing.T) {
+	localHome := filepath.Join(os.TempDir(), "pathschema")
+	err := os.MkdirAll(localHome, os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(localHome)
+
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  localHome,
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Filters.PathSchemas = []dataprovider.PathSchemaFilter{
+		{
+			Path:   "/intake",
+			Schema: "{customer}/{year}",
+			Variables: map[string][]string{
+				"customer": {"acme", "globex"},
+				"year":     {"^20[0-9]{2}$"},
+			},
+		},
+		{
+			Path:   "/intake/special",
+			Schema: "incoming/{any}",
+		},
+	}
+	fs := vfs.NewOsFs("", localHome, nil)
+	conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+
+	testCases := []struct {
+		virtualPath string
+		isDir       bool
+		allowed     bool
+	}{
+		{"/file", false, true},
+		{"/other/dir", true, true},
+		{"/intake", true, true},
+		{"/intake/file", false, false},
+		{"/intake/acme", true, true},
+		{"/intake/globex", true, true},
+		{"/intake/initech", true, false},
+		{"/intake/acme/file", false, false},
+		{"/intake/acme/2021", true, true},
+		{"/intake/acme/1999", true, false},
+		{"/intake/acme/20211", true, false},
+		{"/intake/acme/2021/file.csv", false, true},
+		{"/intake/acme/2021/sub", true, false},
+		{"/intake/acme/2021/sub/file.csv", false, false},
+		{"/intake/initech/2021/file.csv", false, false},
+		{"/intake/special", true, false},
+		{"/intake/special/incoming", true, true},
+		{"/intake/special/outgoing", true, false},
+		{"/intake/special/incoming/anything", true, true},
+		{"/intake/special/incoming/anything/file", false, true},
+		{"/intake/special/incoming/file", false, false},
+	}
+	for _, tc := range testCases {
+		err = conn.IsPathSchemaAllowed(tc.virtualPath, tc.isDir)
+		if tc.allowed {
+			assert.NoError(t, err, "path: %v", tc.virtualPath)
+		} else {
+			assert.Equal(t, ErrPathSchemaMismatch, err, "path: %v", tc.virtualPath)
+		}
+	}
+	for _, protocol := range supportedProtocols {
+		conn.SetProtocol(protocol)
+		err = conn.IsPathSchemaAllowed("/intake/file", false)
+		assert.Equal(t, ErrPathSchemaMismatch, err)
+	}
+	conn.SetProtocol(ProtocolSFTP)
+
+	for _, dir := range []string{"/intake", "/intake/acme", "/intake/acme/2021"} {
+		err = conn.CreateDir(filepath.Join(localHome, dir), dir)
+		assert.NoError(t, err)
+	}
+	err = conn.CreateDir(filepath.Join(localHome, "intake", "initech"), "/intake/initech")
+	assert.Equal(t, ErrPathSchemaMismatch, err)
+	assert.NoDirExists(t, filepath.Join(localHome, "intake", "initech"))
+	// the missing directories created on upload must match the schema too
+	conn.User.Filters.AutoCreateDirs = []string{"/intake"}
+	err = conn.CheckUploadDir("/intake/globex/2022/file.csv")
+	assert.NoError(t, err)
+	assert.DirExists(t, filepath.Join(localHome, "intake", "globex", "2022"))
+	err = conn.CheckUploadDir("/intake/globex/22/file.csv")
+	assert.Equal(t, ErrPathSchemaMismatch, err)
+	assert.NoDirExists(t, filepath.Join(localHome, "intake", "globex", "22"))
+	// renames and symlinks cannot bypass the schema
+	err = ioutil.WriteFile(filepath.Join(localHome, "file.csv"), []byte("data"), os.ModePerm)
+	require.NoError(t, err)
+	err = conn.Rename(filepath.Join(localHome, "file.csv"), filepath.Join(localHome, "intake", "file.csv"),
+		"/file.csv", "/intake/file.csv")
+	assert.Equal(t, ErrPathSchemaMismatch, err)
+	err = conn.CreateSymlink(filepath.Join(localHome, "file.csv"), filepath.Join(localHome, "intake", "acme", "link"),
+		"/file.csv", "/intake/acme/link")
+	assert.Equal(t, ErrPathSchemaMismatch, err)
+	err = os.Mkdir(filepath.Join(localHome, "initech"), os.ModePerm)
+	require.NoError(t, err)
+	err = conn.Rename(filepath.Join(localHome, "initech"), filepath.Join(localHome, "intake", "initech"),
+		"/initech", "/intake/initech")
+	assert.Equal(t, ErrPathSchemaMismatch, err)
+	err = conn.Rename(filepath.Join(localHome, "file.csv"), filepath.Join(localHome, "intake", "acme", "2021", "file.csv"),
+		"/file.csv", "/intake/acme/2021/file.csv")
+	assert.NoError(t, err)
+}
+
+func TestDiskSpaceChecks(t *testing.T) {
+	localHome := filepath.Join(os.TempDir(), "diskspacecheck")
+	err := os.MkdirAll(filepath.Join(localHome, "sub"), os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(localHome)
+
+	oldChecks := Config.DiskSpaceChecks
+	defer func() {
+		Config.DiskSpaceChecks = oldChecks
+	}()
+
+	checks := getValidDiskSpaceChecks([]DiskSpaceCheck{
+		{
+			Path:         "relative",
+			MinFreeSpace: 10,
+		},
+		{
+			Path:         localHome,
+			MinFreeSpace: -1,
+		},
+		{
+			Path:         localHome + string(filepath.Separator),
+			MinFreeSpace: 0,
+		},
+		{
+			Path:         filepath.Join(localHome, "sub"),
+			MinFreeSpace: math.MaxInt64 / 2,
+		},
+	})
+	require.Len(t, checks, 2)
+	assert.Equal(t, localHome, checks[0].Path)
+	Config.DiskSpaceChecks = checks
+	check, ok := Config.getDiskSpaceCheck(filepath.Join(localHome, "file.txt"))
+	assert.True(t, ok)
+	assert.Equal(t, localHome, check.Path)
+	check, ok = Config.getDiskSpaceCheck(filepath.Join(localHome, "sub", "file.txt"))
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(localHome, "sub"), check.Path)
+	_, ok = Config.getDiskSpaceCheck(localHome + "1")
+	assert.False(t, ok)
+
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  localHome,
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	conn := NewBaseConnection("", ProtocolFTP, user, vfs.NewOsFs("", localHome, nil))
+	err = conn.CheckDiskSpace(filepath.Join(localHome, "file.txt"), 0)
+	assert.NoError(t, err)
+	err = conn.CheckDiskSpace(filepath.Join(localHome, "file.txt"), math.MaxInt64/2)
+	assert.EqualError(t, err, ErrInsufficientDiskSpace.Error())
+	err = conn.CheckDiskSpace(filepath.Join(localHome, "sub", "file.txt"), 0)
+	assert.EqualError(t, err, ErrInsufficientDiskSpace.Error())
+	err = conn.CheckDiskSpace(filepath.Join(os.TempDir(), "file.txt"), math.MaxInt64/2)
+	assert.NoError(t, err)
+	conn = NewBaseConnection("", ProtocolSFTP, user, vfs.NewOsFs("", localHome, nil))
+	err = conn.CheckDiskSpace(filepath.Join(localHome, "sub", "file.txt"), 0)
+	assert.EqualError(t, err, ErrInsufficientDiskSpace.Error())
+	// the check is skipped if the available space cannot be read
+	Config.DiskSpaceChecks = []DiskSpaceCheck{
+		{
+			Path:         filepath.Join(localHome, "missing"),
+			MinFreeSpace: math.MaxInt64 / 2,
+		},
+	}
+	err = conn.CheckDiskSpace(filepath.Join(localHome, "missing", "file.txt"), 0)
+	assert.NoError(t, err)
+}
+
+func TestDirectoryFilesLimit(t *testing.T) {
+	localHome := filepath.Join(os.TempDir(), "dirfileslimit")
+	err := os.MkdirAll(filepath.Join(localHome, "inbox", "sub"), os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(localHome)
+
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  localHome,
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Filters.DirectoryFilesLimits = []dataprovider.DirectoryFilesLimitFilter{
+		{
+			Path:     "/inbox",
+			MaxFiles: 2,
+		},
+		{
+			Path:     "/inbox/unlimited",
+			MaxFiles: 0,
+		},
+	}
+	assert.Equal(t, 2, user.GetDirectoryFilesLimit("/inbox"))
+	assert.Equal(t, 2, user.GetDirectoryFilesLimit("/inbox/sub"))
+	assert.Equal(t, 0, user.GetDirectoryFilesLimit("/inbox/unlimited/sub"))
+	assert.Equal(t, 0, user.GetDirectoryFilesLimit("/"))
+
+	fs := vfs.NewOsFs("", localHome, nil)
+	conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+	// a missing directory contains no files
+	assert.NoError(t, conn.CheckDirectoryFilesLimit("/inbox/missing/file1"))
+	for _, name := range []string{"file1", "file2"} {
+		assert.NoError(t, conn.CheckDirectoryFilesLimit(path.Join("/inbox", name)))
+		err = ioutil.WriteFile(filepath.Join(localHome, "inbox", name), []byte("data"), os.ModePerm)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, ErrDirectoryFilesLimit, conn.CheckDirectoryFilesLimit("/inbox/file3"))
+	// overwriting an existing file is allowed and sub directories are not counted
+	assert.NoError(t, conn.CheckDirectoryFilesLimit("/inbox/file1"))
+	assert.NoError(t, conn.CheckDirectoryFilesLimit("/inbox/sub/file3"))
+	assert.NoError(t, conn.CheckDirectoryFilesLimit("/file3"))
+	for _, protocol := range supportedProtocols {
+		conn.SetProtocol(protocol)
+		assert.Equal(t, ErrDirectoryFilesLimit, conn.CheckDirectoryFilesLimit("/inbox/file3"))
+	}
+	conn.SetProtocol(ProtocolSFTP)
+	// renames inside the same directory are allowed, new files are denied
+	err = conn.Rename(filepath.Join(localHome, "inbox", "file1"), filepath.Join(localHome, "inbox", "file3"),
+		"/inbox/file1", "/inbox/file3")
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(localHome, "file4"), []byte("data"), os.ModePerm)
+	require.NoError(t, err)
+	err = conn.Rename(filepath.Join(localHome, "file4"), filepath.Join(localHome, "inbox", "file4"),
+		"/file4", "/inbox/file4")
+	assert.Equal(t, ErrDirectoryFilesLimit, err)
+	err = conn.CreateSymlink(filepath.Join(localHome, "file4"), filepath.Join(localHome, "inbox", "link"),
+		"/file4", "/inbox/link")
+	assert.Equal(t, ErrDirectoryFilesLimit, err)
+	err = conn.Rename(filepath.Join(localHome, "file4"), filepath.Join(localHome, "inbox", "sub", "file4"),
+		"/file4", "/inbox/sub/file4")
+	assert.NoError(t, err)
+	// a directory containing more files than allowed cannot be moved inside the limited path
+	err = os.Mkdir(filepath.Join(localHome, "dir"), os.ModePerm)
+	require.NoError(t, err)
+	for _, name := range []string{"a", "b", "c"} {
+		err = ioutil.WriteFile(filepath.Join(localHome, "dir", name), []byte("data"), os.ModePerm)
+		require.NoError(t, err)
+	}
+	err = conn.Rename(filepath.Join(localHome, "dir"), filepath.Join(localHome, "inbox", "dir"),
+		"/dir", "/inbox/dir")
+	assert.Equal(t, ErrDirectoryFilesLimit, err)
+	err = os.Remove(filepath.Join(localHome, "dir", "c"))
+	require.NoError(t, err)
+	err = conn.Rename(filepath.Join(localHome, "dir"), filepath.Join(localHome, "inbox", "dir"),
+		"/dir", "/inbox/dir")
+	assert.NoError(t, err)
+}
+
+type b2TestFile struct {
+	id          string
+	data        []byte
+	contentType string
+	fileInfo    map[string]string
+}
+
+// b2TestStore is a minimal in memory implementation of the B2 native API
+type b2TestStore struct {
+	sync.Mutex
+	url          string
+	files        map[string]b2TestFile
+	largeFiles   map[string]string
+	parts        map[string]map[int][]byte
+	nextID       int
+	tokens       int
+	expireToken  bool
+	partRequests int
+}
+
+func (s *b2TestStore) sendError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "code": code, "message": code})
+}
+
+func (s *b2TestStore) sendJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (s *b2TestStore) getFileInfo(name string, file b2TestFile) map[string]interface{} {
+	return map[string]interface{}{
+		"fileId":          file.id,
+		"fileName":        name,
+		"contentLength":   len(file.data),
+		"contentType":     file.contentType,
+		"contentSha1":     fmt.Sprintf("%x", sha1.Sum(file.data)),
+		"fileInfo":        file.fileInfo,
+		"action":          "upload",
+		"uploadTimestamp": 1609459200000,
+	}
+}
+
+func (s *b2TestStore) listFileNames(request map[string]interface{}) map[string]interface{} {
+	prefix, _ := request["prefix"].(string)
+	startFileName, _ := request["startFileName"].(string)
+	delimiter, _ := request["delimiter"].(string)
+	maxFileCount := int(request["maxFileCount"].(float64))
+	// a small page size allows to test the paging
+	if maxFileCount > 2 {
+		maxFileCount = 2
+	}
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := []map[string]interface{}{}
+	lastFolder := ""
+	var nextFileName interface{}
+	for _, name := range names {
+		if name < startFileName || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		entryName := name
+		rest := strings.TrimPrefix(name, prefix)
+		if idx := strings.Index(rest, "/"); delimiter != "" && idx >= 0 {
+			entryName = prefix + rest[:idx+1]
+			if entryName == lastFolder {
+				continue
+			}
+		}
+		if len(files) == maxFileCount {
+			nextFileName = entryName
+			break
+		}
+		if entryName != name {
+			lastFolder = entryName
+			files = append(files, map[string]interface{}{"fileName": entryName, "action": "folder"})
+			continue
+		}
+		files = append(files, s.getFileInfo(name, s.files[name]))
+	}
+	return map[string]interface{}{"files": files, "nextFileName": nextFileName}
+}
+
+func (s *b2TestStore) serveAPI(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Header.Get("Authorization") != fmt.Sprintf("token%v", s.tokens) {
+		s.sendError(w, http.StatusUnauthorized, "bad_auth_token")
+		return
+	}
+	if s.expireToken {
+		s.expireToken = false
+		s.sendError(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+	var request map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.sendError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	switch name {
+	case "b2_list_buckets":
+		s.sendJSON(w, map[string]interface{}{"buckets": []map[string]string{
+			{"bucketId": "otherid", "bucketName": "other"},
+			{"bucketId": "bucketid", "bucketName": "bucket"},
+		}})
+	case "b2_list_file_names":
+		if request["bucketId"] != "bucketid" {
+			s.sendError(w, http.StatusBadRequest, "bad_bucket_id")
+			return
+		}
+		s.sendJSON(w, s.listFileNames(request))
+	case "b2_get_upload_url":
+		s.sendJSON(w, map[string]string{"uploadUrl": s.url + "/upload", "authorizationToken": "uploadtoken"})
+	case "b2_start_large_file":
+		s.nextID++
+		fileID := fmt.Sprintf("large%v", s.nextID)
+		s.largeFiles[fileID] = request["fileName"].(string)
+		s.parts[fileID] = make(map[int][]byte)
+		s.sendJSON(w, map[string]string{"fileId": fileID, "fileName": s.largeFiles[fileID]})
+	case "b2_get_upload_part_url":
+		fileID := request["fileId"].(string)
+		s.sendJSON(w, map[string]string{"uploadUrl": s.url + "/upload_part/" + fileID, "authorizationToken": "uploadtoken"})
+	case "b2_finish_large_file":
+		fileID := request["fileId"].(string)
+		sums := request["partSha1Array"].([]interface{})
+		var data []byte
+		for idx, sum := range sums {
+			part := s.parts[fileID][idx+1]
+			if sum.(string) != fmt.Sprintf("%x", sha1.Sum(part)) {
+				s.sendError(w, http.StatusBadRequest, "bad_request")
+				return
+			}
+			data = append(data, part...)
+		}
+		s.files[s.largeFiles[fileID]] = b2TestFile{id: fileID, data: data, contentType: "application/octet-stream"}
+		delete(s.largeFiles, fileID)
+		delete(s.parts, fileID)
+		s.sendJSON(w, map[string]string{"fileId": fileID})
+	case "b2_cancel_large_file":
+		fileID := request["fileId"].(string)
+		delete(s.largeFiles, fileID)
+		delete(s.parts, fileID)
+		s.sendJSON(w, map[string]string{"fileId": fileID})
+	case "b2_copy_file":
+		for _, file := range s.files {
+			if file.id == request["sourceFileId"] {
+				s.nextID++
+				newFile := b2TestFile{
+					id:          fmt.Sprintf("id%v", s.nextID),
+					data:        file.data,
+					contentType: file.contentType,
+					fileInfo:    file.fileInfo,
+				}
+				if request["metadataDirective"] == "REPLACE" {
+					newFile.contentType = request["contentType"].(string)
+					newFile.fileInfo = make(map[string]string)
+					for k, v := range request["fileInfo"].(map[string]interface{}) {
+						newFile.fileInfo[k] = v.(string)
+					}
+				}
+				s.files[request["fileName"].(string)] = newFile
+				s.sendJSON(w, map[string]string{})
+				return
+			}
+		}
+		s.sendError(w, http.StatusNotFound, "not_found")
+	case "b2_delete_file_version":
+		name := request["fileName"].(string)
+		if file, ok := s.files[name]; ok && file.id == request["fileId"] {
+			delete(s.files, name)
+			s.sendJSON(w, map[string]string{})
+			return
+		}
+		s.sendError(w, http.StatusNotFound, "not_found")
+	default:
+		s.sendError(w, http.StatusNotFound, "not_found")
+	}
+}
+
+func (s *b2TestStore) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case r.URL.Path == "/b2api/v2/b2_authorize_account":
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "keyid" || password != "appkey" {
+			s.sendError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		s.tokens++
+		s.sendJSON(w, map[string]interface{}{
+			"accountId":           "account",
+			"authorizationToken":  fmt.Sprintf("token%v", s.tokens),
+			"apiUrl":              s.url,
+			"downloadUrl":         s.url,
+			"recommendedPartSize": 100 * 1024 * 1024,
+		})
+	case strings.HasPrefix(r.URL.Path, "/b2api/v2/"):
+		s.serveAPI(w, r, strings.TrimPrefix(r.URL.Path, "/b2api/v2/"))
+	case r.URL.Path == "/upload" || strings.HasPrefix(r.URL.Path, "/upload_part/"):
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Header.Get("X-Bz-Content-Sha1") != fmt.Sprintf("%x", sha1.Sum(data)) {
+			s.sendError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		if r.URL.Path == "/upload" {
+			name, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+			if err != nil {
+				s.sendError(w, http.StatusBadRequest, "bad_request")
+				return
+			}
+			s.nextID++
+			s.files[name] = b2TestFile{
+				id:          fmt.Sprintf("id%v", s.nextID),
+				data:        data,
+				contentType: r.Header.Get("Content-Type"),
+			}
+			s.sendJSON(w, s.getFileInfo(name, s.files[name]))
+			return
+		}
+		s.partRequests++
+		partNumber, _ := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		s.parts[strings.TrimPrefix(r.URL.Path, "/upload_part/")][partNumber] = data
+		s.sendJSON(w, map[string]string{})
+	case strings.HasPrefix(r.URL.Path, "/file/bucket/"):
+		if r.Header.Get("Authorization") != fmt.Sprintf("token%v", s.tokens) {
+			s.sendError(w, http.StatusUnauthorized, "bad_auth_token")
+			return
+		}
+		file, ok := s.files[strings.TrimPrefix(r.URL.Path, "/file/bucket/")]
+		if !ok {
+			s.sendError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		data := file.data
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+			if err != nil || offset > len(data) {
+				s.sendError(w, http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable")
+				return
+			}
+			data = data[offset:]
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		_, _ = w.Write(data)
+	default:
+		s.sendError(w, http.StatusNotFound, "not_found")
+	}
+}
+
+func TestB2Fs(t *testing.T) {
+	store := &b2TestStore{
+		files: map[string]b2TestFile{
+			"home/":              {id: "id1", contentType: "inode/directory"},
+			"home/dir/file1.txt": {id: "id2", data: []byte("file1"), contentType: "text/plain"},
+			"home/dir/file2.txt": {id: "id3", data: []byte("file2"), contentType: "text/plain"},
+			"home/file.txt":      {id: "id4", data: []byte("file contents"), contentType: "text/plain"},
+			"other/file.txt":     {id: "id5", data: []byte("other"), contentType: "text/plain"},
+		},
+		largeFiles: make(map[string]string),
+		parts:      make(map[string]map[int][]byte),
+		nextID:     5,
+	}
+	server := httptest.NewServer(http.HandlerFunc(store.serveHTTP))
+	defer server.Close()
+	store.url = server.URL
+
+	_, err := vfs.NewB2Fs("", os.TempDir(), vfs.B2FsConfig{
+		Bucket:         "bucket",
+		AccountID:      "keyid",
+		ApplicationKey: vfs.Secret{Status: vfs.SecretStatusPlain, Payload: "appkey"},
+		Endpoint:       "ftp://" + strings.TrimPrefix(server.URL, "http://"),
+	})
+	assert.Error(t, err)
+	fs, err := vfs.NewB2Fs("", os.TempDir(), vfs.B2FsConfig{
+		Bucket:          "bucket",
+		KeyPrefix:       "home",
+		AccountID:       "keyid",
+		ApplicationKey:  vfs.Secret{Status: vfs.SecretStatusPlain, Payload: "appkey"},
+		Endpoint:        server.URL,
+		UploadChunkSize: 5,
+	})
+	require.NoError(t, err)
+	assert.True(t, vfs.IsDirPagesSupported(fs))
+
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  filepath.Join(os.TempDir(), "b2home"),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+
+	files, err := conn.ListDir("/home", "/")
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		for _, info := range files {
+			switch info.Name() {
+			case "dir":
+				assert.True(t, info.IsDir())
+			case "file.txt":
+				assert.False(t, info.IsDir())
+				assert.Equal(t, int64(13), info.Size())
+			default:
+				t.Errorf("unexpected file %#v", info.Name())
+			}
+		}
+	}
+	files, err = conn.ListDir("/home/dir", "/dir")
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	// the token is expired, a new one must be requested
+	store.expireToken = true
+	info, err := conn.DoStat("/home/file.txt", 0)
+	assert.NoError(t, err)
+	assert.False(t, info.IsDir())
+	assert.Equal(t, 2, store.tokens)
+	info, err = conn.DoStat("/home/dir", 0)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	_, err = conn.DoStat("/home/missing", 0)
+	assert.True(t, fs.IsNotExist(err))
+	assert.EqualError(t, conn.GetFsError(err), sftp.ErrSSHFxNoSuchFile.Error())
+	mimeType, err := fs.GetMimeType("/home/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", mimeType)
+
+	_, r, cancelFn, err := fs.Open("/home/file.txt", 5)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("contents"), data)
+	cancelFn()
+	_, _, _, err = fs.Open("/home/missing.txt", 0)
+	assert.True(t, fs.IsNotExist(err))
+
+	// small files are uploaded using a single request
+	_, w, _, err := fs.Create("/home/dir/small file.txt", 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("small"))
+	assert.NoError(t, err)
+	err = w.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("small"), store.files["home/dir/small file.txt"].data)
+	assert.Equal(t, 0, store.partRequests)
+	// bigger files are uploaded as large files
+	largeData := bytes.Repeat([]byte("b2"), 6*1024*1024)
+	_, w, _, err = fs.Create("/home/large.bin", 0)
+	require.NoError(t, err)
+	_, err = w.Write(largeData)
+	assert.NoError(t, err)
+	err = w.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, largeData, store.files["home/large.bin"].data)
+	assert.Equal(t, 3, store.partRequests)
+	assert.Len(t, store.largeFiles, 0)
+
+	err = conn.CreateDir("/home/newdir", "/newdir")
+	assert.NoError(t, err)
+	assert.Equal(t, "inode/directory", store.files["home/newdir/"].contentType)
+	err = conn.Rename("/home/file.txt", "/home/newdir/file.txt", "/file.txt", "/newdir/file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("file contents"), store.files["home/newdir/file.txt"].data)
+	_, ok := store.files["home/file.txt"]
+	assert.False(t, ok)
+	// renaming non empty directories is not supported
+	err = conn.Rename("/home/newdir", "/home/renamed", "/newdir", "/renamed")
+	assert.Error(t, err)
+	err = conn.RemoveFile("/home/newdir/file.txt", "/newdir/file.txt", info)
+	assert.NoError(t, err)
+	err = conn.Rename("/home/newdir", "/home/renamed", "/newdir", "/renamed")
+	assert.NoError(t, err)
+	_, ok = store.files["home/renamed/"]
+	assert.True(t, ok)
+	err = conn.RemoveDir("/home/renamed", "/renamed")
+	assert.NoError(t, err)
+	_, ok = store.files["home/renamed/"]
+	assert.False(t, ok)
+
+	numFiles, size, err := fs.ScanRootDirContents()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, numFiles)
+	assert.Equal(t, int64(15+len(largeData)), size)
+	_, ok = store.files["other/file.txt"]
+	assert.True(t, ok)
+	// the compression metadata are stored as file info and the listings include them
+	compressedFs := vfs.NewCompressedFs(fs, os.TempDir(), vfs.CompressionConfig{Extensions: []string{".txt"}})
+	compressible := bytes.Repeat([]byte("compressible content "), 1024)
+	_, w, _, err = compressedFs.Create("/home/compressed.txt", 0)
+	require.NoError(t, err)
+	_, err = w.Write(compressible)
+	assert.NoError(t, err)
+	err = w.Close()
+	assert.NoError(t, err)
+	assert.Less(t, len(store.files["home/compressed.txt"].data), len(compressible))
+	assert.Equal(t, "text/plain; charset=utf-8", store.files["home/compressed.txt"].contentType)
+	assert.Equal(t, map[string]string{
+		"sftpgo_compression":       "gzip",
+		"sftpgo_uncompressed_size": strconv.Itoa(len(compressible)),
+	}, store.files["home/compressed.txt"].fileInfo)
+	entries, err := compressedFs.ReadDir("/home")
+	assert.NoError(t, err)
+	found := false
+	for _, entry := range entries {
+		if entry.Name() == "compressed.txt" {
+			found = true
+			assert.Equal(t, int64(len(compressible)), entry.Size())
+		}
+	}
+	assert.True(t, found)
+	info, err = compressedFs.Stat("/home/compressed.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(compressible)), info.Size())
+	_, r, _, err = compressedFs.Open("/home/compressed.txt", 0)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, compressible, data)
+
+	fs, err = vfs.NewB2Fs("", os.TempDir(), vfs.B2FsConfig{
+		Bucket:         "missing",
+		AccountID:      "keyid",
+		ApplicationKey: vfs.Secret{Status: vfs.SecretStatusPlain, Payload: "appkey"},
+		Endpoint:       server.URL,
+	})
+	require.NoError(t, err)
+	_, err = fs.Stat("/")
+	assert.True(t, fs.IsNotExist(err))
+	fs, err = vfs.NewB2Fs("", os.TempDir(), vfs.B2FsConfig{
+		Bucket:         "bucket",
+		AccountID:      "keyid",
+		ApplicationKey: vfs.Secret{Status: vfs.SecretStatusPlain, Payload: "wrongkey"},
+		Endpoint:       server.URL,
+	})
+	require.NoError(t, err)
+	_, err = fs.Stat("/file.txt")
+	assert.True(t, fs.IsPermission(err))
+}
+
+type sftpTestServer struct {
+	sync.Mutex
+	listener   net.Listener
+	hostKey    ssh.Signer
+	userKey    ssh.PublicKey
+	handshakes int
+	conns      []*ssh.ServerConn
+}
+
+func startSFTPTestServer(t *testing.T, userKey ssh.PublicKey) *sftpTestServer {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &sftpTestServer{
+		listener: listener,
+		hostKey:  signer,
+		userKey:  userKey,
+	}
+	go server.serve()
+	return server
+}
+
+func (s *sftpTestServer) serve() {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "upstream" && string(pass) == "password" {
+				return nil, nil
+			}
+			return nil, errors.New("invalid credentials")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "upstream" && bytes.Equal(key.Marshal(), s.userKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("invalid public key")
+		},
+	}
+	config.AddHostKey(s.hostKey)
+	for {
+		netConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			sconn, chans, reqs, err := ssh.NewServerConn(netConn, config)
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.handshakes++
+			s.conns = append(s.conns, sconn)
+			s.Unlock()
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type") //nolint:errcheck
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go func() {
+					for req := range requests {
+						ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+						req.Reply(ok, nil) //nolint:errcheck
+						if ok {
+							go func() {
+								server, err := sftp.NewServer(channel)
+								if err == nil {
+									server.Serve() //nolint:errcheck
+									server.Close()
+								}
+								channel.Close()
+							}()
+						}
+					}
+				}()
+			}
+		}()
+	}
+}
+
+func (s *sftpTestServer) getHandshakes() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.handshakes
+}
+
+func (s *sftpTestServer) closeConnections() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+func TestSFTPFs(t *testing.T) {
+	userKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	userKeyDer, err := x509.MarshalECPrivateKey(userKey)
+	require.NoError(t, err)
+	userPrivateKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: userKeyDer})
+	userSigner, err := ssh.NewSignerFromKey(userKey)
+	require.NoError(t, err)
+
+	server := startSFTPTestServer(t, userSigner.PublicKey())
+	defer server.listener.Close()
+
+	upstreamDir := filepath.Join(os.TempDir(), "sftpfs_upstream")
+	err = os.MkdirAll(upstreamDir, os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(upstreamDir)
+
+	config := vfs.SFTPFsConfig{
+		Endpoint:     server.listener.Addr().String(),
+		Username:     "upstream",
+		Password:     vfs.Secret{Status: vfs.SecretStatusPlain, Payload: "password"},
+		Fingerprints: []string{"SHA256:6zzKGAlR0uOxyWlJQS0DBYrA8Q+VpSOtf3Fpy0Cfu8E"},
+		Prefix:       upstreamDir + "/home",
+	}
+	_, err = vfs.NewSFTPFs("", os.TempDir(), config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "host key verification failed")
+	}
+	config.Fingerprints = []string{ssh.FingerprintSHA256(server.hostKey.PublicKey())}
+	config.Password.Payload = "wrong"
+	_, err = vfs.NewSFTPFs("", os.TempDir(), config)
+	assert.Error(t, err)
+	config.Password.Payload = "password"
+	fs, err := vfs.NewSFTPFs("", os.TempDir(), config)
+	require.NoError(t, err)
+	assert.Equal(t, 1, server.getHandshakes())
+	// the connection is reused
+	_, err = vfs.NewSFTPFs("", os.TempDir(), config)
+	require.NoError(t, err)
+	assert.Equal(t, 1, server.getHandshakes())
+	assert.False(t, vfs.IsLocalOsFs(fs))
+
+	user := dataprovider.User{
+		Username: userTestUsername,
+		HomeDir:  filepath.Join(os.TempDir(), "sftpfshome"),
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	defer os.RemoveAll(user.HomeDir)
+	assert.True(t, fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID()))
+	assert.DirExists(t, filepath.Join(upstreamDir, "home"))
+	conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+
+	filePath, err := fs.ResolvePath("/file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, upstreamDir+"/home/file.txt", filePath)
+	assert.Equal(t, "/file.txt", fs.GetRelativePath(filePath))
+	assert.Equal(t, "/", fs.GetRelativePath(upstreamDir+"/home1/file.txt"))
+
+	_, w, _, err := fs.Create(filePath, 0)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("file contents"))
+	assert.NoError(t, err)
+	err = w.Close()
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(upstreamDir, "home", "file.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("file contents"), data)
+
+	_, r, cancelFn, err := fs.Open(filePath, 5)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("contents"), data)
+	cancelFn()
+	_, _, _, err = fs.Open(filePath+".missing", 0)
+	assert.True(t, fs.IsNotExist(err))
+	mimeType, err := fs.GetMimeType(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", mimeType)
+
+	dirPath, err := fs.ResolvePath("/dir")
+	require.NoError(t, err)
+	err = conn.CreateDir(dirPath, "/dir")
+	assert.NoError(t, err)
+	err = conn.Rename(filePath, dirPath+"/file.txt", "/file.txt", "/dir/file.txt")
+	assert.NoError(t, err)
+	files, err := conn.ListDir(dirPath, "/dir")
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, "file.txt", files[0].Name())
+		assert.Equal(t, int64(13), files[0].Size())
+	}
+	info, err := conn.DoStat(dirPath, 0)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	_, err = conn.DoStat(filePath, 0)
+	assert.True(t, fs.IsNotExist(err))
+	assert.EqualError(t, conn.GetFsError(err), sftp.ErrSSHFxNoSuchFile.Error())
+
+	err = fs.Symlink(dirPath+"/file.txt", filePath)
+	assert.NoError(t, err)
+	linkTarget, err := fs.Readlink(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dir/file.txt", linkTarget)
+	err = fs.Remove(filePath, false)
+	assert.NoError(t, err)
+
+	numFiles, size, err := fs.ScanRootDirContents()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numFiles)
+	assert.Equal(t, int64(13), size)
+
+	// a broken connection is established again
+	server.closeConnections()
+	assert.Eventually(t, func() bool {
+		_, err := fs.Stat(dirPath)
+		return err == nil
+	}, 2*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 2, server.getHandshakes())
+
+	err = conn.RemoveFile(dirPath+"/file.txt", "/dir/file.txt", files[0])
+	assert.NoError(t, err)
+	err = conn.RemoveDir(dirPath, "/dir")
+	assert.NoError(t, err)
+	assert.NoDirExists(t, filepath.Join(upstreamDir, "home", "dir"))
+
+	// public key authentication uses a different pooled connection
+	fs, err = vfs.NewSFTPFs("", os.TempDir(), vfs.SFTPFsConfig{
+		Endpoint:   server.listener.Addr().String(),
+		Username:   "upstream",
+		PrivateKey: vfs.Secret{Status: vfs.SecretStatusPlain, Payload: string(userPrivateKey)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, server.getHandshakes())
+	_, err = fs.Stat(upstreamDir)
+	assert.NoError(t, err)
+}
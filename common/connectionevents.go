@@ -0,0 +1,224 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// Supported connection event types
+const (
+	ConnectionEventOpen             = "connection_open"
+	ConnectionEventUpdate           = "connection_update"
+	ConnectionEventClose            = "connection_close"
+	ConnectionEventTransferStart    = "transfer_start"
+	ConnectionEventTransferProgress = "transfer_progress"
+	ConnectionEventTransferEnd      = "transfer_end"
+)
+
+const (
+	// number of recent events kept to resume the streams after a reconnection
+	connectionEventsHistorySize = 512
+	// buffered events for each subscription, if a subscriber is too slow
+	// the events that don't fit the buffer are discarded
+	connectionEventsBufferSize = 1024
+)
+
+var connectionEvents = connectionEventsBroker{
+	subscriptions: make(map[*ConnectionEventsSubscription]bool),
+}
+
+// ConnectionEvent defines a connection or transfer event
+type ConnectionEvent struct {
+	// Unique, increasing, identifier for the event. Progress events are not
+	// stored and they have no ID
+	ID uint64 `json:"id,omitempty"`
+	// Event type
+	Event string `json:"event"`
+	// Event time as unix timestamp in milliseconds
+	Timestamp    int64  `json:"timestamp"`
+	ConnectionID string `json:"connection_id"`
+	Username     string `json:"username,omitempty"`
+	Protocol     string `json:"protocol"`
+	// Remote address, it is set for connection events only
+	RemoteAddress string `json:"remote_address,omitempty"`
+	// Transfer identifier, unique within the connection, and details.
+	// They are set for transfer events only
+	TransferID uint64              `json:"transfer_id,omitempty"`
+	Transfer   *ConnectionTransfer `json:"transfer,omitempty"`
+	// Transfer error, if any. It is set for transfer end events only
+	Error string `json:"error,omitempty"`
+}
+
+// ConnectionEventsFilter defines the filters for the connection events.
+// Empty fields match any value
+type ConnectionEventsFilter struct {
+	Username string
+	Protocol string
+}
+
+func (f *ConnectionEventsFilter) matches(username, protocol string) bool {
+	if f.Username != "" && f.Username != username {
+		return false
+	}
+	if f.Protocol != "" && f.Protocol != protocol {
+		return false
+	}
+	return true
+}
+
+// ConnectionEventsSubscription receives the connection events matching its filter
+type ConnectionEventsSubscription struct {
+	filter  ConnectionEventsFilter
+	events  chan *ConnectionEvent
+	dropped int64
+}
+
+// Events returns the channel to receive the events from
+func (s *ConnectionEventsSubscription) Events() <-chan *ConnectionEvent {
+	return s.events
+}
+
+// GetDropped returns the number of events discarded since the subscriber was too slow
+func (s *ConnectionEventsSubscription) GetDropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+func (s *ConnectionEventsSubscription) send(ev *ConnectionEvent) {
+	if !s.filter.matches(ev.Username, ev.Protocol) {
+		return
+	}
+	select {
+	case s.events <- ev:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+type connectionEventsBroker struct {
+	sync.RWMutex
+	lastID        uint64
+	history       []*ConnectionEvent
+	subscriptions map[*ConnectionEventsSubscription]bool
+}
+
+func (b *connectionEventsBroker) publish(ev *ConnectionEvent) {
+	ev.Timestamp = utils.GetTimeAsMsSinceEpoch(time.Now())
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.lastID++
+	ev.ID = b.lastID
+	if len(b.history) >= connectionEventsHistorySize {
+		copy(b.history, b.history[1:])
+		b.history[len(b.history)-1] = ev
+	} else {
+		b.history = append(b.history, ev)
+	}
+	for s := range b.subscriptions {
+		s.send(ev)
+	}
+}
+
+func (b *connectionEventsBroker) subscribe(filter ConnectionEventsFilter, lastEventID uint64) *ConnectionEventsSubscription {
+	s := &ConnectionEventsSubscription{
+		filter: filter,
+		events: make(chan *ConnectionEvent, connectionEventsBufferSize),
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	// the missed events, if still available, are replayed before the new ones
+	if lastEventID > 0 {
+		for _, ev := range b.history {
+			if ev.ID > lastEventID {
+				s.send(ev)
+			}
+		}
+	}
+	b.subscriptions[s] = true
+	logger.Debug(logSender, "", "connection events subscription added, active subscriptions: %v", len(b.subscriptions))
+	return s
+}
+
+func (b *connectionEventsBroker) unsubscribe(s *ConnectionEventsSubscription) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.subscriptions, s)
+	logger.Debug(logSender, "", "connection events subscription removed, active subscriptions: %v, dropped events: %v",
+		len(b.subscriptions), s.GetDropped())
+}
+
+// SubscribeConnectionEvents returns a subscription to receive the connection and
+// transfer events matching the given filter. If lastEventID is greater than zero
+// the recent events following it are delivered first.
+// The subscription must be removed using UnsubscribeConnectionEvents when no
+// longer needed
+func SubscribeConnectionEvents(filter ConnectionEventsFilter, lastEventID uint64) *ConnectionEventsSubscription {
+	return connectionEvents.subscribe(filter, lastEventID)
+}
+
+// UnsubscribeConnectionEvents removes the given subscription
+func UnsubscribeConnectionEvents(s *ConnectionEventsSubscription) {
+	connectionEvents.unsubscribe(s)
+}
+
+func publishConnectionEvent(event string, c ActiveConnection) {
+	connectionEvents.publish(&ConnectionEvent{
+		Event:         event,
+		ConnectionID:  c.GetID(),
+		Username:      c.GetUsername(),
+		Protocol:      c.GetProtocol(),
+		RemoteAddress: c.GetRemoteAddress(),
+	})
+}
+
+func publishTransferEvent(event string, t *BaseTransfer, err error) {
+	ev := &ConnectionEvent{
+		Event:        event,
+		ConnectionID: t.Connection.GetID(),
+		Username:     t.Connection.GetUsername(),
+		Protocol:     t.Connection.GetProtocol(),
+		TransferID:   t.GetID(),
+	}
+	transfer := getConnectionTransfer(t)
+	ev.Transfer = &transfer
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	connectionEvents.publish(ev)
+}
+
+// GetTransfersProgress returns a progress event for each active transfer
+// within the connections matching the given filter
+func (conns *ActiveConnections) GetTransfersProgress(filter ConnectionEventsFilter) []*ConnectionEvent {
+	conns.RLock()
+	defer conns.RUnlock()
+
+	now := utils.GetTimeAsMsSinceEpoch(time.Now())
+	var events []*ConnectionEvent
+	for _, c := range conns.connections {
+		if !filter.matches(c.GetUsername(), c.GetProtocol()) {
+			continue
+		}
+		for _, t := range c.GetTransfers() {
+			transfer := t
+			events = append(events, &ConnectionEvent{
+				Event:        ConnectionEventTransferProgress,
+				Timestamp:    now,
+				ConnectionID: c.GetID(),
+				Username:     c.GetUsername(),
+				Protocol:     c.GetProtocol(),
+				TransferID:   transfer.ID,
+				Transfer:     &transfer,
+			})
+		}
+	}
+	return events
+}
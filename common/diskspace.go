@@ -0,0 +1,82 @@
+package common
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// DiskSpaceCheck defines a free disk space check for the uploads to a local directory,
+// for example a mount point
+type DiskSpaceCheck struct {
+	// Absolute path to a local directory. The check applies to the uploads to this directory
+	// and its sub directories, if more checks match, the one with the longest path is used
+	Path string `json:"path" mapstructure:"path"`
+	// Minimum free space, as bytes, required on the storage device after the upload. If the
+	// client declares the upload size, SCP does, this size is required too
+	MinFreeSpace int64 `json:"min_free_space" mapstructure:"min_free_space"`
+}
+
+func getValidDiskSpaceChecks(checks []DiskSpaceCheck) []DiskSpaceCheck {
+	var result []DiskSpaceCheck
+	for _, check := range checks {
+		if !filepath.IsAbs(check.Path) || check.MinFreeSpace < 0 {
+			logger.Warn(logSender, "", "ignoring invalid disk space check, path: %#v, min free space: %v",
+				check.Path, check.MinFreeSpace)
+			logger.WarnToConsole("ignoring invalid disk space check, path: %#v, min free space: %v",
+				check.Path, check.MinFreeSpace)
+			continue
+		}
+		check.Path = filepath.Clean(check.Path)
+		result = append(result, check)
+	}
+	return result
+}
+
+// getDiskSpaceCheck returns the check with the longest path containing the
+// specified local path, if any
+func (c *Configuration) getDiskSpaceCheck(fsPath string) (DiskSpaceCheck, bool) {
+	var result DiskSpaceCheck
+	found := false
+	for _, check := range c.DiskSpaceChecks {
+		if fsPath != check.Path && !strings.HasPrefix(fsPath, strings.TrimSuffix(check.Path, string(filepath.Separator))+
+			string(filepath.Separator)) {
+			continue
+		}
+		if !found || len(check.Path) > len(result.Path) {
+			result = check
+			found = true
+		}
+	}
+	return result, found
+}
+
+// CheckDiskSpace returns an error if the storage device for the specified local path has not
+// enough free space for an upload. declaredSize is the upload size declared by the client,
+// 0 means unknown. Only the local filesystem is checked
+func (c *BaseConnection) CheckDiskSpace(fsPath string, declaredSize int64) error {
+	if len(Config.DiskSpaceChecks) == 0 || !vfs.IsLocalOsFs(c.Fs) {
+		return nil
+	}
+	check, ok := Config.getDiskSpaceCheck(fsPath)
+	if !ok {
+		return nil
+	}
+	available, err := vfs.GetAvailableDiskSize(check.Path)
+	if err != nil {
+		c.Log(logger.LevelWarn, "unable to get the available disk space for %#v, the upload is allowed: %v",
+			check.Path, err)
+		return nil
+	}
+	if declaredSize < 0 {
+		declaredSize = 0
+	}
+	if available-declaredSize < check.MinFreeSpace {
+		c.Log(logger.LevelInfo, "denying upload to %#v, available disk space: %v, required: %v, declared size: %v",
+			fsPath, available, check.MinFreeSpace, declaredSize)
+		return c.GetGenericError(ErrInsufficientDiskSpace)
+	}
+	return nil
+}
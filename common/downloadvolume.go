@@ -0,0 +1,169 @@
+package common
+
+import (
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+)
+
+// downloadVolumes tracks the download volume for the users with a limit and active downloads
+var downloadVolumes = downloadVolumeTracker{
+	volumes: make(map[string]*downloadVolume),
+}
+
+// downloadVolume tracks the volume downloaded in the current period by a user.
+// The downloaded bytes are reserved before each read so concurrent downloads
+// cannot exceed the limit. The bytes not yet saved to the data provider are
+// saved when a download ends or when the period changes
+type downloadVolume struct {
+	sync.Mutex
+	user        dataprovider.User
+	periodStart int64
+	used        int64
+	pending     int64
+	transfers   int
+}
+
+// reserve reserves up to size bytes and returns the reserved size.
+// ErrDownloadLimitReached is returned if the limit is already reached
+func (v *downloadVolume) reserve(size int64) (int64, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.checkPeriod(time.Now())
+	remaining := v.user.Filters.DownloadVolumeLimit - v.used
+	if remaining <= 0 {
+		return 0, ErrDownloadLimitReached
+	}
+	if size > remaining {
+		size = remaining
+	}
+	v.used += size
+	v.pending += size
+	return size, nil
+}
+
+// unreserve releases reserved but not downloaded bytes
+func (v *downloadVolume) unreserve(size int64) {
+	if size <= 0 {
+		return
+	}
+	v.Lock()
+	defer v.Unlock()
+
+	v.used -= size
+	v.pending -= size
+	if v.used < 0 {
+		v.used = 0
+	}
+}
+
+// checkPeriod saves the pending bytes and resets the counter if the period has changed
+func (v *downloadVolume) checkPeriod(t time.Time) {
+	periodStart := v.user.GetDownloadVolumePeriodStart(t)
+	if periodStart == v.periodStart {
+		return
+	}
+	v.save()
+	v.periodStart = periodStart
+	v.used = 0
+}
+
+// save saves the pending bytes to the data provider and updates the remaining volume metric
+func (v *downloadVolume) save() {
+	if v.pending != 0 {
+		err := dataprovider.UpdateUserDownloadVolume(v.user, v.pending, v.periodStart)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to update download volume for user %#v: %v", v.user.Username, err)
+		}
+		v.pending = 0
+	}
+	remaining := v.user.Filters.DownloadVolumeLimit - v.used
+	if remaining < 0 {
+		remaining = 0
+	}
+	metrics.UpdateDownloadVolumeRemaining(v.user.Username, remaining)
+}
+
+type downloadVolumeTracker struct {
+	sync.Mutex
+	volumes map[string]*downloadVolume
+}
+
+// acquire returns the download volume for the given user, it must be released when
+// the download ends. A nil volume is returned if the user has no download volume limit
+func (t *downloadVolumeTracker) acquire(user dataprovider.User) *downloadVolume {
+	if !user.HasDownloadVolumeLimit() {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	v, ok := t.volumes[user.Username]
+	if !ok {
+		now := time.Now()
+		used, err := dataprovider.GetUsedDownloadVolume(user.Username, now)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get download volume for user %#v: %v", user.Username, err)
+			used = user.GetUsedDownloadVolume(now)
+		}
+		v = &downloadVolume{
+			user:        user,
+			periodStart: user.GetDownloadVolumePeriodStart(now),
+			used:        used,
+		}
+		t.volumes[user.Username] = v
+	}
+	v.Lock()
+	defer v.Unlock()
+	// use the most recent limit
+	v.user = user
+	v.transfers++
+	return v
+}
+
+// release releases the given download volume and saves the pending bytes
+func (t *downloadVolumeTracker) release(v *downloadVolume) {
+	if v == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	v.Lock()
+	defer v.Unlock()
+
+	v.checkPeriod(time.Now())
+	v.save()
+	v.transfers--
+	if v.transfers <= 0 {
+		delete(t.volumes, v.user.Username)
+	}
+}
+
+// isLimitReached returns true if the given user cannot download more data in the current period
+func (t *downloadVolumeTracker) isLimitReached(user dataprovider.User) bool {
+	if !user.HasDownloadVolumeLimit() {
+		return false
+	}
+	t.Lock()
+	v, ok := t.volumes[user.Username]
+	t.Unlock()
+
+	if ok {
+		v.Lock()
+		defer v.Unlock()
+
+		v.checkPeriod(time.Now())
+		return v.used >= user.Filters.DownloadVolumeLimit
+	}
+	used, err := dataprovider.GetUsedDownloadVolume(user.Username, time.Now())
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get download volume for user %#v: %v", user.Username, err)
+		return false
+	}
+	return used >= user.Filters.DownloadVolumeLimit
+}
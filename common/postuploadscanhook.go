@@ -0,0 +1,191 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/httpclient"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const defaultPostUploadScanHookTimeout = 60
+
+// errPostUploadScanRejected is returned if the hook reports that the uploaded file is not clean
+var errPostUploadScanRejected = errors.New("file rejected by the post-upload scan hook")
+
+// postUploadScanRequest defines the data sent to the post-upload scan hook
+type postUploadScanRequest struct {
+	Username   string            `json:"username"`
+	Path       string            `json:"path"`
+	FsPath     string            `json:"fs_path"`
+	FileSize   int64             `json:"file_size"`
+	Protocol   string            `json:"protocol"`
+	FsProvider int               `json:"fs_provider"`
+	Bucket     string            `json:"bucket,omitempty"`
+	Endpoint   string            `json:"endpoint,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+func (c *Configuration) getPostUploadScanHookTimeout() time.Duration {
+	if c.PostUploadScanHookTimeout <= 0 {
+		return defaultPostUploadScanHookTimeout * time.Second
+	}
+	return time.Duration(c.PostUploadScanHookTimeout) * time.Second
+}
+
+// executePostUploadScanHook executes the post-upload scan hook and returns nil if the
+// uploaded file is clean. errPostUploadScanRejected is returned if the hook rejects the
+// file, any other error means the hook failed
+func (c *Configuration) executePostUploadScanHook(req postUploadScanRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.getPostUploadScanHookTimeout())
+	defer cancel()
+
+	if strings.HasPrefix(c.PostUploadScanHook, "http") {
+		u, err := url.Parse(c.PostUploadScanHook)
+		if err != nil {
+			return fmt.Errorf("invalid post-upload scan hook %#v: %v", c.PostUploadScanHook, err)
+		}
+		var b bytes.Buffer
+		if err = json.NewEncoder(&b).Encode(req); err != nil {
+			return err
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), &b)
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		resp, err := httpclient.GetHTTPClient().Do(httpReq)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return nil
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			return errPostUploadScanRejected
+		default:
+			return fmt.Errorf("%w: %v", errUnexpectedHTTResponse, resp.StatusCode)
+		}
+	}
+	if !filepath.IsAbs(c.PostUploadScanHook) {
+		return fmt.Errorf("invalid post-upload scan hook %#v", c.PostUploadScanHook)
+	}
+	var metadata []byte
+	if len(req.Metadata) > 0 {
+		metadata, _ = json.Marshal(req.Metadata)
+	}
+	cmd := exec.CommandContext(ctx, c.PostUploadScanHook)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SFTPGO_SCAN_USERNAME=%v", req.Username),
+		fmt.Sprintf("SFTPGO_SCAN_PATH=%v", req.Path),
+		fmt.Sprintf("SFTPGO_SCAN_FS_PATH=%v", req.FsPath),
+		fmt.Sprintf("SFTPGO_SCAN_FILE_SIZE=%v", req.FileSize),
+		fmt.Sprintf("SFTPGO_SCAN_PROTOCOL=%v", req.Protocol),
+		fmt.Sprintf("SFTPGO_SCAN_FS_PROVIDER=%v", req.FsProvider),
+		fmt.Sprintf("SFTPGO_SCAN_BUCKET=%v", req.Bucket),
+		fmt.Sprintf("SFTPGO_SCAN_ENDPOINT=%v", req.Endpoint),
+		fmt.Sprintf("SFTPGO_SCAN_METADATA=%v", string(metadata)))
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("post-upload scan hook timed out: %v", ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return errPostUploadScanRejected
+	}
+	return err
+}
+
+// isRejectedByPostUploadScan executes the post-upload scan hook, if defined, for the
+// uploaded file stored at fsPath. If the file is rejected it is moved to the quarantine
+// or deleted and true is returned
+func (t *BaseTransfer) isRejectedByPostUploadScan(fsPath string) bool {
+	if Config.PostUploadScanHook == "" {
+		return false
+	}
+	fileSize := atomic.LoadInt64(&t.BytesReceived) + t.MinWriteOffset
+	if info, err := t.Fs.Stat(fsPath); err == nil {
+		fileSize = info.Size()
+	}
+	notification := newActionNotification(&t.Connection.User, operationQuarantine, fsPath, "", "",
+		t.Connection.protocol, fileSize, nil)
+	startTime := time.Now()
+	err := Config.executePostUploadScanHook(postUploadScanRequest{
+		Username:   t.Connection.User.Username,
+		Path:       t.requestPath,
+		FsPath:     fsPath,
+		FileSize:   fileSize,
+		Protocol:   t.Connection.protocol,
+		FsProvider: notification.FsProvider,
+		Bucket:     notification.Bucket,
+		Endpoint:   notification.Endpoint,
+		Metadata:   t.Connection.User.Metadata,
+	})
+	t.Connection.Log(logger.LevelDebug, "post-upload scan hook executed for %#v, elapsed: %v, error: %v",
+		t.requestPath, time.Since(startTime), err)
+	if err == nil {
+		return false
+	}
+	if err != errPostUploadScanRejected {
+		if Config.PostUploadScanAllowOnFailure {
+			t.Connection.Log(logger.LevelWarn, "post-upload scan hook failed for %#v, the file is accepted: %v",
+				t.requestPath, err)
+			return false
+		}
+		t.Connection.Log(logger.LevelWarn, "post-upload scan hook failed for %#v, the file is rejected: %v",
+			t.requestPath, err)
+	}
+	notification.TargetPath, err = t.quarantineUploadedFile(fsPath)
+	if err != nil {
+		notification.Status = 0
+	}
+	logger.Info(logSender, t.Connection.ID, "uploaded file %#v rejected by the post-upload scan, user: %#v, "+
+		"quarantine path: %#v, error: %v", t.requestPath, t.Connection.User.Username, notification.TargetPath, err)
+	go actionHandler.Handle(notification) //nolint:errcheck
+	return true
+}
+
+// quarantineUploadedFile moves the file at fsPath to the configured quarantine and returns
+// the quarantine path. The file is deleted if no quarantine is configured or if it cannot
+// be moved, in this case an empty path is returned
+func (t *BaseTransfer) quarantineUploadedFile(fsPath string) (string, error) {
+	if Config.PostUploadScanQuarantine != "" {
+		quarantinePath := t.getQuarantinePath()
+		err := t.Fs.Rename(fsPath, quarantinePath)
+		if err == nil {
+			return quarantinePath, nil
+		}
+		t.Connection.Log(logger.LevelWarn, "unable to move rejected file %#v to the quarantine path %#v, "+
+			"it will be deleted: %v", fsPath, quarantinePath, err)
+	}
+	return "", t.Fs.Remove(fsPath, false)
+}
+
+// getQuarantinePath returns the quarantine path for the uploaded file.
+// For Cloud Storage backends the quarantine is a prefix inside the user's bucket
+func (t *BaseTransfer) getQuarantinePath() string {
+	name := fmt.Sprintf("%v_%v_%v", time.Now().UTC().Format("20060102T150405.000000000"),
+		t.Connection.User.Username, path.Base(t.requestPath))
+	switch t.Connection.User.FsConfig.Provider {
+	case dataprovider.LocalFilesystemProvider, dataprovider.CryptedFilesystemProvider:
+		return filepath.Join(Config.PostUploadScanQuarantine, name)
+	case dataprovider.SFTPFilesystemProvider:
+		return path.Join(Config.PostUploadScanQuarantine, name)
+	default:
+		return strings.TrimPrefix(path.Join(Config.PostUploadScanQuarantine, name), "/")
+	}
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/httpclient"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const defaultPreDownloadHookTimeout = 30
+
+// errPreDownloadHookDenied is returned if the hook explicitly denies the download
+var errPreDownloadHookDenied = errors.New("download denied by the pre-download hook")
+
+// preDownloadRequest defines the data sent to the pre-download hook
+type preDownloadRequest struct {
+	Username string            `json:"username"`
+	Path     string            `json:"path"`
+	FileSize int64             `json:"file_size"`
+	Protocol string            `json:"protocol"`
+	IP       string            `json:"ip"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (c *Configuration) getPreDownloadHookTimeout() time.Duration {
+	if c.PreDownloadHookTimeout <= 0 {
+		return defaultPreDownloadHookTimeout * time.Second
+	}
+	return time.Duration(c.PreDownloadHookTimeout) * time.Second
+}
+
+// executePreDownloadHook executes the pre-download hook and returns nil if the download
+// is allowed. errPreDownloadHookDenied is returned if the hook denies the download, any
+// other error means the hook failed
+func (c *Configuration) executePreDownloadHook(req preDownloadRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.getPreDownloadHookTimeout())
+	defer cancel()
+
+	if strings.HasPrefix(c.PreDownloadHook, "http") {
+		u, err := url.Parse(c.PreDownloadHook)
+		if err != nil {
+			return fmt.Errorf("invalid pre-download hook %#v: %v", c.PreDownloadHook, err)
+		}
+		var b bytes.Buffer
+		if err = json.NewEncoder(&b).Encode(req); err != nil {
+			return err
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), &b)
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		resp, err := httpclient.GetHTTPClient().Do(httpReq)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return nil
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			return errPreDownloadHookDenied
+		default:
+			return fmt.Errorf("%w: %v", errUnexpectedHTTResponse, resp.StatusCode)
+		}
+	}
+	if !filepath.IsAbs(c.PreDownloadHook) {
+		return fmt.Errorf("invalid pre-download hook %#v", c.PreDownloadHook)
+	}
+	var metadata []byte
+	if len(req.Metadata) > 0 {
+		metadata, _ = json.Marshal(req.Metadata)
+	}
+	cmd := exec.CommandContext(ctx, c.PreDownloadHook)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SFTPGO_DOWNLOAD_USERNAME=%v", req.Username),
+		fmt.Sprintf("SFTPGO_DOWNLOAD_PATH=%v", req.Path),
+		fmt.Sprintf("SFTPGO_DOWNLOAD_FILE_SIZE=%v", req.FileSize),
+		fmt.Sprintf("SFTPGO_DOWNLOAD_PROTOCOL=%v", req.Protocol),
+		fmt.Sprintf("SFTPGO_DOWNLOAD_IP=%v", req.IP),
+		fmt.Sprintf("SFTPGO_DOWNLOAD_METADATA=%v", string(metadata)))
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("pre-download hook timed out: %v", ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return errPreDownloadHookDenied
+	}
+	return err
+}
+
+// CheckPreDownloadHook executes the pre-download hook, if defined, and returns
+// ErrDownloadDenied if the download of the file at fsPath is not allowed.
+// The file is stat'ed only if the hook is defined and info is nil
+func (c *BaseConnection) CheckPreDownloadHook(fsPath, virtualPath, remoteAddr string, info os.FileInfo) error {
+	if Config.PreDownloadHook == "" {
+		return nil
+	}
+	if info == nil {
+		var err error
+		info, err = c.Fs.Stat(fsPath)
+		if err != nil {
+			return c.GetFsError(err)
+		}
+	}
+	startTime := time.Now()
+	err := Config.executePreDownloadHook(preDownloadRequest{
+		Username: c.User.Username,
+		Path:     virtualPath,
+		FileSize: info.Size(),
+		Protocol: c.protocol,
+		IP:       utils.GetIPFromRemoteAddress(remoteAddr),
+		Metadata: c.User.Metadata,
+	})
+	c.Log(logger.LevelDebug, "pre-download hook executed for %#v, elapsed: %v, error: %v", virtualPath,
+		time.Since(startTime), err)
+	if err == nil {
+		return nil
+	}
+	if err == errPreDownloadHookDenied {
+		c.Log(logger.LevelInfo, "denying download of %#v: %v", virtualPath, err)
+		return ErrDownloadDenied
+	}
+	if Config.PreDownloadHookAllowOnFailure {
+		c.Log(logger.LevelWarn, "pre-download hook failed for %#v, the download is allowed: %v", virtualPath, err)
+		return nil
+	}
+	c.Log(logger.LevelWarn, "pre-download hook failed for %#v, denying download: %v", virtualPath, err)
+	return ErrDownloadDenied
+}
@@ -14,6 +14,10 @@ import (
 	"github.com/drakkan/sftpgo/vfs"
 )
 
+// bandwidthScheduleCheckInterval defines how often the bandwidth schedules are
+// evaluated again for the running transfers
+var bandwidthScheduleCheckInterval = 1 * time.Minute
+
 var (
 	// ErrTransferClosed defines the error returned for a closed transfer
 	ErrTransferClosed = errors.New("transfer already closed")
@@ -38,12 +42,26 @@ type BaseTransfer struct { //nolint:maligned
 	MaxWriteSize   int64
 	AbortTransfer  int32
 	sync.Mutex
-	ErrTransfer error
+	ErrTransfer    error
+	downloadVolume *downloadVolume
+	uploadTimer    *time.Timer
+	// bandwidth limit, as KB/s, and the reference time and transferred bytes
+	// used to compute the transfer rate. They change if a bandwidth schedule
+	// starts or ends while transferring
+	bandwidth      int64
+	throttleStart  time.Time
+	throttleBytes  int64
+	bandwidthCheck time.Time
+	// expected checksum for uploads, nil if no checksum verification is required
+	checksum *uploadChecksum
 }
 
 // NewBaseTransfer returns a new BaseTransfer and adds it to the given connection
 func NewBaseTransfer(file vfs.File, conn *BaseConnection, cancelFn func(), fsPath, requestPath string, transferType int,
 	minWriteOffset, initialSize, maxWriteSize int64, isNewFile bool, fs vfs.Fs) *BaseTransfer {
+	if transferType == TransferUpload && file != nil && minWriteOffset == 0 && initialSize == 0 {
+		file = conn.getTextTransformFile(file, requestPath)
+	}
 	t := &BaseTransfer{
 		ID:             conn.GetTransferID(),
 		File:           file,
@@ -64,6 +82,11 @@ func NewBaseTransfer(file vfs.File, conn *BaseConnection, cancelFn func(), fsPat
 	}
 
 	conn.AddTransfer(t)
+	publishTransferEvent(ConnectionEventTransferStart, t, nil)
+	if transferType == TransferUpload {
+		t.startUploadTimer()
+		t.loadSidecarChecksum()
+	}
 	return t
 }
 
@@ -120,6 +143,13 @@ func (t *BaseTransfer) GetRealFsPath(fsPath string) string {
 	return ""
 }
 
+// CheckConcurrentTransfersLimit returns an error if the limit for the concurrent transfers
+// is exceeded, this transfer is not counted. It is useful for protocols, such as WebDAV,
+// that create the transfer before knowing if data will be transferred
+func (t *BaseTransfer) CheckConcurrentTransfersLimit() error {
+	return t.Connection.checkConcurrentTransfersLimit(t.transferType, t.ID)
+}
+
 // SetCancelFn sets the cancel function for the transfer
 func (t *BaseTransfer) SetCancelFn(cancelFn func()) {
 	t.cancelFn = cancelFn
@@ -138,7 +168,8 @@ func (t *BaseTransfer) Truncate(fsPath string, size int64) (int64, error) {
 				if t.MaxWriteSize > 0 {
 					sizeDiff := initialSize - size
 					t.MaxWriteSize += sizeDiff
-					metrics.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.transferType, t.ErrTransfer)
+					metrics.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.transferType,
+						t.Connection.protocol, t.Connection.GetUsername(), t.ErrTransfer)
 					atomic.StoreInt64(&t.BytesReceived, 0)
 				}
 				t.Unlock()
@@ -156,6 +187,38 @@ func (t *BaseTransfer) Truncate(fsPath string, size int64) (int64, error) {
 	return 0, errTransferMismatch
 }
 
+// ReserveDownloadVolume must be called before each read for downloads, it returns the size,
+// up to the given one, that can be read without exceeding the user's download volume limit.
+// The returned size is accounted as downloaded, any unread part must be given back using
+// ReleaseDownloadVolume. ErrDownloadLimitReached is returned if the limit is already reached
+func (t *BaseTransfer) ReserveDownloadVolume(size int) (int, error) {
+	if !t.Connection.User.HasDownloadVolumeLimit() {
+		return size, nil
+	}
+	t.Lock()
+	if t.downloadVolume == nil {
+		// acquired on the first read, WebDAV opens files for stat and listing too
+		t.downloadVolume = downloadVolumes.acquire(t.Connection.User)
+	}
+	t.Unlock()
+
+	reserved, err := t.downloadVolume.reserve(int64(size))
+	if err != nil {
+		t.Connection.Log(logger.LevelInfo, "download volume limit reached for file %#v, bytes sent: %v", t.fsPath,
+			atomic.LoadInt64(&t.BytesSent))
+		t.TransferError(err)
+		return 0, err
+	}
+	return int(reserved), nil
+}
+
+// ReleaseDownloadVolume gives back the specified unread size reserved using ReserveDownloadVolume
+func (t *BaseTransfer) ReleaseDownloadVolume(size int) {
+	if t.downloadVolume != nil {
+		t.downloadVolume.unreserve(int64(size))
+	}
+}
+
 // TransferError is called if there is an unexpected error.
 // For example network or client issues
 func (t *BaseTransfer) TransferError(err error) {
@@ -174,6 +237,67 @@ func (t *BaseTransfer) TransferError(err error) {
 		atomic.LoadInt64(&t.BytesReceived), elapsed)
 }
 
+// startUploadTimer schedules the upload duration check if a maximum duration is
+// defined for the upload path
+func (t *BaseTransfer) startUploadTimer() {
+	maxDuration, _ := t.Connection.User.GetUploadDurationLimit(t.requestPath)
+	if maxDuration <= 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	t.uploadTimer = time.AfterFunc(time.Duration(maxDuration)*time.Second, t.checkUploadDuration)
+}
+
+func (t *BaseTransfer) stopUploadTimer() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.uploadTimer != nil {
+		t.uploadTimer.Stop()
+		t.uploadTimer = nil
+	}
+}
+
+// getMaxUploadDuration returns the allowed duration for this upload, it is extended
+// based on the received bytes if a minimum upload rate is defined
+func (t *BaseTransfer) getMaxUploadDuration() time.Duration {
+	maxDuration, minRate := t.Connection.User.GetUploadDurationLimit(t.requestPath)
+	result := time.Duration(maxDuration) * time.Second
+	if minRate > 0 {
+		result += time.Duration(float64(atomic.LoadInt64(&t.BytesReceived)) / float64(minRate) * float64(time.Second))
+	}
+	return result
+}
+
+// checkUploadDuration aborts the upload and closes the connection if the upload is
+// still running after the allowed duration, otherwise the check is rescheduled
+func (t *BaseTransfer) checkUploadDuration() {
+	elapsed := time.Since(t.start)
+	maxDuration := t.getMaxUploadDuration()
+
+	t.Lock()
+	if t.uploadTimer == nil {
+		// the transfer is already closed
+		t.Unlock()
+		return
+	}
+	if elapsed < maxDuration {
+		t.uploadTimer.Reset(maxDuration - elapsed)
+		t.Unlock()
+		return
+	}
+	t.uploadTimer = nil
+	t.Unlock()
+
+	t.Connection.Log(logger.LevelInfo, "upload %#v running since %v exceeds the allowed duration %v, bytes received: %v, "+
+		"aborting", t.requestPath, elapsed, maxDuration, atomic.LoadInt64(&t.BytesReceived))
+	t.TransferError(ErrUploadDurationExceeded)
+	t.SignalClose()
+	Connections.Close(t.Connection.GetID())
+}
+
 // Close it is called when the transfer is completed.
 // It logs the transfer info, updates the user quota (for uploads)
 // and executes any defined action.
@@ -181,23 +305,49 @@ func (t *BaseTransfer) TransferError(err error) {
 // we try to delete the temporary file
 func (t *BaseTransfer) Close() error {
 	defer t.Connection.RemoveTransfer(t)
+	defer downloadVolumes.release(t.downloadVolume)
+
+	t.stopUploadTimer()
 
 	var err error
 	numFiles := 0
 	if t.isNewFile {
 		numFiles = 1
 	}
-	metrics.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.transferType, t.ErrTransfer)
-	if t.ErrTransfer == ErrQuotaExceeded && t.File != nil {
-		// if quota is exceeded we try to remove the partial file for uploads to local filesystem
+	metrics.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.transferType,
+		t.Connection.protocol, t.Connection.GetUsername(), t.ErrTransfer)
+	if t.transferType == TransferUpload && t.ErrTransfer == nil {
+		t.ErrTransfer = t.verifyChecksum(t.GetRealFsPath(t.fsPath))
+	}
+	if t.ErrTransfer == ErrChecksumMismatch {
+		// the file, or the temporary file in atomic mode, does not match the expected checksum
+		fsPath := t.GetRealFsPath(t.fsPath)
+		err = t.Fs.Remove(fsPath, false)
+		if err == nil {
+			numFiles--
+			atomic.StoreInt64(&t.BytesReceived, 0)
+			t.MinWriteOffset = 0
+		}
+		t.Connection.Log(logger.LevelWarn, "upload rejected: %v, delete file: %#v, deletion error: %v",
+			t.ErrTransfer, fsPath, err)
+		err = nil
+	} else if t.transferType == TransferUpload && t.ErrTransfer == nil && t.isRejectedByPostUploadScan(t.GetRealFsPath(t.fsPath)) {
+		// the file, or the temporary file in atomic mode, was moved to the quarantine or deleted
+		err = ErrUploadRejected
+		numFiles--
+		atomic.StoreInt64(&t.BytesReceived, 0)
+		t.MinWriteOffset = 0
+	} else if (t.ErrTransfer == ErrQuotaExceeded || t.ErrTransfer == ErrUploadDurationExceeded) && t.File != nil {
+		// if quota or the upload duration are exceeded we try to remove the partial file for uploads
+		// to local filesystem
 		err = os.Remove(t.File.Name())
 		if err == nil {
 			numFiles--
 			atomic.StoreInt64(&t.BytesReceived, 0)
 			t.MinWriteOffset = 0
 		}
-		t.Connection.Log(logger.LevelWarn, "upload denied due to space limit, delete temporary file: %#v, deletion error: %v",
-			t.File.Name(), err)
+		t.Connection.Log(logger.LevelWarn, "upload denied: %v, delete temporary file: %#v, deletion error: %v",
+			t.ErrTransfer, t.File.Name(), err)
 	} else if t.transferType == TransferUpload && t.File != nil && t.File.Name() != t.fsPath {
 		if t.ErrTransfer == nil || Config.UploadMode == UploadModeAtomicWithResume {
 			err = os.Rename(t.File.Name(), t.fsPath)
@@ -216,23 +366,32 @@ func (t *BaseTransfer) Close() error {
 	}
 	elapsed := time.Since(t.start).Nanoseconds() / 1000000
 	if t.transferType == TransferDownload {
+		partial := t.isDownloadPartial()
 		logger.TransferLog(downloadLogSender, t.fsPath, elapsed, atomic.LoadInt64(&t.BytesSent), t.Connection.User.Username,
-			t.Connection.ID, t.Connection.protocol)
+			t.Connection.ID, t.Connection.protocol, partial)
 		action := newActionNotification(&t.Connection.User, operationDownload, t.fsPath, "", "", t.Connection.protocol,
 			atomic.LoadInt64(&t.BytesSent), t.ErrTransfer)
+		action.Elapsed = elapsed
+		action.Partial = partial
 		go actionHandler.Handle(action) //nolint:errcheck
 	} else {
 		fileSize := atomic.LoadInt64(&t.BytesReceived) + t.MinWriteOffset
-		info, err := t.Fs.Stat(t.fsPath)
-		if err == nil {
-			fileSize = info.Size()
+		info, errStat := t.Fs.Stat(t.fsPath)
+		if errStat == nil {
+			fileSize = vfs.GetSizeForQuota(info)
 		}
-		t.Connection.Log(logger.LevelDebug, "uploaded file size %v stat error: %v", fileSize, err)
+		t.Connection.Log(logger.LevelDebug, "uploaded file size %v stat error: %v", fileSize, errStat)
 		t.updateQuota(numFiles, fileSize)
 		logger.TransferLog(uploadLogSender, t.fsPath, elapsed, atomic.LoadInt64(&t.BytesReceived), t.Connection.User.Username,
-			t.Connection.ID, t.Connection.protocol)
+			t.Connection.ID, t.Connection.protocol, t.ErrTransfer != nil)
+		actionErr := t.ErrTransfer
+		if err == ErrUploadRejected {
+			actionErr = err
+		}
 		action := newActionNotification(&t.Connection.User, operationUpload, t.fsPath, "", "", t.Connection.protocol,
-			fileSize, t.ErrTransfer)
+			fileSize, actionErr)
+		action.Elapsed = elapsed
+		action.Partial = t.ErrTransfer != nil
 		go actionHandler.Handle(action) //nolint:errcheck
 	}
 	if t.ErrTransfer != nil {
@@ -241,9 +400,24 @@ func (t *BaseTransfer) Close() error {
 			err = t.ErrTransfer
 		}
 	}
+	publishTransferEvent(ConnectionEventTransferEnd, t, err)
 	return err
 }
 
+// isDownloadPartial returns true if the download failed or if the bytes sent don't cover
+// the whole file, for example the client aborted the transfer or requested a range
+func (t *BaseTransfer) isDownloadPartial() bool {
+	if t.ErrTransfer != nil {
+		return true
+	}
+	info, err := t.Fs.Stat(t.fsPath)
+	if err != nil {
+		t.Connection.Log(logger.LevelDebug, "unable to stat downloaded file %#v: %v", t.fsPath, err)
+		return false
+	}
+	return atomic.LoadInt64(&t.BytesSent) < info.Size()
+}
+
 func (t *BaseTransfer) updateQuota(numFiles int, fileSize int64) bool {
 	// S3 uploads are atomic, if there is an error nothing is uploaded
 	if t.File == nil && t.ErrTransfer != nil {
@@ -266,20 +440,53 @@ func (t *BaseTransfer) updateQuota(numFiles int, fileSize int64) bool {
 	return false
 }
 
+// getBandwidth returns the wanted bandwidth, as KB/s, and the start time and the
+// transferred bytes to use to compute the transfer rate.
+// The bandwidth schedules, if any, are periodically evaluated again: if the limit
+// changes the rate is computed from now on
+func (t *BaseTransfer) getBandwidth(trasferredBytes int64) (int64, time.Time, int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	isFirstCheck := t.bandwidthCheck.IsZero()
+	if !isFirstCheck && (len(t.Connection.User.Filters.BandwidthSchedules) == 0 ||
+		now.Sub(t.bandwidthCheck) < bandwidthScheduleCheckInterval) {
+		return t.bandwidth, t.throttleStart, t.throttleBytes
+	}
+	t.bandwidthCheck = now
+	uploadBandwidth, downloadBandwidth := t.Connection.User.GetBandwidthLimits(now)
+	bandwidth := uploadBandwidth
+	if t.transferType == TransferDownload {
+		bandwidth = downloadBandwidth
+	}
+	if isFirstCheck {
+		t.bandwidth = bandwidth
+		t.throttleStart = t.start
+		t.throttleBytes = 0
+	} else if bandwidth != t.bandwidth {
+		t.Connection.Log(logger.LevelDebug, "bandwidth limit for transfer %#v changed from %v to %v KB/s",
+			t.requestPath, t.bandwidth, bandwidth)
+		t.bandwidth = bandwidth
+		t.throttleStart = now
+		t.throttleBytes = trasferredBytes
+	}
+	return t.bandwidth, t.throttleStart, t.throttleBytes
+}
+
 // HandleThrottle manage bandwidth throttling
 func (t *BaseTransfer) HandleThrottle() {
-	var wantedBandwidth int64
 	var trasferredBytes int64
 	if t.transferType == TransferDownload {
-		wantedBandwidth = t.Connection.User.DownloadBandwidth
 		trasferredBytes = atomic.LoadInt64(&t.BytesSent)
 	} else {
-		wantedBandwidth = t.Connection.User.UploadBandwidth
 		trasferredBytes = atomic.LoadInt64(&t.BytesReceived)
 	}
+	wantedBandwidth, start, startBytes := t.getBandwidth(trasferredBytes)
 	if wantedBandwidth > 0 {
+		trasferredBytes -= startBytes
 		// real and wanted elapsed as milliseconds, bytes as kilobytes
-		realElapsed := time.Since(t.start).Nanoseconds() / 1000000
+		realElapsed := time.Since(start).Nanoseconds() / 1000000
 		// trasferredBytes / 1000 = KB/s, we multiply for 1000 to get milliseconds
 		wantedElapsed := 1000 * (trasferredBytes / 1000) / wantedBandwidth
 		if wantedElapsed > realElapsed {
@@ -1,10 +1,15 @@
 package common
 
 import (
+	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -84,6 +89,72 @@ func TestTransferThrottling(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestTransferBandwidthSchedule(t *testing.T) {
+	u := dataprovider.User{
+		Username:          "test",
+		UploadBandwidth:   50,
+		DownloadBandwidth: 40,
+	}
+	now := time.Now()
+	otherDay := int(now.Add(24 * time.Hour).Weekday())
+	u.Filters.BandwidthSchedules = []dataprovider.BandwidthScheduleFilter{
+		{
+			WeekDays:          []int{otherDay},
+			Start:             "00:00",
+			End:               "24:00",
+			UploadBandwidth:   10,
+			DownloadBandwidth: 10,
+		},
+	}
+	upload, download := u.GetBandwidthLimits(now)
+	assert.Equal(t, int64(50), upload)
+	assert.Equal(t, int64(40), download)
+	u.Filters.BandwidthSchedules = append(u.Filters.BandwidthSchedules, dataprovider.BandwidthScheduleFilter{
+		Start:             "00:00",
+		End:               "24:00",
+		UploadBandwidth:   0,
+		DownloadBandwidth: 20,
+	})
+	upload, download = u.GetBandwidthLimits(now)
+	assert.Equal(t, int64(0), upload)
+	assert.Equal(t, int64(20), download)
+
+	fs := vfs.NewOsFs("", os.TempDir(), nil)
+	conn := NewBaseConnection("id", ProtocolSFTP, u, nil)
+	transfer := NewBaseTransfer(nil, conn, nil, "", "", TransferDownload, 0, 0, 0, true, fs)
+	bandwidth, start, startBytes := transfer.getBandwidth(100)
+	assert.Equal(t, int64(20), bandwidth)
+	assert.Equal(t, transfer.start, start)
+	assert.Equal(t, int64(0), startBytes)
+	// the schedules are not evaluated again before the check interval
+	transfer.Connection.User.Filters.BandwidthSchedules[1].DownloadBandwidth = 30
+	bandwidth, _, _ = transfer.getBandwidth(200)
+	assert.Equal(t, int64(20), bandwidth)
+
+	checkInterval := bandwidthScheduleCheckInterval
+	bandwidthScheduleCheckInterval = 0
+	defer func() {
+		bandwidthScheduleCheckInterval = checkInterval
+	}()
+	// the rate is computed again from now on if the limit changes
+	bandwidth, start, startBytes = transfer.getBandwidth(300)
+	assert.Equal(t, int64(30), bandwidth)
+	assert.True(t, start.After(transfer.start))
+	assert.Equal(t, int64(300), startBytes)
+	bandwidth, _, startBytes = transfer.getBandwidth(400)
+	assert.Equal(t, int64(30), bandwidth)
+	assert.Equal(t, int64(300), startBytes)
+	// unlimited download while the schedule is active
+	transfer.Connection.User.Filters.BandwidthSchedules[1].DownloadBandwidth = 0
+	transfer.BytesSent = 131072
+	startTime := time.Now()
+	transfer.HandleThrottle()
+	elapsed := time.Since(startTime).Nanoseconds() / 1000000
+	assert.Less(t, elapsed, int64(500))
+	err := transfer.Close()
+	assert.NoError(t, err)
+}
+
 func TestRealPath(t *testing.T) {
 	testFile := filepath.Join(os.TempDir(), "afile.txt")
 	fs := vfs.NewOsFs("123", os.TempDir(), nil)
@@ -252,3 +323,373 @@ func TestTransferErrors(t *testing.T) {
 
 	assert.Len(t, conn.GetTransfers(), 0)
 }
+
+type transferActionHandlerStub struct {
+	notifications chan ActionNotification
+}
+
+func (h *transferActionHandlerStub) Handle(notification ActionNotification) error {
+	h.notifications <- notification
+	return nil
+}
+
+func TestAbortedDownloadNotification(t *testing.T) {
+	handler := &transferActionHandlerStub{
+		notifications: make(chan ActionNotification, 1),
+	}
+	InitializeActionHandler(handler)
+	t.Cleanup(func() {
+		InitializeActionHandler(defaultActionHandler{})
+	})
+	waitNotification := func() ActionNotification {
+		select {
+		case a := <-handler.notifications:
+			return a
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "download notification not received")
+		}
+		return ActionNotification{}
+	}
+
+	testFile := filepath.Join(os.TempDir(), "download_test_file")
+	err := ioutil.WriteFile(testFile, make([]byte, 65536), os.ModePerm)
+	require.NoError(t, err)
+	fs := vfs.NewOsFs("id", os.TempDir(), nil)
+	u := dataprovider.User{
+		Username: "test",
+		HomeDir:  os.TempDir(),
+	}
+	conn := NewBaseConnection("id", ProtocolSFTP, u, fs)
+	// the client disconnects after receiving half of the file, the transfer is closed without errors
+	file, err := os.Open(testFile)
+	require.NoError(t, err)
+	transfer := NewBaseTransfer(file, conn, nil, testFile, "/download_test_file", TransferDownload, 0, 0, 0, false, fs)
+	buf := make([]byte, 32768)
+	n, err := file.ReadAt(buf, 0)
+	assert.NoError(t, err)
+	transfer.BytesSent = int64(n)
+	err = file.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.NoError(t, err)
+	a := waitNotification()
+	assert.Equal(t, operationDownload, a.Action)
+	assert.Equal(t, testFile, a.Path)
+	assert.Equal(t, int64(32768), a.FileSize)
+	assert.Equal(t, 1, a.Status)
+	assert.True(t, a.Partial)
+	assert.GreaterOrEqual(t, a.Elapsed, int64(0))
+	assert.Len(t, conn.GetTransfers(), 0)
+	// the download is aborted with an error
+	file, err = os.Open(testFile)
+	require.NoError(t, err)
+	transfer = NewBaseTransfer(file, conn, nil, testFile, "/download_test_file", TransferDownload, 0, 0, 0, false, fs)
+	transfer.BytesSent = 100
+	transfer.TransferError(errors.New("connection reset"))
+	err = file.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.Error(t, err)
+	a = waitNotification()
+	assert.Equal(t, int64(100), a.FileSize)
+	assert.Equal(t, 0, a.Status)
+	assert.True(t, a.Partial)
+	// completed download
+	file, err = os.Open(testFile)
+	require.NoError(t, err)
+	transfer = NewBaseTransfer(file, conn, nil, testFile, "/download_test_file", TransferDownload, 0, 0, 0, false, fs)
+	transfer.BytesSent = 65536
+	err = file.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.NoError(t, err)
+	a = waitNotification()
+	assert.Equal(t, int64(65536), a.FileSize)
+	assert.False(t, a.Partial)
+
+	err = os.Remove(testFile)
+	assert.NoError(t, err)
+}
+
+func TestUploadDuration(t *testing.T) {
+	testFile := filepath.Join(os.TempDir(), "upload_duration_test_file")
+	user := dataprovider.User{
+		Username: "user",
+		HomeDir:  os.TempDir(),
+	}
+	user.Filters.MaxUploadDuration = 10
+	user.Filters.MinUploadRate = 1024
+	user.Filters.UploadDurationLimits = []dataprovider.UploadDurationLimitFilter{
+		{
+			Path:        "/fast",
+			MaxDuration: 0,
+		},
+	}
+	fs := vfs.NewOsFs("", os.TempDir(), nil)
+	conn := NewBaseConnection("id", ProtocolSFTP, user, fs)
+	file, err := os.Create(testFile)
+	require.NoError(t, err)
+	transfer := NewBaseTransfer(file, conn, nil, testFile, "/upload_duration_test_file", TransferUpload, 0, 0, 0, true, fs)
+	assert.NotNil(t, transfer.uploadTimer)
+	assert.Equal(t, 10*time.Second, transfer.getMaxUploadDuration())
+	transfer.BytesReceived = 2048
+	assert.Equal(t, 12*time.Second, transfer.getMaxUploadDuration())
+	// the check is rescheduled if the duration is not exceeded
+	transfer.checkUploadDuration()
+	assert.NotNil(t, transfer.uploadTimer)
+	assert.Nil(t, transfer.ErrTransfer)
+	transfer.start = time.Now().Add(-20 * time.Second)
+	transfer.checkUploadDuration()
+	assert.Nil(t, transfer.uploadTimer)
+	assert.Equal(t, ErrUploadDurationExceeded, transfer.ErrTransfer)
+	err = file.Close()
+	assert.NoError(t, err)
+	err = transfer.Close()
+	assert.Equal(t, ErrUploadDurationExceeded, err)
+	// the partial file is removed
+	assert.NoFileExists(t, testFile)
+	// no limit for this directory
+	transfer = NewBaseTransfer(nil, conn, nil, testFile, "/fast/file", TransferUpload, 0, 0, 0, true, fs)
+	assert.Nil(t, transfer.uploadTimer)
+	transfer.TransferError(ErrUploadDurationExceeded)
+	err = transfer.Close()
+	assert.Error(t, err)
+	// the timer is stopped when the transfer is closed
+	transfer = NewBaseTransfer(nil, conn, nil, testFile, "/file", TransferUpload, 0, 0, 0, true, fs)
+	assert.NotNil(t, transfer.uploadTimer)
+	err = transfer.Close()
+	assert.NoError(t, err)
+	assert.Nil(t, transfer.uploadTimer)
+	transfer.checkUploadDuration()
+	assert.Nil(t, transfer.ErrTransfer)
+}
+
+func TestPostUploadScanHook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req postUploadScanRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Username != "test" || req.FileSize != 9 || req.FsPath == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch req.Path {
+		case "/infected":
+			w.WriteHeader(http.StatusForbidden)
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	handler := &transferActionHandlerStub{
+		notifications: make(chan ActionNotification, 2),
+	}
+	InitializeActionHandler(handler)
+	t.Cleanup(func() {
+		InitializeActionHandler(defaultActionHandler{})
+	})
+	waitNotifications := func() map[string]ActionNotification {
+		result := make(map[string]ActionNotification)
+		for len(result) < 2 {
+			select {
+			case a := <-handler.notifications:
+				result[a.Action] = a
+			case <-time.After(2 * time.Second):
+				require.FailNow(t, "notifications not received")
+			}
+		}
+		return result
+	}
+	quarantineDir := filepath.Join(os.TempDir(), "quarantine")
+	err := os.MkdirAll(quarantineDir, os.ModePerm)
+	require.NoError(t, err)
+	fs := vfs.NewOsFs("id", os.TempDir(), nil)
+	u := dataprovider.User{
+		Username: "test",
+		HomeDir:  os.TempDir(),
+	}
+	conn := NewBaseConnection("id", ProtocolSFTP, u, fs)
+	tempPath := filepath.Join(os.TempDir(), "scan_temp_file")
+	fsPath := filepath.Join(os.TempDir(), "scan_file")
+	upload := func(requestPath string) error {
+		err := ioutil.WriteFile(tempPath, []byte("test data"), os.ModePerm)
+		require.NoError(t, err)
+		file, err := os.Open(tempPath)
+		require.NoError(t, err)
+		transfer := NewBaseTransfer(file, conn, nil, fsPath, requestPath, TransferUpload, 0, 0, 0, true, fs)
+		transfer.BytesReceived = 9
+		err = file.Close()
+		assert.NoError(t, err)
+		return transfer.Close()
+	}
+
+	Config.PostUploadScanHook = server.URL
+	Config.PostUploadScanQuarantine = quarantineDir
+	// clean file, the temporary file is renamed as for any atomic upload
+	err = upload("/clean")
+	assert.NoError(t, err)
+	assert.NoFileExists(t, tempPath)
+	assert.FileExists(t, fsPath)
+	err = os.Remove(fsPath)
+	assert.NoError(t, err)
+	a := <-handler.notifications
+	assert.Equal(t, operationUpload, a.Action)
+	assert.Equal(t, 1, a.Status)
+	// rejected file, moved to the quarantine
+	err = upload("/infected")
+	assert.Equal(t, ErrUploadRejected, err)
+	assert.NoFileExists(t, tempPath)
+	assert.NoFileExists(t, fsPath)
+	notifications := waitNotifications()
+	a = notifications[operationQuarantine]
+	assert.Equal(t, tempPath, a.Path)
+	assert.True(t, strings.HasPrefix(a.TargetPath, quarantineDir))
+	assert.True(t, strings.HasSuffix(a.TargetPath, "_test_infected"))
+	assert.Equal(t, int64(9), a.FileSize)
+	assert.Equal(t, 1, a.Status)
+	assert.FileExists(t, a.TargetPath)
+	a = notifications[operationUpload]
+	assert.Equal(t, int64(0), a.FileSize)
+	assert.Equal(t, 0, a.Status)
+	// the hook fails, the file is rejected and removed if the quarantine is not usable
+	Config.PostUploadScanQuarantine = filepath.Join(os.TempDir(), "missing_quarantine_dir")
+	err = upload("/fail")
+	assert.Equal(t, ErrUploadRejected, err)
+	assert.NoFileExists(t, tempPath)
+	assert.NoFileExists(t, fsPath)
+	notifications = waitNotifications()
+	assert.Empty(t, notifications[operationQuarantine].TargetPath)
+	// failures can be configured to accept the files, rejections are always respected
+	Config.PostUploadScanQuarantine = ""
+	Config.PostUploadScanAllowOnFailure = true
+	err = upload("/fail")
+	assert.NoError(t, err)
+	assert.FileExists(t, fsPath)
+	a = <-handler.notifications
+	assert.Equal(t, operationUpload, a.Action)
+	err = upload("/infected")
+	assert.Equal(t, ErrUploadRejected, err)
+	assert.NoFileExists(t, tempPath)
+	// the rejected temporary file is removed and the existing file is untouched
+	assert.FileExists(t, fsPath)
+	notifications = waitNotifications()
+	assert.Empty(t, notifications[operationQuarantine].TargetPath)
+	assert.Len(t, conn.GetTransfers(), 0)
+
+	if runtime.GOOS != osWindows {
+		hookPath := filepath.Join(os.TempDir(), "post_upload_scan_hook.sh")
+		Config.PostUploadScanHook = hookPath
+		err = ioutil.WriteFile(hookPath, []byte("#!/bin/sh\n\nif [ \"$SFTPGO_SCAN_PATH\" = \"/clean\" ] && "+
+			"[ \"$SFTPGO_SCAN_FS_PATH\" = \""+tempPath+"\" ]; then exit 0; fi\nexit 1\n"), os.ModePerm)
+		assert.NoError(t, err)
+		err = upload("/clean")
+		assert.NoError(t, err)
+		a = <-handler.notifications
+		assert.Equal(t, operationUpload, a.Action)
+		err = upload("/infected")
+		assert.Equal(t, ErrUploadRejected, err)
+		waitNotifications()
+		err = os.Remove(hookPath)
+		assert.NoError(t, err)
+	}
+
+	Config.PostUploadScanHook = ""
+	Config.PostUploadScanAllowOnFailure = false
+	err = os.Remove(fsPath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(quarantineDir)
+	assert.NoError(t, err)
+}
+
+func TestUploadChecksum(t *testing.T) {
+	_, err := ParseSHA256Checksum("invalid")
+	assert.Error(t, err)
+	_, err = ParseSHA256Checksum("abcd")
+	assert.Error(t, err)
+
+	homeDir := filepath.Join(os.TempDir(), "checksum_test")
+	err = os.MkdirAll(homeDir, os.ModePerm)
+	assert.NoError(t, err)
+	user := dataprovider.User{
+		Username: "test",
+		HomeDir:  homeDir,
+	}
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	fs := vfs.NewOsFs("", homeDir, nil)
+	conn := NewBaseConnection("", ProtocolSFTP, user, fs)
+	content := []byte("test content")
+	expected := "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72"
+
+	upload := func(name, checksum string, offsets []int64) error {
+		fsPath := filepath.Join(homeDir, name)
+		file, err := os.Create(fsPath)
+		require.NoError(t, err)
+		transfer := NewBaseTransfer(file, conn, nil, fsPath, "/"+name, TransferUpload, 0, 0, 0, true, fs)
+		if checksum != "" {
+			if err := transfer.SetExpectedChecksum(checksum); err != nil {
+				return err
+			}
+		}
+		for _, off := range offsets {
+			end := off + 4
+			if end > int64(len(content)) {
+				end = int64(len(content))
+			}
+			n, err := file.WriteAt(content[off:end], off)
+			require.NoError(t, err)
+			transfer.UpdateChecksum(content[off:off+int64(n)], off)
+			transfer.BytesReceived += int64(n)
+		}
+		err = file.Close()
+		require.NoError(t, err)
+		return transfer.Close()
+	}
+
+	err = upload("file1", expected, []int64{0, 4, 8})
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(homeDir, "file1"))
+	// out of order writes, the checksum is computed reading back the file
+	err = upload("file2", strings.ToUpper(expected), []int64{4, 0, 8})
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(homeDir, "file2"))
+	err = upload("file3", strings.Repeat("a", 64), []int64{0, 4, 8})
+	assert.Equal(t, ErrChecksumMismatch, err)
+	assert.NoFileExists(t, filepath.Join(homeDir, "file3"))
+	err = upload("file4", strings.Repeat("a", 64), []int64{8, 4, 0})
+	assert.Equal(t, ErrChecksumMismatch, err)
+	assert.NoFileExists(t, filepath.Join(homeDir, "file4"))
+	err = upload("file5", "invalid", nil)
+	assert.Error(t, err)
+
+	transfer := NewBaseTransfer(nil, conn, nil, "", "/file", TransferDownload, 0, 0, 0, false, fs)
+	assert.Error(t, transfer.SetExpectedChecksum(expected))
+	assert.NoError(t, transfer.Close())
+	// sidecar files
+	Config.UploadChecksumSidecar = true
+	err = ioutil.WriteFile(filepath.Join(homeDir, "file6.sha256"), []byte(expected+"  file6\n"), os.ModePerm)
+	assert.NoError(t, err)
+	err = upload("file6", "", []int64{0, 4, 8})
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(homeDir, "file6"))
+	err = ioutil.WriteFile(filepath.Join(homeDir, "file7.sha256"), []byte(strings.Repeat("b", 64)), os.ModePerm)
+	assert.NoError(t, err)
+	err = upload("file7", "", []int64{0, 4, 8})
+	assert.Equal(t, ErrChecksumMismatch, err)
+	assert.NoFileExists(t, filepath.Join(homeDir, "file7"))
+	// an invalid sidecar is ignored
+	err = ioutil.WriteFile(filepath.Join(homeDir, "file8.sha256"), []byte("\n"), os.ModePerm)
+	assert.NoError(t, err)
+	err = upload("file8", "", []int64{0, 4, 8})
+	assert.NoError(t, err)
+	Config.UploadChecksumSidecar = false
+
+	checksum, err := GetFileSHA256(fs, filepath.Join(homeDir, "file1"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, checksum)
+	_, err = GetFileSHA256(fs, filepath.Join(homeDir, "missing"))
+	assert.Error(t, err)
+
+	err = os.RemoveAll(homeDir)
+	assert.NoError(t, err)
+}
@@ -12,10 +12,12 @@ import (
 	"github.com/drakkan/sftpgo/ftpd"
 	"github.com/drakkan/sftpgo/httpclient"
 	"github.com/drakkan/sftpgo/httpd"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/version"
+	"github.com/drakkan/sftpgo/vfs"
 	"github.com/drakkan/sftpgo/webdavd"
 )
 
@@ -43,6 +45,7 @@ type globalConfig struct {
 	ProviderConf dataprovider.Config   `json:"data_provider" mapstructure:"data_provider"`
 	HTTPDConfig  httpd.Conf            `json:"httpd" mapstructure:"httpd"`
 	HTTPConfig   httpclient.Config     `json:"http" mapstructure:"http"`
+	KMSConfig    kms.Config            `json:"kms" mapstructure:"kms"`
 }
 
 func init() {
@@ -58,6 +61,24 @@ func init() {
 			SetstatMode:   0,
 			ProxyProtocol: 0,
 			ProxyAllowed:  []string{},
+			SymlinksMode:  0,
+			BackendTimeouts: vfs.BackendTimeouts{
+				Metadata:     30,
+				LongMetadata: 300,
+				TransferIdle: 0,
+			},
+			UploadIntegrityCheck:          false,
+			MaxOpenFiles:                  0,
+			PreDownloadHook:               "",
+			PreDownloadHookTimeout:        30,
+			PreDownloadHookAllowOnFailure: false,
+			PostUploadScanHook:            "",
+			PostUploadScanHookTimeout:     60,
+			PostUploadScanAllowOnFailure:  false,
+			PostUploadScanQuarantine:      "",
+			UploadChecksumSidecar:         false,
+			PerUserMetrics:                false,
+			DiskSpaceChecks:               []common.DiskSpaceCheck{},
 		},
 		SFTPD: sftpd.Configuration{
 			Banner:                  defaultSFTPDBanner,
@@ -70,9 +91,13 @@ func init() {
 			MACs:                    []string{},
 			TrustedUserCAKeys:       []string{},
 			LoginBannerFile:         "",
+			LoginBanners:            []sftpd.LoginBanner{},
 			EnabledSSHCommands:      sftpd.GetDefaultSSHCommands(),
 			KeyboardInteractiveHook: "",
 			PasswordAuthentication:  true,
+			DeniedClientVersions:    []string{},
+			AllowedClientVersions:   []string{},
+			ListAsyncThreshold:      0,
 		},
 		FTPD: ftpd.Configuration{
 			BindPort:                 0,
@@ -81,6 +106,7 @@ func init() {
 			BannerFile:               "",
 			ActiveTransfersPortNon20: false,
 			ForcePassiveIP:           "",
+			PassiveIPDiscoveryHook:   "",
 			PassivePortRange: ftpd.PortRange{
 				Start: 50000,
 				End:   50100,
@@ -112,27 +138,34 @@ func init() {
 					MaxSize: 1000,
 				},
 			},
+			RejectZeroLengthRanges: false,
+			Locks: webdavd.LocksConfig{
+				DefaultTimeout: 600,
+				MaxTimeout:     3600,
+			},
 		},
 		ProviderConf: dataprovider.Config{
-			Driver:           "sqlite",
-			Name:             "sftpgo.db",
-			Host:             "",
-			Port:             5432,
-			Username:         "",
-			Password:         "",
-			ConnectionString: "",
-			SQLTablesPrefix:  "",
-			ManageUsers:      1,
-			SSLMode:          0,
-			TrackQuota:       1,
-			PoolSize:         0,
-			UsersBaseDir:     "",
+			Driver:               "sqlite",
+			Name:                 "sftpgo.db",
+			Host:                 "",
+			Port:                 5432,
+			Username:             "",
+			Password:             "",
+			ConnectionString:     "",
+			ReadConnectionString: "",
+			SQLTablesPrefix:      "",
+			ManageUsers:          1,
+			SSLMode:              0,
+			TrackQuota:           1,
+			PoolSize:             0,
+			UsersBaseDir:         "",
 			Actions: dataprovider.UserActions{
 				ExecuteOn: []string{},
 				Hook:      "",
 			},
 			ExternalAuthHook:   "",
 			ExternalAuthScope:  0,
+			AuthBackends:       []string{},
 			CredentialsPath:    "credentials",
 			PreLoginHook:       "",
 			PostLoginHook:      "",
@@ -148,6 +181,43 @@ func init() {
 			},
 			UpdateMode:                0,
 			PreferDatabaseCredentials: false,
+			UsersDefaultExpiration:    0,
+			ExpirationWarningDays:     0,
+			QuotaWarningThresholds:    []int{},
+			MetadataKeys:              []string{},
+			LoginRetry: dataprovider.LoginRetry{
+				MaxRetries: 0,
+				Backoff:    200,
+			},
+			LoginLockout: dataprovider.LoginLockout{
+				MaxFailures:  0,
+				LockDuration: 15,
+			},
+			TOTPSkew: 1,
+			LDAP: dataprovider.LDAPConfig{
+				URL:                "",
+				StartTLS:           false,
+				SkipTLSVerify:      false,
+				BindDN:             "",
+				BindPassword:       "",
+				BaseDN:             "",
+				UserFilter:         "(uid=%s)",
+				HomeDirAttribute:   "",
+				UIDAttribute:       "",
+				GIDAttribute:       "",
+				GroupAttribute:     "memberOf",
+				DefaultPermissions: []string{},
+				GroupPermissions:   []dataprovider.LDAPGroupPermissions{},
+				Timeout:            10,
+			},
+			RedisCache: dataprovider.RedisCacheConfig{
+				Address:   "",
+				Password:  "",
+				DB:        0,
+				TTL:       60,
+				KeyPrefix: "sftpgo_user_",
+			},
+			DeletedUsersRetention: 0,
 		},
 		HTTPDConfig: httpd.Conf{
 			BindPort:           8080,
@@ -158,11 +228,60 @@ func init() {
 			AuthUserFile:       "",
 			CertificateFile:    "",
 			CertificateKeyFile: "",
+			StructuredErrors:   false,
+			ScheduledBackups: httpd.ScheduledBackupsConfig{
+				Interval:   0,
+				OutputDir:  "",
+				KeepLast:   0,
+				KeepDays:   0,
+				Passphrase: "",
+			},
+			AuditLog: httpd.AuditLogConfig{
+				Enabled: false,
+				LogFile: "",
+				Hook:    "",
+			},
 		},
 		HTTPConfig: httpclient.Config{
 			Timeout:        20,
 			CACertificates: nil,
 			SkipTLSVerify:  false,
+			RetryQueue: httpclient.RetryQueueConfig{
+				MaxAttempts: 0,
+				BaseDelay:   5,
+				MaxDelay:    600,
+				Path:        "hooks_queue",
+			},
+		},
+		KMSConfig: kms.Config{
+			Provider: kms.ProviderLocal,
+			Vault: kms.VaultConfig{
+				URL:         "",
+				Token:       "",
+				Namespace:   "",
+				Mode:        kms.VaultModeTransit,
+				TransitPath: "transit",
+				TransitKey:  "sftpgo",
+				KVPath:      "secret",
+				KVPrefix:    "sftpgo",
+				KVVersion:   2,
+			},
+			AzureKeyVault: kms.AzureKeyVaultConfig{
+				VaultURL:     "",
+				TenantID:     "",
+				ClientID:     "",
+				ClientSecret: "",
+				SecretPrefix: "sftpgo",
+				CacheTTL:     60,
+			},
+			AWSSecretsManager: kms.AWSSecretsManagerConfig{
+				Enabled:      false,
+				Region:       "",
+				Endpoint:     "",
+				AccessKey:    "",
+				AccessSecret: "",
+				CacheTTL:     300,
+			},
 		},
 	}
 
@@ -225,12 +344,12 @@ func SetHTTPDConfig(config httpd.Conf) {
 	globalConf.HTTPDConfig = config
 }
 
-//GetProviderConf returns the configuration for the data provider
+// GetProviderConf returns the configuration for the data provider
 func GetProviderConf() dataprovider.Config {
 	return globalConf.ProviderConf
 }
 
-//SetProviderConf sets the configuration for the data provider
+// SetProviderConf sets the configuration for the data provider
 func SetProviderConf(config dataprovider.Config) {
 	globalConf.ProviderConf = config
 }
@@ -240,6 +359,16 @@ func GetHTTPConfig() httpclient.Config {
 	return globalConf.HTTPConfig
 }
 
+// GetKMSConfig returns the configuration for the secret provider
+func GetKMSConfig() kms.Config {
+	return globalConf.KMSConfig
+}
+
+// SetKMSConfig sets the configuration for the secret provider
+func SetKMSConfig(config kms.Config) {
+	globalConf.KMSConfig = config
+}
+
 // HasServicesToStart returns true if the config defines at least a service to start.
 // Supported services are SFTP, FTP and WebDAV
 func HasServicesToStart() bool {
@@ -378,6 +507,21 @@ func setViperDefaults() {
 	viper.SetDefault("common.proxy_protocol", globalConf.Common.ProxyProtocol)
 	viper.SetDefault("common.proxy_allowed", globalConf.Common.ProxyAllowed)
 	viper.SetDefault("common.post_connect_hook", globalConf.Common.PostConnectHook)
+	viper.SetDefault("common.symlinks_mode", globalConf.Common.SymlinksMode)
+	viper.SetDefault("common.backend_timeouts.metadata", globalConf.Common.BackendTimeouts.Metadata)
+	viper.SetDefault("common.backend_timeouts.long_metadata", globalConf.Common.BackendTimeouts.LongMetadata)
+	viper.SetDefault("common.backend_timeouts.transfer_idle", globalConf.Common.BackendTimeouts.TransferIdle)
+	viper.SetDefault("common.upload_integrity_check", globalConf.Common.UploadIntegrityCheck)
+	viper.SetDefault("common.max_open_files", globalConf.Common.MaxOpenFiles)
+	viper.SetDefault("common.pre_download_hook", globalConf.Common.PreDownloadHook)
+	viper.SetDefault("common.pre_download_hook_timeout", globalConf.Common.PreDownloadHookTimeout)
+	viper.SetDefault("common.pre_download_hook_allow_on_failure", globalConf.Common.PreDownloadHookAllowOnFailure)
+	viper.SetDefault("common.post_upload_scan_hook", globalConf.Common.PostUploadScanHook)
+	viper.SetDefault("common.post_upload_scan_hook_timeout", globalConf.Common.PostUploadScanHookTimeout)
+	viper.SetDefault("common.post_upload_scan_allow_on_failure", globalConf.Common.PostUploadScanAllowOnFailure)
+	viper.SetDefault("common.post_upload_scan_quarantine", globalConf.Common.PostUploadScanQuarantine)
+	viper.SetDefault("common.upload_checksum_sidecar", globalConf.Common.UploadChecksumSidecar)
+	viper.SetDefault("common.per_user_metrics", globalConf.Common.PerUserMetrics)
 	viper.SetDefault("sftpd.bind_port", globalConf.SFTPD.BindPort)
 	viper.SetDefault("sftpd.bind_address", globalConf.SFTPD.BindAddress)
 	viper.SetDefault("sftpd.max_auth_tries", globalConf.SFTPD.MaxAuthTries)
@@ -391,12 +535,16 @@ func setViperDefaults() {
 	viper.SetDefault("sftpd.enabled_ssh_commands", globalConf.SFTPD.EnabledSSHCommands)
 	viper.SetDefault("sftpd.keyboard_interactive_auth_hook", globalConf.SFTPD.KeyboardInteractiveHook)
 	viper.SetDefault("sftpd.password_authentication", globalConf.SFTPD.PasswordAuthentication)
+	viper.SetDefault("sftpd.denied_client_versions", globalConf.SFTPD.DeniedClientVersions)
+	viper.SetDefault("sftpd.list_async_threshold", globalConf.SFTPD.ListAsyncThreshold)
+	viper.SetDefault("sftpd.allowed_client_versions", globalConf.SFTPD.AllowedClientVersions)
 	viper.SetDefault("ftpd.bind_port", globalConf.FTPD.BindPort)
 	viper.SetDefault("ftpd.bind_address", globalConf.FTPD.BindAddress)
 	viper.SetDefault("ftpd.banner", globalConf.FTPD.Banner)
 	viper.SetDefault("ftpd.banner_file", globalConf.FTPD.BannerFile)
 	viper.SetDefault("ftpd.active_transfers_port_non_20", globalConf.FTPD.ActiveTransfersPortNon20)
 	viper.SetDefault("ftpd.force_passive_ip", globalConf.FTPD.ForcePassiveIP)
+	viper.SetDefault("ftpd.passive_ip_discovery_hook", globalConf.FTPD.PassiveIPDiscoveryHook)
 	viper.SetDefault("ftpd.passive_port_range.start", globalConf.FTPD.PassivePortRange.Start)
 	viper.SetDefault("ftpd.passive_port_range.end", globalConf.FTPD.PassivePortRange.End)
 	viper.SetDefault("ftpd.certificate_file", globalConf.FTPD.CertificateFile)
@@ -417,6 +565,9 @@ func setViperDefaults() {
 	viper.SetDefault("webdavd.cache.users.max_size", globalConf.WebDAVD.Cache.Users.MaxSize)
 	viper.SetDefault("webdavd.cache.mime_types.enabled", globalConf.WebDAVD.Cache.MimeTypes.Enabled)
 	viper.SetDefault("webdavd.cache.mime_types.max_size", globalConf.WebDAVD.Cache.MimeTypes.MaxSize)
+	viper.SetDefault("webdavd.reject_zero_length_ranges", globalConf.WebDAVD.RejectZeroLengthRanges)
+	viper.SetDefault("webdavd.locks.default_timeout", globalConf.WebDAVD.Locks.DefaultTimeout)
+	viper.SetDefault("webdavd.locks.max_timeout", globalConf.WebDAVD.Locks.MaxTimeout)
 	viper.SetDefault("data_provider.driver", globalConf.ProviderConf.Driver)
 	viper.SetDefault("data_provider.name", globalConf.ProviderConf.Name)
 	viper.SetDefault("data_provider.host", globalConf.ProviderConf.Host)
@@ -425,6 +576,7 @@ func setViperDefaults() {
 	viper.SetDefault("data_provider.password", globalConf.ProviderConf.Password)
 	viper.SetDefault("data_provider.sslmode", globalConf.ProviderConf.SSLMode)
 	viper.SetDefault("data_provider.connection_string", globalConf.ProviderConf.ConnectionString)
+	viper.SetDefault("data_provider.read_connection_string", globalConf.ProviderConf.ReadConnectionString)
 	viper.SetDefault("data_provider.sql_tables_prefix", globalConf.ProviderConf.SQLTablesPrefix)
 	viper.SetDefault("data_provider.manage_users", globalConf.ProviderConf.ManageUsers)
 	viper.SetDefault("data_provider.track_quota", globalConf.ProviderConf.TrackQuota)
@@ -434,6 +586,7 @@ func setViperDefaults() {
 	viper.SetDefault("data_provider.actions.hook", globalConf.ProviderConf.Actions.Hook)
 	viper.SetDefault("data_provider.external_auth_hook", globalConf.ProviderConf.ExternalAuthHook)
 	viper.SetDefault("data_provider.external_auth_scope", globalConf.ProviderConf.ExternalAuthScope)
+	viper.SetDefault("data_provider.auth_backends", globalConf.ProviderConf.AuthBackends)
 	viper.SetDefault("data_provider.credentials_path", globalConf.ProviderConf.CredentialsPath)
 	viper.SetDefault("data_provider.prefer_database_credentials", globalConf.ProviderConf.PreferDatabaseCredentials)
 	viper.SetDefault("data_provider.pre_login_hook", globalConf.ProviderConf.PreLoginHook)
@@ -445,6 +598,34 @@ func setViperDefaults() {
 	viper.SetDefault("data_provider.password_hashing.argon2_options.iterations", globalConf.ProviderConf.PasswordHashing.Argon2Options.Iterations)
 	viper.SetDefault("data_provider.password_hashing.argon2_options.parallelism", globalConf.ProviderConf.PasswordHashing.Argon2Options.Parallelism)
 	viper.SetDefault("data_provider.update_mode", globalConf.ProviderConf.UpdateMode)
+	viper.SetDefault("data_provider.users_default_expiration", globalConf.ProviderConf.UsersDefaultExpiration)
+	viper.SetDefault("data_provider.expiration_warning_days", globalConf.ProviderConf.ExpirationWarningDays)
+	viper.SetDefault("data_provider.quota_warning_thresholds", globalConf.ProviderConf.QuotaWarningThresholds)
+	viper.SetDefault("data_provider.metadata_keys", globalConf.ProviderConf.MetadataKeys)
+	viper.SetDefault("data_provider.login_retry.max_retries", globalConf.ProviderConf.LoginRetry.MaxRetries)
+	viper.SetDefault("data_provider.login_retry.backoff", globalConf.ProviderConf.LoginRetry.Backoff)
+	viper.SetDefault("data_provider.login_lockout.max_failures", globalConf.ProviderConf.LoginLockout.MaxFailures)
+	viper.SetDefault("data_provider.login_lockout.lock_duration", globalConf.ProviderConf.LoginLockout.LockDuration)
+	viper.SetDefault("data_provider.totp_skew", globalConf.ProviderConf.TOTPSkew)
+	viper.SetDefault("data_provider.ldap.url", globalConf.ProviderConf.LDAP.URL)
+	viper.SetDefault("data_provider.ldap.start_tls", globalConf.ProviderConf.LDAP.StartTLS)
+	viper.SetDefault("data_provider.ldap.skip_tls_verify", globalConf.ProviderConf.LDAP.SkipTLSVerify)
+	viper.SetDefault("data_provider.ldap.bind_dn", globalConf.ProviderConf.LDAP.BindDN)
+	viper.SetDefault("data_provider.ldap.bind_password", globalConf.ProviderConf.LDAP.BindPassword)
+	viper.SetDefault("data_provider.ldap.base_dn", globalConf.ProviderConf.LDAP.BaseDN)
+	viper.SetDefault("data_provider.ldap.user_filter", globalConf.ProviderConf.LDAP.UserFilter)
+	viper.SetDefault("data_provider.ldap.home_dir_attribute", globalConf.ProviderConf.LDAP.HomeDirAttribute)
+	viper.SetDefault("data_provider.ldap.uid_attribute", globalConf.ProviderConf.LDAP.UIDAttribute)
+	viper.SetDefault("data_provider.ldap.gid_attribute", globalConf.ProviderConf.LDAP.GIDAttribute)
+	viper.SetDefault("data_provider.ldap.group_attribute", globalConf.ProviderConf.LDAP.GroupAttribute)
+	viper.SetDefault("data_provider.ldap.default_permissions", globalConf.ProviderConf.LDAP.DefaultPermissions)
+	viper.SetDefault("data_provider.ldap.timeout", globalConf.ProviderConf.LDAP.Timeout)
+	viper.SetDefault("data_provider.redis_cache.address", globalConf.ProviderConf.RedisCache.Address)
+	viper.SetDefault("data_provider.redis_cache.password", globalConf.ProviderConf.RedisCache.Password)
+	viper.SetDefault("data_provider.redis_cache.db", globalConf.ProviderConf.RedisCache.DB)
+	viper.SetDefault("data_provider.redis_cache.ttl", globalConf.ProviderConf.RedisCache.TTL)
+	viper.SetDefault("data_provider.redis_cache.key_prefix", globalConf.ProviderConf.RedisCache.KeyPrefix)
+	viper.SetDefault("data_provider.deleted_users_retention", globalConf.ProviderConf.DeletedUsersRetention)
 	viper.SetDefault("httpd.bind_port", globalConf.HTTPDConfig.BindPort)
 	viper.SetDefault("httpd.bind_address", globalConf.HTTPDConfig.BindAddress)
 	viper.SetDefault("httpd.templates_path", globalConf.HTTPDConfig.TemplatesPath)
@@ -453,7 +634,42 @@ func setViperDefaults() {
 	viper.SetDefault("httpd.auth_user_file", globalConf.HTTPDConfig.AuthUserFile)
 	viper.SetDefault("httpd.certificate_file", globalConf.HTTPDConfig.CertificateFile)
 	viper.SetDefault("httpd.certificate_key_file", globalConf.HTTPDConfig.CertificateKeyFile)
+	viper.SetDefault("httpd.structured_errors", globalConf.HTTPDConfig.StructuredErrors)
+	viper.SetDefault("httpd.scheduled_backups.interval", globalConf.HTTPDConfig.ScheduledBackups.Interval)
+	viper.SetDefault("httpd.scheduled_backups.output_dir", globalConf.HTTPDConfig.ScheduledBackups.OutputDir)
+	viper.SetDefault("httpd.scheduled_backups.keep_last", globalConf.HTTPDConfig.ScheduledBackups.KeepLast)
+	viper.SetDefault("httpd.scheduled_backups.keep_days", globalConf.HTTPDConfig.ScheduledBackups.KeepDays)
+	viper.SetDefault("httpd.scheduled_backups.passphrase", globalConf.HTTPDConfig.ScheduledBackups.Passphrase)
+	viper.SetDefault("httpd.audit_log.enabled", globalConf.HTTPDConfig.AuditLog.Enabled)
+	viper.SetDefault("httpd.audit_log.log_file", globalConf.HTTPDConfig.AuditLog.LogFile)
+	viper.SetDefault("httpd.audit_log.hook", globalConf.HTTPDConfig.AuditLog.Hook)
 	viper.SetDefault("http.timeout", globalConf.HTTPConfig.Timeout)
 	viper.SetDefault("http.ca_certificates", globalConf.HTTPConfig.CACertificates)
 	viper.SetDefault("http.skip_tls_verify", globalConf.HTTPConfig.SkipTLSVerify)
+	viper.SetDefault("http.retry_queue.max_attempts", globalConf.HTTPConfig.RetryQueue.MaxAttempts)
+	viper.SetDefault("http.retry_queue.base_delay", globalConf.HTTPConfig.RetryQueue.BaseDelay)
+	viper.SetDefault("http.retry_queue.max_delay", globalConf.HTTPConfig.RetryQueue.MaxDelay)
+	viper.SetDefault("http.retry_queue.path", globalConf.HTTPConfig.RetryQueue.Path)
+	viper.SetDefault("kms.provider", globalConf.KMSConfig.Provider)
+	viper.SetDefault("kms.vault.url", globalConf.KMSConfig.Vault.URL)
+	viper.SetDefault("kms.vault.token", globalConf.KMSConfig.Vault.Token)
+	viper.SetDefault("kms.vault.namespace", globalConf.KMSConfig.Vault.Namespace)
+	viper.SetDefault("kms.vault.mode", globalConf.KMSConfig.Vault.Mode)
+	viper.SetDefault("kms.vault.transit_path", globalConf.KMSConfig.Vault.TransitPath)
+	viper.SetDefault("kms.vault.transit_key", globalConf.KMSConfig.Vault.TransitKey)
+	viper.SetDefault("kms.vault.kv_path", globalConf.KMSConfig.Vault.KVPath)
+	viper.SetDefault("kms.vault.kv_prefix", globalConf.KMSConfig.Vault.KVPrefix)
+	viper.SetDefault("kms.vault.kv_version", globalConf.KMSConfig.Vault.KVVersion)
+	viper.SetDefault("kms.azure_key_vault.vault_url", globalConf.KMSConfig.AzureKeyVault.VaultURL)
+	viper.SetDefault("kms.azure_key_vault.tenant_id", globalConf.KMSConfig.AzureKeyVault.TenantID)
+	viper.SetDefault("kms.azure_key_vault.client_id", globalConf.KMSConfig.AzureKeyVault.ClientID)
+	viper.SetDefault("kms.azure_key_vault.client_secret", globalConf.KMSConfig.AzureKeyVault.ClientSecret)
+	viper.SetDefault("kms.azure_key_vault.secret_prefix", globalConf.KMSConfig.AzureKeyVault.SecretPrefix)
+	viper.SetDefault("kms.azure_key_vault.cache_ttl", globalConf.KMSConfig.AzureKeyVault.CacheTTL)
+	viper.SetDefault("kms.aws_secrets_manager.enabled", globalConf.KMSConfig.AWSSecretsManager.Enabled)
+	viper.SetDefault("kms.aws_secrets_manager.region", globalConf.KMSConfig.AWSSecretsManager.Region)
+	viper.SetDefault("kms.aws_secrets_manager.endpoint", globalConf.KMSConfig.AWSSecretsManager.Endpoint)
+	viper.SetDefault("kms.aws_secrets_manager.access_key", globalConf.KMSConfig.AWSSecretsManager.AccessKey)
+	viper.SetDefault("kms.aws_secrets_manager.access_secret", globalConf.KMSConfig.AWSSecretsManager.AccessSecret)
+	viper.SetDefault("kms.aws_secrets_manager.cache_ttl", globalConf.KMSConfig.AWSSecretsManager.CacheTTL)
 }
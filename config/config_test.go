@@ -16,6 +16,7 @@ import (
 	"github.com/drakkan/sftpgo/ftpd"
 	"github.com/drakkan/sftpgo/httpclient"
 	"github.com/drakkan/sftpgo/httpd"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
 )
@@ -279,6 +280,17 @@ func TestSetGetConfig(t *testing.T) {
 	config.SetWebDAVDConfig(webDavConf)
 	assert.Equal(t, webDavConf.CertificateFile, config.GetWebDAVDConfig().CertificateFile)
 	assert.Equal(t, webDavConf.CertificateKeyFile, config.GetWebDAVDConfig().CertificateKeyFile)
+	kmsConf := config.GetKMSConfig()
+	kmsConf.Provider = kms.ProviderVault
+	kmsConf.Vault.URL = "https://vault.example.com:8200"
+	config.SetKMSConfig(kmsConf)
+	assert.Equal(t, kmsConf.Provider, config.GetKMSConfig().Provider)
+	assert.Equal(t, kmsConf.Vault.URL, config.GetKMSConfig().Vault.URL)
+	kmsConf.AWSSecretsManager.Enabled = true
+	kmsConf.AWSSecretsManager.Region = "eu-west-1"
+	config.SetKMSConfig(kmsConf)
+	assert.True(t, config.GetKMSConfig().AWSSecretsManager.Enabled)
+	assert.Equal(t, "eu-west-1", config.GetKMSConfig().AWSSecretsManager.Region)
 }
 
 func TestServiceToStart(t *testing.T) {
@@ -313,11 +325,17 @@ func TestConfigFromEnv(t *testing.T) {
 	os.Setenv("SFTPGO_DATA_PROVIDER__PASSWORD_HASHING__ARGON2_OPTIONS__ITERATIONS", "41")
 	os.Setenv("SFTPGO_DATA_PROVIDER__POOL_SIZE", "10")
 	os.Setenv("SFTPGO_DATA_PROVIDER__ACTIONS__EXECUTE_ON", "add")
+	os.Setenv("SFTPGO_KMS__VAULT__TOKEN", "vault token")
+	os.Setenv("SFTPGO_KMS__AWS_SECRETS_MANAGER__ACCESS_SECRET", "aws secret")
+	os.Setenv("SFTPGO_KMS__AZURE_KEY_VAULT__CLIENT_SECRET", "azure secret")
 	t.Cleanup(func() {
 		os.Unsetenv("SFTPGO_SFTPD__BIND_ADDRESS")
 		os.Unsetenv("SFTPGO_DATA_PROVIDER__PASSWORD_HASHING__ARGON2_OPTIONS__ITERATIONS")
 		os.Unsetenv("SFTPGO_DATA_PROVIDER__POOL_SIZE")
 		os.Unsetenv("SFTPGO_DATA_PROVIDER__ACTIONS__EXECUTE_ON")
+		os.Unsetenv("SFTPGO_KMS__VAULT__TOKEN")
+		os.Unsetenv("SFTPGO_KMS__AWS_SECRETS_MANAGER__ACCESS_SECRET")
+		os.Unsetenv("SFTPGO_KMS__AZURE_KEY_VAULT__CLIENT_SECRET")
 	})
 	err := config.LoadConfig(".", "invalid config")
 	assert.NoError(t, err)
@@ -328,4 +346,13 @@ func TestConfigFromEnv(t *testing.T) {
 	assert.Equal(t, 10, dataProviderConf.PoolSize)
 	assert.Len(t, dataProviderConf.Actions.ExecuteOn, 1)
 	assert.Contains(t, dataProviderConf.Actions.ExecuteOn, "add")
+	kmsConf := config.GetKMSConfig()
+	assert.Equal(t, kms.ProviderLocal, kmsConf.Provider)
+	assert.Equal(t, "vault token", kmsConf.Vault.Token)
+	assert.Equal(t, 2, kmsConf.Vault.KVVersion)
+	assert.Equal(t, "aws secret", kmsConf.AWSSecretsManager.AccessSecret)
+	assert.Equal(t, 300, kmsConf.AWSSecretsManager.CacheTTL)
+	assert.Equal(t, "azure secret", kmsConf.AzureKeyVault.ClientSecret)
+	assert.Equal(t, "sftpgo", kmsConf.AzureKeyVault.SecretPrefix)
+	assert.Equal(t, 60, kmsConf.AzureKeyVault.CacheTTL)
 }
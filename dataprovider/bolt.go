@@ -23,11 +23,13 @@ const (
 )
 
 var (
-	usersBucket      = []byte("users")
-	usersIDIdxBucket = []byte("users_id_idx")
-	foldersBucket    = []byte("folders")
-	dbVersionBucket  = []byte("db_version")
-	dbVersionKey     = []byte("version")
+	usersBucket        = []byte("users")
+	usersIDIdxBucket   = []byte("users_id_idx")
+	foldersBucket      = []byte("folders")
+	groupsBucket       = []byte("groups")
+	deletedUsersBucket = []byte("deleted_users")
+	dbVersionBucket    = []byte("db_version")
+	dbVersionKey       = []byte("version")
 )
 
 // BoltProvider auth provider for bolt key/value store
@@ -79,6 +81,22 @@ func initializeBoltProvider(basePath string) error {
 			providerLog(logger.LevelWarn, "error creating username idx bucket: %v", err)
 			return err
 		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(groupsBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating groups bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(deletedUsersBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating deleted users bucket: %v", err)
+			return err
+		}
 		err = dbHandle.Update(func(tx *bolt.Tx) error {
 			_, e := tx.CreateBucketIfNotExists(dbVersionBucket)
 			return e
@@ -182,6 +200,102 @@ func (p BoltProvider) updateLastLogin(username string) error {
 	})
 }
 
+func (p BoltProvider) updateLastExpirationWarning(username string, expirationDate int64) (bool, error) {
+	updated := false
+	err := p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update last expiration warning",
+				username)}
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		if user.LastExpirationWarning == expirationDate {
+			return nil
+		}
+		user.LastExpirationWarning = expirationDate
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(username), buf)
+		updated = err == nil
+		return err
+	})
+	return updated, err
+}
+
+func (p BoltProvider) updateLastTOTPStep(username string, step int64) (bool, error) {
+	updated := false
+	err := p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update last TOTP step",
+				username)}
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		if user.LastTOTPStep >= step {
+			return nil
+		}
+		user.LastTOTPStep = step
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(username), buf)
+		updated = err == nil
+		return err
+	})
+	return updated, err
+}
+
+func (p BoltProvider) updateLoginFailures(username string, prev, next loginFailures) (bool, error) {
+	updated := false
+	err := p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update login failures",
+				username)}
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		if user.getLoginFailures() != prev {
+			return nil
+		}
+		user.setLoginFailures(next)
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(username), buf)
+		updated = err == nil
+		return err
+	})
+	return updated, err
+}
+
 func (p BoltProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
 		bucket, _, err := getBuckets(tx)
@@ -216,6 +330,39 @@ func (p BoltProvider) updateQuota(username string, filesAdd int, sizeAdd int64,
 	})
 }
 
+func (p BoltProvider) updateDownloadVolume(username string, sizeAdd int64, periodStart int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update download volume",
+				username)}
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		if user.DownloadVolumePeriodStart == periodStart {
+			user.UsedDownloadVolume += sizeAdd
+		} else {
+			user.UsedDownloadVolume = sizeAdd
+			user.DownloadVolumePeriodStart = periodStart
+		}
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(username), buf)
+		providerLog(logger.LevelDebug, "download volume updated for user %#v, size increment: %v period start: %v",
+			username, sizeAdd, periodStart)
+		return err
+	})
+}
+
 func (p BoltProvider) getUsedQuota(username string) (int, int64, error) {
 	user, err := p.userExists(username)
 	if err != nil {
@@ -263,6 +410,10 @@ func (p BoltProvider) addUser(user User) error {
 		if u := bucket.Get([]byte(user.Username)); u != nil {
 			return fmt.Errorf("username %v already exists", user.Username)
 		}
+		err = checkUserGroups(user, tx)
+		if err != nil {
+			return err
+		}
 		id, err := bucket.NextSequence()
 		if err != nil {
 			return err
@@ -272,6 +423,13 @@ func (p BoltProvider) addUser(user User) error {
 		user.UsedQuotaSize = 0
 		user.UsedQuotaFiles = 0
 		user.LastLogin = 0
+		user.UsedDownloadVolume = 0
+		user.DownloadVolumePeriodStart = 0
+		user.LastExpirationWarning = 0
+		user.LoginFailures = 0
+		user.LastLoginFailure = 0
+		user.LockedUntil = 0
+		user.LastTOTPStep = 0
 		for _, folder := range user.VirtualFolders {
 			err = addUserToFolderMapping(folder, user, folderBucket)
 			if err != nil {
@@ -314,6 +472,10 @@ func (p BoltProvider) updateUser(user User) error {
 		if err != nil {
 			return err
 		}
+		err = checkUserGroups(user, tx)
+		if err != nil {
+			return err
+		}
 		for _, folder := range oldUser.VirtualFolders {
 			err = removeUserFromFolderMapping(folder, oldUser, folderBucket)
 			if err != nil {
@@ -331,6 +493,13 @@ func (p BoltProvider) updateUser(user User) error {
 		user.UsedQuotaSize = oldUser.UsedQuotaSize
 		user.UsedQuotaFiles = oldUser.UsedQuotaFiles
 		user.LastLogin = oldUser.LastLogin
+		user.UsedDownloadVolume = oldUser.UsedDownloadVolume
+		user.DownloadVolumePeriodStart = oldUser.DownloadVolumePeriodStart
+		user.LastExpirationWarning = oldUser.LastExpirationWarning
+		user.LoginFailures = oldUser.LoginFailures
+		user.LastLoginFailure = oldUser.LastLoginFailure
+		user.LockedUntil = oldUser.LockedUntil
+		user.LastTOTPStep = oldUser.LastTOTPStep
 		buf, err := json.Marshal(user)
 		if err != nil {
 			return err
@@ -341,33 +510,37 @@ func (p BoltProvider) updateUser(user User) error {
 
 func (p BoltProvider) deleteUser(user User) error {
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
-		bucket, idxBucket, err := getBuckets(tx)
+		return deleteUserInternal(user, tx)
+	})
+}
+
+func deleteUserInternal(user User, tx *bolt.Tx) error {
+	bucket, idxBucket, err := getBuckets(tx)
+	if err != nil {
+		return err
+	}
+	if len(user.VirtualFolders) > 0 {
+		folderBucket, err := getFolderBucket(tx)
 		if err != nil {
 			return err
 		}
-		if len(user.VirtualFolders) > 0 {
-			folderBucket, err := getFolderBucket(tx)
+		for _, folder := range user.VirtualFolders {
+			err = removeUserFromFolderMapping(folder, user, folderBucket)
 			if err != nil {
 				return err
 			}
-			for _, folder := range user.VirtualFolders {
-				err = removeUserFromFolderMapping(folder, user, folderBucket)
-				if err != nil {
-					return err
-				}
-			}
-		}
-		userIDAsBytes := itob(user.ID)
-		userName := idxBucket.Get(userIDAsBytes)
-		if userName == nil {
-			return &RecordNotFoundError{err: fmt.Sprintf("user with id %v does not exist", user.ID)}
-		}
-		err = bucket.Delete(userName)
-		if err != nil {
-			return err
 		}
-		return idxBucket.Delete(userIDAsBytes)
-	})
+	}
+	userIDAsBytes := itob(user.ID)
+	userName := idxBucket.Get(userIDAsBytes)
+	if userName == nil {
+		return &RecordNotFoundError{err: fmt.Sprintf("user with id %v does not exist", user.ID)}
+	}
+	err = bucket.Delete(userName)
+	if err != nil {
+		return err
+	}
+	return idxBucket.Delete(userIDAsBytes)
 }
 
 func (p BoltProvider) dumpUsers() ([]User, error) {
@@ -398,11 +571,14 @@ func (p BoltProvider) dumpUsers() ([]User, error) {
 	return users, err
 }
 
-func (p BoltProvider) getUserWithUsername(username string) ([]User, error) {
+func (p BoltProvider) getUserWithUsername(username string, metadata MetadataFilter) ([]User, error) {
 	users := []User{}
 	var user User
 	user, err := p.userExists(username)
 	if err == nil {
+		if !metadata.matches(user.Metadata) {
+			return users, nil
+		}
 		user.HideConfidentialData()
 		users = append(users, user)
 		return users, nil
@@ -413,7 +589,7 @@ func (p BoltProvider) getUserWithUsername(username string) ([]User, error) {
 	return users, err
 }
 
-func (p BoltProvider) getUsers(limit int, offset int, order string, username string) ([]User, error) {
+func (p BoltProvider) getUsers(limit int, offset int, order string, username string, metadata MetadataFilter) ([]User, error) {
 	users := make([]User, 0, limit)
 	var err error
 	if limit <= 0 {
@@ -421,7 +597,7 @@ func (p BoltProvider) getUsers(limit int, offset int, order string, username str
 	}
 	if len(username) > 0 {
 		if offset == 0 {
-			return p.getUserWithUsername(username)
+			return p.getUserWithUsername(username, metadata)
 		}
 		return users, err
 	}
@@ -438,30 +614,32 @@ func (p BoltProvider) getUsers(limit int, offset int, order string, username str
 		itNum := 0
 		if order == OrderASC {
 			for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+				user, err := joinUserAndFolders(v, folderBucket)
+				if err != nil || !metadata.matches(user.Metadata) {
+					continue
+				}
 				itNum++
 				if itNum <= offset {
 					continue
 				}
-				user, err := joinUserAndFolders(v, folderBucket)
-				if err == nil {
-					user.HideConfidentialData()
-					users = append(users, user)
-				}
+				user.HideConfidentialData()
+				users = append(users, user)
 				if len(users) >= limit {
 					break
 				}
 			}
 		} else {
 			for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+				user, err := joinUserAndFolders(v, folderBucket)
+				if err != nil || !metadata.matches(user.Metadata) {
+					continue
+				}
 				itNum++
 				if itNum <= offset {
 					continue
 				}
-				user, err := joinUserAndFolders(v, folderBucket)
-				if err == nil {
-					user.HideConfidentialData()
-					users = append(users, user)
-				}
+				user.HideConfidentialData()
+				users = append(users, user)
 				if len(users) >= limit {
 					break
 				}
@@ -635,6 +813,221 @@ func (p BoltProvider) deleteFolder(folder vfs.BaseVirtualFolder) error {
 	})
 }
 
+func (p BoltProvider) groupExists(name string) (Group, error) {
+	var group Group
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		group, err = groupExistsInternal(name, bucket)
+		return err
+	})
+	return group, err
+}
+
+func (p BoltProvider) getGroupByID(ID int64) (Group, error) {
+	var group Group
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var g Group
+			err = json.Unmarshal(v, &g)
+			if err != nil {
+				return err
+			}
+			if g.ID == ID {
+				group = g
+				return nil
+			}
+		}
+		return &RecordNotFoundError{err: fmt.Sprintf("group with ID %v does not exist", ID)}
+	})
+	return group, err
+}
+
+func (p BoltProvider) getGroups(limit, offset int, order, name string) ([]Group, error) {
+	groups := make([]Group, 0, limit)
+	var err error
+	if limit <= 0 {
+		return groups, err
+	}
+	if len(name) > 0 {
+		if offset == 0 {
+			var group Group
+			group, err = p.groupExists(name)
+			if err == nil {
+				group.HideConfidentialData()
+				groups = append(groups, group)
+			}
+		}
+		return groups, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		if order == OrderASC {
+			for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+				itNum++
+				if itNum <= offset {
+					continue
+				}
+				var group Group
+				err = json.Unmarshal(v, &group)
+				if err != nil {
+					return err
+				}
+				group.HideConfidentialData()
+				groups = append(groups, group)
+				if len(groups) >= limit {
+					break
+				}
+			}
+		} else {
+			for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+				itNum++
+				if itNum <= offset {
+					continue
+				}
+				var group Group
+				err = json.Unmarshal(v, &group)
+				if err != nil {
+					return err
+				}
+				group.HideConfidentialData()
+				groups = append(groups, group)
+				if len(groups) >= limit {
+					break
+				}
+			}
+		}
+		return err
+	})
+	return groups, err
+}
+
+func (p BoltProvider) addGroup(group Group) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if g := bucket.Get([]byte(group.Name)); g != nil {
+			return fmt.Errorf("group %v already exists", group.Name)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		group.ID = int64(id)
+		buf, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(group.Name), buf)
+	})
+}
+
+func (p BoltProvider) updateGroup(group Group) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		oldGroup, err := groupExistsInternal(group.Name, bucket)
+		if err != nil {
+			return err
+		}
+		group.ID = oldGroup.ID
+		buf, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(group.Name), buf)
+	})
+}
+
+func (p BoltProvider) deleteGroup(group Group) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		usersBucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if g := bucket.Get([]byte(group.Name)); g == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("group %v does not exist", group.Name)}
+		}
+		// groups have no reverse mapping, we need to scan the users
+		cursor := usersBucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var user User
+			err = json.Unmarshal(v, &user)
+			if err != nil {
+				return err
+			}
+			if !utils.IsStringInSlice(group.Name, user.Groups) {
+				continue
+			}
+			var groups []string
+			for _, name := range user.Groups {
+				if name != group.Name {
+					groups = append(groups, name)
+				}
+			}
+			user.Groups = groups
+			buf, err := json.Marshal(user)
+			if err != nil {
+				return err
+			}
+			err = usersBucket.Put(k, buf)
+			if err != nil {
+				return err
+			}
+		}
+		return bucket.Delete([]byte(group.Name))
+	})
+}
+
+func (p BoltProvider) dumpGroups() ([]Group, error) {
+	groups := make([]Group, 0, 10)
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var group Group
+			err = json.Unmarshal(v, &group)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, group)
+		}
+		return err
+	})
+	return groups, err
+}
+
 func (p BoltProvider) updateFolderQuota(mappedPath string, filesAdd int, sizeAdd int64, reset bool) error {
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
 		bucket, err := getFolderBucket(tx)
@@ -675,6 +1068,195 @@ func (p BoltProvider) getUsedFolderQuota(mappedPath string) (int, int64, error)
 	return folder.UsedQuotaFiles, folder.UsedQuotaSize, err
 }
 
+func (p BoltProvider) softDeleteUser(user User) error {
+	deletedUser := DeletedUser{
+		DeletedAt: utils.GetTimeAsMsSinceEpoch(time.Now()),
+		User:      user,
+	}
+	buf, err := json.Marshal(deletedUser)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDeletedUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		// a previously deleted user with the same username is replaced
+		err = bucket.Put([]byte(user.Username), buf)
+		if err != nil {
+			return err
+		}
+		return deleteUserInternal(user, tx)
+	})
+}
+
+func (p BoltProvider) getDeletedUsers(limit, offset int, order, username string) ([]DeletedUser, error) {
+	deletedUsers := make([]DeletedUser, 0, limit)
+	var err error
+	if limit <= 0 {
+		return deletedUsers, err
+	}
+	if len(username) > 0 {
+		if offset == 0 {
+			deletedUser, err := p.deletedUserExists(username)
+			if err == nil {
+				deletedUser.HideConfidentialData()
+				deletedUsers = append(deletedUsers, deletedUser)
+			}
+		}
+		return deletedUsers, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getDeletedUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		next := cursor.Next
+		k, v := cursor.First()
+		if order == OrderDESC {
+			next = cursor.Prev
+			k, v = cursor.Last()
+		}
+		for ; k != nil; k, v = next() {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			var deletedUser DeletedUser
+			err = json.Unmarshal(v, &deletedUser)
+			if err != nil {
+				return err
+			}
+			deletedUser.HideConfidentialData()
+			deletedUsers = append(deletedUsers, deletedUser)
+			if len(deletedUsers) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return deletedUsers, err
+}
+
+func (p BoltProvider) deletedUserExists(username string) (DeletedUser, error) {
+	var deletedUser DeletedUser
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getDeletedUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		u := bucket.Get([]byte(username))
+		if u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("deleted user %v does not exist", username)}
+		}
+		return json.Unmarshal(u, &deletedUser)
+	})
+	return deletedUser, err
+}
+
+func (p BoltProvider) purgeDeletedUser(username string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDeletedUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(username))
+	})
+}
+
+func (p BoltProvider) purgeDeletedUsers(before int64) (int, error) {
+	purged := 0
+	err := p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDeletedUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		var usernames [][]byte
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var deletedUser DeletedUser
+			err = json.Unmarshal(v, &deletedUser)
+			if err != nil {
+				return err
+			}
+			if deletedUser.DeletedAt < before {
+				// the key is only valid for the life of the transaction
+				usernames = append(usernames, append([]byte(nil), k...))
+			}
+		}
+		for _, username := range usernames {
+			err = bucket.Delete(username)
+			if err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// rotateSecrets rotates the secrets for users, soft deleted users and groups
+// inside a single read-write transaction
+func (p BoltProvider) rotateSecrets(rotator *secretsRotator) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		err = boltRotateSecrets(bucket, func(v []byte) ([]byte, error) {
+			var user User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return nil, err
+			}
+			updated, err := rotator.rotateUser(&user)
+			if err != nil || !updated {
+				return nil, err
+			}
+			return json.Marshal(user)
+		})
+		if err != nil {
+			return err
+		}
+		bucket, err = getDeletedUsersBucket(tx)
+		if err != nil {
+			return err
+		}
+		err = boltRotateSecrets(bucket, func(v []byte) ([]byte, error) {
+			var deletedUser DeletedUser
+			if err := json.Unmarshal(v, &deletedUser); err != nil {
+				return nil, err
+			}
+			updated, err := rotator.rotateDeletedUser(&deletedUser.User)
+			if err != nil || !updated {
+				return nil, err
+			}
+			return json.Marshal(deletedUser)
+		})
+		if err != nil {
+			return err
+		}
+		bucket, err = getGroupsBucket(tx)
+		if err != nil {
+			return err
+		}
+		return boltRotateSecrets(bucket, func(v []byte) ([]byte, error) {
+			var group Group
+			if err := json.Unmarshal(v, &group); err != nil {
+				return nil, err
+			}
+			updated, err := rotator.rotateGroup(&group)
+			if err != nil || !updated {
+				return nil, err
+			}
+			return json.Marshal(group)
+		})
+	})
+}
+
 func (p BoltProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -760,6 +1342,7 @@ func joinUserAndFolders(u []byte, foldersBucket *bolt.Bucket) (User, error) {
 			folder.UsedQuotaSize = baseFolder.UsedQuotaSize
 			folder.LastQuotaUpdate = baseFolder.LastQuotaUpdate
 			folder.ID = baseFolder.ID
+			folder.Metadata = baseFolder.Metadata
 			folders = append(folders, folder)
 		}
 		user.VirtualFolders = folders
@@ -877,6 +1460,75 @@ func getBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
 	return bucket, idxBucket, err
 }
 
+// boltRotateSecrets calls rotate for each value in the given bucket and stores the
+// returned values, a nil value means that there is nothing to update
+func boltRotateSecrets(bucket *bolt.Bucket, rotate func(v []byte) ([]byte, error)) error {
+	var keys, values [][]byte
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		buf, err := rotate(v)
+		if err != nil {
+			return err
+		}
+		if buf != nil {
+			// the key is only valid for the life of the transaction
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, buf)
+		}
+	}
+	for idx, key := range keys {
+		if err := bucket.Put(key, values[idx]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getDeletedUsersBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(deletedUsersBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find required buckets, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getGroupsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(groupsBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find required buckets, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func groupExistsInternal(name string, bucket *bolt.Bucket) (Group, error) {
+	var group Group
+	g := bucket.Get([]byte(name))
+	if g == nil {
+		err := &RecordNotFoundError{err: fmt.Sprintf("group %v does not exist", name)}
+		return group, err
+	}
+	err := json.Unmarshal(g, &group)
+	return group, err
+}
+
+func checkUserGroups(user User, tx *bolt.Tx) error {
+	if len(user.Groups) == 0 {
+		return nil
+	}
+	bucket, err := getGroupsBucket(tx)
+	if err != nil {
+		return err
+	}
+	for _, name := range user.Groups {
+		if g := bucket.Get([]byte(name)); g == nil {
+			return &ValidationError{field: "groups", err: fmt.Sprintf("group %#v does not exist", name)}
+		}
+	}
+	return nil
+}
+
 func getFolderBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	var err error
 	bucket := tx.Bucket(foldersBucket)
@@ -24,7 +24,9 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -59,6 +61,8 @@ const (
 	BoltDataProviderName = "bolt"
 	// MemoryDataProviderName name for memory provider
 	MemoryDataProviderName = "memory"
+	// MongoDBDataProviderName name for MongoDB provider
+	MongoDBDataProviderName = "mongodb"
 	// DumpVersion defines the version for the dump.
 	// For restore/load we support the current version and the previous one
 	DumpVersion = 5
@@ -77,9 +81,21 @@ const (
 	operationAdd              = "add"
 	operationUpdate           = "update"
 	operationDelete           = "delete"
+	operationExpirationWarn   = "expiration_warning"
+	operationQuotaWarn        = "quota_warning"
 	sqlPrefixValidChars       = "abcdefghijklmnopqrstuvwxyz_"
 )
 
+// supported authentication backends
+const (
+	// AuthBackendProvider authenticates the users stored inside the data provider
+	AuthBackendProvider = "provider"
+	// AuthBackendExternalHook authenticates the users using the external auth hook
+	AuthBackendExternalHook = "external_hook"
+	// AuthBackendLDAP authenticates the users binding to an LDAP server, password only
+	AuthBackendLDAP = "ldap"
+)
+
 // ordering constants
 const (
 	OrderASC  = "ASC"
@@ -89,10 +105,10 @@ const (
 var (
 	// SupportedProviders defines the supported data providers
 	SupportedProviders = []string{SQLiteDataProviderName, PGSQLDataProviderName, MySQLDataProviderName,
-		BoltDataProviderName, MemoryDataProviderName}
+		BoltDataProviderName, MemoryDataProviderName, MongoDBDataProviderName}
 	// ValidPerms defines all the valid permissions for a user
 	ValidPerms = []string{PermAny, PermListItems, PermDownload, PermUpload, PermOverwrite, PermRename, PermDelete,
-		PermCreateDirs, PermCreateSymlinks, PermChmod, PermChown, PermChtimes}
+		PermCreateDirs, PermCreateSymlinks, PermChmod, PermChown, PermChtimes, PermUploadOnly}
 	// ValidSSHLoginMethods defines all the valid SSH login methods
 	ValidSSHLoginMethods = []string{SSHLoginMethodPublicKey, LoginMethodPassword, SSHLoginMethodKeyboardInteractive,
 		SSHLoginMethodKeyAndPassword, SSHLoginMethodKeyAndKeyboardInt}
@@ -118,10 +134,20 @@ var (
 	logSender               = "dataProvider"
 	availabilityTicker      *time.Ticker
 	availabilityTickerDone  chan bool
+	expirationTicker        *time.Ticker
+	expirationTickerDone    chan bool
+	deletedUsersTicker      *time.Ticker
+	deletedUsersTickerDone  chan bool
+	quotaWarningMutex       sync.Mutex
+	pathSchemaVariableRegex = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+	compiledRegexps         sync.Map
 	credentialsDirPath      string
 	sqlTableUsers           = "users"
 	sqlTableFolders         = "folders"
 	sqlTableFoldersMapping  = "folders_mapping"
+	sqlTableGroups          = "user_groups"
+	sqlTableGroupsMapping   = "user_groups_mapping"
+	sqlTableDeletedUsers    = "deleted_users"
 	sqlTableSchemaVersion   = "schema_version"
 	argon2Params            *argon2id.Params
 )
@@ -144,7 +170,7 @@ type PasswordHashing struct {
 
 // UserActions defines the action to execute on user create, update, delete.
 type UserActions struct {
-	// Valid values are add, update, delete. Empty slice to disable
+	// Valid values are add, update, delete, expiration_warning, quota_warning. Empty slice to disable
 	ExecuteOn []string `json:"execute_on" mapstructure:"execute_on"`
 	// Absolute path to an external program or an HTTP URL
 	Hook string `json:"hook" mapstructure:"hook"`
@@ -174,6 +200,12 @@ type Config struct {
 	// Custom database connection string.
 	// If not empty this connection string will be used instead of build one using the previous parameters
 	ConnectionString string `json:"connection_string" mapstructure:"connection_string"`
+	// Optional connection string for a read replica, used for drivers mysql and postgresql.
+	// If set, read only queries such as users, folders and groups listings, dumps and the user
+	// lookups done while authenticating are routed to the replica. Writes, including quota and
+	// last login updates, and the lookups done before updating an object always use the primary
+	// database. If empty all the queries use the primary database
+	ReadConnectionString string `json:"read_connection_string" mapstructure:"read_connection_string"`
 	// prefix for SQL tables
 	SQLTablesPrefix string `json:"sql_tables_prefix" mapstructure:"sql_tables_prefix"`
 	// Set to 0 to disable users management, 1 to enable
@@ -213,6 +245,14 @@ type Config struct {
 	// you can combine the scopes, for example 3 means password and public key, 5 password and keyboard
 	// interactive and so on
 	ExternalAuthScope int `json:"external_auth_scope" mapstructure:"external_auth_scope"`
+	// AuthBackends defines the ordered list of authentication backends to consult.
+	// Supported values are "provider", the users stored inside the data provider,
+	// "external_hook", the external authentication hook, and "ldap", the LDAP server
+	// defined in the LDAP configuration. A backend declines if it does not
+	// know the user and the next backend is consulted, it rejects if the user is known but
+	// the credentials are invalid and the authentication stops.
+	// Leave empty to use the external auth hook, if defined, and the data provider otherwise
+	AuthBackends []string `json:"auth_backends" mapstructure:"auth_backends"`
 	// CredentialsPath defines the directory for storing user provided credential files such as
 	// Google Cloud Storage credentials. It can be a path relative to the config dir or an
 	// absolute path
@@ -262,15 +302,94 @@ type Config struct {
 	// Cloud Storage) should be stored in the database instead of in the directory specified by
 	// CredentialsPath.
 	PreferDatabaseCredentials bool `json:"prefer_database_credentials" mapstructure:"prefer_database_credentials"`
+	// UsersDefaultExpiration defines the number of days, starting from the creation time,
+	// after which the users added using the REST API without an explicit expiration
+	// date will expire. 0 means no default expiration
+	UsersDefaultExpiration int `json:"users_default_expiration" mapstructure:"users_default_expiration"`
+	// ExpirationWarningDays defines how many days before the expiration date the
+	// "expiration_warning" action is fired for a user. 0 disables the warning
+	ExpirationWarningDays int `json:"expiration_warning_days" mapstructure:"expiration_warning_days"`
+	// QuotaWarningThresholds defines the quota usage percentages, for example 80 and 95,
+	// that fire the "quota_warning" action when a quota update crosses them.
+	// Users can override these thresholds using their filters
+	QuotaWarningThresholds []int `json:"quota_warning_thresholds" mapstructure:"quota_warning_thresholds"`
+	// MetadataKeys defines the allowed keys for the users and folders custom metadata.
+	// Empty means any key is allowed
+	MetadataKeys []string `json:"metadata_keys" mapstructure:"metadata_keys"`
+	// LoginRetry defines the retry policy for the transient errors during the user
+	// lookups done at login time
+	LoginRetry LoginRetry `json:"login_retry" mapstructure:"login_retry"`
+	// LoginLockout defines the policy to lock a user after too many consecutive
+	// failed logins, regardless of the source IP address
+	LoginLockout LoginLockout `json:"login_lockout" mapstructure:"login_lockout"`
+	// TOTPSkew defines the number of TOTP periods, before and after the current one,
+	// for which the codes are accepted to allow for clock skew. 0 means only the
+	// codes for the current period are accepted
+	TOTPSkew int `json:"totp_skew" mapstructure:"totp_skew"`
+	// LDAP defines the configuration for the "ldap" authentication backend
+	LDAP LDAPConfig `json:"ldap" mapstructure:"ldap"`
+	// RedisCache defines an optional Redis cache for the user lookups done at login time
+	RedisCache RedisCacheConfig `json:"redis_cache" mapstructure:"redis_cache"`
+	// DeletedUsersRetention defines the number of hours the deleted users are kept,
+	// they can be restored within this period and are then permanently removed.
+	// 0 means the users are permanently removed as soon as they are deleted
+	DeletedUsersRetention int `json:"deleted_users_retention" mapstructure:"deleted_users_retention"`
 }
 
 // BackupData defines the structure for the backup/restore files
 type BackupData struct {
 	Users   []User                  `json:"users"`
 	Folders []vfs.BaseVirtualFolder `json:"folders"`
+	Groups  []Group                 `json:"groups"`
 	Version int                     `json:"version"`
 }
 
+// MetadataFilter defines a filter based on the custom metadata
+type MetadataFilter struct {
+	// Metadata key to match, empty means no filter
+	Key string
+	// Metadata value to match, if empty any object having the specified key matches
+	Value string
+}
+
+// IsEmpty returns true if no filter is defined
+func (f *MetadataFilter) IsEmpty() bool {
+	return f.Key == ""
+}
+
+func (f *MetadataFilter) matches(metadata map[string]string) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	val, ok := metadata[f.Key]
+	if !ok {
+		return false
+	}
+	return f.Value == "" || f.Value == val
+}
+
+// getSQLPattern returns a pattern, using "!" as escape character, to match the metadata
+// stored as JSON. Strings are always encoded the same way so the pattern cannot match
+// escaped contents, anyway the results must be checked using matches since the LIKE
+// operator is case insensitive for some databases
+func (f *MetadataFilter) getSQLPattern() string {
+	key, _ := json.Marshal(f.Key)
+	pattern := string(key) + ":"
+	if f.Value != "" {
+		value, _ := json.Marshal(f.Value)
+		pattern += string(value)
+	}
+	replacer := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return "%" + replacer.Replace(pattern) + "%"
+}
+
+// externalAuthResponse defines the fields, other than the user ones, allowed in the external auth hook response
+type externalAuthResponse struct {
+	// Decline is checked if the returned username is empty. If true the hook does not know the user
+	// and the next authentication backend is consulted, otherwise the login is rejected
+	Decline bool `json:"decline"`
+}
+
 type keyboardAuthHookRequest struct {
 	RequestID string   `json:"request_id"`
 	Username  string   `json:"username,omitempty"`
@@ -280,12 +399,43 @@ type keyboardAuthHookRequest struct {
 	Questions []string `json:"questions,omitempty"`
 }
 
-type keyboardAuthHookResponse struct {
+type keyboardAuthHookRound struct {
 	Instruction string   `json:"instruction"`
 	Questions   []string `json:"questions"`
 	Echos       []bool   `json:"echos"`
-	AuthResult  int      `json:"auth_result"`
-	CheckPwd    int      `json:"check_password"`
+}
+
+type keyboardAuthHookResponse struct {
+	Instruction string                  `json:"instruction"`
+	Questions   []string                `json:"questions"`
+	Echos       []bool                  `json:"echos"`
+	Rounds      []keyboardAuthHookRound `json:"rounds"`
+	AuthResult  int                     `json:"auth_result"`
+	CheckPwd    int                     `json:"check_password"`
+}
+
+// getRounds returns the question rounds to ask to the client, a response
+// without rounds defines a single round using the top level fields
+func (r *keyboardAuthHookResponse) getRounds() []keyboardAuthHookRound {
+	if len(r.Rounds) > 0 {
+		return r.Rounds
+	}
+	return []keyboardAuthHookRound{
+		{
+			Instruction: r.Instruction,
+			Questions:   r.Questions,
+			Echos:       r.Echos,
+		},
+	}
+}
+
+// getQuestions returns the questions for all the rounds
+func (r *keyboardAuthHookResponse) getQuestions() []string {
+	var questions []string
+	for _, round := range r.getRounds() {
+		questions = append(questions, round.Questions...)
+	}
+	return questions
 }
 
 type checkPasswordRequest struct {
@@ -317,7 +467,8 @@ type userCompactVFolders struct {
 
 // ValidationError raised if input data is not valid
 type ValidationError struct {
-	err string
+	err   string
+	field string
 }
 
 // Validation error details
@@ -325,6 +476,17 @@ func (e *ValidationError) Error() string {
 	return fmt.Sprintf("Validation error: %s", e.err)
 }
 
+// GetField returns the name of the invalid field, using the JSON notation,
+// for example "filters.denied_ip". It is empty if the error is not related to a specific field
+func (e *ValidationError) GetField() string {
+	return e.field
+}
+
+// GetMessage returns the validation error without the prefix
+func (e *ValidationError) GetMessage() string {
+	return e.err
+}
+
 // MethodDisabledError raised if a method is disabled in config file.
 // For example, if user management is disabled, this error is raised
 // every time a user operation is done using the REST API
@@ -357,15 +519,32 @@ type Provider interface {
 	validateUserAndPubKey(username string, pubKey []byte) (User, string, error)
 	updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error
 	getUsedQuota(username string) (int, int64, error)
+	updateDownloadVolume(username string, sizeAdd int64, periodStart int64) error
 	userExists(username string) (User, error)
 	addUser(user User) error
 	updateUser(user User) error
 	deleteUser(user User) error
-	getUsers(limit int, offset int, order string, username string) ([]User, error)
+	getUsers(limit int, offset int, order string, username string, metadata MetadataFilter) ([]User, error)
 	dumpUsers() ([]User, error)
 	getUserByID(ID int64) (User, error)
 	updateLastLogin(username string) error
+	updateLastExpirationWarning(username string, expirationDate int64) (bool, error)
+	updateLoginFailures(username string, prev, next loginFailures) (bool, error)
+	updateLastTOTPStep(username string, step int64) (bool, error)
 	getFolders(limit, offset int, order, folderPath string) ([]vfs.BaseVirtualFolder, error)
+	groupExists(name string) (Group, error)
+	getGroupByID(ID int64) (Group, error)
+	getGroups(limit, offset int, order, name string) ([]Group, error)
+	addGroup(group Group) error
+	updateGroup(group Group) error
+	deleteGroup(group Group) error
+	dumpGroups() ([]Group, error)
+	softDeleteUser(user User) error
+	getDeletedUsers(limit, offset int, order, username string) ([]DeletedUser, error)
+	deletedUserExists(username string) (DeletedUser, error)
+	purgeDeletedUser(username string) error
+	purgeDeletedUsers(before int64) (int, error)
+	rotateSecrets(rotator *secretsRotator) error
 	getFolderByPath(mappedPath string) (vfs.BaseVirtualFolder, error)
 	addFolder(folder vfs.BaseVirtualFolder) error
 	deleteFolder(folder vfs.BaseVirtualFolder) error
@@ -384,17 +563,38 @@ type Provider interface {
 func Initialize(cnf Config, basePath string) error {
 	var err error
 	config = cnf
+	config.LoginRetry.validate()
 
 	if err = validateHooks(); err != nil {
 		return err
 	}
+	if err = validateAuthBackends(); err != nil {
+		return err
+	}
+	if err = config.LoginLockout.validate(); err != nil {
+		return err
+	}
+	if config.TOTPSkew < 0 || config.TOTPSkew > maxTOTPSkew {
+		return fmt.Errorf("invalid TOTP skew %v, it must be between 0 and %v", config.TOTPSkew, maxTOTPSkew)
+	}
+	if config.QuotaWarningThresholds, err = normalizeQuotaWarningThresholds(config.QuotaWarningThresholds); err != nil {
+		return err
+	}
 	if err = validateCredentialsDir(basePath, cnf.PreferDatabaseCredentials); err != nil {
 		return err
 	}
+	if err = config.RedisCache.validate(); err != nil {
+		return err
+	}
 	err = createProvider(basePath)
 	if err != nil {
 		return err
 	}
+	if config.RedisCache.IsEnabled() {
+		providerLog(logger.LevelInfo, "redis cache enabled for the user lookups at login, address: %#v, ttl: %v",
+			config.RedisCache.Address, config.RedisCache.TTL)
+		provider = newCachedProvider(provider, config.RedisCache)
+	}
 	if cnf.UpdateMode == 0 {
 		err = provider.initializeDatabase()
 		if err != nil && err != ErrNoInitRequired {
@@ -421,6 +621,8 @@ func Initialize(cnf Config, basePath string) error {
 		KeyLength:   32,
 	}
 	startAvailabilityTimer()
+	startExpirationWarningTimer()
+	startDeletedUsersPurgeTimer()
 	return nil
 }
 
@@ -463,9 +665,13 @@ func validateSQLTablesPrefix() error {
 		sqlTableUsers = config.SQLTablesPrefix + sqlTableUsers
 		sqlTableFolders = config.SQLTablesPrefix + sqlTableFolders
 		sqlTableFoldersMapping = config.SQLTablesPrefix + sqlTableFoldersMapping
+		sqlTableGroups = config.SQLTablesPrefix + sqlTableGroups
+		sqlTableGroupsMapping = config.SQLTablesPrefix + sqlTableGroupsMapping
+		sqlTableDeletedUsers = config.SQLTablesPrefix + sqlTableDeletedUsers
 		sqlTableSchemaVersion = config.SQLTablesPrefix + sqlTableSchemaVersion
-		providerLog(logger.LevelDebug, "sql table for users %#v, folders %#v folders mapping %#v schema version %#v",
-			sqlTableUsers, sqlTableFolders, sqlTableFoldersMapping, sqlTableSchemaVersion)
+		providerLog(logger.LevelDebug, "sql table for users %#v, folders %#v folders mapping %#v groups %#v groups mapping %#v "+
+			"deleted users %#v schema version %#v", sqlTableUsers, sqlTableFolders, sqlTableFoldersMapping, sqlTableGroups,
+			sqlTableGroupsMapping, sqlTableDeletedUsers, sqlTableSchemaVersion)
 	}
 	return nil
 }
@@ -487,58 +693,282 @@ func InitializeDatabase(cnf Config, basePath string) error {
 
 // CheckUserAndPass retrieves the SFTP user with the given username and password if a match is found or an error
 func CheckUserAndPass(username, password, ip, protocol string) (User, error) {
-	if len(config.ExternalAuthHook) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&1 != 0) {
-		user, err := doExternalAuth(username, password, nil, "", ip, protocol)
-		if err != nil {
-			return user, err
+	user, _, err := authenticate(username, LoginMethodPassword, protocol, 1, func(backend string) (User, string, bool, error) {
+		if backend == AuthBackendLDAP {
+			user, err := doLDAPAuth(username, password, protocol)
+			if err != nil {
+				return user, "", isRecordNotFoundError(err), err
+			}
+			return user, "", false, checkLoginConditions(user)
 		}
-		return checkUserAndPass(user, password, ip, protocol)
-	}
-	if len(config.PreLoginHook) > 0 {
-		user, err := executePreLoginHook(username, LoginMethodPassword, ip, protocol)
-		if err != nil {
-			return user, err
+		if backend == AuthBackendExternalHook {
+			user, err := doExternalAuth(username, password, nil, "", ip, protocol)
+			if err != nil {
+				return user, "", isRecordNotFoundError(err), err
+			}
+			user, err = checkUserAndPass(user, password, ip, protocol)
+			return user, "", false, err
 		}
-		return checkUserAndPass(user, password, ip, protocol)
-	}
-	return provider.validateUserAndPass(username, password, ip, protocol)
+		if len(config.PreLoginHook) > 0 {
+			user, err := executePreLoginHook(username, LoginMethodPassword, ip, protocol)
+			if err == nil {
+				err = checkProviderUser(user, LoginMethodPassword, 1)
+			}
+			if err != nil {
+				return user, "", isRecordNotFoundError(err), err
+			}
+			user, err = checkUserAndPass(user, password, ip, protocol)
+			return user, "", false, err
+		}
+		var user User
+		err := executeLoginLookup(username, func() error {
+			var err error
+			user, err = provider.validateUserAndPass(username, password, ip, protocol)
+			return err
+		})
+		// the user is returned even if the credentials are invalid
+		if errBackend := checkProviderUser(user, LoginMethodPassword, 1); errBackend != nil {
+			return user, "", true, errBackend
+		}
+		return user, "", isRecordNotFoundError(err), err
+	})
+	return user, err
 }
 
 // CheckUserAndPubKey retrieves the SFTP user with the given username and public key if a match is found or an error
 func CheckUserAndPubKey(username string, pubKey []byte, ip, protocol string) (User, string, error) {
-	if len(config.ExternalAuthHook) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&2 != 0) {
-		user, err := doExternalAuth(username, "", pubKey, "", ip, protocol)
-		if err != nil {
-			return user, "", err
+	return authenticate(username, SSHLoginMethodPublicKey, protocol, 2, func(backend string) (User, string, bool, error) {
+		if backend == AuthBackendExternalHook {
+			user, err := doExternalAuth(username, "", pubKey, "", ip, protocol)
+			if err != nil {
+				return user, "", isRecordNotFoundError(err), err
+			}
+			user, keyID, err := checkUserAndPubKey(user, pubKey)
+			return user, keyID, false, err
 		}
-		return checkUserAndPubKey(user, pubKey)
-	}
-	if len(config.PreLoginHook) > 0 {
-		user, err := executePreLoginHook(username, SSHLoginMethodPublicKey, ip, protocol)
-		if err != nil {
-			return user, "", err
+		if len(config.PreLoginHook) > 0 {
+			user, err := executePreLoginHook(username, SSHLoginMethodPublicKey, ip, protocol)
+			if err == nil {
+				err = checkProviderUser(user, SSHLoginMethodPublicKey, 2)
+			}
+			if err != nil {
+				return user, "", isRecordNotFoundError(err), err
+			}
+			user, keyID, err := checkUserAndPubKey(user, pubKey)
+			return user, keyID, false, err
+		}
+		var user User
+		var keyID string
+		err := executeLoginLookup(username, func() error {
+			var err error
+			user, keyID, err = provider.validateUserAndPubKey(username, pubKey)
+			return err
+		})
+		// the user is returned even if the credentials are invalid
+		if errBackend := checkProviderUser(user, SSHLoginMethodPublicKey, 2); errBackend != nil {
+			return user, "", true, errBackend
 		}
-		return checkUserAndPubKey(user, pubKey)
+		return user, keyID, isRecordNotFoundError(err), err
+	})
+}
+
+// CheckUserAndTrustedCert returns the user with the given username if it is allowed to login.
+// The certificate must be already verified by the caller: it must be a valid user certificate,
+// signed by a trusted CA, listing the username as principal. The certificate does not need to
+// be added to the user public keys
+func CheckUserAndTrustedCert(username string, cert *ssh.Certificate, ip, protocol string) (User, string, error) {
+	// a certificate without principals must never be accepted as valid for any user
+	if !utils.IsStringInSlice(username, cert.ValidPrincipals) {
+		return User{}, "", fmt.Errorf("username %#v not in the certificate principals", username)
 	}
-	return provider.validateUserAndPubKey(username, pubKey)
+	return authenticate(username, SSHLoginMethodPublicKey, protocol, 2, func(backend string) (User, string, bool, error) {
+		var user User
+		var err error
+		if backend == AuthBackendExternalHook {
+			user, err = doExternalAuth(username, "", cert.Marshal(), "", ip, protocol)
+			if err != nil {
+				return user, "", isRecordNotFoundError(err), err
+			}
+		} else {
+			if len(config.PreLoginHook) > 0 {
+				user, err = executePreLoginHook(username, SSHLoginMethodPublicKey, ip, protocol)
+			} else {
+				err = executeLoginLookup(username, func() error {
+					var err error
+					user, err = provider.userExists(username)
+					return err
+				})
+			}
+			if err == nil {
+				err = checkProviderUser(user, SSHLoginMethodPublicKey, 2)
+			}
+			if err != nil {
+				return user, "", isRecordNotFoundError(err), err
+			}
+		}
+		if err = checkLoginConditions(user); err != nil {
+			return user, "", false, err
+		}
+		keyID := fmt.Sprintf("%v: %v ID: %v Serial: %v CA: %v", ssh.FingerprintSHA256(cert.Key), cert.Type(),
+			cert.KeyId, cert.Serial, ssh.FingerprintSHA256(cert.SignatureKey))
+		return user, keyID, false, nil
+	})
 }
 
 // CheckKeyboardInteractiveAuth checks the keyboard interactive authentication and returns
 // the authenticated user or an error
 func CheckKeyboardInteractiveAuth(username, authHook string, client ssh.KeyboardInteractiveChallenge, ip, protocol string) (User, error) {
+	user, _, err := authenticate(username, SSHLoginMethodKeyboardInteractive, protocol, 4, func(backend string) (User, string, bool, error) {
+		var user User
+		var err error
+		if backend == AuthBackendExternalHook {
+			user, err = doExternalAuth(username, "", nil, "1", ip, protocol)
+			if err != nil {
+				return user, "", isRecordNotFoundError(err), err
+			}
+		} else {
+			if len(config.PreLoginHook) > 0 {
+				user, err = executePreLoginHook(username, SSHLoginMethodKeyboardInteractive, ip, protocol)
+			} else {
+				err = executeLoginLookup(username, func() error {
+					var err error
+					user, err = provider.userExists(username)
+					return err
+				})
+			}
+			if err == nil {
+				err = checkProviderUser(user, SSHLoginMethodKeyboardInteractive, 4)
+			}
+			if err != nil {
+				return user, "", isRecordNotFoundError(err), err
+			}
+		}
+		user, err = doKeyboardInteractiveAuth(user, authHook, client, ip, protocol)
+		return user, "", false, err
+	})
+	return user, err
+}
+
+// authenticate consults the authentication backends in order and returns the result from the
+// first backend that knows the user. A backend declines if the user is not found, in this case
+// the next backend is consulted. A backend rejects if the user is found but the authentication
+// fails, in this case the chain stops.
+// If no authentication backend is configured the external auth hook is used if it is defined
+// for the given scope, otherwise the data provider is used.
+// Locked users are rejected without consulting the backends
+func authenticate(username, method, protocol string, scope int,
+	authFn func(backend string) (User, string, bool, error)) (User, string, error) {
 	var user User
+	var keyID string
+	var declined bool
 	var err error
-	if len(config.ExternalAuthHook) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&4 != 0) {
-		user, err = doExternalAuth(username, "", nil, "1", ip, protocol)
-	} else if len(config.PreLoginHook) > 0 {
-		user, err = executePreLoginHook(username, SSHLoginMethodKeyboardInteractive, ip, protocol)
-	} else {
-		user, err = provider.userExists(username)
+
+	if err = checkLoginLockout(username); err != nil {
+		return user, keyID, err
 	}
-	if err != nil {
-		return user, err
+	for _, backend := range getAuthBackends(scope) {
+		if backend == AuthBackendExternalHook && !isExternalAuthEnabledForScope(scope) {
+			providerLog(logger.LevelDebug, "auth backend %#v skipped for user %#v, method %v not in scope",
+				backend, username, method)
+			err = fmt.Errorf("external auth hook not enabled for method %v", method)
+			continue
+		}
+		if backend == AuthBackendLDAP && method != LoginMethodPassword {
+			providerLog(logger.LevelDebug, "auth backend %#v skipped for user %#v, method %v not supported",
+				backend, username, method)
+			err = fmt.Errorf("LDAP authentication not supported for method %v", method)
+			continue
+		}
+		user, keyID, declined, err = authFn(backend)
+		if err == nil {
+			providerLog(logger.LevelDebug, "auth backend %#v accepted user %#v, method: %v", backend, username, method)
+			// for SSH the TOTP code is checked as second authentication step, the failures
+			// are reset after the second step otherwise a wrong code is never locked
+			if !isSSHTOTPPending(user, method, protocol) {
+				updateLoginLockout(username, method, false, nil)
+			}
+			if err = applyUserGroups(&user); err != nil {
+				return user, keyID, err
+			}
+			// the access times can be inherited from the groups
+			return user, keyID, checkAccessTimes(&user)
+		}
+		if !declined {
+			providerLog(logger.LevelDebug, "auth backend %#v rejected user %#v, method: %v, err: %v",
+				backend, username, method, err)
+			updateLoginLockout(username, method, false, err)
+			return user, keyID, err
+		}
+		providerLog(logger.LevelDebug, "auth backend %#v declined user %#v, method: %v, err: %v",
+			backend, username, method, err)
+	}
+	return user, keyID, err
+}
+
+func isSSHTOTPPending(user User, method, protocol string) bool {
+	return protocol == "SSH" && method == LoginMethodPassword && user.IsTOTPRequired(protocol)
+}
+
+// checkProviderUser returns a not found error, so the provider backend declines, if the given user was
+// created by another authentication backend that handles the login method. The stored copy must not be
+// used to authenticate these users, the backend that created them could reject them
+func checkProviderUser(user User, method string, scope int) error {
+	if user.AuthBackend == "" || !utils.IsStringInSlice(user.AuthBackend, getAuthBackends(scope)) {
+		return nil
+	}
+	switch user.AuthBackend {
+	case AuthBackendExternalHook:
+		if !isExternalAuthEnabledForScope(scope) {
+			return nil
+		}
+	case AuthBackendLDAP:
+		if method != LoginMethodPassword {
+			return nil
+		}
+	}
+	return &RecordNotFoundError{err: fmt.Sprintf("user %#v is managed by the auth backend %#v", user.Username,
+		user.AuthBackend)}
+}
+
+func getAuthBackends(scope int) []string {
+	if len(config.AuthBackends) > 0 {
+		return config.AuthBackends
+	}
+	if isExternalAuthEnabledForScope(scope) {
+		return []string{AuthBackendExternalHook}
+	}
+	return []string{AuthBackendProvider}
+}
+
+func isExternalAuthEnabledForScope(scope int) bool {
+	return len(config.ExternalAuthHook) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&scope != 0)
+}
+
+func isRecordNotFoundError(err error) bool {
+	_, ok := err.(*RecordNotFoundError)
+	return ok
+}
+
+func validateAuthBackends() error {
+	var backends []string
+	for _, backend := range config.AuthBackends {
+		if backend != AuthBackendProvider && backend != AuthBackendExternalHook && backend != AuthBackendLDAP {
+			return fmt.Errorf("invalid auth backend %#v", backend)
+		}
+		if utils.IsStringInSlice(backend, backends) {
+			return fmt.Errorf("duplicated auth backend %#v", backend)
+		}
+		if backend == AuthBackendExternalHook && len(config.ExternalAuthHook) == 0 {
+			return fmt.Errorf("auth backend %#v requires an external auth hook", backend)
+		}
+		if backend == AuthBackendLDAP {
+			if err := config.LDAP.validate(); err != nil {
+				return fmt.Errorf("auth backend %#v: %v", backend, err)
+			}
+		}
+		backends = append(backends, backend)
 	}
-	return doKeyboardInteractiveAuth(user, authHook, client, ip, protocol)
+	return nil
 }
 
 // UpdateLastLogin updates the last login fields for the given SFTP user
@@ -563,7 +993,93 @@ func UpdateUserQuota(user User, filesAdd int, sizeAdd int64, reset bool) error {
 	if filesAdd == 0 && sizeAdd == 0 && !reset {
 		return nil
 	}
-	return provider.updateQuota(user.Username, filesAdd, sizeAdd, reset)
+	var err error
+	if thresholds := user.getQuotaWarningThresholds(); len(thresholds) > 0 && isQuotaWarningActionEnabled() {
+		err = updateUserQuotaWithWarnings(user, filesAdd, sizeAdd, reset, thresholds)
+	} else {
+		err = provider.updateQuota(user.Username, filesAdd, sizeAdd, reset)
+	}
+	if err == nil {
+		updateUserQuotaMetrics(user)
+	}
+	return err
+}
+
+// updateUserQuotaMetrics updates the per-user quota metrics, if enabled, with the
+// usage stored inside the data provider
+func updateUserQuotaMetrics(user User) {
+	if !metrics.IsPerUserMetricsEnabled() {
+		return
+	}
+	usedFiles, usedSize, err := provider.getUsedQuota(user.Username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get the used quota for user %#v, metrics not updated: %v",
+			user.Username, err)
+		return
+	}
+	metrics.UpdateUserQuota(user.Username, usedFiles, usedSize, user.QuotaFiles, user.QuotaSize)
+}
+
+func isQuotaWarningActionEnabled() bool {
+	return config.Actions.Hook != "" && utils.IsStringInSlice(operationQuotaWarn, config.Actions.ExecuteOn)
+}
+
+// updateUserQuotaWithWarnings updates the user quota and fires the quota warning action
+// for each threshold crossed by this update. The previous usage is read and the quota
+// is updated while holding a lock, so concurrent updates cannot cross the same threshold
+// more than once
+func updateUserQuotaWithWarnings(user User, filesAdd int, sizeAdd int64, reset bool, thresholds []int) error {
+	quotaWarningMutex.Lock()
+	defer quotaWarningMutex.Unlock()
+
+	usedFiles, usedSize, err := provider.getUsedQuota(user.Username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get used quota for user %#v, quota warnings skipped: %v", user.Username, err)
+		return provider.updateQuota(user.Username, filesAdd, sizeAdd, reset)
+	}
+	if err = provider.updateQuota(user.Username, filesAdd, sizeAdd, reset); err != nil {
+		return err
+	}
+	newFiles := filesAdd
+	newSize := sizeAdd
+	if !reset {
+		newFiles += usedFiles
+		newSize += usedSize
+	}
+	previous := user.getQuotaUsagePercentage(usedFiles, usedSize)
+	current := user.getQuotaUsagePercentage(newFiles, newSize)
+	for _, threshold := range thresholds {
+		if previous >= float64(threshold) || current < float64(threshold) {
+			continue
+		}
+		providerLog(logger.LevelInfo, "quota usage for user %#v crossed the %v%% warning threshold, current usage: %.2f%%",
+			user.Username, threshold, current)
+		go executeActionWithParams(operationQuotaWarn, user, map[string]string{
+			"quota_threshold":  strconv.Itoa(threshold),
+			"quota_percentage": strconv.FormatFloat(current, 'f', 2, 64),
+			"used_quota_files": strconv.Itoa(newFiles),
+			"used_quota_size":  strconv.FormatInt(newSize, 10),
+		})
+	}
+	return nil
+}
+
+// normalizeQuotaWarningThresholds validates the given quota usage percentages and
+// returns them sorted and without duplicates
+func normalizeQuotaWarningThresholds(thresholds []int) ([]int, error) {
+	sorted := make([]int, len(thresholds))
+	copy(sorted, thresholds)
+	sort.Ints(sorted)
+	result := make([]int, 0, len(sorted))
+	for _, threshold := range sorted {
+		if threshold <= 0 || threshold > 100 {
+			return nil, fmt.Errorf("invalid quota warning threshold %v, it must be a percentage between 1 and 100", threshold)
+		}
+		if len(result) == 0 || result[len(result)-1] != threshold {
+			result = append(result, threshold)
+		}
+	}
+	return result, nil
 }
 
 // UpdateVirtualFolderQuota updates the quota for the given virtual folder adding filesAdd and sizeAdd.
@@ -589,6 +1105,29 @@ func GetUsedQuota(username string) (int, int64, error) {
 	return provider.getUsedQuota(username)
 }
 
+// UpdateUserDownloadVolume adds sizeAdd to the volume downloaded by the given user in the
+// download volume period starting at periodStart. If the stored period is different, the
+// downloaded volume is reset to sizeAdd and the stored period is updated
+func UpdateUserDownloadVolume(user User, sizeAdd int64, periodStart int64) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	if sizeAdd == 0 {
+		return nil
+	}
+	return provider.updateDownloadVolume(user.Username, sizeAdd, periodStart)
+}
+
+// GetUsedDownloadVolume returns the volume downloaded by the given user in the download
+// volume period including the given time
+func GetUsedDownloadVolume(username string, t time.Time) (int64, error) {
+	user, err := provider.userExists(username)
+	if err != nil {
+		return 0, err
+	}
+	return user.GetUsedDownloadVolume(t), nil
+}
+
 // GetUsedVirtualFolderQuota returns the used quota for the given virtual folder.
 func GetUsedVirtualFolderQuota(mappedPath string) (int, int64, error) {
 	if config.TrackQuota == 0 {
@@ -602,12 +1141,19 @@ func UserExists(username string) (User, error) {
 	return provider.userExists(username)
 }
 
+// ValidateUser validates the given user without saving it
+func ValidateUser(user User) error {
+	u := user.getACopy()
+	return validateUser(&u)
+}
+
 // AddUser adds a new SFTPGo user.
 // ManageUsers configuration must be set to 1 to enable this method
 func AddUser(user User) error {
 	if config.ManageUsers == 0 {
 		return &MethodDisabledError{err: manageUsersDisabledError}
 	}
+	applyDefaultFolderPermissions(&user, nil)
 	err := provider.addUser(user)
 	if err == nil {
 		go executeAction(operationAdd, user)
@@ -621,6 +1167,9 @@ func UpdateUser(user User) error {
 	if config.ManageUsers == 0 {
 		return &MethodDisabledError{err: manageUsersDisabledError}
 	}
+	if u, err := provider.userExists(user.Username); err == nil {
+		applyDefaultFolderPermissions(&user, u.VirtualFolders)
+	}
 	err := provider.updateUser(user)
 	if err == nil {
 		RemoveCachedWebDAVUser(user.Username)
@@ -630,14 +1179,33 @@ func UpdateUser(user User) error {
 }
 
 // DeleteUser deletes an existing SFTPGo user.
+// If a retention for the deleted users is configured the user is soft deleted
+// and it can be restored until the retention period expires.
 // ManageUsers configuration must be set to 1 to enable this method
 func DeleteUser(user User) error {
+	return deleteUser(user, config.DeletedUsersRetention > 0)
+}
+
+// HardDeleteUser deletes an existing SFTPGo user without moving it to the
+// deleted users, even if a retention for the deleted users is configured.
+// ManageUsers configuration must be set to 1 to enable this method
+func HardDeleteUser(user User) error {
+	return deleteUser(user, false)
+}
+
+func deleteUser(user User, soft bool) error {
 	if config.ManageUsers == 0 {
 		return &MethodDisabledError{err: manageUsersDisabledError}
 	}
-	err := provider.deleteUser(user)
+	var err error
+	if soft {
+		err = softDeleteUser(user)
+	} else {
+		err = provider.deleteUser(user)
+	}
 	if err == nil {
 		RemoveCachedWebDAVUser(user.Username)
+		metrics.RemoveUserMetrics(user.Username)
 		go executeAction(operationDelete, user)
 	}
 	return err
@@ -650,9 +1218,20 @@ func ReloadConfig() error {
 	return provider.reloadConfig()
 }
 
-// GetUsers returns an array of users respecting limit and offset and filtered by username exact match if not empty
-func GetUsers(limit, offset int, order string, username string) ([]User, error) {
-	return provider.getUsers(limit, offset, order, username)
+// GetUsers returns an array of users respecting limit and offset and filtered by username exact match
+// and custom metadata if not empty
+func GetUsers(limit, offset int, order string, username string, metadata MetadataFilter) ([]User, error) {
+	return provider.getUsers(limit, offset, order, username, metadata)
+}
+
+// GetDefaultUserExpiration returns the expiration date, as unix timestamp in milliseconds,
+// for users added without an explicit expiration date. 0 means no expiration
+func GetDefaultUserExpiration() int64 {
+	if config.UsersDefaultExpiration <= 0 {
+		return 0
+	}
+	expiration := time.Now().Add(time.Duration(config.UsersDefaultExpiration) * 24 * time.Hour)
+	return utils.GetTimeAsMsSinceEpoch(expiration)
 }
 
 // GetUserByID returns the user with the given database ID if a match is found or an error
@@ -688,7 +1267,7 @@ func GetFolders(limit, offset int, order, folderPath string) ([]vfs.BaseVirtualF
 	return provider.getFolders(limit, offset, order, folderPath)
 }
 
-// DumpData returns all users and folders
+// DumpData returns all users, folders and groups
 func DumpData() (BackupData, error) {
 	var data BackupData
 	data.Version = DumpVersion
@@ -700,8 +1279,27 @@ func DumpData() (BackupData, error) {
 	if err != nil {
 		return data, err
 	}
+	groups, err := provider.dumpGroups()
+	if err != nil {
+		return data, err
+	}
+	// local paths are stored in the canonical form, so the backup can be restored
+	// on a different OS
+	for idx := range users {
+		users[idx].HomeDir = vfs.ToCanonicalPath(users[idx].HomeDir)
+		var virtualFolders []vfs.VirtualFolder
+		for _, v := range users[idx].VirtualFolders {
+			v.MappedPath = vfs.ToCanonicalPath(v.MappedPath)
+			virtualFolders = append(virtualFolders, v)
+		}
+		users[idx].VirtualFolders = virtualFolders
+	}
+	for idx := range folders {
+		folders[idx].MappedPath = vfs.ToCanonicalPath(folders[idx].MappedPath)
+	}
 	data.Users = users
 	data.Folders = folders
+	data.Groups = groups
 	return data, err
 }
 
@@ -746,6 +1344,16 @@ func Close() error {
 		availabilityTickerDone <- true
 		availabilityTicker = nil
 	}
+	if expirationTicker != nil {
+		expirationTicker.Stop()
+		expirationTickerDone <- true
+		expirationTicker = nil
+	}
+	if deletedUsersTicker != nil {
+		deletedUsersTicker.Stop()
+		deletedUsersTickerDone <- true
+		deletedUsersTicker = nil
+	}
 	return provider.close()
 }
 
@@ -765,6 +1373,8 @@ func createProvider(basePath string) error {
 		err = initializeBoltProvider(basePath)
 	} else if config.Driver == MemoryDataProviderName {
 		err = initializeMemoryProvider(basePath)
+	} else if config.Driver == MongoDBDataProviderName {
+		err = initializeMongoDBProvider()
 	} else {
 		err = fmt.Errorf("unsupported data provider: %v", config.Driver)
 	}
@@ -815,13 +1425,13 @@ func isMappedDirOverlapped(dir1, dir2 string) bool {
 
 func validateFolderQuotaLimits(folder vfs.VirtualFolder) error {
 	if folder.QuotaSize < -1 {
-		return &ValidationError{err: fmt.Sprintf("invalid quota_size: %v folder path %#v", folder.QuotaSize, folder.MappedPath)}
+		return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("invalid quota_size: %v folder path %#v", folder.QuotaSize, folder.MappedPath)}
 	}
 	if folder.QuotaFiles < -1 {
-		return &ValidationError{err: fmt.Sprintf("invalid quota_file: %v folder path %#v", folder.QuotaSize, folder.MappedPath)}
+		return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("invalid quota_file: %v folder path %#v", folder.QuotaSize, folder.MappedPath)}
 	}
 	if (folder.QuotaSize == -1 && folder.QuotaFiles != -1) || (folder.QuotaFiles == -1 && folder.QuotaSize != -1) {
-		return &ValidationError{err: fmt.Sprintf("virtual folder quota_size and quota_files must be both -1 or >= 0, quota_size: %v quota_files: %v",
+		return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("virtual folder quota_size and quota_files must be both -1 or >= 0, quota_size: %v quota_files: %v",
 			folder.QuotaFiles, folder.QuotaSize)}
 	}
 	return nil
@@ -837,17 +1447,26 @@ func validateUserVirtualFolders(user *User) error {
 	for _, v := range user.VirtualFolders {
 		cleanedVPath := filepath.ToSlash(path.Clean(v.VirtualPath))
 		if !path.IsAbs(cleanedVPath) || cleanedVPath == "/" {
-			return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v", v.VirtualPath)}
+			return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("invalid virtual folder %#v", v.VirtualPath)}
 		}
 		if err := validateFolderQuotaLimits(v); err != nil {
 			return err
 		}
-		cleanedMPath := filepath.Clean(v.MappedPath)
+		if vfs.HasMixedSeparators(v.MappedPath) {
+			return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("mapped folder %#v cannot mix \"/\" and \"\\\" separators",
+				v.MappedPath)}
+		}
+		cleanedMPath := vfs.ToOSPath(v.MappedPath)
 		if !filepath.IsAbs(cleanedMPath) {
-			return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v", v.MappedPath)}
+			return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("invalid mapped folder %#v", v.MappedPath)}
+		}
+		if err := user.checkResolvedPath(cleanedMPath); err != nil {
+			return &ValidationError{field: "virtual_folders", err: err.Error()}
 		}
-		if isMappedDirOverlapped(cleanedMPath, user.GetHomeDir()) {
-			return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v cannot be inside or contain the user home dir %#v",
+		// the mapped path is stored as is, the overlaps are checked using the resolved paths
+		resolvedMPath := vfs.ToOSPath(user.resolvePathPlaceholders(cleanedMPath))
+		if isMappedDirOverlapped(resolvedMPath, user.GetHomeDir()) {
+			return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("invalid mapped folder %#v cannot be inside or contain the user home dir %#v",
 				v.MappedPath, user.GetHomeDir())}
 		}
 		virtualFolders = append(virtualFolders, vfs.VirtualFolder{
@@ -860,55 +1479,89 @@ func validateUserVirtualFolders(user *User) error {
 		})
 		for k, virtual := range mappedPaths {
 			if GetQuotaTracking() > 0 {
-				if isMappedDirOverlapped(k, cleanedMPath) {
-					return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v overlaps with mapped folder %#v",
+				if isMappedDirOverlapped(k, resolvedMPath) {
+					return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("invalid mapped folder %#v overlaps with mapped folder %#v",
 						v.MappedPath, k)}
 				}
 			} else {
-				if k == cleanedMPath {
-					return &ValidationError{err: fmt.Sprintf("duplicated mapped folder %#v", v.MappedPath)}
+				if k == resolvedMPath {
+					return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("duplicated mapped folder %#v", v.MappedPath)}
 				}
 			}
 			if isVirtualDirOverlapped(virtual, cleanedVPath) {
-				return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v overlaps with virtual folder %#v",
+				return &ValidationError{field: "virtual_folders", err: fmt.Sprintf("invalid virtual folder %#v overlaps with virtual folder %#v",
 					v.VirtualPath, virtual)}
 			}
 		}
-		mappedPaths[cleanedMPath] = cleanedVPath
+		mappedPaths[resolvedMPath] = cleanedVPath
 	}
 	user.VirtualFolders = virtualFolders
 	return nil
 }
 
 func validatePermissions(user *User) error {
-	if len(user.Permissions) == 0 {
-		return &ValidationError{err: "please grant some permissions to this user"}
+	if len(user.Permissions) == 0 && len(user.Groups) == 0 {
+		return &ValidationError{field: "permissions", err: "please grant some permissions to this user"}
+	}
+	// group members can inherit the root dir permissions, they are checked at login
+	permissions, err := cleanPermissions(user.Permissions, len(user.Groups) == 0)
+	if err != nil {
+		return err
+	}
+	user.Permissions = permissions
+	return nil
+}
+
+// validateUploadOnlyPermission checks that the upload only permission is only
+// combined with the create_dirs permission, any other permission would defeat
+// the drop box mode
+func validateUploadOnlyPermission(dir string, perms []string) error {
+	if !utils.IsStringInSlice(PermUploadOnly, perms) {
+		return nil
+	}
+	for _, p := range perms {
+		if p != PermUploadOnly && p != PermCreateDirs {
+			return &ValidationError{field: "permissions",
+				err: fmt.Sprintf("the %#v permission for the directory %#v cannot be combined with %#v", PermUploadOnly, dir, p)}
+		}
 	}
+	return nil
+}
+
+func cleanPermissions(dirPermissions map[string][]string, rootRequired bool) (map[string][]string, error) {
 	permissions := make(map[string][]string)
-	if _, ok := user.Permissions["/"]; !ok {
-		return &ValidationError{err: "permissions for the root dir \"/\" must be set"}
+	if _, ok := dirPermissions["/"]; !ok && rootRequired {
+		return nil, &ValidationError{field: "permissions", err: "permissions for the root dir \"/\" must be set"}
 	}
-	for dir, perms := range user.Permissions {
+	for dir, perms := range dirPermissions {
 		if len(perms) == 0 && dir == "/" {
-			return &ValidationError{err: fmt.Sprintf("no permissions granted for the directory: %#v", dir)}
+			return nil, &ValidationError{field: "permissions", err: fmt.Sprintf("no permissions granted for the directory: %#v", dir)}
 		}
 		if len(perms) > len(ValidPerms) {
-			return &ValidationError{err: "invalid permissions"}
+			return nil, &ValidationError{field: "permissions", err: "invalid permissions"}
 		}
 		for _, p := range perms {
 			if !utils.IsStringInSlice(p, ValidPerms) {
-				return &ValidationError{err: fmt.Sprintf("invalid permission: %#v", p)}
+				return nil, &ValidationError{field: "permissions", err: fmt.Sprintf("invalid permission: %#v", p)}
 			}
 		}
+		if err := validateUploadOnlyPermission(dir, perms); err != nil {
+			return nil, err
+		}
 		cleanedDir := filepath.ToSlash(path.Clean(dir))
 		if cleanedDir != "/" {
 			cleanedDir = strings.TrimSuffix(cleanedDir, "/")
 		}
 		if !path.IsAbs(cleanedDir) {
-			return &ValidationError{err: fmt.Sprintf("cannot set permissions for non absolute path: %#v", dir)}
+			return nil, &ValidationError{field: "permissions", err: fmt.Sprintf("cannot set permissions for non absolute path: %#v", dir)}
 		}
 		if dir != cleanedDir && cleanedDir == "/" {
-			return &ValidationError{err: fmt.Sprintf("cannot set permissions for invalid subdirectory: %#v is an alias for \"/\"", dir)}
+			return nil, &ValidationError{field: "permissions", err: fmt.Sprintf("cannot set permissions for invalid subdirectory: %#v is an alias for \"/\"", dir)}
+		}
+		if IsPermissionPattern(cleanedDir) {
+			if _, err := path.Match(cleanedDir, "/"); err != nil {
+				return nil, &ValidationError{field: "permissions", err: fmt.Sprintf("invalid permissions pattern %#v: %v", dir, err)}
+			}
 		}
 		if utils.IsStringInSlice(PermAny, perms) {
 			permissions[cleanedDir] = []string{PermAny}
@@ -916,8 +1569,7 @@ func validatePermissions(user *User) error {
 			permissions[cleanedDir] = perms
 		}
 	}
-	user.Permissions = permissions
-	return nil
+	return permissions, nil
 }
 
 func validatePublicKeys(user *User) error {
@@ -927,141 +1579,827 @@ func validatePublicKeys(user *User) error {
 	for i, k := range user.PublicKeys {
 		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
 		if err != nil {
-			return &ValidationError{err: fmt.Sprintf("could not parse key nr. %d: %s", i, err)}
+			return &ValidationError{field: "public_keys", err: fmt.Sprintf("could not parse key nr. %d: %s", i, err)}
+		}
+	}
+	return nil
+}
+
+func validateFiltersPatternExtensions(user *User) error {
+	if len(user.Filters.FilePatterns) == 0 {
+		user.Filters.FilePatterns = []PatternsFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []PatternsFilter
+	for _, f := range user.Filters.FilePatterns {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{field: "filters.file_patterns", err: fmt.Sprintf("invalid path %#v for file patterns filter", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{field: "filters.file_patterns", err: fmt.Sprintf("duplicate file patterns filter for path %#v", f.Path)}
+		}
+		if len(f.AllowedPatterns) == 0 && len(f.DeniedPatterns) == 0 {
+			return &ValidationError{field: "filters.file_patterns", err: fmt.Sprintf("empty file patterns filter for path %#v", f.Path)}
+		}
+		f.Path = cleanedPath
+		allowed := make([]string, 0, len(f.AllowedPatterns))
+		denied := make([]string, 0, len(f.DeniedPatterns))
+		for _, pattern := range f.AllowedPatterns {
+			_, err := path.Match(pattern, "abc")
+			if err != nil {
+				return &ValidationError{field: "filters.file_patterns", err: fmt.Sprintf("invalid file pattern filter %#v", pattern)}
+			}
+			allowed = append(allowed, strings.ToLower(pattern))
+		}
+		for _, pattern := range f.DeniedPatterns {
+			_, err := path.Match(pattern, "abc")
+			if err != nil {
+				return &ValidationError{field: "filters.file_patterns", err: fmt.Sprintf("invalid file pattern filter %#v", pattern)}
+			}
+			denied = append(denied, strings.ToLower(pattern))
+		}
+		f.AllowedPatterns = allowed
+		f.DeniedPatterns = denied
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.FilePatterns = filters
+	return nil
+}
+
+func validateFiltersWriteModes(user *User) error {
+	if len(user.Filters.WriteModes) == 0 {
+		user.Filters.WriteModes = []WriteModeFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []WriteModeFilter
+	for _, f := range user.Filters.WriteModes {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{field: "filters.write_modes", err: fmt.Sprintf("invalid path %#v for write modes filter", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{field: "filters.write_modes", err: fmt.Sprintf("duplicate write modes filter for path %#v", f.Path)}
+		}
+		if len(f.AppendOnly) == 0 && len(f.OverwriteOnly) == 0 {
+			return &ValidationError{field: "filters.write_modes", err: fmt.Sprintf("empty write modes filter for path %#v", f.Path)}
+		}
+		f.Path = cleanedPath
+		appendOnly := make([]string, 0, len(f.AppendOnly))
+		overwriteOnly := make([]string, 0, len(f.OverwriteOnly))
+		for _, pattern := range f.AppendOnly {
+			if _, err := path.Match(pattern, "abc"); err != nil || pattern == "" {
+				return &ValidationError{field: "filters.write_modes", err: fmt.Sprintf("invalid write mode pattern %#v", pattern)}
+			}
+			appendOnly = append(appendOnly, strings.ToLower(pattern))
+		}
+		for _, pattern := range f.OverwriteOnly {
+			if _, err := path.Match(pattern, "abc"); err != nil || pattern == "" {
+				return &ValidationError{field: "filters.write_modes", err: fmt.Sprintf("invalid write mode pattern %#v", pattern)}
+			}
+			pattern = strings.ToLower(pattern)
+			if utils.IsStringInSlice(pattern, appendOnly) {
+				return &ValidationError{field: "filters.write_modes",
+					err: fmt.Sprintf("pattern %#v cannot be both append-only and overwrite-only, path %#v", pattern, f.Path)}
+			}
+			overwriteOnly = append(overwriteOnly, pattern)
+		}
+		f.AppendOnly = appendOnly
+		f.OverwriteOnly = overwriteOnly
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.WriteModes = filters
+	return nil
+}
+
+func validateFiltersFileExtensions(user *User) error {
+	if len(user.Filters.FileExtensions) == 0 {
+		user.Filters.FileExtensions = []ExtensionsFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []ExtensionsFilter
+	for _, f := range user.Filters.FileExtensions {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{field: "filters.file_extensions", err: fmt.Sprintf("invalid path %#v for file extensions filter", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{field: "filters.file_extensions", err: fmt.Sprintf("duplicate file extensions filter for path %#v", f.Path)}
+		}
+		if len(f.AllowedExtensions) == 0 && len(f.DeniedExtensions) == 0 {
+			return &ValidationError{field: "filters.file_extensions", err: fmt.Sprintf("empty file extensions filter for path %#v", f.Path)}
+		}
+		f.Path = cleanedPath
+		allowed := make([]string, 0, len(f.AllowedExtensions))
+		denied := make([]string, 0, len(f.DeniedExtensions))
+		for _, ext := range f.AllowedExtensions {
+			allowed = append(allowed, strings.ToLower(ext))
+		}
+		for _, ext := range f.DeniedExtensions {
+			denied = append(denied, strings.ToLower(ext))
+		}
+		f.AllowedExtensions = allowed
+		f.DeniedExtensions = denied
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.FileExtensions = filters
+	return nil
+}
+
+func validateFiltersUploadOrder(user *User) error {
+	if len(user.Filters.UploadOrder) == 0 {
+		user.Filters.UploadOrder = []UploadOrderFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []UploadOrderFilter
+	for _, f := range user.Filters.UploadOrder {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{field: "filters.upload_order", err: fmt.Sprintf("invalid path %#v for upload order filter", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{field: "filters.upload_order", err: fmt.Sprintf("duplicate upload order filter for path %#v", f.Path)}
+		}
+		if !isValidUploadOrderFileName(f.SentinelFile) {
+			return &ValidationError{field: "filters.upload_order", err: fmt.Sprintf("invalid sentinel file %#v for upload order filter, path %#v",
+				f.SentinelFile, f.Path)}
+		}
+		f.Path = cleanedPath
+		required := make([]string, 0, len(f.RequiredFiles))
+		for _, name := range f.RequiredFiles {
+			if !isValidUploadOrderFileName(name) || name == f.SentinelFile {
+				return &ValidationError{field: "filters.upload_order", err: fmt.Sprintf("invalid required file %#v for upload order filter, path %#v",
+					name, f.Path)}
+			}
+			if !utils.IsStringInSlice(name, required) {
+				required = append(required, name)
+			}
+		}
+		f.RequiredFiles = required
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.UploadOrder = filters
+	return nil
+}
+
+func isValidUploadOrderFileName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, "/\\")
+}
+
+func validateFiltersPathSchemas(user *User) error {
+	if len(user.Filters.PathSchemas) == 0 {
+		user.Filters.PathSchemas = []PathSchemaFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []PathSchemaFilter
+	for _, f := range user.Filters.PathSchemas {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{field: "filters.path_schemas", err: fmt.Sprintf("invalid path %#v for path schema filter", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{field: "filters.path_schemas", err: fmt.Sprintf("duplicate path schema filter for path %#v", f.Path)}
+		}
+		f.Path = cleanedPath
+		f.Schema = strings.Trim(f.Schema, "/")
+		var schemaVariables []string
+		for _, segment := range strings.Split(f.Schema, "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				return &ValidationError{field: "filters.path_schemas", err: fmt.Sprintf("invalid schema %#v for path %#v", f.Schema, f.Path)}
+			}
+			if name, ok := getPathSchemaVariable(segment); ok {
+				if !pathSchemaVariableRegex.MatchString(name) {
+					return &ValidationError{field: "filters.path_schemas", err: fmt.Sprintf("invalid variable %#v in schema %#v for path %#v",
+						segment, f.Schema, f.Path)}
+				}
+				schemaVariables = append(schemaVariables, name)
+			} else if strings.ContainsAny(segment, "{}\\") {
+				return &ValidationError{field: "filters.path_schemas", err: fmt.Sprintf("invalid directory name %#v in schema %#v for path %#v",
+					segment, f.Schema, f.Path)}
+			}
+		}
+		variables := make(map[string][]string)
+		for name, values := range f.Variables {
+			if !utils.IsStringInSlice(name, schemaVariables) {
+				return &ValidationError{field: "filters.path_schemas", err: fmt.Sprintf("variable %#v is not defined in schema %#v for path %#v",
+					name, f.Schema, f.Path)}
+			}
+			var allowed []string
+			for _, value := range values {
+				if value == "" || (!strings.HasPrefix(value, "^") && strings.Contains(value, "/")) {
+					return &ValidationError{field: "filters.path_schemas", err: fmt.Sprintf("invalid value %#v for variable %#v, path %#v",
+						value, name, f.Path)}
+				}
+				if strings.HasPrefix(value, "^") {
+					if _, err := regexp.Compile(value); err != nil {
+						return &ValidationError{field: "filters.path_schemas", err: fmt.Sprintf("invalid regexp %#v for variable %#v, path %#v: %v",
+							value, name, f.Path, err)}
+					}
+				}
+				if !utils.IsStringInSlice(value, allowed) {
+					allowed = append(allowed, value)
+				}
+			}
+			if len(allowed) > 0 {
+				variables[name] = allowed
+			}
+		}
+		if len(variables) == 0 {
+			variables = nil
+		}
+		f.Variables = variables
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.PathSchemas = filters
+	return nil
+}
+
+func validateFiltersAutoCreateDirs(user *User) error {
+	dirs := []string{}
+	for _, dir := range user.Filters.AutoCreateDirs {
+		cleanedPath := filepath.ToSlash(path.Clean(dir))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{field: "filters.auto_create_dirs", err: fmt.Sprintf("invalid path %#v for auto create dirs", dir)}
+		}
+		if !utils.IsStringInSlice(cleanedPath, dirs) {
+			dirs = append(dirs, cleanedPath)
+		}
+	}
+	user.Filters.AutoCreateDirs = dirs
+	return nil
+}
+
+func validateFiltersExecCommands(user *User) error {
+	var commands []string
+	for _, command := range user.Filters.AllowedExecCommands {
+		if strings.TrimSpace(command) == "" {
+			continue
+		}
+		if strings.HasPrefix(command, "^") {
+			if _, err := regexp.Compile(command); err != nil {
+				return &ValidationError{field: "filters.allowed_exec_commands", err: fmt.Sprintf("invalid allowed exec command regexp %#v: %v", command, err)}
+			}
+		}
+		if !utils.IsStringInSlice(command, commands) {
+			commands = append(commands, command)
+		}
+	}
+	if len(commands) == 0 {
+		commands = []string{}
+	}
+	user.Filters.AllowedExecCommands = commands
+	return nil
+}
+
+func validateFileFilters(user *User) error {
+	if err := validateFiltersFileExtensions(user); err != nil {
+		return err
+	}
+	if err := validateFiltersUploadOrder(user); err != nil {
+		return err
+	}
+	if err := validateFiltersAutoCreateDirs(user); err != nil {
+		return err
+	}
+	if err := validateFiltersPathSchemas(user); err != nil {
+		return err
+	}
+	if err := validateFiltersWriteModes(user); err != nil {
+		return err
+	}
+	return validateFiltersPatternExtensions(user)
+}
+
+func validateFilters(user *User) error {
+	if len(user.Filters.AllowedIP) == 0 {
+		user.Filters.AllowedIP = []string{}
+	}
+	if len(user.Filters.DeniedIP) == 0 {
+		user.Filters.DeniedIP = []string{}
+	}
+	if len(user.Filters.DeniedLoginMethods) == 0 {
+		user.Filters.DeniedLoginMethods = []string{}
+	}
+	if len(user.Filters.DeniedProtocols) == 0 {
+		user.Filters.DeniedProtocols = []string{}
+	}
+	for _, IPMask := range user.Filters.DeniedIP {
+		_, _, err := net.ParseCIDR(IPMask)
+		if err != nil {
+			return &ValidationError{field: "filters.denied_ip", err: fmt.Sprintf("could not parse denied IP/Mask %#v : %v", IPMask, err)}
+		}
+	}
+	for _, IPMask := range user.Filters.AllowedIP {
+		_, _, err := net.ParseCIDR(IPMask)
+		if err != nil {
+			return &ValidationError{field: "filters.allowed_ip", err: fmt.Sprintf("could not parse allowed IP/Mask %#v : %v", IPMask, err)}
+		}
+	}
+	if len(user.Filters.DeniedLoginMethods) >= len(ValidSSHLoginMethods) {
+		return &ValidationError{field: "filters.denied_login_methods", err: "invalid denied_login_methods"}
+	}
+	for _, loginMethod := range user.Filters.DeniedLoginMethods {
+		if !utils.IsStringInSlice(loginMethod, ValidSSHLoginMethods) {
+			return &ValidationError{field: "filters.denied_login_methods", err: fmt.Sprintf("invalid login method: %#v", loginMethod)}
+		}
+	}
+	if len(user.Filters.DeniedProtocols) >= len(ValidProtocols) {
+		return &ValidationError{field: "filters.denied_protocols", err: "invalid denied_protocols"}
+	}
+	for _, p := range user.Filters.DeniedProtocols {
+		if !utils.IsStringInSlice(p, ValidProtocols) {
+			return &ValidationError{field: "filters.denied_protocols", err: fmt.Sprintf("invalid protocol: %#v", p)}
+		}
+	}
+	if err := validateFiltersExecCommands(user); err != nil {
+		return err
+	}
+	if err := validateFiltersDownloadVolume(user); err != nil {
+		return err
+	}
+	if err := validateFiltersRecursionLimits(user); err != nil {
+		return err
+	}
+	if err := validateFiltersMaxOpenFiles(user); err != nil {
+		return err
+	}
+	if err := validateFiltersIdleTimeout(user); err != nil {
+		return err
+	}
+	if err := validateFiltersConcurrentTransfers(user); err != nil {
+		return err
+	}
+	if err := validateFiltersUploadNameRegex(user); err != nil {
+		return err
+	}
+	if err := validateFiltersDownloadSizeLimits(user); err != nil {
+		return err
+	}
+	if err := validateFiltersDirectoryFilesLimits(user); err != nil {
+		return err
+	}
+	if err := validateFiltersTextTransforms(user); err != nil {
+		return err
+	}
+	if err := validateFiltersUploadDuration(user); err != nil {
+		return err
+	}
+	if err := validateFiltersDefaultFolderPermissions(user); err != nil {
+		return err
+	}
+	if err := validateFiltersBandwidthSchedules(user); err != nil {
+		return err
+	}
+	if err := validateFiltersProtocolPermissions(user); err != nil {
+		return err
+	}
+	if err := validateFiltersAccessTimes(user); err != nil {
+		return err
+	}
+	thresholds, err := normalizeQuotaWarningThresholds(user.Filters.QuotaWarningThresholds)
+	if err != nil {
+		return &ValidationError{field: "filters.quota_warning_thresholds", err: err.Error()}
+	}
+	user.Filters.QuotaWarningThresholds = thresholds
+	return validateFileFilters(user)
+}
+
+func validateFiltersDefaultFolderPermissions(user *User) error {
+	if len(user.Filters.DefaultFolderPermissions) == 0 {
+		user.Filters.DefaultFolderPermissions = []string{}
+		return nil
+	}
+	for _, p := range user.Filters.DefaultFolderPermissions {
+		if !utils.IsStringInSlice(p, ValidPerms) {
+			return &ValidationError{field: "filters.default_folder_permissions", err: fmt.Sprintf("invalid permission: %#v", p)}
+		}
+	}
+	if utils.IsStringInSlice(PermAny, user.Filters.DefaultFolderPermissions) {
+		user.Filters.DefaultFolderPermissions = []string{PermAny}
+	}
+	return nil
+}
+
+func validateFiltersProtocolPermissions(user *User) error {
+	if len(user.Filters.ProtocolPermissions) == 0 {
+		user.Filters.ProtocolPermissions = []ProtocolPermissionsFilter{}
+		return nil
+	}
+	var filters []ProtocolPermissionsFilter
+	var protocols []string
+	for _, f := range user.Filters.ProtocolPermissions {
+		if !utils.IsStringInSlice(f.Protocol, ValidProtocols) {
+			return &ValidationError{field: "filters.protocol_permissions", err: fmt.Sprintf("invalid protocol: %#v", f.Protocol)}
+		}
+		if utils.IsStringInSlice(f.Protocol, protocols) {
+			return &ValidationError{field: "filters.protocol_permissions", err: fmt.Sprintf("duplicate permissions for protocol %#v", f.Protocol)}
+		}
+		permissions, err := cleanPermissions(f.Permissions, true)
+		if err != nil {
+			var errValidation *ValidationError
+			if errors.As(err, &errValidation) {
+				return &ValidationError{field: "filters.protocol_permissions",
+					err: fmt.Sprintf("invalid permissions for protocol %#v: %v", f.Protocol, errValidation.GetMessage())}
+			}
+			return err
+		}
+		protocols = append(protocols, f.Protocol)
+		filters = append(filters, ProtocolPermissionsFilter{
+			Protocol:    f.Protocol,
+			Permissions: permissions,
+		})
+	}
+	user.Filters.ProtocolPermissions = filters
+	return nil
+}
+
+// applyDefaultFolderPermissions grants the configured default permissions to the
+// virtual folders not included in previousFolders, if no explicit permissions are
+// set for their virtual path
+func applyDefaultFolderPermissions(user *User, previousFolders []vfs.VirtualFolder) {
+	if len(user.Filters.DefaultFolderPermissions) == 0 {
+		return
+	}
+	attachedPaths := make(map[string]bool)
+	for _, v := range previousFolders {
+		attachedPaths[path.Clean(filepath.ToSlash(v.VirtualPath))] = true
+	}
+	var permissions map[string][]string
+	for _, v := range user.VirtualFolders {
+		vPath := path.Clean(filepath.ToSlash(v.VirtualPath))
+		if attachedPaths[vPath] {
+			continue
+		}
+		if _, ok := user.Permissions[vPath]; ok {
+			continue
+		}
+		if permissions == nil {
+			// the permissions map could be shared with the stored user, we never modify it
+			permissions = make(map[string][]string)
+			for k, v := range user.Permissions {
+				permissions[k] = v
+			}
+		}
+		perms := make([]string, len(user.Filters.DefaultFolderPermissions))
+		copy(perms, user.Filters.DefaultFolderPermissions)
+		permissions[vPath] = perms
+	}
+	if permissions != nil {
+		user.Permissions = permissions
+	}
+}
+
+func validateFiltersRecursionLimits(user *User) error {
+	if user.Filters.MaxRecursionDepth < 0 {
+		return &ValidationError{field: "filters.max_recursion_depth", err: fmt.Sprintf("invalid max recursion depth: %v", user.Filters.MaxRecursionDepth)}
+	}
+	if user.Filters.MaxRecursionEntries < 0 {
+		return &ValidationError{field: "filters.max_recursion_entries", err: fmt.Sprintf("invalid max recursion entries: %v", user.Filters.MaxRecursionEntries)}
+	}
+	return nil
+}
+
+func validateFiltersDownloadSizeLimits(user *User) error {
+	if user.Filters.MaxDownloadFileSize < 0 {
+		return &ValidationError{field: "filters.max_download_file_size", err: fmt.Sprintf("invalid max download file size: %v", user.Filters.MaxDownloadFileSize)}
+	}
+	if len(user.Filters.DownloadSizeLimits) == 0 {
+		user.Filters.DownloadSizeLimits = []DownloadSizeLimitFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []DownloadSizeLimitFilter
+	for _, f := range user.Filters.DownloadSizeLimits {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{field: "filters.download_size_limits", err: fmt.Sprintf("invalid path %#v for download size limit", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{field: "filters.download_size_limits", err: fmt.Sprintf("duplicate download size limit for path %#v", f.Path)}
+		}
+		if f.MaxFileSize < 0 {
+			return &ValidationError{field: "filters.download_size_limits", err: fmt.Sprintf("invalid download size limit %v for path %#v", f.MaxFileSize, f.Path)}
+		}
+		f.Path = cleanedPath
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.DownloadSizeLimits = filters
+	return nil
+}
+
+func validateFiltersDirectoryFilesLimits(user *User) error {
+	if len(user.Filters.DirectoryFilesLimits) == 0 {
+		user.Filters.DirectoryFilesLimits = []DirectoryFilesLimitFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []DirectoryFilesLimitFilter
+	for _, f := range user.Filters.DirectoryFilesLimits {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{field: "filters.directory_files_limits", err: fmt.Sprintf("invalid path %#v for directory files limit", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{field: "filters.directory_files_limits", err: fmt.Sprintf("duplicate directory files limit for path %#v", f.Path)}
+		}
+		if f.MaxFiles < 0 {
+			return &ValidationError{field: "filters.directory_files_limits", err: fmt.Sprintf("invalid directory files limit %v for path %#v", f.MaxFiles, f.Path)}
+		}
+		f.Path = cleanedPath
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.DirectoryFilesLimits = filters
+	return nil
+}
+
+func validateFiltersUploadDuration(user *User) error {
+	if user.Filters.MaxUploadDuration < 0 {
+		return &ValidationError{field: "filters.max_upload_duration", err: fmt.Sprintf("invalid max upload duration: %v", user.Filters.MaxUploadDuration)}
+	}
+	if user.Filters.MinUploadRate < 0 {
+		return &ValidationError{field: "filters.min_upload_rate", err: fmt.Sprintf("invalid min upload rate: %v", user.Filters.MinUploadRate)}
+	}
+	if len(user.Filters.UploadDurationLimits) == 0 {
+		user.Filters.UploadDurationLimits = []UploadDurationLimitFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []UploadDurationLimitFilter
+	for _, f := range user.Filters.UploadDurationLimits {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{field: "filters.upload_duration_limits", err: fmt.Sprintf("invalid path %#v for upload duration limit", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{field: "filters.upload_duration_limits", err: fmt.Sprintf("duplicate upload duration limit for path %#v", f.Path)}
+		}
+		if f.MaxDuration < 0 || f.MinRate < 0 {
+			return &ValidationError{field: "filters.upload_duration_limits", err: fmt.Sprintf("invalid upload duration limit %v, min rate %v for path %#v",
+				f.MaxDuration, f.MinRate, f.Path)}
+		}
+		f.Path = cleanedPath
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.UploadDurationLimits = filters
+	return nil
+}
+
+func validateFiltersBandwidthSchedules(user *User) error {
+	if len(user.Filters.BandwidthSchedules) == 0 {
+		user.Filters.BandwidthSchedules = []BandwidthScheduleFilter{}
+		return nil
+	}
+	var filters []BandwidthScheduleFilter
+	var windows [][2]int
+	for _, f := range user.Filters.BandwidthSchedules {
+		start, err := parseScheduleTime(f.Start)
+		if err != nil {
+			return &ValidationError{field: "filters.bandwidth_schedules", err: fmt.Sprintf("invalid start: %v", err)}
+		}
+		end, err := parseScheduleTime(f.End)
+		if err != nil {
+			return &ValidationError{field: "filters.bandwidth_schedules", err: fmt.Sprintf("invalid end: %v", err)}
 		}
+		if start >= end {
+			return &ValidationError{field: "filters.bandwidth_schedules", err: fmt.Sprintf("the end %#v must be after the start %#v", f.End, f.Start)}
+		}
+		if f.UploadBandwidth < 0 || f.DownloadBandwidth < 0 {
+			return &ValidationError{field: "filters.bandwidth_schedules", err: fmt.Sprintf("invalid bandwidth, upload: %v, download: %v",
+				f.UploadBandwidth, f.DownloadBandwidth)}
+		}
+		var weekDays []int
+		for _, day := range f.WeekDays {
+			if day < 0 || day > 6 {
+				return &ValidationError{field: "filters.bandwidth_schedules", err: fmt.Sprintf("invalid week day %v", day)}
+			}
+			if !utils.IsIntInSlice(day, weekDays) {
+				weekDays = append(weekDays, day)
+			}
+		}
+		sort.Ints(weekDays)
+		for idx, other := range filters {
+			if start < windows[idx][1] && windows[idx][0] < end && hasCommonWeekDays(weekDays, other.WeekDays) {
+				return &ValidationError{field: "filters.bandwidth_schedules", err: fmt.Sprintf("the window %v-%v overlaps with the window %v-%v",
+					f.Start, f.End, other.Start, other.End)}
+			}
+		}
+		f.WeekDays = weekDays
+		f.Start = fmt.Sprintf("%02d:%02d", start/60, start%60)
+		f.End = fmt.Sprintf("%02d:%02d", end/60, end%60)
+		filters = append(filters, f)
+		windows = append(windows, [2]int{start, end})
 	}
+	user.Filters.BandwidthSchedules = filters
 	return nil
 }
 
-func validateFiltersPatternExtensions(user *User) error {
-	if len(user.Filters.FilePatterns) == 0 {
-		user.Filters.FilePatterns = []PatternsFilter{}
+func validateFiltersAccessTimes(user *User) error {
+	if len(user.Filters.AccessTimes) == 0 {
+		user.Filters.AccessTimes = []AccessTimeFilter{}
+		if user.Filters.DisconnectOutsideAccessTimes {
+			return &ValidationError{field: "filters.disconnect_outside_access_times",
+				err: "disconnecting the sessions outside the access times requires at least an access time window"}
+		}
 		return nil
 	}
-	filteredPaths := []string{}
-	var filters []PatternsFilter
-	for _, f := range user.Filters.FilePatterns {
-		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
-		if !path.IsAbs(cleanedPath) {
-			return &ValidationError{err: fmt.Sprintf("invalid path %#v for file patterns filter", f.Path)}
+	var filters []AccessTimeFilter
+	for _, f := range user.Filters.AccessTimes {
+		start, err := parseScheduleTime(f.Start)
+		if err != nil {
+			return &ValidationError{field: "filters.access_times", err: fmt.Sprintf("invalid start: %v", err)}
 		}
-		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
-			return &ValidationError{err: fmt.Sprintf("duplicate file patterns filter for path %#v", f.Path)}
+		end, err := parseScheduleTime(f.End)
+		if err != nil {
+			return &ValidationError{field: "filters.access_times", err: fmt.Sprintf("invalid end: %v", err)}
 		}
-		if len(f.AllowedPatterns) == 0 && len(f.DeniedPatterns) == 0 {
-			return &ValidationError{err: fmt.Sprintf("empty file patterns filter for path %#v", f.Path)}
+		if start >= end {
+			return &ValidationError{field: "filters.access_times", err: fmt.Sprintf("the end %#v must be after the start %#v", f.End, f.Start)}
 		}
-		f.Path = cleanedPath
-		allowed := make([]string, 0, len(f.AllowedPatterns))
-		denied := make([]string, 0, len(f.DeniedPatterns))
-		for _, pattern := range f.AllowedPatterns {
-			_, err := path.Match(pattern, "abc")
-			if err != nil {
-				return &ValidationError{err: fmt.Sprintf("invalid file pattern filter %#v", pattern)}
+		var weekDays []int
+		for _, day := range f.WeekDays {
+			if day < 0 || day > 6 {
+				return &ValidationError{field: "filters.access_times", err: fmt.Sprintf("invalid week day %v", day)}
+			}
+			if !utils.IsIntInSlice(day, weekDays) {
+				weekDays = append(weekDays, day)
 			}
-			allowed = append(allowed, strings.ToLower(pattern))
 		}
-		for _, pattern := range f.DeniedPatterns {
-			_, err := path.Match(pattern, "abc")
-			if err != nil {
-				return &ValidationError{err: fmt.Sprintf("invalid file pattern filter %#v", pattern)}
+		sort.Ints(weekDays)
+		f.TimeZone = strings.TrimSpace(f.TimeZone)
+		if f.TimeZone != "" {
+			if _, err := time.LoadLocation(f.TimeZone); err != nil {
+				return &ValidationError{field: "filters.access_times", err: fmt.Sprintf("invalid time zone %#v: %v", f.TimeZone, err)}
 			}
-			denied = append(denied, strings.ToLower(pattern))
 		}
-		f.AllowedPatterns = allowed
-		f.DeniedPatterns = denied
+		f.WeekDays = weekDays
+		f.Start = fmt.Sprintf("%02d:%02d", start/60, start%60)
+		f.End = fmt.Sprintf("%02d:%02d", end/60, end%60)
 		filters = append(filters, f)
-		filteredPaths = append(filteredPaths, cleanedPath)
 	}
-	user.Filters.FilePatterns = filters
+	user.Filters.AccessTimes = filters
 	return nil
 }
 
-func validateFiltersFileExtensions(user *User) error {
-	if len(user.Filters.FileExtensions) == 0 {
-		user.Filters.FileExtensions = []ExtensionsFilter{}
+// hasCommonWeekDays returns true if the given week days have at least a day in common,
+// an empty list means any day
+func hasCommonWeekDays(days1, days2 []int) bool {
+	if len(days1) == 0 || len(days2) == 0 {
+		return true
+	}
+	for _, day := range days1 {
+		if utils.IsIntInSlice(day, days2) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateFiltersTextTransforms(user *User) error {
+	if len(user.Filters.TextTransforms) == 0 {
+		user.Filters.TextTransforms = []TextTransformFilter{}
 		return nil
 	}
 	filteredPaths := []string{}
-	var filters []ExtensionsFilter
-	for _, f := range user.Filters.FileExtensions {
+	var filters []TextTransformFilter
+	for _, f := range user.Filters.TextTransforms {
 		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
 		if !path.IsAbs(cleanedPath) {
-			return &ValidationError{err: fmt.Sprintf("invalid path %#v for file extensions filter", f.Path)}
+			return &ValidationError{field: "filters.text_transforms", err: fmt.Sprintf("invalid path %#v for text transform", f.Path)}
 		}
 		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
-			return &ValidationError{err: fmt.Sprintf("duplicate file extensions filter for path %#v", f.Path)}
+			return &ValidationError{field: "filters.text_transforms", err: fmt.Sprintf("duplicate text transform for path %#v", f.Path)}
 		}
-		if len(f.AllowedExtensions) == 0 && len(f.DeniedExtensions) == 0 {
-			return &ValidationError{err: fmt.Sprintf("empty file extensions filter for path %#v", f.Path)}
+		if !vfs.IsValidTextLineEndings(f.LineEndings) {
+			return &ValidationError{field: "filters.text_transforms", err: fmt.Sprintf("invalid line endings %#v for path %#v", f.LineEndings, f.Path)}
 		}
-		f.Path = cleanedPath
-		allowed := make([]string, 0, len(f.AllowedExtensions))
-		denied := make([]string, 0, len(f.DeniedExtensions))
-		for _, ext := range f.AllowedExtensions {
-			allowed = append(allowed, strings.ToLower(ext))
+		if f.LineEndings == "" && !f.StripBOM {
+			return &ValidationError{field: "filters.text_transforms", err: fmt.Sprintf("no conversion defined for path %#v", f.Path)}
 		}
-		for _, ext := range f.DeniedExtensions {
-			denied = append(denied, strings.ToLower(ext))
+		var extensions []string
+		for _, ext := range f.Extensions {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext == "" {
+				continue
+			}
+			if !strings.HasPrefix(ext, ".") || strings.ContainsAny(ext, "/\\*?") {
+				return &ValidationError{field: "filters.text_transforms", err: fmt.Sprintf("invalid extension %#v for path %#v", ext, f.Path)}
+			}
+			extensions = append(extensions, ext)
 		}
-		f.AllowedExtensions = allowed
-		f.DeniedExtensions = denied
+		if len(extensions) == 0 {
+			return &ValidationError{field: "filters.text_transforms", err: fmt.Sprintf("no extensions defined for path %#v", f.Path)}
+		}
+		f.Path = cleanedPath
+		f.Extensions = utils.RemoveDuplicates(extensions)
 		filters = append(filters, f)
 		filteredPaths = append(filteredPaths, cleanedPath)
 	}
-	user.Filters.FileExtensions = filters
+	user.Filters.TextTransforms = filters
 	return nil
 }
 
-func validateFileFilters(user *User) error {
-	if err := validateFiltersFileExtensions(user); err != nil {
-		return err
+func validateFiltersMaxOpenFiles(user *User) error {
+	if user.Filters.MaxOpenFiles < 0 {
+		return &ValidationError{field: "filters.max_open_files", err: fmt.Sprintf("invalid max open files: %v", user.Filters.MaxOpenFiles)}
 	}
-	return validateFiltersPatternExtensions(user)
+	return nil
 }
 
-func validateFilters(user *User) error {
-	if len(user.Filters.AllowedIP) == 0 {
-		user.Filters.AllowedIP = []string{}
-	}
-	if len(user.Filters.DeniedIP) == 0 {
-		user.Filters.DeniedIP = []string{}
+func validateFiltersIdleTimeout(user *User) error {
+	if user.Filters.IdleTimeout < 0 {
+		return &ValidationError{field: "filters.idle_timeout", err: fmt.Sprintf("invalid idle timeout: %v", user.Filters.IdleTimeout)}
 	}
-	if len(user.Filters.DeniedLoginMethods) == 0 {
-		user.Filters.DeniedLoginMethods = []string{}
+	return nil
+}
+
+// getCompiledRegexp returns the compiled regular expression for the given pattern.
+// Each pattern is compiled once, the compiled expressions are cached
+func getCompiledRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := compiledRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
 	}
-	if len(user.Filters.DeniedProtocols) == 0 {
-		user.Filters.DeniedProtocols = []string{}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
 	}
-	for _, IPMask := range user.Filters.DeniedIP {
-		_, _, err := net.ParseCIDR(IPMask)
-		if err != nil {
-			return &ValidationError{err: fmt.Sprintf("could not parse denied IP/Mask %#v : %v", IPMask, err)}
+	compiledRegexps.Store(pattern, re)
+	return re, nil
+}
+
+func validateUploadNameRegex(patterns []string, field string) ([]string, error) {
+	var result []string
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			continue
 		}
-	}
-	for _, IPMask := range user.Filters.AllowedIP {
-		_, _, err := net.ParseCIDR(IPMask)
-		if err != nil {
-			return &ValidationError{err: fmt.Sprintf("could not parse allowed IP/Mask %#v : %v", IPMask, err)}
+		if _, err := getCompiledRegexp(pattern); err != nil {
+			return nil, &ValidationError{field: field, err: fmt.Sprintf("invalid upload name regexp %#v: %v", pattern, err)}
+		}
+		if !utils.IsStringInSlice(pattern, result) {
+			result = append(result, pattern)
 		}
 	}
-	if len(user.Filters.DeniedLoginMethods) >= len(ValidSSHLoginMethods) {
-		return &ValidationError{err: "invalid denied_login_methods"}
+	return result, nil
+}
+
+func validateFiltersUploadNameRegex(user *User) error {
+	allowed, err := validateUploadNameRegex(user.Filters.UploadNameAllowedRegex, "filters.upload_name_allowed_regex")
+	if err != nil {
+		return err
 	}
-	for _, loginMethod := range user.Filters.DeniedLoginMethods {
-		if !utils.IsStringInSlice(loginMethod, ValidSSHLoginMethods) {
-			return &ValidationError{err: fmt.Sprintf("invalid login method: %#v", loginMethod)}
-		}
+	denied, err := validateUploadNameRegex(user.Filters.UploadNameDeniedRegex, "filters.upload_name_denied_regex")
+	if err != nil {
+		return err
 	}
-	if len(user.Filters.DeniedProtocols) >= len(ValidProtocols) {
-		return &ValidationError{err: "invalid denied_protocols"}
+	user.Filters.UploadNameAllowedRegex = allowed
+	user.Filters.UploadNameDeniedRegex = denied
+	return nil
+}
+
+func validateFiltersConcurrentTransfers(user *User) error {
+	if user.Filters.MaxConcurrentUploads < 0 {
+		return &ValidationError{field: "filters.max_concurrent_uploads",
+			err: fmt.Sprintf("invalid max concurrent uploads: %v", user.Filters.MaxConcurrentUploads)}
 	}
-	for _, p := range user.Filters.DeniedProtocols {
-		if !utils.IsStringInSlice(p, ValidProtocols) {
-			return &ValidationError{err: fmt.Sprintf("invalid protocol: %#v", p)}
-		}
+	if user.Filters.MaxConcurrentDownloads < 0 {
+		return &ValidationError{field: "filters.max_concurrent_downloads",
+			err: fmt.Sprintf("invalid max concurrent downloads: %v", user.Filters.MaxConcurrentDownloads)}
 	}
-	return validateFileFilters(user)
+	return nil
+}
+
+func validateFiltersDownloadVolume(user *User) error {
+	if user.Filters.DownloadVolumeLimit < 0 {
+		return &ValidationError{field: "filters.download_volume_limit", err: fmt.Sprintf("invalid download volume limit: %v", user.Filters.DownloadVolumeLimit)}
+	}
+	if user.Filters.DownloadVolumeLimit == 0 {
+		user.Filters.DownloadVolumePeriod = ""
+		return nil
+	}
+	switch user.Filters.DownloadVolumePeriod {
+	case "":
+		user.Filters.DownloadVolumePeriod = DownloadVolumePeriodDay
+	case DownloadVolumePeriodDay, DownloadVolumePeriodMonth:
+	default:
+		return &ValidationError{field: "filters.download_volume_period", err: fmt.Sprintf("invalid download volume period: %#v", user.Filters.DownloadVolumePeriod)}
+	}
+	return nil
 }
 
 func saveGCSCredentials(user *User) error {
@@ -1085,80 +2423,207 @@ func saveGCSCredentials(user *User) error {
 		user.FsConfig.GCSConfig.Credentials.AdditionalData = user.Username
 		err := user.FsConfig.GCSConfig.Credentials.Encrypt()
 		if err != nil {
-			return &ValidationError{err: fmt.Sprintf("could not encrypt GCS credentials: %v", err)}
+			return &ValidationError{field: "filesystem.gcsconfig.credentials", err: fmt.Sprintf("could not encrypt GCS credentials: %v", err)}
 		}
 	}
 	creds, err := json.Marshal(user.FsConfig.GCSConfig.Credentials)
 	if err != nil {
-		return &ValidationError{err: fmt.Sprintf("could not marshal GCS credentials: %v", err)}
+		return &ValidationError{field: "filesystem.gcsconfig.credentials", err: fmt.Sprintf("could not marshal GCS credentials: %v", err)}
 	}
 	err = ioutil.WriteFile(user.getGCSCredentialsFilePath(), creds, 0600)
 	if err != nil {
-		return &ValidationError{err: fmt.Sprintf("could not save GCS credentials: %v", err)}
+		return &ValidationError{field: "filesystem.gcsconfig.credentials", err: fmt.Sprintf("could not save GCS credentials: %v", err)}
 	}
 	user.FsConfig.GCSConfig.Credentials = vfs.Secret{}
 	return nil
 }
 
+func validateHomeMarker(user *User, keyPrefix string) error {
+	if !vfs.IsValidHomeMarkerMode(user.FsConfig.HomeMarker) {
+		return &ValidationError{field: "filesystem.home_marker", err: fmt.Sprintf("invalid home marker mode: %v", user.FsConfig.HomeMarker)}
+	}
+	if user.FsConfig.HomeMarker != vfs.HomeMarkerDisabled && keyPrefix == "" {
+		return &ValidationError{field: "filesystem.home_marker", err: "the home marker requires a key prefix"}
+	}
+	return nil
+}
+
 func validateFilesystemConfig(user *User) error {
+	if err := vfs.ValidateCompressionConfig(&user.FsConfig.Compression); err != nil {
+		return &ValidationError{field: "filesystem.compression", err: fmt.Sprintf("could not validate compression config: %v", err)}
+	}
+	if err := vfs.ValidateCacheConfig(&user.FsConfig.Cache); err != nil {
+		return &ValidationError{field: "filesystem.cache", err: fmt.Sprintf("could not validate cache config: %v", err)}
+	}
 	if user.FsConfig.Provider == S3FilesystemProvider {
 		err := vfs.ValidateS3FsConfig(&user.FsConfig.S3Config)
 		if err != nil {
-			return &ValidationError{err: fmt.Sprintf("could not validate s3config: %v", err)}
+			return &ValidationError{field: "filesystem.s3config", err: fmt.Sprintf("could not validate s3config: %v", err)}
 		}
 		if user.FsConfig.S3Config.AccessSecret.IsPlain() {
 			user.FsConfig.S3Config.AccessSecret.AdditionalData = user.Username
 			err = user.FsConfig.S3Config.AccessSecret.Encrypt()
 			if err != nil {
-				return &ValidationError{err: fmt.Sprintf("could not encrypt s3 access secret: %v", err)}
+				return &ValidationError{field: "filesystem.s3config.access_secret", err: fmt.Sprintf("could not encrypt s3 access secret: %v", err)}
+			}
+		}
+		if user.FsConfig.S3Config.SSECustomerKey.IsPlain() {
+			user.FsConfig.S3Config.SSECustomerKey.AdditionalData = user.Username
+			err = user.FsConfig.S3Config.SSECustomerKey.Encrypt()
+			if err != nil {
+				return &ValidationError{field: "filesystem.s3config.sse_customer_key", err: fmt.Sprintf("could not encrypt s3 SSE-C key: %v", err)}
 			}
 		}
 		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
 		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
-		return nil
+		user.FsConfig.B2Config = vfs.B2FsConfig{}
+		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+		user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+		return validateHomeMarker(user, user.FsConfig.S3Config.KeyPrefix)
 	} else if user.FsConfig.Provider == GCSFilesystemProvider {
 		err := vfs.ValidateGCSFsConfig(&user.FsConfig.GCSConfig, user.getGCSCredentialsFilePath())
 		if err != nil {
-			return &ValidationError{err: fmt.Sprintf("could not validate GCS config: %v", err)}
+			return &ValidationError{field: "filesystem.gcsconfig", err: fmt.Sprintf("could not validate GCS config: %v", err)}
 		}
 		user.FsConfig.S3Config = vfs.S3FsConfig{}
 		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
-		return nil
+		user.FsConfig.B2Config = vfs.B2FsConfig{}
+		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+		user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+		return validateHomeMarker(user, user.FsConfig.GCSConfig.KeyPrefix)
 	} else if user.FsConfig.Provider == AzureBlobFilesystemProvider {
 		err := vfs.ValidateAzBlobFsConfig(&user.FsConfig.AzBlobConfig)
 		if err != nil {
-			return &ValidationError{err: fmt.Sprintf("could not validate Azure Blob config: %v", err)}
+			return &ValidationError{field: "filesystem.azblobconfig", err: fmt.Sprintf("could not validate Azure Blob config: %v", err)}
 		}
 		if user.FsConfig.AzBlobConfig.AccountKey.IsPlain() {
 			user.FsConfig.AzBlobConfig.AccountKey.AdditionalData = user.Username
 			err = user.FsConfig.AzBlobConfig.AccountKey.Encrypt()
 			if err != nil {
-				return &ValidationError{err: fmt.Sprintf("could not encrypt Azure blob account key: %v", err)}
+				return &ValidationError{field: "filesystem.azblobconfig.account_key", err: fmt.Sprintf("could not encrypt Azure blob account key: %v", err)}
 			}
 		}
 		user.FsConfig.S3Config = vfs.S3FsConfig{}
 		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
-		return nil
+		user.FsConfig.B2Config = vfs.B2FsConfig{}
+		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+		user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+		return validateHomeMarker(user, user.FsConfig.AzBlobConfig.KeyPrefix)
+	} else if user.FsConfig.Provider == B2FilesystemProvider {
+		err := vfs.ValidateB2FsConfig(&user.FsConfig.B2Config)
+		if err != nil {
+			return &ValidationError{field: "filesystem.b2config", err: fmt.Sprintf("could not validate B2 config: %v", err)}
+		}
+		if user.FsConfig.B2Config.ApplicationKey.IsPlain() {
+			user.FsConfig.B2Config.ApplicationKey.AdditionalData = user.Username
+			err = user.FsConfig.B2Config.ApplicationKey.Encrypt()
+			if err != nil {
+				return &ValidationError{field: "filesystem.b2config.application_key", err: fmt.Sprintf("could not encrypt B2 application key: %v", err)}
+			}
+		}
+		user.FsConfig.S3Config = vfs.S3FsConfig{}
+		user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+		user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+		user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+		user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+		return validateHomeMarker(user, user.FsConfig.B2Config.KeyPrefix)
+	} else if user.FsConfig.Provider == SFTPFilesystemProvider {
+		return validateSFTPFsConfig(user)
+	} else if user.FsConfig.Provider == CryptedFilesystemProvider {
+		return validateCryptFsConfig(user)
 	}
 	user.FsConfig.Provider = LocalFilesystemProvider
+	// compression at rest, local cache and home marker are supported for Cloud Storage backends only
+	user.FsConfig.Compression = vfs.CompressionConfig{}
+	user.FsConfig.Cache = vfs.CacheConfig{}
+	user.FsConfig.HomeMarker = vfs.HomeMarkerDisabled
+	user.FsConfig.S3Config = vfs.S3FsConfig{}
+	user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+	user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+	user.FsConfig.B2Config = vfs.B2FsConfig{}
+	user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+	user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+	return nil
+}
+
+func validateCryptFsConfig(user *User) error {
+	err := vfs.ValidateCryptFsConfig(&user.FsConfig.CryptConfig)
+	if err != nil {
+		return &ValidationError{field: "filesystem.cryptconfig", err: fmt.Sprintf("could not validate crypt fs config: %v", err)}
+	}
+	if user.FsConfig.CryptConfig.Passphrase.IsPlain() {
+		user.FsConfig.CryptConfig.Passphrase.AdditionalData = user.Username
+		err = user.FsConfig.CryptConfig.Passphrase.Encrypt()
+		if err != nil {
+			return &ValidationError{field: "filesystem.cryptconfig.passphrase", err: fmt.Sprintf("could not encrypt passphrase: %v", err)}
+		}
+	}
+	// compression at rest, local cache and home marker are supported for Cloud Storage backends only
+	user.FsConfig.Compression = vfs.CompressionConfig{}
+	user.FsConfig.Cache = vfs.CacheConfig{}
+	user.FsConfig.HomeMarker = vfs.HomeMarkerDisabled
+	user.FsConfig.S3Config = vfs.S3FsConfig{}
+	user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+	user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+	user.FsConfig.B2Config = vfs.B2FsConfig{}
+	user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+	return nil
+}
+
+func validateSFTPFsConfig(user *User) error {
+	err := vfs.ValidateSFTPFsConfig(&user.FsConfig.SFTPConfig)
+	if err != nil {
+		return &ValidationError{field: "filesystem.sftpconfig", err: fmt.Sprintf("could not validate SFTP config: %v", err)}
+	}
+	if user.FsConfig.SFTPConfig.Password.IsPlain() {
+		user.FsConfig.SFTPConfig.Password.AdditionalData = user.Username
+		err = user.FsConfig.SFTPConfig.Password.Encrypt()
+		if err != nil {
+			return &ValidationError{field: "filesystem.sftpconfig.password", err: fmt.Sprintf("could not encrypt SFTP password: %v", err)}
+		}
+	}
+	if user.FsConfig.SFTPConfig.PrivateKey.IsPlain() {
+		if _, err = ssh.ParsePrivateKey([]byte(user.FsConfig.SFTPConfig.PrivateKey.Payload)); err != nil {
+			return &ValidationError{field: "filesystem.sftpconfig.private_key", err: fmt.Sprintf("invalid SFTP private key: %v", err)}
+		}
+		user.FsConfig.SFTPConfig.PrivateKey.AdditionalData = user.Username
+		err = user.FsConfig.SFTPConfig.PrivateKey.Encrypt()
+		if err != nil {
+			return &ValidationError{field: "filesystem.sftpconfig.private_key", err: fmt.Sprintf("could not encrypt SFTP private key: %v", err)}
+		}
+	}
+	// compression at rest, local cache and home marker are supported for Cloud Storage backends only
+	user.FsConfig.Compression = vfs.CompressionConfig{}
+	user.FsConfig.Cache = vfs.CacheConfig{}
+	user.FsConfig.HomeMarker = vfs.HomeMarkerDisabled
 	user.FsConfig.S3Config = vfs.S3FsConfig{}
 	user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
 	user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+	user.FsConfig.B2Config = vfs.B2FsConfig{}
+	user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
 	return nil
 }
 
 func validateBaseParams(user *User) error {
 	if user.Username == "" {
-		return &ValidationError{err: "username is mandatory"}
+		return &ValidationError{field: "username", err: "username is mandatory"}
 	}
 	if user.HomeDir == "" {
-		return &ValidationError{err: "home_dir is mandatory"}
+		return &ValidationError{field: "home_dir", err: "home_dir is mandatory"}
 	}
 	if user.Password == "" && len(user.PublicKeys) == 0 {
-		return &ValidationError{err: "please set a password or at least a public_key"}
+		return &ValidationError{field: "password", err: "please set a password or at least a public_key"}
+	}
+	if vfs.HasMixedSeparators(user.HomeDir) {
+		return &ValidationError{field: "home_dir", err: fmt.Sprintf("home_dir cannot mix \"/\" and \"\\\" separators, actual value: %v",
+			user.HomeDir)}
 	}
+	user.HomeDir = vfs.ToOSPath(user.HomeDir)
 	if !filepath.IsAbs(user.HomeDir) {
-		return &ValidationError{err: fmt.Sprintf("home_dir must be an absolute path, actual value: %v", user.HomeDir)}
+		return &ValidationError{field: "home_dir", err: fmt.Sprintf("home_dir must be an absolute path, actual value: %v", user.HomeDir)}
+	}
+	if err := user.checkResolvedPath(user.HomeDir); err != nil {
+		return &ValidationError{field: "home_dir", err: err.Error()}
 	}
 	return nil
 }
@@ -1175,19 +2640,52 @@ func createUserPasswordHash(user *User) error {
 }
 
 func validateFolder(folder *vfs.BaseVirtualFolder) error {
-	cleanedMPath := filepath.Clean(folder.MappedPath)
+	if vfs.HasMixedSeparators(folder.MappedPath) {
+		return &ValidationError{field: "mapped_path", err: fmt.Sprintf("mapped folder %#v cannot mix \"/\" and \"\\\" separators",
+			folder.MappedPath)}
+	}
+	cleanedMPath := vfs.ToOSPath(folder.MappedPath)
 	if !filepath.IsAbs(cleanedMPath) {
-		return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v", folder.MappedPath)}
+		return &ValidationError{field: "mapped_path", err: fmt.Sprintf("invalid mapped folder %#v", folder.MappedPath)}
 	}
 	folder.MappedPath = cleanedMPath
+	return validateMetadata(folder.Metadata)
+}
+
+func validateMetadata(metadata map[string]string) error {
+	for k, v := range metadata {
+		if k == "" || strings.TrimSpace(k) != k || len(k) > 255 {
+			return &ValidationError{field: "metadata", err: fmt.Sprintf("invalid metadata key %#v", k)}
+		}
+		if len(config.MetadataKeys) > 0 && !utils.IsStringInSlice(k, config.MetadataKeys) {
+			return &ValidationError{field: "metadata", err: fmt.Sprintf("metadata key %#v is not allowed", k)}
+		}
+		if len(v) > 1024 {
+			return &ValidationError{field: "metadata", err: fmt.Sprintf("value too long for metadata key %#v", k)}
+		}
+	}
 	return nil
 }
 
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	result := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		result[k] = v
+	}
+	return result
+}
+
 func validateUser(user *User) error {
 	buildUserHomeDir(user)
 	if err := validateBaseParams(user); err != nil {
 		return err
 	}
+	if err := validateUserGroups(user); err != nil {
+		return err
+	}
 	if err := validatePermissions(user); err != nil {
 		return err
 	}
@@ -1198,7 +2696,10 @@ func validateUser(user *User) error {
 		return err
 	}
 	if user.Status < 0 || user.Status > 1 {
-		return &ValidationError{err: fmt.Sprintf("invalid user status: %v", user.Status)}
+		return &ValidationError{field: "status", err: fmt.Sprintf("invalid user status: %v", user.Status)}
+	}
+	if user.AuthBackend != "" && user.AuthBackend != AuthBackendExternalHook && user.AuthBackend != AuthBackendLDAP {
+		return &ValidationError{field: "auth_backend", err: fmt.Sprintf("invalid auth backend: %#v", user.AuthBackend)}
 	}
 	if err := createUserPasswordHash(user); err != nil {
 		return err
@@ -1209,6 +2710,12 @@ func validateUser(user *User) error {
 	if err := validateFilters(user); err != nil {
 		return err
 	}
+	if err := validateUserTOTPConfig(user); err != nil {
+		return err
+	}
+	if err := validateMetadata(user.Metadata); err != nil {
+		return err
+	}
 	if err := saveGCSCredentials(user); err != nil {
 		return err
 	}
@@ -1223,6 +2730,14 @@ func checkLoginConditions(user User) error {
 		return fmt.Errorf("user %#v is expired, expiration timestamp: %v current timestamp: %v", user.Username,
 			user.ExpirationDate, utils.GetTimeAsMsSinceEpoch(time.Now()))
 	}
+	return checkAccessTimes(&user)
+}
+
+func checkAccessTimes(user *User) error {
+	if !user.IsAccessTimeAllowed(time.Now()) {
+		return fmt.Errorf("user %#v is not allowed to login at this time, login is only allowed within the configured access times",
+			user.Username)
+	}
 	return nil
 }
 
@@ -1260,6 +2775,17 @@ func checkUserAndPass(user User, password, ip, protocol string) (User, error) {
 	if err != nil {
 		return user, err
 	}
+	// for SSH the TOTP code is requested using keyboard interactive authentication,
+	// the other protocols cannot ask for it so it must be appended to the password
+	if protocol != "SSH" && user.IsTOTPRequired(protocol) {
+		return checkUserPasswordAndTOTP(user, password, func(password string) (User, error) {
+			return checkUserPassword(user, password, ip, protocol)
+		})
+	}
+	return checkUserPassword(user, password, ip, protocol)
+}
+
+func checkUserPassword(user User, password, ip, protocol string) (User, error) {
 	if len(user.Password) == 0 {
 		return user, errors.New("Credentials cannot be null or empty")
 	}
@@ -1430,6 +2956,77 @@ func startAvailabilityTimer() {
 	}()
 }
 
+func startExpirationWarningTimer() {
+	if config.ExpirationWarningDays <= 0 || !utils.IsStringInSlice(operationExpirationWarn, config.Actions.ExecuteOn) {
+		return
+	}
+	expirationTicker = time.NewTicker(1 * time.Hour)
+	expirationTickerDone = make(chan bool)
+	go func() {
+		checkUsersExpiration()
+		for {
+			select {
+			case <-expirationTickerDone:
+				return
+			case <-expirationTicker.C:
+				checkUsersExpiration()
+			}
+		}
+	}()
+}
+
+// checkUsersExpiration fires the expiration warning action for the users
+// expiring within the configured number of days.
+// The action is fired only once for each expiration date, the expiration date
+// for which the warning was fired is stored in the data provider, so restarts
+// and other instances sharing the same data provider will not fire it again.
+// If the expiration date is changed, for example the account is renewed, a new
+// warning will be fired when the new expiration date approaches
+func checkUsersExpiration() {
+	now := utils.GetTimeAsMsSinceEpoch(time.Now())
+	warningTime := now + int64(config.ExpirationWarningDays)*24*3600*1000
+	limit := 100
+	offset := 0
+	for {
+		users, err := provider.getUsers(limit, offset, OrderASC, "", MetadataFilter{})
+		if err != nil {
+			providerLog(logger.LevelWarn, "unable to get users to check for expiration: %v", err)
+			return
+		}
+		for _, user := range users {
+			if !isUserExpiring(&user, now, warningTime) {
+				continue
+			}
+			if user.LastExpirationWarning == user.ExpirationDate {
+				continue
+			}
+			updated, err := provider.updateLastExpirationWarning(user.Username, user.ExpirationDate)
+			if err != nil {
+				providerLog(logger.LevelWarn, "unable to store the expiration warning for user %#v: %v", user.Username, err)
+				continue
+			}
+			if !updated {
+				// already fired by another instance
+				continue
+			}
+			providerLog(logger.LevelInfo, "user %#v will expire at %v, firing expiration warning",
+				user.Username, utils.GetTimeFromMsecSinceEpoch(user.ExpirationDate))
+			go executeAction(operationExpirationWarn, user)
+		}
+		if len(users) < limit {
+			return
+		}
+		offset += limit
+	}
+}
+
+func isUserExpiring(user *User, now, warningTime int64) bool {
+	if user.ExpirationDate <= 0 {
+		return false
+	}
+	return user.ExpirationDate > now && user.ExpirationDate <= warningTime
+}
+
 func validateCredentialsDir(basePath string, preferDbCredentials bool) error {
 	if filepath.IsAbs(config.CredentialsPath) {
 		credentialsDirPath = config.CredentialsPath
@@ -1475,16 +3072,30 @@ func terminateInteractiveAuthProgram(cmd *exec.Cmd, isFinished bool) {
 }
 
 func validateKeyboardAuthResponse(response keyboardAuthHookResponse) error {
-	if len(response.Questions) == 0 {
-		err := errors.New("interactive auth error: hook response does not contain questions")
-		providerLog(logger.LevelInfo, "%v", err)
-		return err
+	if len(response.Rounds) > 0 {
+		if len(response.Questions) > 0 {
+			err := errors.New("interactive auth error: hook response cannot contain both questions and rounds")
+			providerLog(logger.LevelInfo, "%v", err)
+			return err
+		}
+		if response.CheckPwd > 0 {
+			err := errors.New("interactive auth error: password check is not supported for hook responses with rounds")
+			providerLog(logger.LevelInfo, "%v", err)
+			return err
+		}
 	}
-	if len(response.Questions) != len(response.Echos) {
-		err := fmt.Errorf("interactive auth error, http hook response questions don't match echos: %v %v",
-			len(response.Questions), len(response.Echos))
-		providerLog(logger.LevelInfo, "%v", err)
-		return err
+	for idx, round := range response.getRounds() {
+		if len(round.Questions) == 0 {
+			err := fmt.Errorf("interactive auth error: hook response does not contain questions for round %v", idx+1)
+			providerLog(logger.LevelInfo, "%v", err)
+			return err
+		}
+		if len(round.Questions) != len(round.Echos) {
+			err := fmt.Errorf("interactive auth error, hook response questions don't match echos for round %v: %v %v",
+				idx+1, len(round.Questions), len(round.Echos))
+			providerLog(logger.LevelInfo, "%v", err)
+			return err
+		}
 	}
 	return nil
 }
@@ -1546,24 +3157,28 @@ func executeKeyboardInteractiveHTTPHook(user User, authHook string, client ssh.K
 			Username:  user.Username,
 			Password:  user.Password,
 			Answers:   answers,
-			Questions: response.Questions,
+			Questions: response.getQuestions(),
 		}
 	}
 }
 
 func getKeyboardInteractiveAnswers(client ssh.KeyboardInteractiveChallenge, response keyboardAuthHookResponse,
 	user User, ip, protocol string) ([]string, error) {
-	questions := response.Questions
-	answers, err := client(user.Username, response.Instruction, questions, response.Echos)
-	if err != nil {
-		providerLog(logger.LevelInfo, "error getting interactive auth client response: %v", err)
-		return answers, err
-	}
-	if len(answers) != len(questions) {
-		err = fmt.Errorf("client answers does not match questions, expected: %v actual: %v", questions, answers)
-		providerLog(logger.LevelInfo, "keyboard interactive auth error: %v", err)
-		return answers, err
+	var answers []string
+	for _, round := range response.getRounds() {
+		roundAnswers, err := client(user.Username, round.Instruction, round.Questions, round.Echos)
+		if err != nil {
+			providerLog(logger.LevelInfo, "error getting interactive auth client response: %v", err)
+			return answers, err
+		}
+		if len(roundAnswers) != len(round.Questions) {
+			err = fmt.Errorf("client answers does not match questions, expected: %v actual: %v", round.Questions, roundAnswers)
+			providerLog(logger.LevelInfo, "keyboard interactive auth error: %v", err)
+			return answers, err
+		}
+		answers = append(answers, roundAnswers...)
 	}
+	var err error
 	if len(answers) == 1 && response.CheckPwd > 0 {
 		_, err = checkUserAndPass(user, answers[0], ip, protocol)
 		providerLog(logger.LevelInfo, "interactive auth hook requested password validation for user %#v, validation error: %v",
@@ -1795,7 +3410,12 @@ func getPreLoginHookResponse(loginMethod, ip, protocol string, userAsJSON []byte
 }
 
 func executePreLoginHook(username, loginMethod, ip, protocol string) (User, error) {
-	u, err := provider.userExists(username)
+	var u User
+	err := executeLoginLookup(username, func() error {
+		var err error
+		u, err = provider.userExists(username)
+		return err
+	})
 	if err != nil {
 		if _, ok := err.(*RecordNotFoundError); !ok {
 			return u, err
@@ -1827,6 +3447,12 @@ func executePreLoginHook(username, loginMethod, ip, protocol string) (User, erro
 	userUsedQuotaFiles := u.UsedQuotaFiles
 	userLastQuotaUpdate := u.LastQuotaUpdate
 	userLastLogin := u.LastLogin
+	userUsedDownloadVolume := u.UsedDownloadVolume
+	userDownloadVolumePeriodStart := u.DownloadVolumePeriodStart
+	userLastExpirationWarning := u.LastExpirationWarning
+	userLoginFailures := u.getLoginFailures()
+	userLastTOTPStep := u.LastTOTPStep
+	userAuthBackend := u.AuthBackend
 	err = json.Unmarshal(out, &u)
 	if err != nil {
 		return u, fmt.Errorf("Invalid pre-login hook response %#v, error: %v", string(out), err)
@@ -1836,6 +3462,12 @@ func executePreLoginHook(username, loginMethod, ip, protocol string) (User, erro
 	u.UsedQuotaFiles = userUsedQuotaFiles
 	u.LastQuotaUpdate = userLastQuotaUpdate
 	u.LastLogin = userLastLogin
+	u.UsedDownloadVolume = userUsedDownloadVolume
+	u.DownloadVolumePeriodStart = userDownloadVolumePeriodStart
+	u.LastExpirationWarning = userLastExpirationWarning
+	u.setLoginFailures(userLoginFailures)
+	u.LastTOTPStep = userLastTOTPStep
+	u.AuthBackend = userAuthBackend
 	if userID == 0 {
 		err = provider.addUser(u)
 	} else {
@@ -1885,13 +3517,7 @@ func ExecutePostLoginHook(username, loginMethod, ip, protocol string, err error)
 				return
 			}
 			startTime := time.Now()
-			respCode := 0
-			httpClient := httpclient.GetHTTPClient()
-			resp, err := httpClient.Post(url.String(), "application/json", bytes.NewBuffer(postAsJSON))
-			if err == nil {
-				respCode = resp.StatusCode
-				resp.Body.Close()
-			}
+			respCode, err := httpclient.PostJSON(logSender, url.String(), postAsJSON)
 			providerLog(logger.LevelDebug, "post login hook executed, response code: %v, elapsed: %v err: %v",
 				respCode, time.Since(startTime), err)
 			return
@@ -1976,8 +3602,13 @@ func doExternalAuth(username, password string, pubKey []byte, keyboardInteractiv
 		return user, fmt.Errorf("Invalid external auth response: %v", err)
 	}
 	if len(user.Username) == 0 {
+		var resp externalAuthResponse
+		if err = json.Unmarshal(out, &resp); err == nil && resp.Decline {
+			return user, &RecordNotFoundError{err: fmt.Sprintf("username %#v declined by the external auth hook", username)}
+		}
 		return user, ErrInvalidCredentials
 	}
+	user.AuthBackend = AuthBackendExternalHook
 	if len(password) > 0 {
 		user.Password = password
 	}
@@ -1988,13 +3619,23 @@ func doExternalAuth(username, password string, pubKey []byte, keyboardInteractiv
 	// for example an SFTP user logins using "user1" or "user2" and the external auth
 	// returns "user" in both cases, so we use the username returned from
 	// external auth and not the one used to login
-	u, err := provider.userExists(user.Username)
+	var u User
+	err = executeLoginLookup(user.Username, func() error {
+		var err error
+		u, err = provider.userExists(user.Username)
+		return err
+	})
 	if err == nil {
 		user.ID = u.ID
 		user.UsedQuotaSize = u.UsedQuotaSize
 		user.UsedQuotaFiles = u.UsedQuotaFiles
 		user.LastQuotaUpdate = u.LastQuotaUpdate
 		user.LastLogin = u.LastLogin
+		user.UsedDownloadVolume = u.UsedDownloadVolume
+		user.DownloadVolumePeriodStart = u.DownloadVolumePeriodStart
+		user.LastExpirationWarning = u.LastExpirationWarning
+		user.setLoginFailures(u.getLoginFailures())
+		user.LastTOTPStep = u.LastTOTPStep
 		err = provider.updateUser(user)
 	} else {
 		err = provider.addUser(user)
@@ -2009,7 +3650,7 @@ func providerLog(level logger.LogLevel, format string, v ...interface{}) {
 	logger.Log(level, logSender, "", format, v...)
 }
 
-func executeNotificationCommand(operation string, user User) error {
+func executeNotificationCommand(operation string, user User, params map[string]string) error {
 	if !filepath.IsAbs(config.Actions.Hook) {
 		err := fmt.Errorf("invalid notification command %#v", config.Actions.Hook)
 		logger.Warn(logSender, "", "unable to execute notification command: %v", err)
@@ -2020,6 +3661,9 @@ func executeNotificationCommand(operation string, user User) error {
 	commandArgs := user.getNotificationFieldsAsSlice(operation)
 	cmd := exec.CommandContext(ctx, config.Actions.Hook, commandArgs...)
 	cmd.Env = append(os.Environ(), user.getNotificationFieldsAsEnvVars(operation)...)
+	for key, value := range params {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SFTPGO_USER_%v=%v", strings.ToUpper(key), value))
+	}
 	startTime := time.Now()
 	err := cmd.Run()
 	providerLog(logger.LevelDebug, "executed command %#v with arguments: %+v, elapsed: %v, error: %v",
@@ -2029,6 +3673,12 @@ func executeNotificationCommand(operation string, user User) error {
 
 // executed in a goroutine
 func executeAction(operation string, user User) {
+	executeActionWithParams(operation, user, nil)
+}
+
+// executeActionWithParams executes the action for the given operation, the params are
+// added to the query string for HTTP hooks and to the environment for external programs
+func executeActionWithParams(operation string, user User, params map[string]string) {
 	if !utils.IsStringInSlice(operation, config.Actions.ExecuteOn) {
 		return
 	}
@@ -2052,6 +3702,9 @@ func executeAction(operation string, user User) {
 		}
 		q := url.Query()
 		q.Add("action", operation)
+		for key, value := range params {
+			q.Add(key, value)
+		}
 		url.RawQuery = q.Encode()
 		user.HideConfidentialData()
 		userAsJSON, err := json.Marshal(user)
@@ -2069,7 +3722,7 @@ func executeAction(operation string, user User) {
 		providerLog(logger.LevelDebug, "notified operation %#v to URL: %v status code: %v, elapsed: %v err: %v",
 			operation, url.String(), respCode, time.Since(startTime), err)
 	} else {
-		executeNotificationCommand(operation, user) //nolint:errcheck // the error is used in test cases only
+		executeNotificationCommand(operation, user, params) //nolint:errcheck // the error is used in test cases only
 	}
 }
 
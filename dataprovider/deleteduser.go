@@ -0,0 +1,134 @@
+package dataprovider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// DeletedUser defines a soft deleted user.
+// The full user configuration, including filters, virtual folders and
+// filesystem config, is preserved so the user can be restored until the
+// configured retention period expires
+type DeletedUser struct {
+	// deletion time as unix timestamp in milliseconds
+	DeletedAt int64 `json:"deleted_at"`
+	// the user as it was when it was deleted
+	User User `json:"user"`
+}
+
+// HideConfidentialData hides the confidential data for the deleted user
+func (d *DeletedUser) HideConfidentialData() {
+	d.User.HideConfidentialData()
+}
+
+func (d *DeletedUser) getACopy() DeletedUser {
+	return DeletedUser{
+		DeletedAt: d.DeletedAt,
+		User:      d.User.getACopy(),
+	}
+}
+
+// softDeleteUser moves the user with the same username of the given one to
+// the deleted users, the user is reloaded to preserve its relations
+func softDeleteUser(user User) error {
+	u, err := provider.userExists(user.Username)
+	if err != nil {
+		return err
+	}
+	if err = addCredentialsToUser(&u); err != nil {
+		providerLog(logger.LevelWarn, "unable to add credentials to the deleted user %#v: %v", u.Username, err)
+	}
+	return provider.softDeleteUser(u)
+}
+
+// GetDeletedUsers returns an array of soft deleted users respecting limit and
+// offset and filtered by username exact match if not empty
+func GetDeletedUsers(limit, offset int, order, username string) ([]DeletedUser, error) {
+	return provider.getDeletedUsers(limit, offset, order, username)
+}
+
+// DeletedUserExists returns the soft deleted user with the given username
+// if a match is found or an error
+func DeletedUserExists(username string) (DeletedUser, error) {
+	return provider.deletedUserExists(username)
+}
+
+// RestoreDeletedUser restores the soft deleted user with the given username.
+// The restore fails if a user with the same username was added in the meantime.
+// ManageUsers configuration must be set to 1 to enable this method
+func RestoreDeletedUser(username string) (User, error) {
+	if config.ManageUsers == 0 {
+		return User{}, &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	deletedUser, err := provider.deletedUserExists(username)
+	if err != nil {
+		return User{}, err
+	}
+	if _, err = provider.userExists(username); err == nil {
+		return User{}, &ValidationError{err: fmt.Sprintf("unable to restore user %#v: a user with the same username already exists",
+			username)}
+	}
+	user := deletedUser.User
+	if err = AddUser(user); err != nil {
+		return User{}, err
+	}
+	if user.UsedQuotaFiles > 0 || user.UsedQuotaSize > 0 {
+		// the user files are not removed when a user is deleted
+		if err = provider.updateQuota(username, user.UsedQuotaFiles, user.UsedQuotaSize, true); err != nil {
+			providerLog(logger.LevelWarn, "unable to restore the used quota for user %#v: %v", username, err)
+		}
+	}
+	if err = provider.purgeDeletedUser(username); err != nil {
+		providerLog(logger.LevelWarn, "unable to remove the restored user %#v from the deleted users: %v", username, err)
+	}
+	return provider.userExists(username)
+}
+
+// PurgeDeletedUser permanently removes the soft deleted user with the given username.
+// ManageUsers configuration must be set to 1 to enable this method
+func PurgeDeletedUser(username string) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	if _, err := provider.deletedUserExists(username); err != nil {
+		return err
+	}
+	return provider.purgeDeletedUser(username)
+}
+
+func startDeletedUsersPurgeTimer() {
+	if config.DeletedUsersRetention <= 0 {
+		return
+	}
+	deletedUsersTicker = time.NewTicker(1 * time.Hour)
+	deletedUsersTickerDone = make(chan bool)
+	go func() {
+		purgeExpiredDeletedUsers()
+		for {
+			select {
+			case <-deletedUsersTickerDone:
+				return
+			case <-deletedUsersTicker.C:
+				purgeExpiredDeletedUsers()
+			}
+		}
+	}()
+}
+
+// purgeExpiredDeletedUsers permanently removes the users deleted before the
+// configured retention period
+func purgeExpiredDeletedUsers() {
+	retention := time.Duration(config.DeletedUsersRetention) * time.Hour
+	before := utils.GetTimeAsMsSinceEpoch(time.Now().Add(-retention))
+	purged, err := provider.purgeDeletedUsers(before)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to purge the expired deleted users: %v", err)
+		return
+	}
+	if purged > 0 {
+		providerLog(logger.LevelInfo, "expired deleted users purged: %v", purged)
+	}
+}
@@ -0,0 +1,317 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+// Group defines a set of settings shared by its members.
+// At login time the settings not defined for a user are inherited from the groups
+// the user is member of: the user settings always win and the groups are applied
+// in membership order, so the first group defining a setting wins over the next ones
+type Group struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Group name, it must be unique
+	Name string `json:"name"`
+	// optional description, SFTPGo stores it but never interprets it
+	Description string `json:"description,omitempty"`
+	// Permissions per directory. They are inherited for the directories that
+	// have no permissions defined at user level
+	Permissions map[string][]string `json:"permissions,omitempty"`
+	// Quota and bandwidth limits, they are inherited by the members that have
+	// no limits defined, 0 means not defined
+	QuotaSize         int64 `json:"quota_size"`
+	QuotaFiles        int   `json:"quota_files"`
+	UploadBandwidth   int64 `json:"upload_bandwidth"`
+	DownloadBandwidth int64 `json:"download_bandwidth"`
+	// Filters, each filter not defined for the user is inherited.
+	// The TOTP protocols are never inherited, two-factor authentication is configured per user
+	Filters UserFilters `json:"filters"`
+	// Filesystem configuration, it is inherited by the members that use the local filesystem
+	FsConfig Filesystem `json:"filesystem"`
+}
+
+// HideConfidentialData hides the group confidential data
+func (g *Group) HideConfidentialData() {
+	g.FsConfig.hideConfidentialData()
+}
+
+func (g *Group) getACopy() Group {
+	// reuse the deep copy implemented for users for the shared settings
+	u := User{
+		Permissions: g.Permissions,
+		Filters:     g.Filters,
+		FsConfig:    g.FsConfig,
+	}
+	u = u.getACopy()
+	var permissions map[string][]string
+	if len(g.Permissions) > 0 {
+		permissions = u.Permissions
+	}
+	return Group{
+		ID:                g.ID,
+		Name:              g.Name,
+		Description:       g.Description,
+		Permissions:       permissions,
+		QuotaSize:         g.QuotaSize,
+		QuotaFiles:        g.QuotaFiles,
+		UploadBandwidth:   g.UploadBandwidth,
+		DownloadBandwidth: g.DownloadBandwidth,
+		Filters:           u.Filters,
+		FsConfig:          u.FsConfig,
+	}
+}
+
+// GetPermissionsAsJSON returns the permissions as json byte array
+func (g *Group) GetPermissionsAsJSON() ([]byte, error) {
+	return json.Marshal(g.Permissions)
+}
+
+// GetFiltersAsJSON returns the filters as json byte array
+func (g *Group) GetFiltersAsJSON() ([]byte, error) {
+	return json.Marshal(g.Filters)
+}
+
+// GetFsConfigAsJSON returns the filesystem config as json byte array
+func (g *Group) GetFsConfigAsJSON() ([]byte, error) {
+	return json.Marshal(g.FsConfig)
+}
+
+func validateGroup(group *Group) error {
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return &ValidationError{field: "name", err: "group name is mandatory"}
+	}
+	if len(group.Name) > 255 || strings.Contains(group.Name, ",") {
+		return &ValidationError{field: "name", err: fmt.Sprintf("invalid group name %#v", group.Name)}
+	}
+	if len(group.Permissions) > 0 {
+		permissions, err := cleanPermissions(group.Permissions, false)
+		if err != nil {
+			return err
+		}
+		group.Permissions = permissions
+	} else {
+		group.Permissions = nil
+	}
+	// filters and filesystem are validated as for users, the secrets are encrypted
+	// using the group name as additional data
+	u := User{
+		Username: group.Name,
+		Filters:  group.Filters,
+		FsConfig: group.FsConfig,
+	}
+	if err := validateFilters(&u); err != nil {
+		return err
+	}
+	if err := validateFilesystemConfig(&u); err != nil {
+		return err
+	}
+	// GCS credentials are always stored inside the data provider for groups
+	if u.FsConfig.Provider == GCSFilesystemProvider && u.FsConfig.GCSConfig.Credentials.IsPlain() {
+		u.FsConfig.GCSConfig.Credentials.AdditionalData = group.Name
+		if err := u.FsConfig.GCSConfig.Credentials.Encrypt(); err != nil {
+			return &ValidationError{field: "filesystem.gcsconfig.credentials", err: fmt.Sprintf("could not encrypt GCS credentials: %v", err)}
+		}
+	}
+	group.Filters = u.Filters
+	group.FsConfig = u.FsConfig
+	return nil
+}
+
+func validateUserGroups(user *User) error {
+	var groups []string
+	for _, name := range user.Groups {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return &ValidationError{field: "groups", err: "group name cannot be empty"}
+		}
+		for _, g := range groups {
+			if g == name {
+				return &ValidationError{field: "groups", err: fmt.Sprintf("duplicated group %#v", name)}
+			}
+		}
+		groups = append(groups, name)
+	}
+	user.Groups = groups
+	return nil
+}
+
+// applyGroupSettings merges the given groups settings into the user
+func (u *User) applyGroupSettings(groups []Group) error {
+	if u.Permissions == nil {
+		u.Permissions = make(map[string][]string)
+	}
+	for _, g := range groups {
+		for dir, perms := range g.Permissions {
+			if _, ok := u.Permissions[dir]; !ok {
+				u.Permissions[dir] = perms
+			}
+		}
+		if u.QuotaSize == 0 {
+			u.QuotaSize = g.QuotaSize
+		}
+		if u.QuotaFiles == 0 {
+			u.QuotaFiles = g.QuotaFiles
+		}
+		if u.UploadBandwidth == 0 {
+			u.UploadBandwidth = g.UploadBandwidth
+		}
+		if u.DownloadBandwidth == 0 {
+			u.DownloadBandwidth = g.DownloadBandwidth
+		}
+		if u.FsConfig.Provider == LocalFilesystemProvider && g.FsConfig.Provider != LocalFilesystemProvider {
+			u.FsConfig = g.FsConfig
+		}
+	}
+	filters, err := getMergedFilters(u.Filters, groups)
+	if err != nil {
+		return err
+	}
+	u.Filters = filters
+	return nil
+}
+
+// getMergedFilters returns the given filters with the ones not set inherited from the groups.
+// All the filters are omitted from JSON if not set so we can merge the JSON objects
+func getMergedFilters(filters UserFilters, groups []Group) (UserFilters, error) {
+	var result UserFilters
+	fields, err := getFiltersAsJSONFields(filters)
+	if err != nil {
+		return result, err
+	}
+	if filters.DownloadVolumeLimit == 0 {
+		// the period has a default value, it is meaningful only if a limit is set
+		delete(fields, "download_volume_period")
+	}
+	for _, g := range groups {
+		groupFilters := g.Filters
+		groupFilters.TOTPProtocols = nil
+		groupFields, err := getFiltersAsJSONFields(groupFilters)
+		if err != nil {
+			return result, err
+		}
+		for k, v := range groupFields {
+			if _, ok := fields[k]; !ok {
+				fields[k] = v
+			}
+		}
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+func getFiltersAsJSONFields(filters UserFilters) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	data, err := json.Marshal(filters)
+	if err != nil {
+		return fields, err
+	}
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+// applyUserGroups applies the settings inherited from the groups to the given user
+func applyUserGroups(user *User) error {
+	var groups []Group
+	for _, name := range user.Groups {
+		group, err := provider.groupExists(name)
+		if err != nil {
+			if isRecordNotFoundError(err) {
+				providerLog(logger.LevelWarn, "group %#v for user %#v does not exist", name, user.Username)
+				continue
+			}
+			return err
+		}
+		groups = append(groups, group)
+	}
+	if len(groups) > 0 {
+		if err := user.applyGroupSettings(groups); err != nil {
+			providerLog(logger.LevelWarn, "unable to apply groups settings to user %#v: %v", user.Username, err)
+			return err
+		}
+	}
+	// the root permissions can be omitted for group members, the user
+	// could have been removed from all its groups in the meantime
+	if perms, ok := user.Permissions["/"]; !ok || len(perms) == 0 {
+		return fmt.Errorf("no permissions granted for the root directory to user %#v", user.Username)
+	}
+	return nil
+}
+
+// GetUserWithGroupSettings returns the user with the given username and the
+// settings inherited from its groups applied
+func GetUserWithGroupSettings(username string) (User, error) {
+	user, err := provider.userExists(username)
+	if err != nil {
+		return user, err
+	}
+	err = applyUserGroups(&user)
+	return user, err
+}
+
+// GroupExists returns the group with the given name if it exists
+func GroupExists(name string) (Group, error) {
+	return provider.groupExists(name)
+}
+
+// GetGroupByID returns the group with the given database ID if a match is found or an error
+func GetGroupByID(ID int64) (Group, error) {
+	return provider.getGroupByID(ID)
+}
+
+// GetGroups returns an array of groups respecting limit and offset and filtered by name exact match if not empty
+func GetGroups(limit, offset int, order, name string) ([]Group, error) {
+	return provider.getGroups(limit, offset, order, name)
+}
+
+// AddGroup adds a new group.
+// ManageUsers configuration must be set to 1 to enable this method
+func AddGroup(group Group) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return provider.addGroup(group)
+}
+
+// UpdateGroup updates an existing group.
+// ManageUsers configuration must be set to 1 to enable this method
+func UpdateGroup(group Group) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	err := provider.updateGroup(group)
+	if err == nil {
+		// the cached WebDAV users could have settings inherited from this group
+		clearWebDAVUsersCache()
+	}
+	return err
+}
+
+// DeleteGroup deletes an existing group, the group is removed from its members.
+// ManageUsers configuration must be set to 1 to enable this method
+func DeleteGroup(group Group) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	err := provider.deleteGroup(group)
+	if err == nil {
+		clearWebDAVUsersCache()
+	}
+	return err
+}
+
+func clearWebDAVUsersCache() {
+	webDAVUsersCache.Range(func(k, v interface{}) bool {
+		webDAVUsersCache.Delete(k)
+		return true
+	})
+}
@@ -0,0 +1,299 @@
+package dataprovider
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	ldapUsernamePlaceholder = "%s"
+	defaultLDAPUserFilter   = "(uid=%s)"
+	defaultLDAPGroupAttr    = "memberOf"
+	defaultLDAPTimeout      = 10
+)
+
+// LDAPGroupPermissions defines the permissions granted to the members of an LDAP group
+type LDAPGroupPermissions struct {
+	// distinguished name of the group, as reported by the group attribute
+	Group string `json:"group" mapstructure:"group"`
+	// permissions for the root directory
+	Permissions []string `json:"permissions" mapstructure:"permissions"`
+}
+
+// LDAPConfig defines the configuration for the LDAP/Active Directory authentication backend.
+// The users are searched using the configured filter and authenticated binding as
+// them. On success the user is created, or updated, inside the data provider using
+// the directory attributes
+type LDAPConfig struct {
+	// LDAP server URL, for example "ldaps://ldap.example.com" or "ldap://ldap.example.com:389"
+	URL string `json:"url" mapstructure:"url"`
+	// upgrade "ldap://" connections to TLS using the StartTLS extended operation
+	StartTLS bool `json:"start_tls" mapstructure:"start_tls"`
+	// if enabled the LDAP server certificate is not verified. Use for test only
+	SkipTLSVerify bool `json:"skip_tls_verify" mapstructure:"skip_tls_verify"`
+	// DN and password used to search the users. Leave empty for an anonymous search
+	BindDN       string `json:"bind_dn" mapstructure:"bind_dn"`
+	BindPassword string `json:"bind_password" mapstructure:"bind_password"`
+	// the users are searched inside this base DN
+	BaseDN string `json:"base_dn" mapstructure:"base_dn"`
+	// filter to find the user, "%s" is replaced with the escaped username.
+	// For Active Directory use something like "(&(objectClass=user)(sAMAccountName=%s))"
+	UserFilter string `json:"user_filter" mapstructure:"user_filter"`
+	// optional attributes to map the home directory, the UID and the GID.
+	// If the home directory attribute is not set or empty the home directory is
+	// preserved for existing users and obtained from "users_base_dir" for new ones
+	HomeDirAttribute string `json:"home_dir_attribute" mapstructure:"home_dir_attribute"`
+	UIDAttribute     string `json:"uid_attribute" mapstructure:"uid_attribute"`
+	GIDAttribute     string `json:"gid_attribute" mapstructure:"gid_attribute"`
+	// attribute listing the groups the user is member of
+	GroupAttribute string `json:"group_attribute" mapstructure:"group_attribute"`
+	// permissions for the root directory granted to the users not member of
+	// any of the groups defined in GroupPermissions
+	DefaultPermissions []string `json:"default_permissions" mapstructure:"default_permissions"`
+	// permissions granted to the group members. The permissions of all
+	// the groups the user is member of are merged
+	GroupPermissions []LDAPGroupPermissions `json:"group_permissions" mapstructure:"group_permissions"`
+	// timeout, as seconds, for the LDAP requests
+	Timeout int `json:"timeout" mapstructure:"timeout"`
+}
+
+func (c *LDAPConfig) validate() error {
+	c.URL = strings.TrimSpace(c.URL)
+	u, err := url.Parse(c.URL)
+	if err != nil || c.URL == "" {
+		return fmt.Errorf("invalid LDAP url %#v", c.URL)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return fmt.Errorf("invalid LDAP url %#v, the scheme must be ldap or ldaps", c.URL)
+	}
+	if c.StartTLS && u.Scheme == "ldaps" {
+		return errors.New("LDAP start_tls cannot be used for ldaps urls")
+	}
+	if c.BaseDN == "" {
+		return errors.New("LDAP base_dn is required")
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = defaultLDAPUserFilter
+	}
+	if !strings.Contains(c.UserFilter, ldapUsernamePlaceholder) {
+		return fmt.Errorf("LDAP user_filter %#v must contain the %#v placeholder", c.UserFilter, ldapUsernamePlaceholder)
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = defaultLDAPGroupAttr
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultLDAPTimeout
+	}
+	for _, perm := range c.DefaultPermissions {
+		if !utils.IsStringInSlice(perm, ValidPerms) {
+			return fmt.Errorf("invalid LDAP default permission %#v", perm)
+		}
+	}
+	for _, gp := range c.GroupPermissions {
+		if gp.Group == "" {
+			return errors.New("LDAP group permissions require a group")
+		}
+		for _, perm := range gp.Permissions {
+			if !utils.IsStringInSlice(perm, ValidPerms) {
+				return fmt.Errorf("invalid LDAP permission %#v for group %#v", perm, gp.Group)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *LDAPConfig) connect() (*ldap.Conn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(c.Timeout) * time.Second
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: c.SkipTLSVerify, //nolint:gosec
+		MinVersion:         tls.VersionTLS12,
+	}
+	conn, err := ldap.DialURL(c.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if c.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// searchUser returns the directory entry for the given username.
+// A RecordNotFoundError is returned if the user does not exist
+func (c *LDAPConfig) searchUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	if c.BindDN != "" {
+		if err := conn.Bind(c.BindDN, c.BindPassword); err != nil {
+			return nil, fmt.Errorf("unable to bind as %#v: %v", c.BindDN, err)
+		}
+	}
+	attributes := []string{c.GroupAttribute}
+	for _, attr := range []string{c.HomeDirAttribute, c.UIDAttribute, c.GIDAttribute} {
+		if attr != "" {
+			attributes = append(attributes, attr)
+		}
+	}
+	filter := strings.ReplaceAll(c.UserFilter, ldapUsernamePlaceholder, ldap.EscapeFilter(username))
+	req := ldap.NewSearchRequest(c.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, c.Timeout, false,
+		filter, attributes, nil)
+	result, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, &RecordNotFoundError{err: fmt.Sprintf("LDAP user %#v not found", username)}
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, fmt.Errorf("LDAP filter %#v matches multiple entries", filter)
+	}
+}
+
+func (c *LDAPConfig) getPermissions(entry *ldap.Entry) []string {
+	var perms []string
+	groups := entry.GetAttributeValues(c.GroupAttribute)
+	for _, gp := range c.GroupPermissions {
+		for _, group := range groups {
+			if strings.EqualFold(strings.TrimSpace(group), strings.TrimSpace(gp.Group)) {
+				perms = append(perms, gp.Permissions...)
+				break
+			}
+		}
+	}
+	if len(perms) == 0 {
+		perms = c.DefaultPermissions
+	}
+	perms = utils.RemoveDuplicates(perms)
+	if utils.IsStringInSlice(PermAny, perms) {
+		return []string{PermAny}
+	}
+	return perms
+}
+
+// updateUser updates the given user using the attributes from the directory entry
+func (c *LDAPConfig) updateUser(user *User, entry *ldap.Entry) error {
+	if c.HomeDirAttribute != "" {
+		if homeDir := entry.GetAttributeValue(c.HomeDirAttribute); homeDir != "" {
+			user.HomeDir = homeDir
+		}
+	}
+	for _, mapping := range []struct {
+		attribute string
+		value     *int
+	}{
+		{c.UIDAttribute, &user.UID},
+		{c.GIDAttribute, &user.GID},
+	} {
+		if mapping.attribute == "" {
+			continue
+		}
+		if value := entry.GetAttributeValue(mapping.attribute); value != "" {
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid LDAP attribute %#v value %#v: %v", mapping.attribute, value, err)
+			}
+			*mapping.value = id
+		}
+	}
+	perms := c.getPermissions(entry)
+	if len(perms) == 0 {
+		return fmt.Errorf("no permissions granted to LDAP user %#v", user.Username)
+	}
+	if user.Permissions == nil {
+		user.Permissions = make(map[string][]string)
+	}
+	user.Permissions["/"] = perms
+	return nil
+}
+
+// doLDAPAuth authenticates the user binding to the LDAP server and creates, or updates,
+// the user inside the data provider. The existing users not created by LDAP are declined
+func doLDAPAuth(username, password, protocol string) (User, error) {
+	var user User
+	if password == "" {
+		return user, ErrInvalidCredentials
+	}
+	conn, err := config.LDAP.connect()
+	if err != nil {
+		return user, fmt.Errorf("unable to connect to the LDAP server: %v", err)
+	}
+	defer conn.Close()
+
+	entry, err := config.LDAP.searchUser(conn, username)
+	if err != nil {
+		return user, err
+	}
+	err = executeLoginLookup(username, func() error {
+		var err error
+		user, err = provider.userExists(username)
+		return err
+	})
+	exists := err == nil
+	if !exists {
+		if !isRecordNotFoundError(err) {
+			return user, err
+		}
+		user = User{
+			Username: username,
+			Status:   1,
+		}
+	} else {
+		// the users not created by LDAP are never modified, an LDAP entry must not take over them
+		if user.AuthBackend != AuthBackendLDAP {
+			return User{}, &RecordNotFoundError{err: fmt.Sprintf("user %#v exists and it is not managed by LDAP", username)}
+		}
+		if err := checkLoginConditions(user); err != nil {
+			return user, err
+		}
+	}
+	bindAndSave := func(password string) (User, error) {
+		if err := conn.Bind(entry.DN, password); err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+				return user, ErrInvalidCredentials
+			}
+			return user, fmt.Errorf("unable to bind as %#v: %v", entry.DN, err)
+		}
+		if err := config.LDAP.updateUser(&user, entry); err != nil {
+			return user, err
+		}
+		user.Password = password
+		user.AuthBackend = AuthBackendLDAP
+		var err error
+		if exists {
+			err = provider.updateUser(user)
+		} else {
+			err = provider.addUser(user)
+		}
+		if err != nil {
+			providerLog(logger.LevelWarn, "unable to save LDAP user %#v: %v", username, err)
+			return user, err
+		}
+		return provider.userExists(username)
+	}
+	// the TOTP configuration is stored inside the data provider, the code must be removed
+	// from the password before binding
+	if protocol != "SSH" && user.IsTOTPRequired(protocol) {
+		return checkUserPasswordAndTOTP(user, password, bindAndSave)
+	}
+	return bindAndSave(password)
+}
@@ -0,0 +1,242 @@
+package dataprovider
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// ErrLoginLocked defines the error to return if the user is locked after too many
+// consecutive failed logins
+var ErrLoginLocked = errors.New("the account is temporarily locked after too many failed logins")
+
+// LoginLockout defines the policy to lock a user after too many consecutive failed logins.
+// Failures are counted per user regardless of the source IP address and they are stored
+// inside the data provider, so they are shared between multiple SFTPGo instances.
+// Only the users stored inside the data provider can be locked
+type LoginLockout struct {
+	// number of consecutive failed logins that lock the user, 0 disables the lockout
+	MaxFailures int `json:"max_failures" mapstructure:"max_failures"`
+	// lock duration, as minutes. The user is automatically unlocked after this time.
+	// Failures older than this time are forgotten
+	LockDuration int `json:"lock_duration" mapstructure:"lock_duration"`
+}
+
+// IsEnabled returns true if the login lockout is enabled
+func (l *LoginLockout) IsEnabled() bool {
+	return l.MaxFailures > 0
+}
+
+func (l *LoginLockout) validate() error {
+	if !l.IsEnabled() {
+		return nil
+	}
+	if l.LockDuration <= 0 {
+		return errors.New("the login lockout duration must be greater than 0")
+	}
+	return nil
+}
+
+func (l *LoginLockout) getLockDuration() time.Duration {
+	return time.Duration(l.LockDuration) * time.Minute
+}
+
+// LoginLockoutStatus defines the login lockout status for a user
+type LoginLockoutStatus struct {
+	Username string `json:"username"`
+	// consecutive failed logins
+	Failures int `json:"failures"`
+	// last failed login as unix timestamp in milliseconds, 0 means no failures
+	LastFailure int64 `json:"last_failure"`
+	Locked      bool  `json:"locked"`
+	// the time the lock expires as unix timestamp in milliseconds, 0 if the user is not locked
+	LockedUntil int64 `json:"locked_until"`
+}
+
+// loginFailures defines the login lockout fields stored inside the data provider for each user
+type loginFailures struct {
+	Failures    int
+	LastFailure int64
+	LockedUntil int64
+}
+
+// isActive returns false if the failures are expired, the lock is expired and the
+// last failure is older than the lock duration
+func (f *loginFailures) isActive(now int64) bool {
+	if f.Failures == 0 && f.LockedUntil == 0 {
+		return false
+	}
+	return now < f.LockedUntil || now-f.LastFailure <= config.LoginLockout.getLockDuration().Milliseconds()
+}
+
+func (f *loginFailures) isLocked(now int64) bool {
+	return f.isActive(now) && now < f.LockedUntil
+}
+
+func (u *User) getLoginFailures() loginFailures {
+	return loginFailures{
+		Failures:    u.LoginFailures,
+		LastFailure: u.LastLoginFailure,
+		LockedUntil: u.LockedUntil,
+	}
+}
+
+func (u *User) setLoginFailures(f loginFailures) {
+	u.LoginFailures = f.Failures
+	u.LastLoginFailure = f.LastFailure
+	u.LockedUntil = f.LockedUntil
+}
+
+// maxLoginFailuresUpdateRetries is the number of attempts to update the login lockout fields.
+// The updates are conditional and they fail if the fields are modified by a concurrent login
+const maxLoginFailuresUpdateRetries = 5
+
+// updateLoginFailures reads the login lockout fields for the given user and stores the fields
+// returned by the update function. It returns the stored fields, the update function can return
+// false if there is nothing to update
+func updateLoginFailures(username string, update func(f loginFailures, now int64) (loginFailures, bool)) (loginFailures, bool, error) {
+	for i := 0; i < maxLoginFailuresUpdateRetries; i++ {
+		user, err := provider.userExists(username)
+		if err != nil {
+			return loginFailures{}, false, err
+		}
+		prev := user.getLoginFailures()
+		next, ok := update(prev, utils.GetTimeAsMsSinceEpoch(time.Now()))
+		if !ok {
+			return prev, false, nil
+		}
+		updated, err := provider.updateLoginFailures(username, prev, next)
+		if err != nil {
+			return prev, false, err
+		}
+		if updated {
+			return next, true, nil
+		}
+	}
+	return loginFailures{}, false, fmt.Errorf("unable to update the login failures for user %#v, too many concurrent updates",
+		username)
+}
+
+func addLoginFailure(username string) {
+	f, updated, err := updateLoginFailures(username, func(f loginFailures, now int64) (loginFailures, bool) {
+		if f.isLocked(now) {
+			// already locked by a concurrent login
+			return f, false
+		}
+		if !f.isActive(now) || f.LockedUntil != 0 {
+			// no recent failures or the previous lock is expired
+			f = loginFailures{}
+		}
+		f.Failures++
+		f.LastFailure = now
+		if f.Failures >= config.LoginLockout.MaxFailures {
+			f.LockedUntil = now + config.LoginLockout.getLockDuration().Milliseconds()
+		}
+		return f, true
+	})
+	if err != nil {
+		if !isRecordNotFoundError(err) {
+			providerLog(logger.LevelWarn, "unable to count the failed login for user %#v: %v", username, err)
+		}
+		return
+	}
+	if updated && f.LockedUntil > 0 {
+		providerLog(logger.LevelWarn, "user %#v locked until %v after %v consecutive failed logins", username,
+			utils.GetTimeFromMsecSinceEpoch(f.LockedUntil).Format(time.RFC3339), f.Failures)
+	}
+}
+
+func resetLoginFailures(username string) (bool, error) {
+	_, reset, err := updateLoginFailures(username, func(f loginFailures, now int64) (loginFailures, bool) {
+		if f.Failures == 0 && f.LockedUntil == 0 && f.LastFailure == 0 {
+			return f, false
+		}
+		return loginFailures{}, true
+	})
+	return reset, err
+}
+
+// checkLoginLockout returns ErrLoginLocked if the given user is locked.
+// The users not stored inside the data provider are never locked
+func checkLoginLockout(username string) error {
+	if !config.LoginLockout.IsEnabled() {
+		return nil
+	}
+	user, err := provider.userExists(username)
+	if err != nil {
+		if !isRecordNotFoundError(err) {
+			providerLog(logger.LevelWarn, "unable to check the login lockout for user %#v: %v", username, err)
+		}
+		return nil
+	}
+	f := user.getLoginFailures()
+	if f.isLocked(utils.GetTimeAsMsSinceEpoch(time.Now())) {
+		providerLog(logger.LevelDebug, "login denied for user %#v, the account is locked", username)
+		return ErrLoginLocked
+	}
+	return nil
+}
+
+// updateLoginLockout counts the failed login or resets the failures after a successful login.
+// Public key failures are not counted, SSH clients usually try several keys before the right one.
+// Missing users and transient provider errors are not counted too
+func updateLoginLockout(username, method string, declined bool, err error) {
+	if !config.LoginLockout.IsEnabled() {
+		return
+	}
+	if err == nil {
+		if _, errReset := resetLoginFailures(username); errReset != nil && !isRecordNotFoundError(errReset) {
+			providerLog(logger.LevelWarn, "unable to reset the login failures for user %#v: %v", username, errReset)
+		}
+		return
+	}
+	if declined || method == SSHLoginMethodPublicKey || isTransientProviderError(err) {
+		return
+	}
+	addLoginFailure(username)
+}
+
+// GetLoginLockoutStatus returns the login lockout status for the given user
+func GetLoginLockoutStatus(username string) (LoginLockoutStatus, error) {
+	if !config.LoginLockout.IsEnabled() {
+		return LoginLockoutStatus{}, &MethodDisabledError{err: "login lockout is disabled"}
+	}
+	user, err := provider.userExists(username)
+	if err != nil {
+		return LoginLockoutStatus{}, err
+	}
+	status := LoginLockoutStatus{
+		Username: username,
+	}
+	now := utils.GetTimeAsMsSinceEpoch(time.Now())
+	f := user.getLoginFailures()
+	if !f.isActive(now) {
+		return status, nil
+	}
+	status.Failures = f.Failures
+	status.LastFailure = f.LastFailure
+	if f.isLocked(now) {
+		status.Locked = true
+		status.LockedUntil = f.LockedUntil
+	}
+	return status, nil
+}
+
+// ResetLoginLockout unlocks the given user and resets the failed logins counter.
+// It returns false if there was nothing to reset
+func ResetLoginLockout(username string) (bool, error) {
+	if !config.LoginLockout.IsEnabled() {
+		return false, &MethodDisabledError{err: "login lockout is disabled"}
+	}
+	reset, err := resetLoginFailures(username)
+	if err != nil {
+		return false, err
+	}
+	if reset {
+		providerLog(logger.LevelInfo, "login lockout reset for user %#v", username)
+	}
+	return reset, nil
+}
@@ -0,0 +1,54 @@
+package dataprovider
+
+import (
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// LoginRetry defines the retry policy for the user lookups done at login time.
+// Only transient errors, such as refused connections and timeouts, are retried.
+// A missing user or invalid credentials are never retried
+type LoginRetry struct {
+	// maximum number of retries, 0 disables retries
+	MaxRetries int `json:"max_retries" mapstructure:"max_retries"`
+	// delay, as milliseconds, before the first retry. The delay is doubled for each
+	// subsequent retry
+	Backoff int `json:"backoff" mapstructure:"backoff"`
+}
+
+func (r *LoginRetry) validate() {
+	if r.MaxRetries < 0 {
+		r.MaxRetries = 0
+	}
+	if r.Backoff < 0 {
+		r.Backoff = 0
+	}
+}
+
+// isTransientProviderError returns true if the given data provider error could not
+// happen again if the operation is retried
+func isTransientProviderError(err error) bool {
+	if err == nil || isRecordNotFoundError(err) || err == ErrInvalidCredentials {
+		return false
+	}
+	return utils.IsTransientNetworkError(err)
+}
+
+// executeLoginLookup executes the given user lookup and retries it, with exponential
+// backoff, if it fails with a transient error
+func executeLoginLookup(username string, lookupFn func() error) error {
+	err := lookupFn()
+	backoff := time.Duration(config.LoginRetry.Backoff) * time.Millisecond
+	for retry := 1; retry <= config.LoginRetry.MaxRetries && isTransientProviderError(err); retry++ {
+		providerLog(logger.LevelWarn, "transient error looking up user %#v at login, retry %v/%v in %v: %v",
+			username, retry, config.LoginRetry.MaxRetries, backoff, err)
+		metrics.AddLoginProviderRetry()
+		time.Sleep(backoff)
+		backoff *= 2
+		err = lookupFn()
+	}
+	return err
+}
@@ -34,6 +34,14 @@ type memoryProviderHandle struct {
 	vfolders map[string]vfs.BaseVirtualFolder
 	// slice with ordered folders mapped path
 	vfoldersPaths []string
+	// map for groups, group name is the key
+	groups map[string]Group
+	// slice with ordered group names
+	groupNames []string
+	// map for soft deleted users, username is the key
+	deletedUsers map[string]DeletedUser
+	// slice with ordered deleted usernames
+	deletedUsernames []string
 }
 
 // MemoryProvider auth provider for a memory store
@@ -52,13 +60,17 @@ func initializeMemoryProvider(basePath string) error {
 	}
 	provider = MemoryProvider{
 		dbHandle: &memoryProviderHandle{
-			isClosed:      false,
-			usernames:     []string{},
-			usersIdx:      make(map[int64]string),
-			users:         make(map[string]User),
-			vfolders:      make(map[string]vfs.BaseVirtualFolder),
-			vfoldersPaths: []string{},
-			configFile:    configFile,
+			isClosed:         false,
+			usernames:        []string{},
+			usersIdx:         make(map[int64]string),
+			users:            make(map[string]User),
+			vfolders:         make(map[string]vfs.BaseVirtualFolder),
+			vfoldersPaths:    []string{},
+			groups:           make(map[string]Group),
+			groupNames:       []string{},
+			deletedUsers:     make(map[string]DeletedUser),
+			deletedUsernames: []string{},
+			configFile:       configFile,
 		},
 	}
 	return provider.reloadConfig()
@@ -136,6 +148,60 @@ func (p MemoryProvider) updateLastLogin(username string) error {
 	return nil
 }
 
+func (p MemoryProvider) updateLastExpirationWarning(username string, expirationDate int64) (bool, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return false, errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		return false, err
+	}
+	if user.LastExpirationWarning == expirationDate {
+		return false, nil
+	}
+	user.LastExpirationWarning = expirationDate
+	p.dbHandle.users[user.Username] = user
+	return true, nil
+}
+
+func (p MemoryProvider) updateLastTOTPStep(username string, step int64) (bool, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return false, errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		return false, err
+	}
+	if user.LastTOTPStep >= step {
+		return false, nil
+	}
+	user.LastTOTPStep = step
+	p.dbHandle.users[user.Username] = user
+	return true, nil
+}
+
+func (p MemoryProvider) updateLoginFailures(username string, prev, next loginFailures) (bool, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return false, errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		return false, err
+	}
+	if user.getLoginFailures() != prev {
+		return false, nil
+	}
+	user.setLoginFailures(next)
+	p.dbHandle.users[user.Username] = user
+	return true, nil
+}
+
 func (p MemoryProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -161,6 +227,29 @@ func (p MemoryProvider) updateQuota(username string, filesAdd int, sizeAdd int64
 	return nil
 }
 
+func (p MemoryProvider) updateDownloadVolume(username string, sizeAdd int64, periodStart int64) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to update download volume for user %#v error: %v", username, err)
+		return err
+	}
+	if user.DownloadVolumePeriodStart == periodStart {
+		user.UsedDownloadVolume += sizeAdd
+	} else {
+		user.UsedDownloadVolume = sizeAdd
+		user.DownloadVolumePeriodStart = periodStart
+	}
+	providerLog(logger.LevelDebug, "download volume updated for user %#v, size increment: %v period start: %v",
+		username, sizeAdd, periodStart)
+	p.dbHandle.users[user.Username] = user
+	return nil
+}
+
 func (p MemoryProvider) getUsedQuota(username string) (int, int64, error) {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -189,11 +278,21 @@ func (p MemoryProvider) addUser(user User) error {
 	if err == nil {
 		return fmt.Errorf("username %#v already exists", user.Username)
 	}
+	if err = p.checkUserGroupsInternal(user); err != nil {
+		return err
+	}
 	user.ID = p.getNextID()
 	user.LastQuotaUpdate = 0
 	user.UsedQuotaSize = 0
 	user.UsedQuotaFiles = 0
 	user.LastLogin = 0
+	user.UsedDownloadVolume = 0
+	user.DownloadVolumePeriodStart = 0
+	user.LastExpirationWarning = 0
+	user.LoginFailures = 0
+	user.LastLoginFailure = 0
+	user.LockedUntil = 0
+	user.LastTOTPStep = 0
 	user.VirtualFolders = p.joinVirtualFoldersFields(user)
 	p.dbHandle.users[user.Username] = user
 	p.dbHandle.usersIdx[user.ID] = user.Username
@@ -216,6 +315,9 @@ func (p MemoryProvider) updateUser(user User) error {
 	if err != nil {
 		return err
 	}
+	if err = p.checkUserGroupsInternal(user); err != nil {
+		return err
+	}
 	for _, oldFolder := range u.VirtualFolders {
 		p.removeUserFromFolderMapping(oldFolder.MappedPath, u.Username)
 	}
@@ -224,6 +326,13 @@ func (p MemoryProvider) updateUser(user User) error {
 	user.UsedQuotaSize = u.UsedQuotaSize
 	user.UsedQuotaFiles = u.UsedQuotaFiles
 	user.LastLogin = u.LastLogin
+	user.UsedDownloadVolume = u.UsedDownloadVolume
+	user.DownloadVolumePeriodStart = u.DownloadVolumePeriodStart
+	user.LastExpirationWarning = u.LastExpirationWarning
+	user.LoginFailures = u.LoginFailures
+	user.LastLoginFailure = u.LastLoginFailure
+	user.LockedUntil = u.LockedUntil
+	user.LastTOTPStep = u.LastTOTPStep
 	p.dbHandle.users[user.Username] = user
 	return nil
 }
@@ -234,6 +343,10 @@ func (p MemoryProvider) deleteUser(user User) error {
 	if p.dbHandle.isClosed {
 		return errMemoryProviderClosed
 	}
+	return p.deleteUserInternal(user)
+}
+
+func (p MemoryProvider) deleteUserInternal(user User) error {
 	u, err := p.userExistsInternal(user.Username)
 	if err != nil {
 		return err
@@ -284,7 +397,7 @@ func (p MemoryProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
 	return folders, nil
 }
 
-func (p MemoryProvider) getUsers(limit int, offset int, order string, username string) ([]User, error) {
+func (p MemoryProvider) getUsers(limit int, offset int, order string, username string, metadata MetadataFilter) ([]User, error) {
 	users := make([]User, 0, limit)
 	var err error
 	p.dbHandle.Lock()
@@ -298,7 +411,7 @@ func (p MemoryProvider) getUsers(limit int, offset int, order string, username s
 	if len(username) > 0 {
 		if offset == 0 {
 			user, err := p.userExistsInternal(username)
-			if err == nil {
+			if err == nil && metadata.matches(user.Metadata) {
 				user.HideConfidentialData()
 				users = append(users, user)
 			}
@@ -308,11 +421,14 @@ func (p MemoryProvider) getUsers(limit int, offset int, order string, username s
 	itNum := 0
 	if order == OrderASC {
 		for _, username := range p.dbHandle.usernames {
+			user := p.dbHandle.users[username]
+			if !metadata.matches(user.Metadata) {
+				continue
+			}
 			itNum++
 			if itNum <= offset {
 				continue
 			}
-			user := p.dbHandle.users[username]
 			user.HideConfidentialData()
 			users = append(users, user)
 			if len(users) >= limit {
@@ -321,12 +437,15 @@ func (p MemoryProvider) getUsers(limit int, offset int, order string, username s
 		}
 	} else {
 		for i := len(p.dbHandle.usernames) - 1; i >= 0; i-- {
+			username := p.dbHandle.usernames[i]
+			user := p.dbHandle.users[username]
+			if !metadata.matches(user.Metadata) {
+				continue
+			}
 			itNum++
 			if itNum <= offset {
 				continue
 			}
-			username := p.dbHandle.usernames[i]
-			user := p.dbHandle.users[username]
 			user.HideConfidentialData()
 			users = append(users, user)
 			if len(users) >= limit {
@@ -400,6 +519,7 @@ func (p MemoryProvider) joinVirtualFoldersFields(user User) []vfs.VirtualFolder
 			folder.UsedQuotaSize = f.UsedQuotaSize
 			folder.LastQuotaUpdate = f.LastQuotaUpdate
 			folder.ID = f.ID
+			folder.Metadata = f.Metadata
 			folders = append(folders, folder)
 		}
 	}
@@ -570,6 +690,195 @@ func (p MemoryProvider) deleteFolder(folder vfs.BaseVirtualFolder) error {
 	return nil
 }
 
+func (p MemoryProvider) checkUserGroupsInternal(user User) error {
+	for _, name := range user.Groups {
+		if _, ok := p.dbHandle.groups[name]; !ok {
+			return &ValidationError{field: "groups", err: fmt.Sprintf("group %#v does not exist", name)}
+		}
+	}
+	return nil
+}
+
+func (p MemoryProvider) groupExistsInternal(name string) (Group, error) {
+	if val, ok := p.dbHandle.groups[name]; ok {
+		return val.getACopy(), nil
+	}
+	return Group{}, &RecordNotFoundError{err: fmt.Sprintf("group %#v does not exist", name)}
+}
+
+func (p MemoryProvider) groupExists(name string) (Group, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return Group{}, errMemoryProviderClosed
+	}
+	return p.groupExistsInternal(name)
+}
+
+func (p MemoryProvider) getGroupByID(ID int64) (Group, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return Group{}, errMemoryProviderClosed
+	}
+	for _, group := range p.dbHandle.groups {
+		if group.ID == ID {
+			return group.getACopy(), nil
+		}
+	}
+	return Group{}, &RecordNotFoundError{err: fmt.Sprintf("group with ID %v does not exist", ID)}
+}
+
+func (p MemoryProvider) getGroups(limit, offset int, order, name string) ([]Group, error) {
+	groups := make([]Group, 0, limit)
+	var err error
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return groups, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return groups, err
+	}
+	if len(name) > 0 {
+		if offset == 0 {
+			var group Group
+			group, err = p.groupExistsInternal(name)
+			if err == nil {
+				group.HideConfidentialData()
+				groups = append(groups, group)
+			}
+		}
+		return groups, err
+	}
+	itNum := 0
+	if order == OrderASC {
+		for _, groupName := range p.dbHandle.groupNames {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			group := p.dbHandle.groups[groupName]
+			group = group.getACopy()
+			group.HideConfidentialData()
+			groups = append(groups, group)
+			if len(groups) >= limit {
+				break
+			}
+		}
+	} else {
+		for i := len(p.dbHandle.groupNames) - 1; i >= 0; i-- {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			group := p.dbHandle.groups[p.dbHandle.groupNames[i]]
+			group = group.getACopy()
+			group.HideConfidentialData()
+			groups = append(groups, group)
+			if len(groups) >= limit {
+				break
+			}
+		}
+	}
+	return groups, err
+}
+
+func (p MemoryProvider) addGroup(group Group) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	_, err = p.groupExistsInternal(group.Name)
+	if err == nil {
+		return fmt.Errorf("group %#v already exists", group.Name)
+	}
+	group.ID = p.getNextGroupID()
+	p.dbHandle.groups[group.Name] = group.getACopy()
+	p.dbHandle.groupNames = append(p.dbHandle.groupNames, group.Name)
+	sort.Strings(p.dbHandle.groupNames)
+	return nil
+}
+
+func (p MemoryProvider) updateGroup(group Group) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	g, err := p.groupExistsInternal(group.Name)
+	if err != nil {
+		return err
+	}
+	group.ID = g.ID
+	p.dbHandle.groups[group.Name] = group.getACopy()
+	return nil
+}
+
+func (p MemoryProvider) deleteGroup(group Group) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	_, err := p.groupExistsInternal(group.Name)
+	if err != nil {
+		return err
+	}
+	for username, user := range p.dbHandle.users {
+		if utils.IsStringInSlice(group.Name, user.Groups) {
+			var groups []string
+			for _, name := range user.Groups {
+				if name != group.Name {
+					groups = append(groups, name)
+				}
+			}
+			user.Groups = groups
+			p.dbHandle.users[username] = user
+		}
+	}
+	delete(p.dbHandle.groups, group.Name)
+	p.dbHandle.groupNames = []string{}
+	for name := range p.dbHandle.groups {
+		p.dbHandle.groupNames = append(p.dbHandle.groupNames, name)
+	}
+	sort.Strings(p.dbHandle.groupNames)
+	return nil
+}
+
+func (p MemoryProvider) dumpGroups() ([]Group, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	groups := make([]Group, 0, len(p.dbHandle.groupNames))
+	if p.dbHandle.isClosed {
+		return groups, errMemoryProviderClosed
+	}
+	for _, name := range p.dbHandle.groupNames {
+		group := p.dbHandle.groups[name]
+		groups = append(groups, group.getACopy())
+	}
+	return groups, nil
+}
+
+func (p MemoryProvider) getNextGroupID() int64 {
+	nextID := int64(1)
+	for _, v := range p.dbHandle.groups {
+		if v.ID >= nextID {
+			nextID = v.ID + 1
+		}
+	}
+	return nextID
+}
+
 func (p MemoryProvider) getNextID() int64 {
 	nextID := int64(1)
 	for id := range p.dbHandle.usersIdx {
@@ -590,6 +899,179 @@ func (p MemoryProvider) getNextFolderID() int64 {
 	return nextID
 }
 
+func (p MemoryProvider) softDeleteUser(user User) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if err := p.deleteUserInternal(user); err != nil {
+		return err
+	}
+	// a previously deleted user with the same username is replaced
+	if _, ok := p.dbHandle.deletedUsers[user.Username]; !ok {
+		p.dbHandle.deletedUsernames = append(p.dbHandle.deletedUsernames, user.Username)
+		sort.Strings(p.dbHandle.deletedUsernames)
+	}
+	p.dbHandle.deletedUsers[user.Username] = DeletedUser{
+		DeletedAt: utils.GetTimeAsMsSinceEpoch(time.Now()),
+		User:      user.getACopy(),
+	}
+	return nil
+}
+
+func (p MemoryProvider) getDeletedUsers(limit, offset int, order, username string) ([]DeletedUser, error) {
+	deletedUsers := make([]DeletedUser, 0, limit)
+	var err error
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return deletedUsers, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return deletedUsers, err
+	}
+	if len(username) > 0 {
+		if offset == 0 {
+			deletedUser, err := p.deletedUserExistsInternal(username)
+			if err == nil {
+				deletedUser.HideConfidentialData()
+				deletedUsers = append(deletedUsers, deletedUser)
+			}
+		}
+		return deletedUsers, err
+	}
+	itNum := 0
+	for idx := range p.dbHandle.deletedUsernames {
+		if order == OrderDESC {
+			idx = len(p.dbHandle.deletedUsernames) - 1 - idx
+		}
+		itNum++
+		if itNum <= offset {
+			continue
+		}
+		deletedUser := p.dbHandle.deletedUsers[p.dbHandle.deletedUsernames[idx]]
+		deletedUser = deletedUser.getACopy()
+		deletedUser.HideConfidentialData()
+		deletedUsers = append(deletedUsers, deletedUser)
+		if len(deletedUsers) >= limit {
+			break
+		}
+	}
+	return deletedUsers, err
+}
+
+func (p MemoryProvider) deletedUserExists(username string) (DeletedUser, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return DeletedUser{}, errMemoryProviderClosed
+	}
+	return p.deletedUserExistsInternal(username)
+}
+
+func (p MemoryProvider) deletedUserExistsInternal(username string) (DeletedUser, error) {
+	if val, ok := p.dbHandle.deletedUsers[username]; ok {
+		return val.getACopy(), nil
+	}
+	return DeletedUser{}, &RecordNotFoundError{err: fmt.Sprintf("deleted user %#v does not exist", username)}
+}
+
+func (p MemoryProvider) purgeDeletedUser(username string) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	p.purgeDeletedUsersInternal(func(deletedUser *DeletedUser) bool {
+		return deletedUser.User.Username == username
+	})
+	return nil
+}
+
+func (p MemoryProvider) purgeDeletedUsers(before int64) (int, error) {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, errMemoryProviderClosed
+	}
+	return p.purgeDeletedUsersInternal(func(deletedUser *DeletedUser) bool {
+		return deletedUser.DeletedAt < before
+	}), nil
+}
+
+// rotateSecrets rotates the secrets for users, soft deleted users and groups,
+// the rotated copies are stored only if all the rotations succeed
+func (p MemoryProvider) rotateSecrets(rotator *secretsRotator) error {
+	p.dbHandle.Lock()
+	defer p.dbHandle.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	users := make(map[string]User)
+	for _, username := range p.dbHandle.usernames {
+		u := p.dbHandle.users[username]
+		user := u.getACopy()
+		updated, err := rotator.rotateUser(&user)
+		if err != nil {
+			return err
+		}
+		if updated {
+			users[username] = user
+		}
+	}
+	deletedUsers := make(map[string]DeletedUser)
+	for _, username := range p.dbHandle.deletedUsernames {
+		d := p.dbHandle.deletedUsers[username]
+		deletedUser := d.getACopy()
+		updated, err := rotator.rotateDeletedUser(&deletedUser.User)
+		if err != nil {
+			return err
+		}
+		if updated {
+			deletedUsers[username] = deletedUser
+		}
+	}
+	groups := make(map[string]Group)
+	for _, name := range p.dbHandle.groupNames {
+		g := p.dbHandle.groups[name]
+		group := g.getACopy()
+		updated, err := rotator.rotateGroup(&group)
+		if err != nil {
+			return err
+		}
+		if updated {
+			groups[name] = group
+		}
+	}
+	for username, user := range users {
+		p.dbHandle.users[username] = user
+	}
+	for username, deletedUser := range deletedUsers {
+		p.dbHandle.deletedUsers[username] = deletedUser
+	}
+	for name, group := range groups {
+		p.dbHandle.groups[name] = group
+	}
+	return nil
+}
+
+func (p MemoryProvider) purgeDeletedUsersInternal(match func(*DeletedUser) bool) int {
+	purged := 0
+	usernames := make([]string, 0, len(p.dbHandle.deletedUsernames))
+	for _, username := range p.dbHandle.deletedUsernames {
+		deletedUser := p.dbHandle.deletedUsers[username]
+		if match(&deletedUser) {
+			delete(p.dbHandle.deletedUsers, username)
+			purged++
+			continue
+		}
+		usernames = append(usernames, username)
+	}
+	p.dbHandle.deletedUsernames = usernames
+	return purged
+}
+
 func (p MemoryProvider) clear() {
 	p.dbHandle.Lock()
 	defer p.dbHandle.Unlock()
@@ -598,6 +1080,10 @@ func (p MemoryProvider) clear() {
 	p.dbHandle.users = make(map[string]User)
 	p.dbHandle.vfoldersPaths = []string{}
 	p.dbHandle.vfolders = make(map[string]vfs.BaseVirtualFolder)
+	p.dbHandle.groupNames = []string{}
+	p.dbHandle.groups = make(map[string]Group)
+	p.dbHandle.deletedUsernames = []string{}
+	p.dbHandle.deletedUsers = make(map[string]DeletedUser)
 }
 
 func (p MemoryProvider) reloadConfig() error {
@@ -632,6 +1118,13 @@ func (p MemoryProvider) reloadConfig() error {
 		return err
 	}
 	p.clear()
+	for _, group := range dump.Groups {
+		err = p.addGroup(group)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding group %#v: %v", group.Name, err)
+			return err
+		}
+	}
 	for _, folder := range dump.Folders {
 		_, err := p.getFolderByPath(folder.MappedPath)
 		if err == nil {
@@ -662,7 +1155,7 @@ func (p MemoryProvider) reloadConfig() error {
 			}
 		}
 	}
-	providerLog(logger.LevelDebug, "user and folders loaded from file: %#v", p.dbHandle.configFile)
+	providerLog(logger.LevelDebug, "users, folders and groups loaded from file: %#v", p.dbHandle.configFile)
 	return nil
 }
 
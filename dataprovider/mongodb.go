@@ -0,0 +1,1428 @@
+// +build !nomongodb
+
+package dataprovider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/version"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	mongoDBDatabaseVersion  = 1
+	mongoDBQueryTimeout     = 10 * time.Second
+	mongoDBLongQueryTimeout = 60 * time.Second
+	// duplicate key error code, returned if a unique index is violated
+	mongoDBDuplicateKeyCode = 11000
+
+	mongoDBUsersCollection        = "users"
+	mongoDBFoldersCollection      = "folders"
+	mongoDBGroupsCollection       = "groups"
+	mongoDBDeletedUsersCollection = "deleted_users"
+	mongoDBCountersCollection     = "counters"
+	mongoDBSchemaCollection       = "schema_version"
+	mongoDBSchemaVersionID        = "version"
+)
+
+// MongoDBProvider auth provider for MongoDB database.
+// Users, folders and groups are stored as JSON inside the documents, like the bolt provider does.
+// The fields used for lookups and the quota and last login fields are stored as document fields
+// so they can be indexed and atomically updated
+type MongoDBProvider struct {
+	client   *mongo.Client
+	database *mongo.Database
+}
+
+// mongoDBUser is the document stored for a user
+type mongoDBUser struct {
+	ID                        int64    `bson:"_id"`
+	Username                  string   `bson:"username"`
+	Groups                    []string `bson:"groups"`
+	UsedQuotaSize             int64    `bson:"used_quota_size"`
+	UsedQuotaFiles            int      `bson:"used_quota_files"`
+	LastQuotaUpdate           int64    `bson:"last_quota_update"`
+	LastLogin                 int64    `bson:"last_login"`
+	UsedDownloadVolume        int64    `bson:"used_download_volume"`
+	DownloadVolumePeriodStart int64    `bson:"download_volume_period_start"`
+	LastExpirationWarning     int64    `bson:"last_expiration_warning"`
+	LoginFailures             int      `bson:"login_failures"`
+	LastLoginFailure          int64    `bson:"last_login_failure"`
+	LockedUntil               int64    `bson:"locked_until"`
+	LastTOTPStep              int64    `bson:"last_totp_step"`
+	// the user as JSON, the fields above override the ones stored here
+	Data string `bson:"data"`
+}
+
+func (u *mongoDBUser) getUser() (User, error) {
+	var user User
+	if err := json.Unmarshal([]byte(u.Data), &user); err != nil {
+		return user, err
+	}
+	user.ID = u.ID
+	user.Username = u.Username
+	user.UsedQuotaSize = u.UsedQuotaSize
+	user.UsedQuotaFiles = u.UsedQuotaFiles
+	user.LastQuotaUpdate = u.LastQuotaUpdate
+	user.LastLogin = u.LastLogin
+	user.UsedDownloadVolume = u.UsedDownloadVolume
+	user.DownloadVolumePeriodStart = u.DownloadVolumePeriodStart
+	user.LastExpirationWarning = u.LastExpirationWarning
+	user.LoginFailures = u.LoginFailures
+	user.LastLoginFailure = u.LastLoginFailure
+	user.LockedUntil = u.LockedUntil
+	user.LastTOTPStep = u.LastTOTPStep
+	return user, nil
+}
+
+// mongoDBFolder is the document stored for a virtual folder
+type mongoDBFolder struct {
+	ID              int64    `bson:"_id"`
+	MappedPath      string   `bson:"mapped_path"`
+	UsedQuotaSize   int64    `bson:"used_quota_size"`
+	UsedQuotaFiles  int      `bson:"used_quota_files"`
+	LastQuotaUpdate int64    `bson:"last_quota_update"`
+	Users           []string `bson:"users"`
+	// the folder as JSON, the fields above override the ones stored here
+	Data string `bson:"data"`
+}
+
+func (f *mongoDBFolder) getFolder() (vfs.BaseVirtualFolder, error) {
+	var folder vfs.BaseVirtualFolder
+	if err := json.Unmarshal([]byte(f.Data), &folder); err != nil {
+		return folder, err
+	}
+	folder.ID = f.ID
+	folder.MappedPath = f.MappedPath
+	folder.UsedQuotaSize = f.UsedQuotaSize
+	folder.UsedQuotaFiles = f.UsedQuotaFiles
+	folder.LastQuotaUpdate = f.LastQuotaUpdate
+	folder.Users = f.Users
+	return folder, nil
+}
+
+// mongoDBGroup is the document stored for a group
+type mongoDBGroup struct {
+	ID   int64  `bson:"_id"`
+	Name string `bson:"name"`
+	Data string `bson:"data"`
+}
+
+func (g *mongoDBGroup) getGroup() (Group, error) {
+	var group Group
+	if err := json.Unmarshal([]byte(g.Data), &group); err != nil {
+		return group, err
+	}
+	group.ID = g.ID
+	group.Name = g.Name
+	return group, nil
+}
+
+// mongoDBDeletedUser is the document stored for a deleted user
+type mongoDBDeletedUser struct {
+	Username  string `bson:"_id"`
+	DeletedAt int64  `bson:"deleted_at"`
+	Data      string `bson:"data"`
+}
+
+func init() {
+	version.AddFeature("+mongodb")
+}
+
+func initializeMongoDBProvider() error {
+	logSender = fmt.Sprintf("dataprovider_%v", MongoDBDataProviderName)
+	if config.Name == "" {
+		return errors.New("the database name is mandatory for the mongodb provider")
+	}
+	clientOptions := options.Client().ApplyURI(getMongoDBConnectionString(false))
+	if config.PoolSize > 0 {
+		clientOptions.SetMaxPoolSize(uint64(config.PoolSize))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error creating mongodb client, connection string: %#v, error: %v",
+			getMongoDBConnectionString(true), err)
+		return err
+	}
+	providerLog(logger.LevelDebug, "mongodb client created, connection string: %#v, pool size: %v",
+		getMongoDBConnectionString(true), config.PoolSize)
+	provider = MongoDBProvider{
+		client:   client,
+		database: client.Database(config.Name),
+	}
+	return nil
+}
+
+func getMongoDBConnectionString(redactedPwd bool) string {
+	if config.ConnectionString != "" {
+		return config.ConnectionString
+	}
+	u := url.URL{
+		Scheme: "mongodb",
+		Host:   net.JoinHostPort(config.Host, getMongoDBPort()),
+		Path:   "/" + config.Name,
+	}
+	if config.Username != "" {
+		password := config.Password
+		if redactedPwd {
+			password = "[redacted]"
+		}
+		u.User = url.UserPassword(config.Username, password)
+	}
+	query := url.Values{}
+	query.Set("connectTimeoutMS", "10000")
+	if config.SSLMode > 0 {
+		query.Set("tls", "true")
+		if config.SSLMode == 2 {
+			query.Set("tlsInsecure", "true")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (p MongoDBProvider) users() *mongo.Collection {
+	return p.database.Collection(mongoDBUsersCollection)
+}
+
+func (p MongoDBProvider) folders() *mongo.Collection {
+	return p.database.Collection(mongoDBFoldersCollection)
+}
+
+func (p MongoDBProvider) groups() *mongo.Collection {
+	return p.database.Collection(mongoDBGroupsCollection)
+}
+
+func (p MongoDBProvider) deletedUsers() *mongo.Collection {
+	return p.database.Collection(mongoDBDeletedUsersCollection)
+}
+
+func (p MongoDBProvider) checkAvailability() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+	return p.client.Ping(ctx, readpref.Primary())
+}
+
+func (p MongoDBProvider) validateUserAndPass(username, password, ip, protocol string) (User, error) {
+	var user User
+	if len(password) == 0 {
+		return user, errors.New("Credentials cannot be null or empty")
+	}
+	user, err := p.userExists(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error authenticating user: %v, error: %v", username, err)
+		return user, err
+	}
+	return checkUserAndPass(user, password, ip, protocol)
+}
+
+func (p MongoDBProvider) validateUserAndPubKey(username string, pubKey []byte) (User, string, error) {
+	var user User
+	if len(pubKey) == 0 {
+		return user, "", errors.New("Credentials cannot be null or empty")
+	}
+	user, err := p.userExists(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error authenticating user: %v, error: %v", username, err)
+		return user, "", err
+	}
+	return checkUserAndPubKey(user, pubKey)
+}
+
+func (p MongoDBProvider) getUserByID(ID int64) (User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	doc, err := p.getUserDocument(ctx, bson.M{"_id": ID})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = &RecordNotFoundError{err: fmt.Sprintf("user with ID %v does not exist", ID)}
+		}
+		return User{}, err
+	}
+	return p.getUserWithFolders(ctx, doc)
+}
+
+func (p MongoDBProvider) updateLastLogin(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	res, err := p.users().UpdateOne(ctx, bson.M{"username": username}, bson.M{
+		"$set": bson.M{"last_login": utils.GetTimeAsMsSinceEpoch(time.Now())},
+	})
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating last login for user %#v: %v", username, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update last login", username)}
+	}
+	providerLog(logger.LevelDebug, "last login updated for user %#v", username)
+	return nil
+}
+
+func (p MongoDBProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	res, err := p.users().UpdateOne(ctx, bson.M{"username": username}, getMongoDBQuotaUpdate(filesAdd, sizeAdd, reset))
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating quota for user %#v: %v", username, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update quota", username)}
+	}
+	providerLog(logger.LevelDebug, "quota updated for user %#v, files increment: %v size increment: %v is reset? %v",
+		username, filesAdd, sizeAdd, reset)
+	return nil
+}
+
+func (p MongoDBProvider) updateLastExpirationWarning(username string, expirationDate int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	// the update is conditional so only one instance can fire the warning for a given expiration date
+	res, err := p.users().UpdateOne(ctx, bson.M{"username": username, "last_expiration_warning": bson.M{"$ne": expirationDate}},
+		bson.M{"$set": bson.M{"last_expiration_warning": expirationDate}})
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating last expiration warning for user %#v: %v", username, err)
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+func (p MongoDBProvider) updateLastTOTPStep(username string, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	// the update is conditional so a TOTP code can be used only once, even by concurrent logins.
+	// $not matches the documents without the field too
+	res, err := p.users().UpdateOne(ctx, bson.M{"username": username, "last_totp_step": bson.M{"$not": bson.M{"$gte": step}}},
+		bson.M{"$set": bson.M{"last_totp_step": step}})
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating last TOTP step for user %#v: %v", username, err)
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+func (p MongoDBProvider) updateLoginFailures(username string, prev, next loginFailures) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	// the update is conditional so concurrent failed logins cannot overwrite each other.
+	// The documents stored before these fields were added do not have them, a missing field matches 0
+	matchValue := func(val int64) interface{} {
+		if val == 0 {
+			return bson.M{"$in": bson.A{0, nil}}
+		}
+		return val
+	}
+	res, err := p.users().UpdateOne(ctx, bson.M{"username": username, "login_failures": matchValue(int64(prev.Failures)),
+		"last_login_failure": matchValue(prev.LastFailure), "locked_until": matchValue(prev.LockedUntil)},
+		bson.M{"$set": bson.M{"login_failures": next.Failures, "last_login_failure": next.LastFailure,
+			"locked_until": next.LockedUntil}})
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating login failures for user %#v: %v", username, err)
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (p MongoDBProvider) updateDownloadVolume(username string, sizeAdd int64, periodStart int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	// increment the volume if the period is the same, otherwise start a new period.
+	// Both updates are atomic, a concurrent update can only cause the second one to match
+	res, err := p.users().UpdateOne(ctx, bson.M{"username": username, "download_volume_period_start": periodStart},
+		bson.M{"$inc": bson.M{"used_download_volume": sizeAdd}})
+	if err == nil && res.MatchedCount == 0 {
+		res, err = p.users().UpdateOne(ctx, bson.M{"username": username, "download_volume_period_start": bson.M{"$ne": periodStart}},
+			bson.M{"$set": bson.M{"used_download_volume": sizeAdd, "download_volume_period_start": periodStart}})
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating download volume for user %#v: %v", username, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update download volume",
+			username)}
+	}
+	providerLog(logger.LevelDebug, "download volume updated for user %#v, size increment: %v period start: %v",
+		username, sizeAdd, periodStart)
+	return nil
+}
+
+func (p MongoDBProvider) getUsedQuota(username string) (int, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	doc, err := p.getUserDocument(ctx, bson.M{"username": username})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", username)}
+		}
+		providerLog(logger.LevelWarn, "unable to get quota for user %v error: %v", username, err)
+		return 0, 0, err
+	}
+	return doc.UsedQuotaFiles, doc.UsedQuotaSize, nil
+}
+
+func (p MongoDBProvider) userExists(username string) (User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	doc, err := p.getUserDocument(ctx, bson.M{"username": username})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", username)}
+		}
+		return User{}, err
+	}
+	return p.getUserWithFolders(ctx, doc)
+}
+
+func (p MongoDBProvider) addUser(user User) error {
+	err := validateUser(&user)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	if _, err = p.getUserDocument(ctx, bson.M{"username": user.Username}); err == nil {
+		return fmt.Errorf("username %v already exists", user.Username)
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+	if err = p.checkUserGroups(ctx, user); err != nil {
+		return err
+	}
+	user.ID, err = p.getNextID(ctx, mongoDBUsersCollection)
+	if err != nil {
+		return err
+	}
+	user.LastQuotaUpdate = 0
+	user.UsedQuotaSize = 0
+	user.UsedQuotaFiles = 0
+	user.LastLogin = 0
+	user.UsedDownloadVolume = 0
+	user.DownloadVolumePeriodStart = 0
+	user.LastExpirationWarning = 0
+	user.LoginFailures = 0
+	user.LastLoginFailure = 0
+	user.LockedUntil = 0
+	user.LastTOTPStep = 0
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = p.users().InsertOne(ctx, mongoDBUser{
+		ID:       user.ID,
+		Username: user.Username,
+		Groups:   user.Groups,
+		Data:     string(data),
+	})
+	if err != nil {
+		if isMongoDBDuplicateKeyError(err) {
+			return fmt.Errorf("username %v already exists", user.Username)
+		}
+		return err
+	}
+	for _, folder := range user.VirtualFolders {
+		if err = p.addUserToFolderMapping(ctx, folder, user.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p MongoDBProvider) updateUser(user User) error {
+	err := validateUser(&user)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	doc, err := p.getUserDocument(ctx, bson.M{"username": user.Username})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", user.Username)}
+		}
+		return err
+	}
+	oldUser, err := doc.getUser()
+	if err != nil {
+		return err
+	}
+	if err = p.checkUserGroups(ctx, user); err != nil {
+		return err
+	}
+	for _, folder := range oldUser.VirtualFolders {
+		if err = p.removeUserFromFolderMapping(ctx, folder, user.Username); err != nil {
+			return err
+		}
+	}
+	for _, folder := range user.VirtualFolders {
+		if err = p.addUserToFolderMapping(ctx, folder, user.Username); err != nil {
+			return err
+		}
+	}
+	// the quota and last login fields are never updated here
+	user.ID = oldUser.ID
+	return p.updateUserData(ctx, user)
+}
+
+func (p MongoDBProvider) deleteUser(user User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	return p.deleteUserInternal(ctx, user)
+}
+
+func (p MongoDBProvider) deleteUserInternal(ctx context.Context, user User) error {
+	for _, folder := range user.VirtualFolders {
+		if err := p.removeUserFromFolderMapping(ctx, folder, user.Username); err != nil {
+			return err
+		}
+	}
+	res, err := p.users().DeleteOne(ctx, bson.M{"_id": user.ID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return &RecordNotFoundError{err: fmt.Sprintf("user with id %v does not exist", user.ID)}
+	}
+	return nil
+}
+
+func (p MongoDBProvider) dumpUsers() ([]User, error) {
+	users := make([]User, 0, 100)
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBLongQueryTimeout)
+	defer cancel()
+
+	cursor, err := p.users().Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"username": 1}))
+	if err != nil {
+		return users, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc mongoDBUser
+		if err = cursor.Decode(&doc); err != nil {
+			return users, err
+		}
+		user, err := p.getUserWithFolders(ctx, doc)
+		if err != nil {
+			return users, err
+		}
+		if err = addCredentialsToUser(&user); err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+	return users, cursor.Err()
+}
+
+func (p MongoDBProvider) getUsers(limit int, offset int, order string, username string, metadata MetadataFilter) ([]User, error) {
+	users := make([]User, 0, limit)
+	if limit <= 0 {
+		return users, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	filter := bson.M{}
+	if username != "" {
+		filter["username"] = username
+	}
+	findOptions := options.Find().SetSort(bson.M{"username": getMongoDBSortOrder(order)})
+	if metadata.IsEmpty() {
+		// metadata are stored as JSON, they are filtered while iterating the results
+		findOptions.SetSkip(int64(offset)).SetLimit(int64(limit))
+	}
+	cursor, err := p.users().Find(ctx, filter, findOptions)
+	if err != nil {
+		return users, err
+	}
+	defer cursor.Close(ctx)
+
+	itNum := 0
+	for cursor.Next(ctx) {
+		var doc mongoDBUser
+		if err = cursor.Decode(&doc); err != nil {
+			return users, err
+		}
+		user, err := p.getUserWithFolders(ctx, doc)
+		if err != nil {
+			return users, err
+		}
+		if !metadata.IsEmpty() {
+			if !metadata.matches(user.Metadata) {
+				continue
+			}
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+		}
+		user.HideConfidentialData()
+		users = append(users, user)
+		if len(users) >= limit {
+			break
+		}
+	}
+	return users, cursor.Err()
+}
+
+func (p MongoDBProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBLongQueryTimeout)
+	defer cancel()
+
+	return p.findFolders(ctx, options.Find().SetSort(bson.M{"mapped_path": 1}))
+}
+
+func (p MongoDBProvider) getFolders(limit, offset int, order, folderPath string) ([]vfs.BaseVirtualFolder, error) {
+	if limit <= 0 {
+		return make([]vfs.BaseVirtualFolder, 0), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	if folderPath != "" {
+		folders := make([]vfs.BaseVirtualFolder, 0, 1)
+		if offset > 0 {
+			return folders, nil
+		}
+		folder, err := p.folderExists(ctx, folderPath)
+		if err == nil {
+			folders = append(folders, folder)
+		}
+		return folders, err
+	}
+	return p.findFolders(ctx, options.Find().SetSort(bson.M{"mapped_path": getMongoDBSortOrder(order)}).
+		SetSkip(int64(offset)).SetLimit(int64(limit)))
+}
+
+func (p MongoDBProvider) findFolders(ctx context.Context, findOptions *options.FindOptions) ([]vfs.BaseVirtualFolder, error) {
+	folders := make([]vfs.BaseVirtualFolder, 0, 50)
+	cursor, err := p.folders().Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return folders, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc mongoDBFolder
+		if err = cursor.Decode(&doc); err != nil {
+			return folders, err
+		}
+		folder, err := doc.getFolder()
+		if err != nil {
+			return folders, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, cursor.Err()
+}
+
+func (p MongoDBProvider) getFolderByPath(name string) (vfs.BaseVirtualFolder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	return p.folderExists(ctx, name)
+}
+
+func (p MongoDBProvider) folderExists(ctx context.Context, name string) (vfs.BaseVirtualFolder, error) {
+	var doc mongoDBFolder
+	err := p.folders().FindOne(ctx, bson.M{"mapped_path": name}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = &RecordNotFoundError{err: fmt.Sprintf("folder %v does not exist", name)}
+		}
+		return vfs.BaseVirtualFolder{}, err
+	}
+	return doc.getFolder()
+}
+
+func (p MongoDBProvider) addFolder(folder vfs.BaseVirtualFolder) error {
+	err := validateFolder(&folder)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	err = p.addFolderInternal(ctx, folder)
+	if isMongoDBDuplicateKeyError(err) {
+		return fmt.Errorf("folder %v already exists", folder.MappedPath)
+	}
+	return err
+}
+
+func (p MongoDBProvider) addFolderInternal(ctx context.Context, folder vfs.BaseVirtualFolder) error {
+	id, err := p.getNextID(ctx, mongoDBFoldersCollection)
+	if err != nil {
+		return err
+	}
+	folder.ID = id
+	data, err := json.Marshal(folder)
+	if err != nil {
+		return err
+	}
+	users := folder.Users
+	if users == nil {
+		// the users are updated using $addToSet and $pull, they require an array
+		users = []string{}
+	}
+	_, err = p.folders().InsertOne(ctx, mongoDBFolder{
+		ID:              folder.ID,
+		MappedPath:      folder.MappedPath,
+		UsedQuotaSize:   folder.UsedQuotaSize,
+		UsedQuotaFiles:  folder.UsedQuotaFiles,
+		LastQuotaUpdate: folder.LastQuotaUpdate,
+		Users:           users,
+		Data:            string(data),
+	})
+	return err
+}
+
+func (p MongoDBProvider) deleteFolder(folder vfs.BaseVirtualFolder) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	folder, err := p.folderExists(ctx, folder.MappedPath)
+	if err != nil {
+		return err
+	}
+	for _, username := range folder.Users {
+		doc, err := p.getUserDocument(ctx, bson.M{"username": username})
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				continue
+			}
+			return err
+		}
+		user, err := doc.getUser()
+		if err != nil {
+			return err
+		}
+		var folders []vfs.VirtualFolder
+		for _, userFolder := range user.VirtualFolders {
+			if folder.MappedPath != userFolder.MappedPath {
+				folders = append(folders, userFolder)
+			}
+		}
+		user.VirtualFolders = folders
+		if err = p.updateUserData(ctx, user); err != nil {
+			return err
+		}
+	}
+	_, err = p.folders().DeleteOne(ctx, bson.M{"_id": folder.ID})
+	return err
+}
+
+func (p MongoDBProvider) groupExists(name string) (Group, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	return p.getGroup(ctx, bson.M{"name": name}, fmt.Sprintf("group %v does not exist", name))
+}
+
+func (p MongoDBProvider) getGroupByID(ID int64) (Group, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	return p.getGroup(ctx, bson.M{"_id": ID}, fmt.Sprintf("group with ID %v does not exist", ID))
+}
+
+func (p MongoDBProvider) getGroup(ctx context.Context, filter bson.M, notFoundMsg string) (Group, error) {
+	var doc mongoDBGroup
+	err := p.groups().FindOne(ctx, filter).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = &RecordNotFoundError{err: notFoundMsg}
+		}
+		return Group{}, err
+	}
+	return doc.getGroup()
+}
+
+func (p MongoDBProvider) getGroups(limit, offset int, order, name string) ([]Group, error) {
+	groups := make([]Group, 0, limit)
+	if limit <= 0 {
+		return groups, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	if name != "" {
+		if offset > 0 {
+			return groups, nil
+		}
+		group, err := p.getGroup(ctx, bson.M{"name": name}, fmt.Sprintf("group %v does not exist", name))
+		if err == nil {
+			group.HideConfidentialData()
+			groups = append(groups, group)
+		}
+		return groups, err
+	}
+	groups, err := p.findGroups(ctx, options.Find().SetSort(bson.M{"name": getMongoDBSortOrder(order)}).
+		SetSkip(int64(offset)).SetLimit(int64(limit)))
+	for idx := range groups {
+		groups[idx].HideConfidentialData()
+	}
+	return groups, err
+}
+
+func (p MongoDBProvider) findGroups(ctx context.Context, findOptions *options.FindOptions) ([]Group, error) {
+	groups := make([]Group, 0, 10)
+	cursor, err := p.groups().Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return groups, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc mongoDBGroup
+		if err = cursor.Decode(&doc); err != nil {
+			return groups, err
+		}
+		group, err := doc.getGroup()
+		if err != nil {
+			return groups, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, cursor.Err()
+}
+
+func (p MongoDBProvider) addGroup(group Group) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	group.ID, err = p.getNextID(ctx, mongoDBGroupsCollection)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, err = p.groups().InsertOne(ctx, mongoDBGroup{
+		ID:   group.ID,
+		Name: group.Name,
+		Data: string(data),
+	})
+	if isMongoDBDuplicateKeyError(err) {
+		return fmt.Errorf("group %v already exists", group.Name)
+	}
+	return err
+}
+
+func (p MongoDBProvider) updateGroup(group Group) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	oldGroup, err := p.getGroup(ctx, bson.M{"name": group.Name}, fmt.Sprintf("group %v does not exist", group.Name))
+	if err != nil {
+		return err
+	}
+	group.ID = oldGroup.ID
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, err = p.groups().UpdateOne(ctx, bson.M{"_id": group.ID}, bson.M{"$set": bson.M{"data": string(data)}})
+	return err
+}
+
+func (p MongoDBProvider) deleteGroup(group Group) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	group, err := p.getGroup(ctx, bson.M{"name": group.Name}, fmt.Sprintf("group %v does not exist", group.Name))
+	if err != nil {
+		return err
+	}
+	cursor, err := p.users().Find(ctx, bson.M{"groups": group.Name})
+	if err != nil {
+		return err
+	}
+	var docs []mongoDBUser
+	err = cursor.All(ctx, &docs)
+	if err != nil {
+		return err
+	}
+	for idx := range docs {
+		user, err := docs[idx].getUser()
+		if err != nil {
+			return err
+		}
+		var groups []string
+		for _, name := range user.Groups {
+			if name != group.Name {
+				groups = append(groups, name)
+			}
+		}
+		user.Groups = groups
+		if err = p.updateUserData(ctx, user); err != nil {
+			return err
+		}
+	}
+	_, err = p.groups().DeleteOne(ctx, bson.M{"_id": group.ID})
+	return err
+}
+
+func (p MongoDBProvider) dumpGroups() ([]Group, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBLongQueryTimeout)
+	defer cancel()
+
+	return p.findGroups(ctx, options.Find().SetSort(bson.M{"name": 1}))
+}
+
+func (p MongoDBProvider) updateFolderQuota(mappedPath string, filesAdd int, sizeAdd int64, reset bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	res, err := p.folders().UpdateOne(ctx, bson.M{"mapped_path": mappedPath}, getMongoDBQuotaUpdate(filesAdd, sizeAdd, reset))
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating quota for folder %#v: %v", mappedPath, err)
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return &RecordNotFoundError{err: fmt.Sprintf("folder %v does not exist, unable to update quota", mappedPath)}
+	}
+	providerLog(logger.LevelDebug, "quota updated for folder %#v, files increment: %v size increment: %v is reset? %v",
+		mappedPath, filesAdd, sizeAdd, reset)
+	return nil
+}
+
+func (p MongoDBProvider) getUsedFolderQuota(mappedPath string) (int, int64, error) {
+	folder, err := p.getFolderByPath(mappedPath)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get quota for folder %#v error: %v", mappedPath, err)
+		return 0, 0, err
+	}
+	return folder.UsedQuotaFiles, folder.UsedQuotaSize, err
+}
+
+func (p MongoDBProvider) softDeleteUser(user User) error {
+	deletedUser := DeletedUser{
+		DeletedAt: utils.GetTimeAsMsSinceEpoch(time.Now()),
+		User:      user,
+	}
+	data, err := json.Marshal(deletedUser)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	// a previously deleted user with the same username is replaced
+	_, err = p.deletedUsers().ReplaceOne(ctx, bson.M{"_id": user.Username}, mongoDBDeletedUser{
+		Username:  user.Username,
+		DeletedAt: deletedUser.DeletedAt,
+		Data:      string(data),
+	}, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	return p.deleteUserInternal(ctx, user)
+}
+
+func (p MongoDBProvider) getDeletedUsers(limit, offset int, order, username string) ([]DeletedUser, error) {
+	deletedUsers := make([]DeletedUser, 0, limit)
+	if limit <= 0 {
+		return deletedUsers, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	filter := bson.M{}
+	if username != "" {
+		filter["_id"] = username
+	}
+	cursor, err := p.deletedUsers().Find(ctx, filter, options.Find().SetSort(bson.M{"_id": getMongoDBSortOrder(order)}).
+		SetSkip(int64(offset)).SetLimit(int64(limit)))
+	if err != nil {
+		return deletedUsers, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc mongoDBDeletedUser
+		if err = cursor.Decode(&doc); err != nil {
+			return deletedUsers, err
+		}
+		var deletedUser DeletedUser
+		if err = json.Unmarshal([]byte(doc.Data), &deletedUser); err != nil {
+			return deletedUsers, err
+		}
+		deletedUser.HideConfidentialData()
+		deletedUsers = append(deletedUsers, deletedUser)
+	}
+	return deletedUsers, cursor.Err()
+}
+
+func (p MongoDBProvider) deletedUserExists(username string) (DeletedUser, error) {
+	var deletedUser DeletedUser
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	var doc mongoDBDeletedUser
+	err := p.deletedUsers().FindOne(ctx, bson.M{"_id": username}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = &RecordNotFoundError{err: fmt.Sprintf("deleted user %v does not exist", username)}
+		}
+		return deletedUser, err
+	}
+	err = json.Unmarshal([]byte(doc.Data), &deletedUser)
+	return deletedUser, err
+}
+
+func (p MongoDBProvider) purgeDeletedUser(username string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	_, err := p.deletedUsers().DeleteOne(ctx, bson.M{"_id": username})
+	return err
+}
+
+func (p MongoDBProvider) purgeDeletedUsers(before int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBLongQueryTimeout)
+	defer cancel()
+
+	res, err := p.deletedUsers().DeleteMany(ctx, bson.M{"deleted_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+// rotateSecrets rotates the secrets for users, soft deleted users and groups.
+// Transactions require a replica set so each document is updated only if its data
+// was not modified after it was read, if an update fails the already updated
+// documents are restored
+func (p MongoDBProvider) rotateSecrets(rotator *secretsRotator) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBLongQueryTimeout)
+	defer cancel()
+
+	users, err := getMongoDBSecretsUpdates(ctx, p.users(), func(cursor *mongo.Cursor) (*mongoDBSecretsUpdate, error) {
+		var doc mongoDBUser
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		user, err := doc.getUser()
+		if err != nil {
+			return nil, err
+		}
+		updated, err := rotator.rotateUser(&user)
+		if err != nil || !updated {
+			return nil, err
+		}
+		data, err := json.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		return &mongoDBSecretsUpdate{id: doc.ID, name: fmt.Sprintf("user %#v", doc.Username),
+			oldData: doc.Data, newData: string(data)}, nil
+	})
+	if err != nil {
+		return err
+	}
+	deletedUsers, err := getMongoDBSecretsUpdates(ctx, p.deletedUsers(), func(cursor *mongo.Cursor) (*mongoDBSecretsUpdate, error) {
+		var doc mongoDBDeletedUser
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		var deletedUser DeletedUser
+		if err := json.Unmarshal([]byte(doc.Data), &deletedUser); err != nil {
+			return nil, err
+		}
+		updated, err := rotator.rotateDeletedUser(&deletedUser.User)
+		if err != nil || !updated {
+			return nil, err
+		}
+		data, err := json.Marshal(deletedUser)
+		if err != nil {
+			return nil, err
+		}
+		return &mongoDBSecretsUpdate{id: doc.Username, name: fmt.Sprintf("deleted user %#v", doc.Username),
+			oldData: doc.Data, newData: string(data)}, nil
+	})
+	if err != nil {
+		return err
+	}
+	groups, err := getMongoDBSecretsUpdates(ctx, p.groups(), func(cursor *mongo.Cursor) (*mongoDBSecretsUpdate, error) {
+		var doc mongoDBGroup
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		group, err := doc.getGroup()
+		if err != nil {
+			return nil, err
+		}
+		updated, err := rotator.rotateGroup(&group)
+		if err != nil || !updated {
+			return nil, err
+		}
+		data, err := json.Marshal(group)
+		if err != nil {
+			return nil, err
+		}
+		return &mongoDBSecretsUpdate{id: doc.ID, name: fmt.Sprintf("group %#v", doc.Name),
+			oldData: doc.Data, newData: string(data)}, nil
+	})
+	if err != nil {
+		return err
+	}
+	collections := []*mongo.Collection{p.users(), p.deletedUsers(), p.groups()}
+	var applied [][]mongoDBSecretsUpdate
+	for idx, updates := range [][]mongoDBSecretsUpdate{users, deletedUsers, groups} {
+		for updateIdx, update := range updates {
+			if err := update.apply(ctx, collections[idx], update.oldData, update.newData); err != nil {
+				providerLog(logger.LevelError, "unable to update %v during secrets rotation: %v", update.name, err)
+				applied = append(applied, updates[:updateIdx])
+				p.rollbackSecretsUpdates(ctx, collections, applied)
+				return fmt.Errorf("unable to update %v, the secrets rotation was rolled back: %w", update.name, err)
+			}
+		}
+		applied = append(applied, updates)
+	}
+	return nil
+}
+
+func (p MongoDBProvider) rollbackSecretsUpdates(ctx context.Context, collections []*mongo.Collection,
+	applied [][]mongoDBSecretsUpdate) {
+	for idx, updates := range applied {
+		for _, update := range updates {
+			if err := update.apply(ctx, collections[idx], update.newData, update.oldData); err != nil {
+				providerLog(logger.LevelError, "unable to restore the secrets for %v: %v", update.name, err)
+			}
+		}
+	}
+}
+
+// mongoDBSecretsUpdate defines the data update for a document with rotated secrets
+type mongoDBSecretsUpdate struct {
+	id      interface{}
+	name    string
+	oldData string
+	newData string
+}
+
+// apply replaces the document data if it still matches the expected one
+func (u *mongoDBSecretsUpdate) apply(ctx context.Context, collection *mongo.Collection, expected, data string) error {
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": u.id, "data": expected}, bson.M{"$set": bson.M{"data": data}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%v was modified or removed after it was read", u.name)
+	}
+	return nil
+}
+
+func getMongoDBSecretsUpdates(ctx context.Context, collection *mongo.Collection,
+	rotate func(cursor *mongo.Cursor) (*mongoDBSecretsUpdate, error)) ([]mongoDBSecretsUpdate, error) {
+	var updates []mongoDBSecretsUpdate
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return updates, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		update, err := rotate(cursor)
+		if err != nil {
+			return updates, err
+		}
+		if update != nil {
+			updates = append(updates, *update)
+		}
+	}
+	return updates, cursor.Err()
+}
+
+func (p MongoDBProvider) close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	return p.client.Disconnect(ctx)
+}
+
+func (p MongoDBProvider) reloadConfig() error {
+	return nil
+}
+
+// initializeDatabase creates the indexes and saves the schema version
+func (p MongoDBProvider) initializeDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBLongQueryTimeout)
+	defer cancel()
+
+	_, err := p.getDatabaseVersion(ctx)
+	if err == nil {
+		return ErrNoInitRequired
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+	logger.InfoToConsole("creating initial database schema, version %v", mongoDBDatabaseVersion)
+	providerLog(logger.LevelInfo, "creating initial database schema, version %v", mongoDBDatabaseVersion)
+	indexes := map[string][]mongo.IndexModel{
+		mongoDBUsersCollection: {
+			{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "groups", Value: 1}}},
+		},
+		mongoDBFoldersCollection: {
+			{Keys: bson.D{{Key: "mapped_path", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		mongoDBGroupsCollection: {
+			{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		mongoDBDeletedUsersCollection: {
+			{Keys: bson.D{{Key: "deleted_at", Value: 1}}},
+		},
+	}
+	for collection, models := range indexes {
+		if _, err = p.database.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			providerLog(logger.LevelWarn, "unable to create the indexes for the collection %#v: %v", collection, err)
+			return err
+		}
+	}
+	return p.updateDatabaseVersion(ctx, mongoDBDatabaseVersion)
+}
+
+func (p MongoDBProvider) migrateDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoDBQueryTimeout)
+	defer cancel()
+
+	dbVersion, err := p.getDatabaseVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if dbVersion.Version == mongoDBDatabaseVersion {
+		providerLog(logger.LevelDebug, "mongodb database is up to date, current version: %v", dbVersion.Version)
+		return ErrNoInitRequired
+	}
+	return fmt.Errorf("Database version not handled: %v", dbVersion.Version)
+}
+
+func (p MongoDBProvider) getDatabaseVersion(ctx context.Context) (schemaVersion, error) {
+	var dbVersion schemaVersion
+	var doc struct {
+		Version int `bson:"version"`
+	}
+	err := p.database.Collection(mongoDBSchemaCollection).FindOne(ctx, bson.M{"_id": mongoDBSchemaVersionID}).Decode(&doc)
+	dbVersion.Version = doc.Version
+	return dbVersion, err
+}
+
+func (p MongoDBProvider) updateDatabaseVersion(ctx context.Context, version int) error {
+	_, err := p.database.Collection(mongoDBSchemaCollection).UpdateOne(ctx, bson.M{"_id": mongoDBSchemaVersionID},
+		bson.M{"$set": bson.M{"version": version}}, options.Update().SetUpsert(true))
+	return err
+}
+
+// getNextID returns the next ID for the given collection, the IDs are generated using
+// an atomically incremented counter
+func (p MongoDBProvider) getNextID(ctx context.Context, collection string) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := p.database.Collection(mongoDBCountersCollection).FindOneAndUpdate(ctx, bson.M{"_id": collection},
+		bson.M{"$inc": bson.M{"seq": int64(1)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&counter)
+	return counter.Seq, err
+}
+
+func (p MongoDBProvider) getUserDocument(ctx context.Context, filter bson.M) (mongoDBUser, error) {
+	var doc mongoDBUser
+	err := p.users().FindOne(ctx, filter).Decode(&doc)
+	return doc, err
+}
+
+// updateUserData updates the stored user, the quota and last login fields are not modified
+func (p MongoDBProvider) updateUserData(ctx context.Context, user User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	res, err := p.users().UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{
+		"$set": bson.M{"groups": user.Groups, "data": string(data)},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", user.Username)}
+	}
+	return nil
+}
+
+// getUserWithFolders returns the user from the given document, the virtual folders
+// are joined with the stored folders to get the quota and the other folder fields
+func (p MongoDBProvider) getUserWithFolders(ctx context.Context, doc mongoDBUser) (User, error) {
+	user, err := doc.getUser()
+	if err != nil || len(user.VirtualFolders) == 0 {
+		return user, err
+	}
+	var mappedPaths []string
+	for _, folder := range user.VirtualFolders {
+		mappedPaths = append(mappedPaths, folder.MappedPath)
+	}
+	cursor, err := p.folders().Find(ctx, bson.M{"mapped_path": bson.M{"$in": mappedPaths}})
+	if err != nil {
+		return user, err
+	}
+	var docs []mongoDBFolder
+	if err = cursor.All(ctx, &docs); err != nil {
+		return user, err
+	}
+	baseFolders := make(map[string]vfs.BaseVirtualFolder)
+	for idx := range docs {
+		baseFolder, err := docs[idx].getFolder()
+		if err != nil {
+			return user, err
+		}
+		baseFolders[baseFolder.MappedPath] = baseFolder
+	}
+	var folders []vfs.VirtualFolder
+	for _, folder := range user.VirtualFolders {
+		baseFolder, ok := baseFolders[folder.MappedPath]
+		if !ok {
+			continue
+		}
+		folder.UsedQuotaFiles = baseFolder.UsedQuotaFiles
+		folder.UsedQuotaSize = baseFolder.UsedQuotaSize
+		folder.LastQuotaUpdate = baseFolder.LastQuotaUpdate
+		folder.ID = baseFolder.ID
+		folder.Metadata = baseFolder.Metadata
+		folders = append(folders, folder)
+	}
+	user.VirtualFolders = folders
+	return user, nil
+}
+
+func (p MongoDBProvider) checkUserGroups(ctx context.Context, user User) error {
+	for _, name := range user.Groups {
+		err := p.groups().FindOne(ctx, bson.M{"name": name}).Err()
+		if err == mongo.ErrNoDocuments {
+			return &ValidationError{field: "groups", err: fmt.Sprintf("group %#v does not exist", name)}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p MongoDBProvider) addUserToFolderMapping(ctx context.Context, folder vfs.VirtualFolder, username string) error {
+	err := p.folders().FindOne(ctx, bson.M{"mapped_path": folder.MappedPath}).Err()
+	if err == mongo.ErrNoDocuments {
+		// folder does not exists, try to create
+		baseFolder := folder.BaseVirtualFolder
+		baseFolder.Users = nil
+		err = p.addFolderInternal(ctx, baseFolder)
+		if isMongoDBDuplicateKeyError(err) {
+			// added concurrently
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = p.folders().UpdateOne(ctx, bson.M{"mapped_path": folder.MappedPath},
+		bson.M{"$addToSet": bson.M{"users": username}})
+	return err
+}
+
+func (p MongoDBProvider) removeUserFromFolderMapping(ctx context.Context, folder vfs.VirtualFolder, username string) error {
+	// if the folder does not exist there is no associated user
+	_, err := p.folders().UpdateOne(ctx, bson.M{"mapped_path": folder.MappedPath},
+		bson.M{"$pull": bson.M{"users": username}})
+	return err
+}
+
+func getMongoDBQuotaUpdate(filesAdd int, sizeAdd int64, reset bool) bson.M {
+	lastQuotaUpdate := utils.GetTimeAsMsSinceEpoch(time.Now())
+	if reset {
+		return bson.M{
+			"$set": bson.M{
+				"used_quota_size":   sizeAdd,
+				"used_quota_files":  filesAdd,
+				"last_quota_update": lastQuotaUpdate,
+			},
+		}
+	}
+	return bson.M{
+		"$inc": bson.M{
+			"used_quota_size":  sizeAdd,
+			"used_quota_files": filesAdd,
+		},
+		"$set": bson.M{
+			"last_quota_update": lastQuotaUpdate,
+		},
+	}
+}
+
+func getMongoDBSortOrder(order string) int {
+	if order == OrderDESC {
+		return -1
+	}
+	return 1
+}
+
+func isMongoDBDuplicateKeyError(err error) bool {
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			if e.Code == mongoDBDuplicateKeyCode {
+				return true
+			}
+		}
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code == mongoDBDuplicateKeyCode
+	}
+	return false
+}
+
+// getMongoDBPort returns the configured port as string, the default port is used if not set
+func getMongoDBPort() string {
+	if config.Port > 0 {
+		return strconv.Itoa(config.Port)
+	}
+	return "27017"
+}
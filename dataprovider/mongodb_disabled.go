@@ -0,0 +1,17 @@
+// +build nomongodb
+
+package dataprovider
+
+import (
+	"errors"
+
+	"github.com/drakkan/sftpgo/version"
+)
+
+func init() {
+	version.AddFeature("-mongodb")
+}
+
+func initializeMongoDBProvider() error {
+	return errors.New("MongoDB disabled at build time")
+}
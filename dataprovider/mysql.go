@@ -38,11 +38,34 @@ const (
 		"ALTER TABLE `{{folders_mapping}}` ADD CONSTRAINT `unique_mapping` UNIQUE (`user_id`, `folder_id`);" +
 		"ALTER TABLE `{{folders_mapping}}` ADD CONSTRAINT `folders_mapping_folder_id_fk_folders_id` FOREIGN KEY (`folder_id`) REFERENCES `{{folders}}` (`id`) ON DELETE CASCADE;" +
 		"ALTER TABLE `{{folders_mapping}}` ADD CONSTRAINT `folders_mapping_user_id_fk_users_id` FOREIGN KEY (`user_id`) REFERENCES `{{users}}` (`id`) ON DELETE CASCADE;"
+	mysqlV6SQL = "ALTER TABLE `{{users}}` ADD COLUMN `metadata` longtext NULL;" +
+		"ALTER TABLE `{{folders}}` ADD COLUMN `metadata` longtext NULL;"
+	mysqlV7SQL = "ALTER TABLE `{{users}}` ADD COLUMN `used_download_volume` bigint DEFAULT 0 NOT NULL;" +
+		"ALTER TABLE `{{users}}` ADD COLUMN `download_volume_period_start` bigint DEFAULT 0 NOT NULL;"
+	mysqlV8SQL = "ALTER TABLE `{{users}}` ADD COLUMN `totp_config` longtext NULL;"
+	mysqlV9SQL = "CREATE TABLE `{{groups}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `name` varchar(255) NOT NULL UNIQUE, " +
+		"`description` longtext NULL, `permissions` longtext NULL, `quota_size` bigint NOT NULL, `quota_files` integer NOT NULL, " +
+		"`upload_bandwidth` integer NOT NULL, `download_bandwidth` integer NOT NULL, `filters` longtext NULL, `filesystem` longtext NULL);" +
+		"CREATE TABLE `{{groups_mapping}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `group_id` integer NOT NULL, `user_id` integer NOT NULL);" +
+		"ALTER TABLE `{{groups_mapping}}` ADD CONSTRAINT `unique_group_mapping` UNIQUE (`user_id`, `group_id`);" +
+		"ALTER TABLE `{{groups_mapping}}` ADD CONSTRAINT `user_groups_mapping_group_id_fk_groups_id` FOREIGN KEY (`group_id`) REFERENCES `{{groups}}` (`id`) ON DELETE CASCADE;" +
+		"ALTER TABLE `{{groups_mapping}}` ADD CONSTRAINT `user_groups_mapping_user_id_fk_users_id` FOREIGN KEY (`user_id`) REFERENCES `{{users}}` (`id`) ON DELETE CASCADE;"
+	mysqlV10SQL = "CREATE TABLE `{{deleted_users}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `username` varchar(255) NOT NULL UNIQUE, " +
+		"`deleted_at` bigint NOT NULL, `data` longtext NOT NULL);" +
+		"CREATE INDEX `deleted_users_deleted_at_idx` ON `{{deleted_users}}` (`deleted_at`);"
+	mysqlV11SQL = "ALTER TABLE `{{users}}` ADD COLUMN `last_expiration_warning` bigint DEFAULT 0 NOT NULL;"
+	mysqlV12SQL = "ALTER TABLE `{{users}}` ADD COLUMN `auth_backend` varchar(32) DEFAULT '' NOT NULL;"
+	mysqlV13SQL = "ALTER TABLE `{{users}}` ADD COLUMN `login_failures` integer DEFAULT 0 NOT NULL;" +
+		"ALTER TABLE `{{users}}` ADD COLUMN `last_login_failure` bigint DEFAULT 0 NOT NULL;" +
+		"ALTER TABLE `{{users}}` ADD COLUMN `locked_until` bigint DEFAULT 0 NOT NULL;"
+	mysqlV14SQL = "ALTER TABLE `{{users}}` ADD COLUMN `last_totp_step` bigint DEFAULT 0 NOT NULL;"
 )
 
 // MySQLProvider auth provider for MySQL/MariaDB database
 type MySQLProvider struct {
 	dbHandle *sql.DB
+	// handle used for read only queries, it points to dbHandle if no read replica is configured
+	readHandle *sql.DB
 }
 
 func init() {
@@ -58,7 +81,19 @@ func initializeMySQLProvider() error {
 			getMySQLConnectionString(true), config.PoolSize)
 		dbHandle.SetMaxOpenConns(config.PoolSize)
 		dbHandle.SetConnMaxLifetime(1800 * time.Second)
-		provider = MySQLProvider{dbHandle: dbHandle}
+		readHandle := dbHandle
+		if config.ReadConnectionString != "" {
+			readHandle, err = sql.Open("mysql", config.ReadConnectionString)
+			if err != nil {
+				providerLog(logger.LevelWarn, "error creating mysql read replica database handler: %v", err)
+				dbHandle.Close()
+				return err
+			}
+			providerLog(logger.LevelDebug, "mysql read replica database handle created, pool size: %v", config.PoolSize)
+			readHandle.SetMaxOpenConns(config.PoolSize)
+			readHandle.SetConnMaxLifetime(1800 * time.Second)
+		}
+		provider = MySQLProvider{dbHandle: dbHandle, readHandle: readHandle}
 	} else {
 		providerLog(logger.LevelWarn, "error creating mysql database handler, connection string: %#v, error: %v",
 			getMySQLConnectionString(true), err)
@@ -85,15 +120,15 @@ func (p MySQLProvider) checkAvailability() error {
 }
 
 func (p MySQLProvider) validateUserAndPass(username, password, ip, protocol string) (User, error) {
-	return sqlCommonValidateUserAndPass(username, password, ip, protocol, p.dbHandle)
+	return sqlCommonValidateUserAndPass(username, password, ip, protocol, p.readHandle)
 }
 
 func (p MySQLProvider) validateUserAndPubKey(username string, publicKey []byte) (User, string, error) {
-	return sqlCommonValidateUserAndPubKey(username, publicKey, p.dbHandle)
+	return sqlCommonValidateUserAndPubKey(username, publicKey, p.readHandle)
 }
 
 func (p MySQLProvider) getUserByID(ID int64) (User, error) {
-	return sqlCommonGetUserByID(ID, p.dbHandle)
+	return sqlCommonGetUserByID(ID, p.readHandle)
 }
 
 func (p MySQLProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
@@ -104,10 +139,26 @@ func (p MySQLProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
 
+func (p MySQLProvider) updateDownloadVolume(username string, sizeAdd int64, periodStart int64) error {
+	return sqlCommonUpdateDownloadVolume(username, sizeAdd, periodStart, p.dbHandle)
+}
+
 func (p MySQLProvider) updateLastLogin(username string) error {
 	return sqlCommonUpdateLastLogin(username, p.dbHandle)
 }
 
+func (p MySQLProvider) updateLastExpirationWarning(username string, expirationDate int64) (bool, error) {
+	return sqlCommonUpdateLastExpirationWarning(username, expirationDate, p.dbHandle)
+}
+
+func (p MySQLProvider) updateLastTOTPStep(username string, step int64) (bool, error) {
+	return sqlCommonUpdateLastTOTPStep(username, step, p.dbHandle)
+}
+
+func (p MySQLProvider) updateLoginFailures(username string, prev, next loginFailures) (bool, error) {
+	return sqlCommonUpdateLoginFailures(username, prev, next, p.dbHandle)
+}
+
 func (p MySQLProvider) userExists(username string) (User, error) {
 	return sqlCommonCheckUserExists(username, p.dbHandle)
 }
@@ -125,19 +176,23 @@ func (p MySQLProvider) deleteUser(user User) error {
 }
 
 func (p MySQLProvider) dumpUsers() ([]User, error) {
-	return sqlCommonDumpUsers(p.dbHandle)
+	return sqlCommonDumpUsers(p.readHandle)
 }
 
-func (p MySQLProvider) getUsers(limit int, offset int, order string, username string) ([]User, error) {
-	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
+func (p MySQLProvider) getUsers(limit int, offset int, order string, username string, metadata MetadataFilter) ([]User, error) {
+	return sqlCommonGetUsers(limit, offset, order, username, metadata, p.readHandle)
 }
 
 func (p MySQLProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
-	return sqlCommonDumpFolders(p.dbHandle)
+	return sqlCommonDumpFolders(p.readHandle)
 }
 
 func (p MySQLProvider) getFolders(limit, offset int, order, folderPath string) ([]vfs.BaseVirtualFolder, error) {
-	return sqlCommonGetFolders(limit, offset, order, folderPath, p.dbHandle)
+	return sqlCommonGetFolders(limit, offset, order, folderPath, p.readHandle)
+}
+
+func (p MySQLProvider) rotateSecrets(rotator *secretsRotator) error {
+	return sqlCommonRotateSecrets(rotator, p.dbHandle)
 }
 
 func (p MySQLProvider) getFolderByPath(mappedPath string) (vfs.BaseVirtualFolder, error) {
@@ -162,7 +217,60 @@ func (p MySQLProvider) getUsedFolderQuota(mappedPath string) (int, int64, error)
 	return sqlCommonGetFolderUsedQuota(mappedPath, p.dbHandle)
 }
 
+func (p MySQLProvider) groupExists(name string) (Group, error) {
+	return sqlCommonCheckGroupExists(name, p.dbHandle)
+}
+
+func (p MySQLProvider) getGroupByID(ID int64) (Group, error) {
+	return sqlCommonGetGroupByID(ID, p.readHandle)
+}
+
+func (p MySQLProvider) getGroups(limit, offset int, order, name string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, name, p.readHandle)
+}
+
+func (p MySQLProvider) addGroup(group Group) error {
+	return sqlCommonAddGroup(group, p.dbHandle)
+}
+
+func (p MySQLProvider) updateGroup(group Group) error {
+	return sqlCommonUpdateGroup(group, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteGroup(group Group) error {
+	return sqlCommonDeleteGroup(group, p.dbHandle)
+}
+
+func (p MySQLProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.readHandle)
+}
+
+func (p MySQLProvider) softDeleteUser(user User) error {
+	return sqlCommonSoftDeleteUser(user, p.dbHandle)
+}
+
+func (p MySQLProvider) getDeletedUsers(limit, offset int, order, username string) ([]DeletedUser, error) {
+	return sqlCommonGetDeletedUsers(limit, offset, order, username, p.readHandle)
+}
+
+func (p MySQLProvider) deletedUserExists(username string) (DeletedUser, error) {
+	return sqlCommonGetDeletedUser(username, p.dbHandle)
+}
+
+func (p MySQLProvider) purgeDeletedUser(username string) error {
+	return sqlCommonPurgeDeletedUser(username, p.dbHandle)
+}
+
+func (p MySQLProvider) purgeDeletedUsers(before int64) (int, error) {
+	return sqlCommonPurgeDeletedUsers(before, p.dbHandle)
+}
+
 func (p MySQLProvider) close() error {
+	if p.readHandle != p.dbHandle {
+		if err := p.readHandle.Close(); err != nil {
+			providerLog(logger.LevelWarn, "error closing read replica database handle: %v", err)
+		}
+	}
 	return p.dbHandle.Close()
 }
 
@@ -217,6 +325,24 @@ func (p MySQLProvider) migrateDatabase() error {
 		return updateMySQLDatabaseFromV3(p.dbHandle)
 	case 4:
 		return updateMySQLDatabaseFromV4(p.dbHandle)
+	case 5:
+		return updateMySQLDatabaseFromV5(p.dbHandle)
+	case 6:
+		return updateMySQLDatabaseFromV6(p.dbHandle)
+	case 7:
+		return updateMySQLDatabaseFromV7(p.dbHandle)
+	case 8:
+		return updateMySQLDatabaseFromV8(p.dbHandle)
+	case 9:
+		return updateMySQLDatabaseFromV9(p.dbHandle)
+	case 10:
+		return updateMySQLDatabaseFromV10(p.dbHandle)
+	case 11:
+		return updateMySQLDatabaseFromV11(p.dbHandle)
+	case 12:
+		return updateMySQLDatabaseFromV12(p.dbHandle)
+	case 13:
+		return updateMySQLDatabaseFromV13(p.dbHandle)
 	default:
 		return fmt.Errorf("Database version not handled: %v", dbVersion.Version)
 	}
@@ -247,7 +373,79 @@ func updateMySQLDatabaseFromV3(dbHandle *sql.DB) error {
 }
 
 func updateMySQLDatabaseFromV4(dbHandle *sql.DB) error {
-	return updateMySQLDatabaseFrom4To5(dbHandle)
+	err := updateMySQLDatabaseFrom4To5(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV5(dbHandle)
+}
+
+func updateMySQLDatabaseFromV5(dbHandle *sql.DB) error {
+	err := updateMySQLDatabaseFrom5To6(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV6(dbHandle)
+}
+
+func updateMySQLDatabaseFromV6(dbHandle *sql.DB) error {
+	err := updateMySQLDatabaseFrom6To7(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV7(dbHandle)
+}
+
+func updateMySQLDatabaseFromV7(dbHandle *sql.DB) error {
+	err := updateMySQLDatabaseFrom7To8(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV8(dbHandle)
+}
+
+func updateMySQLDatabaseFromV8(dbHandle *sql.DB) error {
+	err := updateMySQLDatabaseFrom8To9(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV9(dbHandle)
+}
+
+func updateMySQLDatabaseFromV9(dbHandle *sql.DB) error {
+	err := updateMySQLDatabaseFrom9To10(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV10(dbHandle)
+}
+
+func updateMySQLDatabaseFromV10(dbHandle *sql.DB) error {
+	err := updateMySQLDatabaseFrom10To11(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV11(dbHandle)
+}
+
+func updateMySQLDatabaseFromV11(dbHandle *sql.DB) error {
+	err := updateMySQLDatabaseFrom11To12(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV12(dbHandle)
+}
+
+func updateMySQLDatabaseFromV12(dbHandle *sql.DB) error {
+	err := updateMySQLDatabaseFrom12To13(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateMySQLDatabaseFromV13(dbHandle)
+}
+
+func updateMySQLDatabaseFromV13(dbHandle *sql.DB) error {
+	return updateMySQLDatabaseFrom13To14(dbHandle)
 }
 
 func updateMySQLDatabaseFrom1To2(dbHandle *sql.DB) error {
@@ -271,3 +469,69 @@ func updateMySQLDatabaseFrom3To4(dbHandle *sql.DB) error {
 func updateMySQLDatabaseFrom4To5(dbHandle *sql.DB) error {
 	return sqlCommonUpdateDatabaseFrom4To5(dbHandle)
 }
+
+func updateMySQLDatabaseFrom5To6(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 5 -> 6")
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	sql := strings.ReplaceAll(mysqlV6SQL, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 6)
+}
+
+func updateMySQLDatabaseFrom6To7(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 6 -> 7")
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	sql := strings.ReplaceAll(mysqlV7SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 7)
+}
+
+func updateMySQLDatabaseFrom7To8(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 7 -> 8")
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	sql := strings.ReplaceAll(mysqlV8SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 8)
+}
+
+func updateMySQLDatabaseFrom8To9(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 8 -> 9")
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	sql := strings.ReplaceAll(mysqlV9SQL, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{groups}}", sqlTableGroups)
+	sql = strings.ReplaceAll(sql, "{{groups_mapping}}", sqlTableGroupsMapping)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 9)
+}
+
+func updateMySQLDatabaseFrom9To10(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 9 -> 10")
+	providerLog(logger.LevelInfo, "updating database version: 9 -> 10")
+	sql := strings.ReplaceAll(mysqlV10SQL, "{{deleted_users}}", sqlTableDeletedUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 10)
+}
+
+func updateMySQLDatabaseFrom10To11(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 10 -> 11")
+	providerLog(logger.LevelInfo, "updating database version: 10 -> 11")
+	sql := strings.ReplaceAll(mysqlV11SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 11)
+}
+
+func updateMySQLDatabaseFrom11To12(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 11 -> 12")
+	providerLog(logger.LevelInfo, "updating database version: 11 -> 12")
+	sql := strings.ReplaceAll(mysqlV12SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 12)
+}
+
+func updateMySQLDatabaseFrom12To13(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 12 -> 13")
+	providerLog(logger.LevelInfo, "updating database version: 12 -> 13")
+	sql := strings.ReplaceAll(mysqlV13SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 13)
+}
+
+func updateMySQLDatabaseFrom13To14(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 13 -> 14")
+	providerLog(logger.LevelInfo, "updating database version: 13 -> 14")
+	sql := strings.ReplaceAll(mysqlV14SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 14)
+}
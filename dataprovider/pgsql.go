@@ -37,11 +37,33 @@ ALTER TABLE "{{folders_mapping}}" ADD CONSTRAINT "folders_mapping_user_id_fk_use
 CREATE INDEX "folders_mapping_folder_id_idx" ON "{{folders_mapping}}" ("folder_id");
 CREATE INDEX "folders_mapping_user_id_idx" ON "{{folders_mapping}}" ("user_id");
 `
+	pgsqlV6SQL = `ALTER TABLE "{{users}}" ADD COLUMN "metadata" text NULL;
+ALTER TABLE "{{folders}}" ADD COLUMN "metadata" text NULL;`
+	pgsqlV7SQL = `ALTER TABLE "{{users}}" ADD COLUMN "used_download_volume" bigint DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "download_volume_period_start" bigint DEFAULT 0 NOT NULL;`
+	pgsqlV8SQL = `ALTER TABLE "{{users}}" ADD COLUMN "totp_config" text NULL;`
+	pgsqlV9SQL = `CREATE TABLE "{{groups}}" ("id" serial NOT NULL PRIMARY KEY, "name" varchar(255) NOT NULL UNIQUE, "description" text NULL, "permissions" text NULL, "quota_size" bigint NOT NULL, "quota_files" integer NOT NULL, "upload_bandwidth" integer NOT NULL, "download_bandwidth" integer NOT NULL, "filters" text NULL, "filesystem" text NULL);
+CREATE TABLE "{{groups_mapping}}" ("id" serial NOT NULL PRIMARY KEY, "group_id" integer NOT NULL, "user_id" integer NOT NULL);
+ALTER TABLE "{{groups_mapping}}" ADD CONSTRAINT "unique_group_mapping" UNIQUE ("user_id", "group_id");
+ALTER TABLE "{{groups_mapping}}" ADD CONSTRAINT "user_groups_mapping_group_id_fk_groups_id" FOREIGN KEY ("group_id") REFERENCES "{{groups}}" ("id") MATCH SIMPLE ON UPDATE NO ACTION ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED;
+ALTER TABLE "{{groups_mapping}}" ADD CONSTRAINT "user_groups_mapping_user_id_fk_users_id" FOREIGN KEY ("user_id") REFERENCES "{{users}}" ("id") MATCH SIMPLE ON UPDATE NO ACTION ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED;
+CREATE INDEX "user_groups_mapping_group_id_idx" ON "{{groups_mapping}}" ("group_id");
+CREATE INDEX "user_groups_mapping_user_id_idx" ON "{{groups_mapping}}" ("user_id");`
+	pgsqlV10SQL = `CREATE TABLE "{{deleted_users}}" ("id" serial NOT NULL PRIMARY KEY, "username" varchar(255) NOT NULL UNIQUE, "deleted_at" bigint NOT NULL, "data" text NOT NULL);
+CREATE INDEX "deleted_users_deleted_at_idx" ON "{{deleted_users}}" ("deleted_at");`
+	pgsqlV11SQL = `ALTER TABLE "{{users}}" ADD COLUMN "last_expiration_warning" bigint DEFAULT 0 NOT NULL;`
+	pgsqlV12SQL = `ALTER TABLE "{{users}}" ADD COLUMN "auth_backend" varchar(32) DEFAULT '' NOT NULL;`
+	pgsqlV13SQL = `ALTER TABLE "{{users}}" ADD COLUMN "login_failures" integer DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "last_login_failure" bigint DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "locked_until" bigint DEFAULT 0 NOT NULL;`
+	pgsqlV14SQL = `ALTER TABLE "{{users}}" ADD COLUMN "last_totp_step" bigint DEFAULT 0 NOT NULL;`
 )
 
 // PGSQLProvider auth provider for PostgreSQL database
 type PGSQLProvider struct {
 	dbHandle *sql.DB
+	// handle used for read only queries, it points to dbHandle if no read replica is configured
+	readHandle *sql.DB
 }
 
 func init() {
@@ -56,7 +78,18 @@ func initializePGSQLProvider() error {
 		providerLog(logger.LevelDebug, "postgres database handle created, connection string: %#v, pool size: %v",
 			getPGSQLConnectionString(true), config.PoolSize)
 		dbHandle.SetMaxOpenConns(config.PoolSize)
-		provider = PGSQLProvider{dbHandle: dbHandle}
+		readHandle := dbHandle
+		if config.ReadConnectionString != "" {
+			readHandle, err = sql.Open("postgres", config.ReadConnectionString)
+			if err != nil {
+				providerLog(logger.LevelWarn, "error creating postgres read replica database handler: %v", err)
+				dbHandle.Close()
+				return err
+			}
+			providerLog(logger.LevelDebug, "postgres read replica database handle created, pool size: %v", config.PoolSize)
+			readHandle.SetMaxOpenConns(config.PoolSize)
+		}
+		provider = PGSQLProvider{dbHandle: dbHandle, readHandle: readHandle}
 	} else {
 		providerLog(logger.LevelWarn, "error creating postgres database handler, connection string: %#v, error: %v",
 			getPGSQLConnectionString(true), err)
@@ -84,15 +117,15 @@ func (p PGSQLProvider) checkAvailability() error {
 }
 
 func (p PGSQLProvider) validateUserAndPass(username, password, ip, protocol string) (User, error) {
-	return sqlCommonValidateUserAndPass(username, password, ip, protocol, p.dbHandle)
+	return sqlCommonValidateUserAndPass(username, password, ip, protocol, p.readHandle)
 }
 
 func (p PGSQLProvider) validateUserAndPubKey(username string, publicKey []byte) (User, string, error) {
-	return sqlCommonValidateUserAndPubKey(username, publicKey, p.dbHandle)
+	return sqlCommonValidateUserAndPubKey(username, publicKey, p.readHandle)
 }
 
 func (p PGSQLProvider) getUserByID(ID int64) (User, error) {
-	return sqlCommonGetUserByID(ID, p.dbHandle)
+	return sqlCommonGetUserByID(ID, p.readHandle)
 }
 
 func (p PGSQLProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
@@ -103,10 +136,26 @@ func (p PGSQLProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
 
+func (p PGSQLProvider) updateDownloadVolume(username string, sizeAdd int64, periodStart int64) error {
+	return sqlCommonUpdateDownloadVolume(username, sizeAdd, periodStart, p.dbHandle)
+}
+
 func (p PGSQLProvider) updateLastLogin(username string) error {
 	return sqlCommonUpdateLastLogin(username, p.dbHandle)
 }
 
+func (p PGSQLProvider) updateLastExpirationWarning(username string, expirationDate int64) (bool, error) {
+	return sqlCommonUpdateLastExpirationWarning(username, expirationDate, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateLastTOTPStep(username string, step int64) (bool, error) {
+	return sqlCommonUpdateLastTOTPStep(username, step, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateLoginFailures(username string, prev, next loginFailures) (bool, error) {
+	return sqlCommonUpdateLoginFailures(username, prev, next, p.dbHandle)
+}
+
 func (p PGSQLProvider) userExists(username string) (User, error) {
 	return sqlCommonCheckUserExists(username, p.dbHandle)
 }
@@ -124,19 +173,23 @@ func (p PGSQLProvider) deleteUser(user User) error {
 }
 
 func (p PGSQLProvider) dumpUsers() ([]User, error) {
-	return sqlCommonDumpUsers(p.dbHandle)
+	return sqlCommonDumpUsers(p.readHandle)
 }
 
-func (p PGSQLProvider) getUsers(limit int, offset int, order string, username string) ([]User, error) {
-	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
+func (p PGSQLProvider) getUsers(limit int, offset int, order string, username string, metadata MetadataFilter) ([]User, error) {
+	return sqlCommonGetUsers(limit, offset, order, username, metadata, p.readHandle)
 }
 
 func (p PGSQLProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
-	return sqlCommonDumpFolders(p.dbHandle)
+	return sqlCommonDumpFolders(p.readHandle)
 }
 
 func (p PGSQLProvider) getFolders(limit, offset int, order, folderPath string) ([]vfs.BaseVirtualFolder, error) {
-	return sqlCommonGetFolders(limit, offset, order, folderPath, p.dbHandle)
+	return sqlCommonGetFolders(limit, offset, order, folderPath, p.readHandle)
+}
+
+func (p PGSQLProvider) rotateSecrets(rotator *secretsRotator) error {
+	return sqlCommonRotateSecrets(rotator, p.dbHandle)
 }
 
 func (p PGSQLProvider) getFolderByPath(mappedPath string) (vfs.BaseVirtualFolder, error) {
@@ -161,7 +214,60 @@ func (p PGSQLProvider) getUsedFolderQuota(mappedPath string) (int, int64, error)
 	return sqlCommonGetFolderUsedQuota(mappedPath, p.dbHandle)
 }
 
+func (p PGSQLProvider) groupExists(name string) (Group, error) {
+	return sqlCommonCheckGroupExists(name, p.dbHandle)
+}
+
+func (p PGSQLProvider) getGroupByID(ID int64) (Group, error) {
+	return sqlCommonGetGroupByID(ID, p.readHandle)
+}
+
+func (p PGSQLProvider) getGroups(limit, offset int, order, name string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, name, p.readHandle)
+}
+
+func (p PGSQLProvider) addGroup(group Group) error {
+	return sqlCommonAddGroup(group, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateGroup(group Group) error {
+	return sqlCommonUpdateGroup(group, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteGroup(group Group) error {
+	return sqlCommonDeleteGroup(group, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.readHandle)
+}
+
+func (p PGSQLProvider) softDeleteUser(user User) error {
+	return sqlCommonSoftDeleteUser(user, p.dbHandle)
+}
+
+func (p PGSQLProvider) getDeletedUsers(limit, offset int, order, username string) ([]DeletedUser, error) {
+	return sqlCommonGetDeletedUsers(limit, offset, order, username, p.readHandle)
+}
+
+func (p PGSQLProvider) deletedUserExists(username string) (DeletedUser, error) {
+	return sqlCommonGetDeletedUser(username, p.dbHandle)
+}
+
+func (p PGSQLProvider) purgeDeletedUser(username string) error {
+	return sqlCommonPurgeDeletedUser(username, p.dbHandle)
+}
+
+func (p PGSQLProvider) purgeDeletedUsers(before int64) (int, error) {
+	return sqlCommonPurgeDeletedUsers(before, p.dbHandle)
+}
+
 func (p PGSQLProvider) close() error {
+	if p.readHandle != p.dbHandle {
+		if err := p.readHandle.Close(); err != nil {
+			providerLog(logger.LevelWarn, "error closing read replica database handle: %v", err)
+		}
+	}
 	return p.dbHandle.Close()
 }
 
@@ -216,6 +322,24 @@ func (p PGSQLProvider) migrateDatabase() error {
 		return updatePGSQLDatabaseFromV3(p.dbHandle)
 	case 4:
 		return updatePGSQLDatabaseFromV4(p.dbHandle)
+	case 5:
+		return updatePGSQLDatabaseFromV5(p.dbHandle)
+	case 6:
+		return updatePGSQLDatabaseFromV6(p.dbHandle)
+	case 7:
+		return updatePGSQLDatabaseFromV7(p.dbHandle)
+	case 8:
+		return updatePGSQLDatabaseFromV8(p.dbHandle)
+	case 9:
+		return updatePGSQLDatabaseFromV9(p.dbHandle)
+	case 10:
+		return updatePGSQLDatabaseFromV10(p.dbHandle)
+	case 11:
+		return updatePGSQLDatabaseFromV11(p.dbHandle)
+	case 12:
+		return updatePGSQLDatabaseFromV12(p.dbHandle)
+	case 13:
+		return updatePGSQLDatabaseFromV13(p.dbHandle)
 	default:
 		return fmt.Errorf("Database version not handled: %v", dbVersion.Version)
 	}
@@ -246,7 +370,79 @@ func updatePGSQLDatabaseFromV3(dbHandle *sql.DB) error {
 }
 
 func updatePGSQLDatabaseFromV4(dbHandle *sql.DB) error {
-	return updatePGSQLDatabaseFrom4To5(dbHandle)
+	err := updatePGSQLDatabaseFrom4To5(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV5(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV5(dbHandle *sql.DB) error {
+	err := updatePGSQLDatabaseFrom5To6(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV6(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV6(dbHandle *sql.DB) error {
+	err := updatePGSQLDatabaseFrom6To7(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV7(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV7(dbHandle *sql.DB) error {
+	err := updatePGSQLDatabaseFrom7To8(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV8(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV8(dbHandle *sql.DB) error {
+	err := updatePGSQLDatabaseFrom8To9(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV9(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV9(dbHandle *sql.DB) error {
+	err := updatePGSQLDatabaseFrom9To10(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV10(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV10(dbHandle *sql.DB) error {
+	err := updatePGSQLDatabaseFrom10To11(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV11(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV11(dbHandle *sql.DB) error {
+	err := updatePGSQLDatabaseFrom11To12(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV12(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV12(dbHandle *sql.DB) error {
+	err := updatePGSQLDatabaseFrom12To13(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updatePGSQLDatabaseFromV13(dbHandle)
+}
+
+func updatePGSQLDatabaseFromV13(dbHandle *sql.DB) error {
+	return updatePGSQLDatabaseFrom13To14(dbHandle)
 }
 
 func updatePGSQLDatabaseFrom1To2(dbHandle *sql.DB) error {
@@ -270,3 +466,69 @@ func updatePGSQLDatabaseFrom3To4(dbHandle *sql.DB) error {
 func updatePGSQLDatabaseFrom4To5(dbHandle *sql.DB) error {
 	return sqlCommonUpdateDatabaseFrom4To5(dbHandle)
 }
+
+func updatePGSQLDatabaseFrom5To6(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 5 -> 6")
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	sql := strings.ReplaceAll(pgsqlV6SQL, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 6)
+}
+
+func updatePGSQLDatabaseFrom6To7(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 6 -> 7")
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	sql := strings.ReplaceAll(pgsqlV7SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 7)
+}
+
+func updatePGSQLDatabaseFrom7To8(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 7 -> 8")
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	sql := strings.ReplaceAll(pgsqlV8SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 8)
+}
+
+func updatePGSQLDatabaseFrom8To9(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 8 -> 9")
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	sql := strings.ReplaceAll(pgsqlV9SQL, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{groups}}", sqlTableGroups)
+	sql = strings.ReplaceAll(sql, "{{groups_mapping}}", sqlTableGroupsMapping)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 9)
+}
+
+func updatePGSQLDatabaseFrom9To10(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 9 -> 10")
+	providerLog(logger.LevelInfo, "updating database version: 9 -> 10")
+	sql := strings.ReplaceAll(pgsqlV10SQL, "{{deleted_users}}", sqlTableDeletedUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 10)
+}
+
+func updatePGSQLDatabaseFrom10To11(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 10 -> 11")
+	providerLog(logger.LevelInfo, "updating database version: 10 -> 11")
+	sql := strings.ReplaceAll(pgsqlV11SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 11)
+}
+
+func updatePGSQLDatabaseFrom11To12(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 11 -> 12")
+	providerLog(logger.LevelInfo, "updating database version: 11 -> 12")
+	sql := strings.ReplaceAll(pgsqlV12SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 12)
+}
+
+func updatePGSQLDatabaseFrom12To13(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 12 -> 13")
+	providerLog(logger.LevelInfo, "updating database version: 12 -> 13")
+	sql := strings.ReplaceAll(pgsqlV13SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 13)
+}
+
+func updatePGSQLDatabaseFrom13To14(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 13 -> 14")
+	providerLog(logger.LevelInfo, "updating database version: 13 -> 14")
+	sql := strings.ReplaceAll(pgsqlV14SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 14)
+}
@@ -0,0 +1,253 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	defaultRedisCacheTTL       = 60
+	defaultRedisCacheKeyPrefix = "sftpgo_user_"
+	redisCacheTimeout          = 5 * time.Second
+	// the generation keys must outlive any in flight cache fill, see getUserForLogin
+	redisCacheGenerationTTL = 3600
+	redisCacheGenerationKey = "_gen"
+)
+
+// RedisCacheConfig defines an optional Redis cache for the user lookups done at
+// login time. The cached users are invalidated when they are updated or deleted,
+// so the cache can be shared between multiple SFTPGo instances using the same
+// data provider. Quota and download volume reads always bypass the cache
+type RedisCacheConfig struct {
+	// Redis server address, for example "127.0.0.1:6379". Empty means disabled
+	Address string `json:"address" mapstructure:"address"`
+	// optional password for the Redis server
+	Password string `json:"password" mapstructure:"password"`
+	// Redis database to use
+	DB int `json:"db" mapstructure:"db"`
+	// time to live, as seconds, for the cached users
+	TTL int `json:"ttl" mapstructure:"ttl"`
+	// prefix for the cache keys, the username is appended to this prefix
+	KeyPrefix string `json:"key_prefix" mapstructure:"key_prefix"`
+}
+
+// IsEnabled returns true if the Redis cache is configured
+func (c *RedisCacheConfig) IsEnabled() bool {
+	return c.Address != ""
+}
+
+func (c *RedisCacheConfig) validate() error {
+	if !c.IsEnabled() {
+		return nil
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultRedisCacheTTL
+	}
+	if c.KeyPrefix == "" {
+		c.KeyPrefix = defaultRedisCacheKeyPrefix
+	}
+	if c.DB < 0 {
+		return errors.New("invalid redis cache configuration: the database cannot be negative")
+	}
+	return nil
+}
+
+func (c *RedisCacheConfig) getPool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", c.Address,
+				redis.DialPassword(c.Password),
+				redis.DialDatabase(c.DB),
+				redis.DialConnectTimeout(redisCacheTimeout),
+				redis.DialReadTimeout(redisCacheTimeout),
+				redis.DialWriteTimeout(redisCacheTimeout))
+		},
+		TestOnBorrow: func(conn redis.Conn, lastUsed time.Time) error {
+			if time.Since(lastUsed) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+}
+
+// cachedProvider wraps a data provider and caches the users looked up at login
+// time inside Redis. Cache errors are logged and the wrapped provider is used,
+// so a Redis failure never prevents the users from logging in
+type cachedProvider struct {
+	Provider
+	pool      *redis.Pool
+	ttl       int
+	keyPrefix string
+}
+
+func newCachedProvider(p Provider, conf RedisCacheConfig) *cachedProvider {
+	return &cachedProvider{
+		Provider:  p,
+		pool:      conf.getPool(),
+		ttl:       conf.TTL,
+		keyPrefix: conf.KeyPrefix,
+	}
+}
+
+func (p *cachedProvider) getCacheKey(username string) string {
+	return p.keyPrefix + username
+}
+
+// getGenerationKey returns the key incremented each time the given user is invalidated
+func (p *cachedProvider) getGenerationKey(username string) string {
+	return p.keyPrefix + username + redisCacheGenerationKey
+}
+
+func (p *cachedProvider) getCachedUser(username string) (User, bool) {
+	var user User
+	conn := p.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", p.getCacheKey(username)))
+	if err != nil {
+		if err != redis.ErrNil {
+			providerLog(logger.LevelWarn, "unable to get user %#v from the redis cache: %v", username, err)
+		}
+		return user, false
+	}
+	if err = json.Unmarshal(data, &user); err != nil {
+		providerLog(logger.LevelWarn, "unable to decode cached user %#v: %v", username, err)
+		return user, false
+	}
+	return user, true
+}
+
+// invalidateUser removes the given user from the cache and increments its generation,
+// so a concurrent cache fill that read the user before the update is discarded
+func (p *cachedProvider) invalidateUser(username string) {
+	conn := p.pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		providerLog(logger.LevelWarn, "unable to remove user %#v from the redis cache: %v", username, err)
+		return
+	}
+	conn.Send("INCR", p.getGenerationKey(username))                            //nolint:errcheck
+	conn.Send("EXPIRE", p.getGenerationKey(username), redisCacheGenerationTTL) //nolint:errcheck
+	conn.Send("DEL", p.getCacheKey(username))                                  //nolint:errcheck
+	if _, err := conn.Do("EXEC"); err != nil {
+		providerLog(logger.LevelWarn, "unable to remove user %#v from the redis cache: %v", username, err)
+	}
+}
+
+// getUserForLogin returns the cached user or reads it from the wrapped provider and caches it.
+// The generation key is watched before reading the user from the provider, if the user is
+// invalidated before the user is cached the transaction is aborted, so a stale user read
+// before a concurrent update is never cached
+func (p *cachedProvider) getUserForLogin(username string) (User, error) {
+	if user, ok := p.getCachedUser(username); ok {
+		return user, nil
+	}
+	conn := p.pool.Get()
+	defer conn.Close()
+
+	_, errWatch := conn.Do("WATCH", p.getGenerationKey(username))
+	if errWatch != nil {
+		providerLog(logger.LevelWarn, "unable to watch user %#v inside the redis cache: %v", username, errWatch)
+	}
+	user, err := p.Provider.userExists(username)
+	if err != nil || errWatch != nil {
+		conn.Do("UNWATCH") //nolint:errcheck
+		return user, err
+	}
+	data, err := json.Marshal(user)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to encode user %#v for the redis cache: %v", user.Username, err)
+		conn.Do("UNWATCH") //nolint:errcheck
+		return user, nil
+	}
+	if err = conn.Send("MULTI"); err == nil {
+		conn.Send("SET", p.getCacheKey(username), data, "EX", p.ttl) //nolint:errcheck
+		var reply interface{}
+		reply, err = conn.Do("EXEC")
+		if err == nil && reply == nil {
+			providerLog(logger.LevelDebug, "user %#v not cached, it was updated while reading it", username)
+		}
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to add user %#v to the redis cache: %v", user.Username, err)
+	}
+	return user, nil
+}
+
+func (p *cachedProvider) validateUserAndPass(username, password, ip, protocol string) (User, error) {
+	var user User
+	if password == "" {
+		return user, errors.New("Credentials cannot be null or empty")
+	}
+	user, err := p.getUserForLogin(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error authenticating user %#v: %v", username, err)
+		return user, err
+	}
+	return checkUserAndPass(user, password, ip, protocol)
+}
+
+func (p *cachedProvider) validateUserAndPubKey(username string, pubKey []byte) (User, string, error) {
+	var user User
+	if len(pubKey) == 0 {
+		return user, "", errors.New("Credentials cannot be null or empty")
+	}
+	user, err := p.getUserForLogin(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error authenticating user %#v: %v", username, err)
+		return user, "", err
+	}
+	return checkUserAndPubKey(user, pubKey)
+}
+
+func (p *cachedProvider) updateUser(user User) error {
+	err := p.Provider.updateUser(user)
+	p.invalidateUser(user.Username)
+	return err
+}
+
+func (p *cachedProvider) deleteUser(user User) error {
+	err := p.Provider.deleteUser(user)
+	p.invalidateUser(user.Username)
+	return err
+}
+
+func (p *cachedProvider) softDeleteUser(user User) error {
+	err := p.Provider.softDeleteUser(user)
+	p.invalidateUser(user.Username)
+	return err
+}
+
+// deleteFolder removes the folder and invalidates the users it is mapped to,
+// the cached users include the virtual folders
+func (p *cachedProvider) deleteFolder(folder vfs.BaseVirtualFolder) error {
+	folders, err := p.Provider.getFolders(1, 0, OrderASC, folder.MappedPath)
+	if err != nil {
+		return err
+	}
+	err = p.Provider.deleteFolder(folder)
+	for _, f := range folders {
+		for _, username := range f.Users {
+			p.invalidateUser(username)
+		}
+	}
+	return err
+}
+
+func (p *cachedProvider) close() error {
+	if err := p.pool.Close(); err != nil {
+		providerLog(logger.LevelWarn, "unable to close the redis cache pool: %v", err)
+	}
+	return p.Provider.close()
+}
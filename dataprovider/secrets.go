@@ -0,0 +1,197 @@
+package dataprovider
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// SecretsRotationResult defines the result of a secrets rotation
+type SecretsRotationResult struct {
+	// true if the secrets were only checked and nothing was updated
+	DryRun bool `json:"dry_run"`
+	// number of users, soft deleted users and groups with rotated secrets
+	Users        int `json:"users"`
+	DeletedUsers int `json:"deleted_users"`
+	Groups       int `json:"groups"`
+	// number of rotated secrets
+	Secrets int `json:"secrets"`
+	// number of secrets referencing an external secrets store, they are not
+	// managed by SFTPGo and so they are not rotated
+	References int `json:"references"`
+}
+
+// secretsRotationMu serializes the secrets rotations
+var secretsRotationMu sync.Mutex
+
+type rotatableSecret struct {
+	field  string
+	secret *vfs.Secret
+}
+
+// RotateSecrets decrypts all the secrets stored inside the data provider, for users, soft deleted
+// users and groups, and encrypts them again using the configured secret provider. For the local
+// provider new random keys are generated, if a different provider is configured the secrets are
+// migrated to it.
+// The stored objects are read and updated inside a single data provider transaction, so a secret
+// that cannot be decrypted or a failed update aborts the rotation without changes. The MongoDB
+// provider has no transactions, each object is updated only if it was not modified after it was
+// read and the already updated objects are restored if the rotation fails.
+// If dryRun is true the secrets are only decrypted to check they can be rotated.
+// ManageUsers configuration must be set to 1 to enable this method
+func RotateSecrets(dryRun bool) (SecretsRotationResult, error) {
+	rotator := &secretsRotator{
+		dryRun: dryRun,
+		result: SecretsRotationResult{
+			DryRun: dryRun,
+		},
+	}
+	if config.ManageUsers == 0 {
+		return rotator.result, &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	secretsRotationMu.Lock()
+	defer secretsRotationMu.Unlock()
+
+	if err := provider.rotateSecrets(rotator); err != nil {
+		providerLog(logger.LevelError, "unable to rotate the secrets, dry run? %v: %v", dryRun, err)
+		return rotator.result, err
+	}
+	result := rotator.result
+	if dryRun {
+		providerLog(logger.LevelInfo, "secrets rotation dry run completed, users: %v, deleted users: %v, groups: %v, "+
+			"secrets: %v, references: %v", result.Users, result.DeletedUsers, result.Groups, result.Secrets, result.References)
+		return result, nil
+	}
+	clearWebDAVUsersCache()
+	providerLog(logger.LevelInfo, "secrets rotation completed, users: %v, deleted users: %v, groups: %v, secrets: %v, "+
+		"references: %v", result.Users, result.DeletedUsers, result.Groups, result.Secrets, result.References)
+	return result, nil
+}
+
+// secretsRotator rotates the secrets of the objects read by the data provider
+// inside its transaction and collects the rotation result
+type secretsRotator struct {
+	dryRun bool
+	result SecretsRotationResult
+}
+
+// rotateUser rotates the secrets for the given user, it returns true if the
+// user must be updated. GCS credentials stored on file are written again, if the
+// transaction is rolled back the file still contains a valid secret
+func (r *secretsRotator) rotateUser(user *User) (bool, error) {
+	if err := addCredentialsToUser(user); err != nil {
+		return false, fmt.Errorf("unable to load the GCS credentials for user %#v: %w", user.Username, err)
+	}
+	numRotated, err := rotateSecrets(getUserSecrets(user), user.Username, r.dryRun, &r.result)
+	if err != nil {
+		return false, fmt.Errorf("unable to rotate secrets for user %#v: %w", user.Username, err)
+	}
+	if numRotated == 0 {
+		return false, nil
+	}
+	r.result.Users++
+	if r.dryRun {
+		return false, nil
+	}
+	if err := saveGCSCredentials(user); err != nil {
+		return false, fmt.Errorf("unable to save the GCS credentials for user %#v: %w", user.Username, err)
+	}
+	return true, nil
+}
+
+// rotateDeletedUser rotates the secrets for the given soft deleted user, the
+// GCS credentials are stored with the user so no file is written
+func (r *secretsRotator) rotateDeletedUser(user *User) (bool, error) {
+	numRotated, err := rotateSecrets(getUserSecrets(user), user.Username, r.dryRun, &r.result)
+	if err != nil {
+		return false, fmt.Errorf("unable to rotate secrets for deleted user %#v: %w", user.Username, err)
+	}
+	if numRotated == 0 {
+		return false, nil
+	}
+	r.result.DeletedUsers++
+	return !r.dryRun, nil
+}
+
+// rotateGroup rotates the secrets for the given group, it returns true if the
+// group must be updated
+func (r *secretsRotator) rotateGroup(group *Group) (bool, error) {
+	numRotated, err := rotateSecrets(getFsConfigSecrets(&group.FsConfig), group.Name, r.dryRun, &r.result)
+	if err != nil {
+		return false, fmt.Errorf("unable to rotate secrets for group %#v: %w", group.Name, err)
+	}
+	if numRotated == 0 {
+		return false, nil
+	}
+	r.result.Groups++
+	return !r.dryRun, nil
+}
+
+// rotateSecrets decrypts the given secrets and, if dryRun is false, encrypts them again
+// using the configured secret provider. It returns the number of rotated secrets
+func rotateSecrets(secrets []rotatableSecret, additionalData string, dryRun bool, result *SecretsRotationResult) (int, error) {
+	numRotated := 0
+	for _, s := range secrets {
+		if !s.secret.IsEncrypted() {
+			continue
+		}
+		if s.secret.IsReference() {
+			result.References++
+			continue
+		}
+		secret := *s.secret
+		if err := secret.Decrypt(); err != nil {
+			return numRotated, fmt.Errorf("unable to decrypt %v: %w", s.field, err)
+		}
+		if !dryRun {
+			secret.AdditionalData = additionalData
+			if err := secret.Encrypt(); err != nil {
+				return numRotated, fmt.Errorf("unable to encrypt %v: %w", s.field, err)
+			}
+			*s.secret = secret
+		}
+		numRotated++
+		result.Secrets++
+	}
+	return numRotated, nil
+}
+
+func getUserSecrets(user *User) []rotatableSecret {
+	secrets := getFsConfigSecrets(&user.FsConfig)
+	return append(secrets, rotatableSecret{field: "totp_config.secret", secret: &user.TOTPConfig.Secret})
+}
+
+func getFsConfigSecrets(fsConfig *Filesystem) []rotatableSecret {
+	switch fsConfig.Provider {
+	case S3FilesystemProvider:
+		return []rotatableSecret{
+			{field: "s3config.access_secret", secret: &fsConfig.S3Config.AccessSecret},
+			{field: "s3config.sse_customer_key", secret: &fsConfig.S3Config.SSECustomerKey},
+		}
+	case GCSFilesystemProvider:
+		return []rotatableSecret{
+			{field: "gcsconfig.credentials", secret: &fsConfig.GCSConfig.Credentials},
+		}
+	case AzureBlobFilesystemProvider:
+		return []rotatableSecret{
+			{field: "azblobconfig.account_key", secret: &fsConfig.AzBlobConfig.AccountKey},
+		}
+	case B2FilesystemProvider:
+		return []rotatableSecret{
+			{field: "b2config.application_key", secret: &fsConfig.B2Config.ApplicationKey},
+		}
+	case SFTPFilesystemProvider:
+		return []rotatableSecret{
+			{field: "sftpconfig.password", secret: &fsConfig.SFTPConfig.Password},
+			{field: "sftpconfig.private_key", secret: &fsConfig.SFTPConfig.PrivateKey},
+		}
+	case CryptedFilesystemProvider:
+		return []rotatableSecret{
+			{field: "cryptconfig.passphrase", secret: &fsConfig.CryptConfig.Passphrase},
+		}
+	default:
+		return nil
+	}
+}
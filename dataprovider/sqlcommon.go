@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -14,7 +15,7 @@ import (
 )
 
 const (
-	sqlDatabaseVersion     = 5
+	sqlDatabaseVersion     = 14
 	initialDBVersionSQL    = "INSERT INTO {{schema_version}} (version) VALUES (1);"
 	defaultSQLQueryTimeout = 10 * time.Second
 	longSQLQueryTimeout    = 60 * time.Second
@@ -43,7 +44,7 @@ func getUserByUsername(username string, dbHandle sqlQuerier) (User, error) {
 	if err != nil {
 		return user, err
 	}
-	return getUserWithVirtualFolders(user, dbHandle)
+	return getUserWithRelations(user, dbHandle)
 }
 
 func sqlCommonValidateUserAndPass(username, password, ip, protocol string, dbHandle *sql.DB) (User, error) {
@@ -95,7 +96,7 @@ func sqlCommonGetUserByID(ID int64, dbHandle *sql.DB) (User, error) {
 	if err != nil {
 		return user, err
 	}
-	return getUserWithVirtualFolders(user, dbHandle)
+	return getUserWithRelations(user, dbHandle)
 }
 
 func sqlCommonUpdateQuota(username string, filesAdd int, sizeAdd int64, reset bool, dbHandle *sql.DB) error {
@@ -118,6 +119,26 @@ func sqlCommonUpdateQuota(username string, filesAdd int, sizeAdd int64, reset bo
 	return err
 }
 
+func sqlCommonUpdateDownloadVolume(username string, sizeAdd int64, periodStart int64, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUpdateDownloadVolumeQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, periodStart, sizeAdd, sizeAdd, periodStart, username)
+	if err == nil {
+		providerLog(logger.LevelDebug, "download volume updated for user %#v, size increment: %v period start: %v",
+			username, sizeAdd, periodStart)
+	} else {
+		providerLog(logger.LevelWarn, "error updating download volume for user %#v: %v", username, err)
+	}
+	return err
+}
+
 func sqlCommonGetUsedQuota(username string, dbHandle *sql.DB) (int, int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -158,6 +179,73 @@ func sqlCommonUpdateLastLogin(username string, dbHandle *sql.DB) error {
 	return err
 }
 
+func sqlCommonUpdateLastTOTPStep(username string, step int64, dbHandle *sql.DB) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUpdateLastTOTPStepQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return false, err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, step, username, step)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating last TOTP step for user %#v: %v", username, err)
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func sqlCommonUpdateLoginFailures(username string, prev, next loginFailures, dbHandle *sql.DB) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUpdateLoginFailuresQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return false, err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, next.Failures, next.LastFailure, next.LockedUntil, username, prev.Failures,
+		prev.LastFailure, prev.LockedUntil)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating login failures for user %#v: %v", username, err)
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func sqlCommonUpdateLastExpirationWarning(username string, expirationDate int64, dbHandle *sql.DB) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUpdateLastExpirationWarningQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return false, err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, expirationDate, username, expirationDate)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating last expiration warning for user %#v: %v", username, err)
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
 func sqlCommonCheckUserExists(username string, dbHandle *sql.DB) (User, error) {
 	var user User
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
@@ -174,7 +262,7 @@ func sqlCommonCheckUserExists(username string, dbHandle *sql.DB) (User, error) {
 	if err != nil {
 		return user, err
 	}
-	return getUserWithVirtualFolders(user, dbHandle)
+	return getUserWithRelations(user, dbHandle)
 }
 
 func sqlCommonAddUser(user User, dbHandle *sql.DB) error {
@@ -216,9 +304,14 @@ func sqlCommonAddUser(user User, dbHandle *sql.DB) error {
 		sqlCommonRollbackTransaction(tx)
 		return err
 	}
+	totpConfig, err := user.GetTOTPConfigAsJSON()
+	if err != nil {
+		sqlCommonRollbackTransaction(tx)
+		return err
+	}
 	_, err = stmt.ExecContext(ctx, user.Username, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
 		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate, string(filters),
-		string(fsConfig))
+		string(fsConfig), getMetadataForDb(user.Metadata), string(totpConfig), user.AuthBackend)
 	if err != nil {
 		sqlCommonRollbackTransaction(tx)
 		return err
@@ -228,6 +321,11 @@ func sqlCommonAddUser(user User, dbHandle *sql.DB) error {
 		sqlCommonRollbackTransaction(tx)
 		return err
 	}
+	err = generateGroupsMapping(ctx, user, tx)
+	if err != nil {
+		sqlCommonRollbackTransaction(tx)
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -270,9 +368,14 @@ func sqlCommonUpdateUser(user User, dbHandle *sql.DB) error {
 		sqlCommonRollbackTransaction(tx)
 		return err
 	}
+	totpConfig, err := user.GetTOTPConfigAsJSON()
+	if err != nil {
+		sqlCommonRollbackTransaction(tx)
+		return err
+	}
 	_, err = stmt.ExecContext(ctx, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
 		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate,
-		string(filters), string(fsConfig), user.ID)
+		string(filters), string(fsConfig), getMetadataForDb(user.Metadata), string(totpConfig), user.AuthBackend, user.ID)
 	if err != nil {
 		sqlCommonRollbackTransaction(tx)
 		return err
@@ -282,6 +385,11 @@ func sqlCommonUpdateUser(user User, dbHandle *sql.DB) error {
 		sqlCommonRollbackTransaction(tx)
 		return err
 	}
+	err = generateGroupsMapping(ctx, user, tx)
+	if err != nil {
+		sqlCommonRollbackTransaction(tx)
+		return err
+	}
 	return tx.Commit()
 }
 
@@ -327,42 +435,66 @@ func sqlCommonDumpUsers(dbHandle sqlQuerier) ([]User, error) {
 		}
 		users = append(users, u)
 	}
-	return getUsersWithVirtualFolders(users, dbHandle)
+	return getUsersWithRelations(users, dbHandle)
 }
 
-func sqlCommonGetUsers(limit int, offset int, order string, username string, dbHandle sqlQuerier) ([]User, error) {
+func sqlCommonGetUsers(limit int, offset int, order string, username string, metadata MetadataFilter,
+	dbHandle sqlQuerier) ([]User, error) {
 	users := make([]User, 0, limit)
+	if limit <= 0 {
+		return users, nil
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
-	q := getUsersQuery(order, username)
+	q := getUsersQuery(order, username, metadata)
 	stmt, err := dbHandle.PrepareContext(ctx, q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
 		return nil, err
 	}
 	defer stmt.Close()
-	var rows *sql.Rows
+	var args []interface{}
 	if len(username) > 0 {
-		rows, err = stmt.QueryContext(ctx, username, limit, offset) //nolint:rowserrcheck // rows.Err() is checked
+		args = append(args, username)
+	}
+	if metadata.IsEmpty() {
+		args = append(args, limit, offset)
 	} else {
-		rows, err = stmt.QueryContext(ctx, limit, offset) //nolint:rowserrcheck // rows.Err() is checked
+		args = append(args, metadata.getSQLPattern())
 	}
+	rows, err := stmt.QueryContext(ctx, args...) //nolint:rowserrcheck // rows.Err() is checked
 	if err == nil {
 		defer rows.Close()
+		itNum := 0
 		for rows.Next() {
 			u, err := getUserFromDbRow(nil, rows)
 			if err != nil {
 				return users, err
 			}
+			if !metadata.IsEmpty() {
+				if !metadata.matches(u.Metadata) {
+					continue
+				}
+				itNum++
+				if itNum <= offset {
+					continue
+				}
+			}
 			u.HideConfidentialData()
 			users = append(users, u)
+			if len(users) >= limit {
+				break
+			}
 		}
+		// the rows must be released before loading the relations, the iteration
+		// could be stopped before reading all the results
+		rows.Close()
 	}
 	err = rows.Err()
 	if err != nil {
 		return users, err
 	}
-	return getUsersWithVirtualFolders(users, dbHandle)
+	return getUsersWithRelations(users, dbHandle)
 }
 
 func updateUserPermissionsFromDb(user *User, permissions string) error {
@@ -391,15 +523,23 @@ func getUserFromDbRow(row *sql.Row, rows *sql.Rows) (User, error) {
 	var publicKey sql.NullString
 	var filters sql.NullString
 	var fsConfig sql.NullString
+	var metadata sql.NullString
+	var totpConfig sql.NullString
 	var err error
 	if row != nil {
 		err = row.Scan(&user.ID, &user.Username, &password, &publicKey, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
 			&user.QuotaSize, &user.QuotaFiles, &permissions, &user.UsedQuotaSize, &user.UsedQuotaFiles, &user.LastQuotaUpdate,
-			&user.UploadBandwidth, &user.DownloadBandwidth, &user.ExpirationDate, &user.LastLogin, &user.Status, &filters, &fsConfig)
+			&user.UploadBandwidth, &user.DownloadBandwidth, &user.ExpirationDate, &user.LastLogin, &user.Status, &filters, &fsConfig,
+			&metadata, &user.UsedDownloadVolume, &user.DownloadVolumePeriodStart, &totpConfig,
+			&user.LastExpirationWarning, &user.AuthBackend, &user.LoginFailures, &user.LastLoginFailure, &user.LockedUntil,
+			&user.LastTOTPStep)
 	} else {
 		err = rows.Scan(&user.ID, &user.Username, &password, &publicKey, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
 			&user.QuotaSize, &user.QuotaFiles, &permissions, &user.UsedQuotaSize, &user.UsedQuotaFiles, &user.LastQuotaUpdate,
-			&user.UploadBandwidth, &user.DownloadBandwidth, &user.ExpirationDate, &user.LastLogin, &user.Status, &filters, &fsConfig)
+			&user.UploadBandwidth, &user.DownloadBandwidth, &user.ExpirationDate, &user.LastLogin, &user.Status, &filters, &fsConfig,
+			&metadata, &user.UsedDownloadVolume, &user.DownloadVolumePeriodStart, &totpConfig,
+			&user.LastExpirationWarning, &user.AuthBackend, &user.LoginFailures, &user.LastLoginFailure, &user.LockedUntil,
+			&user.LastTOTPStep)
 	}
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -440,9 +580,40 @@ func getUserFromDbRow(row *sql.Row, rows *sql.Rows) (User, error) {
 			user.FsConfig = fs
 		}
 	}
+	if totpConfig.Valid {
+		var config UserTOTPConfig
+		err = json.Unmarshal([]byte(totpConfig.String), &config)
+		if err == nil {
+			user.TOTPConfig = config
+		}
+	}
+	user.Metadata = getMetadataFromDb(metadata)
 	return user, err
 }
 
+// getMetadataForDb returns the custom metadata as JSON or NULL if there are no metadata
+func getMetadataForDb(metadata map[string]string) sql.NullString {
+	if len(metadata) == 0 {
+		return sql.NullString{}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+func getMetadataFromDb(metadata sql.NullString) map[string]string {
+	if !metadata.Valid {
+		return nil
+	}
+	var result map[string]string
+	if err := json.Unmarshal([]byte(metadata.String), &result); err != nil || len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
 func sqlCommonCheckFolderExists(ctx context.Context, name string, dbHandle sqlQuerier) (vfs.BaseVirtualFolder, error) {
 	var folder vfs.BaseVirtualFolder
 	q := getFolderByPathQuery()
@@ -453,10 +624,13 @@ func sqlCommonCheckFolderExists(ctx context.Context, name string, dbHandle sqlQu
 	}
 	defer stmt.Close()
 	row := stmt.QueryRowContext(ctx, name)
-	err = row.Scan(&folder.ID, &folder.MappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles, &folder.LastQuotaUpdate)
+	var metadata sql.NullString
+	err = row.Scan(&folder.ID, &folder.MappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles, &folder.LastQuotaUpdate,
+		&metadata)
 	if err == sql.ErrNoRows {
 		return folder, &RecordNotFoundError{err: err.Error()}
 	}
+	folder.Metadata = getMetadataFromDb(metadata)
 	return folder, err
 }
 
@@ -492,7 +666,8 @@ func sqlCommonAddFolder(folder vfs.BaseVirtualFolder, dbHandle sqlQuerier) error
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.ExecContext(ctx, folder.MappedPath, folder.UsedQuotaSize, folder.UsedQuotaFiles, folder.LastQuotaUpdate)
+	_, err = stmt.ExecContext(ctx, folder.MappedPath, folder.UsedQuotaSize, folder.UsedQuotaFiles, folder.LastQuotaUpdate,
+		getMetadataForDb(folder.Metadata))
 	return err
 }
 
@@ -528,10 +703,13 @@ func sqlCommonDumpFolders(dbHandle sqlQuerier) ([]vfs.BaseVirtualFolder, error)
 	defer rows.Close()
 	for rows.Next() {
 		var folder vfs.BaseVirtualFolder
-		err = rows.Scan(&folder.ID, &folder.MappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles, &folder.LastQuotaUpdate)
+		var metadata sql.NullString
+		err = rows.Scan(&folder.ID, &folder.MappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles, &folder.LastQuotaUpdate,
+			&metadata)
 		if err != nil {
 			return folders, err
 		}
+		folder.Metadata = getMetadataFromDb(metadata)
 		folders = append(folders, folder)
 	}
 	err = rows.Err()
@@ -564,10 +742,13 @@ func sqlCommonGetFolders(limit, offset int, order, folderPath string, dbHandle s
 	defer rows.Close()
 	for rows.Next() {
 		var folder vfs.BaseVirtualFolder
-		err = rows.Scan(&folder.ID, &folder.MappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles, &folder.LastQuotaUpdate)
+		var metadata sql.NullString
+		err = rows.Scan(&folder.ID, &folder.MappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles, &folder.LastQuotaUpdate,
+			&metadata)
 		if err != nil {
 			return folders, err
 		}
+		folder.Metadata = getMetadataFromDb(metadata)
 		folders = append(folders, folder)
 	}
 
@@ -621,8 +802,53 @@ func generateVirtualFoldersMapping(ctx context.Context, user User, dbHandle sqlQ
 	return err
 }
 
-func getUserWithVirtualFolders(user User, dbHandle sqlQuerier) (User, error) {
-	users, err := getUsersWithVirtualFolders([]User{user}, dbHandle)
+func sqlCommonClearGroupMapping(ctx context.Context, user User, dbHandle sqlQuerier) error {
+	q := getClearGroupMappingQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, user.Username)
+	return err
+}
+
+func sqlCommonAddGroupMapping(ctx context.Context, user User, group Group, dbHandle sqlQuerier) error {
+	q := getAddGroupMappingQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, group.ID, user.Username)
+	return err
+}
+
+func generateGroupsMapping(ctx context.Context, user User, dbHandle sqlQuerier) error {
+	err := sqlCommonClearGroupMapping(ctx, user, dbHandle)
+	if err != nil {
+		return err
+	}
+	for _, name := range user.Groups {
+		group, err := sqlCommonGetGroupByName(ctx, name, dbHandle)
+		if err != nil {
+			if _, ok := err.(*RecordNotFoundError); ok {
+				return &ValidationError{field: "groups", err: fmt.Sprintf("group %#v does not exist", name)}
+			}
+			return err
+		}
+		err = sqlCommonAddGroupMapping(ctx, user, group, dbHandle)
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func getUserWithRelations(user User, dbHandle sqlQuerier) (User, error) {
+	users, err := getUsersWithRelations([]User{user}, dbHandle)
 	if err != nil {
 		return user, err
 	}
@@ -632,6 +858,58 @@ func getUserWithVirtualFolders(user User, dbHandle sqlQuerier) (User, error) {
 	return users[0], err
 }
 
+// getUsersWithRelations adds the virtual folders and the groups to the given users
+func getUsersWithRelations(users []User, dbHandle sqlQuerier) ([]User, error) {
+	users, err := getUsersWithVirtualFolders(users, dbHandle)
+	if err != nil {
+		return users, err
+	}
+	return getUsersWithGroups(users, dbHandle)
+}
+
+func getUsersWithGroups(users []User, dbHandle sqlQuerier) ([]User, error) {
+	var err error
+	usersGroups := make(map[int64][]string)
+	if len(users) == 0 {
+		return users, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getRelatedGroupsForUsersQuery(users)
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var userID int64
+		err = rows.Scan(&name, &userID)
+		if err != nil {
+			return users, err
+		}
+		usersGroups[userID] = append(usersGroups[userID], name)
+	}
+	err = rows.Err()
+	if err != nil {
+		return users, err
+	}
+	if len(usersGroups) == 0 {
+		return users, err
+	}
+	for idx := range users {
+		ref := &users[idx]
+		ref.Groups = usersGroups[ref.ID]
+	}
+	return users, err
+}
+
 func getUsersWithVirtualFolders(users []User, dbHandle sqlQuerier) ([]User, error) {
 	var err error
 	usersVirtualFolders := make(map[int64][]vfs.VirtualFolder)
@@ -655,11 +933,13 @@ func getUsersWithVirtualFolders(users []User, dbHandle sqlQuerier) ([]User, erro
 	for rows.Next() {
 		var folder vfs.VirtualFolder
 		var userID int64
+		var metadata sql.NullString
 		err = rows.Scan(&folder.ID, &folder.MappedPath, &folder.UsedQuotaSize, &folder.UsedQuotaFiles,
-			&folder.LastQuotaUpdate, &folder.VirtualPath, &folder.QuotaSize, &folder.QuotaFiles, &userID)
+			&folder.LastQuotaUpdate, &metadata, &folder.VirtualPath, &folder.QuotaSize, &folder.QuotaFiles, &userID)
 		if err != nil {
 			return users, err
 		}
+		folder.Metadata = getMetadataFromDb(metadata)
 		usersVirtualFolders[userID] = append(usersVirtualFolders[userID], folder)
 	}
 	err = rows.Err()
@@ -719,92 +999,654 @@ func getVirtualFoldersWithUsers(folders []vfs.BaseVirtualFolder, dbHandle sqlQue
 	return folders, err
 }
 
-func sqlCommonUpdateFolderQuota(mappedPath string, filesAdd int, sizeAdd int64, reset bool, dbHandle *sql.DB) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
-	defer cancel()
-	q := getUpdateFolderQuotaQuery(reset)
-	stmt, err := dbHandle.PrepareContext(ctx, q)
+func getGroupFromDbRow(row *sql.Row, rows *sql.Rows) (Group, error) {
+	var group Group
+	var description sql.NullString
+	var permissions sql.NullString
+	var filters sql.NullString
+	var fsConfig sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&group.ID, &group.Name, &description, &permissions, &group.QuotaSize, &group.QuotaFiles,
+			&group.UploadBandwidth, &group.DownloadBandwidth, &filters, &fsConfig)
+	} else {
+		err = rows.Scan(&group.ID, &group.Name, &description, &permissions, &group.QuotaSize, &group.QuotaFiles,
+			&group.UploadBandwidth, &group.DownloadBandwidth, &filters, &fsConfig)
+	}
 	if err != nil {
-		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
-		return err
+		if err == sql.ErrNoRows {
+			return group, &RecordNotFoundError{err: err.Error()}
+		}
+		return group, err
 	}
-	defer stmt.Close()
-	_, err = stmt.ExecContext(ctx, sizeAdd, filesAdd, utils.GetTimeAsMsSinceEpoch(time.Now()), mappedPath)
-	if err == nil {
-		providerLog(logger.LevelDebug, "quota updated for folder %#v, files increment: %v size increment: %v is reset? %v",
-			mappedPath, filesAdd, sizeAdd, reset)
-	} else {
-		providerLog(logger.LevelWarn, "error updating quota for folder %#v: %v", mappedPath, err)
+	if description.Valid {
+		group.Description = description.String
 	}
-	return err
+	if permissions.Valid {
+		var perms map[string][]string
+		err = json.Unmarshal([]byte(permissions.String), &perms)
+		if err != nil {
+			return group, err
+		}
+		group.Permissions = perms
+	}
+	if filters.Valid {
+		var groupFilters UserFilters
+		err = json.Unmarshal([]byte(filters.String), &groupFilters)
+		if err == nil {
+			group.Filters = groupFilters
+		}
+	}
+	if fsConfig.Valid {
+		var fs Filesystem
+		err = json.Unmarshal([]byte(fsConfig.String), &fs)
+		if err == nil {
+			group.FsConfig = fs
+		}
+	}
+	return group, err
 }
 
-func sqlCommonGetFolderUsedQuota(mappedPath string, dbHandle *sql.DB) (int, int64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
-	defer cancel()
-	q := getQuotaFolderQuery()
+func sqlCommonGetGroupByName(ctx context.Context, name string, dbHandle sqlQuerier) (Group, error) {
+	q := getGroupByNameQuery()
 	stmt, err := dbHandle.PrepareContext(ctx, q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
-		return 0, 0, err
+		return Group{}, err
 	}
 	defer stmt.Close()
-
-	var usedFiles int
-	var usedSize int64
-	err = stmt.QueryRowContext(ctx, mappedPath).Scan(&usedSize, &usedFiles)
-	if err != nil {
-		providerLog(logger.LevelWarn, "error getting quota for folder: %v, error: %v", mappedPath, err)
-		return 0, 0, err
-	}
-	return usedFiles, usedSize, err
+	row := stmt.QueryRowContext(ctx, name)
+	return getGroupFromDbRow(row, nil)
 }
 
-func sqlCommonRollbackTransaction(tx *sql.Tx) {
-	err := tx.Rollback()
-	if err != nil {
-		providerLog(logger.LevelWarn, "error rolling back transaction: %v", err)
-	}
+func sqlCommonCheckGroupExists(name string, dbHandle *sql.DB) (Group, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	return sqlCommonGetGroupByName(ctx, name, dbHandle)
 }
 
-func sqlCommonGetDatabaseVersion(dbHandle *sql.DB, showInitWarn bool) (schemaVersion, error) {
-	var result schemaVersion
+func sqlCommonGetGroupByID(ID int64, dbHandle *sql.DB) (Group, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
-	q := getDatabaseVersionQuery()
+	q := getGroupByIDQuery()
 	stmt, err := dbHandle.PrepareContext(ctx, q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
-		if showInitWarn && strings.Contains(err.Error(), sqlTableSchemaVersion) {
-			logger.WarnToConsole("database query error, did you forgot to run the \"initprovider\" command?")
-		}
-		return result, err
+		return Group{}, err
 	}
 	defer stmt.Close()
-	row := stmt.QueryRowContext(ctx)
-	err = row.Scan(&result.Version)
-	return result, err
+	row := stmt.QueryRowContext(ctx, ID)
+	return getGroupFromDbRow(row, nil)
 }
 
-func sqlCommonUpdateDatabaseVersion(ctx context.Context, dbHandle sqlQuerier, version int) error {
-	q := getUpdateDBVersionQuery()
+func sqlCommonGetGroups(limit, offset int, order, name string, dbHandle sqlQuerier) ([]Group, error) {
+	groups := make([]Group, 0, limit)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getGroupsQuery(order, name)
 	stmt, err := dbHandle.PrepareContext(ctx, q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
-		return err
+		return nil, err
 	}
 	defer stmt.Close()
-	_, err = stmt.ExecContext(ctx, version)
-	return err
+	var rows *sql.Rows
+	if len(name) > 0 {
+		rows, err = stmt.QueryContext(ctx, name, limit, offset) //nolint:rowserrcheck // rows.Err() is checked
+	} else {
+		rows, err = stmt.QueryContext(ctx, limit, offset) //nolint:rowserrcheck // rows.Err() is checked
+	}
+	if err != nil {
+		return groups, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		group, err := getGroupFromDbRow(nil, rows)
+		if err != nil {
+			return groups, err
+		}
+		group.HideConfidentialData()
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
 }
 
-func sqlCommonExecSQLAndUpdateDBVersion(dbHandle *sql.DB, sql []string, newVersion int) error {
+func sqlCommonDumpGroups(dbHandle sqlQuerier) ([]Group, error) {
+	groups := make([]Group, 0, 10)
 	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
 	defer cancel()
-	tx, err := dbHandle.BeginTx(ctx, nil)
+	q := getDumpGroupsQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
 	if err != nil {
-		return err
-	}
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return groups, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		group, err := getGroupFromDbRow(nil, rows)
+		if err != nil {
+			return groups, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+func sqlCommonAddGroup(group Group, dbHandle *sql.DB) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getAddGroupQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	permissions, filters, fsConfig, err := getGroupJSONFieldsForDb(&group)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, group.Name, group.Description, permissions, group.QuotaSize, group.QuotaFiles,
+		group.UploadBandwidth, group.DownloadBandwidth, filters, fsConfig)
+	return err
+}
+
+func sqlCommonUpdateGroup(group Group, dbHandle *sql.DB) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUpdateGroupQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	permissions, filters, fsConfig, err := getGroupJSONFieldsForDb(&group)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(ctx, group.Description, permissions, group.QuotaSize, group.QuotaFiles,
+		group.UploadBandwidth, group.DownloadBandwidth, filters, fsConfig, group.Name)
+	return err
+}
+
+func sqlCommonDeleteGroup(group Group, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDeleteGroupQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	// the mapping with the users is removed by the foreign keys cascade
+	_, err = stmt.ExecContext(ctx, group.Name)
+	return err
+}
+
+func getGroupJSONFieldsForDb(group *Group) (sql.NullString, string, string, error) {
+	var permissions sql.NullString
+	if len(group.Permissions) > 0 {
+		perms, err := group.GetPermissionsAsJSON()
+		if err != nil {
+			return permissions, "", "", err
+		}
+		permissions = sql.NullString{String: string(perms), Valid: true}
+	}
+	filters, err := group.GetFiltersAsJSON()
+	if err != nil {
+		return permissions, "", "", err
+	}
+	fsConfig, err := group.GetFsConfigAsJSON()
+	if err != nil {
+		return permissions, "", "", err
+	}
+	return permissions, string(filters), string(fsConfig), nil
+}
+
+func sqlCommonUpdateFolderQuota(mappedPath string, filesAdd int, sizeAdd int64, reset bool, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getUpdateFolderQuotaQuery(reset)
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, sizeAdd, filesAdd, utils.GetTimeAsMsSinceEpoch(time.Now()), mappedPath)
+	if err == nil {
+		providerLog(logger.LevelDebug, "quota updated for folder %#v, files increment: %v size increment: %v is reset? %v",
+			mappedPath, filesAdd, sizeAdd, reset)
+	} else {
+		providerLog(logger.LevelWarn, "error updating quota for folder %#v: %v", mappedPath, err)
+	}
+	return err
+}
+
+func sqlCommonGetFolderUsedQuota(mappedPath string, dbHandle *sql.DB) (int, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getQuotaFolderQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return 0, 0, err
+	}
+	defer stmt.Close()
+
+	var usedFiles int
+	var usedSize int64
+	err = stmt.QueryRowContext(ctx, mappedPath).Scan(&usedSize, &usedFiles)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error getting quota for folder: %v, error: %v", mappedPath, err)
+		return 0, 0, err
+	}
+	return usedFiles, usedSize, err
+}
+
+func getDeletedUserFromDbRow(row *sql.Row, rows *sql.Rows) (DeletedUser, error) {
+	var deletedUser DeletedUser
+	var username string
+	var data string
+	var err error
+	if row != nil {
+		err = row.Scan(&username, &deletedUser.DeletedAt, &data)
+	} else {
+		err = rows.Scan(&username, &deletedUser.DeletedAt, &data)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return deletedUser, &RecordNotFoundError{err: err.Error()}
+		}
+		return deletedUser, err
+	}
+	err = json.Unmarshal([]byte(data), &deletedUser.User)
+	return deletedUser, err
+}
+
+func sqlCommonSoftDeleteUser(user User, dbHandle *sql.DB) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	tx, err := dbHandle.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// a previously deleted user with the same username is replaced
+	queries := []string{getDeleteDeletedUserQuery(), getAddDeletedUserQuery(), getDeleteUserQuery()}
+	args := [][]interface{}{
+		{user.Username},
+		{user.Username, utils.GetTimeAsMsSinceEpoch(time.Now()), string(data)},
+		{user.ID},
+	}
+	for idx, q := range queries {
+		stmt, err := tx.PrepareContext(ctx, q)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+			sqlCommonRollbackTransaction(tx)
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, args[idx]...)
+		stmt.Close()
+		if err != nil {
+			sqlCommonRollbackTransaction(tx)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func sqlCommonGetDeletedUser(username string, dbHandle *sql.DB) (DeletedUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDeletedUserQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return DeletedUser{}, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRowContext(ctx, username)
+	return getDeletedUserFromDbRow(row, nil)
+}
+
+func sqlCommonGetDeletedUsers(limit, offset int, order, username string, dbHandle *sql.DB) ([]DeletedUser, error) {
+	deletedUsers := make([]DeletedUser, 0, limit)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDeletedUsersQuery(order, username)
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(username) > 0 {
+		rows, err = stmt.QueryContext(ctx, username, limit, offset) //nolint:rowserrcheck // rows.Err() is checked
+	} else {
+		rows, err = stmt.QueryContext(ctx, limit, offset) //nolint:rowserrcheck // rows.Err() is checked
+	}
+	if err != nil {
+		return deletedUsers, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		deletedUser, err := getDeletedUserFromDbRow(nil, rows)
+		if err != nil {
+			return deletedUsers, err
+		}
+		deletedUser.HideConfidentialData()
+		deletedUsers = append(deletedUsers, deletedUser)
+	}
+	return deletedUsers, rows.Err()
+}
+
+func sqlCommonPurgeDeletedUser(username string, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDeleteDeletedUserQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, username)
+	return err
+}
+
+func sqlCommonPurgeDeletedUsers(before int64, dbHandle *sql.DB) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+	q := getPurgeDeletedUsersQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return 0, err
+	}
+	defer stmt.Close()
+	res, err := stmt.ExecContext(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	return int(purged), err
+}
+
+// sqlCommonRotateSecrets rotates the secrets for users, soft deleted users and groups
+// inside a single transaction. The rows are read inside the transaction, and locked if
+// supported, so a concurrent update cannot be overwritten with stale data
+func sqlCommonRotateSecrets(rotator *secretsRotator, dbHandle *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+	tx, err := dbHandle.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = sqlCommonRotateUsersSecrets(ctx, tx, rotator); err != nil {
+		sqlCommonRollbackTransaction(tx)
+		return err
+	}
+	if err = sqlCommonRotateDeletedUsersSecrets(ctx, tx, rotator); err != nil {
+		sqlCommonRollbackTransaction(tx)
+		return err
+	}
+	if err = sqlCommonRotateGroupsSecrets(ctx, tx, rotator); err != nil {
+		sqlCommonRollbackTransaction(tx)
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqlCommonRotateUsersSecrets(ctx context.Context, tx *sql.Tx, rotator *secretsRotator) error {
+	users, err := sqlCommonGetUsersSecrets(ctx, tx)
+	if err != nil {
+		return err
+	}
+	var updates [][]interface{}
+	for idx := range users {
+		user := &users[idx]
+		updated, err := rotator.rotateUser(user)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			continue
+		}
+		fsConfig, err := user.GetFsConfigAsJSON()
+		if err != nil {
+			return err
+		}
+		totpConfig, err := user.GetTOTPConfigAsJSON()
+		if err != nil {
+			return err
+		}
+		updates = append(updates, []interface{}{string(fsConfig), string(totpConfig), user.ID})
+	}
+	return sqlCommonExecSecretsUpdates(ctx, tx, getUpdateUserSecretsQuery(), updates)
+}
+
+func sqlCommonGetUsersSecrets(ctx context.Context, tx *sql.Tx) ([]User, error) {
+	q := getUsersSecretsQuery()
+	stmt, err := tx.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		var fsConfig, totpConfig sql.NullString
+		if err := rows.Scan(&user.ID, &user.Username, &fsConfig, &totpConfig); err != nil {
+			return nil, err
+		}
+		if fsConfig.Valid {
+			if err := json.Unmarshal([]byte(fsConfig.String), &user.FsConfig); err != nil {
+				return nil, fmt.Errorf("unable to decode the filesystem config for user %#v: %w", user.Username, err)
+			}
+		}
+		if totpConfig.Valid {
+			if err := json.Unmarshal([]byte(totpConfig.String), &user.TOTPConfig); err != nil {
+				return nil, fmt.Errorf("unable to decode the TOTP config for user %#v: %w", user.Username, err)
+			}
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func sqlCommonRotateDeletedUsersSecrets(ctx context.Context, tx *sql.Tx, rotator *secretsRotator) error {
+	q := getDeletedUsersSecretsQuery()
+	stmt, err := tx.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var username, data string
+		if err := rows.Scan(&username, &data); err != nil {
+			return err
+		}
+		var user User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			return fmt.Errorf("unable to decode the deleted user %#v: %w", username, err)
+		}
+		user.Username = username
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	var updates [][]interface{}
+	for idx := range users {
+		user := &users[idx]
+		updated, err := rotator.rotateDeletedUser(user)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			continue
+		}
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, []interface{}{string(data), user.Username})
+	}
+	return sqlCommonExecSecretsUpdates(ctx, tx, getUpdateDeletedUserSecretsQuery(), updates)
+}
+
+func sqlCommonRotateGroupsSecrets(ctx context.Context, tx *sql.Tx, rotator *secretsRotator) error {
+	q := getGroupsSecretsQuery()
+	stmt, err := tx.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var groups []Group
+	for rows.Next() {
+		var group Group
+		var fsConfig sql.NullString
+		if err := rows.Scan(&group.ID, &group.Name, &fsConfig); err != nil {
+			return err
+		}
+		if fsConfig.Valid {
+			if err := json.Unmarshal([]byte(fsConfig.String), &group.FsConfig); err != nil {
+				return fmt.Errorf("unable to decode the filesystem config for group %#v: %w", group.Name, err)
+			}
+		}
+		groups = append(groups, group)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	var updates [][]interface{}
+	for idx := range groups {
+		group := &groups[idx]
+		updated, err := rotator.rotateGroup(group)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			continue
+		}
+		fsConfig, err := group.GetFsConfigAsJSON()
+		if err != nil {
+			return err
+		}
+		updates = append(updates, []interface{}{string(fsConfig), group.ID})
+	}
+	return sqlCommonExecSecretsUpdates(ctx, tx, getUpdateGroupSecretsQuery(), updates)
+}
+
+func sqlCommonExecSecretsUpdates(ctx context.Context, tx *sql.Tx, q string, updates [][]interface{}) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	stmt, err := tx.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	for _, args := range updates {
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqlCommonRollbackTransaction(tx *sql.Tx) {
+	err := tx.Rollback()
+	if err != nil {
+		providerLog(logger.LevelWarn, "error rolling back transaction: %v", err)
+	}
+}
+
+func sqlCommonGetDatabaseVersion(dbHandle *sql.DB, showInitWarn bool) (schemaVersion, error) {
+	var result schemaVersion
+	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
+	defer cancel()
+	q := getDatabaseVersionQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		if showInitWarn && strings.Contains(err.Error(), sqlTableSchemaVersion) {
+			logger.WarnToConsole("database query error, did you forgot to run the \"initprovider\" command?")
+		}
+		return result, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRowContext(ctx)
+	err = row.Scan(&result.Version)
+	return result, err
+}
+
+func sqlCommonUpdateDatabaseVersion(ctx context.Context, dbHandle sqlQuerier, version int) error {
+	q := getUpdateDBVersionQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, version)
+	return err
+}
+
+func sqlCommonExecSQLAndUpdateDBVersion(dbHandle *sql.DB, sql []string, newVersion int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), longSQLQueryTimeout)
+	defer cancel()
+	tx, err := dbHandle.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
 	for _, q := range sql {
 		if len(strings.TrimSpace(q)) == 0 {
 			continue
@@ -870,7 +1712,7 @@ func sqlCommonRestoreCompatVirtualFolders(ctx context.Context, users []userCompa
 				quotaFiles = 0
 				quotaSize = 0
 			}
-			b, err := sqlCommonAddOrGetFolder(ctx, vfolder.MappedPath, 0, 0, 0, dbHandle)
+			b, err := sqlCommonAddOrGetCompatV4Folder(ctx, vfolder.MappedPath, dbHandle)
 			if err != nil {
 				providerLog(logger.LevelWarn, "error restoring virtual folder for user %#v: %v", user.Username, err)
 				return foldersToScan, err
@@ -899,6 +1741,41 @@ func sqlCommonRestoreCompatVirtualFolders(ctx context.Context, users []userCompa
 	return foldersToScan, nil
 }
 
+// sqlCommonAddOrGetCompatV4Folder is like sqlCommonAddOrGetFolder but it only uses the
+// columns available in the version 4 schema
+func sqlCommonAddOrGetCompatV4Folder(ctx context.Context, name string, dbHandle sqlQuerier) (vfs.BaseVirtualFolder, error) {
+	folder := vfs.BaseVirtualFolder{
+		MappedPath: name,
+	}
+	if err := validateFolder(&folder); err != nil {
+		return folder, err
+	}
+	q := getCompatV4FolderIDQuery()
+	stmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return folder, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRowContext(ctx, folder.MappedPath).Scan(&folder.ID)
+	if err != sql.ErrNoRows {
+		return folder, err
+	}
+	q = getCompatV4AddFolderQuery()
+	addStmt, err := dbHandle.PrepareContext(ctx, q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return folder, err
+	}
+	defer addStmt.Close()
+	_, err = addStmt.ExecContext(ctx, folder.MappedPath)
+	if err != nil {
+		return folder, err
+	}
+	err = stmt.QueryRowContext(ctx, folder.MappedPath).Scan(&folder.ID)
+	return folder, err
+}
+
 func sqlCommonUpdateDatabaseFrom3To4(sqlV4 string, dbHandle *sql.DB) error {
 	logger.InfoToConsole("updating database version: 3 -> 4")
 	providerLog(logger.LevelInfo, "updating database version: 3 -> 4")
@@ -63,6 +63,28 @@ ALTER TABLE "new__users" RENAME TO "{{users}}";
 CREATE INDEX "folders_mapping_folder_id_idx" ON "{{folders_mapping}}" ("folder_id");
 CREATE INDEX "folders_mapping_user_id_idx" ON "{{folders_mapping}}" ("user_id");
 `
+	sqliteV6SQL = `ALTER TABLE "{{users}}" ADD COLUMN "metadata" text NULL;
+ALTER TABLE "{{folders}}" ADD COLUMN "metadata" text NULL;`
+	sqliteV7SQL = `ALTER TABLE "{{users}}" ADD COLUMN "used_download_volume" bigint DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "download_volume_period_start" bigint DEFAULT 0 NOT NULL;`
+	sqliteV8SQL = `ALTER TABLE "{{users}}" ADD COLUMN "totp_config" text NULL;`
+	sqliteV9SQL = `CREATE TABLE "{{groups}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "name" varchar(255) NOT NULL UNIQUE,
+"description" text NULL, "permissions" text NULL, "quota_size" bigint NOT NULL, "quota_files" integer NOT NULL,
+"upload_bandwidth" integer NOT NULL, "download_bandwidth" integer NOT NULL, "filters" text NULL, "filesystem" text NULL);
+CREATE TABLE "{{groups_mapping}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "group_id" integer NOT NULL REFERENCES "{{groups}}" ("id")
+ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED, "user_id" integer NOT NULL REFERENCES "{{users}}" ("id") ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+CONSTRAINT "unique_group_mapping" UNIQUE ("user_id", "group_id"));
+CREATE INDEX "user_groups_mapping_group_id_idx" ON "{{groups_mapping}}" ("group_id");
+CREATE INDEX "user_groups_mapping_user_id_idx" ON "{{groups_mapping}}" ("user_id");`
+	sqliteV10SQL = `CREATE TABLE "{{deleted_users}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "username" varchar(255) NOT NULL UNIQUE,
+"deleted_at" bigint NOT NULL, "data" text NOT NULL);
+CREATE INDEX "deleted_users_deleted_at_idx" ON "{{deleted_users}}" ("deleted_at");`
+	sqliteV11SQL = `ALTER TABLE "{{users}}" ADD COLUMN "last_expiration_warning" bigint DEFAULT 0 NOT NULL;`
+	sqliteV12SQL = `ALTER TABLE "{{users}}" ADD COLUMN "auth_backend" varchar(32) DEFAULT '' NOT NULL;`
+	sqliteV13SQL = `ALTER TABLE "{{users}}" ADD COLUMN "login_failures" integer DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "last_login_failure" bigint DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "locked_until" bigint DEFAULT 0 NOT NULL;`
+	sqliteV14SQL = `ALTER TABLE "{{users}}" ADD COLUMN "last_totp_step" bigint DEFAULT 0 NOT NULL;`
 )
 
 // SQLiteProvider auth provider for SQLite database
@@ -126,10 +148,26 @@ func (p SQLiteProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
 
+func (p SQLiteProvider) updateDownloadVolume(username string, sizeAdd int64, periodStart int64) error {
+	return sqlCommonUpdateDownloadVolume(username, sizeAdd, periodStart, p.dbHandle)
+}
+
 func (p SQLiteProvider) updateLastLogin(username string) error {
 	return sqlCommonUpdateLastLogin(username, p.dbHandle)
 }
 
+func (p SQLiteProvider) updateLastExpirationWarning(username string, expirationDate int64) (bool, error) {
+	return sqlCommonUpdateLastExpirationWarning(username, expirationDate, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateLastTOTPStep(username string, step int64) (bool, error) {
+	return sqlCommonUpdateLastTOTPStep(username, step, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateLoginFailures(username string, prev, next loginFailures) (bool, error) {
+	return sqlCommonUpdateLoginFailures(username, prev, next, p.dbHandle)
+}
+
 func (p SQLiteProvider) userExists(username string) (User, error) {
 	return sqlCommonCheckUserExists(username, p.dbHandle)
 }
@@ -150,8 +188,8 @@ func (p SQLiteProvider) dumpUsers() ([]User, error) {
 	return sqlCommonDumpUsers(p.dbHandle)
 }
 
-func (p SQLiteProvider) getUsers(limit int, offset int, order string, username string) ([]User, error) {
-	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
+func (p SQLiteProvider) getUsers(limit int, offset int, order string, username string, metadata MetadataFilter) ([]User, error) {
+	return sqlCommonGetUsers(limit, offset, order, username, metadata, p.dbHandle)
 }
 
 func (p SQLiteProvider) dumpFolders() ([]vfs.BaseVirtualFolder, error) {
@@ -162,6 +200,10 @@ func (p SQLiteProvider) getFolders(limit, offset int, order, folderPath string)
 	return sqlCommonGetFolders(limit, offset, order, folderPath, p.dbHandle)
 }
 
+func (p SQLiteProvider) rotateSecrets(rotator *secretsRotator) error {
+	return sqlCommonRotateSecrets(rotator, p.dbHandle)
+}
+
 func (p SQLiteProvider) getFolderByPath(mappedPath string) (vfs.BaseVirtualFolder, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultSQLQueryTimeout)
 	defer cancel()
@@ -184,6 +226,54 @@ func (p SQLiteProvider) getUsedFolderQuota(mappedPath string) (int, int64, error
 	return sqlCommonGetFolderUsedQuota(mappedPath, p.dbHandle)
 }
 
+func (p SQLiteProvider) groupExists(name string) (Group, error) {
+	return sqlCommonCheckGroupExists(name, p.dbHandle)
+}
+
+func (p SQLiteProvider) getGroupByID(ID int64) (Group, error) {
+	return sqlCommonGetGroupByID(ID, p.dbHandle)
+}
+
+func (p SQLiteProvider) getGroups(limit, offset int, order, name string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, name, p.dbHandle)
+}
+
+func (p SQLiteProvider) addGroup(group Group) error {
+	return sqlCommonAddGroup(group, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateGroup(group Group) error {
+	return sqlCommonUpdateGroup(group, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteGroup(group Group) error {
+	return sqlCommonDeleteGroup(group, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.dbHandle)
+}
+
+func (p SQLiteProvider) softDeleteUser(user User) error {
+	return sqlCommonSoftDeleteUser(user, p.dbHandle)
+}
+
+func (p SQLiteProvider) getDeletedUsers(limit, offset int, order, username string) ([]DeletedUser, error) {
+	return sqlCommonGetDeletedUsers(limit, offset, order, username, p.dbHandle)
+}
+
+func (p SQLiteProvider) deletedUserExists(username string) (DeletedUser, error) {
+	return sqlCommonGetDeletedUser(username, p.dbHandle)
+}
+
+func (p SQLiteProvider) purgeDeletedUser(username string) error {
+	return sqlCommonPurgeDeletedUser(username, p.dbHandle)
+}
+
+func (p SQLiteProvider) purgeDeletedUsers(before int64) (int, error) {
+	return sqlCommonPurgeDeletedUsers(before, p.dbHandle)
+}
+
 func (p SQLiteProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -239,6 +329,24 @@ func (p SQLiteProvider) migrateDatabase() error {
 		return updateSQLiteDatabaseFromV3(p.dbHandle)
 	case 4:
 		return updateSQLiteDatabaseFromV4(p.dbHandle)
+	case 5:
+		return updateSQLiteDatabaseFromV5(p.dbHandle)
+	case 6:
+		return updateSQLiteDatabaseFromV6(p.dbHandle)
+	case 7:
+		return updateSQLiteDatabaseFromV7(p.dbHandle)
+	case 8:
+		return updateSQLiteDatabaseFromV8(p.dbHandle)
+	case 9:
+		return updateSQLiteDatabaseFromV9(p.dbHandle)
+	case 10:
+		return updateSQLiteDatabaseFromV10(p.dbHandle)
+	case 11:
+		return updateSQLiteDatabaseFromV11(p.dbHandle)
+	case 12:
+		return updateSQLiteDatabaseFromV12(p.dbHandle)
+	case 13:
+		return updateSQLiteDatabaseFromV13(p.dbHandle)
 	default:
 		return fmt.Errorf("Database version not handled: %v", dbVersion.Version)
 	}
@@ -269,7 +377,79 @@ func updateSQLiteDatabaseFromV3(dbHandle *sql.DB) error {
 }
 
 func updateSQLiteDatabaseFromV4(dbHandle *sql.DB) error {
-	return updateSQLiteDatabaseFrom4To5(dbHandle)
+	err := updateSQLiteDatabaseFrom4To5(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV5(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV5(dbHandle *sql.DB) error {
+	err := updateSQLiteDatabaseFrom5To6(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV6(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV6(dbHandle *sql.DB) error {
+	err := updateSQLiteDatabaseFrom6To7(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV7(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV7(dbHandle *sql.DB) error {
+	err := updateSQLiteDatabaseFrom7To8(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV8(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV8(dbHandle *sql.DB) error {
+	err := updateSQLiteDatabaseFrom8To9(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV9(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV9(dbHandle *sql.DB) error {
+	err := updateSQLiteDatabaseFrom9To10(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV10(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV10(dbHandle *sql.DB) error {
+	err := updateSQLiteDatabaseFrom10To11(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV11(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV11(dbHandle *sql.DB) error {
+	err := updateSQLiteDatabaseFrom11To12(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV12(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV12(dbHandle *sql.DB) error {
+	err := updateSQLiteDatabaseFrom12To13(dbHandle)
+	if err != nil {
+		return err
+	}
+	return updateSQLiteDatabaseFromV13(dbHandle)
+}
+
+func updateSQLiteDatabaseFromV13(dbHandle *sql.DB) error {
+	return updateSQLiteDatabaseFrom13To14(dbHandle)
 }
 
 func updateSQLiteDatabaseFrom1To2(dbHandle *sql.DB) error {
@@ -293,3 +473,69 @@ func updateSQLiteDatabaseFrom3To4(dbHandle *sql.DB) error {
 func updateSQLiteDatabaseFrom4To5(dbHandle *sql.DB) error {
 	return sqlCommonUpdateDatabaseFrom4To5(dbHandle)
 }
+
+func updateSQLiteDatabaseFrom5To6(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 5 -> 6")
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	sql := strings.ReplaceAll(sqliteV6SQL, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{folders}}", sqlTableFolders)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 6)
+}
+
+func updateSQLiteDatabaseFrom6To7(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 6 -> 7")
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	sql := strings.ReplaceAll(sqliteV7SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 7)
+}
+
+func updateSQLiteDatabaseFrom7To8(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 7 -> 8")
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	sql := strings.ReplaceAll(sqliteV8SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 8)
+}
+
+func updateSQLiteDatabaseFrom8To9(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 8 -> 9")
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	sql := strings.ReplaceAll(sqliteV9SQL, "{{users}}", sqlTableUsers)
+	sql = strings.ReplaceAll(sql, "{{groups}}", sqlTableGroups)
+	sql = strings.ReplaceAll(sql, "{{groups_mapping}}", sqlTableGroupsMapping)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 9)
+}
+
+func updateSQLiteDatabaseFrom9To10(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 9 -> 10")
+	providerLog(logger.LevelInfo, "updating database version: 9 -> 10")
+	sql := strings.ReplaceAll(sqliteV10SQL, "{{deleted_users}}", sqlTableDeletedUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 10)
+}
+
+func updateSQLiteDatabaseFrom10To11(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 10 -> 11")
+	providerLog(logger.LevelInfo, "updating database version: 10 -> 11")
+	sql := strings.ReplaceAll(sqliteV11SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 11)
+}
+
+func updateSQLiteDatabaseFrom11To12(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 11 -> 12")
+	providerLog(logger.LevelInfo, "updating database version: 11 -> 12")
+	sql := strings.ReplaceAll(sqliteV12SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 12)
+}
+
+func updateSQLiteDatabaseFrom12To13(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 12 -> 13")
+	providerLog(logger.LevelInfo, "updating database version: 12 -> 13")
+	sql := strings.ReplaceAll(sqliteV13SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 13)
+}
+
+func updateSQLiteDatabaseFrom13To14(dbHandle *sql.DB) error {
+	logger.InfoToConsole("updating database version: 13 -> 14")
+	providerLog(logger.LevelInfo, "updating database version: 13 -> 14")
+	sql := strings.ReplaceAll(sqliteV14SQL, "{{users}}", sqlTableUsers)
+	return sqlCommonExecSQLAndUpdateDBVersion(dbHandle, strings.Split(sql, ";"), 14)
+}
@@ -10,8 +10,11 @@ import (
 
 const (
 	selectUserFields = "id,username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,used_quota_size," +
-		"used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,expiration_date,last_login,status,filters,filesystem"
-	selectFolderFields = "id,path,used_quota_size,used_quota_files,last_quota_update"
+		"used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,expiration_date,last_login,status,filters,filesystem," +
+		"metadata,used_download_volume,download_volume_period_start,totp_config,last_expiration_warning," +
+		"auth_backend,login_failures,last_login_failure,locked_until,last_totp_step"
+	selectFolderFields = "id,path,used_quota_size,used_quota_files,last_quota_update,metadata"
+	selectGroupFields  = "id,name,description,permissions,quota_size,quota_files,upload_bandwidth,download_bandwidth,filters,filesystem"
 )
 
 func getSQLPlaceholders() []string {
@@ -34,13 +37,25 @@ func getUserByIDQuery() string {
 	return fmt.Sprintf(`SELECT %v FROM %v WHERE id = %v`, selectUserFields, sqlTableUsers, sqlPlaceholders[0])
 }
 
-func getUsersQuery(order string, username string) string {
+func getUsersQuery(order string, username string, metadata MetadataFilter) string {
+	var conditions []string
 	if len(username) > 0 {
-		return fmt.Sprintf(`SELECT %v FROM %v WHERE username = %v ORDER BY username %v LIMIT %v OFFSET %v`,
-			selectUserFields, sqlTableUsers, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+		conditions = append(conditions, fmt.Sprintf("username = %v", sqlPlaceholders[len(conditions)]))
 	}
-	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY username %v LIMIT %v OFFSET %v`, selectUserFields, sqlTableUsers,
-		order, sqlPlaceholders[0], sqlPlaceholders[1])
+	if !metadata.IsEmpty() {
+		conditions = append(conditions, fmt.Sprintf("metadata LIKE %v ESCAPE '!'", sqlPlaceholders[len(conditions)]))
+	}
+	var where string
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if !metadata.IsEmpty() {
+		// the LIKE condition can match more users than the filter, limit and offset
+		// are applied while iterating the results
+		return fmt.Sprintf(`SELECT %v FROM %v%v ORDER BY username %v`, selectUserFields, sqlTableUsers, where, order)
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v%v ORDER BY username %v LIMIT %v OFFSET %v`, selectUserFields, sqlTableUsers,
+		where, order, sqlPlaceholders[len(conditions)], sqlPlaceholders[len(conditions)+1])
 }
 
 func getDumpUsersQuery() string {
@@ -60,6 +75,36 @@ func getUpdateQuotaQuery(reset bool) string {
 		WHERE username = %v`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
 }
 
+// getUpdateDownloadVolumeQuery returns the query to increment the downloaded volume,
+// the volume is reset if the stored period is different from the given one
+func getUpdateDownloadVolumeQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET used_download_volume = CASE WHEN download_volume_period_start = %v
+		THEN used_download_volume + %v ELSE %v END,download_volume_period_start = %v WHERE username = %v`, sqlTableUsers,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4])
+}
+
+// getUpdateLastExpirationWarningQuery returns the query to store the expiration date for which
+// the expiration warning was fired, no row is updated if the warning was already fired
+func getUpdateLastExpirationWarningQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET last_expiration_warning = %v WHERE username = %v AND last_expiration_warning <> %v`,
+		sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+// getUpdateLastTOTPStepQuery returns the query to store the time step of the last used TOTP code,
+// no row is updated if the code for this step, or for a more recent one, was already used
+func getUpdateLastTOTPStepQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET last_totp_step = %v WHERE username = %v AND last_totp_step < %v`,
+		sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+// getUpdateLoginFailuresQuery returns the query to update the login lockout fields, no row is
+// updated if the stored fields do not match the expected ones
+func getUpdateLoginFailuresQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET login_failures = %v,last_login_failure = %v,locked_until = %v WHERE username = %v
+		AND login_failures = %v AND last_login_failure = %v AND locked_until = %v`, sqlTableUsers, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6])
+}
+
 func getUpdateLastLoginQuery() string {
 	return fmt.Sprintf(`UPDATE %v SET last_login = %v WHERE username = %v`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1])
 }
@@ -72,19 +117,20 @@ func getQuotaQuery() string {
 func getAddUserQuery() string {
 	return fmt.Sprintf(`INSERT INTO %v (username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,
 		used_quota_size,used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,status,last_login,expiration_date,filters,
-		filesystem)
-		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,0,0,0,%v,%v,%v,0,%v,%v,%v)`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1],
+		filesystem,metadata,totp_config,auth_backend)
+		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,0,0,0,%v,%v,%v,0,%v,%v,%v,%v,%v,%v)`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1],
 		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7],
 		sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13],
-		sqlPlaceholders[14], sqlPlaceholders[15])
+		sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16], sqlPlaceholders[17], sqlPlaceholders[18])
 }
 
 func getUpdateUserQuery() string {
 	return fmt.Sprintf(`UPDATE %v SET password=%v,public_keys=%v,home_dir=%v,uid=%v,gid=%v,max_sessions=%v,quota_size=%v,
-		quota_files=%v,permissions=%v,upload_bandwidth=%v,download_bandwidth=%v,status=%v,expiration_date=%v,filters=%v,filesystem=%v
-		WHERE id = %v`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
-		sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9],
-		sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13], sqlPlaceholders[14], sqlPlaceholders[15])
+		quota_files=%v,permissions=%v,upload_bandwidth=%v,download_bandwidth=%v,status=%v,expiration_date=%v,filters=%v,filesystem=%v,
+		metadata=%v,totp_config=%v,auth_backend=%v WHERE id = %v`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
+		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8],
+		sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13], sqlPlaceholders[14],
+		sqlPlaceholders[15], sqlPlaceholders[16], sqlPlaceholders[17], sqlPlaceholders[18])
 }
 
 func getDeleteUserQuery() string {
@@ -96,8 +142,8 @@ func getFolderByPathQuery() string {
 }
 
 func getAddFolderQuery() string {
-	return fmt.Sprintf(`INSERT INTO %v (path,used_quota_size,used_quota_files,last_quota_update) VALUES (%v,%v,%v,%v)`,
-		sqlTableFolders, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
+	return fmt.Sprintf(`INSERT INTO %v (path,used_quota_size,used_quota_files,last_quota_update,metadata) VALUES (%v,%v,%v,%v,%v)`,
+		sqlTableFolders, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4])
 }
 
 func getDeleteFolderQuery() string {
@@ -151,8 +197,8 @@ func getRelatedFoldersForUsersQuery(users []User) string {
 	if sb.Len() > 0 {
 		sb.WriteString(")")
 	}
-	return fmt.Sprintf(`SELECT f.id,f.path,f.used_quota_size,f.used_quota_files,f.last_quota_update,fm.virtual_path,fm.quota_size,fm.quota_files,fm.user_id
-		FROM %v f INNER JOIN %v fm ON f.id = fm.folder_id WHERE fm.user_id IN %v ORDER BY fm.user_id`, sqlTableFolders,
+	return fmt.Sprintf(`SELECT f.id,f.path,f.used_quota_size,f.used_quota_files,f.last_quota_update,f.metadata,fm.virtual_path,fm.quota_size,
+		fm.quota_files,fm.user_id FROM %v f INNER JOIN %v fm ON f.id = fm.folder_id WHERE fm.user_id IN %v ORDER BY fm.user_id`, sqlTableFolders,
 		sqlTableFoldersMapping, sb.String())
 }
 
@@ -173,6 +219,135 @@ func getRelatedUsersForFoldersQuery(folders []vfs.BaseVirtualFolder) string {
 		WHERE fm.folder_id IN %v ORDER BY fm.folder_id`, sqlTableFoldersMapping, sqlTableUsers, sb.String())
 }
 
+func getGroupByNameQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v`, selectGroupFields, sqlTableGroups, sqlPlaceholders[0])
+}
+
+func getGroupByIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE id = %v`, selectGroupFields, sqlTableGroups, sqlPlaceholders[0])
+}
+
+func getGroupsQuery(order, name string) string {
+	if len(name) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v ORDER BY name %v LIMIT %v OFFSET %v`,
+			selectGroupFields, sqlTableGroups, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY name %v LIMIT %v OFFSET %v`, selectGroupFields, sqlTableGroups,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpGroupsQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectGroupFields, sqlTableGroups)
+}
+
+func getAddGroupQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (name,description,permissions,quota_size,quota_files,upload_bandwidth,download_bandwidth,
+		filters,filesystem) VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v)`, sqlTableGroups, sqlPlaceholders[0], sqlPlaceholders[1],
+		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7],
+		sqlPlaceholders[8])
+}
+
+func getUpdateGroupQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET description=%v,permissions=%v,quota_size=%v,quota_files=%v,upload_bandwidth=%v,
+		download_bandwidth=%v,filters=%v,filesystem=%v WHERE name = %v`, sqlTableGroups, sqlPlaceholders[0], sqlPlaceholders[1],
+		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7],
+		sqlPlaceholders[8])
+}
+
+func getDeleteGroupQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE name = %v`, sqlTableGroups, sqlPlaceholders[0])
+}
+
+func getClearGroupMappingQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE user_id = (SELECT id FROM %v WHERE username = %v)`, sqlTableGroupsMapping,
+		sqlTableUsers, sqlPlaceholders[0])
+}
+
+func getAddGroupMappingQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (group_id,user_id) VALUES (%v,(SELECT id FROM %v WHERE username = %v))`,
+		sqlTableGroupsMapping, sqlPlaceholders[0], sqlTableUsers, sqlPlaceholders[1])
+}
+
+func getRelatedGroupsForUsersQuery(users []User) string {
+	var sb strings.Builder
+	for _, u := range users {
+		if sb.Len() == 0 {
+			sb.WriteString("(")
+		} else {
+			sb.WriteString(",")
+		}
+		sb.WriteString(strconv.FormatInt(u.ID, 10))
+	}
+	if sb.Len() > 0 {
+		sb.WriteString(")")
+	}
+	return fmt.Sprintf(`SELECT g.name,gm.user_id FROM %v g INNER JOIN %v gm ON g.id = gm.group_id WHERE gm.user_id IN %v
+		ORDER BY gm.user_id,gm.id`, sqlTableGroups, sqlTableGroupsMapping, sb.String())
+}
+
+func getDeletedUserQuery() string {
+	return fmt.Sprintf(`SELECT username,deleted_at,data FROM %v WHERE username = %v`, sqlTableDeletedUsers, sqlPlaceholders[0])
+}
+
+func getDeletedUsersQuery(order, username string) string {
+	if len(username) > 0 {
+		return fmt.Sprintf(`SELECT username,deleted_at,data FROM %v WHERE username = %v ORDER BY username %v LIMIT %v OFFSET %v`,
+			sqlTableDeletedUsers, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT username,deleted_at,data FROM %v ORDER BY username %v LIMIT %v OFFSET %v`,
+		sqlTableDeletedUsers, order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getAddDeletedUserQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (username,deleted_at,data) VALUES (%v,%v,%v)`, sqlTableDeletedUsers,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDeleteDeletedUserQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE username = %v`, sqlTableDeletedUsers, sqlPlaceholders[0])
+}
+
+func getPurgeDeletedUsersQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE deleted_at < %v`, sqlTableDeletedUsers, sqlPlaceholders[0])
+}
+
+// getSelectForUpdateSuffix returns the suffix to lock the selected rows until the
+// transaction ends, SQLite locks the whole database on write so it is not needed
+func getSelectForUpdateSuffix() string {
+	if config.Driver == MySQLDataProviderName || config.Driver == PGSQLDataProviderName {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+func getUsersSecretsQuery() string {
+	return fmt.Sprintf(`SELECT id,username,filesystem,totp_config FROM %v ORDER BY id%v`, sqlTableUsers,
+		getSelectForUpdateSuffix())
+}
+
+func getUpdateUserSecretsQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET filesystem=%v,totp_config=%v WHERE id=%v`, sqlTableUsers, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDeletedUsersSecretsQuery() string {
+	return fmt.Sprintf(`SELECT username,data FROM %v ORDER BY username%v`, sqlTableDeletedUsers,
+		getSelectForUpdateSuffix())
+}
+
+func getUpdateDeletedUserSecretsQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET data=%v WHERE username=%v`, sqlTableDeletedUsers, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+func getGroupsSecretsQuery() string {
+	return fmt.Sprintf(`SELECT id,name,filesystem FROM %v ORDER BY id%v`, sqlTableGroups, getSelectForUpdateSuffix())
+}
+
+func getUpdateGroupSecretsQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET filesystem=%v WHERE id=%v`, sqlTableGroups, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
 func getDatabaseVersionQuery() string {
 	return fmt.Sprintf("SELECT version from %v LIMIT 1", sqlTableSchemaVersion)
 }
@@ -192,3 +367,12 @@ func getCompatV4FsConfigQuery() string {
 func updateCompatV4FsConfigQuery() string {
 	return fmt.Sprintf(`UPDATE %v SET filesystem=%v WHERE id=%v`, sqlTableUsers, sqlPlaceholders[0], sqlPlaceholders[1])
 }
+
+func getCompatV4FolderIDQuery() string {
+	return fmt.Sprintf(`SELECT id FROM %v WHERE path = %v`, sqlTableFolders, sqlPlaceholders[0])
+}
+
+func getCompatV4AddFolderQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (path,used_quota_size,used_quota_files,last_quota_update) VALUES (%v,0,0,0)`,
+		sqlTableFolders, sqlPlaceholders[0])
+}
@@ -0,0 +1,299 @@
+package dataprovider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	totpIssuer           = "SFTPGo"
+	totpRecoveryCodesNum = 10
+	// recovery codes are formatted as two groups of 5 hex chars separated by a dash
+	totpRecoveryCodeLen = 11
+	totpPrompt          = "Authentication code: "
+	maxTOTPSkew         = 10
+)
+
+var totpRecoveryCodeRegex = regexp.MustCompile(`^[0-9a-f]{5}-[0-9a-f]{5}$`)
+
+// UserTOTPConfig defines the time-based one-time password configuration for a user
+type UserTOTPConfig struct {
+	// if enabled the TOTP code is required to login using the protocols
+	// defined in the user filters
+	Enabled bool `json:"enabled"`
+	// base32 encoded TOTP secret, it is stored encrypted
+	Secret vfs.Secret `json:"secret,omitempty"`
+	// recovery codes, each code can be used only once instead of a TOTP code
+	RecoveryCodes []TOTPRecoveryCode `json:"recovery_codes,omitempty"`
+}
+
+// TOTPRecoveryCode defines a one-time recovery code
+type TOTPRecoveryCode struct {
+	// SHA256 hash of the recovery code, the code itself is never stored
+	Hash string `json:"hash,omitempty"`
+	Used bool   `json:"used"`
+}
+
+// TOTPProvisioning defines the data needed to configure an authenticator app
+type TOTPProvisioning struct {
+	// base32 encoded TOTP secret
+	Secret string `json:"secret"`
+	// otpauth URL, it can be imported directly or converted to a QR code
+	URL string `json:"url"`
+	// one-time recovery codes, they are shown only once
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// GenerateUserTOTP generates a new TOTP secret and new recovery codes for the given user.
+// The generated secret is not active until EnableUserTOTP is called with a valid code
+func GenerateUserTOTP(username string) (TOTPProvisioning, error) {
+	var result TOTPProvisioning
+	user, err := provider.userExists(username)
+	if err != nil {
+		return result, err
+	}
+	if user.TOTPConfig.Enabled {
+		return result, &ValidationError{field: "totp_config", err: "TOTP is already enabled, disable it before generating a new secret"}
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return result, err
+	}
+	result.Secret = secret
+	result.URL = utils.GetTOTPProvisioningURL(totpIssuer, username, secret)
+	user.TOTPConfig = UserTOTPConfig{
+		Enabled: false,
+		Secret: vfs.Secret{
+			Status:  vfs.SecretStatusPlain,
+			Payload: secret,
+		},
+	}
+	for i := 0; i < totpRecoveryCodesNum; i++ {
+		code, err := generateTOTPRecoveryCode()
+		if err != nil {
+			return result, err
+		}
+		result.RecoveryCodes = append(result.RecoveryCodes, code)
+		user.TOTPConfig.RecoveryCodes = append(user.TOTPConfig.RecoveryCodes, TOTPRecoveryCode{
+			Hash: getTOTPRecoveryCodeHash(code),
+		})
+	}
+	return result, UpdateUser(user)
+}
+
+// EnableUserTOTP enables TOTP for the given user if the code is valid for the generated secret
+func EnableUserTOTP(username, code string) error {
+	user, err := provider.userExists(username)
+	if err != nil {
+		return err
+	}
+	if user.TOTPConfig.Secret.IsEmpty() {
+		return &ValidationError{field: "totp_config", err: "no TOTP secret generated"}
+	}
+	if user.TOTPConfig.Enabled {
+		return &ValidationError{field: "totp_config", err: "TOTP is already enabled"}
+	}
+	if !user.isTOTPCodeValid(code) {
+		return &ValidationError{field: "totp_config", err: "invalid TOTP code"}
+	}
+	user.TOTPConfig.Enabled = true
+	return UpdateUser(user)
+}
+
+// DisableUserTOTP disables TOTP for the given user and removes the secret and the recovery codes
+func DisableUserTOTP(username string) error {
+	user, err := provider.userExists(username)
+	if err != nil {
+		return err
+	}
+	user.TOTPConfig = UserTOTPConfig{}
+	return UpdateUser(user)
+}
+
+// CheckKeyboardInteractiveTOTP asks for a TOTP code, or a recovery code, using a
+// keyboard interactive challenge. It is used as second authentication step for SSH.
+// Wrong codes are counted as failed logins for the login lockout
+func CheckKeyboardInteractiveTOTP(username string, client ssh.KeyboardInteractiveChallenge) (User, error) {
+	if err := checkLoginLockout(username); err != nil {
+		return User{}, err
+	}
+	user, err := checkKeyboardInteractiveTOTP(username, client)
+	if err == nil || err == ErrInvalidCredentials {
+		updateLoginLockout(username, SSHLoginMethodKeyboardInteractive, false, err)
+	}
+	return user, err
+}
+
+func checkKeyboardInteractiveTOTP(username string, client ssh.KeyboardInteractiveChallenge) (User, error) {
+	user, err := provider.userExists(username)
+	if err != nil {
+		return user, err
+	}
+	if err = checkLoginConditions(user); err != nil {
+		return user, err
+	}
+	if !user.TOTPConfig.Enabled {
+		return user, errors.New("TOTP is not enabled")
+	}
+	answers, err := client(user.Username, "", []string{totpPrompt}, []bool{false})
+	if err != nil {
+		return user, err
+	}
+	if len(answers) != 1 {
+		return user, fmt.Errorf("unexpected number of answers: %v", len(answers))
+	}
+	err = useTOTPCode(user, answers[0])
+	if err == nil {
+		return user, applyUserGroups(&user)
+	}
+	if err != ErrInvalidCredentials {
+		return user, err
+	}
+	if user.hasTOTPRecoveryCode(answers[0]) {
+		if err = useTOTPRecoveryCode(&user, answers[0]); err != nil {
+			return user, err
+		}
+		return user, applyUserGroups(&user)
+	}
+	return user, ErrInvalidCredentials
+}
+
+// checkUserPasswordAndTOTP checks a password with the TOTP code, or a recovery code,
+// appended. It is used for the protocols that cannot ask for the code interactively.
+// The password, without the code, is checked using checkPassword
+func checkUserPasswordAndTOTP(user User, password string, checkPassword func(password string) (User, error)) (User, error) {
+	if len(password) > totpRecoveryCodeLen {
+		code := password[len(password)-totpRecoveryCodeLen:]
+		if totpRecoveryCodeRegex.MatchString(code) {
+			if !user.hasTOTPRecoveryCode(code) {
+				return user, ErrInvalidCredentials
+			}
+			user, err := checkPassword(password[:len(password)-totpRecoveryCodeLen])
+			if err != nil {
+				return user, err
+			}
+			return user, useTOTPRecoveryCode(&user, code)
+		}
+	}
+	if len(password) <= utils.TOTPDigits {
+		return user, ErrInvalidCredentials
+	}
+	code := password[len(password)-utils.TOTPDigits:]
+	if !user.isTOTPCodeValid(code) {
+		return user, ErrInvalidCredentials
+	}
+	// the code is marked as used only after checking the password
+	user, err := checkPassword(password[:len(password)-utils.TOTPDigits])
+	if err != nil {
+		return user, err
+	}
+	return user, useTOTPCode(user, code)
+}
+
+// useTOTPCode checks the given TOTP code and marks its time step as used. A code is
+// accepted only if its time step is more recent than the last used one, so a code
+// cannot be replayed
+func useTOTPCode(user User, code string) error {
+	step, ok := user.getTOTPCodeStep(code)
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	updated, err := provider.updateLastTOTPStep(user.Username, step)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		providerLog(logger.LevelInfo, "TOTP code for user %#v refused, the code was already used", user.Username)
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// useTOTPRecoveryCode marks the given recovery code as used
+func useTOTPRecoveryCode(user *User, code string) error {
+	// reload the user to avoid to overwrite concurrent changes
+	u, err := provider.userExists(user.Username)
+	if err != nil {
+		return err
+	}
+	hash := getTOTPRecoveryCodeHash(code)
+	for idx := range u.TOTPConfig.RecoveryCodes {
+		rc := &u.TOTPConfig.RecoveryCodes[idx]
+		if !rc.Used && subtle.ConstantTimeCompare([]byte(rc.Hash), []byte(hash)) == 1 {
+			rc.Used = true
+			if err := provider.updateUser(u); err != nil {
+				providerLog(logger.LevelWarn, "unable to mark TOTP recovery code as used for user %#v: %v", u.Username, err)
+				return err
+			}
+			RemoveCachedWebDAVUser(u.Username)
+			providerLog(logger.LevelInfo, "TOTP recovery code used for user %#v, remaining codes: %v", u.Username,
+				u.getRemainingTOTPRecoveryCodes())
+			user.TOTPConfig = u.TOTPConfig
+			return nil
+		}
+	}
+	return ErrInvalidCredentials
+}
+
+func validateUserTOTPConfig(user *User) error {
+	for _, p := range user.Filters.TOTPProtocols {
+		if !utils.IsStringInSlice(p, ValidProtocols) {
+			return &ValidationError{field: "filters.totp_protocols", err: fmt.Sprintf("invalid TOTP protocol: %#v", p)}
+		}
+	}
+	user.Filters.TOTPProtocols = utils.RemoveDuplicates(user.Filters.TOTPProtocols)
+	if user.TOTPConfig.Secret.IsEmpty() {
+		if user.TOTPConfig.Enabled {
+			return &ValidationError{field: "totp_config", err: "TOTP cannot be enabled without a secret"}
+		}
+		user.TOTPConfig.RecoveryCodes = nil
+		return nil
+	}
+	if user.TOTPConfig.Secret.IsEncrypted() && !user.TOTPConfig.Secret.IsValid() {
+		return &ValidationError{field: "totp_config", err: "invalid encrypted TOTP secret"}
+	}
+	if !user.TOTPConfig.Secret.IsValidInput() {
+		return &ValidationError{field: "totp_config", err: "invalid TOTP secret"}
+	}
+	if user.TOTPConfig.Secret.IsPlain() {
+		if _, err := utils.GetTOTPCode(user.TOTPConfig.Secret.Payload, time.Now()); err != nil {
+			return &ValidationError{field: "totp_config", err: err.Error()}
+		}
+		user.TOTPConfig.Secret.AdditionalData = user.Username
+		if err := user.TOTPConfig.Secret.Encrypt(); err != nil {
+			return &ValidationError{field: "totp_config", err: fmt.Sprintf("could not encrypt TOTP secret: %v", err)}
+		}
+	}
+	for _, rc := range user.TOTPConfig.RecoveryCodes {
+		if _, err := hex.DecodeString(rc.Hash); err != nil || len(rc.Hash) != 2*sha256.Size {
+			return &ValidationError{field: "totp_config", err: fmt.Sprintf("invalid TOTP recovery code hash: %#v", rc.Hash)}
+		}
+	}
+	return nil
+}
+
+func generateTOTPRecoveryCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+	return code[:5] + "-" + code[5:], nil
+}
+
+func getTOTPRecoveryCodeHash(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
@@ -1,6 +1,7 @@
 package dataprovider
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,17 +9,25 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/net/webdav"
-
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
 )
 
+// Placeholders supported inside the users home dir and the virtual folders mapped paths
+const (
+	pathPlaceholderUsername = "%username%"
+	pathPlaceholderUID      = "%uid%"
+	pathPlaceholderGID      = "%gid%"
+)
+
+var pathPlaceholders = []string{pathPlaceholderUsername, pathPlaceholderUID, pathPlaceholderGID}
+
 // Available permissions for SFTP users
 const (
 	// All permissions are granted
@@ -46,6 +55,10 @@ const (
 	PermChown = "chown"
 	// changing file or directory access and modification time is allowed
 	PermChtimes = "chtimes"
+	// drop box mode: new files can be uploaded but the directory contents cannot
+	// be listed, downloaded, overwritten, renamed or deleted.
+	// It can only be combined with the create_dirs permission
+	PermUploadOnly = "upload_only"
 )
 
 // Available login methods
@@ -58,6 +71,19 @@ const (
 	SSHLoginMethodKeyAndKeyboardInt   = "publickey+keyboard-interactive"
 )
 
+// Supported periods for the download volume limit
+const (
+	DownloadVolumePeriodDay   = "day"
+	DownloadVolumePeriodMonth = "month"
+)
+
+// Allowed write modes for existing files, see WriteModeFilter
+const (
+	WriteModeAny = iota
+	WriteModeAppendOnly
+	WriteModeOverwriteOnly
+)
+
 var (
 	errNoMatchingVirtualFolder = errors.New("no matching virtual folder found")
 )
@@ -67,7 +93,6 @@ type CachedUser struct {
 	User       User
 	Expiration time.Time
 	Password   string
-	LockSystem webdav.LockSystem
 }
 
 // IsExpired returns true if the cached user is expired
@@ -121,6 +146,197 @@ type PatternsFilter struct {
 	DeniedPatterns []string `json:"denied_patterns,omitempty"`
 }
 
+// DownloadSizeLimitFilter defines the maximum size for the files that can be
+// downloaded from a virtual directory
+type DownloadSizeLimitFilter struct {
+	// Virtual path, if no other specific filter is defined, the filter apply for
+	// sub directories too
+	Path string `json:"path"`
+	// maximum size, as bytes, for the downloadable files. 0 means unlimited
+	MaxFileSize int64 `json:"max_file_size"`
+}
+
+// DirectoryFilesLimitFilter defines the maximum number of files that can be stored
+// directly inside a virtual directory
+type DirectoryFilesLimitFilter struct {
+	// Virtual path, if no other specific filter is defined, the filter apply for
+	// sub directories too, each directory is limited on its own
+	Path string `json:"path"`
+	// maximum number of files, sub directories are not counted. 0 means unlimited
+	MaxFiles int `json:"max_files"`
+}
+
+// UploadDurationLimitFilter defines the maximum duration for the uploads to a virtual directory
+type UploadDurationLimitFilter struct {
+	// Virtual path, if no other specific filter is defined, the filter apply for
+	// sub directories too
+	Path string `json:"path"`
+	// maximum duration, as seconds, for an upload, from open to close. 0 means unlimited
+	MaxDuration int `json:"max_duration"`
+	// minimum transfer rate, as bytes per second. If set the allowed duration is extended
+	// by the time needed to transfer the received bytes at this rate
+	MinRate int64 `json:"min_rate,omitempty"`
+}
+
+// BandwidthScheduleFilter defines the bandwidth limits applied within a time window.
+// The times are evaluated using the server local time
+type BandwidthScheduleFilter struct {
+	// week days, 0 is Sunday and 6 is Saturday. If empty the window applies to any day
+	WeekDays []int `json:"week_days,omitempty"`
+	// window start, as HH:MM
+	Start string `json:"start"`
+	// window end, as HH:MM, it is excluded. Use 24:00 for the end of the day.
+	// The end must be after the start, split windows crossing midnight
+	End string `json:"end"`
+	// maximum upload and download bandwidth as KB/s within the window, 0 means unlimited
+	UploadBandwidth   int64 `json:"upload_bandwidth"`
+	DownloadBandwidth int64 `json:"download_bandwidth"`
+}
+
+// isActive returns true if the window includes the given time
+func (f *BandwidthScheduleFilter) isActive(t time.Time) bool {
+	return isTimeInWindow(t, f.WeekDays, f.Start, f.End)
+}
+
+// AccessTimeFilter defines a time window within which the user is allowed to login
+type AccessTimeFilter struct {
+	// week days, 0 is Sunday and 6 is Saturday. If empty the window applies to any day
+	WeekDays []int `json:"week_days,omitempty"`
+	// window start, as HH:MM
+	Start string `json:"start"`
+	// window end, as HH:MM, it is excluded. Use 24:00 for the end of the day.
+	// The end must be after the start, split windows crossing midnight
+	End string `json:"end"`
+	// IANA time zone name used to evaluate the window, for example "Europe/Rome".
+	// If empty the server local time is used
+	TimeZone string `json:"time_zone,omitempty"`
+}
+
+// isActive returns true if the window includes the given time
+func (f *AccessTimeFilter) isActive(t time.Time) bool {
+	if f.TimeZone != "" {
+		loc, err := time.LoadLocation(f.TimeZone)
+		if err != nil {
+			return false
+		}
+		t = t.In(loc)
+	}
+	return isTimeInWindow(t, f.WeekDays, f.Start, f.End)
+}
+
+// isTimeInWindow returns true if the given time is within the window defined by the
+// given week days, an empty list means any day, and start and end times as HH:MM
+func isTimeInWindow(t time.Time, weekDays []int, startTime, endTime string) bool {
+	if len(weekDays) > 0 && !utils.IsIntInSlice(int(t.Weekday()), weekDays) {
+		return false
+	}
+	start, err := parseScheduleTime(startTime)
+	if err != nil {
+		return false
+	}
+	end, err := parseScheduleTime(endTime)
+	if err != nil {
+		return false
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	return minutes >= start && minutes < end
+}
+
+// parseScheduleTime parses a time as HH:MM and returns the minutes since midnight
+func parseScheduleTime(value string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %#v, the expected format is HH:MM", value)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("invalid hours in time %#v", value)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid minutes in time %#v", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+// TextTransformFilter defines the conversions applied to the text files uploaded
+// inside a virtual directory. Only the files with the configured extensions are
+// converted, any other file is stored as it is uploaded.
+// Text transforms are supported for the local filesystem only and they are not applied
+// to resumed uploads
+type TextTransformFilter struct {
+	// Virtual path, if no other specific filter is defined, the filter apply for
+	// sub directories too
+	Path string `json:"path"`
+	// files with these, case insensitive, extensions are converted, for example ".txt", ".edi"
+	Extensions []string `json:"extensions"`
+	// line endings for the stored files: "lf" or "crlf". Empty means unchanged
+	LineEndings string `json:"line_endings,omitempty"`
+	// set to true to remove the UTF-8 BOM at the start of the uploaded files
+	StripBOM bool `json:"strip_bom,omitempty"`
+}
+
+// WriteModeFilter defines the allowed write modes, for existing files, based on
+// case insensitive shell like patterns. Patterns starting with "." and without
+// wildcards, for example ".log", match the file extension.
+// An existing append-only file can only be opened to add data at its end, it cannot
+// be truncated. An existing overwrite-only file must be truncated when opened for writing,
+// appending to it is not allowed. Files not matching any pattern allow both modes.
+// New files can always be created
+type WriteModeFilter struct {
+	// Virtual path, if no other specific filter is defined, the filter apply for
+	// sub directories too.
+	// For example if filters are defined for the paths "/" and "/sub" then the
+	// filters for "/" are applied for any file outside the "/sub" directory
+	Path string `json:"path"`
+	// files with these patterns are append-only
+	AppendOnly []string `json:"append_only,omitempty"`
+	// files with these patterns are overwrite-only
+	OverwriteOnly []string `json:"overwrite_only,omitempty"`
+}
+
+// UploadOrderFilter defines an upload order rule for a directory.
+// A directory with an upload order rule is unlocked until the sentinel file
+// is uploaded, after that it is locked and further uploads, other than
+// overwriting the sentinel itself, are denied.
+// If required files are defined the sentinel file can be uploaded only after
+// all of them are present inside the directory.
+// The rule applies to the configured directory only and not to its sub directories
+type UploadOrderFilter struct {
+	// Virtual path of the directory
+	Path string `json:"path"`
+	// sentinel file name, for example "manifest.json"
+	SentinelFile string `json:"sentinel_file"`
+	// file names that must exist before the sentinel file can be uploaded
+	RequiredFiles []string `json:"required_files,omitempty"`
+}
+
+// PathSchemaFilter defines the directory structure required for the paths created
+// inside a directory. The schema is a "/" separated list of segments, relative to the
+// filter path, each segment is a literal directory name or a variable such as "{customer}".
+// Directories can be created only if they match the schema, files can be uploaded only
+// inside a directory matching the whole schema.
+// The schema applies to any sub directory, the most specific filter is used
+type PathSchemaFilter struct {
+	// Virtual path of the directory
+	Path string `json:"path"`
+	// schema, for example "{customer}/{year}/{month}"
+	Schema string `json:"schema"`
+	// allowed values for the schema variables. Values starting with "^" are regular
+	// expressions that must match the whole segment. A variable without allowed values
+	// matches any directory name
+	Variables map[string][]string `json:"variables,omitempty"`
+}
+
+// ProtocolPermissionsFilter defines the permissions to apply for a specific protocol
+type ProtocolPermissionsFilter struct {
+	// one of the protocols defined in ValidProtocols
+	Protocol string `json:"protocol"`
+	// permissions for the given protocol, they replace the base user permissions,
+	// the root directory permissions are required
+	Permissions map[string][]string `json:"permissions"`
+}
+
 // UserFilters defines additional restrictions for a user
 type UserFilters struct {
 	// only clients connecting from these IP/Mask are allowed.
@@ -141,8 +357,94 @@ type UserFilters struct {
 	FileExtensions []ExtensionsFilter `json:"file_extensions,omitempty"`
 	// filter based on shell patterns
 	FilePatterns []PatternsFilter `json:"file_patterns,omitempty"`
+	// regular expressions matched against the base name of uploaded files and rename targets.
+	// Denied expressions are evaluated first, if allowed expressions are defined the name
+	// must match at least one of them. Downloads are not affected
+	UploadNameAllowedRegex []string `json:"upload_name_allowed_regex,omitempty"`
+	UploadNameDeniedRegex  []string `json:"upload_name_denied_regex,omitempty"`
 	// max size allowed for a single upload, 0 means unlimited
 	MaxUploadFileSize int64 `json:"max_upload_file_size,omitempty"`
+	// upload order rules, they are opt-in and evaluated when a file is opened for writing
+	UploadOrder []UploadOrderFilter `json:"upload_order,omitempty"`
+	// allowed write modes, append or overwrite, for existing files
+	WriteModes []WriteModeFilter `json:"write_modes,omitempty"`
+	// command lines allowed over SSH exec in addition to the globally enabled SSH commands.
+	// Each entry must match the whole command line, entries starting with "^" are
+	// regular expressions. If null or empty no additional command is allowed
+	AllowedExecCommands []string `json:"allowed_exec_commands,omitempty"`
+	// max volume, as bytes, that can be downloaded in a period, 0 means unlimited
+	DownloadVolumeLimit int64 `json:"download_volume_limit,omitempty"`
+	// period for the download volume limit: "day" or "month". Periods start at midnight UTC
+	DownloadVolumePeriod string `json:"download_volume_period,omitempty"`
+	// virtual directories where the missing intermediate directories are automatically
+	// created on upload. The setting applies to the sub directories too
+	AutoCreateDirs []string `json:"auto_create_dirs,omitempty"`
+	// by default the active sessions are closed if the password or the public keys change,
+	// set to true to keep them
+	KeepSessionsOnCredentialsChange bool `json:"keep_sessions_on_credentials_change,omitempty"`
+	// maximum directory depth, relative to the starting directory, for recursive operations
+	// such as depth infinity PROPFIND and recursive delete. 0 means unlimited
+	MaxRecursionDepth int `json:"max_recursion_depth,omitempty"`
+	// maximum number of files and directories visited by a recursive operation. 0 means unlimited
+	MaxRecursionEntries int `json:"max_recursion_entries,omitempty"`
+	// maximum number of files that can be open at the same time within a single session.
+	// 0 means the global setting is used
+	MaxOpenFiles int `json:"max_open_files,omitempty"`
+	// idle timeout, as minutes, for the user sessions. 0 means the global setting is used
+	IdleTimeout int `json:"idle_timeout,omitempty"`
+	// maximum number of uploads and downloads that can run at the same time for the user,
+	// regardless of the number of sessions. 0 means unlimited
+	MaxConcurrentUploads   int `json:"max_concurrent_uploads,omitempty"`
+	MaxConcurrentDownloads int `json:"max_concurrent_downloads,omitempty"`
+	// maximum size, as bytes, for the files that can be downloaded, 0 means unlimited.
+	// It does not affect the uploads
+	MaxDownloadFileSize int64 `json:"max_download_file_size,omitempty"`
+	// per directory overrides for MaxDownloadFileSize
+	DownloadSizeLimits []DownloadSizeLimitFilter `json:"download_size_limits,omitempty"`
+	// maximum number of files that can be created directly inside the configured directories
+	DirectoryFilesLimits []DirectoryFilesLimitFilter `json:"directory_files_limits,omitempty"`
+	// opt-in line endings conversion and BOM removal for uploaded text files
+	TextTransforms []TextTransformFilter `json:"text_transforms,omitempty"`
+	// maximum duration, as seconds, for an upload, from open to close. 0 means unlimited
+	MaxUploadDuration int `json:"max_upload_duration,omitempty"`
+	// minimum upload rate, as bytes per second, used to extend MaxUploadDuration
+	// based on the uploaded size. 0 means the duration does not depend on the size
+	MinUploadRate int64 `json:"min_upload_rate,omitempty"`
+	// per directory overrides for MaxUploadDuration and MinUploadRate
+	UploadDurationLimits []UploadDurationLimitFilter `json:"upload_duration_limits,omitempty"`
+	// permissions granted to the virtual folders attached to this user from now on,
+	// if no explicit permissions are set for their virtual path. Existing folders are
+	// not affected. If null or empty no default is applied
+	DefaultFolderPermissions []string `json:"default_folder_permissions,omitempty"`
+	// if enabled, a rename fails if the parent directory of the target path does not exist.
+	// Cloud Storage backends allow to create a key inside a missing "directory", the
+	// renamed object will be stored inside a directory that exists only as a key prefix
+	RequireRenameTargetDir bool `json:"require_rename_target_dir,omitempty"`
+	// if enabled, renames and moves always require the rename permission on both the source
+	// and the target directories. By default a user with the delete permission on the source
+	// directory and the upload/create permissions on the target directory can rename too
+	RequireRenamePermission bool `json:"require_rename_permission,omitempty"`
+	// quota usage percentages that fire the "quota_warning" user action when crossed,
+	// they override the global thresholds defined in the data provider configuration
+	QuotaWarningThresholds []int `json:"quota_warning_thresholds,omitempty"`
+	// opt-in directory structures required for the directories and files created
+	// inside the configured paths
+	PathSchemas []PathSchemaFilter `json:"path_schemas,omitempty"`
+	// bandwidth limits for specific time windows, they override the user bandwidth limits
+	// while active. The windows cannot overlap
+	BandwidthSchedules []BandwidthScheduleFilter `json:"bandwidth_schedules,omitempty"`
+	// protocols requiring the TOTP code once TOTP is enabled for the user.
+	// If null or empty the code is required for all the protocols
+	TOTPProtocols []string `json:"totp_protocols,omitempty"`
+	// per protocol permissions, if a protocol is listed here its permissions replace
+	// the base user permissions for the connections using that protocol
+	ProtocolPermissions []ProtocolPermissionsFilter `json:"protocol_permissions,omitempty"`
+	// time windows within which the user is allowed to login.
+	// If null or empty the user can login at any time
+	AccessTimes []AccessTimeFilter `json:"access_times,omitempty"`
+	// if enabled, the active sessions are disconnected when they are outside
+	// the allowed access times
+	DisconnectOutsideAccessTimes bool `json:"disconnect_outside_access_times,omitempty"`
 }
 
 // FilesystemProvider defines the supported storages
@@ -154,6 +456,9 @@ const (
 	S3FilesystemProvider                                  // AWS S3 compatible
 	GCSFilesystemProvider                                 // Google Cloud Storage
 	AzureBlobFilesystemProvider                           // Azure Blob Storage
+	B2FilesystemProvider                                  // Backblaze B2 Cloud Storage
+	SFTPFilesystemProvider                                // upstream SFTP server
+	CryptedFilesystemProvider                             // Local encrypted
 )
 
 // Filesystem defines cloud storage filesystem details
@@ -162,6 +467,35 @@ type Filesystem struct {
 	S3Config     vfs.S3FsConfig     `json:"s3config,omitempty"`
 	GCSConfig    vfs.GCSFsConfig    `json:"gcsconfig,omitempty"`
 	AzBlobConfig vfs.AzBlobFsConfig `json:"azblobconfig,omitempty"`
+	B2Config     vfs.B2FsConfig     `json:"b2config,omitempty"`
+	SFTPConfig   vfs.SFTPFsConfig   `json:"sftpconfig,omitempty"`
+	CryptConfig  vfs.CryptFsConfig  `json:"cryptconfig,omitempty"`
+	// transparent compression at rest, Cloud Storage backends only
+	Compression vfs.CompressionConfig `json:"compression,omitempty"`
+	// local read-through cache, Cloud Storage backends only
+	Cache vfs.CacheConfig `json:"cache,omitempty"`
+	// home marker mode for the configured key prefix, Cloud Storage backends only.
+	// 0 disabled, 1 create the marker on login if missing, 2 deny login if the marker is missing
+	HomeMarker int `json:"home_marker,omitempty"`
+}
+
+func (f *Filesystem) hideConfidentialData() {
+	switch f.Provider {
+	case S3FilesystemProvider:
+		f.S3Config.AccessSecret.Hide()
+		f.S3Config.SSECustomerKey.Hide()
+	case GCSFilesystemProvider:
+		f.GCSConfig.Credentials.Hide()
+	case AzureBlobFilesystemProvider:
+		f.AzBlobConfig.AccountKey.Hide()
+	case B2FilesystemProvider:
+		f.B2Config.ApplicationKey.Hide()
+	case SFTPFilesystemProvider:
+		f.SFTPConfig.Password.Hide()
+		f.SFTPConfig.PrivateKey.Hide()
+	case CryptedFilesystemProvider:
+		f.CryptConfig.Passphrase.Hide()
+	}
 }
 
 // User defines a SFTPGo user
@@ -204,6 +538,24 @@ type User struct {
 	UsedQuotaFiles int `json:"used_quota_files"`
 	// Last quota update as unix timestamp in milliseconds
 	LastQuotaUpdate int64 `json:"last_quota_update"`
+	// Downloaded bytes in the current download volume period
+	UsedDownloadVolume int64 `json:"used_download_volume,omitempty"`
+	// Start of the current download volume period as unix timestamp in milliseconds
+	DownloadVolumePeriodStart int64 `json:"download_volume_period_start,omitempty"`
+	// Expiration date, as unix timestamp in milliseconds, for which the last expiration warning was fired
+	LastExpirationWarning int64 `json:"last_expiration_warning,omitempty"`
+	// Consecutive failed logins counted for the login lockout
+	LoginFailures int `json:"login_failures,omitempty"`
+	// Last failed login, as unix timestamp in milliseconds
+	LastLoginFailure int64 `json:"last_login_failure,omitempty"`
+	// Login lockout expiration, as unix timestamp in milliseconds
+	LockedUntil int64 `json:"locked_until,omitempty"`
+	// Time step of the last TOTP code used to login, the codes for this step and for
+	// the previous ones are refused
+	LastTOTPStep int64 `json:"last_totp_step,omitempty"`
+	// Authentication backend that created the user, empty for the users managed inside the data provider.
+	// The provider backend does not authenticate the users created by another backend
+	AuthBackend string `json:"auth_backend,omitempty"`
 	// Maximum upload bandwidth as KB/s, 0 means unlimited
 	UploadBandwidth int64 `json:"upload_bandwidth"`
 	// Maximum download bandwidth as KB/s, 0 means unlimited
@@ -214,32 +566,69 @@ type User struct {
 	Filters UserFilters `json:"filters"`
 	// Filesystem configuration details
 	FsConfig Filesystem `json:"filesystem"`
+	// Custom metadata as key/value pairs. SFTPGo stores them but never interprets them
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Groups the user is member of. The settings not defined for the user are inherited
+	// from the groups at login time, see Group for details
+	Groups []string `json:"groups,omitempty"`
+	// Time-based one-time password configuration, used for two-factor authentication
+	TOTPConfig UserTOTPConfig `json:"totp_config"`
 }
 
-// GetFilesystem returns the filesystem for this user
+// GetFilesystem returns the filesystem for this user.
+// If the storage credentials are fetched from an external secrets store and they cannot
+// be resolved, the user can still login but the filesystem operations will fail
 func (u *User) GetFilesystem(connectionID string) (vfs.Fs, error) {
-	if u.FsConfig.Provider == S3FilesystemProvider {
-		return vfs.NewS3Fs(connectionID, u.GetHomeDir(), u.FsConfig.S3Config)
-	} else if u.FsConfig.Provider == GCSFilesystemProvider {
+	if err := u.checkPathPlaceholders(); err != nil {
+		return nil, err
+	}
+	fs, err := u.getFilesystem(connectionID)
+	if err != nil && vfs.IsSecretResolutionError(err) {
+		providerLog(logger.LevelWarn, "unable to create filesystem for user %#v, connection id %#v: %v",
+			u.Username, connectionID, err)
+		return vfs.NewUnavailableFs(connectionID, u.GetHomeDir(),
+			fmt.Sprintf("Fs provider %v", u.FsConfig.Provider), err), nil
+	}
+	return fs, err
+}
+
+func (u *User) getFilesystem(connectionID string) (vfs.Fs, error) {
+	var fs vfs.Fs
+	var err error
+	switch u.FsConfig.Provider {
+	case S3FilesystemProvider:
+		fs, err = vfs.NewS3Fs(connectionID, u.GetHomeDir(), u.FsConfig.S3Config)
+	case GCSFilesystemProvider:
 		config := u.FsConfig.GCSConfig
 		config.CredentialFile = u.getGCSCredentialsFilePath()
-		return vfs.NewGCSFs(connectionID, u.GetHomeDir(), config)
-	} else if u.FsConfig.Provider == AzureBlobFilesystemProvider {
-		return vfs.NewAzBlobFs(connectionID, u.GetHomeDir(), u.FsConfig.AzBlobConfig)
+		fs, err = vfs.NewGCSFs(connectionID, u.GetHomeDir(), config)
+	case AzureBlobFilesystemProvider:
+		fs, err = vfs.NewAzBlobFs(connectionID, u.GetHomeDir(), u.FsConfig.AzBlobConfig)
+	case B2FilesystemProvider:
+		fs, err = vfs.NewB2Fs(connectionID, u.GetHomeDir(), u.FsConfig.B2Config)
+	case SFTPFilesystemProvider:
+		return vfs.NewSFTPFs(connectionID, u.GetHomeDir(), u.FsConfig.SFTPConfig)
+	case CryptedFilesystemProvider:
+		return vfs.NewCryptFs(connectionID, u.GetHomeDir(), u.FsConfig.CryptConfig)
+	default:
+		return vfs.NewOsFs(connectionID, u.GetHomeDir(), u.getResolvedVirtualFolders()), nil
 	}
-	return vfs.NewOsFs(connectionID, u.GetHomeDir(), u.VirtualFolders), nil
+	if err == nil && u.FsConfig.Cache.IsEnabled() {
+		fs, err = vfs.NewCachedFs(fs, u.GetHomeDir(), u.FsConfig.Cache)
+	}
+	if err == nil && u.FsConfig.Compression.IsEnabled() {
+		fs = vfs.NewCompressedFs(fs, u.GetHomeDir(), u.FsConfig.Compression)
+	}
+	return fs, err
 }
 
 // HideConfidentialData hides user confidential data
 func (u *User) HideConfidentialData() {
 	u.Password = ""
-	switch u.FsConfig.Provider {
-	case S3FilesystemProvider:
-		u.FsConfig.S3Config.AccessSecret.Hide()
-	case GCSFilesystemProvider:
-		u.FsConfig.GCSConfig.Credentials.Hide()
-	case AzureBlobFilesystemProvider:
-		u.FsConfig.AzBlobConfig.AccountKey.Hide()
+	u.FsConfig.hideConfidentialData()
+	u.TOTPConfig.Secret.Hide()
+	for idx := range u.TOTPConfig.RecoveryCodes {
+		u.TOTPConfig.RecoveryCodes[idx].Hash = ""
 	}
 }
 
@@ -259,16 +648,84 @@ func (u *User) GetPermissionsForPath(p string) []string {
 	// dirsForPath contains all the dirs for a given path in reverse order
 	// for example if the path is: /1/2/3/4 it contains:
 	// [ "/1/2/3/4", "/1/2/3", "/1/2", "/1", "/" ]
-	// so the first match is the one we are interested to
+	// so the first match is the one we are interested to.
+	// Plain directory keys take precedence over patterns matching the same dir
 	for _, val := range dirsForPath {
 		if perms, ok := u.Permissions[val]; ok {
 			permissions = perms
 			break
 		}
+		if perms, ok := u.getPatternPermissions(val); ok {
+			permissions = perms
+			break
+		}
 	}
 	return permissions
 }
 
+// GetPermissionsForFile returns the permissions for the given file.
+// Patterns matching the file path take precedence, if there is no
+// matching pattern the permissions for the parent directory are returned
+func (u *User) GetPermissionsForFile(filePath string) []string {
+	filePath = utils.CleanPath(filePath)
+	if perms, ok := u.getPatternPermissions(filePath); ok {
+		return perms
+	}
+	return u.GetPermissionsForPath(path.Dir(filePath))
+}
+
+// getPatternPermissions returns the permissions for the most specific pattern
+// matching the given path. A pattern is more specific than another one if it has
+// more literal, non-wildcard, characters, ties are broken by comparing the patterns
+func (u *User) getPatternPermissions(p string) ([]string, bool) {
+	var permissions []string
+	matchedPattern := ""
+	matchedLiterals := -1
+	for pattern, perms := range u.Permissions {
+		if !IsPermissionPattern(pattern) {
+			continue
+		}
+		if matched, err := path.Match(pattern, p); err != nil || !matched {
+			continue
+		}
+		literals := getPatternLiteralsCount(pattern)
+		if literals > matchedLiterals || (literals == matchedLiterals && pattern < matchedPattern) {
+			permissions = perms
+			matchedPattern = pattern
+			matchedLiterals = literals
+		}
+	}
+	return permissions, matchedLiterals >= 0
+}
+
+// IsPermissionPattern returns true if the given permissions key is a glob
+// pattern instead of a plain directory
+func IsPermissionPattern(key string) bool {
+	return strings.ContainsAny(key, "*?[")
+}
+
+func getPatternLiteralsCount(pattern string) int {
+	count := 0
+	inClass := false
+	for idx := 0; idx < len(pattern); idx++ {
+		switch c := pattern[idx]; {
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+		case c == '*' || c == '?':
+		case c == '\\':
+			idx++
+			count++
+		default:
+			count++
+		}
+	}
+	return count
+}
+
 // GetVirtualFolderForPath returns the virtual folder containing the specified sftp path.
 // If the path is not inside a virtual folder an error is returned
 func (u *User) GetVirtualFolderForPath(sftpPath string) (vfs.VirtualFolder, error) {
@@ -314,8 +771,8 @@ func (u *User) AddVirtualDirs(list []os.FileInfo, sftpPath string) []os.FileInfo
 // IsMappedPath returns true if the specified filesystem path has a virtual folder mapping.
 // The filesystem path must be cleaned before calling this method
 func (u *User) IsMappedPath(fsPath string) bool {
-	for _, v := range u.VirtualFolders {
-		if fsPath == v.MappedPath {
+	for idx := range u.VirtualFolders {
+		if fsPath == u.GetMappedPath(&u.VirtualFolders[idx]) {
 			return true
 		}
 	}
@@ -359,17 +816,40 @@ func (u *User) HasPermissionsInside(sftpPath string) bool {
 				return true
 			}
 		}
+		if IsPermissionPattern(dir) && isPatternInside(dir, sftpPath) {
+			return true
+		}
 	}
 	return false
 }
 
+// isPatternInside returns true if the given pattern could match sftpPath
+// or a path inside it
+func isPatternInside(pattern, sftpPath string) bool {
+	patternElems := strings.Split(pattern, "/")
+	pathElems := strings.Split(sftpPath, "/")
+	if sftpPath == "/" {
+		pathElems = []string{""}
+	}
+	if len(patternElems) < len(pathElems) {
+		return false
+	}
+	for idx, elem := range pathElems {
+		if matched, err := path.Match(patternElems[idx], elem); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
 // HasOverlappedMappedPaths returns true if this user has virtual folders with overlapped mapped paths
 func (u *User) HasOverlappedMappedPaths() bool {
 	if len(u.VirtualFolders) <= 1 {
 		return false
 	}
-	for _, v1 := range u.VirtualFolders {
-		for _, v2 := range u.VirtualFolders {
+	folders := u.getResolvedVirtualFolders()
+	for _, v1 := range folders {
+		for _, v2 := range folders {
 			if v1.VirtualPath == v2.VirtualPath {
 				continue
 			}
@@ -383,11 +863,12 @@ func (u *User) HasOverlappedMappedPaths() bool {
 
 // HasPerm returns true if the user has the given permission or any permission
 func (u *User) HasPerm(permission, path string) bool {
-	perms := u.GetPermissionsForPath(path)
-	if utils.IsStringInSlice(PermAny, perms) {
-		return true
-	}
-	return utils.IsStringInSlice(permission, perms)
+	return isPermissionGranted(permission, u.GetPermissionsForPath(path))
+}
+
+// HasFilePerm returns true if the user has the given permission for the specified file
+func (u *User) HasFilePerm(permission, filePath string) bool {
+	return isPermissionGranted(permission, u.GetPermissionsForFile(filePath))
 }
 
 // HasPerms return true if the user has all the given permissions
@@ -397,13 +878,31 @@ func (u *User) HasPerms(permissions []string, path string) bool {
 		return true
 	}
 	for _, permission := range permissions {
-		if !utils.IsStringInSlice(permission, perms) {
+		if !isPermissionGranted(permission, perms) {
 			return false
 		}
 	}
 	return true
 }
 
+// IsUploadOnlyPath returns true if the specified path is a drop box directory
+func (u *User) IsUploadOnlyPath(path string) bool {
+	return utils.IsStringInSlice(PermUploadOnly, u.GetPermissionsForPath(path))
+}
+
+// isPermissionGranted returns true if the given permission is granted by the
+// specified permissions list. The upload only permission grants upload and
+// nothing else, create_dirs can be explicitly added
+func isPermissionGranted(permission string, perms []string) bool {
+	if utils.IsStringInSlice(PermAny, perms) {
+		return true
+	}
+	if utils.IsStringInSlice(PermUploadOnly, perms) && permission == PermUpload {
+		return true
+	}
+	return utils.IsStringInSlice(permission, perms)
+}
+
 // HasNoQuotaRestrictions returns true if no quota restrictions need to be applyed
 func (u *User) HasNoQuotaRestrictions(checkFiles bool) bool {
 	if u.QuotaSize == 0 && (!checkFiles || u.QuotaFiles == 0) {
@@ -412,6 +911,42 @@ func (u *User) HasNoQuotaRestrictions(checkFiles bool) bool {
 	return false
 }
 
+// HasDownloadVolumeLimit returns true if the user has a periodic download volume limit
+func (u *User) HasDownloadVolumeLimit() bool {
+	return u.Filters.DownloadVolumeLimit > 0
+}
+
+// GetDownloadVolumePeriodStart returns the start, as unix timestamp in milliseconds,
+// of the download volume period including the given time
+func (u *User) GetDownloadVolumePeriodStart(t time.Time) int64 {
+	t = t.UTC()
+	var start time.Time
+	if u.Filters.DownloadVolumePeriod == DownloadVolumePeriodMonth {
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	} else {
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return utils.GetTimeAsMsSinceEpoch(start)
+}
+
+// GetUsedDownloadVolume returns the bytes downloaded in the period including the given time
+func (u *User) GetUsedDownloadVolume(t time.Time) int64 {
+	if u.DownloadVolumePeriodStart != u.GetDownloadVolumePeriodStart(t) {
+		return 0
+	}
+	return u.UsedDownloadVolume
+}
+
+// GetRemainingDownloadVolume returns the bytes that can still be downloaded in the
+// period including the given time. It is meaningful only if a limit is defined
+func (u *User) GetRemainingDownloadVolume(t time.Time) int64 {
+	remaining := u.Filters.DownloadVolumeLimit - u.GetUsedDownloadVolume(t)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
 // IsLoginMethodAllowed returns true if the specified login method is allowed
 func (u *User) IsLoginMethodAllowed(loginMethod string, partialSuccessMethods []string) bool {
 	if len(u.Filters.DeniedLoginMethods) == 0 {
@@ -434,6 +969,13 @@ func (u *User) IsLoginMethodAllowed(loginMethod string, partialSuccessMethods []
 // can continue for multi-step authentication
 func (u *User) GetNextAuthMethods(partialSuccessMethods []string, isPasswordAuthEnabled bool) []string {
 	var methods []string
+	if len(partialSuccessMethods) > 0 && partialSuccessMethods[len(partialSuccessMethods)-1] == LoginMethodPassword {
+		// the TOTP code is requested using keyboard interactive authentication after a successful password login
+		if u.IsTOTPRequired("SSH") {
+			methods = append(methods, SSHLoginMethodKeyboardInteractive)
+		}
+		return methods
+	}
 	if len(partialSuccessMethods) != 1 {
 		return methods
 	}
@@ -468,6 +1010,68 @@ func (u *User) IsPartialAuth(loginMethod string) bool {
 	return true
 }
 
+// GetPermissionsForProtocol returns the permissions to apply for the given protocol.
+// If an override is defined for the protocol it replaces the base permissions,
+// otherwise the base permissions are returned
+func (u *User) GetPermissionsForProtocol(protocol string) map[string][]string {
+	for _, f := range u.Filters.ProtocolPermissions {
+		if f.Protocol == protocol {
+			return f.Permissions
+		}
+	}
+	return u.Permissions
+}
+
+// IsTOTPRequired returns true if the TOTP code is required to login using the given protocol
+func (u *User) IsTOTPRequired(protocol string) bool {
+	if !u.TOTPConfig.Enabled {
+		return false
+	}
+	if len(u.Filters.TOTPProtocols) == 0 {
+		return true
+	}
+	return utils.IsStringInSlice(protocol, u.Filters.TOTPProtocols)
+}
+
+// isTOTPCodeValid returns true if the given code is valid for the user's TOTP secret
+func (u *User) isTOTPCodeValid(code string) bool {
+	_, ok := u.getTOTPCodeStep(code)
+	return ok
+}
+
+// getTOTPCodeStep returns the time step for the given code if it is valid for the user's TOTP secret
+func (u *User) getTOTPCodeStep(code string) (int64, bool) {
+	secret := u.TOTPConfig.Secret
+	if secret.IsEncrypted() {
+		if err := secret.Decrypt(); err != nil {
+			providerLog(logger.LevelWarn, "unable to decrypt TOTP secret for user %#v: %v", u.Username, err)
+			return 0, false
+		}
+	}
+	return utils.ValidateTOTPCode(secret.Payload, code, time.Now(), config.TOTPSkew)
+}
+
+// hasTOTPRecoveryCode returns true if the given code is an unused recovery code
+func (u *User) hasTOTPRecoveryCode(code string) bool {
+	hash := getTOTPRecoveryCodeHash(code)
+	for _, rc := range u.TOTPConfig.RecoveryCodes {
+		if !rc.Used && subtle.ConstantTimeCompare([]byte(rc.Hash), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) getRemainingTOTPRecoveryCodes() int {
+	remaining := 0
+	for _, rc := range u.TOTPConfig.RecoveryCodes {
+		if !rc.Used {
+			remaining++
+		}
+	}
+	return remaining
+}
+
 // GetAllowedLoginMethods returns the allowed login methods
 func (u *User) GetAllowedLoginMethods() []string {
 	var allowedMethods []string
@@ -554,6 +1158,289 @@ func (u *User) isFilePatternAllowed(virtualPath string) bool {
 	return true
 }
 
+// IsUploadNameAllowed returns true if the base name of the specified virtual path is
+// allowed by the upload name regular expressions. This check applies to uploads and
+// rename targets
+func (u *User) IsUploadNameAllowed(virtualPath string) bool {
+	if len(u.Filters.UploadNameAllowedRegex) == 0 && len(u.Filters.UploadNameDeniedRegex) == 0 {
+		return true
+	}
+	name := path.Base(virtualPath)
+	for _, denied := range u.Filters.UploadNameDeniedRegex {
+		re, err := getCompiledRegexp(denied)
+		if err != nil || re.MatchString(name) {
+			return false
+		}
+	}
+	for _, allowed := range u.Filters.UploadNameAllowedRegex {
+		re, err := getCompiledRegexp(allowed)
+		if err == nil && re.MatchString(name) {
+			return true
+		}
+	}
+	return len(u.Filters.UploadNameAllowedRegex) == 0
+}
+
+// IsExecCommandAllowed returns true if the specified SSH exec command line is allowed
+// for this user
+func (u *User) IsExecCommandAllowed(command string) bool {
+	for _, allowed := range u.Filters.AllowedExecCommands {
+		if strings.HasPrefix(allowed, "^") {
+			re, err := regexp.Compile(allowed)
+			if err != nil {
+				continue
+			}
+			if loc := re.FindStringIndex(command); loc != nil && loc[0] == 0 && loc[1] == len(command) {
+				return true
+			}
+		} else if allowed == command {
+			return true
+		}
+	}
+	return false
+}
+
+// GetWriteMode returns the allowed write mode, for an existing file, for the specified virtual path
+func (u *User) GetWriteMode(virtualPath string) int {
+	if len(u.Filters.WriteModes) == 0 {
+		return WriteModeAny
+	}
+	dirsForPath := utils.GetDirsForSFTPPath(path.Dir(virtualPath))
+	var filter WriteModeFilter
+	for _, dir := range dirsForPath {
+		for _, f := range u.Filters.WriteModes {
+			if f.Path == dir {
+				filter = f
+				break
+			}
+		}
+		if filter.Path != "" {
+			break
+		}
+	}
+	if filter.Path != "" {
+		toMatch := strings.ToLower(path.Base(virtualPath))
+		for _, pattern := range filter.AppendOnly {
+			if isWriteModePatternMatch(pattern, toMatch) {
+				return WriteModeAppendOnly
+			}
+		}
+		for _, pattern := range filter.OverwriteOnly {
+			if isWriteModePatternMatch(pattern, toMatch) {
+				return WriteModeOverwriteOnly
+			}
+		}
+	}
+	return WriteModeAny
+}
+
+func isWriteModePatternMatch(pattern, name string) bool {
+	if strings.HasPrefix(pattern, ".") && !strings.ContainsAny(pattern, "*?[") {
+		return strings.HasSuffix(name, pattern)
+	}
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
+
+// GetUploadOrderFilter returns the upload order rule for the specified virtual directory, if any
+func (u *User) GetUploadOrderFilter(virtualDir string) (UploadOrderFilter, bool) {
+	for _, f := range u.Filters.UploadOrder {
+		if f.Path == virtualDir {
+			return f, true
+		}
+	}
+	return UploadOrderFilter{}, false
+}
+
+// CheckPathSchema returns an error if the specified virtual path, to create, does not match
+// the path schema defined for its parent directories, if any. isDir must be true if a
+// directory will be created, files can only be created inside a directory matching the
+// whole schema
+func (u *User) CheckPathSchema(virtualPath string, isDir bool) error {
+	if len(u.Filters.PathSchemas) == 0 {
+		return nil
+	}
+	filter, ok := u.getPathSchemaFilter(path.Dir(virtualPath))
+	if !ok {
+		return nil
+	}
+	virtualDir := virtualPath
+	if !isDir {
+		virtualDir = path.Dir(virtualPath)
+	}
+	var segments []string
+	if rel := strings.Trim(strings.TrimPrefix(virtualDir, filter.Path), "/"); rel != "" {
+		segments = strings.Split(rel, "/")
+	}
+	schema := strings.Split(filter.Schema, "/")
+	if isDir && len(segments) > len(schema) {
+		return fmt.Errorf("directory %#v is deeper than the schema %#v defined for %#v", virtualPath,
+			filter.Schema, filter.Path)
+	}
+	if !isDir && len(segments) != len(schema) {
+		return fmt.Errorf("file %#v must be inside a directory matching the whole schema %#v defined for %#v",
+			virtualPath, filter.Schema, filter.Path)
+	}
+	for idx, segment := range segments {
+		if !filter.isSegmentAllowed(schema[idx], segment) {
+			return fmt.Errorf("directory name %#v in %#v does not match %#v, schema %#v defined for %#v", segment,
+				virtualPath, schema[idx], filter.Schema, filter.Path)
+		}
+	}
+	return nil
+}
+
+func (u *User) getPathSchemaFilter(virtualDir string) (PathSchemaFilter, bool) {
+	for _, dir := range utils.GetDirsForSFTPPath(virtualDir) {
+		for _, f := range u.Filters.PathSchemas {
+			if f.Path == dir {
+				return f, true
+			}
+		}
+	}
+	return PathSchemaFilter{}, false
+}
+
+func (f *PathSchemaFilter) isSegmentAllowed(schemaSegment, segment string) bool {
+	name, isVariable := getPathSchemaVariable(schemaSegment)
+	if !isVariable {
+		return schemaSegment == segment
+	}
+	values := f.Variables[name]
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if strings.HasPrefix(value, "^") {
+			re, err := regexp.Compile(value)
+			if err != nil {
+				continue
+			}
+			if loc := re.FindStringIndex(segment); loc != nil && loc[0] == 0 && loc[1] == len(segment) {
+				return true
+			}
+		} else if value == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// getPathSchemaVariable returns the variable name and true if the schema segment is a variable
+func getPathSchemaVariable(schemaSegment string) (string, bool) {
+	if len(schemaSegment) > 2 && strings.HasPrefix(schemaSegment, "{") && strings.HasSuffix(schemaSegment, "}") {
+		return schemaSegment[1 : len(schemaSegment)-1], true
+	}
+	return "", false
+}
+
+// GetMaxDownloadFileSize returns the maximum size for a file downloadable from the given
+// virtual path. The most specific directory limit is used if any. 0 means unlimited
+func (u *User) GetMaxDownloadFileSize(virtualPath string) int64 {
+	if len(u.Filters.DownloadSizeLimits) > 0 {
+		for _, dir := range utils.GetDirsForSFTPPath(path.Dir(virtualPath)) {
+			for _, f := range u.Filters.DownloadSizeLimits {
+				if f.Path == dir {
+					return f.MaxFileSize
+				}
+			}
+		}
+	}
+	return u.Filters.MaxDownloadFileSize
+}
+
+// GetDirectoryFilesLimit returns the maximum number of files allowed directly inside the
+// given virtual directory. The most specific directory limit is used. 0 means unlimited
+func (u *User) GetDirectoryFilesLimit(virtualDir string) int {
+	for _, dir := range utils.GetDirsForSFTPPath(virtualDir) {
+		for _, f := range u.Filters.DirectoryFilesLimits {
+			if f.Path == dir {
+				return f.MaxFiles
+			}
+		}
+	}
+	return 0
+}
+
+// GetBandwidthLimits returns the upload and download bandwidth limits, as KB/s, at the given time.
+// The limits of the active bandwidth schedule are returned if any, 0 means unlimited
+func (u *User) GetBandwidthLimits(t time.Time) (int64, int64) {
+	for idx := range u.Filters.BandwidthSchedules {
+		if u.Filters.BandwidthSchedules[idx].isActive(t) {
+			return u.Filters.BandwidthSchedules[idx].UploadBandwidth, u.Filters.BandwidthSchedules[idx].DownloadBandwidth
+		}
+	}
+	return u.UploadBandwidth, u.DownloadBandwidth
+}
+
+// IsAccessTimeAllowed returns true if the user is allowed to login at the given time.
+// Any time is allowed if no access time window is defined
+func (u *User) IsAccessTimeAllowed(t time.Time) bool {
+	if len(u.Filters.AccessTimes) == 0 {
+		return true
+	}
+	for idx := range u.Filters.AccessTimes {
+		if u.Filters.AccessTimes[idx].isActive(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetUploadDurationLimit returns the maximum upload duration, as seconds, and the minimum
+// upload rate, as bytes per second, for the given virtual path. The most specific directory
+// limit is used if any. A 0 duration means unlimited
+func (u *User) GetUploadDurationLimit(virtualPath string) (int, int64) {
+	if len(u.Filters.UploadDurationLimits) > 0 {
+		for _, dir := range utils.GetDirsForSFTPPath(path.Dir(virtualPath)) {
+			for _, f := range u.Filters.UploadDurationLimits {
+				if f.Path == dir {
+					return f.MaxDuration, f.MinRate
+				}
+			}
+		}
+	}
+	return u.Filters.MaxUploadDuration, u.Filters.MinUploadRate
+}
+
+// GetTextTransform returns the text transform to apply to a file uploaded to the given
+// virtual path, if any. The most specific directory filter is used
+func (u *User) GetTextTransform(virtualPath string) (TextTransformFilter, bool) {
+	if len(u.Filters.TextTransforms) == 0 {
+		return TextTransformFilter{}, false
+	}
+	toMatch := strings.ToLower(virtualPath)
+	for _, dir := range utils.GetDirsForSFTPPath(path.Dir(virtualPath)) {
+		for _, f := range u.Filters.TextTransforms {
+			if f.Path == dir {
+				for _, ext := range f.Extensions {
+					if strings.HasSuffix(toMatch, ext) {
+						return f, true
+					}
+				}
+				return TextTransformFilter{}, false
+			}
+		}
+	}
+	return TextTransformFilter{}, false
+}
+
+// HasRecursionLimits returns true if the recursive operations are limited for this user
+func (u *User) HasRecursionLimits() bool {
+	return u.Filters.MaxRecursionDepth > 0 || u.Filters.MaxRecursionEntries > 0
+}
+
+// IsAutoCreateDirsEnabled returns true if the missing intermediate directories must be
+// automatically created for uploads inside the specified virtual directory
+func (u *User) IsAutoCreateDirsEnabled(virtualDir string) bool {
+	for _, dir := range u.Filters.AutoCreateDirs {
+		if dir == "/" || dir == virtualDir || strings.HasPrefix(virtualDir, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // IsLoginFromAddrAllowed returns true if the login is allowed from the specified remoteAddr.
 // If AllowedIP is defined only the specified IP/Mask can login.
 // If DeniedIP is defined the specified IP/Mask cannot login.
@@ -604,6 +1491,11 @@ func (u *User) GetFiltersAsJSON() ([]byte, error) {
 	return json.Marshal(u.Filters)
 }
 
+// GetTOTPConfigAsJSON returns the TOTP configuration as json byte array
+func (u *User) GetTOTPConfigAsJSON() ([]byte, error) {
+	return json.Marshal(u.TOTPConfig)
+}
+
 // GetFsConfigAsJSON returns the filesystem config as json byte array
 func (u *User) GetFsConfigAsJSON() ([]byte, error) {
 	return json.Marshal(u.FsConfig)
@@ -625,9 +1517,95 @@ func (u *User) GetGID() int {
 	return u.GID
 }
 
-// GetHomeDir returns the shortest path name equivalent to the user's home directory
+// GetHomeDir returns the shortest path name equivalent to the user's home directory.
+// The placeholders, if any, are replaced with the user's values
 func (u *User) GetHomeDir() string {
-	return filepath.Clean(u.HomeDir)
+	return vfs.ToOSPath(u.resolvePathPlaceholders(u.HomeDir))
+}
+
+// GetMappedPath returns the filesystem path for the given virtual folder.
+// The placeholders, if any, are replaced with the user's values
+func (u *User) GetMappedPath(folder *vfs.VirtualFolder) string {
+	return vfs.ToOSPath(u.resolvePathPlaceholders(folder.MappedPath))
+}
+
+func (u *User) getResolvedVirtualFolders() []vfs.VirtualFolder {
+	folders := make([]vfs.VirtualFolder, 0, len(u.VirtualFolders))
+	for idx := range u.VirtualFolders {
+		folder := u.VirtualFolders[idx]
+		folder.MappedPath = u.GetMappedPath(&folder)
+		folders = append(folders, folder)
+	}
+	return folders
+}
+
+// resolvePathPlaceholders replaces the placeholders inside the given filesystem path
+func (u *User) resolvePathPlaceholders(p string) string {
+	if !HasPathPlaceholders(p) {
+		return p
+	}
+	replacer := strings.NewReplacer(pathPlaceholderUsername, u.Username, pathPlaceholderUID, strconv.Itoa(u.UID),
+		pathPlaceholderGID, strconv.Itoa(u.GID))
+	return replacer.Replace(p)
+}
+
+// checkPathPlaceholders checks that the home dir and the virtual folders mapped paths,
+// resolved for this user, are absolute and inside their allowed roots
+func (u *User) checkPathPlaceholders() error {
+	if err := u.checkResolvedPath(u.HomeDir); err != nil {
+		return &ValidationError{field: "home_dir", err: err.Error()}
+	}
+	for idx := range u.VirtualFolders {
+		if err := u.checkResolvedPath(u.VirtualFolders[idx].MappedPath); err != nil {
+			return &ValidationError{field: "virtual_folders", err: err.Error()}
+		}
+	}
+	return nil
+}
+
+// checkResolvedPath checks that the given path, resolved for this user, is absolute
+// and inside the static directory before the first placeholder.
+// For example "/data/%username%" must resolve to a directory inside "/data"
+func (u *User) checkResolvedPath(p string) error {
+	if !HasPathPlaceholders(p) {
+		return nil
+	}
+	resolved := vfs.ToOSPath(u.resolvePathPlaceholders(p))
+	if !filepath.IsAbs(resolved) {
+		return fmt.Errorf("path %#v resolves to %#v: it is not an absolute path", p, resolved)
+	}
+	root := getPathPlaceholdersRoot(p)
+	if resolved == root || !strings.HasPrefix(resolved, strings.TrimSuffix(root, string(os.PathSeparator))+string(os.PathSeparator)) {
+		return fmt.Errorf("path %#v resolves to %#v: it is not inside %#v", p, resolved, root)
+	}
+	return nil
+}
+
+// HasPathPlaceholders returns true if the given filesystem path contains
+// placeholders that are replaced with the values of each user
+func HasPathPlaceholders(p string) bool {
+	for _, placeholder := range pathPlaceholders {
+		if strings.Contains(p, placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// getPathPlaceholdersRoot returns the static directory before the first placeholder
+func getPathPlaceholdersRoot(p string) string {
+	p = vfs.ToOSPath(p)
+	idx := len(p)
+	for _, placeholder := range pathPlaceholders {
+		if pos := strings.Index(p, placeholder); pos >= 0 && pos < idx {
+			idx = pos
+		}
+	}
+	prefix := p[:idx]
+	if strings.HasSuffix(prefix, string(os.PathSeparator)) {
+		return filepath.Clean(prefix)
+	}
+	return filepath.Dir(prefix)
 }
 
 // HasQuotaRestrictions returns true if there is a quota restriction on number of files or size or both
@@ -635,6 +1613,33 @@ func (u *User) HasQuotaRestrictions() bool {
 	return u.QuotaFiles > 0 || u.QuotaSize > 0
 }
 
+// getQuotaWarningThresholds returns the quota usage percentages that fire the quota
+// warning action for this user, the user thresholds override the global ones
+func (u *User) getQuotaWarningThresholds() []int {
+	if !u.HasQuotaRestrictions() {
+		return nil
+	}
+	if len(u.Filters.QuotaWarningThresholds) > 0 {
+		return u.Filters.QuotaWarningThresholds
+	}
+	return config.QuotaWarningThresholds
+}
+
+// getQuotaUsagePercentage returns the highest usage percentage between the files
+// and the size quota, considering only the defined limits
+func (u *User) getQuotaUsagePercentage(usedFiles int, usedSize int64) float64 {
+	var percentage float64
+	if u.QuotaSize > 0 {
+		percentage = float64(usedSize) * 100 / float64(u.QuotaSize)
+	}
+	if u.QuotaFiles > 0 {
+		if filesPercentage := float64(usedFiles) * 100 / float64(u.QuotaFiles); filesPercentage > percentage {
+			percentage = filesPercentage
+		}
+	}
+	return percentage
+}
+
 // GetQuotaSummary returns used quota and limits if defined
 func (u *User) GetQuotaSummary() string {
 	var result string
@@ -648,6 +1653,12 @@ func (u *User) GetQuotaSummary() string {
 			result += "/" + utils.ByteCountSI(u.QuotaSize)
 		}
 	}
+	if u.HasDownloadVolumeLimit() {
+		now := time.Now()
+		result += fmt.Sprintf(". Downloads: %v/%v per %v, remaining: %v", utils.ByteCountSI(u.GetUsedDownloadVolume(now)),
+			utils.ByteCountSI(u.Filters.DownloadVolumeLimit), u.Filters.DownloadVolumePeriod,
+			utils.ByteCountSI(u.GetRemainingDownloadVolume(now)))
+	}
 	return result
 }
 
@@ -693,6 +1704,12 @@ func (u *User) GetBandwidthAsString() string {
 	} else {
 		result += "unlimited."
 	}
+	if len(u.Filters.BandwidthSchedules) > 0 {
+		result += fmt.Sprintf(" Schedules: %v.", len(u.Filters.BandwidthSchedules))
+	}
+	if len(u.Filters.AccessTimes) > 0 {
+		result += fmt.Sprintf(" Access times: %v.", len(u.Filters.AccessTimes))
+	}
 	return result
 }
 
@@ -711,6 +1728,12 @@ func (u *User) GetInfoString() string {
 		result += "Storage: GCS "
 	} else if u.FsConfig.Provider == AzureBlobFilesystemProvider {
 		result += "Storage: Azure "
+	} else if u.FsConfig.Provider == B2FilesystemProvider {
+		result += "Storage: B2 "
+	} else if u.FsConfig.Provider == SFTPFilesystemProvider {
+		result += "Storage: SFTP "
+	} else if u.FsConfig.Provider == CryptedFilesystemProvider {
+		result += "Storage: Local encrypted "
 	}
 	if len(u.PublicKeys) > 0 {
 		result += fmt.Sprintf("Public keys: %v ", len(u.PublicKeys))
@@ -754,6 +1777,16 @@ func (u User) GetAllowedIPAsString() string {
 	return result
 }
 
+// GetCompressionExtensionsAsString returns the compressed file extensions as comma separated string
+func (u User) GetCompressionExtensionsAsString() string {
+	return strings.Join(u.FsConfig.Compression.Extensions, ",")
+}
+
+// GetCompressionPathsAsString returns the compressed virtual folders as comma separated string
+func (u User) GetCompressionPathsAsString() string {
+	return strings.Join(u.FsConfig.Compression.Paths, ",")
+}
+
 // GetDeniedIPAsString returns the denied IP as comma separated string
 func (u User) GetDeniedIPAsString() string {
 	result := ""
@@ -779,6 +1812,8 @@ func (u *User) getACopy() User {
 	}
 	filters := UserFilters{}
 	filters.MaxUploadFileSize = u.Filters.MaxUploadFileSize
+	filters.DownloadVolumeLimit = u.Filters.DownloadVolumeLimit
+	filters.DownloadVolumePeriod = u.Filters.DownloadVolumePeriod
 	filters.AllowedIP = make([]string, len(u.Filters.AllowedIP))
 	copy(filters.AllowedIP, u.Filters.AllowedIP)
 	filters.DeniedIP = make([]string, len(u.Filters.DeniedIP))
@@ -789,8 +1824,127 @@ func (u *User) getACopy() User {
 	copy(filters.FileExtensions, u.Filters.FileExtensions)
 	filters.FilePatterns = make([]PatternsFilter, len(u.Filters.FilePatterns))
 	copy(filters.FilePatterns, u.Filters.FilePatterns)
+	filters.UploadNameAllowedRegex = make([]string, len(u.Filters.UploadNameAllowedRegex))
+	copy(filters.UploadNameAllowedRegex, u.Filters.UploadNameAllowedRegex)
+	filters.UploadNameDeniedRegex = make([]string, len(u.Filters.UploadNameDeniedRegex))
+	copy(filters.UploadNameDeniedRegex, u.Filters.UploadNameDeniedRegex)
 	filters.DeniedProtocols = make([]string, len(u.Filters.DeniedProtocols))
 	copy(filters.DeniedProtocols, u.Filters.DeniedProtocols)
+	filters.AllowedExecCommands = make([]string, len(u.Filters.AllowedExecCommands))
+	copy(filters.AllowedExecCommands, u.Filters.AllowedExecCommands)
+	filters.AutoCreateDirs = make([]string, len(u.Filters.AutoCreateDirs))
+	copy(filters.AutoCreateDirs, u.Filters.AutoCreateDirs)
+	filters.KeepSessionsOnCredentialsChange = u.Filters.KeepSessionsOnCredentialsChange
+	filters.MaxRecursionDepth = u.Filters.MaxRecursionDepth
+	filters.MaxRecursionEntries = u.Filters.MaxRecursionEntries
+	filters.MaxOpenFiles = u.Filters.MaxOpenFiles
+	filters.IdleTimeout = u.Filters.IdleTimeout
+	filters.MaxConcurrentUploads = u.Filters.MaxConcurrentUploads
+	filters.MaxConcurrentDownloads = u.Filters.MaxConcurrentDownloads
+	filters.MaxDownloadFileSize = u.Filters.MaxDownloadFileSize
+	filters.DownloadSizeLimits = make([]DownloadSizeLimitFilter, len(u.Filters.DownloadSizeLimits))
+	copy(filters.DownloadSizeLimits, u.Filters.DownloadSizeLimits)
+	filters.DirectoryFilesLimits = make([]DirectoryFilesLimitFilter, len(u.Filters.DirectoryFilesLimits))
+	copy(filters.DirectoryFilesLimits, u.Filters.DirectoryFilesLimits)
+	filters.MaxUploadDuration = u.Filters.MaxUploadDuration
+	filters.MinUploadRate = u.Filters.MinUploadRate
+	filters.UploadDurationLimits = make([]UploadDurationLimitFilter, len(u.Filters.UploadDurationLimits))
+	copy(filters.UploadDurationLimits, u.Filters.UploadDurationLimits)
+	filters.DefaultFolderPermissions = make([]string, len(u.Filters.DefaultFolderPermissions))
+	copy(filters.DefaultFolderPermissions, u.Filters.DefaultFolderPermissions)
+	filters.RequireRenameTargetDir = u.Filters.RequireRenameTargetDir
+	filters.RequireRenamePermission = u.Filters.RequireRenamePermission
+	filters.TOTPProtocols = make([]string, len(u.Filters.TOTPProtocols))
+	copy(filters.TOTPProtocols, u.Filters.TOTPProtocols)
+	filters.QuotaWarningThresholds = make([]int, len(u.Filters.QuotaWarningThresholds))
+	copy(filters.QuotaWarningThresholds, u.Filters.QuotaWarningThresholds)
+	filters.ProtocolPermissions = make([]ProtocolPermissionsFilter, 0, len(u.Filters.ProtocolPermissions))
+	for _, f := range u.Filters.ProtocolPermissions {
+		permissions := make(map[string][]string)
+		for dir, perms := range f.Permissions {
+			p := make([]string, len(perms))
+			copy(p, perms)
+			permissions[dir] = p
+		}
+		filters.ProtocolPermissions = append(filters.ProtocolPermissions, ProtocolPermissionsFilter{
+			Protocol:    f.Protocol,
+			Permissions: permissions,
+		})
+	}
+	filters.TextTransforms = make([]TextTransformFilter, 0, len(u.Filters.TextTransforms))
+	for _, f := range u.Filters.TextTransforms {
+		extensions := make([]string, len(f.Extensions))
+		copy(extensions, f.Extensions)
+		filters.TextTransforms = append(filters.TextTransforms, TextTransformFilter{
+			Path:        f.Path,
+			Extensions:  extensions,
+			LineEndings: f.LineEndings,
+			StripBOM:    f.StripBOM,
+		})
+	}
+	filters.WriteModes = make([]WriteModeFilter, 0, len(u.Filters.WriteModes))
+	for _, f := range u.Filters.WriteModes {
+		appendOnly := make([]string, len(f.AppendOnly))
+		copy(appendOnly, f.AppendOnly)
+		overwriteOnly := make([]string, len(f.OverwriteOnly))
+		copy(overwriteOnly, f.OverwriteOnly)
+		filters.WriteModes = append(filters.WriteModes, WriteModeFilter{
+			Path:          f.Path,
+			AppendOnly:    appendOnly,
+			OverwriteOnly: overwriteOnly,
+		})
+	}
+	filters.UploadOrder = make([]UploadOrderFilter, 0, len(u.Filters.UploadOrder))
+	for _, f := range u.Filters.UploadOrder {
+		requiredFiles := make([]string, len(f.RequiredFiles))
+		copy(requiredFiles, f.RequiredFiles)
+		filters.UploadOrder = append(filters.UploadOrder, UploadOrderFilter{
+			Path:          f.Path,
+			SentinelFile:  f.SentinelFile,
+			RequiredFiles: requiredFiles,
+		})
+	}
+	filters.BandwidthSchedules = make([]BandwidthScheduleFilter, 0, len(u.Filters.BandwidthSchedules))
+	for _, f := range u.Filters.BandwidthSchedules {
+		weekDays := make([]int, len(f.WeekDays))
+		copy(weekDays, f.WeekDays)
+		filters.BandwidthSchedules = append(filters.BandwidthSchedules, BandwidthScheduleFilter{
+			WeekDays:          weekDays,
+			Start:             f.Start,
+			End:               f.End,
+			UploadBandwidth:   f.UploadBandwidth,
+			DownloadBandwidth: f.DownloadBandwidth,
+		})
+	}
+	filters.AccessTimes = make([]AccessTimeFilter, 0, len(u.Filters.AccessTimes))
+	for _, f := range u.Filters.AccessTimes {
+		weekDays := make([]int, len(f.WeekDays))
+		copy(weekDays, f.WeekDays)
+		filters.AccessTimes = append(filters.AccessTimes, AccessTimeFilter{
+			WeekDays: weekDays,
+			Start:    f.Start,
+			End:      f.End,
+			TimeZone: f.TimeZone,
+		})
+	}
+	filters.DisconnectOutsideAccessTimes = u.Filters.DisconnectOutsideAccessTimes
+	filters.PathSchemas = make([]PathSchemaFilter, 0, len(u.Filters.PathSchemas))
+	for _, f := range u.Filters.PathSchemas {
+		var variables map[string][]string
+		if len(f.Variables) > 0 {
+			variables = make(map[string][]string)
+			for k, v := range f.Variables {
+				values := make([]string, len(v))
+				copy(values, v)
+				variables[k] = values
+			}
+		}
+		filters.PathSchemas = append(filters.PathSchemas, PathSchemaFilter{
+			Path:      f.Path,
+			Schema:    f.Schema,
+			Variables: variables,
+		})
+	}
 	fsConfig := Filesystem{
 		Provider: u.FsConfig.Provider,
 		S3Config: vfs.S3FsConfig{
@@ -803,6 +1957,17 @@ func (u *User) getACopy() User {
 			KeyPrefix:         u.FsConfig.S3Config.KeyPrefix,
 			UploadPartSize:    u.FsConfig.S3Config.UploadPartSize,
 			UploadConcurrency: u.FsConfig.S3Config.UploadConcurrency,
+			RequesterPays:     u.FsConfig.S3Config.RequesterPays,
+			SSEEncryption:     u.FsConfig.S3Config.SSEEncryption,
+			SSEKMSKeyID:       u.FsConfig.S3Config.SSEKMSKeyID,
+			RoleARN:           u.FsConfig.S3Config.RoleARN,
+			ExternalID:        u.FsConfig.S3Config.ExternalID,
+			RoleSessionName:   u.FsConfig.S3Config.RoleSessionName,
+			R2AccountID:       u.FsConfig.S3Config.R2AccountID,
+			MaxRetries:        u.FsConfig.S3Config.MaxRetries,
+			RetryBaseDelay:    u.FsConfig.S3Config.RetryBaseDelay,
+			RequestTimeout:    u.FsConfig.S3Config.RequestTimeout,
+			SSECustomerKey:    u.FsConfig.S3Config.SSECustomerKey,
 		},
 		GCSConfig: vfs.GCSFsConfig{
 			Bucket:               u.FsConfig.GCSConfig.Bucket,
@@ -811,44 +1976,100 @@ func (u *User) getACopy() User {
 			AutomaticCredentials: u.FsConfig.GCSConfig.AutomaticCredentials,
 			StorageClass:         u.FsConfig.GCSConfig.StorageClass,
 			KeyPrefix:            u.FsConfig.GCSConfig.KeyPrefix,
+			KMSKeyName:           u.FsConfig.GCSConfig.KMSKeyName,
 		},
 		AzBlobConfig: vfs.AzBlobFsConfig{
-			Container:         u.FsConfig.AzBlobConfig.Container,
-			AccountName:       u.FsConfig.AzBlobConfig.AccountName,
-			AccountKey:        u.FsConfig.AzBlobConfig.AccountKey,
-			Endpoint:          u.FsConfig.AzBlobConfig.Endpoint,
-			SASURL:            u.FsConfig.AzBlobConfig.SASURL,
-			KeyPrefix:         u.FsConfig.AzBlobConfig.KeyPrefix,
-			UploadPartSize:    u.FsConfig.AzBlobConfig.UploadPartSize,
-			UploadConcurrency: u.FsConfig.AzBlobConfig.UploadConcurrency,
-			UseEmulator:       u.FsConfig.AzBlobConfig.UseEmulator,
-			AccessTier:        u.FsConfig.AzBlobConfig.AccessTier,
+			Container:               u.FsConfig.AzBlobConfig.Container,
+			AccountName:             u.FsConfig.AzBlobConfig.AccountName,
+			AccountKey:              u.FsConfig.AzBlobConfig.AccountKey,
+			Endpoint:                u.FsConfig.AzBlobConfig.Endpoint,
+			SASURL:                  u.FsConfig.AzBlobConfig.SASURL,
+			KeyPrefix:               u.FsConfig.AzBlobConfig.KeyPrefix,
+			UploadPartSize:          u.FsConfig.AzBlobConfig.UploadPartSize,
+			UploadConcurrency:       u.FsConfig.AzBlobConfig.UploadConcurrency,
+			UseEmulator:             u.FsConfig.AzBlobConfig.UseEmulator,
+			AccessTier:              u.FsConfig.AzBlobConfig.AccessTier,
+			UseManagedIdentity:      u.FsConfig.AzBlobConfig.UseManagedIdentity,
+			ManagedIdentityClientID: u.FsConfig.AzBlobConfig.ManagedIdentityClientID,
+		},
+		B2Config: vfs.B2FsConfig{
+			Bucket:          u.FsConfig.B2Config.Bucket,
+			KeyPrefix:       u.FsConfig.B2Config.KeyPrefix,
+			AccountID:       u.FsConfig.B2Config.AccountID,
+			ApplicationKey:  u.FsConfig.B2Config.ApplicationKey,
+			Endpoint:        u.FsConfig.B2Config.Endpoint,
+			UploadChunkSize: u.FsConfig.B2Config.UploadChunkSize,
+		},
+		SFTPConfig: vfs.SFTPFsConfig{
+			Endpoint:   u.FsConfig.SFTPConfig.Endpoint,
+			Username:   u.FsConfig.SFTPConfig.Username,
+			Password:   u.FsConfig.SFTPConfig.Password,
+			PrivateKey: u.FsConfig.SFTPConfig.PrivateKey,
+			Prefix:     u.FsConfig.SFTPConfig.Prefix,
+		},
+		CryptConfig: vfs.CryptFsConfig{
+			Passphrase: u.FsConfig.CryptConfig.Passphrase,
 		},
 	}
+	if len(u.FsConfig.SFTPConfig.Fingerprints) > 0 {
+		fsConfig.SFTPConfig.Fingerprints = make([]string, len(u.FsConfig.SFTPConfig.Fingerprints))
+		copy(fsConfig.SFTPConfig.Fingerprints, u.FsConfig.SFTPConfig.Fingerprints)
+	}
+	fsConfig.Compression.Extensions = make([]string, len(u.FsConfig.Compression.Extensions))
+	copy(fsConfig.Compression.Extensions, u.FsConfig.Compression.Extensions)
+	fsConfig.Compression.Paths = make([]string, len(u.FsConfig.Compression.Paths))
+	copy(fsConfig.Compression.Paths, u.FsConfig.Compression.Paths)
+	fsConfig.Compression.QuotaBasis = u.FsConfig.Compression.QuotaBasis
+	fsConfig.Cache = u.FsConfig.Cache
+	fsConfig.HomeMarker = u.FsConfig.HomeMarker
+	totpConfig := UserTOTPConfig{
+		Enabled: u.TOTPConfig.Enabled,
+		Secret:  u.TOTPConfig.Secret,
+	}
+	if len(u.TOTPConfig.RecoveryCodes) > 0 {
+		totpConfig.RecoveryCodes = make([]TOTPRecoveryCode, len(u.TOTPConfig.RecoveryCodes))
+		copy(totpConfig.RecoveryCodes, u.TOTPConfig.RecoveryCodes)
+	}
+	var groups []string
+	if len(u.Groups) > 0 {
+		groups = make([]string, len(u.Groups))
+		copy(groups, u.Groups)
+	}
 
 	return User{
-		ID:                u.ID,
-		Username:          u.Username,
-		Password:          u.Password,
-		PublicKeys:        pubKeys,
-		HomeDir:           u.HomeDir,
-		VirtualFolders:    virtualFolders,
-		UID:               u.UID,
-		GID:               u.GID,
-		MaxSessions:       u.MaxSessions,
-		QuotaSize:         u.QuotaSize,
-		QuotaFiles:        u.QuotaFiles,
-		Permissions:       permissions,
-		UsedQuotaSize:     u.UsedQuotaSize,
-		UsedQuotaFiles:    u.UsedQuotaFiles,
-		LastQuotaUpdate:   u.LastQuotaUpdate,
-		UploadBandwidth:   u.UploadBandwidth,
-		DownloadBandwidth: u.DownloadBandwidth,
-		Status:            u.Status,
-		ExpirationDate:    u.ExpirationDate,
-		LastLogin:         u.LastLogin,
-		Filters:           filters,
-		FsConfig:          fsConfig,
+		ID:                        u.ID,
+		Username:                  u.Username,
+		Password:                  u.Password,
+		PublicKeys:                pubKeys,
+		HomeDir:                   u.HomeDir,
+		VirtualFolders:            virtualFolders,
+		UID:                       u.UID,
+		GID:                       u.GID,
+		MaxSessions:               u.MaxSessions,
+		QuotaSize:                 u.QuotaSize,
+		QuotaFiles:                u.QuotaFiles,
+		Permissions:               permissions,
+		UsedQuotaSize:             u.UsedQuotaSize,
+		UsedQuotaFiles:            u.UsedQuotaFiles,
+		LastQuotaUpdate:           u.LastQuotaUpdate,
+		UsedDownloadVolume:        u.UsedDownloadVolume,
+		DownloadVolumePeriodStart: u.DownloadVolumePeriodStart,
+		LastExpirationWarning:     u.LastExpirationWarning,
+		LoginFailures:             u.LoginFailures,
+		LastLoginFailure:          u.LastLoginFailure,
+		LockedUntil:               u.LockedUntil,
+		LastTOTPStep:              u.LastTOTPStep,
+		AuthBackend:               u.AuthBackend,
+		UploadBandwidth:           u.UploadBandwidth,
+		DownloadBandwidth:         u.DownloadBandwidth,
+		Status:                    u.Status,
+		ExpirationDate:            u.ExpirationDate,
+		LastLogin:                 u.LastLogin,
+		Filters:                   filters,
+		FsConfig:                  fsConfig,
+		Metadata:                  copyMetadata(u.Metadata),
+		Groups:                    groups,
+		TOTPConfig:                totpConfig,
 	}
 }
 
@@ -864,6 +2085,10 @@ func (u *User) getNotificationFieldsAsSlice(action string) []string {
 }
 
 func (u *User) getNotificationFieldsAsEnvVars(action string) []string {
+	var metadata []byte
+	if len(u.Metadata) > 0 {
+		metadata, _ = json.Marshal(u.Metadata)
+	}
 	return []string{fmt.Sprintf("SFTPGO_USER_ACTION=%v", action),
 		fmt.Sprintf("SFTPGO_USER_USERNAME=%v", u.Username),
 		fmt.Sprintf("SFTPGO_USER_PASSWORD=%v", u.Password),
@@ -878,7 +2103,8 @@ func (u *User) getNotificationFieldsAsEnvVars(action string) []string {
 		fmt.Sprintf("SFTPGO_USER_UPLOAD_BANDWIDTH=%v", u.UploadBandwidth),
 		fmt.Sprintf("SFTPGO_USER_DOWNLOAD_BANDWIDTH=%v", u.DownloadBandwidth),
 		fmt.Sprintf("SFTPGO_USER_MAX_SESSIONS=%v", u.MaxSessions),
-		fmt.Sprintf("SFTPGO_USER_FS_PROVIDER=%v", u.FsConfig.Provider)}
+		fmt.Sprintf("SFTPGO_USER_FS_PROVIDER=%v", u.FsConfig.Provider),
+		fmt.Sprintf("SFTPGO_USER_METADATA=%v", string(metadata))}
 }
 
 func (u *User) getGCSCredentialsFilePath() string {
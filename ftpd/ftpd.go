@@ -2,10 +2,15 @@
 package ftpd
 
 import (
+	"fmt"
+	"net"
 	"path/filepath"
+	"strings"
 
 	ftpserver "github.com/fclairamb/ftpserverlib"
+	ftpserverlog "github.com/fclairamb/ftpserverlib/log"
 
+	"github.com/drakkan/sftpgo/common"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
 )
@@ -34,6 +39,10 @@ type Configuration struct {
 	BindAddress string `json:"bind_address" mapstructure:"bind_address"`
 	// External IP address to expose for passive connections.
 	ForcePassiveIP string `json:"force_passive_ip" mapstructure:"force_passive_ip"`
+	// HTTP URL or absolute path to an external program to use to discover the external IP
+	// address to expose for passive connections. The URL response body or the program
+	// standard output must contain the IP address. It is ignored if force_passive_ip is set
+	PassiveIPDiscoveryHook string `json:"passive_ip_discovery_hook" mapstructure:"passive_ip_discovery_hook"`
 	// Greeting banner displayed when a connection first comes in
 	Banner string `json:"banner" mapstructure:"banner"`
 	// the contents of the specified file, if any, are diplayed when someone connects to the server.
@@ -57,14 +66,44 @@ type Configuration struct {
 func (c *Configuration) Initialize(configDir string) error {
 	var err error
 	logger.Debug(logSender, "", "initializing FTP server with config %+v", *c)
+	if err = c.checkPassiveSettings(); err != nil {
+		return err
+	}
 	server, err = NewServer(c, configDir)
 	if err != nil {
 		return err
 	}
 	ftpServer := ftpserver.NewFtpServer(server)
+	ftpServer.Logger = &libLogger{}
 	return ftpServer.ListenAndServe()
 }
 
+func (c *Configuration) checkPassiveSettings() error {
+	if c.ForcePassiveIP != "" {
+		if ip := net.ParseIP(c.ForcePassiveIP); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("the provided passive IP %#v is not a valid IPv4 address", c.ForcePassiveIP)
+		}
+	}
+	if c.PassiveIPDiscoveryHook != "" && !strings.HasPrefix(c.PassiveIPDiscoveryHook, "http") &&
+		!filepath.IsAbs(c.PassiveIPDiscoveryHook) {
+		return fmt.Errorf("invalid passive IP discovery hook %#v, it must be an HTTP URL or an absolute path",
+			c.PassiveIPDiscoveryHook)
+	}
+	if c.PassivePortRange.Start == 0 && c.PassivePortRange.End == 0 {
+		return nil
+	}
+	if c.PassivePortRange.Start <= 0 || c.PassivePortRange.End > 65535 ||
+		c.PassivePortRange.Start >= c.PassivePortRange.End {
+		return fmt.Errorf("invalid passive port range %v-%v, the start port must be greater than 0 and less than the end port, the end port cannot be greater than 65535",
+			c.PassivePortRange.Start, c.PassivePortRange.End)
+	}
+	if c.BindPort >= c.PassivePortRange.Start && c.BindPort <= c.PassivePortRange.End {
+		return fmt.Errorf("the passive port range %v-%v cannot include the FTP port %v",
+			c.PassivePortRange.Start, c.PassivePortRange.End, c.BindPort)
+	}
+	return nil
+}
+
 // ReloadTLSCertificate reloads the TLS certificate and key from the configured paths
 func ReloadTLSCertificate() error {
 	if server != nil && server.certMgr != nil {
@@ -82,3 +121,47 @@ func getConfigPath(name, configDir string) string {
 	}
 	return name
 }
+
+// libLogger forwards the ftpserverlib log messages to our logger so that errors,
+// such as an exhausted passive port range, are visible.
+// Debug messages are discarded: they include the received commands and so the
+// clear text passwords
+type libLogger struct {
+	connectionID string
+}
+
+func (l *libLogger) Debug(event string, keyvals ...interface{}) {}
+
+func (l *libLogger) Info(event string, keyvals ...interface{}) {
+	logger.Debug(logSender, l.connectionID, "%v", formatLibLogEvent(event, keyvals))
+}
+
+func (l *libLogger) Warn(event string, keyvals ...interface{}) {
+	logger.Warn(logSender, l.connectionID, "%v", formatLibLogEvent(event, keyvals))
+}
+
+func (l *libLogger) Error(event string, keyvals ...interface{}) {
+	logger.Error(logSender, l.connectionID, "%v", formatLibLogEvent(event, keyvals))
+}
+
+func (l *libLogger) With(keyvals ...interface{}) ftpserverlog.Logger {
+	connectionID := l.connectionID
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == "clientId" {
+			connectionID = fmt.Sprintf("%v_%v", common.ProtocolFTP, keyvals[i+1])
+		}
+	}
+	return &libLogger{connectionID: connectionID}
+}
+
+func formatLibLogEvent(event string, keyvals []interface{}) string {
+	var sb strings.Builder
+	sb.WriteString(event)
+	for i := 0; i < len(keyvals); i += 2 {
+		sb.WriteString(fmt.Sprintf(" %v=", keyvals[i]))
+		if i+1 < len(keyvals) {
+			sb.WriteString(fmt.Sprintf("%v", keyvals[i+1]))
+		}
+	}
+	return sb.String()
+}
@@ -17,6 +17,8 @@ import (
 	"testing"
 	"time"
 
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
 	"github.com/jlaffaye/ftp"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
@@ -27,6 +29,7 @@ import (
 	"github.com/drakkan/sftpgo/ftpd"
 	"github.com/drakkan/sftpgo/httpd"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
 )
 
@@ -164,6 +167,7 @@ func TestMain(m *testing.M) {
 
 	waitTCPListening(fmt.Sprintf("%s:%d", ftpdConf.BindAddress, ftpdConf.BindPort))
 	waitTCPListening(fmt.Sprintf("%s:%d", httpdConf.BindAddress, httpdConf.BindPort))
+	waitNoConnections()
 	ftpd.ReloadTLSCertificate() //nolint:errcheck
 
 	exitCode := m.Run()
@@ -274,6 +278,63 @@ func TestLoginInvalidPwd(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLoginWithTOTP(t *testing.T) {
+	u := getTestUser()
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	provisioning, _, err := httpd.GenerateUserTOTP(user, http.StatusOK)
+	assert.NoError(t, err)
+	code, err := utils.GetTOTPCode(provisioning.Secret, time.Now())
+	assert.NoError(t, err)
+	_, err = httpd.EnableUserTOTP(user, code, http.StatusOK)
+	assert.NoError(t, err)
+
+	user.Password = defaultPassword
+	_, err = getFTPClient(user, false)
+	assert.Error(t, err, "login without TOTP code must fail")
+	user.Password = "wrong" + code
+	_, err = getFTPClient(user, false)
+	assert.Error(t, err, "login with a wrong password must fail")
+	user.Password = defaultPassword + code
+	client, err := getFTPClient(user, false)
+	if assert.NoError(t, err) {
+		err = checkBasicFTP(client)
+		assert.NoError(t, err)
+		err = client.Quit()
+		assert.NoError(t, err)
+	}
+	_, err = getFTPClient(user, false)
+	assert.Error(t, err, "a TOTP code can be used only once")
+	user.Password = defaultPassword + provisioning.RecoveryCodes[0]
+	client, err = getFTPClient(user, false)
+	if assert.NoError(t, err) {
+		err = checkBasicFTP(client)
+		assert.NoError(t, err)
+		err = client.Quit()
+		assert.NoError(t, err)
+	}
+	_, err = getFTPClient(user, false)
+	assert.Error(t, err, "a recovery code can be used only once")
+	// the TOTP code is not required for FTP
+	user.Password = ""
+	user.Filters.TOTPProtocols = []string{common.ProtocolSSH}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	user.Password = defaultPassword
+	client, err = getFTPClient(user, false)
+	if assert.NoError(t, err) {
+		err = checkBasicFTP(client)
+		assert.NoError(t, err)
+		err = client.Quit()
+		assert.NoError(t, err)
+	}
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestLoginExternalAuth(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
@@ -325,6 +386,148 @@ func TestLoginExternalAuth(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLoginLDAPAuth(t *testing.T) {
+	u := getTestUser()
+	ldapAddr, ldapUsers := startLDAPServer(t)
+	userDN := "uid=" + u.Username + ",ou=users,dc=example,dc=com"
+	homeDir := filepath.Join(homeBasePath, "ldap_"+u.Username)
+	ldapUsers[u.Username] = ldapTestEntry{
+		dn:       userDN,
+		password: defaultPassword,
+		attributes: map[string][]string{
+			"homeDirectory": {homeDir},
+			"memberOf":      {"cn=sftp,ou=groups,dc=example,dc=com"},
+		},
+	}
+	err := dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	providerConf.AuthBackends = []string{dataprovider.AuthBackendLDAP, dataprovider.AuthBackendProvider}
+	providerConf.LDAP = dataprovider.LDAPConfig{
+		URL:                "ldap://" + ldapAddr,
+		BindDN:             "cn=admin,dc=example,dc=com",
+		BindPassword:       "admin_password",
+		BaseDN:             "ou=users,dc=example,dc=com",
+		HomeDirAttribute:   "homeDirectory",
+		DefaultPermissions: []string{dataprovider.PermListItems},
+		GroupPermissions: []dataprovider.LDAPGroupPermissions{
+			{
+				Group:       "CN=sftp,OU=groups,DC=example,DC=com",
+				Permissions: []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload},
+			},
+		},
+	}
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.NoError(t, err)
+
+	client, err := getFTPClient(u, false)
+	if assert.NoError(t, err) {
+		err = checkBasicFTP(client)
+		assert.NoError(t, err)
+		err := client.Quit()
+		assert.NoError(t, err)
+	}
+	var user dataprovider.User
+	users, _, err := httpd.GetUsers(0, 0, u.Username, http.StatusOK)
+	assert.NoError(t, err)
+	if assert.Len(t, users, 1) {
+		user = users[0]
+		assert.Equal(t, homeDir, user.HomeDir)
+		assert.Equal(t, []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload},
+			user.Permissions["/"])
+		assert.Equal(t, dataprovider.AuthBackendLDAP, user.AuthBackend)
+	}
+	u.Password = "wrong password"
+	client, err = getFTPClient(u, false)
+	if !assert.Error(t, err) {
+		err := client.Quit()
+		assert.NoError(t, err)
+	}
+	// the login conditions are checked before updating the user
+	u.Password = defaultPassword
+	user.Status = 0
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getFTPClient(u, false)
+	if !assert.Error(t, err, "login for a disabled LDAP user must fail") {
+		err := client.Quit()
+		assert.NoError(t, err)
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, user.Status)
+	user.Status = 1
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	// a user removed from the LDAP server cannot login using the copy stored inside the data provider
+	delete(ldapUsers, u.Username)
+	client, err = getFTPClient(u, false)
+	if !assert.Error(t, err, "login for a user removed from the LDAP server must fail") {
+		err := client.Quit()
+		assert.NoError(t, err)
+	}
+	// users not found inside the LDAP server fall back to the data provider
+	localUser := getTestUser()
+	localUser.Username = defaultUsername + "_local"
+	localUser, _, err = httpd.AddUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	client, err = getFTPClient(localUser, false)
+	if assert.NoError(t, err) {
+		err = checkBasicFTP(client)
+		assert.NoError(t, err)
+		err := client.Quit()
+		assert.NoError(t, err)
+	}
+	// an LDAP entry cannot take over an existing user not created by LDAP
+	ldapUsers[localUser.Username] = ldapTestEntry{
+		dn:       "uid=" + localUser.Username + ",ou=users,dc=example,dc=com",
+		password: "ldap password",
+		attributes: map[string][]string{
+			"homeDirectory": {homeDir},
+			"memberOf":      {"cn=sftp,ou=groups,dc=example,dc=com"},
+		},
+	}
+	ldapLocalUser := localUser
+	ldapLocalUser.Password = "ldap password"
+	client, err = getFTPClient(ldapLocalUser, false)
+	if !assert.Error(t, err, "an LDAP entry must not take over a local user") {
+		err := client.Quit()
+		assert.NoError(t, err)
+	}
+	client, err = getFTPClient(localUser, false)
+	if assert.NoError(t, err) {
+		err = checkBasicFTP(client)
+		assert.NoError(t, err)
+		err := client.Quit()
+		assert.NoError(t, err)
+	}
+	users, _, err = httpd.GetUsers(0, 0, localUser.Username, http.StatusOK)
+	assert.NoError(t, err)
+	if assert.Len(t, users, 1) {
+		assert.Empty(t, users[0].AuthBackend)
+		assert.Equal(t, localUser.HomeDir, users[0].HomeDir)
+		assert.Equal(t, localUser.Permissions, users[0].Permissions)
+	}
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
+	assert.NoError(t, err)
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.NoError(t, err)
+}
+
 func TestPreLoginHook(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
@@ -731,6 +934,65 @@ func TestDeniedProtocols(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestProtocolPermissions(t *testing.T) {
+	u := getTestUser()
+	u.Filters.ProtocolPermissions = []dataprovider.ProtocolPermissionsFilter{
+		{
+			Protocol: common.ProtocolSSH,
+			Permissions: map[string][]string{
+				"/": {dataprovider.PermListItems},
+			},
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	// the SSH override does not apply to FTP
+	client, err := getFTPClient(user, true)
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicFTP(client))
+		err = client.Quit()
+		assert.NoError(t, err)
+	}
+	user.Filters.ProtocolPermissions = append(user.Filters.ProtocolPermissions, dataprovider.ProtocolPermissionsFilter{
+		Protocol: common.ProtocolFTP,
+		Permissions: map[string][]string{
+			"/":    {dataprovider.PermListItems, dataprovider.PermDownload},
+			"/sub": {dataprovider.PermAny},
+		},
+	})
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Len(t, user.Filters.ProtocolPermissions, 2)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client, err = getFTPClient(user, true)
+	if assert.NoError(t, err) {
+		err = ftpUploadFile(testFilePath, testFileName, testFileSize, client, 0)
+		assert.Error(t, err)
+		err = client.MakeDir("sub")
+		assert.Error(t, err)
+		err = client.Quit()
+		assert.NoError(t, err)
+	}
+	err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "sub"), os.ModePerm)
+	assert.NoError(t, err)
+	client, err = getFTPClient(user, true)
+	if assert.NoError(t, err) {
+		err = ftpUploadFile(testFilePath, path.Join("/sub", testFileName), testFileSize, client, 0)
+		assert.NoError(t, err)
+		err = client.Quit()
+		assert.NoError(t, err)
+	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestQuotaLimits(t *testing.T) {
 	u := getTestUser()
 	u.QuotaFiles = 1
@@ -1348,6 +1610,116 @@ func TestChmod(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+type ldapTestEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// startLDAPServer starts a minimal LDAP server supporting simple binds and equality searches.
+// The returned map can be used to add users and must be populated before the first connection
+func startLDAPServer(t *testing.T) (string, map[string]ldapTestEntry) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	users := make(map[string]ldapTestEntry)
+	passwords := map[string]string{
+		"cn=admin,dc=example,dc=com": "admin_password",
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleLDAPConn(conn, users, passwords)
+		}
+	}()
+	return listener.Addr().String(), users
+}
+
+func handleLDAPConn(conn net.Conn, users map[string]ldapTestEntry, passwords map[string]string) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := request.Children[1].Value.(string)
+			password := request.Children[2].Data.String()
+			resultCode := uint16(ldap.LDAPResultInvalidCredentials)
+			if expected, ok := passwords[dn]; ok && expected == password {
+				resultCode = ldap.LDAPResultSuccess
+			}
+			for _, user := range users {
+				if user.dn == dn && user.password == password {
+					resultCode = ldap.LDAPResultSuccess
+				}
+			}
+			writeLDAPResponse(conn, messageID, ldapResult(ldap.ApplicationBindResponse, resultCode))
+		case ldap.ApplicationSearchRequest:
+			if user, ok := users[findLDAPFilterValue(request.Children[6], users)]; ok {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, user.dn, ""))
+				attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, values := range user.attributes {
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, value := range values {
+						vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+					}
+					attribute.AppendChild(vals)
+					attributes.AppendChild(attribute)
+				}
+				entry.AppendChild(attributes)
+				writeLDAPResponse(conn, messageID, entry)
+			}
+			writeLDAPResponse(conn, messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+func findLDAPFilterValue(filter *ber.Packet, users map[string]ldapTestEntry) string {
+	if value, ok := filter.Value.(string); ok {
+		if _, exists := users[value]; exists {
+			return value
+		}
+	}
+	for _, child := range filter.Children {
+		if value := findLDAPFilterValue(child, users); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func ldapResult(tag ber.Tag, resultCode uint16) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(resultCode), ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return result
+}
+
+func writeLDAPResponse(conn net.Conn, messageID int64, response *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	packet.AppendChild(response)
+	conn.Write(packet.Bytes()) //nolint:errcheck
+}
+
 func checkBasicFTP(client *ftp.ServerConn) error {
 	_, err := client.CurrentDir()
 	if err != nil {
@@ -1456,6 +1828,15 @@ func waitTCPListening(address string) {
 	}
 }
 
+// waitNoConnections waits for the removal of the connections opened checking the
+// listeners, they could otherwise conflict with the mock client context IDs
+func waitNoConnections() {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(common.Connections.GetStats()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 func getTestUser() dataprovider.User {
 	user := dataprovider.User{
 		Username:       defaultUsername,
@@ -39,7 +39,10 @@ func (c *Connection) GetClientVersion() string {
 
 // GetRemoteAddress return the connected client's address
 func (c *Connection) GetRemoteAddress() string {
-	return c.clientContext.RemoteAddr().String()
+	if c.clientContext != nil {
+		return c.clientContext.RemoteAddr().String()
+	}
+	return ""
 }
 
 // Disconnect disconnects the client
@@ -262,6 +265,10 @@ func (c *Connection) ReadDir(name string) ([]os.FileInfo, error) {
 func (c *Connection) GetHandle(name string, flags int, offset int64) (ftpserver.FileTransfer, error) {
 	c.UpdateLastActivity()
 
+	if err := c.CheckOpenFilesLimit(); err != nil {
+		return nil, c.GetGenericError(err)
+	}
+
 	p, err := c.Fs.ResolvePath(name)
 	if err != nil {
 		return nil, c.GetFsError(err)
@@ -273,7 +280,7 @@ func (c *Connection) GetHandle(name string, flags int, offset int64) (ftpserver.
 }
 
 func (c *Connection) downloadFile(fsPath, ftpPath string, offset int64) (ftpserver.FileTransfer, error) {
-	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(ftpPath)) {
+	if !c.User.HasFilePerm(dataprovider.PermDownload, ftpPath) {
 		return nil, c.GetPermissionDeniedError()
 	}
 
@@ -282,6 +289,19 @@ func (c *Connection) downloadFile(fsPath, ftpPath string, offset int64) (ftpserv
 		return nil, c.GetPermissionDeniedError()
 	}
 
+	if err := c.CheckDownloadVolumeLimit(); err != nil {
+		return nil, err
+	}
+	if err := c.CheckDownloadFileSize(fsPath, ftpPath, nil); err != nil {
+		return nil, c.GetGenericError(err)
+	}
+	if err := c.CheckConcurrentTransfersLimit(common.TransferDownload); err != nil {
+		return nil, c.GetGenericError(err)
+	}
+	if err := c.CheckPreDownloadHook(fsPath, ftpPath, c.GetRemoteAddress(), nil); err != nil {
+		return nil, c.GetGenericError(err)
+	}
+
 	file, r, cancelFn, err := c.Fs.Open(fsPath, offset)
 	if err != nil {
 		c.Log(logger.LevelWarn, "could not open file %#v for reading: %+v", fsPath, err)
@@ -296,10 +316,25 @@ func (c *Connection) downloadFile(fsPath, ftpPath string, offset int64) (ftpserv
 }
 
 func (c *Connection) uploadFile(fsPath, ftpPath string, flags int) (ftpserver.FileTransfer, error) {
-	if !c.User.IsFileAllowed(ftpPath) {
+	if !c.User.IsFileAllowed(ftpPath) || !c.User.IsUploadNameAllowed(ftpPath) {
 		c.Log(logger.LevelWarn, "writing file %#v is not allowed", ftpPath)
 		return nil, c.GetPermissionDeniedError()
 	}
+	if err := c.IsUploadOrderAllowed(ftpPath); err != nil {
+		return nil, err
+	}
+	if err := c.IsPathSchemaAllowed(ftpPath, false); err != nil {
+		return nil, err
+	}
+	if err := c.CheckDirectoryFilesLimit(ftpPath); err != nil {
+		return nil, err
+	}
+	if err := c.CheckDiskSpace(fsPath, 0); err != nil {
+		return nil, err
+	}
+	if err := c.CheckConcurrentTransfersLimit(common.TransferUpload); err != nil {
+		return nil, c.GetGenericError(err)
+	}
 
 	filePath := fsPath
 	if common.Config.IsAtomicUploadEnabled() && c.Fs.IsAtomicUploadSupported() {
@@ -308,9 +343,12 @@ func (c *Connection) uploadFile(fsPath, ftpPath string, flags int) (ftpserver.Fi
 
 	stat, statErr := c.Fs.Lstat(fsPath)
 	if (statErr == nil && stat.Mode()&os.ModeSymlink != 0) || c.Fs.IsNotExist(statErr) {
-		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(ftpPath)) {
+		if !c.User.HasFilePerm(dataprovider.PermUpload, ftpPath) {
 			return nil, c.GetPermissionDeniedError()
 		}
+		if err := c.CheckUploadDir(ftpPath); err != nil {
+			return nil, err
+		}
 		return c.handleFTPUploadToNewFile(fsPath, filePath, ftpPath)
 	}
 
@@ -325,11 +363,11 @@ func (c *Connection) uploadFile(fsPath, ftpPath string, flags int) (ftpserver.Fi
 		return nil, c.GetOpUnsupportedError()
 	}
 
-	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(ftpPath)) {
+	if !c.User.HasFilePerm(dataprovider.PermOverwrite, ftpPath) {
 		return nil, c.GetPermissionDeniedError()
 	}
 
-	return c.handleFTPUploadToExistingFile(flags, fsPath, filePath, stat.Size(), ftpPath)
+	return c.handleFTPUploadToExistingFile(flags, fsPath, filePath, vfs.GetSizeForQuota(stat), ftpPath)
 }
 
 func (c *Connection) handleFTPUploadToNewFile(resolvedPath, filePath, requestPath string) (ftpserver.FileTransfer, error) {
@@ -366,6 +404,9 @@ func (c *Connection) handleFTPUploadToExistingFile(flags int, resolvedPath, file
 	}
 	minWriteOffset := int64(0)
 	isResume := flags&os.O_APPEND != 0 && flags&os.O_TRUNC == 0
+	if err := c.IsWriteModeAllowed(requestPath, isResume); err != nil {
+		return nil, err
+	}
 	// if there is a size limit remaining size cannot be 0 here, since quotaResult.HasSpace
 	// will return false in this case and we deny the upload before
 	maxWriteSize, err := c.GetMaxWriteSize(quotaResult, isResume, fileSize)
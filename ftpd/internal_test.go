@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -167,6 +169,103 @@ func TestServerGetSettings(t *testing.T) {
 	common.Config = oldConfig
 }
 
+func TestPassiveSettings(t *testing.T) {
+	c := &Configuration{
+		BindPort:       2121,
+		ForcePassiveIP: "invalid",
+	}
+	err := c.Initialize(configDir)
+	assert.Error(t, err)
+	c.ForcePassiveIP = "::1"
+	assert.Error(t, c.checkPassiveSettings())
+	c.ForcePassiveIP = "192.168.1.1"
+	assert.NoError(t, c.checkPassiveSettings())
+	c.PassiveIPDiscoveryHook = "relative/path"
+	assert.Error(t, c.checkPassiveSettings())
+	c.PassiveIPDiscoveryHook = "http://127.0.0.1/ip"
+	assert.NoError(t, c.checkPassiveSettings())
+	c.PassivePortRange = PortRange{Start: 0, End: 100}
+	assert.Error(t, c.checkPassiveSettings())
+	c.PassivePortRange = PortRange{Start: 100, End: 100}
+	assert.Error(t, c.checkPassiveSettings())
+	c.PassivePortRange = PortRange{Start: 65000, End: 65536}
+	assert.Error(t, c.checkPassiveSettings())
+	c.PassivePortRange = PortRange{Start: 2000, End: 2200}
+	err = c.checkPassiveSettings()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cannot include the FTP port")
+	}
+	c.PassivePortRange = PortRange{Start: 50000, End: 50100}
+	assert.NoError(t, c.checkPassiveSettings())
+}
+
+func TestPassiveIPDiscovery(t *testing.T) {
+	ip := "10.1.2.3"
+	statusCode := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(ip + "\n"))
+	}))
+	defer ts.Close()
+
+	c := &Configuration{
+		BindPort:               2121,
+		PassiveIPDiscoveryHook: ts.URL,
+	}
+	server, err := NewServer(c, configDir)
+	assert.NoError(t, err)
+	settings, err := server.GetSettings()
+	assert.NoError(t, err)
+	if assert.NotNil(t, settings.PublicIPResolver) {
+		resolved, err := settings.PublicIPResolver(mockFTPClientContext{})
+		assert.NoError(t, err)
+		assert.Equal(t, ip, resolved)
+	}
+	// the last discovered IP is used if the hook fails
+	statusCode = http.StatusInternalServerError
+	server.passiveIP.resolvedAt = time.Now().Add(-passiveIPCacheTTL)
+	resolved, err := server.passiveIP.resolve(mockFTPClientContext{})
+	assert.NoError(t, err)
+	assert.Equal(t, ip, resolved)
+	server.passiveIP.ip = ""
+	_, err = server.passiveIP.resolve(mockFTPClientContext{})
+	assert.Error(t, err)
+	statusCode = http.StatusOK
+	ip = "invalid"
+	_, err = server.passiveIP.resolve(mockFTPClientContext{})
+	assert.Error(t, err)
+
+	if runtime.GOOS != "windows" {
+		hookPath := filepath.Join(os.TempDir(), "passive_ip_hook.sh")
+		err = ioutil.WriteFile(hookPath, []byte("#!/bin/sh\n\necho '172.16.1.1'\n"), os.ModePerm)
+		assert.NoError(t, err)
+		resolver := &passiveIPResolver{hook: hookPath}
+		resolved, err := resolver.resolve(mockFTPClientContext{})
+		assert.NoError(t, err)
+		assert.Equal(t, "172.16.1.1", resolved)
+		err = os.Remove(hookPath)
+		assert.NoError(t, err)
+	}
+	// the resolver is not used if the passive IP is forced
+	c.ForcePassiveIP = "192.168.1.1"
+	settings, err = server.GetSettings()
+	assert.NoError(t, err)
+	assert.Nil(t, settings.PublicIPResolver)
+}
+
+func TestLibLogger(t *testing.T) {
+	l := &libLogger{}
+	clientLogger := l.With("clientId", 10)
+	assert.Equal(t, "FTP_10", clientLogger.(*libLogger).connectionID)
+	assert.Equal(t, "Could not find any free port nbAttempts=10 portRangeStart=50000",
+		formatLibLogEvent("Could not find any free port", []interface{}{"nbAttempts", 10, "portRangeStart", 50000}))
+	assert.Equal(t, "event key=", formatLibLogEvent("event", []interface{}{"key"}))
+	clientLogger.Debug("debug")
+	clientLogger.Info("info")
+	clientLogger.Warn("warn")
+	clientLogger.Error("error")
+}
+
 func TestUserInvalidParams(t *testing.T) {
 	u := dataprovider.User{
 		HomeDir: "invalid",
@@ -0,0 +1,104 @@
+package ftpd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+
+	"github.com/drakkan/sftpgo/common"
+	"github.com/drakkan/sftpgo/httpclient"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	// the discovered passive IP is reused for this time before running the hook again
+	passiveIPCacheTTL    = 5 * time.Minute
+	passiveIPHookTimeout = 10 * time.Second
+)
+
+// passiveIPResolver discovers the external IP to expose for passive connections
+// using the configured hook. The last discovered IP is used if the hook fails
+type passiveIPResolver struct {
+	sync.Mutex
+	hook       string
+	ip         string
+	resolvedAt time.Time
+}
+
+func (r *passiveIPResolver) resolve(cc ftpserver.ClientContext) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.ip != "" && time.Since(r.resolvedAt) < passiveIPCacheTTL {
+		return r.ip, nil
+	}
+	connectionID := fmt.Sprintf("%v_%v", common.ProtocolFTP, cc.ID())
+	ip, err := r.discover()
+	if err != nil {
+		if r.ip != "" {
+			logger.Warn(logSender, connectionID, "unable to discover the passive IP, using the last known one %#v: %v",
+				r.ip, err)
+			return r.ip, nil
+		}
+		logger.Warn(logSender, connectionID, "unable to discover the passive IP: %v", err)
+		return "", err
+	}
+	if ip != r.ip {
+		logger.Info(logSender, connectionID, "the discovered passive IP is %#v", ip)
+	}
+	r.ip = ip
+	r.resolvedAt = time.Now()
+	return ip, nil
+}
+
+func (r *passiveIPResolver) discover() (string, error) {
+	var out []byte
+	var err error
+
+	if strings.HasPrefix(r.hook, "http") {
+		out, err = r.discoverFromURL()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), passiveIPHookTimeout)
+		defer cancel()
+
+		out, err = exec.CommandContext(ctx, r.hook).Output()
+	}
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(out))
+	ip := net.ParseIP(value)
+	if ip == nil || ip.To4() == nil {
+		return "", fmt.Errorf("the passive IP discovery hook returned %#v, it is not a valid IPv4 address", value)
+	}
+	return ip.To4().String(), nil
+}
+
+func (r *passiveIPResolver) discoverFromURL() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), passiveIPHookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.hook, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpclient.GetHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response code from the passive IP discovery hook: %v", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+}
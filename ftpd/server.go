@@ -16,6 +16,7 @@ import (
 	"github.com/drakkan/sftpgo/metrics"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/version"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 // Server implements the ftpserverlib MainDriver interface
@@ -24,6 +25,7 @@ type Server struct {
 	certMgr      *common.CertManager
 	initialMsg   string
 	statusBanner string
+	passiveIP    *passiveIPResolver
 }
 
 // NewServer returns a new FTP server driver
@@ -34,6 +36,7 @@ func NewServer(config *Configuration, configDir string) (*Server, error) {
 		certMgr:      nil,
 		initialMsg:   config.Banner,
 		statusBanner: fmt.Sprintf("SFTPGo %v FTP Server", version.Get().Version),
+		passiveIP:    &passiveIPResolver{hook: config.PassiveIPDiscoveryHook},
 	}
 	certificateFile := getConfigPath(config.CertificateFile, configDir)
 	certificateKeyFile := getConfigPath(config.CertificateKeyFile, configDir)
@@ -82,10 +85,16 @@ func (s *Server) GetSettings() (*ftpserver.Settings, error) {
 		}
 	}
 
+	var ipResolver ftpserver.PublicIPResolver
+	if s.config.ForcePassiveIP == "" && s.config.PassiveIPDiscoveryHook != "" {
+		ipResolver = s.passiveIP.resolve
+	}
+
 	return &ftpserver.Settings{
 		Listener:                 ftpListener,
 		ListenAddr:               fmt.Sprintf("%s:%d", s.config.BindAddress, s.config.BindPort),
 		PublicHost:               s.config.ForcePassiveIP,
+		PublicIPResolver:         ipResolver,
 		PassiveTransferPortRange: portRange,
 		ActiveTransferPortNon20:  s.config.ActiveTransfersPortNon20,
 		IdleTimeout:              -1,
@@ -187,6 +196,10 @@ func (s *Server) validateUser(user dataprovider.User, cc ftpserver.ClientContext
 	if err != nil {
 		return nil, err
 	}
+	if err := vfs.CheckHomeMarker(fs, user.FsConfig.HomeMarker); err != nil {
+		logger.Warn(logSender, connectionID, "cannot login user %#v, home marker check failed: %v", user.Username, err)
+		return nil, fmt.Errorf("Login for user %#v is not allowed, home marker check failed", user.Username)
+	}
 	connection := &Connection{
 		BaseConnection: common.NewBaseConnection(fmt.Sprintf("%v", cc.ID()), common.ProtocolFTP, user, fs),
 		clientContext:  cc,
@@ -205,6 +218,7 @@ func updateLoginMetrics(username, remoteAddress string, err error) {
 		logger.ConnectionFailedLog(username, ip, dataprovider.LoginMethodPassword,
 			common.ProtocolFTP, err.Error())
 	}
-	metrics.AddLoginResult(dataprovider.LoginMethodPassword, err)
+	metrics.AddLoginResult(dataprovider.LoginMethodPassword, common.ProtocolFTP,
+		common.GetUsernameForLoginMetrics(username, err), err)
 	dataprovider.ExecutePostLoginHook(username, dataprovider.LoginMethodPassword, ip, common.ProtocolFTP, err)
 }
@@ -46,7 +46,12 @@ func newTransfer(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter,
 func (t *transfer) Read(p []byte) (n int, err error) {
 	t.Connection.UpdateLastActivity()
 
-	n, err = t.reader.Read(p)
+	size, err := t.ReserveDownloadVolume(len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err = t.reader.Read(p[:size])
+	t.ReleaseDownloadVolume(size - n)
 	atomic.AddInt64(&t.BytesSent, int64(n))
 
 	if err != nil && err != io.EOF {
@@ -62,6 +67,7 @@ func (t *transfer) Write(p []byte) (n int, err error) {
 	t.Connection.UpdateLastActivity()
 
 	n, err = t.writer.Write(p)
+	t.UpdateChecksum(p[:n], t.MinWriteOffset+atomic.LoadInt64(&t.BytesReceived))
 	atomic.AddInt64(&t.BytesReceived, int64(n))
 
 	if t.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&t.BytesReceived) > t.MaxWriteSize {
@@ -27,7 +27,9 @@ type Config struct {
 	// the server and any host name in that certificate.
 	// In this mode, TLS is susceptible to man-in-the-middle attacks.
 	// This should be used only for testing.
-	SkipTLSVerify   bool `json:"skip_tls_verify" mapstructure:"skip_tls_verify"`
+	SkipTLSVerify bool `json:"skip_tls_verify" mapstructure:"skip_tls_verify"`
+	// RetryQueue defines how to retry the failed HTTP notifications
+	RetryQueue      RetryQueueConfig `json:"retry_queue" mapstructure:"retry_queue"`
 	customTransport *http.Transport
 }
 
@@ -49,6 +51,22 @@ func (c Config) Initialize(configDir string) {
 	}
 	customTransport.TLSClientConfig.InsecureSkipVerify = c.SkipTLSVerify
 	httpConfig.customTransport = customTransport
+	c.initializeRetryQueue(configDir)
+}
+
+func (c Config) initializeRetryQueue(configDir string) {
+	retryQueue = nil
+	if !c.RetryQueue.isEnabled() {
+		return
+	}
+	queue, err := newHookRetryQueue(c.RetryQueue, configDir)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to initialize the HTTP notifications retry queue: %v", err)
+		logger.WarnToConsole("unable to initialize the HTTP notifications retry queue: %v", err)
+		return
+	}
+	retryQueue = queue
+	retryQueue.resume()
 }
 
 // loadCACerts returns system cert pools and try to add the configured
@@ -0,0 +1,274 @@
+package httpclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	deadLetterFileName  = "dead_letter.log"
+	pendingEventsSuffix = ".json"
+)
+
+var (
+	errUnexpectedHTTPResponse = errors.New("unexpected HTTP response code")
+	retryQueue                *hookRetryQueue
+)
+
+// RetryQueueConfig defines the configuration for the retry queue used for
+// HTTP notifications, such as the custom actions and the post-login hook.
+// Failed notifications are saved to disk and retried with an exponential
+// backoff, the notifications still failing after the configured attempts
+// are appended to a dead letter log
+type RetryQueueConfig struct {
+	// Maximum number of delivery attempts, including the first one.
+	// 0 or 1 means the notifications are never retried
+	MaxAttempts int `json:"max_attempts" mapstructure:"max_attempts"`
+	// Delay, in seconds, before the first retry. The delay is doubled after each
+	// failed attempt
+	BaseDelay int `json:"base_delay" mapstructure:"base_delay"`
+	// Maximum delay, in seconds, between two attempts
+	MaxDelay int `json:"max_delay" mapstructure:"max_delay"`
+	// Directory for the pending notifications and the dead letter log.
+	// It can be an absolute path or a path relative to the config dir
+	Path string `json:"path" mapstructure:"path"`
+}
+
+func (c *RetryQueueConfig) isEnabled() bool {
+	return c.MaxAttempts > 1
+}
+
+// queuedEvent is a pending notification, it is saved to disk so that it
+// survives a restart
+type queuedEvent struct {
+	ID          string          `json:"id"`
+	Sender      string          `json:"sender"`
+	URL         string          `json:"url"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   int64           `json:"created_at"`
+	NextAttempt int64           `json:"next_attempt"`
+	LastError   string          `json:"last_error"`
+}
+
+type hookRetryQueue struct {
+	config RetryQueueConfig
+	dir    string
+	// protects the dead letter log
+	mu sync.Mutex
+}
+
+func newHookRetryQueue(config RetryQueueConfig, configDir string) (*hookRetryQueue, error) {
+	dir := config.Path
+	if !utils.IsFileInputValid(dir) {
+		return nil, fmt.Errorf("invalid retry queue path %#v", dir)
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(configDir, dir)
+	}
+	if config.BaseDelay <= 0 {
+		config.BaseDelay = 1
+	}
+	if config.MaxDelay < config.BaseDelay {
+		config.MaxDelay = config.BaseDelay
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &hookRetryQueue{
+		config: config,
+		dir:    dir,
+	}, nil
+}
+
+// resume schedules the notifications pending from a previous run
+func (q *hookRetryQueue) resume() {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to read the pending notifications from %#v: %v", q.dir, err)
+		return
+	}
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(fi.Name(), pendingEventsSuffix) {
+			continue
+		}
+		event, err := q.load(filepath.Join(q.dir, fi.Name()))
+		if err != nil {
+			logger.Warn(logSender, "", "unable to load pending notification %#v: %v", fi.Name(), err)
+			continue
+		}
+		logger.Debug(logSender, "", "resuming pending notification %#v to URL %#v, attempts: %v", event.ID,
+			event.URL, event.Attempts)
+		q.schedule(event)
+	}
+}
+
+func (q *hookRetryQueue) add(sender, url string, body []byte, err error) {
+	now := time.Now()
+	event := &queuedEvent{
+		ID:        xid.New().String(),
+		Sender:    sender,
+		URL:       url,
+		Body:      json.RawMessage(body),
+		Attempts:  1,
+		CreatedAt: utils.GetTimeAsMsSinceEpoch(now),
+		LastError: err.Error(),
+	}
+	event.NextAttempt = utils.GetTimeAsMsSinceEpoch(now.Add(q.getDelay(event.Attempts)))
+	if err := q.save(event); err != nil {
+		logger.Warn(sender, "", "unable to queue the notification to URL %#v: %v", url, err)
+		q.addToDeadLetter(event)
+		return
+	}
+	q.schedule(event)
+}
+
+func (q *hookRetryQueue) schedule(event *queuedEvent) {
+	delay := time.Until(utils.GetTimeFromMsecSinceEpoch(event.NextAttempt))
+	if delay < 0 {
+		delay = 0
+	}
+	time.AfterFunc(delay, func() {
+		q.retry(event)
+	})
+}
+
+func (q *hookRetryQueue) retry(event *queuedEvent) {
+	event.Attempts++
+	respCode, err := postJSON(event.URL, event.Body)
+	if err == nil {
+		logger.Debug(event.Sender, "", "notification %#v delivered to URL %#v after %v attempts", event.ID, event.URL,
+			event.Attempts)
+		q.remove(event)
+		return
+	}
+	event.LastError = err.Error()
+	if event.Attempts >= q.config.MaxAttempts {
+		logger.Warn(event.Sender, "", "unable to deliver notification %#v to URL %#v after %v attempts, last response code: %v, err: %v",
+			event.ID, event.URL, event.Attempts, respCode, err)
+		q.addToDeadLetter(event)
+		q.remove(event)
+		return
+	}
+	event.NextAttempt = utils.GetTimeAsMsSinceEpoch(time.Now().Add(q.getDelay(event.Attempts)))
+	logger.Debug(event.Sender, "", "unable to deliver notification %#v to URL %#v, attempt %v, response code: %v, err: %v",
+		event.ID, event.URL, event.Attempts, respCode, err)
+	if err := q.save(event); err != nil {
+		logger.Warn(logSender, "", "unable to update the pending notification %#v: %v", event.ID, err)
+	}
+	q.schedule(event)
+}
+
+// getDelay returns the delay before the next attempt, the delay is doubled
+// after each failed attempt up to the configured limit
+func (q *hookRetryQueue) getDelay(attempts int) time.Duration {
+	delay := q.config.BaseDelay
+	for i := 1; i < attempts && delay < q.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.config.MaxDelay {
+		delay = q.config.MaxDelay
+	}
+	return time.Duration(delay) * time.Second
+}
+
+func (q *hookRetryQueue) getEventPath(event *queuedEvent) string {
+	return filepath.Join(q.dir, event.ID+pendingEventsSuffix)
+}
+
+func (q *hookRetryQueue) save(event *queuedEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	eventPath := q.getEventPath(event)
+	tmpPath := eventPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, eventPath)
+}
+
+func (q *hookRetryQueue) load(eventPath string) (*queuedEvent, error) {
+	data, err := ioutil.ReadFile(eventPath)
+	if err != nil {
+		return nil, err
+	}
+	var event queuedEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	if event.ID == "" || event.URL == "" {
+		return nil, errors.New("invalid pending notification")
+	}
+	return &event, nil
+}
+
+func (q *hookRetryQueue) remove(event *queuedEvent) {
+	if err := os.Remove(q.getEventPath(event)); err != nil && !os.IsNotExist(err) {
+		logger.Warn(logSender, "", "unable to remove the pending notification %#v: %v", event.ID, err)
+	}
+}
+
+func (q *hookRetryQueue) addToDeadLetter(event *queuedEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to serialize the failed notification %#v: %v", event.ID, err)
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(q.dir, deadLetterFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to open the dead letter log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		logger.Warn(logSender, "", "unable to add the notification %#v to the dead letter log: %v", event.ID, err)
+	}
+}
+
+func postJSON(url string, body []byte) (int, error) {
+	resp, err := GetHTTPClient().Post(url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, errUnexpectedHTTPResponse
+	}
+	return resp.StatusCode, nil
+}
+
+// PostJSON sends the given JSON body to the specified URL. A response code
+// other than 200 is considered an error. If the retry queue is enabled, a
+// failed notification is queued and retried in background, the returned
+// error refers to the first attempt.
+// The sender is used for logging
+func PostJSON(sender, url string, body []byte) (int, error) {
+	respCode, err := postJSON(url, body)
+	if err != nil && retryQueue != nil {
+		logger.Debug(sender, "", "unable to deliver notification to URL %#v, response code: %v, err: %v, it will be retried",
+			url, respCode, err)
+		retryQueue.add(sender, url, body, err)
+	}
+	return respCode, err
+}
@@ -0,0 +1,84 @@
+package httpd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/common"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// FileChecksum defines the checksum for a stored file
+type FileChecksum struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	Checksum  string `json:"checksum"`
+	Size      int64  `json:"size"`
+}
+
+func getUserFileChecksum(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	virtualPath := r.URL.Query().Get("path")
+	if virtualPath == "" {
+		sendAPIResponse(w, r, errors.New("the path is mandatory"), "", http.StatusBadRequest)
+		return
+	}
+	virtualPath = utils.CleanPath(virtualPath)
+	user, err := dataprovider.GetUserByID(userID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	user, err = dataprovider.GetUserWithGroupSettings(user.Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	fs, err := user.GetFilesystem("")
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to create the user filesystem", http.StatusInternalServerError)
+		return
+	}
+	fsPath, err := fs.ResolvePath(virtualPath)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	info, err := fs.Stat(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			sendAPIResponse(w, r, err, "", http.StatusNotFound)
+			return
+		}
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		sendAPIResponse(w, r, fmt.Errorf("%#v is not a regular file", virtualPath), "", http.StatusBadRequest)
+		return
+	}
+	checksum, err := common.GetFileSHA256(fs, fsPath)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to compute the checksum", http.StatusInternalServerError)
+		return
+	}
+	logger.Debug(logSender, "", "checksum computed for user %#v, path %#v", user.Username, virtualPath)
+	render.JSON(w, r, FileChecksum{
+		Path:      virtualPath,
+		Algorithm: "sha256",
+		Checksum:  checksum,
+		Size:      info.Size(),
+	})
+}
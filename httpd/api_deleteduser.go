@@ -0,0 +1,88 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+)
+
+func getDeletedUsers(w http.ResponseWriter, r *http.Request) {
+	var err error
+	limit := 100
+	offset := 0
+	order := dataprovider.OrderASC
+	username := ""
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != dataprovider.OrderASC && order != dataprovider.OrderDESC {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["username"]; ok {
+		username = r.URL.Query().Get("username")
+	}
+	deletedUsers, err := dataprovider.GetDeletedUsers(limit, offset, order, username)
+	if err == nil {
+		render.JSON(w, r, deletedUsers)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getDeletedUserByUsername(w http.ResponseWriter, r *http.Request) {
+	deletedUser, err := dataprovider.DeletedUserExists(chi.URLParam(r, "username"))
+	if err == nil {
+		deletedUser.HideConfidentialData()
+		render.JSON(w, r, deletedUser)
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func restoreDeletedUser(w http.ResponseWriter, r *http.Request) {
+	user, err := dataprovider.RestoreDeletedUser(chi.URLParam(r, "username"))
+	if err == nil {
+		auditAction(r, auditActionRestore, auditObjectUser, user.Username, nil, getAuditSnapshot(user))
+		user.HideConfidentialData()
+		render.JSON(w, r, user)
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func purgeDeletedUser(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	err := dataprovider.PurgeDeletedUser(username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	auditAction(r, auditActionPurge, auditObjectDeletedUser, username, nil, nil)
+	sendAPIResponse(w, r, err, "Deleted user purged", http.StatusOK)
+}
@@ -0,0 +1,93 @@
+package httpd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+)
+
+// Stable error codes for the structured error responses.
+// Each code is always returned with the same HTTP status code
+const (
+	errCodeBadRequest       = "bad_request"        // 400
+	errCodeValidationFailed = "validation_failed"  // 400
+	errCodeUnauthorized     = "unauthorized"       // 401
+	errCodeForbidden        = "forbidden"          // 403
+	errCodeNotFound         = "not_found"          // 404
+	errCodeMethodNotAllowed = "method_not_allowed" // 405
+	errCodeConflict         = "conflict"           // 409
+	errCodeInternalError    = "internal_error"     // 500
+)
+
+// structuredErrors enables the structured error responses for the REST API
+var structuredErrors bool
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          errCodeBadRequest,
+	http.StatusUnauthorized:        errCodeUnauthorized,
+	http.StatusForbidden:           errCodeForbidden,
+	http.StatusNotFound:            errCodeNotFound,
+	http.StatusMethodNotAllowed:    errCodeMethodNotAllowed,
+	http.StatusConflict:            errCodeConflict,
+	http.StatusInternalServerError: errCodeInternalError,
+}
+
+type apiErrorDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type apiError struct {
+	Code    string           `json:"code"`
+	Message string           `json:"message"`
+	Details []apiErrorDetail `json:"details,omitempty"`
+}
+
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+// getErrorCode returns the error code for the given error and HTTP status code
+func getErrorCode(err error, status int) string {
+	if _, ok := err.(*dataprovider.ValidationError); ok && status == http.StatusBadRequest {
+		return errCodeValidationFailed
+	}
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return errCodeInternalError
+	}
+	return errCodeBadRequest
+}
+
+func sendAPIErrorResponse(w http.ResponseWriter, r *http.Request, err error, message string, code int) {
+	resp := apiErrorResponse{
+		Error: apiError{
+			Code:    getErrorCode(err, code),
+			Message: message,
+		},
+	}
+	if err != nil {
+		if message != "" {
+			resp.Error.Message = fmt.Sprintf("%v: %v", message, err)
+		} else {
+			resp.Error.Message = err.Error()
+		}
+		if validationErr, ok := err.(*dataprovider.ValidationError); ok && validationErr.GetField() != "" {
+			resp.Error.Details = append(resp.Error.Details, apiErrorDetail{
+				Field:   validationErr.GetField(),
+				Message: validationErr.GetMessage(),
+			})
+		}
+	}
+	if resp.Error.Message == "" {
+		resp.Error.Message = http.StatusText(code)
+	}
+	ctx := context.WithValue(r.Context(), render.StatusCtxKey, code)
+	render.JSON(w, r.WithContext(ctx), resp)
+}
@@ -0,0 +1,148 @@
+package httpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/common"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	defaultEventsProgressInterval = 5
+	maxEventsProgressInterval     = 300
+	eventsKeepAliveInterval       = 15 * time.Second
+	// the stream is closed before the server write timeout expires, the clients
+	// reconnect, after the suggested retry delay, sending the last received event
+	// ID and the missed events are replayed
+	eventsStreamDuration = 50 * time.Second
+	eventsRetryDelay     = 1000 // milliseconds
+)
+
+var eventsValidProtocols = []string{common.ProtocolSFTP, common.ProtocolSCP, common.ProtocolSSH, common.ProtocolFTP,
+	common.ProtocolWebDAV}
+
+// streamConnectionEvents streams the connection and transfer events as server-sent events
+func streamConnectionEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendAPIResponse(w, r, nil, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	filter, progressInterval, err := getConnectionEventsFilter(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	lastEventID, err := getLastEventID(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	subscription := common.SubscribeConnectionEvents(filter, lastEventID)
+	defer common.UnsubscribeConnectionEvents(subscription)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %v\n\n", eventsRetryDelay) //nolint:errcheck
+	flusher.Flush()
+
+	keepAliveTicker := time.NewTicker(eventsKeepAliveInterval)
+	defer keepAliveTicker.Stop()
+	var progressC <-chan time.Time
+	if progressInterval > 0 {
+		progressTicker := time.NewTicker(time.Duration(progressInterval) * time.Second)
+		defer progressTicker.Stop()
+		progressC = progressTicker.C
+	}
+	streamTimer := time.NewTimer(eventsStreamDuration)
+	defer streamTimer.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-streamTimer.C:
+			return
+		case ev := <-subscription.Events():
+			if err := writeConnectionEvent(w, ev); err != nil {
+				logger.Debug(logSender, "", "unable to write connection event: %v", err)
+				return
+			}
+		case <-progressC:
+			for _, ev := range common.Connections.GetTransfersProgress(filter) {
+				if err := writeConnectionEvent(w, ev); err != nil {
+					logger.Debug(logSender, "", "unable to write transfer progress event: %v", err)
+					return
+				}
+			}
+		case <-keepAliveTicker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeConnectionEvent(w http.ResponseWriter, ev *common.ConnectionEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	if ev.ID > 0 {
+		sb.WriteString(fmt.Sprintf("id: %v\n", ev.ID))
+	}
+	sb.WriteString(fmt.Sprintf("event: %v\ndata: %s\n\n", ev.Event, data))
+	_, err = fmt.Fprint(w, sb.String())
+	return err
+}
+
+func getConnectionEventsFilter(r *http.Request) (common.ConnectionEventsFilter, int, error) {
+	filter := common.ConnectionEventsFilter{
+		Username: r.URL.Query().Get("username"),
+		Protocol: strings.ToUpper(r.URL.Query().Get("protocol")),
+	}
+	if filter.Protocol != "" && !utils.IsStringInSlice(filter.Protocol, eventsValidProtocols) {
+		return filter, 0, fmt.Errorf("invalid protocol %#v, valid values: %v", filter.Protocol,
+			strings.Join(eventsValidProtocols, ", "))
+	}
+	progressInterval := defaultEventsProgressInterval
+	if _, ok := r.URL.Query()["progress_interval"]; ok {
+		interval, err := strconv.Atoi(r.URL.Query().Get("progress_interval"))
+		if err != nil {
+			return filter, 0, errors.New("invalid progress_interval")
+		}
+		if interval < 0 || interval > maxEventsProgressInterval {
+			return filter, 0, fmt.Errorf("progress_interval must be between 0 and %v", maxEventsProgressInterval)
+		}
+		progressInterval = interval
+	}
+	return filter, progressInterval, nil
+}
+
+// getLastEventID returns the ID of the last event received by a reconnecting client, if any.
+// Browsers send it as header, the query parameter is for clients that cannot set headers
+func getLastEventID(r *http.Request) (uint64, error) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid last event ID")
+	}
+	return id, nil
+}
@@ -67,6 +67,7 @@ func addFolder(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		folder, err = dataprovider.GetFolderByPath(folder.MappedPath)
 		if err == nil {
+			auditAction(r, auditActionAdd, auditObjectFolder, folder.MappedPath, nil, getAuditSnapshot(folder))
 			render.JSON(w, r, folder)
 		} else {
 			sendAPIResponse(w, r, err, "", getRespStatus(err))
@@ -96,6 +97,7 @@ func deleteFolderByPath(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
 	} else {
+		auditAction(r, auditActionDelete, auditObjectFolder, folder.MappedPath, getAuditSnapshot(folder), nil)
 		sendAPIResponse(w, r, err, "Folder deleted", http.StatusOK)
 	}
 }
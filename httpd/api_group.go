@@ -0,0 +1,175 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+func getGroups(w http.ResponseWriter, r *http.Request) {
+	var err error
+	limit := 100
+	offset := 0
+	order := dataprovider.OrderASC
+	name := ""
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != dataprovider.OrderASC && order != dataprovider.OrderDESC {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["name"]; ok {
+		name = r.URL.Query().Get("name")
+	}
+	groups, err := dataprovider.GetGroups(limit, offset, order, name)
+	if err == nil {
+		render.JSON(w, r, groups)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getGroupByID(w http.ResponseWriter, r *http.Request) {
+	groupID, err := strconv.ParseInt(chi.URLParam(r, "groupID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid groupID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	group, err := dataprovider.GetGroupByID(groupID)
+	if err == nil {
+		group.HideConfidentialData()
+		render.JSON(w, r, group)
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func addGroup(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var group dataprovider.Group
+	err := render.DecodeJSON(r.Body, &group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if err = checkRedactedSecrets(&group.FsConfig); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.AddGroup(group)
+	if err == nil {
+		group, err = dataprovider.GroupExists(group.Name)
+		if err == nil {
+			auditAction(r, auditActionAdd, auditObjectGroup, group.Name, nil, getAuditSnapshot(group))
+			group.HideConfidentialData()
+			render.JSON(w, r, group)
+		} else {
+			sendAPIResponse(w, r, err, "", getRespStatus(err))
+		}
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func updateGroup(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	groupID, err := strconv.ParseInt(chi.URLParam(r, "groupID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid groupID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	group, err := dataprovider.GetGroupByID(groupID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	auditBefore := getAuditSnapshot(group)
+	currentName := group.Name
+	currentFsConfig := group.FsConfig
+	// the permissions are replaced, decoding into the existing map would merge them
+	group.Permissions = nil
+	group.FsConfig.S3Config = vfs.S3FsConfig{}
+	group.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+	group.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+	group.FsConfig.B2Config = vfs.B2FsConfig{}
+	group.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+	group.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+	err = render.DecodeJSON(r.Body, &group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	// the secrets are shared with the users code, they are handled the same way
+	u := dataprovider.User{FsConfig: group.FsConfig}
+	updateEncryptedSecrets(&u, currentFsConfig.S3Config.AccessSecret, currentFsConfig.S3Config.SSECustomerKey,
+		currentFsConfig.AzBlobConfig.AccountKey,
+		currentFsConfig.GCSConfig.Credentials, currentFsConfig.B2Config.ApplicationKey, currentFsConfig.SFTPConfig.Password,
+		currentFsConfig.SFTPConfig.PrivateKey, currentFsConfig.CryptConfig.Passphrase)
+	group.FsConfig = u.FsConfig
+
+	if group.ID != groupID {
+		sendAPIResponse(w, r, err, "group ID in request body does not match group ID in path parameter", http.StatusBadRequest)
+		return
+	}
+	if group.Name != currentName {
+		sendAPIResponse(w, r, err, "group name cannot be changed", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.UpdateGroup(group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		auditAction(r, auditActionUpdate, auditObjectGroup, group.Name, auditBefore, getGroupAuditSnapshot(group.Name))
+		sendAPIResponse(w, r, err, "Group updated", http.StatusOK)
+	}
+}
+
+func deleteGroup(w http.ResponseWriter, r *http.Request) {
+	groupID, err := strconv.ParseInt(chi.URLParam(r, "groupID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid groupID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	group, err := dataprovider.GetGroupByID(groupID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	err = dataprovider.DeleteGroup(group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	} else {
+		auditAction(r, auditActionDelete, auditObjectGroup, group.Name, getAuditSnapshot(group), nil)
+		sendAPIResponse(w, r, err, "Group deleted", http.StatusOK)
+	}
+}
@@ -0,0 +1,373 @@
+package httpd
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	csvImportDateFormat = "2006-01-02" // YYYY-MM-DD
+	// status for the imported CSV rows
+	csvRowCreated = "created"
+	csvRowUpdated = "updated"
+	csvRowSkipped = "skipped"
+	csvRowFailed  = "failed"
+	csvRowAborted = "aborted"
+)
+
+// supported CSV columns, only username is required
+var csvImportColumns = []string{"username", "password", "public_keys", "home_dir", "uid", "gid", "status",
+	"expiration_date", "max_sessions", "quota_size", "quota_files", "permissions", "upload_bandwidth",
+	"download_bandwidth", "groups"}
+
+type csvImportOptions struct {
+	mode   int
+	strict bool
+}
+
+// csvImportRow defines the result of the import for a CSV row
+type csvImportRow struct {
+	Row      int    `json:"row"`
+	Username string `json:"username,omitempty"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	user     dataprovider.User
+	isNew    bool
+	// the stored user before the import, used to revert an update
+	previous dataprovider.User
+}
+
+// csvImportReport defines the per-row report for a CSV import
+type csvImportReport struct {
+	Created int             `json:"created"`
+	Updated int             `json:"updated"`
+	Skipped int             `json:"skipped"`
+	Failed  int             `json:"failed"`
+	Rows    []*csvImportRow `json:"rows"`
+}
+
+func (r *csvImportReport) setFailed(row *csvImportRow, err error) {
+	row.Status = csvRowFailed
+	row.Error = err.Error()
+	r.Failed++
+}
+
+func importUsers(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxRestoreSize)
+	opts, err := getCSVImportOptions(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	report, err := parseUsersCSV(r.Body, opts)
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to parse the CSV file", http.StatusBadRequest)
+		return
+	}
+	status := http.StatusOK
+	if opts.strict {
+		// no change is made if a row is invalid or cannot be imported
+		importUsersStrict(r, report)
+		if report.Failed > 0 {
+			status = http.StatusBadRequest
+		}
+	} else {
+		for _, row := range report.Rows {
+			if row.Status == "" {
+				importUser(r, row, report)
+			}
+		}
+	}
+	logger.Debug(logSender, "", "users import completed, created: %v, updated: %v, skipped: %v, failed: %v, strict: %v",
+		report.Created, report.Updated, report.Skipped, report.Failed, opts.strict)
+	ctx := context.WithValue(r.Context(), render.StatusCtxKey, status)
+	render.JSON(w, r.WithContext(ctx), report)
+}
+
+// importUsersStrict imports the valid rows only if all the rows are valid, if a
+// row cannot be imported the rows already imported are reverted
+func importUsersStrict(r *http.Request, report *csvImportReport) {
+	var imported []*csvImportRow
+	for _, row := range report.Rows {
+		if row.Status != "" {
+			continue
+		}
+		if report.Failed > 0 {
+			row.Status = csvRowAborted
+			continue
+		}
+		if importUser(r, row, report) {
+			imported = append(imported, row)
+		}
+	}
+	if report.Failed == 0 {
+		return
+	}
+	for idx := len(imported) - 1; idx >= 0; idx-- {
+		revertImportedUser(r, imported[idx], report)
+	}
+}
+
+// importUser adds or updates the user for the given row and returns true on success
+func importUser(r *http.Request, row *csvImportRow, report *csvImportReport) bool {
+	var err error
+	var auditBefore map[string]interface{}
+	if row.isNew {
+		err = dataprovider.AddUser(row.user)
+	} else {
+		row.previous, err = dataprovider.UserExists(row.user.Username)
+		if err == nil {
+			auditBefore = getAuditSnapshot(row.previous)
+			err = dataprovider.UpdateUser(row.user)
+		}
+	}
+	logger.Debug(logSender, "", "importing user %#v, new: %v, error: %v", row.user.Username, row.isNew, err)
+	if err != nil {
+		report.setFailed(row, err)
+		return false
+	}
+	auditAction(r, auditActionImportUsers, auditObjectUser, row.user.Username, auditBefore,
+		getUserAuditSnapshot(row.user.Username))
+	if row.isNew {
+		row.Status = csvRowCreated
+		report.Created++
+	} else {
+		row.Status = csvRowUpdated
+		report.Updated++
+	}
+	return true
+}
+
+// revertImportedUser removes the user added for the given row or restores the
+// previous user if it was updated
+func revertImportedUser(r *http.Request, row *csvImportRow, report *csvImportReport) {
+	user, err := dataprovider.UserExists(row.Username)
+	if err == nil {
+		if row.isNew {
+			err = dataprovider.HardDeleteUser(user)
+		} else {
+			err = dataprovider.UpdateUser(row.previous)
+		}
+	}
+	if err != nil {
+		logger.Warn(logSender, "", "unable to revert the import for user %#v: %v", row.Username, err)
+		row.Error = fmt.Sprintf("unable to revert the import: %v", err)
+		return
+	}
+	logger.Debug(logSender, "", "import reverted for user %#v, new: %v", row.Username, row.isNew)
+	if row.isNew {
+		auditAction(r, auditActionImportUsers, auditObjectUser, row.Username, getAuditSnapshot(user), nil)
+		report.Created--
+	} else {
+		auditAction(r, auditActionImportUsers, auditObjectUser, row.Username, getAuditSnapshot(user),
+			getUserAuditSnapshot(row.Username))
+		report.Updated--
+	}
+	row.Status = csvRowAborted
+}
+
+func getCSVImportOptions(r *http.Request) (csvImportOptions, error) {
+	var err error
+	opts := csvImportOptions{}
+	if _, ok := r.URL.Query()["mode"]; ok {
+		opts.mode, err = strconv.Atoi(r.URL.Query().Get("mode"))
+		if err != nil || (opts.mode != 0 && opts.mode != 1) {
+			return opts, fmt.Errorf("invalid mode: %#v", r.URL.Query().Get("mode"))
+		}
+	}
+	if _, ok := r.URL.Query()["strict"]; ok {
+		strict, err := strconv.Atoi(r.URL.Query().Get("strict"))
+		if err != nil || (strict != 0 && strict != 1) {
+			return opts, fmt.Errorf("invalid strict: %#v", r.URL.Query().Get("strict"))
+		}
+		opts.strict = strict == 1
+	}
+	return opts, nil
+}
+
+// parseUsersCSV parses the CSV and returns a report with a row for each record.
+// The rows that cannot be imported are marked as failed, the other ones have an
+// empty status. An error is returned only if the CSV cannot be read
+func parseUsersCSV(reader io.Reader, opts csvImportOptions) (*csvImportReport, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns, err := getCSVImportColumns(header)
+	if err != nil {
+		return nil, err
+	}
+	report := &csvImportReport{
+		Rows: []*csvImportRow{},
+	}
+	usernames := make(map[string]bool)
+	for rowNum := 2; ; rowNum++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		row := &csvImportRow{Row: rowNum}
+		report.Rows = append(report.Rows, row)
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return nil, err
+			}
+			report.setFailed(row, err)
+			continue
+		}
+		if len(record) != len(columns) {
+			report.setFailed(row, fmt.Errorf("wrong number of fields: %v, expected: %v", len(record), len(columns)))
+			continue
+		}
+		values := make(map[string]string)
+		for idx, column := range columns {
+			values[column] = strings.TrimSpace(record[idx])
+		}
+		row.Username = values["username"]
+		if row.Username == "" {
+			report.setFailed(row, errors.New("the username is mandatory"))
+			continue
+		}
+		if _, ok := usernames[row.Username]; ok {
+			report.setFailed(row, fmt.Errorf("duplicate username %#v", row.Username))
+			continue
+		}
+		usernames[row.Username] = true
+		prepareCSVImportRow(row, values, opts, report)
+	}
+	return report, nil
+}
+
+func prepareCSVImportRow(row *csvImportRow, values map[string]string, opts csvImportOptions, report *csvImportReport) {
+	user, err := dataprovider.UserExists(row.Username)
+	if err == nil {
+		if opts.mode == 1 {
+			row.Status = csvRowSkipped
+			report.Skipped++
+			return
+		}
+	} else {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); !ok {
+			report.setFailed(row, err)
+			return
+		}
+		row.isNew = true
+		user = dataprovider.User{
+			Username:       row.Username,
+			Status:         1,
+			ExpirationDate: dataprovider.GetDefaultUserExpiration(),
+			Permissions:    make(map[string][]string),
+		}
+	}
+	if err = setUserFromCSVValues(&user, values); err != nil {
+		report.setFailed(row, err)
+		return
+	}
+	if opts.strict {
+		if err = dataprovider.ValidateUser(user); err != nil {
+			report.setFailed(row, err)
+			return
+		}
+	}
+	row.user = user
+}
+
+// setUserFromCSVValues sets the user fields for the non empty values
+func setUserFromCSVValues(user *dataprovider.User, values map[string]string) error {
+	var err error
+	for _, column := range csvImportColumns {
+		value := values[column]
+		if value == "" {
+			continue
+		}
+		switch column {
+		case "password":
+			user.Password = value
+		case "public_keys":
+			user.PublicKeys = getSliceFromDelimitedValues(value, ";")
+		case "home_dir":
+			user.HomeDir = value
+		case "uid":
+			user.UID, err = strconv.Atoi(value)
+		case "gid":
+			user.GID, err = strconv.Atoi(value)
+		case "status":
+			user.Status, err = strconv.Atoi(value)
+		case "expiration_date":
+			var expirationDate time.Time
+			expirationDate, err = time.Parse(csvImportDateFormat, value)
+			user.ExpirationDate = utils.GetTimeAsMsSinceEpoch(expirationDate)
+		case "max_sessions":
+			user.MaxSessions, err = strconv.Atoi(value)
+		case "quota_size":
+			user.QuotaSize, err = strconv.ParseInt(value, 10, 64)
+		case "quota_files":
+			user.QuotaFiles, err = strconv.Atoi(value)
+		case "permissions":
+			user.Permissions, err = getPermissionsFromCSVValue(value)
+		case "upload_bandwidth":
+			user.UploadBandwidth, err = strconv.ParseInt(value, 10, 64)
+		case "download_bandwidth":
+			user.DownloadBandwidth, err = strconv.ParseInt(value, 10, 64)
+		case "groups":
+			user.Groups = getSliceFromDelimitedValues(value, ";")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %v %#v: %v", column, value, err)
+		}
+	}
+	return nil
+}
+
+// getPermissionsFromCSVValue parses permissions in the format "/::list,download;/sub::*"
+func getPermissionsFromCSVValue(value string) (map[string][]string, error) {
+	permissions := make(map[string][]string)
+	for _, dirPerms := range getSliceFromDelimitedValues(value, ";") {
+		parts := strings.Split(dirPerms, "::")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid directory permissions %#v", dirPerms)
+		}
+		permissions[strings.TrimSpace(parts[0])] = getSliceFromDelimitedValues(parts[1], ",")
+	}
+	return permissions, nil
+}
+
+func getCSVImportColumns(header []string) ([]string, error) {
+	columns := make([]string, 0, len(header))
+	for idx, h := range header {
+		if idx == 0 {
+			// spreadsheet applications could add the UTF-8 byte order mark
+			h = strings.TrimPrefix(h, "\ufeff")
+		}
+		column := strings.ToLower(strings.TrimSpace(h))
+		if !utils.IsStringInSlice(column, csvImportColumns) {
+			return nil, fmt.Errorf("unsupported column %#v", h)
+		}
+		if utils.IsStringInSlice(column, columns) {
+			return nil, fmt.Errorf("duplicate column %#v", h)
+		}
+		columns = append(columns, column)
+	}
+	if !utils.IsStringInSlice("username", columns) {
+		return nil, errors.New("the username column is mandatory")
+	}
+	return columns, nil
+}
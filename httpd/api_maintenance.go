@@ -8,8 +8,12 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/go-chi/render"
 
 	"github.com/drakkan/sftpgo/common"
 	"github.com/drakkan/sftpgo/dataprovider"
@@ -71,11 +75,12 @@ func dumpData(w http.ResponseWriter, r *http.Request) {
 }
 
 func loadData(w http.ResponseWriter, r *http.Request) {
-	inputFile, scanQuota, mode, err := getLoaddataOptions(r)
+	opts, err := getLoaddataOptions(r)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
+	inputFile := opts.inputFile
 	if !filepath.IsAbs(inputFile) {
 		sendAPIResponse(w, r, fmt.Errorf("Invalid input_file %#v: it must be an absolute path", inputFile), "", http.StatusBadRequest)
 		return
@@ -96,103 +101,379 @@ func loadData(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
+	content, err = DecryptBackupData(content, scheduledBackups.Passphrase)
+	if err != nil {
+		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to decrypt input file: %#v", inputFile), http.StatusBadRequest)
+		return
+	}
 	dump, err := dataprovider.ParseDumpData(content)
 	if err != nil {
 		sendAPIResponse(w, r, err, fmt.Sprintf("Unable to parse input file: %#v", inputFile), http.StatusBadRequest)
 		return
 	}
 
-	if err = RestoreFolders(dump.Folders, inputFile, scanQuota); err != nil {
-		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	var summaries []*restoreSummary
+	// the restore can change the data provider even if it fails
+	defer func() {
+		auditAction(r, auditActionLoadData, auditObjectProvider, inputFile, nil, getRestoreAuditSnapshot(summaries))
+	}()
+	// groups and folders must be restored before users, users can reference
+	// them and folders not included inside the backup or defined after them
+	groups := restoreGroups(dump.Groups, opts)
+	summaries = append(summaries, groups)
+	if groups.hasFailures() && !opts.continueOnError {
+		sendAPIResponse(w, r, groups.getError(), "", getRespStatus(groups.firstErr))
 		return
 	}
-
-	if err = RestoreUsers(dump.Users, inputFile, mode, scanQuota); err != nil {
-		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	folders := restoreFolders(getFoldersToRestore(dump.Folders, dump.Users), opts)
+	summaries = append(summaries, folders)
+	if folders.hasFailures() && !opts.continueOnError {
+		sendAPIResponse(w, r, folders.getError(), "", getRespStatus(folders.firstErr))
 		return
 	}
+	users := restoreUsers(dump.Users, opts)
+	summaries = append(summaries, users)
 
-	logger.Debug(logSender, "", "backup restored, users: %v", len(dump.Users))
-	sendAPIResponse(w, r, err, "Data restored", http.StatusOK)
+	logger.Debug(logSender, "", "backup restored, users: %v/%v, folders: %v/%v, groups: %v/%v", users.restored, len(dump.Users),
+		folders.restored, len(dump.Folders), groups.restored, len(dump.Groups))
+	var errs []string
+	status := http.StatusOK
+	for _, summary := range []*restoreSummary{groups, folders, users} {
+		if summary.hasFailures() {
+			errs = append(errs, summary.getError().Error())
+			if status == http.StatusOK {
+				status = getRespStatus(summary.firstErr)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		sendAPIResponse(w, r, errors.New(strings.Join(errs, "; ")), fmt.Sprintf("Data partially restored, groups: %v restored %v failed, "+
+			"folders: %v restored %v failed, users: %v restored %v failed", groups.restored, len(groups.failures),
+			folders.restored, len(folders.failures), users.restored, len(users.failures)), status)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Data restored", http.StatusOK)
 }
 
-func getLoaddataOptions(r *http.Request) (string, int, int, error) {
-	var inputFile string
+func getLoaddataOptions(r *http.Request) (restoreOptions, error) {
 	var err error
-	scanQuota := 0
-	restoreMode := 0
+	opts := restoreOptions{
+		concurrency: 1,
+	}
 	if _, ok := r.URL.Query()["input_file"]; ok {
-		inputFile = strings.TrimSpace(r.URL.Query().Get("input_file"))
+		opts.inputFile = strings.TrimSpace(r.URL.Query().Get("input_file"))
 	}
 	if _, ok := r.URL.Query()["scan_quota"]; ok {
-		scanQuota, err = strconv.Atoi(r.URL.Query().Get("scan_quota"))
+		opts.scanQuota, err = strconv.Atoi(r.URL.Query().Get("scan_quota"))
 		if err != nil {
-			err = fmt.Errorf("invalid scan_quota: %v", err)
+			return opts, fmt.Errorf("invalid scan_quota: %v", err)
 		}
 	}
 	if _, ok := r.URL.Query()["mode"]; ok {
-		restoreMode, err = strconv.Atoi(r.URL.Query().Get("mode"))
+		opts.mode, err = strconv.Atoi(r.URL.Query().Get("mode"))
 		if err != nil {
-			err = fmt.Errorf("invalid mode: %v", err)
+			return opts, fmt.Errorf("invalid mode: %v", err)
 		}
 	}
-	return inputFile, scanQuota, restoreMode, err
+	if _, ok := r.URL.Query()["concurrency"]; ok {
+		opts.concurrency, err = strconv.Atoi(r.URL.Query().Get("concurrency"))
+		if err != nil {
+			return opts, fmt.Errorf("invalid concurrency: %v", err)
+		}
+		if opts.concurrency < 1 || opts.concurrency > maxRestoreConcurrency {
+			return opts, fmt.Errorf("invalid concurrency %v, allowed range: 1-%v", opts.concurrency, maxRestoreConcurrency)
+		}
+	}
+	if _, ok := r.URL.Query()["on_error"]; ok {
+		onError, err := strconv.Atoi(r.URL.Query().Get("on_error"))
+		if err != nil || (onError != 0 && onError != 1) {
+			return opts, fmt.Errorf("invalid on_error: %#v", r.URL.Query().Get("on_error"))
+		}
+		opts.continueOnError = onError == 1
+	}
+	return opts, nil
+}
+
+// RestoreGroups restores the specified groups
+func RestoreGroups(groups []dataprovider.Group, inputFile string, mode int) error {
+	return restoreGroups(groups, restoreOptions{
+		inputFile:   inputFile,
+		mode:        mode,
+		concurrency: 1,
+	}).getError()
 }
 
 // RestoreFolders restores the specified folders
 func RestoreFolders(folders []vfs.BaseVirtualFolder, inputFile string, scanQuota int) error {
+	return restoreFolders(folders, restoreOptions{
+		inputFile:   inputFile,
+		scanQuota:   scanQuota,
+		concurrency: 1,
+	}).getError()
+}
+
+// RestoreUsers restores the specified users
+func RestoreUsers(users []dataprovider.User, inputFile string, mode, scanQuota int) error {
+	return restoreUsers(users, restoreOptions{
+		inputFile:   inputFile,
+		scanQuota:   scanQuota,
+		mode:        mode,
+		concurrency: 1,
+	}).getError()
+}
+
+// getFoldersToRestore returns the folders to restore including the ones that
+// are only referenced by users, so they will be created before the users.
+// This way users can be restored in parallel without racing to create the
+// same folder
+func getFoldersToRestore(folders []vfs.BaseVirtualFolder, users []dataprovider.User) []vfs.BaseVirtualFolder {
+	mappedPaths := make(map[string]bool)
 	for _, folder := range folders {
-		_, err := dataprovider.GetFolderByPath(folder.MappedPath)
-		if err == nil {
-			logger.Debug(logSender, "", "folder %#v already exists, restore not needed", folder.MappedPath)
-			continue
-		}
-		folder.Users = nil
-		err = dataprovider.AddFolder(folder)
-		logger.Debug(logSender, "", "adding new folder: %+v, dump file: %#v, error: %v", folder, inputFile, err)
-		if err != nil {
-			return err
-		}
-		if scanQuota >= 1 {
-			if common.QuotaScans.AddVFolderQuotaScan(folder.MappedPath) {
-				logger.Debug(logSender, "", "starting quota scan for restored folder: %#v", folder.MappedPath)
-				go doFolderQuotaScan(folder) //nolint:errcheck
+		mappedPaths[filepath.Clean(folder.MappedPath)] = true
+	}
+	for _, user := range users {
+		for _, vfolder := range user.VirtualFolders {
+			mappedPath := filepath.Clean(vfolder.MappedPath)
+			if _, ok := mappedPaths[mappedPath]; ok || !filepath.IsAbs(mappedPath) {
+				continue
 			}
+			mappedPaths[mappedPath] = true
+			folders = append(folders, vfs.BaseVirtualFolder{
+				MappedPath: mappedPath,
+			})
+		}
+	}
+	return folders
+}
+
+func restoreGroups(groups []dataprovider.Group, opts restoreOptions) *restoreSummary {
+	summary := &restoreSummary{kind: "group"}
+	for _, group := range groups {
+		err := restoreGroup(group, opts)
+		summary.add(group.Name, err)
+		if err != nil && !opts.continueOnError {
+			break
+		}
+	}
+	return summary
+}
+
+func restoreGroup(group dataprovider.Group, opts restoreOptions) error {
+	g, err := dataprovider.GroupExists(group.Name)
+	if err == nil {
+		if opts.mode == 1 {
+			logger.Debug(logSender, "", "loaddata mode 1, existing group %#v not updated", g.Name)
+			return nil
+		}
+		group.ID = g.ID
+		err = dataprovider.UpdateGroup(group)
+		logger.Debug(logSender, "", "restoring existing group: %#v, dump file: %#v, error: %v", group.Name, opts.inputFile, err)
+		return err
+	}
+	err = dataprovider.AddGroup(group)
+	logger.Debug(logSender, "", "adding new group: %#v, dump file: %#v, error: %v", group.Name, opts.inputFile, err)
+	return err
+}
+
+func restoreFolders(folders []vfs.BaseVirtualFolder, opts restoreOptions) *restoreSummary {
+	summary := &restoreSummary{kind: "folder"}
+	for _, folder := range folders {
+		err := restoreFolder(folder, opts)
+		summary.add(folder.MappedPath, err)
+		if err != nil && !opts.continueOnError {
+			break
+		}
+	}
+	return summary
+}
+
+func restoreFolder(folder vfs.BaseVirtualFolder, opts restoreOptions) error {
+	if !vfs.HasMixedSeparators(folder.MappedPath) {
+		// backups store the mapped path in the canonical form
+		folder.MappedPath = vfs.ToOSPath(folder.MappedPath)
+	}
+	_, err := dataprovider.GetFolderByPath(folder.MappedPath)
+	if err == nil {
+		logger.Debug(logSender, "", "folder %#v already exists, restore not needed", folder.MappedPath)
+		return nil
+	}
+	folder.Users = nil
+	err = dataprovider.AddFolder(folder)
+	logger.Debug(logSender, "", "adding new folder: %+v, dump file: %#v, error: %v", folder, opts.inputFile, err)
+	if err != nil {
+		return err
+	}
+	// a mapped path with placeholders is resolved for each user, it cannot be scanned
+	if opts.scanQuota >= 1 && !dataprovider.HasPathPlaceholders(folder.MappedPath) {
+		if common.QuotaScans.AddVFolderQuotaScan(folder.MappedPath) {
+			logger.Debug(logSender, "", "starting quota scan for restored folder: %#v", folder.MappedPath)
+			go doFolderQuotaScan(folder) //nolint:errcheck
 		}
 	}
 	return nil
 }
 
-// RestoreUsers restores the specified users
-func RestoreUsers(users []dataprovider.User, inputFile string, mode, scanQuota int) error {
+// restoreUsers restores the given users using up to opts.concurrency
+// parallel workers. If continue on error is not set no new user is
+// restored after the first failure, users already in progress will
+// be completed anyway
+func restoreUsers(users []dataprovider.User, opts restoreOptions) *restoreSummary {
+	summary := &restoreSummary{kind: "user"}
+	guard := make(chan bool, opts.concurrency)
+	var wg sync.WaitGroup
+
 	for _, user := range users {
-		u, err := dataprovider.UserExists(user.Username)
-		if err == nil {
-			if mode == 1 {
-				logger.Debug(logSender, "", "loaddata mode 1, existing user %#v not updated", u.Username)
-				continue
-			}
-			user.ID = u.ID
-			err = dataprovider.UpdateUser(user)
-			user.Password = "[redacted]"
-			logger.Debug(logSender, "", "restoring existing user: %+v, dump file: %#v, error: %v", user, inputFile, err)
-			if mode == 2 && err == nil {
-				disconnectUser(user.Username)
-			}
-		} else {
-			err = dataprovider.AddUser(user)
-			user.Password = "[redacted]"
-			logger.Debug(logSender, "", "adding new user: %+v, dump file: %#v, error: %v", user, inputFile, err)
+		guard <- true
+		if summary.hasFailures() && !opts.continueOnError {
+			<-guard
+			break
 		}
-		if err != nil {
-			return err
+		wg.Add(1)
+		go func(user dataprovider.User) {
+			defer func() {
+				<-guard
+				wg.Done()
+			}()
+
+			summary.add(user.Username, restoreUser(user, opts))
+		}(user)
+	}
+	wg.Wait()
+	return summary
+}
+
+func restoreUser(user dataprovider.User, opts restoreOptions) error {
+	u, err := dataprovider.UserExists(user.Username)
+	if err == nil {
+		if opts.mode == 1 {
+			logger.Debug(logSender, "", "loaddata mode 1, existing user %#v not updated", u.Username)
+			return nil
 		}
-		if scanQuota == 1 || (scanQuota == 2 && user.HasQuotaRestrictions()) {
-			if common.QuotaScans.AddUserQuotaScan(user.Username) {
-				logger.Debug(logSender, "", "starting quota scan for restored user: %#v", user.Username)
-				go doQuotaScan(user) //nolint:errcheck
-			}
+		user.ID = u.ID
+		err = dataprovider.UpdateUser(user)
+		user.Password = "[redacted]"
+		logger.Debug(logSender, "", "restoring existing user: %+v, dump file: %#v, error: %v", user, opts.inputFile, err)
+		if opts.mode == 2 && err == nil {
+			disconnectUser(user.Username, "user restored")
+		}
+	} else {
+		err = dataprovider.AddUser(user)
+		user.Password = "[redacted]"
+		logger.Debug(logSender, "", "adding new user: %+v, dump file: %#v, error: %v", user, opts.inputFile, err)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.scanQuota == 1 || (opts.scanQuota == 2 && user.HasQuotaRestrictions()) {
+		if common.QuotaScans.AddUserQuotaScan(user.Username) {
+			logger.Debug(logSender, "", "starting quota scan for restored user: %#v", user.Username)
+			go doQuotaScan(user) //nolint:errcheck
 		}
 	}
 	return nil
 }
+
+type restoreOptions struct {
+	inputFile       string
+	scanQuota       int
+	mode            int
+	concurrency     int
+	continueOnError bool
+}
+
+// restoreSummary collects the results for the restore of a set of objects
+type restoreSummary struct {
+	sync.Mutex
+	kind     string
+	restored int
+	// restored and failed object names, recorded in the audit log
+	names       []string
+	failedNames []string
+	failures    []string
+	firstErr    error
+}
+
+func (s *restoreSummary) add(name string, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err == nil {
+		s.restored++
+		s.names = append(s.names, name)
+		return
+	}
+	if s.firstErr == nil {
+		s.firstErr = err
+	}
+	s.failedNames = append(s.failedNames, name)
+	s.failures = append(s.failures, fmt.Sprintf("unable to restore %v %#v: %v", s.kind, name, err))
+}
+
+func (s *restoreSummary) hasFailures() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.firstErr != nil
+}
+
+// getError returns nil if there are no failures, otherwise an error
+// listing all the failures
+func (s *restoreSummary) getError() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.firstErr == nil {
+		return nil
+	}
+	return errors.New(strings.Join(s.failures, "; "))
+}
+
+// getRestoreAuditSnapshot returns the restored and failed object names for the
+// given summaries, the objects are restored concurrently so the names are sorted
+func getRestoreAuditSnapshot(summaries []*restoreSummary) map[string]interface{} {
+	if !auditLog.Enabled {
+		return nil
+	}
+	snapshot := make(map[string]interface{})
+	for _, s := range summaries {
+		s.Lock()
+		if len(s.names) > 0 {
+			names := append([]string(nil), s.names...)
+			sort.Strings(names)
+			snapshot[s.kind+"s.restored"] = names
+		}
+		if len(s.failedNames) > 0 {
+			names := append([]string(nil), s.failedNames...)
+			sort.Strings(names)
+			snapshot[s.kind+"s.failed"] = names
+		}
+		s.Unlock()
+	}
+	return snapshot
+}
+
+func rotateSecrets(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if _, ok := r.URL.Query()["dry_run"]; ok {
+		switch r.URL.Query().Get("dry_run") {
+		case "0":
+		case "1":
+			dryRun = true
+		default:
+			sendAPIResponse(w, r, fmt.Errorf("invalid dry_run: %#v", r.URL.Query().Get("dry_run")), "", http.StatusBadRequest)
+			return
+		}
+	}
+	logger.Info(logSender, "", "rotating the stored secrets, dry run: %v", dryRun)
+	result, err := dataprovider.RotateSecrets(dryRun)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to rotate the stored secrets: %v", err)
+		sendAPIResponse(w, r, err, "Unable to rotate the secrets", getRespStatus(err))
+		return
+	}
+	if !dryRun {
+		// the counts of the objects with rotated secrets
+		auditAction(r, auditActionRotateSecrets, auditObjectProvider, "", nil, getAuditSnapshot(result))
+	}
+	render.JSON(w, r, result)
+}
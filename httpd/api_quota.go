@@ -43,7 +43,7 @@ func updateUserQuotaUsage(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	user, err := dataprovider.UserExists(u.Username)
+	user, err := dataprovider.GetUserWithGroupSettings(u.Username)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -114,7 +114,7 @@ func startQuotaScan(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	user, err := dataprovider.UserExists(u.Username)
+	user, err := dataprovider.GetUserWithGroupSettings(u.Username)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
@@ -144,6 +144,11 @@ func startVFolderQuotaScan(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
+	if dataprovider.HasPathPlaceholders(folder.MappedPath) {
+		sendAPIResponse(w, r, errors.New("the mapped path contains placeholders, it is resolved for each user and cannot be scanned"),
+			"", http.StatusBadRequest)
+		return
+	}
 	if common.QuotaScans.AddVFolderQuotaScan(folder.MappedPath) {
 		go doFolderQuotaScan(folder) //nolint:errcheck
 		sendAPIResponse(w, r, err, "Scan started", http.StatusAccepted)
@@ -0,0 +1,119 @@
+package httpd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	defaultSignedURLExpiration = 3600
+	// 7 days, the maximum allowed for S3 presigned and GCS V4 signed URLs
+	maxSignedURLExpiration = 604800
+)
+
+// SignedURL defines a time limited URL to download a file directly from the
+// storage backend
+type SignedURL struct {
+	URL string `json:"url"`
+	// expiration as unix timestamp in milliseconds
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+func getUserSignedURL(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	virtualPath := r.URL.Query().Get("path")
+	if virtualPath == "" {
+		sendAPIResponse(w, r, errors.New("the path is mandatory"), "", http.StatusBadRequest)
+		return
+	}
+	virtualPath = utils.CleanPath(virtualPath)
+	expiration, err := getSignedURLExpiration(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(userID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	user, err = dataprovider.GetUserWithGroupSettings(user.Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	if !user.HasFilePerm(dataprovider.PermDownload, virtualPath) || !user.IsFileAllowed(virtualPath) {
+		sendAPIResponse(w, r, fmt.Errorf("download of %#v is not allowed for user %#v", virtualPath, user.Username),
+			"", http.StatusForbidden)
+		return
+	}
+	fs, err := user.GetFilesystem("")
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to create the user filesystem", http.StatusInternalServerError)
+		return
+	}
+	fsPath, err := fs.ResolvePath(virtualPath)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	// check the signing capability before contacting the storage backend
+	expiresAt := time.Now().Add(expiration)
+	signedURL, err := fs.GetSignedURL(fsPath, expiration)
+	if err != nil {
+		if errors.Is(err, vfs.ErrVfsUnsupported) {
+			sendAPIResponse(w, r, err, "Unable to generate a signed URL for this filesystem", http.StatusBadRequest)
+			return
+		}
+		sendAPIResponse(w, r, err, "Unable to generate the signed URL", http.StatusInternalServerError)
+		return
+	}
+	info, err := fs.Stat(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			sendAPIResponse(w, r, err, "", http.StatusNotFound)
+			return
+		}
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		sendAPIResponse(w, r, fmt.Errorf("%#v is a directory", virtualPath), "", http.StatusBadRequest)
+		return
+	}
+	logger.Debug(logSender, "", "signed URL generated for user %#v, path %#v, expiration: %v", user.Username,
+		virtualPath, expiration)
+	render.JSON(w, r, SignedURL{
+		URL:       signedURL,
+		ExpiresAt: utils.GetTimeAsMsSinceEpoch(expiresAt),
+	})
+}
+
+func getSignedURLExpiration(r *http.Request) (time.Duration, error) {
+	expiration := defaultSignedURLExpiration
+	if _, ok := r.URL.Query()["expires"]; ok {
+		var err error
+		expiration, err = strconv.Atoi(r.URL.Query().Get("expires"))
+		if err != nil || expiration <= 0 || expiration > maxSignedURLExpiration {
+			return 0, fmt.Errorf("invalid expires %#v, it must be between 1 and %v seconds",
+				r.URL.Query().Get("expires"), maxSignedURLExpiration)
+		}
+	}
+	return time.Duration(expiration) * time.Second, nil
+}
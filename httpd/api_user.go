@@ -1,8 +1,10 @@
 package httpd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 
@@ -11,6 +13,8 @@ import (
 
 	"github.com/drakkan/sftpgo/common"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
 )
 
@@ -19,6 +23,7 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 	offset := 0
 	order := dataprovider.OrderASC
 	username := ""
+	var metadata dataprovider.MetadataFilter
 	var err error
 	if _, ok := r.URL.Query()["limit"]; ok {
 		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
@@ -50,7 +55,11 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 	if _, ok := r.URL.Query()["username"]; ok {
 		username = r.URL.Query().Get("username")
 	}
-	users, err := dataprovider.GetUsers(limit, offset, order, username)
+	if _, ok := r.URL.Query()["metadata_key"]; ok {
+		metadata.Key = r.URL.Query().Get("metadata_key")
+		metadata.Value = r.URL.Query().Get("metadata_value")
+	}
+	users, err := dataprovider.GetUsers(limit, offset, order, username, metadata)
 	if err == nil {
 		render.JSON(w, r, users)
 	} else {
@@ -77,32 +86,32 @@ func getUserByID(w http.ResponseWriter, r *http.Request) {
 func addUser(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
 	var user dataprovider.User
-	err := render.DecodeJSON(r.Body, &user)
+	userAsJSON, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	switch user.FsConfig.Provider {
-	case dataprovider.S3FilesystemProvider:
-		if user.FsConfig.S3Config.AccessSecret.IsRedacted() {
-			sendAPIResponse(w, r, errors.New("invalid access_secret"), "", http.StatusBadRequest)
-			return
-		}
-	case dataprovider.GCSFilesystemProvider:
-		if user.FsConfig.GCSConfig.Credentials.IsRedacted() {
-			sendAPIResponse(w, r, errors.New("invalid credentials"), "", http.StatusBadRequest)
-			return
-		}
-	case dataprovider.AzureBlobFilesystemProvider:
-		if user.FsConfig.AzBlobConfig.AccountKey.IsRedacted() {
-			sendAPIResponse(w, r, errors.New("invalid account_key"), "", http.StatusBadRequest)
-			return
-		}
+	err = json.Unmarshal(userAsJSON, &user)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if !isExpirationDateDefined(userAsJSON) {
+		user.ExpirationDate = dataprovider.GetDefaultUserExpiration()
+	}
+	// TOTP can only be configured using the dedicated endpoints
+	user.TOTPConfig = dataprovider.UserTOTPConfig{}
+	// the auth backend is set by the backend that creates the user
+	user.AuthBackend = ""
+	if err = checkRedactedSecrets(&user.FsConfig); err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
 	}
 	err = dataprovider.AddUser(user)
 	if err == nil {
 		user, err = dataprovider.UserExists(user.Username)
 		if err == nil {
+			auditAction(r, auditActionAdd, auditObjectUser, user.Username, nil, getAuditSnapshot(user))
 			user.HideConfidentialData()
 			render.JSON(w, r, user)
 		} else {
@@ -135,12 +144,19 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 		return
 	}
+	auditBefore := getAuditSnapshot(user)
 	currentPermissions := user.Permissions
 	var currentS3AccessSecret vfs.Secret
+	var currentS3SSECustomerKey vfs.Secret
 	var currentAzAccountKey vfs.Secret
 	var currentGCSCredentials vfs.Secret
+	var currentB2ApplicationKey vfs.Secret
+	var currentSFTPPassword vfs.Secret
+	var currentSFTPPrivateKey vfs.Secret
+	var currentCryptPassphrase vfs.Secret
 	if user.FsConfig.Provider == dataprovider.S3FilesystemProvider {
 		currentS3AccessSecret = user.FsConfig.S3Config.AccessSecret
+		currentS3SSECustomerKey = user.FsConfig.S3Config.SSECustomerKey
 	}
 	if user.FsConfig.Provider == dataprovider.AzureBlobFilesystemProvider {
 		currentAzAccountKey = user.FsConfig.AzBlobConfig.AccountKey
@@ -148,10 +164,31 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	if user.FsConfig.Provider == dataprovider.GCSFilesystemProvider {
 		currentGCSCredentials = user.FsConfig.GCSConfig.Credentials
 	}
+	if user.FsConfig.Provider == dataprovider.B2FilesystemProvider {
+		currentB2ApplicationKey = user.FsConfig.B2Config.ApplicationKey
+	}
+	if user.FsConfig.Provider == dataprovider.SFTPFilesystemProvider {
+		currentSFTPPassword = user.FsConfig.SFTPConfig.Password
+		currentSFTPPrivateKey = user.FsConfig.SFTPConfig.PrivateKey
+	}
+	if user.FsConfig.Provider == dataprovider.CryptedFilesystemProvider {
+		currentCryptPassphrase = user.FsConfig.CryptConfig.Passphrase
+	}
+	currentPassword := user.Password
+	currentPublicKeys := make([]string, len(user.PublicKeys))
+	copy(currentPublicKeys, user.PublicKeys)
+	currentStatus := user.Status
+	currentTOTPConfig := user.TOTPConfig
+	currentAuthBackend := user.AuthBackend
 	user.Permissions = make(map[string][]string)
 	user.FsConfig.S3Config = vfs.S3FsConfig{}
 	user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
 	user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+	user.FsConfig.B2Config = vfs.B2FsConfig{}
+	user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+	user.FsConfig.CryptConfig = vfs.CryptFsConfig{}
+	// metadata are replaced, decoding into the existing map would merge the keys
+	user.Metadata = nil
 	err = render.DecodeJSON(r.Body, &user)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
@@ -161,7 +198,11 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	if len(user.Permissions) == 0 {
 		user.Permissions = currentPermissions
 	}
-	updateEncryptedSecrets(&user, currentS3AccessSecret, currentAzAccountKey, currentGCSCredentials)
+	updateEncryptedSecrets(&user, currentS3AccessSecret, currentS3SSECustomerKey, currentAzAccountKey, currentGCSCredentials,
+		currentB2ApplicationKey, currentSFTPPassword, currentSFTPPrivateKey, currentCryptPassphrase)
+	// TOTP can only be configured using the dedicated endpoints
+	user.TOTPConfig = currentTOTPConfig
+	user.AuthBackend = currentAuthBackend
 
 	if user.ID != userID {
 		sendAPIResponse(w, r, err, "user ID in request body does not match user ID in path parameter", http.StatusBadRequest)
@@ -171,9 +212,12 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
 	} else {
+		auditAction(r, auditActionUpdate, auditObjectUser, user.Username, auditBefore, getUserAuditSnapshot(user.Username))
 		sendAPIResponse(w, r, err, "User updated", http.StatusOK)
 		if disconnect == 1 {
-			disconnectUser(user.Username)
+			disconnectUser(user.Username, "user updated, disconnect requested")
+		} else if reason := getUpdateDisconnectReason(&user, currentPassword, currentPublicKeys, currentStatus); reason != "" {
+			disconnectUser(user.Username, reason)
 		}
 	}
 }
@@ -194,34 +238,282 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
 	} else {
+		auditAction(r, auditActionDelete, auditObjectUser, user.Username, getAuditSnapshot(user), nil)
 		sendAPIResponse(w, r, err, "User deleted", http.StatusOK)
-		disconnectUser(user.Username)
+		disconnectUser(user.Username, "user deleted")
+	}
+}
+
+func disconnectUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(userID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	closed := disconnectUser(user.Username, "disconnect requested")
+	sendAPIResponse(w, r, nil, fmt.Sprintf("User disconnected, closed connections: %v", closed), http.StatusOK)
+}
+
+func getUserLoginLockout(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(userID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	status, err := dataprovider.GetLoginLockoutStatus(user.Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, status)
+}
+
+func resetUserLoginLockout(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(userID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	reset, err := dataprovider.ResetLoginLockout(user.Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
 	}
+	if !reset {
+		sendAPIResponse(w, r, nil, "No failed logins to reset", http.StatusOK)
+		return
+	}
+	auditAction(r, auditActionResetLockout, auditObjectUser, user.Username, nil, nil)
+	sendAPIResponse(w, r, nil, "Login lockout reset", http.StatusOK)
 }
 
-func disconnectUser(username string) {
+func generateUserTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(userID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	provisioning, err := dataprovider.GenerateUserTOTP(user.Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	auditAction(r, auditActionUpdate, auditObjectUser, user.Username, getAuditSnapshot(user),
+		getUserAuditSnapshot(user.Username))
+	render.JSON(w, r, provisioning)
+}
+
+func enableUserTOTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(userID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	var req totpEnableRequest
+	err = render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.EnableUserTOTP(user.Username, req.Code)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	auditAction(r, auditActionUpdate, auditObjectUser, user.Username, getAuditSnapshot(user),
+		getUserAuditSnapshot(user.Username))
+	sendAPIResponse(w, r, nil, "TOTP enabled", http.StatusOK)
+}
+
+func disableUserTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(userID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	err = dataprovider.DisableUserTOTP(user.Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	auditAction(r, auditActionUpdate, auditObjectUser, user.Username, getAuditSnapshot(user),
+		getUserAuditSnapshot(user.Username))
+	sendAPIResponse(w, r, nil, "TOTP disabled", http.StatusOK)
+}
+
+// disconnectUser closes all the active connections for the specified user
+// and returns the number of closed connections
+func disconnectUser(username, reason string) int {
+	closed := 0
 	for _, stat := range common.Connections.GetStats() {
 		if stat.Username == username {
-			common.Connections.Close(stat.ConnectionID)
+			if common.Connections.Close(stat.ConnectionID) {
+				closed++
+			}
+		}
+	}
+	if closed > 0 {
+		logger.Info(logSender, "", "user %#v disconnected, closed connections: %v, reason: %v", username, closed, reason)
+	}
+	return closed
+}
+
+// getUpdateDisconnectReason returns the reason to close the active sessions for an updated user.
+// An empty string means that the active sessions can be kept
+func getUpdateDisconnectReason(user *dataprovider.User, oldPassword string, oldPublicKeys []string, oldStatus int) string {
+	if oldStatus == 1 && user.Status == 0 {
+		return "account disabled"
+	}
+	if user.Filters.KeepSessionsOnCredentialsChange {
+		return ""
+	}
+	if user.Password != oldPassword {
+		return "password changed"
+	}
+	if len(user.PublicKeys) != len(oldPublicKeys) {
+		return "public keys changed"
+	}
+	for _, k := range user.PublicKeys {
+		if !utils.IsStringInSlice(k, oldPublicKeys) {
+			return "public keys changed"
 		}
 	}
+	return ""
 }
 
-func updateEncryptedSecrets(user *dataprovider.User, currentS3AccessSecret, currentAzAccountKey, currentGCSCredentials vfs.Secret) {
-	// we use the new access secret if plain or empty, otherwise the old value
+// checkRedactedSecrets returns an error if the secrets for the configured
+// filesystem are redacted, redacted secrets cannot be saved
+func checkRedactedSecrets(fsConfig *dataprovider.Filesystem) error {
+	switch fsConfig.Provider {
+	case dataprovider.S3FilesystemProvider:
+		if fsConfig.S3Config.AccessSecret.IsRedacted() {
+			return errors.New("invalid access_secret")
+		}
+		if fsConfig.S3Config.SSECustomerKey.IsRedacted() {
+			return errors.New("invalid sse_customer_key")
+		}
+	case dataprovider.GCSFilesystemProvider:
+		if fsConfig.GCSConfig.Credentials.IsRedacted() {
+			return errors.New("invalid credentials")
+		}
+	case dataprovider.AzureBlobFilesystemProvider:
+		if fsConfig.AzBlobConfig.AccountKey.IsRedacted() {
+			return errors.New("invalid account_key")
+		}
+	case dataprovider.B2FilesystemProvider:
+		if fsConfig.B2Config.ApplicationKey.IsRedacted() {
+			return errors.New("invalid application_key")
+		}
+	case dataprovider.SFTPFilesystemProvider:
+		if fsConfig.SFTPConfig.Password.IsRedacted() {
+			return errors.New("invalid SFTP password")
+		}
+		if fsConfig.SFTPConfig.PrivateKey.IsRedacted() {
+			return errors.New("invalid SFTP private key")
+		}
+	case dataprovider.CryptedFilesystemProvider:
+		if fsConfig.CryptConfig.Passphrase.IsRedacted() {
+			return errors.New("invalid passphrase")
+		}
+	}
+	return nil
+}
+
+func updateEncryptedSecrets(user *dataprovider.User, currentS3AccessSecret, currentS3SSECustomerKey, currentAzAccountKey,
+	currentGCSCredentials, currentB2ApplicationKey, currentSFTPPassword, currentSFTPPrivateKey, currentCryptPassphrase vfs.Secret,
+) {
+	// we use the new access secret if plain, a reference to an external secrets store
+	// or empty, otherwise the old value
 	if user.FsConfig.Provider == dataprovider.S3FilesystemProvider {
-		if !user.FsConfig.S3Config.AccessSecret.IsPlain() && !user.FsConfig.S3Config.AccessSecret.IsEmpty() {
+		if !user.FsConfig.S3Config.AccessSecret.IsPlain() && !user.FsConfig.S3Config.AccessSecret.IsReference() &&
+			!user.FsConfig.S3Config.AccessSecret.IsEmpty() {
 			user.FsConfig.S3Config.AccessSecret = currentS3AccessSecret
 		}
+		if !user.FsConfig.S3Config.SSECustomerKey.IsPlain() && !user.FsConfig.S3Config.SSECustomerKey.IsReference() &&
+			!user.FsConfig.S3Config.SSECustomerKey.IsEmpty() {
+			user.FsConfig.S3Config.SSECustomerKey = currentS3SSECustomerKey
+		}
 	}
 	if user.FsConfig.Provider == dataprovider.AzureBlobFilesystemProvider {
-		if !user.FsConfig.AzBlobConfig.AccountKey.IsPlain() && !user.FsConfig.AzBlobConfig.AccountKey.IsEmpty() {
+		if !user.FsConfig.AzBlobConfig.AccountKey.IsPlain() && !user.FsConfig.AzBlobConfig.AccountKey.IsReference() &&
+			!user.FsConfig.AzBlobConfig.AccountKey.IsEmpty() {
 			user.FsConfig.AzBlobConfig.AccountKey = currentAzAccountKey
 		}
 	}
 	if user.FsConfig.Provider == dataprovider.GCSFilesystemProvider {
-		if !user.FsConfig.GCSConfig.Credentials.IsPlain() && !user.FsConfig.GCSConfig.Credentials.IsEmpty() {
+		if !user.FsConfig.GCSConfig.Credentials.IsPlain() && !user.FsConfig.GCSConfig.Credentials.IsReference() &&
+			!user.FsConfig.GCSConfig.Credentials.IsEmpty() {
 			user.FsConfig.GCSConfig.Credentials = currentGCSCredentials
 		}
 	}
+	if user.FsConfig.Provider == dataprovider.B2FilesystemProvider {
+		if !user.FsConfig.B2Config.ApplicationKey.IsPlain() && !user.FsConfig.B2Config.ApplicationKey.IsReference() &&
+			!user.FsConfig.B2Config.ApplicationKey.IsEmpty() {
+			user.FsConfig.B2Config.ApplicationKey = currentB2ApplicationKey
+		}
+	}
+	if user.FsConfig.Provider == dataprovider.SFTPFilesystemProvider {
+		if !user.FsConfig.SFTPConfig.Password.IsPlain() && !user.FsConfig.SFTPConfig.Password.IsReference() &&
+			!user.FsConfig.SFTPConfig.Password.IsEmpty() {
+			user.FsConfig.SFTPConfig.Password = currentSFTPPassword
+		}
+		if !user.FsConfig.SFTPConfig.PrivateKey.IsPlain() && !user.FsConfig.SFTPConfig.PrivateKey.IsReference() &&
+			!user.FsConfig.SFTPConfig.PrivateKey.IsEmpty() {
+			user.FsConfig.SFTPConfig.PrivateKey = currentSFTPPrivateKey
+		}
+	}
+	if user.FsConfig.Provider == dataprovider.CryptedFilesystemProvider {
+		if !user.FsConfig.CryptConfig.Passphrase.IsPlain() && !user.FsConfig.CryptConfig.Passphrase.IsReference() &&
+			!user.FsConfig.CryptConfig.Passphrase.IsEmpty() {
+			user.FsConfig.CryptConfig.Passphrase = currentCryptPassphrase
+		}
+	}
+}
+
+// isExpirationDateDefined returns true if the expiration date is explicitly
+// set inside the given JSON serialized user, 0 (no expiration) included
+func isExpirationDateDefined(userAsJSON []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(userAsJSON, &fields); err != nil {
+		return true
+	}
+	_, ok := fields["expiration_date"]
+	return ok
 }
@@ -62,6 +62,10 @@ func buildURLRelativeToBase(paths ...string) string {
 }
 
 func sendAPIResponse(w http.ResponseWriter, r *http.Request, err error, message string, code int) {
+	if structuredErrors && code >= http.StatusBadRequest {
+		sendAPIErrorResponse(w, r, err, message, code)
+		return
+	}
 	var errorString string
 	if err != nil {
 		errorString = err.Error()
@@ -284,6 +288,156 @@ func CloseConnection(connectionID string, expectedStatusCode int) ([]byte, error
 	return body, err
 }
 
+// GenerateUserTOTP generates a new TOTP secret and new recovery codes for the given user and
+// checks the received HTTP Status code against expectedStatusCode
+func GenerateUserTOTP(user dataprovider.User, expectedStatusCode int) (dataprovider.TOTPProvisioning, []byte, error) {
+	var provisioning dataprovider.TOTPProvisioning
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"totp", "generate"), nil, "")
+	if err != nil {
+		return provisioning, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &provisioning)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return provisioning, body, err
+}
+
+// EnableUserTOTP enables TOTP for the given user using the specified code and checks the received
+// HTTP Status code against expectedStatusCode
+func EnableUserTOTP(user dataprovider.User, code string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	asJSON, _ := json.Marshal(map[string]string{"code": code})
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"totp", "enable"), bytes.NewBuffer(asJSON), "application/json")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	body, _ = getResponseBody(resp)
+	return body, err
+}
+
+// DisableUserTOTP disables TOTP for the given user and checks the received HTTP Status code
+// against expectedStatusCode
+func DisableUserTOTP(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"totp", "disable"), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	body, _ = getResponseBody(resp)
+	return body, err
+}
+
+// DisconnectUser closes all the active connections for the given user and checks the received
+// HTTP Status code against expectedStatusCode
+func DisconnectUser(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"disconnect"), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	body, _ = getResponseBody(resp)
+	return body, err
+}
+
+// GetUserLoginLockout returns the login lockout status for the given user and checks the
+// received HTTP Status code against expectedStatusCode.
+func GetUserLoginLockout(user dataprovider.User, expectedStatusCode int) (dataprovider.LoginLockoutStatus, []byte, error) {
+	var status dataprovider.LoginLockoutStatus
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"lockout"), nil, "")
+	if err != nil {
+		return status, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &status)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return status, body, err
+}
+
+// ResetUserLoginLockout unlocks the given user and resets the failed logins counter and checks
+// the received HTTP Status code against expectedStatusCode.
+func ResetUserLoginLockout(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10),
+		"lockout"), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	body, _ = getResponseBody(resp)
+	return body, err
+}
+
+// GetUserSignedURL returns a signed URL to download the file at virtualPath for the given user
+// and checks the received HTTP Status code against expectedStatusCode.
+// A zero expires means the default expiration
+func GetUserSignedURL(user dataprovider.User, virtualPath string, expires int, expectedStatusCode int) (SignedURL, []byte, error) {
+	var signedURL SignedURL
+	var body []byte
+	url, err := addSignedURLQueryParams(buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10), "signed_url"),
+		virtualPath, expires)
+	if err != nil {
+		return signedURL, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return signedURL, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &signedURL)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return signedURL, body, err
+}
+
+// GetUserFileChecksum returns the SHA-256 checksum for the file at virtualPath for the given user
+// and checks the received HTTP Status code against expectedStatusCode.
+func GetUserFileChecksum(user dataprovider.User, virtualPath string, expectedStatusCode int) (FileChecksum, []byte, error) {
+	var checksum FileChecksum
+	var body []byte
+	url, err := addSignedURLQueryParams(buildURLRelativeToBase(userPath, strconv.FormatInt(user.ID, 10), "checksum"),
+		virtualPath, 0)
+	if err != nil {
+		return checksum, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return checksum, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &checksum)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return checksum, body, err
+}
+
 // AddFolder adds a new folder and checks the received HTTP Status code against expectedStatusCode
 func AddFolder(folder vfs.BaseVirtualFolder, expectedStatusCode int) (vfs.BaseVirtualFolder, []byte, error) {
 	var newFolder vfs.BaseVirtualFolder
@@ -361,6 +515,180 @@ func GetFolders(limit int64, offset int64, mappedPath string, expectedStatusCode
 	return folders, body, err
 }
 
+// AddGroup adds a new group and checks the received HTTP Status code against expectedStatusCode
+func AddGroup(group dataprovider.Group, expectedStatusCode int) (dataprovider.Group, []byte, error) {
+	var newGroup dataprovider.Group
+	var body []byte
+	groupAsJSON, _ := json.Marshal(group)
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(groupPath), bytes.NewBuffer(groupAsJSON),
+		"application/json")
+	if err != nil {
+		return newGroup, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newGroup, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newGroup)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkGroup(&group, &newGroup)
+	}
+	return newGroup, body, err
+}
+
+// UpdateGroup updates an existing group and checks the received HTTP Status code against expectedStatusCode
+func UpdateGroup(group dataprovider.Group, expectedStatusCode int) (dataprovider.Group, []byte, error) {
+	var newGroup dataprovider.Group
+	var body []byte
+	groupAsJSON, _ := json.Marshal(group)
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(groupPath, strconv.FormatInt(group.ID, 10)),
+		bytes.NewBuffer(groupAsJSON), "application/json")
+	if err != nil {
+		return group, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newGroup, body, err
+	}
+	if err == nil {
+		newGroup, body, err = GetGroupByID(group.ID, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkGroup(&group, &newGroup)
+	}
+	return newGroup, body, err
+}
+
+// RemoveGroup removes an existing group and checks the received HTTP Status code against expectedStatusCode
+func RemoveGroup(group dataprovider.Group, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(groupPath, strconv.FormatInt(group.ID, 10)), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetGroupByID gets a group by database id and checks the received HTTP Status code against expectedStatusCode
+func GetGroupByID(groupID int64, expectedStatusCode int) (dataprovider.Group, []byte, error) {
+	var group dataprovider.Group
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(groupPath, strconv.FormatInt(groupID, 10)), nil, "")
+	if err != nil {
+		return group, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &group)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return group, body, err
+}
+
+// GetGroups returns a list of groups and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+// The results can be filtered specifying a group name, the name filter is an exact match
+func GetGroups(limit, offset int64, name string, expectedStatusCode int) ([]dataprovider.Group, []byte, error) {
+	var groups []dataprovider.Group
+	var body []byte
+	url, err := addLimitAndOffsetQueryParams(buildURLRelativeToBase(groupPath), limit, offset)
+	if err != nil {
+		return groups, body, err
+	}
+	if len(name) > 0 {
+		q := url.Query()
+		q.Add("name", name)
+		url.RawQuery = q.Encode()
+	}
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return groups, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &groups)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return groups, body, err
+}
+
+// GetDeletedUsers returns a list of soft deleted users and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+// The results can be filtered specifying a username, the username filter is an exact match
+func GetDeletedUsers(limit, offset int64, username string, expectedStatusCode int) ([]dataprovider.DeletedUser, []byte, error) {
+	var deletedUsers []dataprovider.DeletedUser
+	var body []byte
+	url, err := addLimitAndOffsetQueryParams(buildURLRelativeToBase(deletedUserPath), limit, offset)
+	if err != nil {
+		return deletedUsers, body, err
+	}
+	if len(username) > 0 {
+		q := url.Query()
+		q.Add("username", username)
+		url.RawQuery = q.Encode()
+	}
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return deletedUsers, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &deletedUsers)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return deletedUsers, body, err
+}
+
+// RestoreDeletedUser restores the soft deleted user with the given username and checks the
+// received HTTP Status code against expectedStatusCode.
+func RestoreDeletedUser(username string, expectedStatusCode int) (dataprovider.User, []byte, error) {
+	var user dataprovider.User
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(deletedUserPath, username, "restore"), nil, "")
+	if err != nil {
+		return user, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &user)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return user, body, err
+}
+
+// PurgeDeletedUser permanently removes the soft deleted user with the given username and
+// checks the received HTTP Status code against expectedStatusCode.
+func PurgeDeletedUser(username string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(deletedUserPath, username), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
 // GetFoldersQuotaScans gets active quota scans for folders and checks the received HTTP Status code against expectedStatusCode.
 func GetFoldersQuotaScans(expectedStatusCode int) ([]common.ActiveVirtualFolderQuotaScan, []byte, error) {
 	var quotaScans []common.ActiveVirtualFolderQuotaScan
@@ -474,6 +802,53 @@ func Dumpdata(outputFile, indent string, expectedStatusCode int) (map[string]int
 	return response, body, err
 }
 
+// ScheduledBackup requests an on demand backup using the scheduled backups configuration
+// and returns the path of the generated backup
+func ScheduledBackup(expectedStatusCode int) (string, []byte, error) {
+	var response map[string]string
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(scheduledBackupPath), nil, "")
+	if err != nil {
+		return "", body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &response)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return response["output_file"], body, err
+}
+
+// RotateSecrets decrypts all the stored secrets and encrypts them again using the configured
+// secret provider. If dryRun is true the secrets are only checked
+func RotateSecrets(dryRun bool, expectedStatusCode int) (dataprovider.SecretsRotationResult, []byte, error) {
+	var result dataprovider.SecretsRotationResult
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(secretsRotationPath))
+	if err != nil {
+		return result, body, err
+	}
+	if dryRun {
+		q := url.Query()
+		q.Add("dry_run", "1")
+		url.RawQuery = q.Encode()
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, url.String(), nil, "")
+	if err != nil {
+		return result, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &result)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return result, body, err
+}
+
 // Loaddata restores a backup.
 // New users are added, existing users are updated. Users will be restored one by one and the restore is stopped if a
 // user cannot be added/updated, so it could happen a partial restore
@@ -548,9 +923,59 @@ func checkFolder(expected *vfs.BaseVirtualFolder, actual *vfs.BaseVirtualFolder)
 			return errors.New("folder users mismatch")
 		}
 	}
+	if !compareMetadata(expected.Metadata, actual.Metadata) {
+		return errors.New("folder metadata mismatch")
+	}
 	return nil
 }
 
+func checkGroup(expected *dataprovider.Group, actual *dataprovider.Group) error {
+	if expected.ID <= 0 {
+		if actual.ID <= 0 {
+			return errors.New("actual group ID must be > 0")
+		}
+	} else {
+		if actual.ID != expected.ID {
+			return errors.New("group ID mismatch")
+		}
+	}
+	if expected.Name != actual.Name {
+		return errors.New("group name mismatch")
+	}
+	if expected.Description != actual.Description {
+		return errors.New("group description mismatch")
+	}
+	// the shared settings are compared using the users helpers
+	expectedUser := &dataprovider.User{
+		Permissions:       expected.Permissions,
+		QuotaSize:         expected.QuotaSize,
+		QuotaFiles:        expected.QuotaFiles,
+		UploadBandwidth:   expected.UploadBandwidth,
+		DownloadBandwidth: expected.DownloadBandwidth,
+		Filters:           expected.Filters,
+		FsConfig:          expected.FsConfig,
+	}
+	actualUser := &dataprovider.User{
+		Permissions:       actual.Permissions,
+		QuotaSize:         actual.QuotaSize,
+		QuotaFiles:        actual.QuotaFiles,
+		UploadBandwidth:   actual.UploadBandwidth,
+		DownloadBandwidth: actual.DownloadBandwidth,
+		Filters:           actual.Filters,
+		FsConfig:          actual.FsConfig,
+	}
+	if len(expected.Permissions) != len(actual.Permissions) {
+		return errors.New("group permissions mismatch")
+	}
+	if err := compareUserFilters(expectedUser, actualUser); err != nil {
+		return err
+	}
+	if err := compareUserFsConfig(expectedUser, actualUser); err != nil {
+		return err
+	}
+	return compareEqualsUserFields(expectedUser, actualUser)
+}
+
 func checkUser(expected *dataprovider.User, actual *dataprovider.User) error {
 	if len(actual.Password) > 0 {
 		return errors.New("User password must not be visible")
@@ -623,6 +1048,30 @@ func compareUserFsConfig(expected *dataprovider.User, actual *dataprovider.User)
 	if err := compareAzBlobConfig(expected, actual); err != nil {
 		return err
 	}
+	if err := compareB2Config(expected, actual); err != nil {
+		return err
+	}
+	if err := compareSFTPConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := checkEncryptedSecret(expected.FsConfig.CryptConfig.Passphrase, actual.FsConfig.CryptConfig.Passphrase); err != nil {
+		return err
+	}
+	if !checkFilterMatch(expected.FsConfig.Compression.Extensions, actual.FsConfig.Compression.Extensions) {
+		return errors.New("compression extensions mismatch")
+	}
+	if !checkFilterMatch(expected.FsConfig.Compression.Paths, actual.FsConfig.Compression.Paths) {
+		return errors.New("compression paths mismatch")
+	}
+	if expected.FsConfig.HomeMarker != actual.FsConfig.HomeMarker {
+		return errors.New("Fs home marker mismatch")
+	}
+	if expected.FsConfig.Compression.QuotaBasis != actual.FsConfig.Compression.QuotaBasis {
+		return errors.New("compression quota basis mismatch")
+	}
+	if expected.FsConfig.Cache != actual.FsConfig.Cache {
+		return errors.New("cache config mismatch")
+	}
 	return nil
 }
 
@@ -630,7 +1079,10 @@ func compareS3Config(expected *dataprovider.User, actual *dataprovider.User) err
 	if expected.FsConfig.S3Config.Bucket != actual.FsConfig.S3Config.Bucket {
 		return errors.New("S3 bucket mismatch")
 	}
-	if expected.FsConfig.S3Config.Region != actual.FsConfig.S3Config.Region {
+	// region and endpoint are set to their defaults for Cloudflare R2, if empty
+	isR2Default := expected.FsConfig.S3Config.R2AccountID != ""
+	if expected.FsConfig.S3Config.Region != actual.FsConfig.S3Config.Region &&
+		(!isR2Default || expected.FsConfig.S3Config.Region != "") {
 		return errors.New("S3 region mismatch")
 	}
 	if expected.FsConfig.S3Config.AccessKey != actual.FsConfig.S3Config.AccessKey {
@@ -639,7 +1091,11 @@ func compareS3Config(expected *dataprovider.User, actual *dataprovider.User) err
 	if err := checkEncryptedSecret(expected.FsConfig.S3Config.AccessSecret, actual.FsConfig.S3Config.AccessSecret); err != nil {
 		return fmt.Errorf("S3 access secret mismatch: %v", err)
 	}
-	if expected.FsConfig.S3Config.Endpoint != actual.FsConfig.S3Config.Endpoint {
+	if err := checkEncryptedSecret(expected.FsConfig.S3Config.SSECustomerKey, actual.FsConfig.S3Config.SSECustomerKey); err != nil {
+		return fmt.Errorf("S3 SSE-C key mismatch: %v", err)
+	}
+	if expected.FsConfig.S3Config.Endpoint != actual.FsConfig.S3Config.Endpoint &&
+		(!isR2Default || expected.FsConfig.S3Config.Endpoint != "") {
 		return errors.New("S3 endpoint mismatch")
 	}
 	if expected.FsConfig.S3Config.StorageClass != actual.FsConfig.S3Config.StorageClass {
@@ -651,6 +1107,36 @@ func compareS3Config(expected *dataprovider.User, actual *dataprovider.User) err
 	if expected.FsConfig.S3Config.UploadConcurrency != actual.FsConfig.S3Config.UploadConcurrency {
 		return errors.New("S3 upload concurrency mismatch")
 	}
+	if expected.FsConfig.S3Config.RequesterPays != actual.FsConfig.S3Config.RequesterPays {
+		return errors.New("S3 requester pays mismatch")
+	}
+	if expected.FsConfig.S3Config.SSEEncryption != actual.FsConfig.S3Config.SSEEncryption {
+		return errors.New("S3 SSE encryption mismatch")
+	}
+	if expected.FsConfig.S3Config.SSEKMSKeyID != actual.FsConfig.S3Config.SSEKMSKeyID {
+		return errors.New("S3 SSE KMS key ID mismatch")
+	}
+	if expected.FsConfig.S3Config.RoleARN != actual.FsConfig.S3Config.RoleARN {
+		return errors.New("S3 role ARN mismatch")
+	}
+	if expected.FsConfig.S3Config.ExternalID != actual.FsConfig.S3Config.ExternalID {
+		return errors.New("S3 external ID mismatch")
+	}
+	if expected.FsConfig.S3Config.RoleSessionName != actual.FsConfig.S3Config.RoleSessionName {
+		return errors.New("S3 role session name mismatch")
+	}
+	if !strings.EqualFold(expected.FsConfig.S3Config.R2AccountID, actual.FsConfig.S3Config.R2AccountID) {
+		return errors.New("S3 R2 account ID mismatch")
+	}
+	if expected.FsConfig.S3Config.MaxRetries != actual.FsConfig.S3Config.MaxRetries {
+		return errors.New("S3 max retries mismatch")
+	}
+	if expected.FsConfig.S3Config.RetryBaseDelay != actual.FsConfig.S3Config.RetryBaseDelay {
+		return errors.New("S3 retry base delay mismatch")
+	}
+	if expected.FsConfig.S3Config.RequestTimeout != actual.FsConfig.S3Config.RequestTimeout {
+		return errors.New("S3 request timeout mismatch")
+	}
 	if expected.FsConfig.S3Config.KeyPrefix != actual.FsConfig.S3Config.KeyPrefix &&
 		expected.FsConfig.S3Config.KeyPrefix+"/" != actual.FsConfig.S3Config.KeyPrefix {
 		return errors.New("S3 key prefix mismatch")
@@ -665,6 +1151,9 @@ func compareGCSConfig(expected *dataprovider.User, actual *dataprovider.User) er
 	if expected.FsConfig.GCSConfig.StorageClass != actual.FsConfig.GCSConfig.StorageClass {
 		return errors.New("GCS storage class mismatch")
 	}
+	if strings.TrimSpace(expected.FsConfig.GCSConfig.KMSKeyName) != actual.FsConfig.GCSConfig.KMSKeyName {
+		return errors.New("GCS KMS key name mismatch")
+	}
 	if expected.FsConfig.GCSConfig.KeyPrefix != actual.FsConfig.GCSConfig.KeyPrefix &&
 		expected.FsConfig.GCSConfig.KeyPrefix+"/" != actual.FsConfig.GCSConfig.KeyPrefix {
 		return errors.New("GCS key prefix mismatch")
@@ -704,6 +1193,65 @@ func compareAzBlobConfig(expected *dataprovider.User, actual *dataprovider.User)
 	if expected.FsConfig.AzBlobConfig.UseEmulator != actual.FsConfig.AzBlobConfig.UseEmulator {
 		return errors.New("Azure Blob use emulator mismatch")
 	}
+	if expected.FsConfig.AzBlobConfig.UseManagedIdentity != actual.FsConfig.AzBlobConfig.UseManagedIdentity {
+		return errors.New("Azure Blob use managed identity mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.ManagedIdentityClientID != actual.FsConfig.AzBlobConfig.ManagedIdentityClientID {
+		return errors.New("Azure Blob managed identity client ID mismatch")
+	}
+	return nil
+}
+
+func compareB2Config(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.B2Config.Bucket != actual.FsConfig.B2Config.Bucket {
+		return errors.New("B2 bucket mismatch")
+	}
+	if expected.FsConfig.B2Config.AccountID != actual.FsConfig.B2Config.AccountID {
+		return errors.New("B2 account ID mismatch")
+	}
+	if err := checkEncryptedSecret(expected.FsConfig.B2Config.ApplicationKey, actual.FsConfig.B2Config.ApplicationKey); err != nil {
+		return fmt.Errorf("B2 application key mismatch: %v", err)
+	}
+	if expected.FsConfig.B2Config.Endpoint != actual.FsConfig.B2Config.Endpoint {
+		return errors.New("B2 endpoint mismatch")
+	}
+	if expected.FsConfig.B2Config.UploadChunkSize != actual.FsConfig.B2Config.UploadChunkSize {
+		return errors.New("B2 upload chunk size mismatch")
+	}
+	if expected.FsConfig.B2Config.KeyPrefix != actual.FsConfig.B2Config.KeyPrefix &&
+		expected.FsConfig.B2Config.KeyPrefix+"/" != actual.FsConfig.B2Config.KeyPrefix {
+		return errors.New("B2 key prefix mismatch")
+	}
+	return nil
+}
+
+func compareSFTPConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.SFTPConfig.Endpoint != actual.FsConfig.SFTPConfig.Endpoint &&
+		expected.FsConfig.SFTPConfig.Endpoint+":22" != actual.FsConfig.SFTPConfig.Endpoint {
+		return errors.New("SFTP endpoint mismatch")
+	}
+	if expected.FsConfig.SFTPConfig.Username != actual.FsConfig.SFTPConfig.Username {
+		return errors.New("SFTP username mismatch")
+	}
+	if err := checkEncryptedSecret(expected.FsConfig.SFTPConfig.Password, actual.FsConfig.SFTPConfig.Password); err != nil {
+		return fmt.Errorf("SFTP password mismatch: %v", err)
+	}
+	if err := checkEncryptedSecret(expected.FsConfig.SFTPConfig.PrivateKey, actual.FsConfig.SFTPConfig.PrivateKey); err != nil {
+		return fmt.Errorf("SFTP private key mismatch: %v", err)
+	}
+	if len(expected.FsConfig.SFTPConfig.Fingerprints) != len(actual.FsConfig.SFTPConfig.Fingerprints) {
+		return errors.New("SFTP fingerprints mismatch")
+	}
+	for _, fp := range expected.FsConfig.SFTPConfig.Fingerprints {
+		if !utils.IsStringInSlice(fp, actual.FsConfig.SFTPConfig.Fingerprints) {
+			return errors.New("SFTP fingerprints content mismatch")
+		}
+	}
+	if expected.FsConfig.SFTPConfig.Prefix != actual.FsConfig.SFTPConfig.Prefix &&
+		path.Clean(expected.FsConfig.SFTPConfig.Prefix) != actual.FsConfig.SFTPConfig.Prefix &&
+		!(expected.FsConfig.SFTPConfig.Prefix == "" && actual.FsConfig.SFTPConfig.Prefix == "/") {
+		return errors.New("SFTP prefix mismatch")
+	}
 	return nil
 }
 
@@ -739,9 +1287,18 @@ func compareUserFilters(expected *dataprovider.User, actual *dataprovider.User)
 	if len(expected.Filters.DeniedProtocols) != len(actual.Filters.DeniedProtocols) {
 		return errors.New("Denied protocols mismatch")
 	}
+	if len(expected.Filters.TOTPProtocols) != len(actual.Filters.TOTPProtocols) {
+		return errors.New("TOTP protocols mismatch")
+	}
 	if expected.Filters.MaxUploadFileSize != actual.Filters.MaxUploadFileSize {
 		return errors.New("Max upload file size mismatch")
 	}
+	if expected.Filters.DownloadVolumeLimit != actual.Filters.DownloadVolumeLimit {
+		return errors.New("Download volume limit mismatch")
+	}
+	if expected.Filters.DownloadVolumePeriod != "" && expected.Filters.DownloadVolumePeriod != actual.Filters.DownloadVolumePeriod {
+		return errors.New("Download volume period mismatch")
+	}
 	for _, IPMask := range expected.Filters.AllowedIP {
 		if !utils.IsStringInSlice(IPMask, actual.Filters.AllowedIP) {
 			return errors.New("AllowedIP contents mismatch")
@@ -757,17 +1314,284 @@ func compareUserFilters(expected *dataprovider.User, actual *dataprovider.User)
 			return errors.New("Denied login methods contents mismatch")
 		}
 	}
+	for _, protocol := range expected.Filters.TOTPProtocols {
+		if !utils.IsStringInSlice(protocol, actual.Filters.TOTPProtocols) {
+			return errors.New("TOTP protocols contents mismatch")
+		}
+	}
 	for _, protocol := range expected.Filters.DeniedProtocols {
 		if !utils.IsStringInSlice(protocol, actual.Filters.DeniedProtocols) {
 			return errors.New("Denied protocols contents mismatch")
 		}
 	}
+	if len(expected.Filters.AllowedExecCommands) != len(actual.Filters.AllowedExecCommands) {
+		return errors.New("Allowed exec commands mismatch")
+	}
+	for _, command := range expected.Filters.AllowedExecCommands {
+		if !utils.IsStringInSlice(command, actual.Filters.AllowedExecCommands) {
+			return errors.New("Allowed exec commands contents mismatch")
+		}
+	}
+	if len(expected.Filters.UploadNameAllowedRegex) != len(actual.Filters.UploadNameAllowedRegex) {
+		return errors.New("Upload name allowed regex mismatch")
+	}
+	for _, re := range expected.Filters.UploadNameAllowedRegex {
+		if !utils.IsStringInSlice(re, actual.Filters.UploadNameAllowedRegex) {
+			return errors.New("Upload name allowed regex contents mismatch")
+		}
+	}
+	if len(expected.Filters.UploadNameDeniedRegex) != len(actual.Filters.UploadNameDeniedRegex) {
+		return errors.New("Upload name denied regex mismatch")
+	}
+	for _, re := range expected.Filters.UploadNameDeniedRegex {
+		if !utils.IsStringInSlice(re, actual.Filters.UploadNameDeniedRegex) {
+			return errors.New("Upload name denied regex contents mismatch")
+		}
+	}
+	if expected.Filters.MaxRecursionDepth != actual.Filters.MaxRecursionDepth {
+		return errors.New("Max recursion depth mismatch")
+	}
+	if expected.Filters.MaxRecursionEntries != actual.Filters.MaxRecursionEntries {
+		return errors.New("Max recursion entries mismatch")
+	}
+	if expected.Filters.MaxOpenFiles != actual.Filters.MaxOpenFiles {
+		return errors.New("Max open files mismatch")
+	}
+	if expected.Filters.IdleTimeout != actual.Filters.IdleTimeout {
+		return errors.New("Idle timeout mismatch")
+	}
+	if expected.Filters.MaxConcurrentUploads != actual.Filters.MaxConcurrentUploads {
+		return errors.New("Max concurrent uploads mismatch")
+	}
+	if expected.Filters.MaxConcurrentDownloads != actual.Filters.MaxConcurrentDownloads {
+		return errors.New("Max concurrent downloads mismatch")
+	}
+	if expected.Filters.MaxDownloadFileSize != actual.Filters.MaxDownloadFileSize {
+		return errors.New("Max download file size mismatch")
+	}
+	if len(expected.Filters.DownloadSizeLimits) != len(actual.Filters.DownloadSizeLimits) {
+		return errors.New("Download size limits mismatch")
+	}
+	for _, f := range expected.Filters.DownloadSizeLimits {
+		found := false
+		for _, f1 := range actual.Filters.DownloadSizeLimits {
+			if path.Clean(f.Path) == f1.Path && f.MaxFileSize == f1.MaxFileSize {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("Download size limits contents mismatch")
+		}
+	}
+	if len(expected.Filters.DirectoryFilesLimits) != len(actual.Filters.DirectoryFilesLimits) {
+		return errors.New("Directory files limits mismatch")
+	}
+	for _, f := range expected.Filters.DirectoryFilesLimits {
+		found := false
+		for _, f1 := range actual.Filters.DirectoryFilesLimits {
+			if path.Clean(f.Path) == f1.Path && f.MaxFiles == f1.MaxFiles {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("Directory files limits contents mismatch")
+		}
+	}
+	if err := compareUserUploadDurationFilters(expected, actual); err != nil {
+		return err
+	}
+	if err := compareUserBandwidthSchedules(expected, actual); err != nil {
+		return err
+	}
+	if err := compareUserAccessTimes(expected, actual); err != nil {
+		return err
+	}
+	if expected.Filters.KeepSessionsOnCredentialsChange != actual.Filters.KeepSessionsOnCredentialsChange {
+		return errors.New("Keep sessions on credentials change mismatch")
+	}
+	if expected.Filters.RequireRenameTargetDir != actual.Filters.RequireRenameTargetDir {
+		return errors.New("Require rename target dir mismatch")
+	}
+	if expected.Filters.RequireRenamePermission != actual.Filters.RequireRenamePermission {
+		return errors.New("Require rename permission mismatch")
+	}
+	if len(expected.Filters.AutoCreateDirs) != len(actual.Filters.AutoCreateDirs) {
+		return errors.New("Auto create dirs mismatch")
+	}
+	for _, dir := range expected.Filters.AutoCreateDirs {
+		if !utils.IsStringInSlice(dir, actual.Filters.AutoCreateDirs) {
+			return errors.New("Auto create dirs contents mismatch")
+		}
+	}
+	if err := compareUserQuotaWarningThresholds(expected, actual); err != nil {
+		return err
+	}
+	if len(expected.Filters.DefaultFolderPermissions) != len(actual.Filters.DefaultFolderPermissions) {
+		return errors.New("Default folder permissions mismatch")
+	}
+	for _, p := range expected.Filters.DefaultFolderPermissions {
+		if !utils.IsStringInSlice(p, actual.Filters.DefaultFolderPermissions) {
+			return errors.New("Default folder permissions contents mismatch")
+		}
+	}
 	if err := compareUserFileExtensionsFilters(expected, actual); err != nil {
 		return err
 	}
+	if err := compareUserUploadOrderFilters(expected, actual); err != nil {
+		return err
+	}
+	if err := compareUserPathSchemasFilters(expected, actual); err != nil {
+		return err
+	}
+	if err := compareUserProtocolPermissionsFilters(expected, actual); err != nil {
+		return err
+	}
+	if err := compareUserWriteModesFilters(expected, actual); err != nil {
+		return err
+	}
+	if err := compareUserTextTransformsFilters(expected, actual); err != nil {
+		return err
+	}
 	return compareUserFilePatternsFilters(expected, actual)
 }
 
+// compareUserQuotaWarningThresholds ignores the order and the duplicates, the
+// thresholds are stored sorted and without duplicates
+func compareUserQuotaWarningThresholds(expected *dataprovider.User, actual *dataprovider.User) error {
+	contains := func(thresholds []int, threshold int) bool {
+		for _, t := range thresholds {
+			if t == threshold {
+				return true
+			}
+		}
+		return false
+	}
+	for _, threshold := range expected.Filters.QuotaWarningThresholds {
+		if !contains(actual.Filters.QuotaWarningThresholds, threshold) {
+			return errors.New("Quota warning thresholds mismatch")
+		}
+	}
+	for _, threshold := range actual.Filters.QuotaWarningThresholds {
+		if !contains(expected.Filters.QuotaWarningThresholds, threshold) {
+			return errors.New("Quota warning thresholds mismatch")
+		}
+	}
+	return nil
+}
+
+func compareUserUploadDurationFilters(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.Filters.MaxUploadDuration != actual.Filters.MaxUploadDuration {
+		return errors.New("Max upload duration mismatch")
+	}
+	if expected.Filters.MinUploadRate != actual.Filters.MinUploadRate {
+		return errors.New("Min upload rate mismatch")
+	}
+	if len(expected.Filters.UploadDurationLimits) != len(actual.Filters.UploadDurationLimits) {
+		return errors.New("Upload duration limits mismatch")
+	}
+	for _, f := range expected.Filters.UploadDurationLimits {
+		found := false
+		for _, f1 := range actual.Filters.UploadDurationLimits {
+			if path.Clean(f.Path) == f1.Path && f.MaxDuration == f1.MaxDuration && f.MinRate == f1.MinRate {
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("Upload duration limits contents mismatch")
+		}
+	}
+	return nil
+}
+
+func compareUserBandwidthSchedules(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.BandwidthSchedules) != len(actual.Filters.BandwidthSchedules) {
+		return errors.New("bandwidth schedules mismatch")
+	}
+	for idx, f := range expected.Filters.BandwidthSchedules {
+		f1 := actual.Filters.BandwidthSchedules[idx]
+		if f.UploadBandwidth != f1.UploadBandwidth || f.DownloadBandwidth != f1.DownloadBandwidth {
+			return errors.New("bandwidth schedules limits mismatch")
+		}
+		if len(f.WeekDays) != len(f1.WeekDays) {
+			return errors.New("bandwidth schedules week days mismatch")
+		}
+		for _, day := range f.WeekDays {
+			if !utils.IsIntInSlice(day, f1.WeekDays) {
+				return errors.New("bandwidth schedules week days content mismatch")
+			}
+		}
+	}
+	return nil
+}
+
+func compareUserAccessTimes(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.AccessTimes) != len(actual.Filters.AccessTimes) {
+		return errors.New("access times mismatch")
+	}
+	if expected.Filters.DisconnectOutsideAccessTimes != actual.Filters.DisconnectOutsideAccessTimes {
+		return errors.New("disconnect outside access times mismatch")
+	}
+	for idx, f := range expected.Filters.AccessTimes {
+		f1 := actual.Filters.AccessTimes[idx]
+		if strings.TrimSpace(f.TimeZone) != f1.TimeZone {
+			return errors.New("access times time zone mismatch")
+		}
+		if len(f.WeekDays) != len(f1.WeekDays) {
+			return errors.New("access times week days mismatch")
+		}
+		for _, day := range f.WeekDays {
+			if !utils.IsIntInSlice(day, f1.WeekDays) {
+				return errors.New("access times week days content mismatch")
+			}
+		}
+	}
+	return nil
+}
+
+func compareUserTextTransformsFilters(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.TextTransforms) != len(actual.Filters.TextTransforms) {
+		return errors.New("text transforms mismatch")
+	}
+	for _, f := range expected.Filters.TextTransforms {
+		found := false
+		for _, f1 := range actual.Filters.TextTransforms {
+			if path.Clean(f.Path) == f1.Path {
+				if !checkFilterMatch(f.Extensions, f1.Extensions) || f.LineEndings != f1.LineEndings ||
+					f.StripBOM != f1.StripBOM {
+					return errors.New("text transforms contents mismatch")
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("text transforms contents mismatch")
+		}
+	}
+	return nil
+}
+
+func compareUserWriteModesFilters(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.WriteModes) != len(actual.Filters.WriteModes) {
+		return errors.New("write modes mismatch")
+	}
+	for _, f := range expected.Filters.WriteModes {
+		found := false
+		for _, f1 := range actual.Filters.WriteModes {
+			if path.Clean(f.Path) == path.Clean(f1.Path) {
+				if !checkFilterMatch(f.AppendOnly, f1.AppendOnly) ||
+					!checkFilterMatch(f.OverwriteOnly, f1.OverwriteOnly) {
+					return errors.New("write modes contents mismatch")
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("write modes contents mismatch")
+		}
+	}
+	return nil
+}
+
 func checkFilterMatch(expected []string, actual []string) bool {
 	if len(expected) != len(actual) {
 		return false
@@ -802,6 +1626,92 @@ func compareUserFilePatternsFilters(expected *dataprovider.User, actual *datapro
 	return nil
 }
 
+func compareUserUploadOrderFilters(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.UploadOrder) != len(actual.Filters.UploadOrder) {
+		return errors.New("upload order mismatch")
+	}
+	for _, f := range expected.Filters.UploadOrder {
+		found := false
+		for _, f1 := range actual.Filters.UploadOrder {
+			if path.Clean(f.Path) == path.Clean(f1.Path) {
+				if f.SentinelFile != f1.SentinelFile || len(f.RequiredFiles) != len(f1.RequiredFiles) {
+					return errors.New("upload order contents mismatch")
+				}
+				for _, name := range f.RequiredFiles {
+					if !utils.IsStringInSlice(name, f1.RequiredFiles) {
+						return errors.New("upload order contents mismatch")
+					}
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("upload order contents mismatch")
+		}
+	}
+	return nil
+}
+
+func compareUserProtocolPermissionsFilters(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.ProtocolPermissions) != len(actual.Filters.ProtocolPermissions) {
+		return errors.New("protocol permissions mismatch")
+	}
+	for _, f := range expected.Filters.ProtocolPermissions {
+		found := false
+		for _, f1 := range actual.Filters.ProtocolPermissions {
+			if f.Protocol == f1.Protocol {
+				if len(f.Permissions) != len(f1.Permissions) {
+					return errors.New("protocol permissions contents mismatch")
+				}
+				for dir, perms := range f.Permissions {
+					if actualPerms, ok := f1.Permissions[dir]; ok {
+						for _, v := range actualPerms {
+							if !utils.IsStringInSlice(v, perms) {
+								return errors.New("protocol permissions contents mismatch")
+							}
+						}
+					} else {
+						return errors.New("protocol permissions directories mismatch")
+					}
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("protocol permissions contents mismatch")
+		}
+	}
+	return nil
+}
+
+func compareUserPathSchemasFilters(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.PathSchemas) != len(actual.Filters.PathSchemas) {
+		return errors.New("path schemas mismatch")
+	}
+	for _, f := range expected.Filters.PathSchemas {
+		found := false
+		for _, f1 := range actual.Filters.PathSchemas {
+			if path.Clean(f.Path) == path.Clean(f1.Path) {
+				if strings.Trim(f.Schema, "/") != f1.Schema || len(f.Variables) != len(f1.Variables) {
+					return errors.New("path schemas contents mismatch")
+				}
+				for name, values := range f.Variables {
+					for _, value := range values {
+						if !utils.IsStringInSlice(value, f1.Variables[name]) {
+							return errors.New("path schemas contents mismatch")
+						}
+					}
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("path schemas contents mismatch")
+		}
+	}
+	return nil
+}
+
 func compareUserFileExtensionsFilters(expected *dataprovider.User, actual *dataprovider.User) error {
 	if len(expected.Filters.FileExtensions) != len(actual.Filters.FileExtensions) {
 		return errors.New("file extensions mismatch")
@@ -861,9 +1771,32 @@ func compareEqualsUserFields(expected *dataprovider.User, actual *dataprovider.U
 	if expected.ExpirationDate != actual.ExpirationDate {
 		return errors.New("ExpirationDate mismatch")
 	}
+	if !compareMetadata(expected.Metadata, actual.Metadata) {
+		return errors.New("Metadata mismatch")
+	}
+	if len(expected.Groups) != len(actual.Groups) {
+		return errors.New("Groups mismatch")
+	}
+	for idx, name := range expected.Groups {
+		if actual.Groups[idx] != name {
+			return errors.New("Groups mismatch")
+		}
+	}
 	return nil
 }
 
+func compareMetadata(expected, actual map[string]string) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+	for k, v := range expected {
+		if val, ok := actual[k]; !ok || val != v {
+			return false
+		}
+	}
+	return true
+}
+
 func addLimitAndOffsetQueryParams(rawurl string, limit, offset int64) (*url.URL, error) {
 	url, err := url.Parse(rawurl)
 	if err != nil {
@@ -880,6 +1813,20 @@ func addLimitAndOffsetQueryParams(rawurl string, limit, offset int64) (*url.URL,
 	return url, err
 }
 
+func addSignedURLQueryParams(rawurl, virtualPath string, expires int) (*url.URL, error) {
+	url, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Query()
+	q.Add("path", virtualPath)
+	if expires != 0 {
+		q.Add("expires", strconv.Itoa(expires))
+	}
+	url.RawQuery = q.Encode()
+	return url, err
+}
+
 func addModeQueryParam(rawurl, mode string) (*url.URL, error) {
 	url, err := url.Parse(rawurl)
 	if err != nil {
@@ -0,0 +1,298 @@
+package httpd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/httpclient"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	auditObjectUser          = "user"
+	auditObjectDeletedUser   = "deleted_user"
+	auditObjectFolder        = "folder"
+	auditObjectGroup         = "group"
+	auditObjectProvider      = "provider"
+	auditActionAdd           = "add"
+	auditActionUpdate        = "update"
+	auditActionDelete        = "delete"
+	auditActionRestore       = "restore"
+	auditActionPurge         = "purge"
+	auditActionResetLockout  = "reset_lockout"
+	auditActionLoadData      = "loaddata"
+	auditActionImportUsers   = "import_users"
+	auditActionRotateSecrets = "rotate_secrets"
+	auditRedactedValue       = "[redacted]"
+)
+
+var (
+	auditLog      AuditLogConfig
+	auditLogFile  *os.File
+	auditLogMutex sync.Mutex
+	// the values for these fields are never included in the audit events,
+	// only the fact that they are changed. The secrets stored as vfs.Secret are
+	// covered by payload, key and additional_data, the other fields are the
+	// credentials stored as plain strings
+	auditRedactedFields = []string{"password", "payload", "key", "additional_data", "hash", "sas_url", "external_id"}
+)
+
+// AuditLogConfig defines the audit log for the changes made using the REST API and
+// the web admin. Read operations are not logged
+type AuditLogConfig struct {
+	// Set to true to enable the audit log
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Path to a file where the audit events are appended as JSON lines, SFTPGo never
+	// rotates or truncates it. This can be an absolute path or a path relative to the
+	// config dir. Empty means that the audit events are written to the main log
+	LogFile string `json:"log_file" mapstructure:"log_file"`
+	// HTTP URL to notify, each audit event is sent as JSON using a POST request.
+	// The retry queue configured inside the "http" section is used for failed notifications
+	Hook string `json:"hook" mapstructure:"hook"`
+}
+
+func (c *AuditLogConfig) validate() error {
+	if c.Hook == "" {
+		return nil
+	}
+	u, err := url.Parse(c.Hook)
+	if err != nil {
+		return fmt.Errorf("invalid audit log hook %#v: %v", c.Hook, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid audit log hook %#v: only http and https URLs are supported", c.Hook)
+	}
+	return nil
+}
+
+type auditChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type auditEvent struct {
+	// unix timestamp in milliseconds
+	Timestamp  int64         `json:"timestamp"`
+	Admin      string        `json:"admin"`
+	IP         string        `json:"ip"`
+	RequestID  string        `json:"request_id,omitempty"`
+	Action     string        `json:"action"`
+	ObjectType string        `json:"object_type"`
+	ObjectName string        `json:"object_name"`
+	Changes    []auditChange `json:"changes,omitempty"`
+}
+
+func initializeAuditLog(c AuditLogConfig, configDir string) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+
+	if auditLogFile != nil {
+		auditLogFile.Close()
+		auditLogFile = nil
+	}
+	auditLog = c
+	if !c.Enabled {
+		return nil
+	}
+	logFile := getConfigPath(c.LogFile, configDir)
+	if logFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open the audit log file %#v: %v", logFile, err)
+	}
+	auditLogFile = f
+	return nil
+}
+
+// getAuditSnapshot returns the given object as a flat map, the keys are the JSON field
+// paths separated by dots. It returns nil if the audit log is disabled
+func getAuditSnapshot(object interface{}) map[string]interface{} {
+	if !auditLog.Enabled {
+		return nil
+	}
+	asJSON, err := json.Marshal(object)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the audit snapshot: %v", err)
+		return nil
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(asJSON, &values); err != nil {
+		logger.Warn(logSender, "", "unable to get the audit snapshot: %v", err)
+		return nil
+	}
+	snapshot := make(map[string]interface{})
+	flattenAuditValues("", values, snapshot)
+	return snapshot
+}
+
+func getUserAuditSnapshot(username string) map[string]interface{} {
+	if !auditLog.Enabled {
+		return nil
+	}
+	user, err := dataprovider.UserExists(username)
+	if err != nil {
+		return nil
+	}
+	return getAuditSnapshot(user)
+}
+
+func getGroupAuditSnapshot(name string) map[string]interface{} {
+	if !auditLog.Enabled {
+		return nil
+	}
+	group, err := dataprovider.GroupExists(name)
+	if err != nil {
+		return nil
+	}
+	return getAuditSnapshot(group)
+}
+
+func getFolderAuditSnapshot(mappedPath string) map[string]interface{} {
+	if !auditLog.Enabled {
+		return nil
+	}
+	folder, err := dataprovider.GetFolderByPath(mappedPath)
+	if err != nil {
+		return nil
+	}
+	return getAuditSnapshot(folder)
+}
+
+func flattenAuditValues(prefix string, value interface{}, result map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			flattenAuditValues(joinAuditField(prefix, key), val, result)
+		}
+	case []interface{}:
+		// arrays of objects, such as the virtual folders, are flattened using the indexes
+		for _, item := range v {
+			if _, ok := item.(map[string]interface{}); ok {
+				for idx, val := range v {
+					flattenAuditValues(joinAuditField(prefix, fmt.Sprintf("%d", idx)), val, result)
+				}
+				return
+			}
+		}
+		result[prefix] = v
+	default:
+		result[prefix] = v
+	}
+}
+
+func joinAuditField(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func isAuditFieldRedacted(field string) bool {
+	return utils.IsStringInSlice(field[strings.LastIndex(field, ".")+1:], auditRedactedFields)
+}
+
+// getAuditChanges returns the differences between the given snapshots,
+// the confidential values are redacted
+func getAuditChanges(before, after map[string]interface{}) []auditChange {
+	var changes []auditChange
+	fields := make(map[string]bool)
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+	for field := range fields {
+		beforeValue, beforeOk := before[field]
+		afterValue, afterOk := after[field]
+		if beforeOk == afterOk && reflect.DeepEqual(beforeValue, afterValue) {
+			continue
+		}
+		if isAuditFieldRedacted(field) {
+			if beforeOk && beforeValue != nil && beforeValue != "" {
+				beforeValue = auditRedactedValue
+			}
+			if afterOk && afterValue != nil && afterValue != "" {
+				afterValue = auditRedactedValue
+			}
+		}
+		changes = append(changes, auditChange{
+			Field:  field,
+			Before: beforeValue,
+			After:  afterValue,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes
+}
+
+// auditAction records a change made by an administrator, before and after are the snapshots of the
+// changed object, they can be nil for added/deleted objects and for bulk actions
+func auditAction(r *http.Request, action, objectType, objectName string, before, after map[string]interface{}) {
+	if !auditLog.Enabled {
+		return
+	}
+	admin := ""
+	if httpAuth != nil && httpAuth.isEnabled() {
+		admin, _, _ = r.BasicAuth()
+	}
+	event := auditEvent{
+		Timestamp:  utils.GetTimeAsMsSinceEpoch(time.Now()),
+		Admin:      admin,
+		IP:         utils.GetIPFromRemoteAddress(r.RemoteAddr),
+		RequestID:  middleware.GetReqID(r.Context()),
+		Action:     action,
+		ObjectType: objectType,
+		ObjectName: objectName,
+		Changes:    getAuditChanges(before, after),
+	}
+	writeAuditEvent(&event)
+}
+
+func writeAuditEvent(event *auditEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to marshal the audit event: %v", err)
+		return
+	}
+	auditLogMutex.Lock()
+	if auditLogFile != nil {
+		if _, err := auditLogFile.Write(append(data, '\n')); err != nil {
+			logger.Error(logSender, "", "unable to write the audit event to file: %v", err)
+		}
+	} else {
+		logger.AuditLog(event.Admin, event.IP, event.RequestID, event.Action, event.ObjectType, event.ObjectName,
+			event.Changes)
+	}
+	auditLogMutex.Unlock()
+
+	if auditLog.Hook != "" {
+		go func(hook string) {
+			respCode, err := httpclient.PostJSON(logSender, hook, data)
+			if err != nil {
+				logger.Warn(logSender, "", "unable to notify the audit event to %#v, response code: %v, err: %v",
+					hook, respCode, err)
+			}
+		}(auditLog.Hook)
+	}
+}
@@ -24,14 +24,20 @@ const (
 	logSender                 = "httpd"
 	apiPrefix                 = "/api/v1"
 	activeConnectionsPath     = "/api/v1/connection"
+	connectionEventsPath      = "/api/v1/connection_events"
 	quotaScanPath             = "/api/v1/quota_scan"
 	quotaScanVFolderPath      = "/api/v1/folder_quota_scan"
 	userPath                  = "/api/v1/user"
 	versionPath               = "/api/v1/version"
 	folderPath                = "/api/v1/folder"
+	groupPath                 = "/api/v1/group"
+	deletedUserPath           = "/api/v1/deleted_user"
 	providerStatusPath        = "/api/v1/providerstatus"
 	dumpDataPath              = "/api/v1/dumpdata"
 	loadDataPath              = "/api/v1/loaddata"
+	importUsersPath           = "/api/v1/import_users"
+	scheduledBackupPath       = "/api/v1/scheduled_backup"
+	secretsRotationPath       = "/api/v1/secrets_rotation"
 	updateUsedQuotaPath       = "/api/v1/quota_update"
 	updateFolderUsedQuotaPath = "/api/v1/folder_quota_update"
 	metricsPath               = "/metrics"
@@ -44,8 +50,9 @@ const (
 	webFolderPath             = "/web/folder"
 	webStaticFilesPath        = "/static"
 	// MaxRestoreSize defines the max size for the loaddata input file
-	MaxRestoreSize = 10485760 // 10 MB
-	maxRequestSize = 1048576  // 1MB
+	MaxRestoreSize        = 10485760 // 10 MB
+	maxRequestSize        = 1048576  // 1MB
+	maxRestoreConcurrency = 10
 )
 
 var (
@@ -80,6 +87,14 @@ type Conf struct {
 	// "paramchange" request to the running service on Windows.
 	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
 	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+	// If enabled the REST API error responses use a JSON envelope with a stable error code,
+	// a human readable message and optional field level validation details.
+	// Disabled by default for backward compatibility
+	StructuredErrors bool `json:"structured_errors" mapstructure:"structured_errors"`
+	// Periodic full backups of the data provider
+	ScheduledBackups ScheduledBackupsConfig `json:"scheduled_backups" mapstructure:"scheduled_backups"`
+	// Audit log for the users, folders and groups changes
+	AuditLog AuditLogConfig `json:"audit_log" mapstructure:"audit_log"`
 }
 
 type apiResponse struct {
@@ -87,6 +102,10 @@ type apiResponse struct {
 	Message string `json:"message"`
 }
 
+type totpEnableRequest struct {
+	Code string `json:"code"`
+}
+
 // Initialize configures and starts the HTTP server
 func (c Conf) Initialize(configDir string, enableProfiler bool) error {
 	var err error
@@ -102,6 +121,15 @@ func (c Conf) Initialize(configDir string, enableProfiler bool) error {
 		return fmt.Errorf("Required directory is invalid, static file path: %#v template path: %#v",
 			staticFilesPath, templatesPath)
 	}
+	structuredErrors = c.StructuredErrors
+	if err = c.ScheduledBackups.validate(); err != nil {
+		return err
+	}
+	scheduledBackups = c.ScheduledBackups
+	scheduledBackupsDir = scheduledBackups.getOutputDir()
+	if err = initializeAuditLog(c.AuditLog, configDir); err != nil {
+		return err
+	}
 	authUserFile := getConfigPath(c.AuthUserFile, configDir)
 	httpAuth, err = newBasicAuthProvider(authUserFile)
 	if err != nil {
@@ -115,6 +143,7 @@ func (c Conf) Initialize(configDir string, enableProfiler bool) error {
 		logger.Info(logSender, "", "built-in web interface disabled, please set templates_path and static_files_path to enable it")
 	}
 	initializeRouter(staticFilesPath, enableProfiler, enableWebAdmin)
+	startScheduledBackups()
 	httpServer := &http.Server{
 		Addr:           fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort),
 		Handler:        router,
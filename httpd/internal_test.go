@@ -1,10 +1,15 @@
 package httpd
 
 import (
+	"bytes"
 	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -13,6 +18,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/stretchr/testify/assert"
@@ -38,6 +44,49 @@ func TestGetRespStatus(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, respStatus)
 }
 
+func TestStructuredErrors(t *testing.T) {
+	assert.Equal(t, errCodeValidationFailed, getErrorCode(&dataprovider.ValidationError{}, http.StatusBadRequest))
+	assert.Equal(t, errCodeNotFound, getErrorCode(&dataprovider.RecordNotFoundError{}, http.StatusNotFound))
+	assert.Equal(t, errCodeBadRequest, getErrorCode(nil, http.StatusRequestEntityTooLarge))
+	assert.Equal(t, errCodeInternalError, getErrorCode(nil, http.StatusServiceUnavailable))
+
+	structuredErrors = true
+	defer func() {
+		structuredErrors = false
+	}()
+
+	req, _ := http.NewRequest(http.MethodPost, userPath, bytes.NewBuffer([]byte(`{"home_dir":"/tmp"}`)))
+	rr := httptest.NewRecorder()
+	addUser(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var resp apiErrorResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, errCodeValidationFailed, resp.Error.Code)
+	assert.Contains(t, resp.Error.Message, "username is mandatory")
+	if assert.Len(t, resp.Error.Details, 1) {
+		assert.Equal(t, "username", resp.Error.Details[0].Field)
+		assert.Equal(t, "username is mandatory", resp.Error.Details[0].Message)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, userPath+"/0", nil)
+	rr = httptest.NewRecorder()
+	sendAPIResponse(rr, req, nil, "Not Found", http.StatusNotFound)
+	resp = apiErrorResponse{}
+	err = json.Unmarshal(rr.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, errCodeNotFound, resp.Error.Code)
+	assert.Equal(t, "Not Found", resp.Error.Message)
+	assert.Empty(t, resp.Error.Details)
+	// successful responses are not affected
+	rr = httptest.NewRecorder()
+	sendAPIResponse(rr, req, nil, "OK", http.StatusOK)
+	var okResp apiResponse
+	err = json.Unmarshal(rr.Body.Bytes(), &okResp)
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", okResp.Message)
+}
+
 func TestCheckResponse(t *testing.T) {
 	err := checkResponse(http.StatusOK, http.StatusCreated)
 	assert.Error(t, err)
@@ -644,3 +693,348 @@ func TestQuotaScanInvalidFs(t *testing.T) {
 	err := doQuotaScan(user)
 	assert.Error(t, err)
 }
+
+func TestTransientNetworkErrors(t *testing.T) {
+	assert.False(t, utils.IsTransientNetworkError(nil))
+	assert.False(t, utils.IsTransientNetworkError(errors.New("generic error")))
+	assert.False(t, utils.IsTransientNetworkError(dataprovider.ErrInvalidCredentials))
+	_, err := net.Dial("tcp", strings.TrimPrefix(inactiveURL, "http://"))
+	if assert.Error(t, err) {
+		assert.True(t, utils.IsTransientNetworkError(err))
+	}
+	assert.True(t, utils.IsTransientNetworkError(fmt.Errorf("query failed: %w", driver.ErrBadConn)))
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	assert.True(t, utils.IsTransientNetworkError(ctx.Err()))
+	_, err = (&net.Dialer{Timeout: 1}).Dial("tcp", "127.0.0.1:8080")
+	if assert.Error(t, err) {
+		assert.True(t, utils.IsTransientNetworkError(err))
+	}
+}
+
+func TestScheduledBackupsEncryption(t *testing.T) {
+	data := []byte(`{"users":[],"folders":[],"groups":[],"version":5}`)
+	encrypted, err := encryptBackupData(data, "passphrase")
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(encrypted, []byte(encryptedBackupMagic)))
+	decrypted, err := DecryptBackupData(encrypted, "passphrase")
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+	_, err = DecryptBackupData(encrypted, "wrong passphrase")
+	assert.Error(t, err)
+	_, err = DecryptBackupData(encrypted, "")
+	assert.Error(t, err)
+	_, err = DecryptBackupData(encrypted[:encryptedBackupHeaderSize-1], "passphrase")
+	assert.Error(t, err)
+	encrypted[len(encryptedBackupMagic)] = 0x20
+	_, err = DecryptBackupData(encrypted, "passphrase")
+	assert.Error(t, err)
+	// not encrypted data are returned unchanged
+	decrypted, err = DecryptBackupData(data, "passphrase")
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+}
+
+func TestScheduledBackupsRetention(t *testing.T) {
+	conf := ScheduledBackupsConfig{
+		Interval: -1,
+	}
+	assert.Error(t, conf.validate())
+	conf.Interval = 0
+	conf.KeepDays = -1
+	assert.Error(t, conf.validate())
+	conf.KeepDays = 0
+	assert.NoError(t, conf.validate())
+
+	savedConf := scheduledBackups
+	savedDir := scheduledBackupsDir
+	defer func() {
+		scheduledBackups = savedConf
+		scheduledBackupsDir = savedDir
+	}()
+
+	scheduledBackups = ScheduledBackupsConfig{
+		OutputDir:  filepath.Join(os.TempDir(), "scheduled_backups_test"),
+		KeepLast:   2,
+		Passphrase: "secret",
+	}
+	scheduledBackupsDir = scheduledBackups.getOutputDir()
+	assert.Equal(t, scheduledBackups.OutputDir, scheduledBackupsDir)
+	now := time.Now().UTC()
+	var backups []string
+	for i := 4; i > 0; i-- {
+		outputFile, err := writeScheduledBackup(now.Add(-time.Duration(i)*24*time.Hour + time.Hour))
+		assert.NoError(t, err)
+		assert.True(t, strings.HasSuffix(outputFile, ".json.enc"))
+		backups = append(backups, outputFile)
+	}
+	content, err := ioutil.ReadFile(backups[0])
+	assert.NoError(t, err)
+	content, err = DecryptBackupData(content, scheduledBackups.Passphrase)
+	assert.NoError(t, err)
+	_, err = dataprovider.ParseDumpData(content)
+	assert.NoError(t, err)
+	// other files must be preserved
+	otherFile := filepath.Join(scheduledBackupsDir, "manual_backup.json")
+	err = ioutil.WriteFile(otherFile, []byte("{}"), os.ModePerm)
+	assert.NoError(t, err)
+
+	removeExpiredScheduledBackups(now)
+	assert.NoFileExists(t, backups[0])
+	assert.NoFileExists(t, backups[1])
+	assert.FileExists(t, backups[2])
+	assert.FileExists(t, backups[3])
+	assert.FileExists(t, otherFile)
+
+	scheduledBackups.KeepLast = 0
+	scheduledBackups.KeepDays = 1
+	removeExpiredScheduledBackups(now)
+	assert.NoFileExists(t, backups[2])
+	assert.FileExists(t, backups[3])
+
+	outputFile, err := executeScheduledBackup()
+	assert.NoError(t, err)
+	assert.FileExists(t, outputFile)
+	list, err := getScheduledBackups()
+	assert.NoError(t, err)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, outputFile, list[0].path)
+		assert.Equal(t, backups[3], list[1].path)
+	}
+
+	scheduledBackups.OutputDir = "relative"
+	assert.Equal(t, filepath.Join(backupsPath, "relative"), scheduledBackups.getOutputDir())
+	scheduledBackups.OutputDir = ""
+	assert.Equal(t, backupsPath, scheduledBackups.getOutputDir())
+
+	scheduledBackups.Interval = 1
+	startScheduledBackups()
+	assert.NotNil(t, scheduledBackupsTicker)
+	stopScheduledBackups()
+	assert.Nil(t, scheduledBackupsTicker)
+
+	err = os.RemoveAll(scheduledBackupsDir)
+	assert.NoError(t, err)
+}
+
+func TestAuditLogChanges(t *testing.T) {
+	auditLog.Enabled = true
+	defer func() {
+		auditLog.Enabled = false
+	}()
+
+	before := dataprovider.User{
+		Username: "audit_user",
+		Password: "hashed",
+		HomeDir:  filepath.Join(os.TempDir(), "audit_user"),
+		Permissions: map[string][]string{
+			"/": {dataprovider.PermAny},
+		},
+		QuotaSize: 100,
+	}
+	before.FsConfig.Provider = dataprovider.S3FilesystemProvider
+	before.FsConfig.S3Config.AccessKey = "access key"
+	before.FsConfig.S3Config.AccessSecret = vfs.Secret{
+		Status:  vfs.SecretStatusAES256GCM,
+		Payload: "payload",
+		Key:     "key",
+	}
+	after := before
+	after.Password = "changed"
+	after.QuotaSize = 200
+	after.Permissions = map[string][]string{
+		"/":    {dataprovider.PermAny},
+		"/sub": {dataprovider.PermListItems},
+	}
+	after.FsConfig.S3Config.AccessSecret = vfs.Secret{
+		Status:  vfs.SecretStatusAES256GCM,
+		Payload: "new payload",
+		Key:     "new key",
+	}
+	after.VirtualFolders = []vfs.VirtualFolder{
+		{
+			BaseVirtualFolder: vfs.BaseVirtualFolder{
+				MappedPath: filepath.Join(os.TempDir(), "mapped"),
+			},
+			VirtualPath: "/vdir",
+		},
+	}
+	changes := getAuditChanges(getAuditSnapshot(before), getAuditSnapshot(after))
+	fields := make(map[string]auditChange)
+	for _, c := range changes {
+		fields[c.Field] = c
+	}
+	assert.Len(t, fields, len(changes))
+	if assert.Contains(t, fields, "password") {
+		assert.Equal(t, auditRedactedValue, fields["password"].Before)
+		assert.Equal(t, auditRedactedValue, fields["password"].After)
+	}
+	if assert.Contains(t, fields, "quota_size") {
+		assert.Equal(t, float64(100), fields["quota_size"].Before)
+		assert.Equal(t, float64(200), fields["quota_size"].After)
+	}
+	if assert.Contains(t, fields, "permissions./sub") {
+		assert.Nil(t, fields["permissions./sub"].Before)
+		assert.Equal(t, []interface{}{dataprovider.PermListItems}, fields["permissions./sub"].After)
+	}
+	assert.Contains(t, fields, "filesystem.s3config.access_secret.payload")
+	assert.Contains(t, fields, "filesystem.s3config.access_secret.key")
+	assert.Contains(t, fields, "virtual_folders.0.virtual_path")
+	assert.NotContains(t, fields, "username")
+	assert.NotContains(t, fields, "filesystem.s3config.access_key")
+	for _, c := range changes {
+		assert.NotEqual(t, "payload", c.Before)
+		assert.NotEqual(t, "new payload", c.After)
+		assert.NotEqual(t, "changed", c.After)
+	}
+	// added objects
+	changes = getAuditChanges(nil, getAuditSnapshot(after))
+	for _, c := range changes {
+		assert.Nil(t, c.Before)
+		if c.Field == "filesystem.s3config.access_secret.payload" {
+			assert.Equal(t, auditRedactedValue, c.After)
+		}
+	}
+	assert.Empty(t, getAuditChanges(getAuditSnapshot(after), getAuditSnapshot(after)))
+	// the credentials stored as plain strings are redacted too
+	before.FsConfig = dataprovider.Filesystem{
+		Provider: dataprovider.AzureBlobFilesystemProvider,
+		AzBlobConfig: vfs.AzBlobFsConfig{
+			Container: "container",
+			SASURL:    "https://myaccount.blob.core.windows.net/?sv=2020-02-10&sig=oldsignature",
+		},
+	}
+	after = before
+	after.FsConfig.AzBlobConfig.SASURL = "https://myaccount.blob.core.windows.net/?sv=2020-02-10&sig=newsignature"
+	changes = getAuditChanges(getAuditSnapshot(before), getAuditSnapshot(after))
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, "filesystem.azblobconfig.sas_url", changes[0].Field)
+		assert.Equal(t, auditRedactedValue, changes[0].Before)
+		assert.Equal(t, auditRedactedValue, changes[0].After)
+	}
+	before.FsConfig = dataprovider.Filesystem{
+		Provider: dataprovider.S3FilesystemProvider,
+		S3Config: vfs.S3FsConfig{
+			Bucket:     "bucket",
+			RoleARN:    "arn:aws:iam::123456789012:role/sftpgo",
+			ExternalID: "old external id",
+		},
+	}
+	after = before
+	after.FsConfig.S3Config.ExternalID = "new external id"
+	changes = getAuditChanges(getAuditSnapshot(before), getAuditSnapshot(after))
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, "filesystem.s3config.external_id", changes[0].Field)
+		assert.Equal(t, auditRedactedValue, changes[0].Before)
+		assert.Equal(t, auditRedactedValue, changes[0].After)
+	}
+
+	auditLog.Enabled = false
+	assert.Nil(t, getAuditSnapshot(after))
+}
+
+func TestBulkActionsAuditSnapshot(t *testing.T) {
+	summaries := []*restoreSummary{{kind: "group"}, {kind: "user"}}
+	summaries[1].add("user2", nil)
+	summaries[1].add("user1", nil)
+	summaries[1].add("user3", errors.New("restore error"))
+	assert.Nil(t, getRestoreAuditSnapshot(summaries))
+
+	auditLog.Enabled = true
+	defer func() {
+		auditLog.Enabled = false
+	}()
+
+	changes := getAuditChanges(nil, getRestoreAuditSnapshot(summaries))
+	if assert.Len(t, changes, 2) {
+		assert.Equal(t, "users.failed", changes[0].Field)
+		assert.Equal(t, []string{"user3"}, changes[0].After)
+		assert.Equal(t, "users.restored", changes[1].Field)
+		assert.Equal(t, []string{"user1", "user2"}, changes[1].After)
+	}
+	changes = getAuditChanges(nil, getAuditSnapshot(dataprovider.SecretsRotationResult{
+		Users:        2,
+		DeletedUsers: 1,
+		Secrets:      4,
+	}))
+	fields := make(map[string]interface{})
+	for _, c := range changes {
+		fields[c.Field] = c.After
+	}
+	assert.Equal(t, float64(2), fields["users"])
+	assert.Equal(t, float64(1), fields["deleted_users"])
+	assert.Equal(t, float64(0), fields["groups"])
+	assert.Equal(t, float64(4), fields["secrets"])
+}
+
+func TestAuditLog(t *testing.T) {
+	err := initializeAuditLog(AuditLogConfig{Enabled: true, Hook: "ftp://127.0.0.1"}, os.TempDir())
+	assert.Error(t, err)
+	err = initializeAuditLog(AuditLogConfig{Enabled: true, Hook: "http://local host"}, os.TempDir())
+	assert.Error(t, err)
+	err = initializeAuditLog(AuditLogConfig{Enabled: true, LogFile: filepath.Join(os.TempDir(), "missing", "audit.log")},
+		os.TempDir())
+	assert.Error(t, err)
+
+	hookEvents := make(chan auditEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event auditEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			hookEvents <- event
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	logFile := "audit_test.log"
+	err = initializeAuditLog(AuditLogConfig{
+		Enabled: true,
+		LogFile: logFile,
+		Hook:    server.URL,
+	}, os.TempDir())
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodDelete, folderPath, nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	folder := vfs.BaseVirtualFolder{
+		MappedPath: filepath.Join(os.TempDir(), "audit_folder"),
+	}
+	auditAction(req, auditActionDelete, auditObjectFolder, folder.MappedPath, getAuditSnapshot(folder), nil)
+
+	select {
+	case event := <-hookEvents:
+		assert.Equal(t, auditActionDelete, event.Action)
+		assert.Equal(t, auditObjectFolder, event.ObjectType)
+		assert.Equal(t, folder.MappedPath, event.ObjectName)
+		assert.Equal(t, "10.1.2.3", event.IP)
+		assert.NotEmpty(t, event.Changes)
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "audit event not notified")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(os.TempDir(), logFile))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if assert.Len(t, lines, 1) {
+		var event auditEvent
+		err = json.Unmarshal([]byte(lines[0]), &event)
+		assert.NoError(t, err)
+		assert.Equal(t, auditActionDelete, event.Action)
+		assert.Greater(t, event.Timestamp, int64(0))
+		for _, c := range event.Changes {
+			assert.Nil(t, c.After)
+		}
+	}
+
+	err = initializeAuditLog(AuditLogConfig{}, os.TempDir())
+	assert.NoError(t, err)
+	assert.Nil(t, auditLogFile)
+	// the audit log is disabled, nothing is written
+	auditAction(req, auditActionDelete, auditObjectFolder, folder.MappedPath, nil, nil)
+	content, err = ioutil.ReadFile(filepath.Join(os.TempDir(), logFile))
+	assert.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(content)), "\n"), 1)
+
+	err = os.Remove(filepath.Join(os.TempDir(), logFile))
+	assert.NoError(t, err)
+}
@@ -80,6 +80,7 @@ func initializeRouter(staticFilesPath string, enableProfiler, enableWebAdmin boo
 			})
 
 			router.Delete(activeConnectionsPath+"/{connectionID}", handleCloseConnection)
+			router.Get(connectionEventsPath, streamConnectionEvents)
 			router.Get(quotaScanPath, getQuotaScans)
 			router.Post(quotaScanPath, startQuotaScan)
 			router.Get(quotaScanVFolderPath, getVFolderQuotaScans)
@@ -89,11 +90,31 @@ func initializeRouter(staticFilesPath string, enableProfiler, enableWebAdmin boo
 			router.Get(userPath+"/{userID}", getUserByID)
 			router.Put(userPath+"/{userID}", updateUser)
 			router.Delete(userPath+"/{userID}", deleteUser)
+			router.Post(userPath+"/{userID}/disconnect", disconnectUserSessions)
+			router.Get(userPath+"/{userID}/lockout", getUserLoginLockout)
+			router.Delete(userPath+"/{userID}/lockout", resetUserLoginLockout)
+			router.Post(userPath+"/{userID}/totp/generate", generateUserTOTP)
+			router.Post(userPath+"/{userID}/totp/enable", enableUserTOTP)
+			router.Post(userPath+"/{userID}/totp/disable", disableUserTOTP)
+			router.Get(userPath+"/{userID}/signed_url", getUserSignedURL)
+			router.Get(userPath+"/{userID}/checksum", getUserFileChecksum)
 			router.Get(folderPath, getFolders)
 			router.Post(folderPath, addFolder)
 			router.Delete(folderPath, deleteFolderByPath)
+			router.Get(groupPath, getGroups)
+			router.Post(groupPath, addGroup)
+			router.Get(groupPath+"/{groupID}", getGroupByID)
+			router.Put(groupPath+"/{groupID}", updateGroup)
+			router.Delete(groupPath+"/{groupID}", deleteGroup)
+			router.Get(deletedUserPath, getDeletedUsers)
+			router.Get(deletedUserPath+"/{username}", getDeletedUserByUsername)
+			router.Post(deletedUserPath+"/{username}/restore", restoreDeletedUser)
+			router.Delete(deletedUserPath+"/{username}", purgeDeletedUser)
 			router.Get(dumpDataPath, dumpData)
 			router.Get(loadDataPath, loadData)
+			router.Post(importUsersPath, importUsers)
+			router.Post(scheduledBackupPath, runScheduledBackup)
+			router.Post(secretsRotationPath, rotateSecrets)
 			router.Put(updateUsedQuotaPath, updateUserQuotaUsage)
 			router.Put(updateFolderUsedQuotaPath, updateVFolderQuotaUsage)
 			if enableWebAdmin {
@@ -0,0 +1,308 @@
+package httpd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/minio/sio"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	scheduledBackupPrefix   = "scheduled_backup_"
+	scheduledBackupExt      = ".json"
+	encryptedBackupExt      = ".enc"
+	scheduledBackupTSFormat = "20060102T150405.000"
+	// magic bytes + version byte + random nonce
+	encryptedBackupMagic      = "SFTPGOBK"
+	encryptedBackupVersion10  = byte(0x10)
+	encryptedBackupNonceLen   = 32
+	encryptedBackupHeaderSize = len(encryptedBackupMagic) + 1 + encryptedBackupNonceLen
+)
+
+var (
+	scheduledBackups       ScheduledBackupsConfig
+	scheduledBackupsDir    string
+	scheduledBackupsMutex  sync.Mutex
+	scheduledBackupsTicker *time.Ticker
+	scheduledBackupsDone   chan bool
+)
+
+// ScheduledBackupsConfig defines the configuration for the scheduled data provider backups.
+// A backup is a full dump, the same generated by the dumpdata REST API, saved to a local directory
+type ScheduledBackupsConfig struct {
+	// Interval, as hours, between two backups. 0 means disabled.
+	// The backups can also be generated on demand using the REST API
+	Interval int `json:"interval" mapstructure:"interval"`
+	// Directory for the backup files. This can be an absolute path or a path relative
+	// to the backups path. Empty means the backups path
+	OutputDir string `json:"output_dir" mapstructure:"output_dir"`
+	// Number of scheduled backups to keep. 0 means no limit
+	KeepLast int `json:"keep_last" mapstructure:"keep_last"`
+	// Scheduled backups older than this number of days are removed. 0 means no limit
+	KeepDays int `json:"keep_days" mapstructure:"keep_days"`
+	// If not empty the backups are encrypted using a key derived from this passphrase.
+	// The same passphrase is required to restore them
+	Passphrase string `json:"passphrase" mapstructure:"passphrase"`
+}
+
+func (c *ScheduledBackupsConfig) validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid scheduled backups interval: %v", c.Interval)
+	}
+	if c.KeepLast < 0 || c.KeepDays < 0 {
+		return fmt.Errorf("invalid scheduled backups retention, keep last: %v, keep days: %v", c.KeepLast, c.KeepDays)
+	}
+	return nil
+}
+
+func (c *ScheduledBackupsConfig) getOutputDir() string {
+	if c.OutputDir == "" {
+		return backupsPath
+	}
+	if filepath.IsAbs(c.OutputDir) {
+		return c.OutputDir
+	}
+	return filepath.Join(backupsPath, c.OutputDir)
+}
+
+func startScheduledBackups() {
+	stopScheduledBackups()
+	if scheduledBackups.Interval == 0 {
+		return
+	}
+	logger.Info(logSender, "", "scheduled backups enabled, interval: %v hours, output dir: %#v", scheduledBackups.Interval,
+		scheduledBackupsDir)
+	scheduledBackupsTicker = time.NewTicker(time.Duration(scheduledBackups.Interval) * time.Hour)
+	scheduledBackupsDone = make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-scheduledBackupsDone:
+				return
+			case <-scheduledBackupsTicker.C:
+				executeScheduledBackup() //nolint:errcheck
+			}
+		}
+	}()
+}
+
+func stopScheduledBackups() {
+	if scheduledBackupsTicker != nil {
+		scheduledBackupsTicker.Stop()
+		scheduledBackupsDone <- true
+		scheduledBackupsTicker = nil
+	}
+}
+
+// executeScheduledBackup writes a full backup and applies the retention policy.
+// It returns the path of the generated backup
+func executeScheduledBackup() (string, error) {
+	scheduledBackupsMutex.Lock()
+	defer scheduledBackupsMutex.Unlock()
+
+	outputFile, err := writeScheduledBackup(time.Now().UTC())
+	if err != nil {
+		logger.Warn(logSender, "", "unable to write the scheduled backup: %v", err)
+		return "", err
+	}
+	logger.Info(logSender, "", "scheduled backup saved to %#v", outputFile)
+	removeExpiredScheduledBackups(time.Now().UTC())
+	return outputFile, nil
+}
+
+// writeScheduledBackup dumps the data provider to a temporary file that is then
+// renamed, so a partial backup is never left inside the output directory
+func writeScheduledBackup(now time.Time) (string, error) {
+	if err := os.MkdirAll(scheduledBackupsDir, 0700); err != nil {
+		return "", err
+	}
+	backup, err := dataprovider.DumpData()
+	if err != nil {
+		return "", err
+	}
+	dump, err := json.Marshal(backup)
+	if err != nil {
+		return "", err
+	}
+	name := scheduledBackupPrefix + now.Format(scheduledBackupTSFormat) + scheduledBackupExt
+	if scheduledBackups.Passphrase != "" {
+		dump, err = encryptBackupData(dump, scheduledBackups.Passphrase)
+		if err != nil {
+			return "", err
+		}
+		name += encryptedBackupExt
+	}
+	f, err := ioutil.TempFile(scheduledBackupsDir, ".tmp_"+scheduledBackupPrefix)
+	if err != nil {
+		return "", err
+	}
+	tempFile := f.Name()
+	_, err = f.Write(dump)
+	if err == nil {
+		err = f.Sync()
+	}
+	errClose := f.Close()
+	if err == nil {
+		err = errClose
+	}
+	outputFile := filepath.Join(scheduledBackupsDir, name)
+	if err == nil {
+		err = os.Rename(tempFile, outputFile)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return "", err
+	}
+	return outputFile, nil
+}
+
+// removeExpiredScheduledBackups removes the scheduled backups exceeding the
+// configured retention. Only the files generated by the scheduler are considered
+func removeExpiredScheduledBackups(now time.Time) {
+	if scheduledBackups.KeepLast == 0 && scheduledBackups.KeepDays == 0 {
+		return
+	}
+	backups, err := getScheduledBackups()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to list the scheduled backups: %v", err)
+		return
+	}
+	// backups are sorted from the newest to the oldest
+	for idx, backup := range backups {
+		expired := scheduledBackups.KeepLast > 0 && idx >= scheduledBackups.KeepLast
+		if !expired && scheduledBackups.KeepDays > 0 {
+			expired = now.Sub(backup.createdAt) > time.Duration(scheduledBackups.KeepDays)*24*time.Hour
+		}
+		if !expired {
+			continue
+		}
+		err = os.Remove(backup.path)
+		logger.Debug(logSender, "", "removing expired scheduled backup %#v, err: %v", backup.path, err)
+	}
+}
+
+type scheduledBackupFile struct {
+	path      string
+	createdAt time.Time
+}
+
+// getScheduledBackups returns the scheduled backups inside the output directory
+// sorted from the newest to the oldest
+func getScheduledBackups() ([]scheduledBackupFile, error) {
+	infos, err := ioutil.ReadDir(scheduledBackupsDir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []scheduledBackupFile
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasPrefix(name, scheduledBackupPrefix) {
+			continue
+		}
+		ts := strings.TrimSuffix(strings.TrimSuffix(name, encryptedBackupExt), scheduledBackupExt)
+		createdAt, err := time.Parse(scheduledBackupTSFormat, strings.TrimPrefix(ts, scheduledBackupPrefix))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, scheduledBackupFile{
+			path:      filepath.Join(scheduledBackupsDir, name),
+			createdAt: createdAt,
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].createdAt.After(backups[j].createdAt)
+	})
+	return backups, nil
+}
+
+func deriveBackupKey(passphrase string, nonce []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, []byte(passphrase), nonce, nil)
+	_, err := io.ReadFull(kdf, key)
+	return key, err
+}
+
+func getBackupSIOConfig(key []byte) sio.Config {
+	return sio.Config{
+		MinVersion: sio.Version20,
+		MaxVersion: sio.Version20,
+		Key:        key,
+	}
+}
+
+// encryptBackupData encrypts the backup using the DARE format and a key derived
+// from the given passphrase and a random nonce stored inside the header
+func encryptBackupData(data []byte, passphrase string) ([]byte, error) {
+	nonce := make([]byte, encryptedBackupNonceLen)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key, err := deriveBackupKey(passphrase, nonce)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(encryptedBackupMagic)
+	buf.WriteByte(encryptedBackupVersion10)
+	buf.Write(nonce)
+	if _, err = sio.Encrypt(&buf, bytes.NewReader(data), getBackupSIOConfig(key)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecryptBackupData decrypts a backup encrypted using the scheduled backups passphrase.
+// Backups that are not encrypted are returned unchanged
+func DecryptBackupData(data []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encryptedBackupMagic)) {
+		return data, nil
+	}
+	if passphrase == "" {
+		return nil, errors.New("the backup is encrypted but no passphrase is configured")
+	}
+	if len(data) < encryptedBackupHeaderSize {
+		return nil, errors.New("invalid encrypted backup: header too short")
+	}
+	version := data[len(encryptedBackupMagic)]
+	if version != encryptedBackupVersion10 {
+		return nil, fmt.Errorf("unsupported encrypted backup version %v", version)
+	}
+	key, err := deriveBackupKey(passphrase, data[len(encryptedBackupMagic)+1:encryptedBackupHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err = sio.Decrypt(&buf, bytes.NewReader(data[encryptedBackupHeaderSize:]), getBackupSIOConfig(key)); err != nil {
+		return nil, fmt.Errorf("unable to decrypt the backup, please check the passphrase: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func runScheduledBackup(w http.ResponseWriter, r *http.Request) {
+	outputFile, err := executeScheduledBackup()
+	if err != nil {
+		sendAPIResponse(w, r, err, "Unable to write the backup", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, map[string]string{
+		"output_file": outputFile,
+	})
+}
@@ -92,7 +92,12 @@ type userPage struct {
 	RedactedSecret       string
 	IsAdd                bool
 	IsS3SecretEnc        bool
+	IsS3SSECKeyEnc       bool
 	IsAzSecretEnc        bool
+	IsB2SecretEnc        bool
+	IsSFTPPasswordEnc    bool
+	IsSFTPKeyEnc         bool
+	IsCryptPassphraseEnc bool
 }
 
 type folderPage struct {
@@ -215,7 +220,12 @@ func renderAddUserPage(w http.ResponseWriter, user dataprovider.User, error stri
 		ValidProtocols:       dataprovider.ValidProtocols,
 		RootDirPerms:         user.GetPermissionsForPath("/"),
 		IsS3SecretEnc:        user.FsConfig.S3Config.AccessSecret.IsEncrypted(),
+		IsS3SSECKeyEnc:       user.FsConfig.S3Config.SSECustomerKey.IsEncrypted(),
 		IsAzSecretEnc:        user.FsConfig.AzBlobConfig.AccountKey.IsEncrypted(),
+		IsB2SecretEnc:        user.FsConfig.B2Config.ApplicationKey.IsEncrypted(),
+		IsSFTPPasswordEnc:    user.FsConfig.SFTPConfig.Password.IsEncrypted(),
+		IsSFTPKeyEnc:         user.FsConfig.SFTPConfig.PrivateKey.IsEncrypted(),
+		IsCryptPassphraseEnc: user.FsConfig.CryptConfig.Passphrase.IsEncrypted(),
 		RedactedSecret:       redactedSecret,
 	}
 	renderTemplate(w, templateUser, data)
@@ -232,7 +242,12 @@ func renderUpdateUserPage(w http.ResponseWriter, user dataprovider.User, error s
 		ValidProtocols:       dataprovider.ValidProtocols,
 		RootDirPerms:         user.GetPermissionsForPath("/"),
 		IsS3SecretEnc:        user.FsConfig.S3Config.AccessSecret.IsEncrypted(),
+		IsS3SSECKeyEnc:       user.FsConfig.S3Config.SSECustomerKey.IsEncrypted(),
 		IsAzSecretEnc:        user.FsConfig.AzBlobConfig.AccountKey.IsEncrypted(),
+		IsB2SecretEnc:        user.FsConfig.B2Config.ApplicationKey.IsEncrypted(),
+		IsSFTPPasswordEnc:    user.FsConfig.SFTPConfig.Password.IsEncrypted(),
+		IsSFTPKeyEnc:         user.FsConfig.SFTPConfig.PrivateKey.IsEncrypted(),
+		IsCryptPassphraseEnc: user.FsConfig.CryptConfig.Passphrase.IsEncrypted(),
 		RedactedSecret:       redactedSecret,
 	}
 	renderTemplate(w, templateUser, data)
@@ -383,6 +398,157 @@ func getFilePatternsFromPostField(valueAllowed, valuesDenied string) []dataprovi
 	return result
 }
 
+func getDownloadSizeLimitsFromPostField(value string) []dataprovider.DownloadSizeLimitFilter {
+	var result []dataprovider.DownloadSizeLimitFilter
+	for dir, values := range getListFromPostFields(value) {
+		if len(values) == 0 {
+			continue
+		}
+		size, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil {
+			size = -1
+		}
+		result = append(result, dataprovider.DownloadSizeLimitFilter{
+			Path:        dir,
+			MaxFileSize: size,
+		})
+	}
+	return result
+}
+
+func getDirectoryFilesLimitsFromPostField(value string) []dataprovider.DirectoryFilesLimitFilter {
+	var result []dataprovider.DirectoryFilesLimitFilter
+	for dir, values := range getListFromPostFields(value) {
+		if len(values) == 0 {
+			continue
+		}
+		maxFiles, err := strconv.Atoi(values[0])
+		if err != nil {
+			maxFiles = -1
+		}
+		result = append(result, dataprovider.DirectoryFilesLimitFilter{
+			Path:     dir,
+			MaxFiles: maxFiles,
+		})
+	}
+	return result
+}
+
+func getUploadDurationLimitsFromPostField(value string) []dataprovider.UploadDurationLimitFilter {
+	var result []dataprovider.UploadDurationLimitFilter
+	for dir, values := range getListFromPostFields(value) {
+		if len(values) == 0 {
+			continue
+		}
+		duration, err := strconv.Atoi(values[0])
+		if err != nil {
+			duration = -1
+		}
+		var minRate int64
+		if len(values) > 1 {
+			minRate, err = strconv.ParseInt(values[1], 10, 64)
+			if err != nil {
+				minRate = -1
+			}
+		}
+		result = append(result, dataprovider.UploadDurationLimitFilter{
+			Path:        dir,
+			MaxDuration: duration,
+			MinRate:     minRate,
+		})
+	}
+	return result
+}
+
+func getBandwidthSchedulesFromPostField(value string) []dataprovider.BandwidthScheduleFilter {
+	var result []dataprovider.BandwidthScheduleFilter
+	for _, cleaned := range getSliceFromDelimitedValues(value, "\n") {
+		parts := strings.Split(cleaned, "::")
+		window := strings.Split(parts[0], "-")
+		if len(window) != 2 {
+			// the validation will fail
+			window = append(window, "")
+		}
+		filter := dataprovider.BandwidthScheduleFilter{
+			Start: strings.TrimSpace(window[0]),
+			End:   strings.TrimSpace(window[1]),
+		}
+		if len(parts) > 1 {
+			limits := strings.Split(parts[1], ",")
+			bandwidth, err := strconv.ParseInt(strings.TrimSpace(limits[0]), 10, 64)
+			if err != nil {
+				bandwidth = -1
+			}
+			filter.UploadBandwidth = bandwidth
+			if len(limits) > 1 {
+				bandwidth, err = strconv.ParseInt(strings.TrimSpace(limits[1]), 10, 64)
+				if err != nil {
+					bandwidth = -1
+				}
+				filter.DownloadBandwidth = bandwidth
+			}
+		}
+		if len(parts) > 2 {
+			for _, d := range getSliceFromDelimitedValues(parts[2], ",") {
+				day, err := strconv.Atoi(d)
+				if err != nil {
+					day = -1
+				}
+				filter.WeekDays = append(filter.WeekDays, day)
+			}
+		}
+		result = append(result, filter)
+	}
+	return result
+}
+
+func getTextTransformsFromPostField(value string) []dataprovider.TextTransformFilter {
+	var result []dataprovider.TextTransformFilter
+	for _, cleaned := range getSliceFromDelimitedValues(value, "\n") {
+		parts := strings.Split(cleaned, "::")
+		if len(parts) < 3 {
+			continue
+		}
+		dir := path.Clean(strings.TrimSpace(parts[0]))
+		filter := dataprovider.TextTransformFilter{
+			Path:       dir,
+			Extensions: getSliceFromDelimitedValues(parts[1], ","),
+		}
+		for _, option := range getSliceFromDelimitedValues(parts[2], ",") {
+			if option == "strip_bom" {
+				filter.StripBOM = true
+			} else {
+				filter.LineEndings = option
+			}
+		}
+		result = append(result, filter)
+	}
+	return result
+}
+
+func getWriteModesFromPostField(valueAppendOnly, valueOverwriteOnly string) []dataprovider.WriteModeFilter {
+	var result []dataprovider.WriteModeFilter
+	appendOnlyPatterns := getListFromPostFields(valueAppendOnly)
+	overwriteOnlyPatterns := getListFromPostFields(valueOverwriteOnly)
+
+	for dir, patterns := range appendOnlyPatterns {
+		result = append(result, dataprovider.WriteModeFilter{
+			Path:          dir,
+			AppendOnly:    patterns,
+			OverwriteOnly: overwriteOnlyPatterns[dir],
+		})
+	}
+	for dir, patterns := range overwriteOnlyPatterns {
+		if _, ok := appendOnlyPatterns[dir]; !ok {
+			result = append(result, dataprovider.WriteModeFilter{
+				Path:          dir,
+				OverwriteOnly: patterns,
+			})
+		}
+	}
+	return result
+}
+
 func getFileExtensionsFromPostField(valueAllowed, valuesDenied string) []dataprovider.ExtensionsFilter {
 	var result []dataprovider.ExtensionsFilter
 	allowedExtensions := getListFromPostFields(valueAllowed)
@@ -425,8 +591,23 @@ func getFiltersFromUserPostFields(r *http.Request) dataprovider.UserFilters {
 	filters.DeniedIP = getSliceFromDelimitedValues(r.Form.Get("denied_ip"), ",")
 	filters.DeniedLoginMethods = r.Form["ssh_login_methods"]
 	filters.DeniedProtocols = r.Form["denied_protocols"]
+	filters.TOTPProtocols = r.Form["totp_protocols"]
 	filters.FileExtensions = getFileExtensionsFromPostField(r.Form.Get("allowed_extensions"), r.Form.Get("denied_extensions"))
 	filters.FilePatterns = getFilePatternsFromPostField(r.Form.Get("allowed_patterns"), r.Form.Get("denied_patterns"))
+	filters.DownloadSizeLimits = getDownloadSizeLimitsFromPostField(r.Form.Get("download_size_limits"))
+	filters.DirectoryFilesLimits = getDirectoryFilesLimitsFromPostField(r.Form.Get("directory_files_limits"))
+	filters.WriteModes = getWriteModesFromPostField(r.Form.Get("append_only_patterns"), r.Form.Get("overwrite_only_patterns"))
+	filters.TextTransforms = getTextTransformsFromPostField(r.Form.Get("text_transforms"))
+	filters.UploadDurationLimits = getUploadDurationLimitsFromPostField(r.Form.Get("upload_duration_limits"))
+	filters.BandwidthSchedules = getBandwidthSchedulesFromPostField(r.Form.Get("bandwidth_schedules"))
+	filters.AllowedExecCommands = getSliceFromDelimitedValues(r.Form.Get("allowed_exec_commands"), "\n")
+	filters.UploadNameAllowedRegex = getSliceFromDelimitedValues(r.Form.Get("upload_name_allowed_regex"), "\n")
+	filters.UploadNameDeniedRegex = getSliceFromDelimitedValues(r.Form.Get("upload_name_denied_regex"), "\n")
+	filters.AutoCreateDirs = getSliceFromDelimitedValues(r.Form.Get("auto_create_dirs"), ",")
+	filters.DefaultFolderPermissions = r.Form["default_folder_permissions"]
+	filters.KeepSessionsOnCredentialsChange = len(r.Form.Get("keep_sessions_on_credentials_change")) > 0
+	filters.RequireRenameTargetDir = len(r.Form.Get("require_rename_target_dir")) > 0
+	filters.RequireRenamePermission = len(r.Form.Get("require_rename_permission")) > 0
 	return filters
 }
 
@@ -451,6 +632,29 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		provider = int(dataprovider.LocalFilesystemProvider)
 	}
 	fs.Provider = dataprovider.FilesystemProvider(provider)
+	fs.Compression.Extensions = getSliceFromDelimitedValues(r.Form.Get("compression_extensions"), ",")
+	fs.Compression.Paths = getSliceFromDelimitedValues(r.Form.Get("compression_paths"), ",")
+	fs.Compression.QuotaBasis, err = strconv.Atoi(r.Form.Get("compression_quota_basis"))
+	if err != nil {
+		fs.Compression.QuotaBasis = vfs.CompressionQuotaBasisLogical
+	}
+	fs.Cache.Path = r.Form.Get("cache_path")
+	fs.Cache.MaxSize, err = strconv.ParseInt(r.Form.Get("cache_max_size"), 10, 64)
+	if err != nil {
+		fs.Cache.MaxSize = 0
+	}
+	fs.Cache.MaxFileSize, err = strconv.ParseInt(r.Form.Get("cache_max_file_size"), 10, 64)
+	if err != nil {
+		fs.Cache.MaxFileSize = 0
+	}
+	fs.Cache.TTL, err = strconv.Atoi(r.Form.Get("cache_ttl"))
+	if err != nil {
+		fs.Cache.TTL = 0
+	}
+	fs.HomeMarker, err = strconv.Atoi(r.Form.Get("home_marker"))
+	if err != nil {
+		fs.HomeMarker = vfs.HomeMarkerDisabled
+	}
 	if fs.Provider == dataprovider.S3FilesystemProvider {
 		fs.S3Config.Bucket = r.Form.Get("s3_bucket")
 		fs.S3Config.Region = r.Form.Get("s3_region")
@@ -459,6 +663,14 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		fs.S3Config.Endpoint = r.Form.Get("s3_endpoint")
 		fs.S3Config.StorageClass = r.Form.Get("s3_storage_class")
 		fs.S3Config.KeyPrefix = r.Form.Get("s3_key_prefix")
+		fs.S3Config.RequesterPays = len(r.Form.Get("s3_requester_pays")) > 0
+		fs.S3Config.SSEEncryption = r.Form.Get("s3_sse_encryption")
+		fs.S3Config.SSEKMSKeyID = r.Form.Get("s3_sse_kms_key_id")
+		fs.S3Config.SSECustomerKey = getSecretFromFormField(r, "s3_sse_customer_key")
+		fs.S3Config.RoleARN = r.Form.Get("s3_role_arn")
+		fs.S3Config.ExternalID = r.Form.Get("s3_external_id")
+		fs.S3Config.RoleSessionName = r.Form.Get("s3_role_session_name")
+		fs.S3Config.R2AccountID = r.Form.Get("s3_r2_account_id")
 		fs.S3Config.UploadPartSize, err = strconv.ParseInt(r.Form.Get("s3_upload_part_size"), 10, 64)
 		if err != nil {
 			return fs, err
@@ -467,9 +679,23 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		if err != nil {
 			return fs, err
 		}
+		// blank retry and timeout settings mean the defaults
+		fs.S3Config.MaxRetries, err = strconv.Atoi(r.Form.Get("s3_max_retries"))
+		if err != nil {
+			fs.S3Config.MaxRetries = 0
+		}
+		fs.S3Config.RetryBaseDelay, err = strconv.Atoi(r.Form.Get("s3_retry_base_delay"))
+		if err != nil {
+			fs.S3Config.RetryBaseDelay = 0
+		}
+		fs.S3Config.RequestTimeout, err = strconv.Atoi(r.Form.Get("s3_request_timeout"))
+		if err != nil {
+			fs.S3Config.RequestTimeout = 0
+		}
 	} else if fs.Provider == dataprovider.GCSFilesystemProvider {
 		fs.GCSConfig.Bucket = r.Form.Get("gcs_bucket")
 		fs.GCSConfig.StorageClass = r.Form.Get("gcs_storage_class")
+		fs.GCSConfig.KMSKeyName = r.Form.Get("gcs_kms_key_name")
 		fs.GCSConfig.KeyPrefix = r.Form.Get("gcs_key_prefix")
 		autoCredentials := r.Form.Get("gcs_auto_credentials")
 		if len(autoCredentials) > 0 {
@@ -506,6 +732,8 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		fs.AzBlobConfig.KeyPrefix = r.Form.Get("az_key_prefix")
 		fs.AzBlobConfig.AccessTier = r.Form.Get("az_access_tier")
 		fs.AzBlobConfig.UseEmulator = len(r.Form.Get("az_use_emulator")) > 0
+		fs.AzBlobConfig.UseManagedIdentity = len(r.Form.Get("az_use_managed_identity")) > 0
+		fs.AzBlobConfig.ManagedIdentityClientID = r.Form.Get("az_managed_identity_client_id")
 		fs.AzBlobConfig.UploadPartSize, err = strconv.ParseInt(r.Form.Get("az_upload_part_size"), 10, 64)
 		if err != nil {
 			return fs, err
@@ -514,6 +742,25 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		if err != nil {
 			return fs, err
 		}
+	} else if fs.Provider == dataprovider.B2FilesystemProvider {
+		fs.B2Config.Bucket = r.Form.Get("b2_bucket")
+		fs.B2Config.AccountID = r.Form.Get("b2_account_id")
+		fs.B2Config.ApplicationKey = getSecretFromFormField(r, "b2_application_key")
+		fs.B2Config.Endpoint = r.Form.Get("b2_endpoint")
+		fs.B2Config.KeyPrefix = r.Form.Get("b2_key_prefix")
+		fs.B2Config.UploadChunkSize, err = strconv.ParseInt(r.Form.Get("b2_upload_chunk_size"), 10, 64)
+		if err != nil {
+			return fs, err
+		}
+	} else if fs.Provider == dataprovider.SFTPFilesystemProvider {
+		fs.SFTPConfig.Endpoint = r.Form.Get("sftp_endpoint")
+		fs.SFTPConfig.Username = r.Form.Get("sftp_username")
+		fs.SFTPConfig.Password = getSecretFromFormField(r, "sftp_password")
+		fs.SFTPConfig.PrivateKey = getSecretFromFormField(r, "sftp_private_key")
+		fs.SFTPConfig.Fingerprints = getSliceFromDelimitedValues(r.Form.Get("sftp_fingerprints"), "\n")
+		fs.SFTPConfig.Prefix = r.Form.Get("sftp_prefix")
+	} else if fs.Provider == dataprovider.CryptedFilesystemProvider {
+		fs.CryptConfig.Passphrase = getSecretFromFormField(r, "crypt_passphrase")
 	}
 	return fs, nil
 }
@@ -590,11 +837,75 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 		Filters:           getFiltersFromUserPostFields(r),
 		FsConfig:          fsConfig,
 	}
+	if groups := getSliceFromDelimitedValues(r.Form.Get("groups"), ","); len(groups) > 0 {
+		user.Groups = groups
+	}
+	if len(user.Groups) > 0 && len(user.Permissions["/"]) == 0 {
+		// the permissions for the root directory can be inherited from the groups
+		delete(user.Permissions, "/")
+	}
+	user.Filters.DownloadVolumeLimit, err = strconv.ParseInt(r.Form.Get("download_volume_limit"), 10, 64)
+	if err != nil {
+		user.Filters.DownloadVolumeLimit = 0
+	}
+	user.Filters.DownloadVolumePeriod = r.Form.Get("download_volume_period")
+	user.Filters.MaxRecursionDepth, err = strconv.Atoi(r.Form.Get("max_recursion_depth"))
+	if err != nil {
+		user.Filters.MaxRecursionDepth = 0
+	}
+	user.Filters.MaxRecursionEntries, err = strconv.Atoi(r.Form.Get("max_recursion_entries"))
+	if err != nil {
+		user.Filters.MaxRecursionEntries = 0
+	}
+	user.Filters.MaxOpenFiles, err = strconv.Atoi(r.Form.Get("max_open_files"))
+	if err != nil {
+		user.Filters.MaxOpenFiles = 0
+	}
+	user.Filters.IdleTimeout, err = strconv.Atoi(r.Form.Get("idle_timeout"))
+	if err != nil {
+		user.Filters.IdleTimeout = 0
+	}
+	user.Filters.MaxConcurrentUploads, err = strconv.Atoi(r.Form.Get("max_concurrent_uploads"))
+	if err != nil {
+		user.Filters.MaxConcurrentUploads = 0
+	}
+	user.Filters.MaxConcurrentDownloads, err = strconv.Atoi(r.Form.Get("max_concurrent_downloads"))
+	if err != nil {
+		user.Filters.MaxConcurrentDownloads = 0
+	}
+	user.Filters.MaxDownloadFileSize, err = strconv.ParseInt(r.Form.Get("max_download_file_size"), 10, 64)
+	if err != nil {
+		user.Filters.MaxDownloadFileSize = 0
+	}
+	user.Filters.MaxUploadDuration, err = strconv.Atoi(r.Form.Get("max_upload_duration"))
+	if err != nil {
+		user.Filters.MaxUploadDuration = 0
+	}
+	user.Filters.MinUploadRate, err = strconv.ParseInt(r.Form.Get("min_upload_rate"), 10, 64)
+	if err != nil {
+		user.Filters.MinUploadRate = 0
+	}
+	user.Filters.QuotaWarningThresholds, err = getQuotaWarningThresholdsFromPostField(r.Form.Get("quota_warning_thresholds"))
+	if err != nil {
+		return user, err
+	}
 	maxFileSize, err := strconv.ParseInt(r.Form.Get("max_upload_file_size"), 10, 64)
 	user.Filters.MaxUploadFileSize = maxFileSize
 	return user, err
 }
 
+func getQuotaWarningThresholdsFromPostField(value string) ([]int, error) {
+	var thresholds []int
+	for _, v := range getSliceFromDelimitedValues(value, ",") {
+		threshold, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota warning threshold %#v", v)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	return thresholds, nil
+}
+
 func handleGetWebUsers(w http.ResponseWriter, r *http.Request) {
 	limit := defaultQueryLimit
 	if _, ok := r.URL.Query()["qlimit"]; ok {
@@ -606,7 +917,7 @@ func handleGetWebUsers(w http.ResponseWriter, r *http.Request) {
 	}
 	users := make([]dataprovider.User, 0, limit)
 	for {
-		u, err := dataprovider.GetUsers(limit, len(users), dataprovider.OrderASC, "")
+		u, err := dataprovider.GetUsers(limit, len(users), dataprovider.OrderASC, "", dataprovider.MetadataFilter{})
 		if err != nil {
 			renderInternalServerErrorPage(w, err)
 			return
@@ -652,6 +963,7 @@ func handleWebAddUserPost(w http.ResponseWriter, r *http.Request) {
 	}
 	err = dataprovider.AddUser(user)
 	if err == nil {
+		auditAction(r, auditActionAdd, auditObjectUser, user.Username, nil, getUserAuditSnapshot(user.Username))
 		http.Redirect(w, r, webUsersPath, http.StatusSeeOther)
 	} else {
 		renderAddUserPage(w, user, err.Error())
@@ -685,13 +997,42 @@ func handleWebUpdateUserPost(w http.ResponseWriter, r *http.Request) {
 	if !updatedUser.FsConfig.S3Config.AccessSecret.IsPlain() && !updatedUser.FsConfig.S3Config.AccessSecret.IsEmpty() {
 		updatedUser.FsConfig.S3Config.AccessSecret = user.FsConfig.S3Config.AccessSecret
 	}
+	if !updatedUser.FsConfig.S3Config.SSECustomerKey.IsPlain() && !updatedUser.FsConfig.S3Config.SSECustomerKey.IsEmpty() {
+		updatedUser.FsConfig.S3Config.SSECustomerKey = user.FsConfig.S3Config.SSECustomerKey
+	}
 	if !updatedUser.FsConfig.AzBlobConfig.AccountKey.IsPlain() && !updatedUser.FsConfig.AzBlobConfig.AccountKey.IsEmpty() {
 		updatedUser.FsConfig.AzBlobConfig.AccountKey = user.FsConfig.AzBlobConfig.AccountKey
 	}
+	if !updatedUser.FsConfig.B2Config.ApplicationKey.IsPlain() && !updatedUser.FsConfig.B2Config.ApplicationKey.IsEmpty() {
+		updatedUser.FsConfig.B2Config.ApplicationKey = user.FsConfig.B2Config.ApplicationKey
+	}
+	if !updatedUser.FsConfig.SFTPConfig.Password.IsPlain() && !updatedUser.FsConfig.SFTPConfig.Password.IsEmpty() {
+		updatedUser.FsConfig.SFTPConfig.Password = user.FsConfig.SFTPConfig.Password
+	}
+	if !updatedUser.FsConfig.SFTPConfig.PrivateKey.IsPlain() && !updatedUser.FsConfig.SFTPConfig.PrivateKey.IsEmpty() {
+		updatedUser.FsConfig.SFTPConfig.PrivateKey = user.FsConfig.SFTPConfig.PrivateKey
+	}
+	if !updatedUser.FsConfig.CryptConfig.Passphrase.IsPlain() && !updatedUser.FsConfig.CryptConfig.Passphrase.IsEmpty() {
+		updatedUser.FsConfig.CryptConfig.Passphrase = user.FsConfig.CryptConfig.Passphrase
+	}
+	// upload order rules, path schemas, protocol permissions, access times, custom metadata,
+	// TOTP configuration and auth backend cannot be edited using the web admin, preserve the existing ones
+	updatedUser.Filters.UploadOrder = user.Filters.UploadOrder
+	updatedUser.Filters.PathSchemas = user.Filters.PathSchemas
+	updatedUser.Filters.ProtocolPermissions = user.Filters.ProtocolPermissions
+	updatedUser.Filters.AccessTimes = user.Filters.AccessTimes
+	updatedUser.Filters.DisconnectOutsideAccessTimes = user.Filters.DisconnectOutsideAccessTimes
+	updatedUser.Metadata = user.Metadata
+	updatedUser.TOTPConfig = user.TOTPConfig
+	updatedUser.AuthBackend = user.AuthBackend
 	err = dataprovider.UpdateUser(updatedUser)
 	if err == nil {
+		auditAction(r, auditActionUpdate, auditObjectUser, user.Username, getAuditSnapshot(user),
+			getUserAuditSnapshot(user.Username))
 		if len(r.Form.Get("disconnect")) > 0 {
-			disconnectUser(user.Username)
+			disconnectUser(user.Username, "user updated, disconnect requested")
+		} else if reason := getUpdateDisconnectReason(&updatedUser, user.Password, user.PublicKeys, user.Status); reason != "" {
+			disconnectUser(user.Username, reason)
 		}
 		http.Redirect(w, r, webUsersPath, http.StatusSeeOther)
 	} else {
@@ -724,6 +1065,7 @@ func handleWebAddFolderPost(w http.ResponseWriter, r *http.Request) {
 
 	err = dataprovider.AddFolder(folder)
 	if err == nil {
+		auditAction(r, auditActionAdd, auditObjectFolder, folder.MappedPath, nil, getFolderAuditSnapshot(folder.MappedPath))
 		http.Redirect(w, r, webFoldersPath, http.StatusSeeOther)
 	} else {
 		renderAddFolderPage(w, folder, err.Error())
@@ -0,0 +1,139 @@
+package kms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	awsSecretsManagerTimeout = 30 * time.Second
+	// separates the secret id from the optional JSON key inside the secret payload
+	awsSecretJSONKeySeparator = "#"
+)
+
+var errAWSSecretsManagerEncrypt = errors.New("AWS Secrets Manager secrets are references to existing secrets, they cannot be created by SFTPGo")
+
+// awsSecretsManagerProvider resolves the secrets referencing AWS Secrets Manager.
+// The secrets payload is the ARN or the name of the secret, optionally followed by
+// "#<key>" to select a key if the secret value is a JSON object
+type awsSecretsManagerProvider struct {
+	svc   secretsmanageriface.SecretsManagerAPI
+	cache *secretsCache
+}
+
+func newAWSSecretsManagerProvider(config AWSSecretsManagerConfig) (*awsSecretsManagerProvider, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	awsConfig := aws.NewConfig()
+	if config.Region != "" {
+		awsConfig.WithRegion(config.Region)
+	}
+	if config.AccessKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(config.AccessKey, config.AccessSecret, "")
+	}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	sessOpts := session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	sess, err := session.NewSessionWithOptions(sessOpts)
+	if err != nil {
+		return nil, err
+	}
+	return newAWSSecretsManagerProviderWithClient(secretsmanager.New(sess), config.CacheTTL), nil
+}
+
+func newAWSSecretsManagerProviderWithClient(svc secretsmanageriface.SecretsManagerAPI, cacheTTL int) *awsSecretsManagerProvider {
+	return &awsSecretsManagerProvider{
+		svc:   svc,
+		cache: newSecretsCache(cacheTTL),
+	}
+}
+
+func (p *awsSecretsManagerProvider) Name() string {
+	return "AWS Secrets Manager"
+}
+
+func (p *awsSecretsManagerProvider) EncryptedStatus() vfs.SecretStatus {
+	return vfs.SecretStatusAWSSecretsManager
+}
+
+func (p *awsSecretsManagerProvider) Encrypt(payload, additionalData string) (string, string, error) {
+	return "", "", errAWSSecretsManagerEncrypt
+}
+
+// Decrypt returns the value for the referenced secret. Resolved secrets are cached
+// for the configured TTL, so a rotated secret is picked up when the cache expires
+func (p *awsSecretsManagerProvider) Decrypt(payload, key, additionalData string) (string, error) {
+	if value, ok := p.cache.get(payload); ok {
+		return value, nil
+	}
+	secretID := payload
+	jsonKey := ""
+	if idx := strings.LastIndex(payload, awsSecretJSONKeySeparator); idx >= 0 {
+		secretID = payload[:idx]
+		jsonKey = payload[idx+1:]
+	}
+	if secretID == "" {
+		return "", fmt.Errorf("invalid AWS Secrets Manager reference %#v", payload)
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), awsSecretsManagerTimeout)
+	defer cancelFn()
+
+	out, err := p.svc.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+	var value string
+	if out.SecretString != nil {
+		value = *out.SecretString
+	} else {
+		value = string(out.SecretBinary)
+	}
+	if jsonKey != "" {
+		value, err = getAWSSecretJSONValue(value, jsonKey)
+		if err != nil {
+			return "", err
+		}
+	}
+	p.cache.add(payload, value)
+	return value, nil
+}
+
+func getAWSSecretJSONValue(secret, jsonKey string) (string, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &values); err != nil {
+		return "", fmt.Errorf("the secret value is not a JSON object, unable to get key %#v: %v", jsonKey, err)
+	}
+	val, ok := values[jsonKey]
+	if !ok {
+		return "", fmt.Errorf("key %#v not found inside the secret", jsonKey)
+	}
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	default:
+		asJSON, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(asJSON), nil
+	}
+}
@@ -0,0 +1,192 @@
+package kms
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+
+	"github.com/drakkan/sftpgo/httpclient"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	azureKeyVaultResource          = "https://vault.azure.net"
+	azureKeyVaultAPIVersion        = "7.1"
+	azureActiveDirectoryEndpoint   = "https://login.microsoftonline.com/"
+	azureKeyVaultAdditionalDataTag = "additional_data"
+)
+
+var errAzureKeyVaultAdditionalDataMismatch = errors.New("azure key vault secret additional data mismatch")
+
+// azureTokenProvider returns the Azure AD tokens, adal.ServicePrincipalToken implements it
+type azureTokenProvider interface {
+	EnsureFresh() error
+	OAuthToken() string
+}
+
+type azureKeyVaultSecret struct {
+	Value string            `json:"value"`
+	ID    string            `json:"id,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+}
+
+type azureKeyVaultError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// azureKeyVaultProvider stores the secrets inside Azure Key Vault, SFTPGo only
+// stores the secret name, as payload, and the secret version, as key.
+// The secret values are fetched each time they are used and cached for the
+// configured TTL, so the data provider never contains the secret values
+type azureKeyVaultProvider struct {
+	config AzureKeyVaultConfig
+	token  azureTokenProvider
+	cache  *secretsCache
+}
+
+func newAzureKeyVaultProvider(config AzureKeyVaultConfig) (*azureKeyVaultProvider, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	var spt *adal.ServicePrincipalToken
+	if config.ClientSecret != "" {
+		oauthConfig, err := adal.NewOAuthConfig(azureActiveDirectoryEndpoint, config.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		spt, err = adal.NewServicePrincipalToken(*oauthConfig, config.ClientID, config.ClientSecret, azureKeyVaultResource)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		spt, err = adal.NewServicePrincipalTokenFromManagedIdentity(azureKeyVaultResource, &adal.ManagedIdentityOptions{
+			ClientID: config.ClientID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newAzureKeyVaultProviderWithToken(config, spt), nil
+}
+
+func newAzureKeyVaultProviderWithToken(config AzureKeyVaultConfig, token azureTokenProvider) *azureKeyVaultProvider {
+	return &azureKeyVaultProvider{
+		config: config,
+		token:  token,
+		cache:  newSecretsCache(config.CacheTTL),
+	}
+}
+
+func (p *azureKeyVaultProvider) Name() string {
+	return "Azure Key Vault"
+}
+
+func (p *azureKeyVaultProvider) EncryptedStatus() vfs.SecretStatus {
+	return vfs.SecretStatusAzureKeyVault
+}
+
+// Encrypt stores the payload as a new secret and returns its name and version
+func (p *azureKeyVaultProvider) Encrypt(payload, additionalData string) (string, string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", "", err
+	}
+	name := fmt.Sprintf("%v-%v", p.config.SecretPrefix, hex.EncodeToString(id))
+	secret := azureKeyVaultSecret{
+		Value: payload,
+	}
+	if additionalData != "" {
+		secret.Tags = map[string]string{
+			azureKeyVaultAdditionalDataTag: additionalData,
+		}
+	}
+	var result azureKeyVaultSecret
+	if err := p.doRequest(http.MethodPut, path.Join("secrets", name), secret, &result); err != nil {
+		return "", "", err
+	}
+	version := path.Base(result.ID)
+	if version == "" || version == name || version == "." || version == "/" {
+		return "", "", fmt.Errorf("azure key vault returned an invalid secret id %#v", result.ID)
+	}
+	return name, version, nil
+}
+
+// Decrypt returns the value for the secret with the given name and version
+func (p *azureKeyVaultProvider) Decrypt(payload, key, additionalData string) (string, error) {
+	if payload == "" || key == "" {
+		return "", fmt.Errorf("invalid azure key vault secret name %#v or version %#v", payload, key)
+	}
+	secretPath := path.Join("secrets", url.PathEscape(payload), url.PathEscape(key))
+	if value, ok := p.cache.get(secretPath); ok {
+		return value, nil
+	}
+	var result azureKeyVaultSecret
+	if err := p.doRequest(http.MethodGet, secretPath, nil, &result); err != nil {
+		return "", err
+	}
+	if result.Tags[azureKeyVaultAdditionalDataTag] != additionalData {
+		return "", errAzureKeyVaultAdditionalDataMismatch
+	}
+	p.cache.add(secretPath, result.Value)
+	return result.Value, nil
+}
+
+// doRequest sends a request to the Azure Key Vault REST API and unmarshals the response into result
+func (p *azureKeyVaultProvider) doRequest(method, apiPath string, body, result interface{}) error {
+	if err := p.token.EnsureFresh(); err != nil {
+		return fmt.Errorf("unable to get an Azure AD token for key vault: %v", err)
+	}
+	var reqBody io.Reader
+	if body != nil {
+		asJSON, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(asJSON)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%v/%v?api-version=%v", p.config.VaultURL, apiPath,
+		azureKeyVaultAPIVersion), reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token.OAuthToken())
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := httpclient.GetHTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to send request to azure key vault: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var kvErr azureKeyVaultError
+		if err := json.Unmarshal(respBody, &kvErr); err == nil && kvErr.Error.Code != "" {
+			return fmt.Errorf("azure key vault request failed, status code: %v, error: %v: %v", resp.StatusCode,
+				kvErr.Error.Code, kvErr.Error.Message)
+		}
+		return fmt.Errorf("azure key vault request failed, status code: %v", resp.StatusCode)
+	}
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return fmt.Errorf("unable to decode azure key vault response: %v", err)
+	}
+	return nil
+}
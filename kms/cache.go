@@ -0,0 +1,56 @@
+package kms
+
+import (
+	"sync"
+	"time"
+)
+
+type cachedSecretValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+// secretsCache caches the secrets fetched from an external secrets store for a limited time
+type secretsCache struct {
+	sync.Mutex
+	ttl   time.Duration
+	items map[string]cachedSecretValue
+}
+
+func newSecretsCache(ttl int) *secretsCache {
+	return &secretsCache{
+		ttl:   time.Duration(ttl) * time.Second,
+		items: make(map[string]cachedSecretValue),
+	}
+}
+
+func (c *secretsCache) get(key string) (string, bool) {
+	if c.ttl <= 0 {
+		return "", false
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	cached, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(cached.expiresAt) {
+		delete(c.items, key)
+		return "", false
+	}
+	return cached.value, true
+}
+
+func (c *secretsCache) add(key, value string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	c.items[key] = cachedSecretValue{
+		value:     value,
+		expiresAt: time.Now().Add(c.ttl),
+	}
+}
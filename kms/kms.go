@@ -0,0 +1,239 @@
+// Package kms allows to configure the provider used to encrypt and decrypt
+// the secrets, such as the cloud storage credentials, stored inside the data provider
+package kms
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// Supported secret providers
+const (
+	// ProviderLocal encrypts the secrets using AES-256-GCM and a random key
+	// stored alongside the secret. This is the default
+	ProviderLocal = "local"
+	// ProviderVault delegates secrets encryption/storage to HashiCorp Vault
+	ProviderVault = "vault"
+	// ProviderAzureKeyVault stores the secrets inside Azure Key Vault
+	ProviderAzureKeyVault = "azurekeyvault"
+)
+
+// Supported HashiCorp Vault modes
+const (
+	// VaultModeTransit encrypts the secrets using the Vault transit secrets engine
+	VaultModeTransit = "transit"
+	// VaultModeKV stores the secrets inside a Vault KV secrets engine
+	VaultModeKV = "kv"
+)
+
+const (
+	logSender          = "kms"
+	vaultTokenEnvVar   = "VAULT_TOKEN"
+	defaultTransitPath = "transit"
+	defaultTransitKey  = "sftpgo"
+	defaultKVPath      = "secret"
+	defaultKVPrefix    = "sftpgo"
+	// the secret names are "<prefix>-<32 hex chars>", Azure Key Vault allows up to 127 chars
+	maxAzureKeyVaultPrefixLen = 94
+)
+
+var azureKeyVaultPrefixRegex = regexp.MustCompile(`^[0-9a-zA-Z-]+$`)
+
+// VaultConfig defines the configuration for the HashiCorp Vault secret provider
+type VaultConfig struct {
+	// Vault server URL, for example https://vault.example.com:8200
+	URL string `json:"url" mapstructure:"url"`
+	// Token used to authenticate against Vault. If empty the VAULT_TOKEN
+	// environment variable will be used
+	Token string `json:"token" mapstructure:"token"`
+	// Vault Enterprise namespace, leave empty if not needed
+	Namespace string `json:"namespace" mapstructure:"namespace"`
+	// Mode defines how the secrets are managed: "transit" or "kv"
+	Mode string `json:"mode" mapstructure:"mode"`
+	// Mount path for the transit secrets engine
+	TransitPath string `json:"transit_path" mapstructure:"transit_path"`
+	// Name of the transit key used to encrypt the secrets
+	TransitKey string `json:"transit_key" mapstructure:"transit_key"`
+	// Mount path for the KV secrets engine
+	KVPath string `json:"kv_path" mapstructure:"kv_path"`
+	// Prefix for the secrets stored inside the KV secrets engine
+	KVPrefix string `json:"kv_prefix" mapstructure:"kv_prefix"`
+	// KV secrets engine version: 1 or 2
+	KVVersion int `json:"kv_version" mapstructure:"kv_version"`
+}
+
+// AWSSecretsManagerConfig defines the configuration to resolve the secrets referencing
+// AWS Secrets Manager. If the credentials are empty the AWS SDK default credential
+// chain is used, for example environment variables, shared config or IAM roles
+type AWSSecretsManagerConfig struct {
+	// Set to true to resolve the secrets referencing AWS Secrets Manager
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// AWS region, if empty the SDK default region is used
+	Region string `json:"region" mapstructure:"region"`
+	// Custom endpoint, leave empty to use the default AWS endpoint
+	Endpoint string `json:"endpoint" mapstructure:"endpoint"`
+	// AWS access key, leave empty to use the default credential chain
+	AccessKey string `json:"access_key" mapstructure:"access_key"`
+	// AWS access secret
+	AccessSecret string `json:"access_secret" mapstructure:"access_secret"`
+	// Resolved secrets are cached for this number of seconds, 0 disables the cache
+	CacheTTL int `json:"cache_ttl" mapstructure:"cache_ttl"`
+}
+
+func (c *AWSSecretsManagerConfig) validate() error {
+	if c.AccessKey == "" && c.AccessSecret != "" {
+		return errors.New("aws secrets manager access key cannot be empty with access secret not empty")
+	}
+	if c.AccessKey != "" && c.AccessSecret == "" {
+		return errors.New("aws secrets manager access secret cannot be empty with access key not empty")
+	}
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("invalid aws secrets manager cache ttl: %v", c.CacheTTL)
+	}
+	return nil
+}
+
+// AzureKeyVaultConfig defines the configuration for the Azure Key Vault secret provider.
+// If the client secret is empty SFTPGo authenticates using the managed identity
+type AzureKeyVaultConfig struct {
+	// Key Vault URL, for example https://myvault.vault.azure.net
+	VaultURL string `json:"vault_url" mapstructure:"vault_url"`
+	// Azure AD tenant ID, required to authenticate using the client credentials
+	TenantID string `json:"tenant_id" mapstructure:"tenant_id"`
+	// Client ID for the service principal or, if the client secret is empty,
+	// for the user assigned managed identity. Leave empty to use the system
+	// assigned managed identity
+	ClientID string `json:"client_id" mapstructure:"client_id"`
+	// Client secret for the service principal
+	ClientSecret string `json:"client_secret" mapstructure:"client_secret"`
+	// Prefix for the names of the secrets stored inside Key Vault
+	SecretPrefix string `json:"secret_prefix" mapstructure:"secret_prefix"`
+	// Fetched secrets are cached for this number of seconds, 0 disables the cache
+	CacheTTL int `json:"cache_ttl" mapstructure:"cache_ttl"`
+}
+
+func (c *AzureKeyVaultConfig) validate() error {
+	c.VaultURL = strings.TrimRight(strings.TrimSpace(c.VaultURL), "/")
+	if c.VaultURL == "" {
+		return errors.New("azure key vault url is required")
+	}
+	u, err := url.Parse(c.VaultURL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("invalid azure key vault url %#v", c.VaultURL)
+	}
+	if c.ClientSecret != "" && (c.TenantID == "" || c.ClientID == "") {
+		return errors.New("azure key vault tenant id and client id are required to authenticate using a client secret")
+	}
+	if c.SecretPrefix == "" {
+		c.SecretPrefix = defaultKVPrefix
+	}
+	if len(c.SecretPrefix) > maxAzureKeyVaultPrefixLen || !azureKeyVaultPrefixRegex.MatchString(c.SecretPrefix) {
+		return fmt.Errorf("invalid azure key vault secret prefix %#v, only alphanumeric characters and dashes are allowed",
+			c.SecretPrefix)
+	}
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("invalid azure key vault cache ttl: %v", c.CacheTTL)
+	}
+	return nil
+}
+
+// Config defines the configuration for the secret provider
+type Config struct {
+	// Provider to use to encrypt new secrets: "local", "vault" or "azurekeyvault".
+	// The secrets already encrypted using the local provider can
+	// always be decrypted
+	Provider string `json:"provider" mapstructure:"provider"`
+	// Vault defines the configuration for HashiCorp Vault
+	Vault VaultConfig `json:"vault" mapstructure:"vault"`
+	// AzureKeyVault defines the configuration for Azure Key Vault
+	AzureKeyVault AzureKeyVaultConfig `json:"azure_key_vault" mapstructure:"azure_key_vault"`
+	// AWSSecretsManager defines the configuration to resolve the secrets referencing
+	// AWS Secrets Manager. It can be used together with any provider
+	AWSSecretsManager AWSSecretsManagerConfig `json:"aws_secrets_manager" mapstructure:"aws_secrets_manager"`
+}
+
+// Initialize validates the configuration and sets the secret provider
+func (c Config) Initialize() error {
+	if c.AWSSecretsManager.Enabled {
+		provider, err := newAWSSecretsManagerProvider(c.AWSSecretsManager)
+		if err != nil {
+			return err
+		}
+		logger.Info(logSender, "", "AWS Secrets Manager references enabled, region %#v cache ttl: %v seconds",
+			c.AWSSecretsManager.Region, c.AWSSecretsManager.CacheTTL)
+		vfs.RegisterSecretProvider(provider)
+	}
+	switch c.Provider {
+	case "", ProviderLocal:
+		logger.Debug(logSender, "", "using the local secret provider")
+		return nil
+	case ProviderVault:
+		provider, err := newVaultProvider(c.Vault)
+		if err != nil {
+			return err
+		}
+		logger.Info(logSender, "", "using HashiCorp Vault secret provider, url %#v mode %#v", c.Vault.URL, provider.config.Mode)
+		vfs.SetSecretProvider(provider)
+		return nil
+	case ProviderAzureKeyVault:
+		provider, err := newAzureKeyVaultProvider(c.AzureKeyVault)
+		if err != nil {
+			return err
+		}
+		logger.Info(logSender, "", "using Azure Key Vault secret provider, url %#v, managed identity: %v, cache ttl: %v seconds",
+			provider.config.VaultURL, provider.config.ClientSecret == "", provider.config.CacheTTL)
+		vfs.SetSecretProvider(provider)
+		return nil
+	default:
+		return fmt.Errorf("unsupported secret provider %#v", c.Provider)
+	}
+}
+
+func (c *VaultConfig) validate() error {
+	c.URL = strings.TrimRight(strings.TrimSpace(c.URL), "/")
+	if c.URL == "" {
+		return errors.New("vault url is required")
+	}
+	if c.Token == "" {
+		c.Token = os.Getenv(vaultTokenEnvVar)
+	}
+	if c.Token == "" {
+		return errors.New("vault token is required")
+	}
+	c.TransitPath = strings.Trim(c.TransitPath, "/")
+	if c.TransitPath == "" {
+		c.TransitPath = defaultTransitPath
+	}
+	if c.TransitKey == "" {
+		c.TransitKey = defaultTransitKey
+	}
+	c.KVPath = strings.Trim(c.KVPath, "/")
+	if c.KVPath == "" {
+		c.KVPath = defaultKVPath
+	}
+	c.KVPrefix = strings.Trim(c.KVPrefix, "/")
+	if c.KVPrefix == "" {
+		c.KVPrefix = defaultKVPrefix
+	}
+	switch c.Mode {
+	case "", VaultModeTransit:
+		c.Mode = VaultModeTransit
+	case VaultModeKV:
+		if c.KVVersion == 0 {
+			c.KVVersion = 2
+		}
+		if c.KVVersion != 1 && c.KVVersion != 2 {
+			return fmt.Errorf("unsupported vault kv version: %v", c.KVVersion)
+		}
+	default:
+		return fmt.Errorf("unsupported vault mode %#v", c.Mode)
+	}
+	return nil
+}
@@ -0,0 +1,708 @@
+package kms
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/drakkan/sftpgo/httpclient"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const testVaultToken = "s.testtoken"
+
+// fakeVault implements the subset of the Vault HTTP API used by the vault provider
+type fakeVault struct {
+	sync.Mutex
+	kv map[string]json.RawMessage
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != testVaultToken {
+		writeVaultResponse(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+	apiPath := strings.TrimPrefix(r.URL.Path, "/v1/")
+	switch {
+	case strings.HasPrefix(apiPath, "transit/encrypt/"):
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeVaultResponse(w, http.StatusBadRequest, nil)
+			return
+		}
+		writeVaultResponse(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]string{"ciphertext": "vault:v1:" + req["plaintext"]},
+		})
+	case strings.HasPrefix(apiPath, "transit/decrypt/"):
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeVaultResponse(w, http.StatusBadRequest, nil)
+			return
+		}
+		if !strings.HasPrefix(req["ciphertext"], "vault:v1:") {
+			writeVaultResponse(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid ciphertext"}})
+			return
+		}
+		writeVaultResponse(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]string{"plaintext": strings.TrimPrefix(req["ciphertext"], "vault:v1:")},
+		})
+	default:
+		v.Lock()
+		defer v.Unlock()
+
+		switch r.Method {
+		case http.MethodPost:
+			var data json.RawMessage
+			if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+				writeVaultResponse(w, http.StatusBadRequest, nil)
+				return
+			}
+			v.kv[apiPath] = data
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			data, ok := v.kv[apiPath]
+			if !ok {
+				writeVaultResponse(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+				return
+			}
+			writeVaultResponse(w, http.StatusOK, map[string]interface{}{"data": data})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func writeVaultResponse(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if body != nil {
+		json.NewEncoder(w).Encode(body) //nolint:errcheck
+	}
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	vault := &fakeVault{
+		kv: make(map[string]json.RawMessage),
+	}
+	server := httptest.NewServer(vault)
+	t.Cleanup(server.Close)
+	return vault, server
+}
+
+func TestMain(m *testing.M) {
+	httpConfig := httpclient.Config{
+		Timeout: 5,
+	}
+	httpConfig.Initialize("")
+	os.Exit(m.Run())
+}
+
+func restoreSecretProvider(t *testing.T) {
+	provider := vfs.GetSecretProvider()
+	t.Cleanup(func() {
+		vfs.SetSecretProvider(provider)
+	})
+}
+
+func TestVaultSecretWithoutProvider(t *testing.T) {
+	secret := vfs.Secret{
+		Status:  vfs.SecretStatusVaultKV,
+		Payload: "sftpgo/path",
+		Key:     "secret",
+	}
+	err := secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no secret provider configured")
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	c := Config{}
+	assert.NoError(t, c.Initialize())
+	c.Provider = ProviderLocal
+	assert.NoError(t, c.Initialize())
+	c.Provider = "unknown"
+	assert.Error(t, c.Initialize())
+	c.Provider = ProviderVault
+	err := c.Initialize()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "url is required")
+	}
+	c.Vault.URL = "http://127.0.0.1:8200/"
+	os.Unsetenv(vaultTokenEnvVar)
+	err = c.Initialize()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "token is required")
+	}
+	c.Vault.Mode = "unknown"
+	os.Setenv(vaultTokenEnvVar, testVaultToken)
+	t.Cleanup(func() {
+		os.Unsetenv(vaultTokenEnvVar)
+	})
+	err = c.Initialize()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unsupported vault mode")
+	}
+	c.Vault.Mode = VaultModeKV
+	c.Vault.KVVersion = 3
+	err = c.Initialize()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unsupported vault kv version")
+	}
+
+	vaultConf := VaultConfig{
+		URL:  " http://127.0.0.1:8200/ ",
+		Mode: VaultModeKV,
+	}
+	err = vaultConf.validate()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:8200", vaultConf.URL)
+	assert.Equal(t, testVaultToken, vaultConf.Token)
+	assert.Equal(t, defaultTransitPath, vaultConf.TransitPath)
+	assert.Equal(t, defaultTransitKey, vaultConf.TransitKey)
+	assert.Equal(t, defaultKVPath, vaultConf.KVPath)
+	assert.Equal(t, defaultKVPrefix, vaultConf.KVPrefix)
+	assert.Equal(t, 2, vaultConf.KVVersion)
+}
+
+func TestVaultTransit(t *testing.T) {
+	restoreSecretProvider(t)
+	_, server := newFakeVault(t)
+
+	// secrets encrypted with the local provider must be still readable after switching to vault
+	localSecret := vfs.Secret{
+		Status:         vfs.SecretStatusPlain,
+		Payload:        "local secret",
+		AdditionalData: "user",
+	}
+	require.NoError(t, localSecret.Encrypt())
+	assert.Equal(t, vfs.SecretStatusAES256GCM, localSecret.Status)
+
+	c := Config{
+		Provider: ProviderVault,
+		Vault: VaultConfig{
+			URL:   server.URL,
+			Token: testVaultToken,
+		},
+	}
+	require.NoError(t, c.Initialize())
+	assert.Equal(t, "HashiCorp Vault", vfs.GetSecretProvider().Name())
+
+	secret := vfs.Secret{
+		Status:         vfs.SecretStatusPlain,
+		Payload:        "test secret",
+		AdditionalData: "user",
+	}
+	require.NoError(t, secret.Encrypt())
+	assert.Equal(t, vfs.SecretStatusVaultTransit, secret.Status)
+	assert.True(t, secret.IsEncrypted())
+	assert.True(t, secret.IsValid())
+	assert.Equal(t, "transit/sftpgo", secret.Key)
+	assert.True(t, strings.HasPrefix(secret.Payload, "vault:v1:"))
+	assert.NotContains(t, secret.Payload, "test secret")
+	require.NoError(t, secret.Decrypt())
+	assert.Equal(t, vfs.SecretStatusPlain, secret.Status)
+	assert.Equal(t, "test secret", secret.Payload)
+	assert.Empty(t, secret.Key)
+	assert.Empty(t, secret.AdditionalData)
+
+	require.NoError(t, localSecret.Decrypt())
+	assert.Equal(t, "local secret", localSecret.Payload)
+
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusVaultTransit,
+		Payload: "vault:v1:" + base64.StdEncoding.EncodeToString([]byte("payload")),
+	}
+	assert.False(t, secret.IsValid())
+	assert.Error(t, secret.Decrypt())
+	secret.Key = "transit/sftpgo"
+	assert.True(t, secret.IsValid())
+	require.NoError(t, secret.Decrypt())
+	assert.Equal(t, "payload", secret.Payload)
+
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusVaultTransit,
+		Payload: "invalid",
+		Key:     "transit/sftpgo",
+	}
+	err := secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid ciphertext")
+	}
+
+	c.Vault.Token = "invalid token"
+	require.NoError(t, c.Initialize())
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusPlain,
+		Payload: "test secret",
+	}
+	err = secret.Encrypt()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "permission denied")
+	}
+	assert.Equal(t, vfs.SecretStatusPlain, secret.Status)
+}
+
+func TestVaultKV(t *testing.T) {
+	restoreSecretProvider(t)
+	vault, server := newFakeVault(t)
+
+	for _, version := range []int{1, 2} {
+		c := Config{
+			Provider: ProviderVault,
+			Vault: VaultConfig{
+				URL:       server.URL,
+				Token:     testVaultToken,
+				Mode:      VaultModeKV,
+				KVPath:    "kv",
+				KVVersion: version,
+			},
+		}
+		require.NoError(t, c.Initialize())
+
+		secret := vfs.Secret{
+			Status:         vfs.SecretStatusPlain,
+			Payload:        "test secret",
+			AdditionalData: "user",
+		}
+		require.NoError(t, secret.Encrypt())
+		assert.Equal(t, vfs.SecretStatusVaultKV, secret.Status)
+		assert.Equal(t, "kv", secret.Key)
+		assert.True(t, strings.HasPrefix(secret.Payload, defaultKVPrefix+"/"))
+		assert.True(t, secret.IsValid())
+		kvPath := "kv/" + secret.Payload
+		if version == 2 {
+			kvPath = "kv/data/" + secret.Payload
+		}
+		vault.Lock()
+		_, ok := vault.kv[kvPath]
+		vault.Unlock()
+		assert.True(t, ok, "secret not found at path %#v", kvPath)
+
+		wrongAdditionalData := secret
+		wrongAdditionalData.AdditionalData = "another user"
+		assert.EqualError(t, wrongAdditionalData.Decrypt(), errVaultAdditionalDataMismatch.Error())
+
+		require.NoError(t, secret.Decrypt())
+		assert.Equal(t, vfs.SecretStatusPlain, secret.Status)
+		assert.Equal(t, "test secret", secret.Payload)
+
+		secret = vfs.Secret{
+			Status:  vfs.SecretStatusVaultKV,
+			Payload: "sftpgo/missing",
+			Key:     "kv",
+		}
+		err := secret.Decrypt()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "status code: 404")
+		}
+	}
+}
+
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	sync.Mutex
+	secrets map[string]string
+	calls   int
+}
+
+func (s *fakeSecretsManager) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput,
+	opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.calls++
+	value, ok := s.secrets[aws.StringValue(input.SecretId)]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException: secret not found")
+	}
+	return &secretsmanager.GetSecretValueOutput{
+		SecretString: aws.String(value),
+	}, nil
+}
+
+func (s *fakeSecretsManager) setSecret(id, value string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.secrets[id] = value
+}
+
+func (s *fakeSecretsManager) getCalls() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.calls
+}
+
+func TestAWSSecretsManager(t *testing.T) {
+	restoreSecretProvider(t)
+	secretARN := "arn:aws:secretsmanager:us-east-1:123456789012:secret:sftpgo"
+
+	secret := vfs.Secret{
+		Status:  vfs.SecretStatusAWSSecretsManager,
+		Payload: secretARN,
+	}
+	assert.True(t, secret.IsEncrypted())
+	assert.True(t, secret.IsReference())
+	assert.True(t, secret.IsValid())
+	err := secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.True(t, vfs.IsSecretResolutionError(err))
+		assert.Contains(t, err.Error(), "no secret provider configured")
+	}
+
+	c := Config{
+		AWSSecretsManager: AWSSecretsManagerConfig{
+			Enabled:   true,
+			AccessKey: "key",
+		},
+	}
+	assert.Error(t, c.Initialize())
+	c.AWSSecretsManager.AccessKey = ""
+	c.AWSSecretsManager.AccessSecret = "secret"
+	assert.Error(t, c.Initialize())
+	c.AWSSecretsManager.AccessSecret = ""
+	c.AWSSecretsManager.CacheTTL = -1
+	assert.Error(t, c.Initialize())
+	c.AWSSecretsManager.CacheTTL = 60
+	c.AWSSecretsManager.Region = "us-east-1"
+	require.NoError(t, c.Initialize())
+	// the provider used to encrypt new secrets is unchanged
+	assert.Equal(t, "Local", vfs.GetSecretProvider().Name())
+
+	svc := &fakeSecretsManager{
+		secrets: map[string]string{
+			secretARN:     "plain value",
+			"json-secret": `{"access_secret":"json value","nested":{"a":1}}`,
+		},
+	}
+	provider := newAWSSecretsManagerProviderWithClient(svc, 60)
+	vfs.RegisterSecretProvider(provider)
+
+	plainSecret := vfs.Secret{
+		Status:  vfs.SecretStatusPlain,
+		Payload: "value",
+	}
+	require.NoError(t, plainSecret.Encrypt())
+	assert.Equal(t, vfs.SecretStatusAES256GCM, plainSecret.Status)
+	_, _, err = provider.Encrypt("value", "")
+	assert.EqualError(t, err, errAWSSecretsManagerEncrypt.Error())
+
+	require.NoError(t, secret.Decrypt())
+	assert.Equal(t, vfs.SecretStatusPlain, secret.Status)
+	assert.Equal(t, "plain value", secret.Payload)
+	assert.Equal(t, 1, svc.getCalls())
+	// the secret is rotated, the cached value is used until it expires
+	svc.setSecret(secretARN, "rotated value")
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusAWSSecretsManager,
+		Payload: secretARN,
+	}
+	cachedSecret := secret
+	require.NoError(t, cachedSecret.Decrypt())
+	assert.Equal(t, "plain value", cachedSecret.Payload)
+	assert.Equal(t, 1, svc.getCalls())
+	provider.cache.Lock()
+	provider.cache.items[secretARN] = cachedSecretValue{
+		value:     "plain value",
+		expiresAt: time.Now().Add(-1 * time.Second),
+	}
+	provider.cache.Unlock()
+	require.NoError(t, secret.Decrypt())
+	assert.Equal(t, "rotated value", secret.Payload)
+	assert.Equal(t, 2, svc.getCalls())
+
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusAWSSecretsManager,
+		Payload: "json-secret#access_secret",
+	}
+	require.NoError(t, secret.Decrypt())
+	assert.Equal(t, "json value", secret.Payload)
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusAWSSecretsManager,
+		Payload: "json-secret#nested",
+	}
+	require.NoError(t, secret.Decrypt())
+	assert.JSONEq(t, `{"a":1}`, secret.Payload)
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusAWSSecretsManager,
+		Payload: "json-secret#missing",
+	}
+	err = secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.True(t, vfs.IsSecretResolutionError(err))
+		assert.Contains(t, err.Error(), "not found inside the secret")
+	}
+	assert.Equal(t, vfs.SecretStatusAWSSecretsManager, secret.Status)
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusAWSSecretsManager,
+		Payload: secretARN + "#key",
+	}
+	err = secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not a JSON object")
+	}
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusAWSSecretsManager,
+		Payload: "#key",
+	}
+	err = secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid AWS Secrets Manager reference")
+	}
+	// failures are not cached
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusAWSSecretsManager,
+		Payload: "missing",
+	}
+	err = secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.True(t, vfs.IsSecretResolutionError(err))
+		assert.Contains(t, err.Error(), "ResourceNotFoundException")
+	}
+	svc.setSecret("missing", "now available")
+	require.NoError(t, secret.Decrypt())
+	assert.Equal(t, "now available", secret.Payload)
+	// without cache each decryption fetches the secret
+	provider = newAWSSecretsManagerProviderWithClient(svc, 0)
+	vfs.RegisterSecretProvider(provider)
+	calls := svc.getCalls()
+	for i := 0; i < 2; i++ {
+		secret = vfs.Secret{
+			Status:  vfs.SecretStatusAWSSecretsManager,
+			Payload: secretARN,
+		}
+		require.NoError(t, secret.Decrypt())
+		assert.Equal(t, "rotated value", secret.Payload)
+	}
+	assert.Equal(t, calls+2, svc.getCalls())
+}
+
+const testAzureToken = "azure-token"
+
+type fakeAzureToken struct {
+	err error
+}
+
+func (t *fakeAzureToken) EnsureFresh() error {
+	return t.err
+}
+
+func (t *fakeAzureToken) OAuthToken() string {
+	return testAzureToken
+}
+
+// fakeAzureKeyVault implements the subset of the Azure Key Vault REST API used by the provider
+type fakeAzureKeyVault struct {
+	sync.Mutex
+	secrets map[string]azureKeyVaultSecret
+	gets    int
+}
+
+func (v *fakeAzureKeyVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+testAzureToken {
+		writeVaultResponse(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": map[string]string{"code": "Unauthorized", "message": "invalid token"},
+		})
+		return
+	}
+	if r.URL.Query().Get("api-version") != azureKeyVaultAPIVersion {
+		writeVaultResponse(w, http.StatusBadRequest, nil)
+		return
+	}
+	v.Lock()
+	defer v.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		var secret azureKeyVaultSecret
+		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
+			writeVaultResponse(w, http.StatusBadRequest, nil)
+			return
+		}
+		secret.ID = "http://" + r.Host + r.URL.Path + "/v1"
+		v.secrets[r.URL.Path+"/v1"] = secret
+		writeVaultResponse(w, http.StatusOK, secret)
+	case http.MethodGet:
+		v.gets++
+		secret, ok := v.secrets[r.URL.Path]
+		if !ok {
+			writeVaultResponse(w, http.StatusNotFound, map[string]interface{}{
+				"error": map[string]string{"code": "SecretNotFound", "message": "secret not found"},
+			})
+			return
+		}
+		writeVaultResponse(w, http.StatusOK, secret)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (v *fakeAzureKeyVault) getGets() int {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.gets
+}
+
+func TestAzureKeyVaultConfig(t *testing.T) {
+	c := Config{
+		Provider: ProviderAzureKeyVault,
+	}
+	err := c.Initialize()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "url is required")
+	}
+	c.AzureKeyVault.VaultURL = "myvault.vault.azure.net"
+	err = c.Initialize()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid azure key vault url")
+	}
+	c.AzureKeyVault.VaultURL = "https://myvault.vault.azure.net/"
+	c.AzureKeyVault.ClientSecret = "secret"
+	err = c.Initialize()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tenant id and client id are required")
+	}
+	c.AzureKeyVault.ClientSecret = ""
+	c.AzureKeyVault.SecretPrefix = "invalid_prefix"
+	err = c.Initialize()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid azure key vault secret prefix")
+	}
+	c.AzureKeyVault.SecretPrefix = strings.Repeat("a", maxAzureKeyVaultPrefixLen+1)
+	assert.Error(t, c.Initialize())
+	c.AzureKeyVault.SecretPrefix = ""
+	c.AzureKeyVault.CacheTTL = -1
+	err = c.Initialize()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid azure key vault cache ttl")
+	}
+
+	azConf := AzureKeyVaultConfig{
+		VaultURL: " https://myvault.vault.azure.net/ ",
+	}
+	require.NoError(t, azConf.validate())
+	assert.Equal(t, "https://myvault.vault.azure.net", azConf.VaultURL)
+	assert.Equal(t, defaultKVPrefix, azConf.SecretPrefix)
+
+	restoreSecretProvider(t)
+	c.AzureKeyVault.CacheTTL = 0
+	c.AzureKeyVault.TenantID = "tenant"
+	c.AzureKeyVault.ClientID = "client"
+	c.AzureKeyVault.ClientSecret = "secret"
+	require.NoError(t, c.Initialize())
+	assert.Equal(t, "Azure Key Vault", vfs.GetSecretProvider().Name())
+	assert.Equal(t, vfs.SecretStatusAzureKeyVault, vfs.GetSecretProvider().EncryptedStatus())
+}
+
+func TestAzureKeyVault(t *testing.T) {
+	restoreSecretProvider(t)
+	vault := &fakeAzureKeyVault{
+		secrets: make(map[string]azureKeyVaultSecret),
+	}
+	server := httptest.NewServer(vault)
+	t.Cleanup(server.Close)
+
+	config := AzureKeyVaultConfig{
+		VaultURL: server.URL,
+		CacheTTL: 60,
+	}
+	require.NoError(t, config.validate())
+	token := &fakeAzureToken{}
+	provider := newAzureKeyVaultProviderWithToken(config, token)
+	vfs.SetSecretProvider(provider)
+
+	secret := vfs.Secret{
+		Status:         vfs.SecretStatusPlain,
+		Payload:        "test secret",
+		AdditionalData: "user",
+	}
+	require.NoError(t, secret.Encrypt())
+	assert.Equal(t, vfs.SecretStatusAzureKeyVault, secret.Status)
+	assert.True(t, strings.HasPrefix(secret.Payload, defaultKVPrefix+"-"))
+	assert.Equal(t, "v1", secret.Key)
+	assert.True(t, secret.IsEncrypted())
+	assert.False(t, secret.IsReference())
+	assert.True(t, secret.IsValid())
+	vault.Lock()
+	stored, ok := vault.secrets["/secrets/"+secret.Payload+"/v1"]
+	vault.Unlock()
+	if assert.True(t, ok) {
+		assert.Equal(t, "test secret", stored.Value)
+		assert.Equal(t, "user", stored.Tags[azureKeyVaultAdditionalDataTag])
+	}
+	invalidSecret := secret
+	invalidSecret.Key = ""
+	assert.False(t, invalidSecret.IsValid())
+
+	wrongAdditionalData := secret
+	wrongAdditionalData.AdditionalData = "another user"
+	err := wrongAdditionalData.Decrypt()
+	if assert.Error(t, err) {
+		assert.True(t, vfs.IsSecretResolutionError(err))
+		assert.Contains(t, err.Error(), errAzureKeyVaultAdditionalDataMismatch.Error())
+	}
+	encryptedSecret := secret
+	require.NoError(t, secret.Decrypt())
+	assert.Equal(t, vfs.SecretStatusPlain, secret.Status)
+	assert.Equal(t, "test secret", secret.Payload)
+	assert.Equal(t, 2, vault.getGets())
+	// the value is cached, Key Vault is not contacted again
+	secret = encryptedSecret
+	require.NoError(t, secret.Decrypt())
+	assert.Equal(t, "test secret", secret.Payload)
+	assert.Equal(t, 2, vault.getGets())
+	// if Key Vault is unreachable the decryption fails with a resolution error
+	provider.cache = newSecretsCache(0)
+	token.err = errors.New("token error")
+	secret = encryptedSecret
+	err = secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.True(t, vfs.IsSecretResolutionError(err))
+		assert.Contains(t, err.Error(), "unable to get an Azure AD token")
+	}
+	assert.Equal(t, vfs.SecretStatusAzureKeyVault, secret.Status)
+	token.err = nil
+	server.Close()
+	err = secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.True(t, vfs.IsSecretResolutionError(err))
+		assert.Contains(t, err.Error(), "unable to send request to azure key vault")
+	}
+	plainSecret := vfs.Secret{
+		Status:  vfs.SecretStatusPlain,
+		Payload: "value",
+	}
+	assert.Error(t, plainSecret.Encrypt())
+
+	server = httptest.NewServer(vault)
+	t.Cleanup(server.Close)
+	provider.config.VaultURL = server.URL
+	secret = vfs.Secret{
+		Status:  vfs.SecretStatusAzureKeyVault,
+		Payload: "sftpgo-missing",
+		Key:     "v1",
+	}
+	err = secret.Decrypt()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "SecretNotFound")
+	}
+	_, err = provider.Decrypt("", "v1", "")
+	assert.Error(t, err)
+}
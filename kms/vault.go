@@ -0,0 +1,223 @@
+package kms
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/drakkan/sftpgo/httpclient"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+var errVaultAdditionalDataMismatch = errors.New("vault secret additional data mismatch")
+
+type vaultResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []string        `json:"errors"`
+}
+
+type vaultKVSecret struct {
+	Value          string `json:"value"`
+	AdditionalData string `json:"additional_data,omitempty"`
+}
+
+// vaultProvider encrypts the secrets using the Vault transit secrets engine
+// or stores them inside a Vault KV secrets engine
+type vaultProvider struct {
+	config VaultConfig
+}
+
+func newVaultProvider(config VaultConfig) (*vaultProvider, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &vaultProvider{
+		config: config,
+	}, nil
+}
+
+func (p *vaultProvider) Name() string {
+	return "HashiCorp Vault"
+}
+
+func (p *vaultProvider) EncryptedStatus() vfs.SecretStatus {
+	if p.config.Mode == VaultModeKV {
+		return vfs.SecretStatusVaultKV
+	}
+	return vfs.SecretStatusVaultTransit
+}
+
+// Encrypt returns the encrypted payload and the key to use to decrypt it.
+// In transit mode the key is "<mount path>/<key name>", in KV mode the
+// payload is the path of the secret and the key is the KV mount path
+func (p *vaultProvider) Encrypt(payload, additionalData string) (string, string, error) {
+	if p.config.Mode == VaultModeKV {
+		return p.kvWrite(payload, additionalData)
+	}
+	return p.transitEncrypt(payload)
+}
+
+func (p *vaultProvider) Decrypt(payload, key, additionalData string) (string, error) {
+	if p.config.Mode == VaultModeKV {
+		return p.kvRead(payload, key, additionalData)
+	}
+	return p.transitDecrypt(payload, key)
+}
+
+func (p *vaultProvider) transitEncrypt(payload string) (string, string, error) {
+	body := map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString([]byte(payload)),
+	}
+	var result struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	err := p.doRequest(http.MethodPost, path.Join(p.config.TransitPath, "encrypt", p.config.TransitKey), body, &result)
+	if err != nil {
+		return "", "", err
+	}
+	if result.Ciphertext == "" {
+		return "", "", errors.New("vault returned an empty ciphertext")
+	}
+	return result.Ciphertext, path.Join(p.config.TransitPath, p.config.TransitKey), nil
+}
+
+func (p *vaultProvider) transitDecrypt(payload, key string) (string, error) {
+	mountPath, keyName := path.Split(key)
+	mountPath = strings.Trim(mountPath, "/")
+	if mountPath == "" || keyName == "" {
+		return "", fmt.Errorf("invalid vault transit key %#v", key)
+	}
+	body := map[string]string{
+		"ciphertext": payload,
+	}
+	var result struct {
+		Plaintext string `json:"plaintext"`
+	}
+	err := p.doRequest(http.MethodPost, path.Join(mountPath, "decrypt", keyName), body, &result)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(result.Plaintext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func (p *vaultProvider) kvWrite(payload, additionalData string) (string, string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", "", err
+	}
+	secretPath := path.Join(p.config.KVPrefix, hex.EncodeToString(id))
+	secret := vaultKVSecret{
+		Value:          payload,
+		AdditionalData: additionalData,
+	}
+	var body interface{} = secret
+	if p.config.KVVersion == 2 {
+		body = map[string]interface{}{
+			"data": secret,
+		}
+	}
+	err := p.doRequest(http.MethodPost, p.getKVAPIPath(p.config.KVPath, secretPath), body, nil)
+	if err != nil {
+		return "", "", err
+	}
+	return secretPath, p.config.KVPath, nil
+}
+
+func (p *vaultProvider) kvRead(payload, key, additionalData string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("invalid vault kv mount path %#v", key)
+	}
+	var secret vaultKVSecret
+	var err error
+	if p.config.KVVersion == 2 {
+		var result struct {
+			Data vaultKVSecret `json:"data"`
+		}
+		err = p.doRequest(http.MethodGet, p.getKVAPIPath(key, payload), nil, &result)
+		secret = result.Data
+	} else {
+		err = p.doRequest(http.MethodGet, p.getKVAPIPath(key, payload), nil, &secret)
+	}
+	if err != nil {
+		return "", err
+	}
+	if secret.AdditionalData != additionalData {
+		return "", errVaultAdditionalDataMismatch
+	}
+	return secret.Value, nil
+}
+
+func (p *vaultProvider) getKVAPIPath(mountPath, secretPath string) string {
+	if p.config.KVVersion == 2 {
+		return path.Join(mountPath, "data", secretPath)
+	}
+	return path.Join(mountPath, secretPath)
+}
+
+// doRequest sends a request to the Vault HTTP API and, if result is not nil,
+// unmarshals the "data" field of the response into it
+func (p *vaultProvider) doRequest(method, apiPath string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		asJSON, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(asJSON)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%v/v1/%v", p.config.URL, apiPath), reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", p.config.Token)
+	req.Header.Set("X-Vault-Request", "true")
+	if p.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.config.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := httpclient.GetHTTPClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to send request to vault: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var vaultResp vaultResponse
+	if len(respBody) > 0 {
+		if err = json.Unmarshal(respBody, &vaultResp); err != nil && resp.StatusCode < 300 {
+			return fmt.Errorf("unable to decode vault response: %v", err)
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if len(vaultResp.Errors) > 0 {
+			return fmt.Errorf("vault request failed, status code: %v, errors: %v", resp.StatusCode,
+				strings.Join(vaultResp.Errors, ", "))
+		}
+		return fmt.Errorf("vault request failed, status code: %v", resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	if len(vaultResp.Data) == 0 {
+		return errors.New("vault returned an empty response")
+	}
+	return json.Unmarshal(vaultResp.Data, result)
+}
@@ -161,12 +161,14 @@ func ErrorToConsole(format string, v ...interface{}) {
 }
 
 // TransferLog logs an SFTP/SCP upload or download
-func TransferLog(operation string, path string, elapsed int64, size int64, user string, connectionID string, protocol string) {
+func TransferLog(operation string, path string, elapsed int64, size int64, user string, connectionID string, protocol string,
+	partial bool) {
 	logger.Info().
 		Timestamp().
 		Str("sender", operation).
 		Int64("elapsed_ms", elapsed).
 		Int64("size_bytes", size).
+		Bool("partial", partial).
 		Str("username", user).
 		Str("file_path", path).
 		Str("connection_id", connectionID).
@@ -195,6 +197,21 @@ func CommandLog(command, path, target, user, fileMode, connectionID, protocol st
 		Send()
 }
 
+// AuditLog logs a change made by an administrator using the REST API or the web admin
+func AuditLog(admin, ip, requestID, action, objectType, objectName string, changes interface{}) {
+	logger.Info().
+		Timestamp().
+		Str("sender", "audit").
+		Str("admin", admin).
+		Str("client_ip", ip).
+		Str("request_id", requestID).
+		Str("action", action).
+		Str("object_type", objectType).
+		Str("object_name", objectName).
+		Interface("changes", changes).
+		Send()
+}
+
 // ConnectionFailedLog logs failed attempts to initialize a connection.
 // A connection can fail for an authentication error or other errors such as
 // a client abort or a time out if the login does not happen in two minutes.
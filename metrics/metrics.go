@@ -4,6 +4,8 @@
 package metrics
 
 import (
+	"sync"
+
 	"github.com/go-chi/chi"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -17,8 +19,25 @@ const (
 	loginMethodKeyboardInteractive = "keyboard-interactive"
 	loginMethodKeyAndPassword      = "publickey+password"
 	loginMethodKeyAndKeyboardInt   = "publickey+keyboard-interactive"
+	directionUpload                = "upload"
+	directionDownload              = "download"
+	loginResultOK                  = "ok"
+	loginResultKO                  = "ko"
 )
 
+// perUserMetrics enables the metrics labeled by username. It is disabled by default,
+// each user adds new time series
+var perUserMetrics bool
+
+// userProtocols tracks the protocols with per-user metrics for each user, so the
+// time series can be removed when a user is deleted
+var userProtocols = struct {
+	sync.Mutex
+	protocols map[string]map[string]bool
+}{
+	protocols: make(map[string]map[string]bool),
+}
+
 func init() {
 	version.AddFeature("+metrics")
 }
@@ -36,6 +55,13 @@ var (
 		Help: "Total number of logged in users",
 	})
 
+	// downloadVolumeRemaining is the metric that reports the remaining download volume, in bytes,
+	// for the current period. It is reported for users with a download volume limit only
+	downloadVolumeRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_download_volume_remaining_bytes",
+		Help: "Remaining download volume, in bytes, for the current period for users with a download volume limit",
+	}, []string{"username"})
+
 	// totalUploads is the metric that reports the total number of successful uploads
 	totalUploads = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "sftpgo_uploads_total",
@@ -521,15 +547,200 @@ var (
 		Name: "sftpgo_az_head_container_errors",
 		Help: "The total number of Azure head container errors",
 	})
+
+	// totalB2Uploads is the metric that reports the total number of successful B2 uploads
+	totalB2Uploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_uploads_total",
+		Help: "The total number of successful B2 uploads",
+	})
+
+	// totalB2Downloads is the metric that reports the total number of successful B2 downloads
+	totalB2Downloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_downloads_total",
+		Help: "The total number of successful B2 downloads",
+	})
+
+	// totalB2UploadErrors is the metric that reports the total number of B2 upload errors
+	totalB2UploadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_upload_errors_total",
+		Help: "The total number of B2 upload errors",
+	})
+
+	// totalB2DownloadErrors is the metric that reports the total number of B2 download errors
+	totalB2DownloadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_download_errors_total",
+		Help: "The total number of B2 download errors",
+	})
+
+	// totalB2UploadSize is the metric that reports the total B2 uploads size as bytes
+	totalB2UploadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_upload_size",
+		Help: "The total B2 upload size as bytes, partial uploads are included",
+	})
+
+	// totalB2DownloadSize is the metric that reports the total B2 downloads size as bytes
+	totalB2DownloadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_download_size",
+		Help: "The total B2 download size as bytes, partial downloads are included",
+	})
+
+	// totalB2ListObjects is the metric that reports the total successful B2 list objects requests
+	totalB2ListObjects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_list_objects",
+		Help: "The total number of successful B2 list objects requests",
+	})
+
+	// totalB2CopyObject is the metric that reports the total successful B2 copy object requests
+	totalB2CopyObject = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_copy_object",
+		Help: "The total number of successful B2 copy object requests",
+	})
+
+	// totalB2DeleteObject is the metric that reports the total successful B2 delete object requests
+	totalB2DeleteObject = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_delete_object",
+		Help: "The total number of successful B2 delete object requests",
+	})
+
+	// totalB2ListObjectsErrors is the metric that reports the total B2 list objects errors
+	totalB2ListObjectsErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_list_objects_errors",
+		Help: "The total number of B2 list objects errors",
+	})
+
+	// totalB2CopyObjectErrors is the metric that reports the total B2 copy object errors
+	totalB2CopyObjectErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_copy_object_errors",
+		Help: "The total number of B2 copy object errors",
+	})
+
+	// totalB2DeleteObjectErrors is the metric that reports the total B2 delete object errors
+	totalB2DeleteObjectErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_b2_delete_object_errors",
+		Help: "The total number of B2 delete object errors",
+	})
+
+	// totalFsCacheHits is the metric that reports the total reads served from the local read-through cache
+	totalFsCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_fs_cache_hits_total",
+		Help: "The total number of reads served from the local read-through cache",
+	})
+
+	// totalFsCacheMisses is the metric that reports the total cacheable reads served from the storage backend
+	totalFsCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_fs_cache_misses_total",
+		Help: "The total number of cacheable reads served from the storage backend",
+	})
+
+	// totalLoginProviderRetries is the metric that reports the total data provider user lookups
+	// retried at login time after a transient error
+	totalLoginProviderRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_login_provider_retries_total",
+		Help: "The total number of data provider user lookups retried at login after a transient error",
+	})
+
+	// protocolTransferBytes is the metric that reports the transferred bytes for each protocol and direction
+	protocolTransferBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_protocol_transfer_bytes_total",
+		Help: "The total number of transferred bytes by protocol and direction",
+	}, []string{"protocol", "direction"})
+
+	// protocolActiveConnections is the metric that reports the active connections for each protocol
+	protocolActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_protocol_active_connections",
+		Help: "Number of active connections by protocol",
+	}, []string{"protocol"})
+
+	// protocolLogins is the metric that reports the login results for each protocol
+	protocolLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_protocol_logins_total",
+		Help: "The total number of logins by protocol and result",
+	}, []string{"protocol", "result"})
+
+	// userTransferBytes is the metric that reports the transferred bytes for each user,
+	// protocol and direction. It is reported if the per-user metrics are enabled
+	userTransferBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_user_transfer_bytes_total",
+		Help: "The total number of transferred bytes by user, protocol and direction",
+	}, []string{"username", "protocol", "direction"})
+
+	// userActiveConnections is the metric that reports the active connections for each user
+	// and protocol. It is reported if the per-user metrics are enabled
+	userActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_user_active_connections",
+		Help: "Number of active connections by user and protocol",
+	}, []string{"username", "protocol"})
+
+	// userLogins is the metric that reports the login results for each user and protocol.
+	// It is reported if the per-user metrics are enabled
+	userLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_user_logins_total",
+		Help: "The total number of logins by user, protocol and result",
+	}, []string{"username", "protocol", "result"})
+
+	// userQuotaUsedBytes is the metric that reports the used quota size for each user.
+	// It is reported if the per-user metrics are enabled
+	userQuotaUsedBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_user_quota_used_bytes",
+		Help: "Used quota, in bytes, by user",
+	}, []string{"username"})
+
+	// userQuotaUsedFiles is the metric that reports the used quota files for each user.
+	// It is reported if the per-user metrics are enabled
+	userQuotaUsedFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_user_quota_used_files",
+		Help: "Used quota, as number of files, by user",
+	}, []string{"username"})
+
+	// userQuotaLimitBytes is the metric that reports the quota size limit for each user,
+	// 0 means unlimited. It is reported if the per-user metrics are enabled
+	userQuotaLimitBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_user_quota_limit_bytes",
+		Help: "Quota size limit, in bytes, by user. 0 means unlimited",
+	}, []string{"username"})
+
+	// userQuotaLimitFiles is the metric that reports the quota files limit for each user,
+	// 0 means unlimited. It is reported if the per-user metrics are enabled
+	userQuotaLimitFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_user_quota_limit_files",
+		Help: "Quota files limit by user. 0 means unlimited",
+	}, []string{"username"})
 )
 
+// SetPerUserMetrics enables or disables the metrics labeled by username.
+//
+// Do NOT call this function after application initialization.
+func SetPerUserMetrics(enabled bool) {
+	perUserMetrics = enabled
+}
+
+// IsPerUserMetricsEnabled returns true if the metrics labeled by username are enabled
+func IsPerUserMetricsEnabled() bool {
+	return perUserMetrics
+}
+
+// addUserProtocol records that per-user metrics exist for the given user and protocol
+func addUserProtocol(username, protocol string) {
+	userProtocols.Lock()
+	defer userProtocols.Unlock()
+
+	protocols, ok := userProtocols.protocols[username]
+	if !ok {
+		protocols = make(map[string]bool)
+		userProtocols.protocols[username] = protocols
+	}
+	protocols[protocol] = true
+}
+
 // AddMetricsEndpoint exposes metrics to the specified endpoint
 func AddMetricsEndpoint(metricsPath string, handler chi.Router) {
 	handler.Handle(metricsPath, promhttp.Handler())
 }
 
 // TransferCompleted updates metrics after an upload or a download
-func TransferCompleted(bytesSent, bytesReceived int64, transferKind int, err error) {
+func TransferCompleted(bytesSent, bytesReceived int64, transferKind int, protocol, username string, err error) {
+	direction := directionUpload
+	bytes := bytesReceived
 	if transferKind == 0 {
 		// upload
 		if err == nil {
@@ -546,6 +757,13 @@ func TransferCompleted(bytesSent, bytesReceived int64, transferKind int, err err
 			totalDownloadErrors.Inc()
 		}
 		totalDownloadSize.Add(float64(bytesSent))
+		direction = directionDownload
+		bytes = bytesSent
+	}
+	protocolTransferBytes.WithLabelValues(protocol, direction).Add(float64(bytes))
+	if perUserMetrics && username != "" {
+		addUserProtocol(username, protocol)
+		userTransferBytes.WithLabelValues(username, protocol, direction).Add(float64(bytes))
 	}
 }
 
@@ -747,6 +965,54 @@ func AZHeadContainerCompleted(err error) {
 	}
 }
 
+// B2TransferCompleted updates metrics after a B2 upload or a download
+func B2TransferCompleted(bytes int64, transferKind int, err error) {
+	if transferKind == 0 {
+		// upload
+		if err == nil {
+			totalB2Uploads.Inc()
+		} else {
+			totalB2UploadErrors.Inc()
+		}
+		totalB2UploadSize.Add(float64(bytes))
+	} else {
+		// download
+		if err == nil {
+			totalB2Downloads.Inc()
+		} else {
+			totalB2DownloadErrors.Inc()
+		}
+		totalB2DownloadSize.Add(float64(bytes))
+	}
+}
+
+// B2ListObjectsCompleted updates metrics after a B2 list objects request terminates
+func B2ListObjectsCompleted(err error) {
+	if err == nil {
+		totalB2ListObjects.Inc()
+	} else {
+		totalB2ListObjectsErrors.Inc()
+	}
+}
+
+// B2CopyObjectCompleted updates metrics after a B2 copy object request terminates
+func B2CopyObjectCompleted(err error) {
+	if err == nil {
+		totalB2CopyObject.Inc()
+	} else {
+		totalB2CopyObjectErrors.Inc()
+	}
+}
+
+// B2DeleteObjectCompleted updates metrics after a B2 delete object request terminates
+func B2DeleteObjectCompleted(err error) {
+	if err == nil {
+		totalB2DeleteObject.Inc()
+	} else {
+		totalB2DeleteObjectErrors.Inc()
+	}
+}
+
 // SSHCommandCompleted update metrics after an SSH command terminates
 func SSHCommandCompleted(err error) {
 	if err == nil {
@@ -782,8 +1048,18 @@ func AddLoginAttempt(authMethod string) {
 	}
 }
 
-// AddLoginResult increments the metrics for login results
-func AddLoginResult(authMethod string, err error) {
+// AddLoginResult increments the metrics for login results. The per-user metrics
+// are not updated if username is empty
+func AddLoginResult(authMethod, protocol, username string, err error) {
+	result := loginResultOK
+	if err != nil {
+		result = loginResultKO
+	}
+	protocolLogins.WithLabelValues(protocol, result).Inc()
+	if perUserMetrics && username != "" {
+		addUserProtocol(username, protocol)
+		userLogins.WithLabelValues(username, protocol, result).Inc()
+	}
 	if err == nil {
 		totalLoginOK.Inc()
 		switch authMethod {
@@ -837,3 +1113,77 @@ func HTTPRequestServed(status int) {
 func UpdateActiveConnectionsSize(size int) {
 	activeConnections.Set(float64(size))
 }
+
+// AddActiveConnection increments the active connections metrics for the given protocol and user.
+// The per-user metrics are not updated if username is empty, for example before the login
+func AddActiveConnection(protocol, username string) {
+	protocolActiveConnections.WithLabelValues(protocol).Inc()
+	if perUserMetrics && username != "" {
+		addUserProtocol(username, protocol)
+		userActiveConnections.WithLabelValues(username, protocol).Inc()
+	}
+}
+
+// RemoveActiveConnection decrements the active connections metrics for the given protocol and user
+func RemoveActiveConnection(protocol, username string) {
+	protocolActiveConnections.WithLabelValues(protocol).Dec()
+	if perUserMetrics && username != "" {
+		userActiveConnections.WithLabelValues(username, protocol).Dec()
+	}
+}
+
+// UpdateUserQuota sets the quota metrics for the given user
+func UpdateUserQuota(username string, usedFiles int, usedSize int64, quotaFiles int, quotaSize int64) {
+	if !perUserMetrics {
+		return
+	}
+	userQuotaUsedFiles.WithLabelValues(username).Set(float64(usedFiles))
+	userQuotaUsedBytes.WithLabelValues(username).Set(float64(usedSize))
+	userQuotaLimitFiles.WithLabelValues(username).Set(float64(quotaFiles))
+	userQuotaLimitBytes.WithLabelValues(username).Set(float64(quotaSize))
+}
+
+// RemoveUserMetrics removes all the per-user metrics for the given user
+func RemoveUserMetrics(username string) {
+	if !perUserMetrics {
+		return
+	}
+	userQuotaUsedFiles.DeleteLabelValues(username)
+	userQuotaUsedBytes.DeleteLabelValues(username)
+	userQuotaLimitFiles.DeleteLabelValues(username)
+	userQuotaLimitBytes.DeleteLabelValues(username)
+	downloadVolumeRemaining.DeleteLabelValues(username)
+
+	userProtocols.Lock()
+	defer userProtocols.Unlock()
+
+	for protocol := range userProtocols.protocols[username] {
+		userActiveConnections.DeleteLabelValues(username, protocol)
+		for _, direction := range []string{directionUpload, directionDownload} {
+			userTransferBytes.DeleteLabelValues(username, protocol, direction)
+		}
+		for _, result := range []string{loginResultOK, loginResultKO} {
+			userLogins.DeleteLabelValues(username, protocol, result)
+		}
+	}
+	delete(userProtocols.protocols, username)
+}
+
+// UpdateDownloadVolumeRemaining sets the metric for the remaining download volume for the given user
+func UpdateDownloadVolumeRemaining(username string, remaining int64) {
+	downloadVolumeRemaining.WithLabelValues(username).Set(float64(remaining))
+}
+
+// FsCacheAccessed increments the metrics for the local read-through cache
+func FsCacheAccessed(hit bool) {
+	if hit {
+		totalFsCacheHits.Inc()
+	} else {
+		totalFsCacheMisses.Inc()
+	}
+}
+
+// AddLoginProviderRetry increments the metric for the login-time data provider retries
+func AddLoginProviderRetry() {
+	totalLoginProviderRetries.Inc()
+}
@@ -16,7 +16,7 @@ func init() {
 func AddMetricsEndpoint(metricsPath string, handler chi.Router) {}
 
 // TransferCompleted updates metrics after an upload or a download
-func TransferCompleted(bytesSent, bytesReceived int64, transferKind int, err error) {}
+func TransferCompleted(bytesSent, bytesReceived int64, transferKind int, protocol, username string, err error) {}
 
 // S3TransferCompleted updates metrics after an S3 upload or a download
 func S3TransferCompleted(bytes int64, transferKind int, err error) {}
@@ -48,6 +48,18 @@ func GCSDeleteObjectCompleted(err error) {}
 // GCSHeadBucketCompleted updates metrics after a GCS head bucket request terminates
 func GCSHeadBucketCompleted(err error) {}
 
+// B2TransferCompleted updates metrics after a B2 upload or a download
+func B2TransferCompleted(bytes int64, transferKind int, err error) {}
+
+// B2ListObjectsCompleted updates metrics after a B2 list objects request terminates
+func B2ListObjectsCompleted(err error) {}
+
+// B2CopyObjectCompleted updates metrics after a B2 copy object request terminates
+func B2CopyObjectCompleted(err error) {}
+
+// B2DeleteObjectCompleted updates metrics after a B2 delete object request terminates
+func B2DeleteObjectCompleted(err error) {}
+
 // SSHCommandCompleted update metrics after an SSH command terminates
 func SSHCommandCompleted(err error) {}
 
@@ -57,8 +69,9 @@ func UpdateDataProviderAvailability(err error) {}
 // AddLoginAttempt increments the metrics for login attempts
 func AddLoginAttempt(authMethod string) {}
 
-// AddLoginResult increments the metrics for login results
-func AddLoginResult(authMethod string, err error) {}
+// AddLoginResult increments the metrics for login results. The per-user metrics
+// are not updated if username is empty
+func AddLoginResult(authMethod, protocol, username string, err error) {}
 
 // AddNoAuthTryed increments the metric for clients disconnected
 // for inactivity before trying to login
@@ -69,3 +82,35 @@ func HTTPRequestServed(status int) {}
 
 // UpdateActiveConnectionsSize sets the metric for active connections
 func UpdateActiveConnectionsSize(size int) {}
+
+// SetPerUserMetrics enables or disables the metrics labeled by username.
+//
+// Do NOT call this function after application initialization.
+func SetPerUserMetrics(enabled bool) {}
+
+// IsPerUserMetricsEnabled returns true if the metrics labeled by username are enabled
+func IsPerUserMetricsEnabled() bool {
+	return false
+}
+
+// AddActiveConnection increments the active connections metrics for the given protocol and user.
+// The per-user metrics are not updated if username is empty, for example before the login
+func AddActiveConnection(protocol, username string) {}
+
+// RemoveActiveConnection decrements the active connections metrics for the given protocol and user
+func RemoveActiveConnection(protocol, username string) {}
+
+// UpdateUserQuota sets the quota metrics for the given user
+func UpdateUserQuota(username string, usedFiles int, usedSize int64, quotaFiles int, quotaSize int64) {}
+
+// RemoveUserMetrics removes all the per-user metrics for the given user
+func RemoveUserMetrics(username string) {}
+
+// UpdateDownloadVolumeRemaining sets the metric for the remaining download volume for the given user
+func UpdateDownloadVolumeRemaining(username string, remaining int64) {}
+
+// FsCacheAccessed increments the metrics for the local read-through cache
+func FsCacheAccessed(hit bool) {}
+
+// AddLoginProviderRetry increments the metric for the login-time data provider retries
+func AddLoginProviderRetry() {}
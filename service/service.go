@@ -83,9 +83,20 @@ func (s *Service) Start() error {
 
 	common.Initialize(config.GetCommonConfig())
 
+	httpConfig := config.GetHTTPConfig()
+	httpConfig.Initialize(s.ConfigDir)
+
+	kmsConfig := config.GetKMSConfig()
+	err := kmsConfig.Initialize()
+	if err != nil {
+		logger.Error(logSender, "", "error initializing the secret provider: %v", err)
+		logger.ErrorToConsole("error initializing the secret provider: %v", err)
+		return err
+	}
+
 	providerConf := config.GetProviderConf()
 
-	err := dataprovider.Initialize(providerConf, s.ConfigDir)
+	err = dataprovider.Initialize(providerConf, s.ConfigDir)
 	if err != nil {
 		logger.Error(logSender, "", "error initializing data provider: %v", err)
 		logger.ErrorToConsole("error initializing data provider: %v", err)
@@ -108,9 +119,6 @@ func (s *Service) Start() error {
 		return err
 	}
 
-	httpConfig := config.GetHTTPConfig()
-	httpConfig.Initialize(s.ConfigDir)
-
 	s.startServices()
 
 	return nil
@@ -217,10 +225,18 @@ func (s *Service) loadInitialData() error {
 	if err != nil {
 		return fmt.Errorf("unable to read input file %#v: %v", s.LoadDataFrom, err)
 	}
+	content, err = httpd.DecryptBackupData(content, config.GetHTTPDConfig().ScheduledBackups.Passphrase)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt input file %#v: %v", s.LoadDataFrom, err)
+	}
 	dump, err := dataprovider.ParseDumpData(content)
 	if err != nil {
 		return fmt.Errorf("unable to parse file to restore %#v: %v", s.LoadDataFrom, err)
 	}
+	err = httpd.RestoreGroups(dump.Groups, s.LoadDataFrom, s.LoadDataMode)
+	if err != nil {
+		return fmt.Errorf("unable to restore groups from file %#v: %v", s.LoadDataFrom, err)
+	}
 	err = httpd.RestoreFolders(dump.Folders, s.LoadDataFrom, s.LoadDataQuotaScan)
 	if err != nil {
 		return fmt.Errorf("unable to restore folders from file %#v: %v", s.LoadDataFrom, err)
@@ -214,6 +214,10 @@ func (s *Service) getPortableDirToServe() string {
 		dirToServe = s.PortableUser.FsConfig.S3Config.KeyPrefix
 	} else if s.PortableUser.FsConfig.Provider == dataprovider.GCSFilesystemProvider {
 		dirToServe = s.PortableUser.FsConfig.GCSConfig.KeyPrefix
+	} else if s.PortableUser.FsConfig.Provider == dataprovider.B2FilesystemProvider {
+		dirToServe = s.PortableUser.FsConfig.B2Config.KeyPrefix
+	} else if s.PortableUser.FsConfig.Provider == dataprovider.SFTPFilesystemProvider {
+		dirToServe = s.PortableUser.FsConfig.SFTPConfig.Prefix
 	} else {
 		dirToServe = s.PortableUser.HomeDir
 	}
@@ -0,0 +1,140 @@
+package sftpd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// maxClientVersionBytes is the maximum number of bytes allowed, before the
+// SSH identification string, by RFC 4253 section 4.2
+const maxClientVersionBytes = 255
+
+type clientVersionDeniedError struct {
+	version string
+	rule    string
+}
+
+func (e *clientVersionDeniedError) Error() string {
+	return fmt.Sprintf("client version %#v denied by rule %#v", e.version, e.rule)
+}
+
+// clientVersionRule matches a client identification string.
+// Rules starting with "^" are regular expressions, the other ones
+// are matched as substrings
+type clientVersionRule struct {
+	rule string
+	re   *regexp.Regexp
+}
+
+func (r *clientVersionRule) match(version string) bool {
+	if r.re != nil {
+		return r.re.MatchString(version)
+	}
+	return strings.Contains(version, r.rule)
+}
+
+func parseClientVersionRules(rules []string) ([]clientVersionRule, error) {
+	var result []clientVersionRule
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		r := clientVersionRule{
+			rule: rule,
+		}
+		if strings.HasPrefix(rule, "^") {
+			re, err := regexp.Compile(rule)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client version regexp %#v: %v", rule, err)
+			}
+			r.re = re
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func (c *Configuration) initializeClientVersionRules() error {
+	var err error
+	c.allowedClientVersions, err = parseClientVersionRules(c.AllowedClientVersions)
+	if err != nil {
+		return err
+	}
+	c.deniedClientVersions, err = parseClientVersionRules(c.DeniedClientVersions)
+	return err
+}
+
+func (c *Configuration) hasClientVersionRules() bool {
+	return len(c.deniedClientVersions) > 0
+}
+
+// checkClientVersion returns an error if the specified client identification string
+// matches a denied rule and no allowed rule. Any other client is allowed
+func (c *Configuration) checkClientVersion(version string) error {
+	for _, denied := range c.deniedClientVersions {
+		if denied.match(version) {
+			for _, allowed := range c.allowedClientVersions {
+				if allowed.match(version) {
+					return nil
+				}
+			}
+			return &clientVersionDeniedError{
+				version: version,
+				rule:    denied.rule,
+			}
+		}
+	}
+	return nil
+}
+
+// clientVersionConn is a net.Conn wrapper that inspects the client identification string
+// while the SSH library reads it, the connection is refused, before the key exchange,
+// if the client version is denied
+type clientVersionConn struct {
+	net.Conn
+	config   *Configuration
+	buf      []byte
+	consumed int
+	checked  bool
+}
+
+func (c *clientVersionConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.checked || n == 0 {
+		return n, err
+	}
+	c.buf = append(c.buf, p[:n]...)
+	for !c.checked {
+		idx := bytes.IndexByte(c.buf, '\n')
+		if (idx < 0 && c.consumed+len(c.buf) > maxClientVersionBytes) || c.consumed+idx > maxClientVersionBytes {
+			// invalid identification string, the SSH library will refuse it
+			c.checked = true
+			c.buf = nil
+			break
+		}
+		if idx < 0 {
+			break
+		}
+		line := c.buf[:idx]
+		c.buf = c.buf[idx+1:]
+		c.consumed += idx + 1
+		if !bytes.HasPrefix(line, []byte("SSH-")) {
+			continue
+		}
+		c.checked = true
+		c.buf = nil
+		version := strings.TrimSuffix(string(line), "\r")
+		if errVersion := c.config.checkClientVersion(version); errVersion != nil {
+			logger.Info(logSender, "", "connection from %v refused: %v",
+				utils.GetIPFromRemoteAddress(c.RemoteAddr().String()), errVersion)
+			return 0, errVersion
+		}
+	}
+	return n, err
+}
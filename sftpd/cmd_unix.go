@@ -3,6 +3,7 @@
 package sftpd
 
 import (
+	"errors"
 	"os/exec"
 	"syscall"
 )
@@ -14,3 +15,13 @@ func wrapCmd(cmd *exec.Cmd, uid, gid int) *exec.Cmd {
 	}
 	return cmd
 }
+
+// checkExecCredentials returns an error if the allowed exec commands cannot be executed
+// using the given uid and gid. A zero uid or gid means that the command would be executed
+// as the SFTPGo service user, or as root, so it is refused
+func checkExecCredentials(uid, gid int) error {
+	if uid <= 0 || gid <= 0 {
+		return errors.New("allowed exec commands require a user with a non-zero uid and gid")
+	}
+	return nil
+}
@@ -1,9 +1,16 @@
 package sftpd
 
 import (
+	"errors"
 	"os/exec"
 )
 
 func wrapCmd(cmd *exec.Cmd, uid, gid int) *exec.Cmd {
 	return cmd
 }
+
+// checkExecCredentials returns an error, the user's credentials cannot be set on Windows
+// so the allowed exec commands would be executed as the SFTPGo service user
+func checkExecCredentials(uid, gid int) error {
+	return errors.New("allowed exec commands are not supported on Windows")
+}
@@ -24,6 +24,8 @@ type Connection struct {
 	RemoteAddr net.Addr
 	channel    io.ReadWriteCloser
 	command    string
+	// maximum time to wait for a paged directory listing, 0 means no limit
+	listAsyncThreshold time.Duration
 }
 
 // GetClientVersion returns the connected client's version
@@ -33,7 +35,10 @@ func (c *Connection) GetClientVersion() string {
 
 // GetRemoteAddress return the connected client's address
 func (c *Connection) GetRemoteAddress() string {
-	return c.RemoteAddr.String()
+	if c.RemoteAddr != nil {
+		return c.RemoteAddr.String()
+	}
+	return ""
 }
 
 // GetCommand returns the SSH command, if any
@@ -45,7 +50,7 @@ func (c *Connection) GetCommand() string {
 func (c *Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 	c.UpdateLastActivity()
 
-	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(request.Filepath)) {
+	if !c.User.HasFilePerm(dataprovider.PermDownload, request.Filepath) {
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
@@ -54,10 +59,26 @@ func (c *Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
+	if err := c.CheckDownloadVolumeLimit(); err != nil {
+		return nil, err
+	}
+	if err := c.CheckOpenFilesLimit(); err != nil {
+		return nil, c.GetGenericError(err)
+	}
+	if err := c.CheckConcurrentTransfersLimit(common.TransferDownload); err != nil {
+		return nil, c.GetGenericError(err)
+	}
+
 	p, err := c.Fs.ResolvePath(request.Filepath)
 	if err != nil {
 		return nil, c.GetFsError(err)
 	}
+	if err := c.CheckDownloadFileSize(p, request.Filepath, nil); err != nil {
+		return nil, c.GetGenericError(err)
+	}
+	if err := c.CheckPreDownloadHook(p, request.Filepath, c.GetRemoteAddress(), nil); err != nil {
+		return nil, c.GetGenericError(err)
+	}
 
 	file, r, cancelFn, err := c.Fs.Open(p, 0)
 	if err != nil {
@@ -85,15 +106,33 @@ func (c *Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReaderAt, error) {
 	c.UpdateLastActivity()
 
-	if !c.User.IsFileAllowed(request.Filepath) {
+	if !c.User.IsFileAllowed(request.Filepath) || !c.User.IsUploadNameAllowed(request.Filepath) {
 		c.Log(logger.LevelWarn, "writing file %#v is not allowed", request.Filepath)
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
+	if err := c.IsUploadOrderAllowed(request.Filepath); err != nil {
+		return nil, err
+	}
+	if err := c.IsPathSchemaAllowed(request.Filepath, false); err != nil {
+		return nil, err
+	}
+	if err := c.CheckDirectoryFilesLimit(request.Filepath); err != nil {
+		return nil, err
+	}
+	if err := c.CheckOpenFilesLimit(); err != nil {
+		return nil, c.GetGenericError(err)
+	}
+	if err := c.CheckConcurrentTransfersLimit(common.TransferUpload); err != nil {
+		return nil, c.GetGenericError(err)
+	}
 
 	p, err := c.Fs.ResolvePath(request.Filepath)
 	if err != nil {
 		return nil, c.GetFsError(err)
 	}
+	if err := c.CheckDiskSpace(p, 0); err != nil {
+		return nil, err
+	}
 
 	filePath := p
 	if common.Config.IsAtomicUploadEnabled() && c.Fs.IsAtomicUploadSupported() {
@@ -105,7 +144,7 @@ func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReader
 		// read and write mode is only supported for local filesystem
 		errForRead = sftp.ErrSSHFxOpUnsupported
 	}
-	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(request.Filepath)) {
+	if !c.User.HasFilePerm(dataprovider.PermDownload, request.Filepath) {
 		// we can try to read only for local fs here, see above.
 		// os.ErrPermission will become sftp.ErrSSHFxPermissionDenied when sent to
 		// the client
@@ -114,9 +153,12 @@ func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReader
 
 	stat, statErr := c.Fs.Lstat(p)
 	if (statErr == nil && stat.Mode()&os.ModeSymlink != 0) || c.Fs.IsNotExist(statErr) {
-		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(request.Filepath)) {
+		if !c.User.HasFilePerm(dataprovider.PermUpload, request.Filepath) {
 			return nil, sftp.ErrSSHFxPermissionDenied
 		}
+		if err := c.CheckUploadDir(request.Filepath); err != nil {
+			return nil, err
+		}
 		return c.handleSFTPUploadToNewFile(p, filePath, request.Filepath, errForRead)
 	}
 
@@ -131,11 +173,11 @@ func (c *Connection) handleFilewrite(request *sftp.Request) (sftp.WriterAtReader
 		return nil, sftp.ErrSSHFxOpUnsupported
 	}
 
-	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(request.Filepath)) {
+	if !c.User.HasFilePerm(dataprovider.PermOverwrite, request.Filepath) {
 		return nil, sftp.ErrSSHFxPermissionDenied
 	}
 
-	return c.handleSFTPUploadToExistingFile(request.Pflags(), p, filePath, stat.Size(), request.Filepath, errForRead)
+	return c.handleSFTPUploadToExistingFile(request.Pflags(), p, filePath, vfs.GetSizeForQuota(stat), request.Filepath, errForRead)
 }
 
 // Filecmd hander for basic SFTP system calls related to files, but not anything to do with reading
@@ -192,6 +234,9 @@ func (c *Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 
 	switch request.Method {
 	case "List":
+		if c.listAsyncThreshold > 0 && vfs.IsDirPagesSupported(c.Fs) {
+			return c.listDirAsync(p, request)
+		}
 		files, err := c.ListDir(p, request.Filepath)
 		if err != nil {
 			return nil, err
@@ -253,6 +298,34 @@ func (c *Connection) Lstat(request *sftp.Request) (sftp.ListerAt, error) {
 	return listerAt([]os.FileInfo{s}), nil
 }
 
+// listDirAsync lists the specified directory in background. If the listing completes within
+// the configured threshold the whole listing is returned, as usual, otherwise the entries
+// are returned to the client as they are fetched
+func (c *Connection) listDirAsync(fsPath string, request *sftp.Request) (sftp.ListerAt, error) {
+	if !c.User.HasPerm(dataprovider.PermListItems, request.Filepath) {
+		return nil, c.GetPermissionDeniedError()
+	}
+	lister := newAsyncListerAt(request.Context())
+	go func() {
+		lister.finish(c.ListDirPages(fsPath, request.Filepath, lister.add))
+	}()
+
+	timer := time.NewTimer(c.listAsyncThreshold)
+	defer timer.Stop()
+
+	select {
+	case <-lister.completed:
+		if lister.err != nil {
+			return nil, lister.err
+		}
+		return listerAt(lister.files), nil
+	case <-timer.C:
+		c.Log(logger.LevelDebug, "listing for dir %#v not completed after %v, the entries will be returned as they are fetched",
+			request.Filepath, c.listAsyncThreshold)
+		return lister, nil
+	}
+}
+
 func (c *Connection) getSFTPCmdTargetPath(requestTarget string) (string, error) {
 	var target string
 	// If a target is provided in this request validate that it is going to the correct
@@ -345,7 +418,15 @@ func (c *Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, r
 	minWriteOffset := int64(0)
 	osFlags := getOSOpenFlags(pflags)
 	isTruncate := osFlags&os.O_TRUNC != 0
+	if err := c.IsWriteModeAllowed(requestPath, !isTruncate); err != nil {
+		return nil, err
+	}
 	isResume := pflags.Append && !isTruncate
+	if !isTruncate && c.User.GetWriteMode(requestPath) == dataprovider.WriteModeAppendOnly {
+		// the existing data must be preserved, writes are allowed starting from the end
+		// of the file only. This requires upload resume support
+		isResume = true
+	}
 
 	// if there is a size limit the remaining size cannot be 0 here, since quotaResult.HasSpace
 	// will return false in this case and we deny the upload before.
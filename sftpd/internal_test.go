@@ -2,6 +2,9 @@ package sftpd
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -244,6 +248,117 @@ func TestUnsupportedListOP(t *testing.T) {
 	assert.EqualError(t, err, sftp.ErrSSHFxOpUnsupported.Error())
 }
 
+// pagedMockFs is a Fs returning the directory listing in pages, with a delay before each page
+type pagedMockFs struct {
+	vfs.Fs
+	pages [][]os.FileInfo
+	delay time.Duration
+	err   error
+}
+
+func (fs *pagedMockFs) ReadDirPages(dirname string, fn func(page []os.FileInfo) bool) error {
+	for _, page := range fs.pages {
+		time.Sleep(fs.delay)
+		if !fn(page) {
+			return nil
+		}
+	}
+	return fs.err
+}
+
+func listAllEntries(t *testing.T, lister sftp.ListerAt) ([]string, error) {
+	var names []string
+	for {
+		f := make([]os.FileInfo, 10)
+		n, err := lister.ListAt(f, int64(len(names)))
+		for _, fi := range f[:n] {
+			names = append(names, fi.Name())
+		}
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return names, err
+		}
+		assert.Greater(t, n, 0)
+	}
+}
+
+func TestAsyncListing(t *testing.T) {
+	user := dataprovider.User{
+		Username: "testuser",
+		Permissions: map[string][]string{
+			"/":     {dataprovider.PermAny},
+			"/deny": {dataprovider.PermDownload},
+		},
+		VirtualFolders: []vfs.VirtualFolder{
+			{
+				BaseVirtualFolder: vfs.BaseVirtualFolder{
+					MappedPath: filepath.Join(os.TempDir(), "vdir"),
+				},
+				VirtualPath: "/vdir",
+			},
+		},
+	}
+	fs := &pagedMockFs{
+		Fs: vfs.NewOsFs("", os.TempDir(), nil),
+		pages: [][]os.FileInfo{
+			{vfs.NewFileInfo("file1", false, 10, time.Now(), false), vfs.NewFileInfo("vdir", false, 10, time.Now(), false)},
+			{vfs.NewFileInfo("file2", false, 10, time.Now(), false)},
+			{vfs.NewFileInfo("dir1", true, 0, time.Now(), false)},
+		},
+	}
+	c := Connection{
+		BaseConnection:     common.NewBaseConnection("", common.ProtocolSFTP, user, fs),
+		listAsyncThreshold: 500 * time.Millisecond,
+	}
+	// fast listing, the whole listing is returned
+	lister, err := c.Filelist(sftp.NewRequest("List", "/"))
+	assert.NoError(t, err)
+	assert.IsType(t, listerAt{}, lister)
+	names, err := listAllEntries(t, lister)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"vdir", "file1", "file2", "dir1"}, names)
+	// slow listing, the entries are returned as they are fetched
+	fs.delay = 200 * time.Millisecond
+	c.listAsyncThreshold = 100 * time.Millisecond
+	lister, err = c.Filelist(sftp.NewRequest("List", "/"))
+	assert.NoError(t, err)
+	assert.IsType(t, &asyncListerAt{}, lister)
+	f := make([]os.FileInfo, 10)
+	n, err := lister.ListAt(f, 0)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, n) {
+		assert.Equal(t, "vdir", f[0].Name())
+	}
+	names, err = listAllEntries(t, lister)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"vdir", "file1", "file2", "dir1"}, names)
+	// the listing error is returned after the entries fetched before it
+	fs.err = errors.New("listing error")
+	lister, err = c.Filelist(sftp.NewRequest("List", "/"))
+	assert.NoError(t, err)
+	names, err = listAllEntries(t, lister)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"vdir", "file1", "file2", "dir1"}, names)
+	// the listing stops if the directory handle is closed
+	fs.err = nil
+	ctx, cancelFn := context.WithCancel(context.Background())
+	lister, err = c.Filelist(sftp.NewRequest("List", "/").WithContext(ctx))
+	assert.NoError(t, err)
+	cancelFn()
+	_, err = listAllEntries(t, lister)
+	assert.NoError(t, err)
+	// permissions are checked before starting the listing
+	_, err = c.Filelist(sftp.NewRequest("List", "/deny"))
+	assert.EqualError(t, err, sftp.ErrSSHFxPermissionDenied.Error())
+	// async listing is disabled
+	c.listAsyncThreshold = 0
+	lister, err = c.Filelist(sftp.NewRequest("List", "/"))
+	assert.NoError(t, err)
+	assert.IsType(t, listerAt{}, lister)
+}
+
 func TestTransferCancelFn(t *testing.T) {
 	testfile := "testfile"
 	file, err := os.Create(testfile)
@@ -1789,6 +1904,232 @@ func TestCertCheckerInitErrors(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCertCheckerCriticalOptions(t *testing.T) {
+	_, caPrivKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	caSigner, err := ssh.NewSignerFromKey(caPrivKey)
+	require.NoError(t, err)
+	userPubKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshUserPubKey, err := ssh.NewPublicKey(userPubKey)
+	require.NoError(t, err)
+	caKeyPath := filepath.Join(os.TempDir(), "test_ca_user_key.pub")
+	err = ioutil.WriteFile(caKeyPath, ssh.MarshalAuthorizedKey(caSigner.PublicKey()), os.ModePerm)
+	require.NoError(t, err)
+
+	c := Configuration{}
+	c.TrustedUserCAKeys = []string{caKeyPath}
+	err = c.initializeCertChecker("")
+	assert.NoError(t, err)
+	assert.True(t, c.certChecker.IsUserAuthority(caSigner.PublicKey()))
+	assert.False(t, c.certChecker.IsUserAuthority(sshUserPubKey))
+
+	getCert := func(criticalOptions map[string]string, validBefore time.Time, principals ...string) *ssh.Certificate {
+		if len(principals) == 0 {
+			principals = []string{"user1"}
+		}
+		cert := &ssh.Certificate{
+			Key:             sshUserPubKey,
+			CertType:        ssh.UserCert,
+			KeyId:           "test cert",
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(time.Now().Add(-1 * time.Hour).Unix()),
+			ValidBefore:     uint64(validBefore.Unix()),
+			Permissions: ssh.Permissions{
+				CriticalOptions: criticalOptions,
+			},
+		}
+		err := cert.SignCert(rand.Reader, caSigner)
+		require.NoError(t, err)
+		return cert
+	}
+	validBefore := time.Now().Add(1 * time.Hour)
+	cert := getCert(map[string]string{sourceAddressCriticalOption: "127.0.0.1/32"}, validBefore)
+	assert.NoError(t, c.certChecker.CheckCert("user1", cert))
+	// the principal must match the username
+	assert.Error(t, c.certChecker.CheckCert("user2", cert))
+	// force-command is not supported, the certificate must be rejected
+	cert = getCert(map[string]string{"force-command": "/bin/true"}, validBefore)
+	assert.Error(t, c.certChecker.CheckCert("user1", cert))
+	// expired certificate
+	cert = getCert(nil, time.Now().Add(-1*time.Minute))
+	assert.Error(t, c.certChecker.CheckCert("user1", cert))
+	assert.Error(t, c.checkUserCert("user1", cert))
+
+	cert = getCert(nil, validBefore, "user1", "user2")
+	assert.NoError(t, c.checkUserCert("user1", cert))
+	assert.NoError(t, c.checkUserCert("user2", cert))
+	assert.Error(t, c.checkUserCert("user3", cert))
+	// a certificate without principals is accepted by CheckCert for any username, it must be rejected
+	cert = getCert(nil, validBefore)
+	cert.ValidPrincipals = nil
+	err = cert.SignCert(rand.Reader, caSigner)
+	require.NoError(t, err)
+	assert.NoError(t, c.certChecker.CheckCert("user1", cert))
+	err = c.checkUserCert("user1", cert)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no principals")
+	}
+	cert.CertType = ssh.HostCert
+	assert.Error(t, c.checkUserCert("user1", cert))
+	// untrusted CA
+	cert = getCert(nil, validBefore)
+	_, otherCAPrivKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherCASigner, err := ssh.NewSignerFromKey(otherCAPrivKey)
+	require.NoError(t, err)
+	err = cert.SignCert(rand.Reader, otherCASigner)
+	require.NoError(t, err)
+	assert.Error(t, c.checkUserCert("user1", cert))
+
+	err = os.Remove(caKeyPath)
+	assert.NoError(t, err)
+}
+
+func TestClientVersionRules(t *testing.T) {
+	c := Configuration{}
+	c.DeniedClientVersions = []string{"^SSH-2.0-[invalid"}
+	err := c.initializeClientVersionRules()
+	assert.Error(t, err)
+	c.DeniedClientVersions = nil
+	c.AllowedClientVersions = []string{"(invalid"}
+	err = c.initializeClientVersionRules()
+	assert.NoError(t, err)
+	// allowed rules alone have no effect
+	assert.False(t, c.hasClientVersionRules())
+	c.DeniedClientVersions = []string{"libssh", "^SSH-2\\.0-Go", " "}
+	c.AllowedClientVersions = []string{"libssh_0.9.6"}
+	err = c.initializeClientVersionRules()
+	assert.NoError(t, err)
+	assert.True(t, c.hasClientVersionRules())
+	assert.Len(t, c.deniedClientVersions, 2)
+
+	assert.Error(t, c.checkClientVersion("SSH-2.0-libssh_0.8.1"))
+	assert.Error(t, c.checkClientVersion("SSH-2.0-Go"))
+	assert.NoError(t, c.checkClientVersion("SSH-2.0-OpenSSH_8.4 Go"))
+	assert.NoError(t, c.checkClientVersion("SSH-2.0-libssh_0.9.6"))
+	// unknown clients are allowed
+	assert.NoError(t, c.checkClientVersion("SSH-2.0-UnknownClient_1.0"))
+}
+
+func TestLoginBanners(t *testing.T) {
+	configDir := filepath.Join(os.TempDir(), "loginbanners")
+	err := os.MkdirAll(configDir, os.ModePerm)
+	require.NoError(t, err)
+	defer os.RemoveAll(configDir)
+	err = ioutil.WriteFile(filepath.Join(configDir, "default"), []byte("default banner for %username%"), os.ModePerm)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(configDir, "eu"), []byte("EU notice for %username% from %ip%"), os.ModePerm)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(configDir, "partners"), []byte("partners notice %date%"), os.ModePerm)
+	require.NoError(t, err)
+
+	c := Configuration{
+		LoginBannerFile: "default",
+		LoginBanners: []LoginBanner{
+			{
+				Networks:   []string{"192.168.1.0/24"},
+				BannerFile: "eu",
+			},
+		},
+	}
+	serverConfig := &ssh.ServerConfig{}
+	err = c.configureLoginBanner(serverConfig, configDir)
+	assert.NoError(t, err)
+	assert.NotNil(t, serverConfig.BannerCallback)
+	assert.Equal(t, "EU notice for user1 from 192.168.1.5", c.getLoginBanner("default", "192.168.1.5:2222", "user1"))
+	assert.Equal(t, "default", c.getLoginBanner("default", "10.8.0.1:2222", "user1"))
+	// control characters in the username are removed
+	assert.Equal(t, "EU notice for user1 from 192.168.1.5", c.getLoginBanner("default", "192.168.1.5:2222", "user\n1"))
+
+	c.LoginBanners = []LoginBanner{
+		{
+			Networks:   []string{"10.8.0.0/16"},
+			Usernames:  []string{"partner_*"},
+			BannerFile: filepath.Join(configDir, "partners"),
+		},
+		{
+			Usernames:  []string{"partner_*"},
+			BannerFile: "eu",
+		},
+	}
+	err = c.initializeLoginBanners(configDir)
+	assert.NoError(t, err)
+	assert.Equal(t, "partners notice "+time.Now().UTC().Format("2006-01-02"),
+		c.getLoginBanner("", "10.8.1.1:2222", "partner_acme"))
+	assert.Equal(t, "EU notice for partner_acme from 10.9.1.1", c.getLoginBanner("", "10.9.1.1:2222", "partner_acme"))
+	assert.Equal(t, "", c.getLoginBanner("", "10.8.1.1:2222", "user1"))
+	assert.Equal(t, "default banner for user1", c.getLoginBanner("default banner for %username%", "10.8.1.1:2222", "user1"))
+
+	c.LoginBanners = []LoginBanner{
+		{
+			Networks:   []string{"10.8.0.0/33"},
+			BannerFile: "eu",
+		},
+	}
+	err = c.configureLoginBanner(serverConfig, configDir)
+	assert.Error(t, err)
+	c.LoginBanners[0].Networks = nil
+	c.LoginBanners[0].Usernames = []string{"[a-"}
+	err = c.initializeLoginBanners(configDir)
+	assert.Error(t, err)
+	c.LoginBanners[0].Usernames = nil
+	c.LoginBanners[0].BannerFile = "missing"
+	err = c.initializeLoginBanners(configDir)
+	assert.Error(t, err)
+	c.LoginBanners[0].BannerFile = " "
+	err = c.initializeLoginBanners(configDir)
+	assert.Error(t, err)
+
+	c.LoginBanners = nil
+	c.LoginBannerFile = ""
+	serverConfig = &ssh.ServerConfig{}
+	err = c.configureLoginBanner(serverConfig, configDir)
+	assert.NoError(t, err)
+	assert.Nil(t, serverConfig.BannerCallback)
+}
+
+func TestClientVersionConn(t *testing.T) {
+	c := Configuration{
+		DeniedClientVersions: []string{"Scanner"},
+	}
+	err := c.initializeClientVersionRules()
+	require.NoError(t, err)
+	for _, data := range []string{"SSH-2.0-Scanner_1.0\r\n", "a comment\r\nSSH-2.0-Scanner\n"} {
+		client, server := net.Pipe()
+		go func(data string) {
+			_, err := client.Write([]byte(data))
+			assert.NoError(t, err)
+			client.Close()
+		}(data)
+		conn := &clientVersionConn{
+			Conn:   server,
+			config: &c,
+		}
+		_, err = ioutil.ReadAll(conn)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "denied by rule")
+		}
+		server.Close()
+	}
+	for _, data := range []string{"SSH-2.0-OpenSSH_8.4\r\nScanner", strings.Repeat("a", 300) + "\nSSH-2.0-Scanner\n"} {
+		client, server := net.Pipe()
+		go func(data string) {
+			_, err := client.Write([]byte(data))
+			assert.NoError(t, err)
+			client.Close()
+		}(data)
+		conn := &clientVersionConn{
+			Conn:   server,
+			config: &c,
+		}
+		read, err := ioutil.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, data, string(read))
+		server.Close()
+	}
+}
+
 func TestRecursiveCopyErrors(t *testing.T) {
 	permissions := make(map[string][]string)
 	permissions["/"] = []string{dataprovider.PermAny}
@@ -15,3 +15,10 @@ func TestWrapCmd(t *testing.T) {
 	assert.Equal(t, uint32(1000), cmd.SysProcAttr.Credential.Uid)
 	assert.Equal(t, uint32(1001), cmd.SysProcAttr.Credential.Gid)
 }
+
+func TestCheckExecCredentials(t *testing.T) {
+	assert.Error(t, checkExecCredentials(0, 0))
+	assert.Error(t, checkExecCredentials(1000, 0))
+	assert.Error(t, checkExecCredentials(0, 1000))
+	assert.NoError(t, checkExecCredentials(1000, 1001))
+}
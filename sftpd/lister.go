@@ -1,8 +1,10 @@
 package sftpd
 
 import (
+	"context"
 	"io"
 	"os"
+	"sync"
 )
 
 type listerAt []os.FileInfo
@@ -20,3 +22,85 @@ func (l listerAt) ListAt(f []os.FileInfo, offset int64) (int, error) {
 	}
 	return n, nil
 }
+
+// asyncListerAt is a ListerAt for directory listings fetched in background.
+// The entries are returned as they arrive, ListAt waits until at least one
+// entry after the requested offset is available or the listing is completed
+type asyncListerAt struct {
+	sync.Mutex
+	ctx       context.Context
+	files     []os.FileInfo
+	err       error
+	updated   chan struct{}
+	completed chan struct{}
+}
+
+func newAsyncListerAt(ctx context.Context) *asyncListerAt {
+	return &asyncListerAt{
+		ctx:       ctx,
+		updated:   make(chan struct{}),
+		completed: make(chan struct{}),
+	}
+}
+
+// add appends the specified entries, it returns false if the listing is not needed anymore
+func (l *asyncListerAt) add(page []os.FileInfo) bool {
+	if l.ctx.Err() != nil {
+		return false
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	l.files = append(l.files, page...)
+	close(l.updated)
+	l.updated = make(chan struct{})
+	return true
+}
+
+// finish marks the listing as completed with the specified error
+func (l *asyncListerAt) finish(err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.err = err
+	close(l.completed)
+}
+
+func (l *asyncListerAt) isCompleted() bool {
+	select {
+	case <-l.completed:
+		return true
+	default:
+		return false
+	}
+}
+
+// ListAt returns the entries available after the specified offset, waiting for them if needed.
+// Once all the entries are returned, it returns io.EOF or the listing error, if any
+func (l *asyncListerAt) ListAt(f []os.FileInfo, offset int64) (int, error) {
+	for {
+		l.Lock()
+		completed := l.isCompleted()
+		if offset < int64(len(l.files)) {
+			n := copy(f, l.files[offset:])
+			l.Unlock()
+			return n, nil
+		}
+		err := l.err
+		updated := l.updated
+		l.Unlock()
+
+		if completed {
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		select {
+		case <-updated:
+		case <-l.completed:
+		case <-l.ctx.Done():
+			return 0, io.EOF
+		}
+	}
+}
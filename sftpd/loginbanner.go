@@ -0,0 +1,172 @@
+package sftpd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	bannerPlaceholderUsername = "%username%"
+	bannerPlaceholderIP       = "%ip%"
+	bannerPlaceholderDate     = "%date%"
+)
+
+// LoginBanner defines a login banner sent to the clients connecting from the
+// configured networks and/or authenticating as the configured users
+type LoginBanner struct {
+	// Source networks in CIDR notation, for example "192.168.1.0/24".
+	// Empty means any network
+	Networks []string `json:"networks" mapstructure:"networks"`
+	// Usernames, shell patterns such as "partner_*" are supported. Empty means any user
+	Usernames []string `json:"usernames" mapstructure:"usernames"`
+	// Path to the banner file, it can be a path relative to the configuration
+	// directory or an absolute one
+	BannerFile string `json:"banner_file" mapstructure:"banner_file"`
+}
+
+type loginBannerRule struct {
+	networks  []*net.IPNet
+	usernames []string
+	content   string
+}
+
+func (r *loginBannerRule) match(ip net.IP, username string) bool {
+	if len(r.networks) > 0 {
+		if ip == nil {
+			return false
+		}
+		matched := false
+		for _, network := range r.networks {
+			if network.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.usernames) > 0 {
+		for _, pattern := range r.usernames {
+			if matched, _ := path.Match(pattern, username); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func readLoginBannerFile(bannerFile, configDir string) (string, error) {
+	bannerFilePath := bannerFile
+	if !filepath.IsAbs(bannerFilePath) {
+		bannerFilePath = filepath.Join(configDir, bannerFilePath)
+	}
+	content, err := ioutil.ReadFile(bannerFilePath)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func (c *Configuration) initializeLoginBanners(configDir string) error {
+	c.loginBanners = nil
+	for idx, banner := range c.LoginBanners {
+		if strings.TrimSpace(banner.BannerFile) == "" {
+			return fmt.Errorf("login banner %v: the banner file is mandatory", idx+1)
+		}
+		rule := loginBannerRule{}
+		for _, network := range banner.Networks {
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(network))
+			if err != nil {
+				return fmt.Errorf("login banner %v: invalid network %#v: %v", idx+1, network, err)
+			}
+			rule.networks = append(rule.networks, ipNet)
+		}
+		for _, username := range banner.Usernames {
+			username = strings.TrimSpace(username)
+			if username == "" {
+				continue
+			}
+			if _, err := path.Match(username, ""); err != nil {
+				return fmt.Errorf("login banner %v: invalid username pattern %#v: %v", idx+1, username, err)
+			}
+			rule.usernames = append(rule.usernames, username)
+		}
+		content, err := readLoginBannerFile(banner.BannerFile, configDir)
+		if err != nil {
+			return fmt.Errorf("login banner %v: unable to read the banner file: %v", idx+1, err)
+		}
+		rule.content = content
+		c.loginBanners = append(c.loginBanners, rule)
+	}
+	return nil
+}
+
+// getLoginBanner returns the banner for the specified client IP and username, the
+// first matching rule wins. The default banner is returned if no rule matches
+func (c *Configuration) getLoginBanner(defaultBanner, remoteAddr, username string) string {
+	ip := net.ParseIP(utils.GetIPFromRemoteAddress(remoteAddr))
+	banner := defaultBanner
+	for _, rule := range c.loginBanners {
+		if rule.match(ip, username) {
+			banner = rule.content
+			break
+		}
+	}
+	if banner == "" {
+		return ""
+	}
+	return replaceBannerPlaceholders(banner, username, ip)
+}
+
+func replaceBannerPlaceholders(banner, username string, ip net.IP) string {
+	// the username is chosen by the client, control characters are never sent back
+	username = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, username)
+	ipAddr := ""
+	if ip != nil {
+		ipAddr = ip.String()
+	}
+	replacer := strings.NewReplacer(bannerPlaceholderUsername, username, bannerPlaceholderIP, ipAddr,
+		bannerPlaceholderDate, time.Now().UTC().Format("2006-01-02"))
+	return replacer.Replace(banner)
+}
+
+func (c *Configuration) configureLoginBanner(serverConfig *ssh.ServerConfig, configDir string) error {
+	if err := c.initializeLoginBanners(configDir); err != nil {
+		return err
+	}
+	defaultBanner := ""
+	if len(c.LoginBannerFile) > 0 {
+		content, err := readLoginBannerFile(c.LoginBannerFile, configDir)
+		if err == nil {
+			defaultBanner = content
+		} else {
+			logger.WarnToConsole("unable to read SFTPD login banner file: %v", err)
+			logger.Warn(logSender, "", "unable to read login banner file: %v", err)
+		}
+	}
+	if defaultBanner == "" && len(c.loginBanners) == 0 {
+		return nil
+	}
+	serverConfig.BannerCallback = func(conn ssh.ConnMetadata) string {
+		return c.getLoginBanner(defaultBanner, conn.RemoteAddr().String(), conn.User())
+	}
+	return nil
+}
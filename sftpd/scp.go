@@ -200,6 +200,11 @@ func (c *scpCommand) handleUploadFile(resolvedPath, filePath string, sizeToRead
 		return err
 	}
 
+	if err := c.connection.CheckConcurrentTransfersLimit(common.TransferUpload); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
+
 	maxWriteSize, _ := c.connection.GetMaxWriteSize(quotaResult, false, fileSize)
 
 	file, w, cancelFn, err := c.connection.Fs.Create(filePath, 0)
@@ -243,11 +248,23 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 
 	var err error
 
-	if !c.connection.User.IsFileAllowed(uploadFilePath) {
+	if !c.connection.User.IsFileAllowed(uploadFilePath) || !c.connection.User.IsUploadNameAllowed(uploadFilePath) {
 		c.connection.Log(logger.LevelWarn, "writing file %#v is not allowed", uploadFilePath)
 		c.sendErrorMessage(common.ErrPermissionDenied)
 		return common.ErrPermissionDenied
 	}
+	if err := c.connection.IsUploadOrderAllowed(uploadFilePath); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
+	if err := c.connection.IsPathSchemaAllowed(uploadFilePath, false); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
+	if err := c.connection.CheckDirectoryFilesLimit(uploadFilePath); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
 
 	p, err := c.connection.Fs.ResolvePath(uploadFilePath)
 	if err != nil {
@@ -255,17 +272,25 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		c.sendErrorMessage(err)
 		return err
 	}
+	if err := c.connection.CheckDiskSpace(p, sizeToRead); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
 	filePath := p
 	if common.Config.IsAtomicUploadEnabled() && c.connection.Fs.IsAtomicUploadSupported() {
 		filePath = c.connection.Fs.GetAtomicUploadPath(p)
 	}
 	stat, statErr := c.connection.Fs.Lstat(p)
 	if (statErr == nil && stat.Mode()&os.ModeSymlink != 0) || c.connection.Fs.IsNotExist(statErr) {
-		if !c.connection.User.HasPerm(dataprovider.PermUpload, path.Dir(uploadFilePath)) {
+		if !c.connection.User.HasFilePerm(dataprovider.PermUpload, uploadFilePath) {
 			c.connection.Log(logger.LevelWarn, "cannot upload file: %#v, permission denied", uploadFilePath)
 			c.sendErrorMessage(common.ErrPermissionDenied)
 			return common.ErrPermissionDenied
 		}
+		if err := c.connection.CheckUploadDir(uploadFilePath); err != nil {
+			c.sendErrorMessage(err)
+			return err
+		}
 		return c.handleUploadFile(p, filePath, sizeToRead, true, 0, uploadFilePath)
 	}
 
@@ -282,11 +307,16 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		return err
 	}
 
-	if !c.connection.User.HasPerm(dataprovider.PermOverwrite, uploadFilePath) {
+	if !c.connection.User.HasFilePerm(dataprovider.PermOverwrite, uploadFilePath) {
 		c.connection.Log(logger.LevelWarn, "cannot overwrite file: %#v, permission denied", uploadFilePath)
 		c.sendErrorMessage(common.ErrPermissionDenied)
 		return common.ErrPermissionDenied
 	}
+	// SCP always overwrites existing files
+	if err := c.connection.IsWriteModeAllowed(uploadFilePath, false); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
 
 	if common.Config.IsAtomicUploadEnabled() && c.connection.Fs.IsAtomicUploadSupported() {
 		err = c.connection.Fs.Rename(p, filePath)
@@ -298,7 +328,7 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		}
 	}
 
-	return c.handleUploadFile(p, filePath, sizeToRead, false, stat.Size(), uploadFilePath)
+	return c.handleUploadFile(p, filePath, sizeToRead, false, vfs.GetSizeForQuota(stat), uploadFilePath)
 }
 
 func (c *scpCommand) sendDownloadProtocolMessages(dirPath string, stat os.FileInfo) error {
@@ -317,8 +347,9 @@ func (c *scpCommand) sendDownloadProtocolMessages(dirPath string, stat os.FileIn
 	}
 
 	dirName := filepath.Base(dirPath)
-	for _, v := range c.connection.User.VirtualFolders {
-		if v.MappedPath == dirPath {
+	for idx := range c.connection.User.VirtualFolders {
+		v := &c.connection.User.VirtualFolders[idx]
+		if c.connection.User.GetMappedPath(v) == dirPath {
 			dirName = path.Base(v.VirtualPath)
 			break
 		}
@@ -352,6 +383,14 @@ func (c *scpCommand) handleRecursiveDownload(dirPath string, stat os.FileInfo) e
 		var dirs []string
 		for _, file := range files {
 			filePath := c.connection.Fs.GetRelativePath(c.connection.Fs.Join(dirPath, file.Name()))
+			if file.Mode()&os.ModeSymlink != 0 {
+				// symlinks to directories are not followed, they could create endless cycles
+				isDir, errDir := vfs.IsDirectory(c.connection.Fs, c.connection.Fs.Join(dirPath, file.Name()))
+				if errDir == nil && isDir {
+					c.connection.Log(logger.LevelDebug, "recursive download, skipping symlink to directory %#v", filePath)
+					continue
+				}
+			}
 			if file.Mode().IsRegular() || file.Mode()&os.ModeSymlink != 0 {
 				err = c.handleDownload(filePath)
 				if err != nil {
@@ -472,7 +511,7 @@ func (c *scpCommand) handleDownload(filePath string) error {
 		return err
 	}
 
-	if !c.connection.User.HasPerm(dataprovider.PermDownload, path.Dir(filePath)) {
+	if !c.connection.User.HasFilePerm(dataprovider.PermDownload, filePath) {
 		c.connection.Log(logger.LevelWarn, "error downloading dir: %#v, permission denied", filePath)
 		c.sendErrorMessage(common.ErrPermissionDenied)
 		return common.ErrPermissionDenied
@@ -484,6 +523,26 @@ func (c *scpCommand) handleDownload(filePath string) error {
 		return common.ErrPermissionDenied
 	}
 
+	if err := c.connection.CheckDownloadVolumeLimit(); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
+
+	if err := c.connection.CheckDownloadFileSize(p, filePath, stat); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
+
+	if err := c.connection.CheckConcurrentTransfersLimit(common.TransferDownload); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
+
+	if err := c.connection.CheckPreDownloadHook(p, filePath, c.connection.GetRemoteAddress(), stat); err != nil {
+		c.sendErrorMessage(err)
+		return err
+	}
+
 	file, r, cancelFn, err := c.connection.Fs.Open(p, 0)
 	if err != nil {
 		c.connection.Log(logger.LevelError, "could not open file %#v for reading: %v", p, err)
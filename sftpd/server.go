@@ -23,6 +23,7 @@ import (
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 const (
@@ -76,6 +77,10 @@ type Configuration struct {
 	// LoginBannerFile the contents of the specified file, if any, are sent to
 	// the remote user before authentication is allowed.
 	LoginBannerFile string `json:"login_banner_file" mapstructure:"login_banner_file"`
+	// LoginBanners defines the login banners to send based on the client IP address
+	// and/or the username, the first matching banner is sent instead of the one defined
+	// using LoginBannerFile
+	LoginBanners []LoginBanner `json:"login_banners" mapstructure:"login_banners"`
 	// Deprecated: please use the same key in common configuration
 	SetstatMode int `json:"setstat_mode" mapstructure:"setstat_mode"`
 	// List of enabled SSH commands.
@@ -107,9 +112,23 @@ type Configuration struct {
 	// Deprecated: please use the same key in common configuration
 	ProxyProtocol int `json:"proxy_protocol" mapstructure:"proxy_protocol"`
 	// Deprecated: please use the same key in common configuration
-	ProxyAllowed     []string `json:"proxy_allowed" mapstructure:"proxy_allowed"`
-	certChecker      *ssh.CertChecker
-	parsedUserCAKeys []ssh.PublicKey
+	ProxyAllowed []string `json:"proxy_allowed" mapstructure:"proxy_allowed"`
+	// Clients whose SSH identification string, for example "SSH-2.0-libssh_0.8.1",
+	// matches one of these rules are refused before the key exchange.
+	// Rules starting with "^" are regular expressions, the other ones are substrings
+	DeniedClientVersions []string `json:"denied_client_versions" mapstructure:"denied_client_versions"`
+	// Exceptions to the denied rules, a client matching a denied rule and one of these
+	// rules is allowed. Clients not matching any denied rule are always allowed
+	AllowedClientVersions []string `json:"allowed_client_versions" mapstructure:"allowed_client_versions"`
+	// Maximum time, as milliseconds, to wait for a directory listing from a Cloud Storage backend
+	// before replying to the client. Slower listings continue in background and the entries
+	// are returned as they are fetched. 0 means the whole listing is always awaited
+	ListAsyncThreshold    int `json:"list_async_threshold" mapstructure:"list_async_threshold"`
+	certChecker           *ssh.CertChecker
+	parsedUserCAKeys      []ssh.PublicKey
+	deniedClientVersions  []clientVersionRule
+	allowedClientVersions []clientVersionRule
+	loginBanners          []loginBannerRule
 }
 
 // Key contains information about host keys
@@ -145,7 +164,7 @@ func (c *Configuration) Initialize(configDir string) error {
 		},
 		NextAuthMethodsCallback: func(conn ssh.ConnMetadata) []string {
 			var nextMethods []string
-			user, err := dataprovider.UserExists(conn.User())
+			user, err := dataprovider.GetUserWithGroupSettings(conn.User())
 			if err == nil {
 				nextMethods = user.GetNextAuthMethods(conn.PartialSuccessMethods(), c.PasswordAuthentication)
 			}
@@ -157,6 +176,9 @@ func (c *Configuration) Initialize(configDir string) error {
 	if c.PasswordAuthentication {
 		serverConfig.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 			sp, err := c.validatePasswordCredentials(conn, pass)
+			if err == ssh.ErrPartialSuccess {
+				return sp, err
+			}
 			if err != nil {
 				return nil, &authenticationError{err: fmt.Sprintf("could not validate password credentials: %v", err)}
 			}
@@ -173,11 +195,17 @@ func (c *Configuration) Initialize(configDir string) error {
 		return err
 	}
 
+	if err := c.initializeClientVersionRules(); err != nil {
+		return err
+	}
+
 	sftp.SetSFTPExtensions(sftpExtensions...) //nolint:errcheck // we configure valid SFTP Extensions so we cannot get an error
 
 	c.configureSecurityOptions(serverConfig)
 	c.configureKeyboardInteractiveAuth(serverConfig)
-	c.configureLoginBanner(serverConfig, configDir)
+	if err := c.configureLoginBanner(serverConfig, configDir); err != nil {
+		return err
+	}
 	c.checkSSHCommands()
 
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort))
@@ -217,28 +245,28 @@ func (c *Configuration) configureSecurityOptions(serverConfig *ssh.ServerConfig)
 	}
 }
 
-func (c *Configuration) configureLoginBanner(serverConfig *ssh.ServerConfig, configDir string) {
-	if len(c.LoginBannerFile) > 0 {
-		bannerFilePath := c.LoginBannerFile
-		if !filepath.IsAbs(bannerFilePath) {
-			bannerFilePath = filepath.Join(configDir, bannerFilePath)
+func (c *Configuration) configureKeyboardInteractiveAuth(serverConfig *ssh.ServerConfig) {
+	if !c.checkKeyboardInteractiveHook() {
+		c.KeyboardInteractiveHook = ""
+		// keyboard interactive authentication is still needed to ask for the
+		// TOTP code after a successful password authentication
+		if !c.PasswordAuthentication {
+			return
 		}
-		bannerContent, err := ioutil.ReadFile(bannerFilePath)
-		if err == nil {
-			banner := string(bannerContent)
-			serverConfig.BannerCallback = func(conn ssh.ConnMetadata) string {
-				return banner
-			}
-		} else {
-			logger.WarnToConsole("unable to read SFTPD login banner file: %v", err)
-			logger.Warn(logSender, "", "unable to read login banner file: %v", err)
+	}
+	serverConfig.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		sp, err := c.validateKeyboardInteractiveCredentials(conn, client)
+		if err != nil {
+			return nil, &authenticationError{err: fmt.Sprintf("could not validate keyboard interactive credentials: %v", err)}
 		}
+
+		return sp, nil
 	}
 }
 
-func (c *Configuration) configureKeyboardInteractiveAuth(serverConfig *ssh.ServerConfig) {
+func (c *Configuration) checkKeyboardInteractiveHook() bool {
 	if len(c.KeyboardInteractiveHook) == 0 {
-		return
+		return false
 	}
 	if !strings.HasPrefix(c.KeyboardInteractiveHook, "http") {
 		if !filepath.IsAbs(c.KeyboardInteractiveHook) {
@@ -246,23 +274,16 @@ func (c *Configuration) configureKeyboardInteractiveAuth(serverConfig *ssh.Serve
 				c.KeyboardInteractiveHook)
 			logger.Warn(logSender, "", "invalid keyboard interactive authentication program: %#v must be an absolute path",
 				c.KeyboardInteractiveHook)
-			return
+			return false
 		}
 		_, err := os.Stat(c.KeyboardInteractiveHook)
 		if err != nil {
 			logger.WarnToConsole("invalid keyboard interactive authentication program:: %v", err)
 			logger.Warn(logSender, "", "invalid keyboard interactive authentication program:: %v", err)
-			return
-		}
-	}
-	serverConfig.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-		sp, err := c.validateKeyboardInteractiveCredentials(conn, client)
-		if err != nil {
-			return nil, &authenticationError{err: fmt.Sprintf("could not validate keyboard interactive credentials: %v", err)}
+			return false
 		}
-
-		return sp, nil
 	}
+	return true
 }
 
 // AcceptInboundConnection handles an inbound connection to the server instance and determines if the request should be served or not.
@@ -280,6 +301,12 @@ func (c *Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Serve
 		conn.Close()
 		return
 	}
+	if c.hasClientVersionRules() {
+		conn = &clientVersionConn{
+			Conn:   conn,
+			config: c,
+		}
+	}
 	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
 	if err != nil {
 		logger.Debug(logSender, "", "failed to accept an incoming connection: %v", err)
@@ -310,6 +337,10 @@ func (c *Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Serve
 		logger.Warn(logSender, "", "could not create filesystem for user %#v err: %v", user.Username, err)
 		return
 	}
+	if err = vfs.CheckHomeMarker(fs, user.FsConfig.HomeMarker); err != nil {
+		logger.Warn(logSender, connectionID, "home marker check failed for user %#v err: %v", user.Username, err)
+		return
+	}
 
 	fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
 
@@ -356,10 +387,11 @@ func (c *Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Serve
 					if string(req.Payload[4:]) == "sftp" {
 						ok = true
 						connection := Connection{
-							BaseConnection: common.NewBaseConnection(connID, common.ProtocolSFTP, user, fs),
-							ClientVersion:  string(sconn.ClientVersion()),
-							RemoteAddr:     remoteAddr,
-							channel:        channel,
+							BaseConnection:     common.NewBaseConnection(connID, common.ProtocolSFTP, user, fs),
+							ClientVersion:      string(sconn.ClientVersion()),
+							RemoteAddr:         remoteAddr,
+							channel:            channel,
+							listAsyncThreshold: time.Duration(c.ListAsyncThreshold) * time.Millisecond,
 						}
 						go c.handleSftpConnection(channel, &connection)
 					}
@@ -633,6 +665,28 @@ func (c *Configuration) initializeCertChecker(configDir string) error {
 	return nil
 }
 
+// checkUserCert checks that the given certificate is a user certificate, signed by a trusted CA,
+// valid for the given username
+func (c *Configuration) checkUserCert(username string, cert *ssh.Certificate) error {
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("ssh: cert has type %d", cert.CertType)
+	}
+	if !c.certChecker.IsUserAuthority(cert.SignatureKey) {
+		return errors.New("ssh: certificate signed by unrecognized authority")
+	}
+	// CheckCert accepts certificates without principals for any username, OpenSSH rejects them
+	if len(cert.ValidPrincipals) == 0 {
+		return errors.New("ssh: certificate has no principals")
+	}
+	if !utils.IsStringInSlice(username, cert.ValidPrincipals) {
+		return fmt.Errorf("ssh: principal %#v not in the set of valid principals for the certificate", username)
+	}
+	// the certificate validity window and the critical options are checked here, certificates
+	// with unsupported critical options, for example force-command, are rejected.
+	// The source-address critical option is enforced by the SSH server
+	return c.certChecker.CheckCert(username, cert)
+}
+
 func (c *Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
 	var err error
 	var user dataprovider.User
@@ -642,26 +696,19 @@ func (c *Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubK
 
 	connectionID := hex.EncodeToString(conn.SessionID())
 	method := dataprovider.SSHLoginMethodPublicKey
+	ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
 	cert, ok := pubKey.(*ssh.Certificate)
 	if ok {
-		if cert.CertType != ssh.UserCert {
-			err = fmt.Errorf("ssh: cert has type %d", cert.CertType)
-			updateLoginMetrics(conn, method, err)
-			return nil, err
-		}
-		if !c.certChecker.IsUserAuthority(cert.SignatureKey) {
-			err = fmt.Errorf("ssh: certificate signed by unrecognized authority")
-			updateLoginMetrics(conn, method, err)
-			return nil, err
-		}
-		if err := c.certChecker.CheckCert(conn.User(), cert); err != nil {
+		if err = c.checkUserCert(conn.User(), cert); err != nil {
 			updateLoginMetrics(conn, method, err)
 			return nil, err
 		}
 		certPerm = &cert.Permissions
+		user, keyID, err = dataprovider.CheckUserAndTrustedCert(conn.User(), cert, ipAddr, common.ProtocolSSH)
+	} else {
+		user, keyID, err = dataprovider.CheckUserAndPubKey(conn.User(), pubKey.Marshal(), ipAddr, common.ProtocolSSH)
 	}
-	ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
-	if user, keyID, err = dataprovider.CheckUserAndPubKey(conn.User(), pubKey.Marshal(), ipAddr, common.ProtocolSSH); err == nil {
+	if err == nil {
 		if user.IsPartialAuth(method) {
 			logger.Debug(logSender, connectionID, "user %#v authenticated with partial success", conn.User())
 			return certPerm, ssh.ErrPartialSuccess
@@ -693,6 +740,11 @@ func (c *Configuration) validatePasswordCredentials(conn ssh.ConnMetadata, pass
 	}
 	ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
 	if user, err = dataprovider.CheckUserAndPass(conn.User(), string(pass), ipAddr, common.ProtocolSSH); err == nil {
+		if user.IsTOTPRequired(common.ProtocolSSH) {
+			logger.Debug(logSender, hex.EncodeToString(conn.SessionID()), "user %#v authenticated with partial success, "+
+				"TOTP code required", conn.User())
+			return nil, ssh.ErrPartialSuccess
+		}
 		sshPerm, err = loginUser(user, method, "", conn)
 	}
 	updateLoginMetrics(conn, method, err)
@@ -704,8 +756,15 @@ func (c *Configuration) validateKeyboardInteractiveCredentials(conn ssh.ConnMeta
 	var user dataprovider.User
 	var sshPerm *ssh.Permissions
 
+	partialSuccessMethods := conn.PartialSuccessMethods()
+	if len(partialSuccessMethods) > 0 && partialSuccessMethods[len(partialSuccessMethods)-1] == dataprovider.LoginMethodPassword {
+		return c.validateTOTPCredentials(conn, client)
+	}
+	if len(c.KeyboardInteractiveHook) == 0 {
+		return nil, errors.New("keyboard interactive authentication is not configured")
+	}
 	method := dataprovider.SSHLoginMethodKeyboardInteractive
-	if len(conn.PartialSuccessMethods()) == 1 {
+	if len(partialSuccessMethods) == 1 {
 		method = dataprovider.SSHLoginMethodKeyAndKeyboardInt
 	}
 	ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
@@ -717,12 +776,30 @@ func (c *Configuration) validateKeyboardInteractiveCredentials(conn ssh.ConnMeta
 	return sshPerm, err
 }
 
+// validateTOTPCredentials asks for the TOTP code after a successful password authentication.
+// The login method is the one used for the first authentication factor
+func (c *Configuration) validateTOTPCredentials(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	var err error
+	var user dataprovider.User
+	var sshPerm *ssh.Permissions
+
+	method := dataprovider.LoginMethodPassword
+	if len(conn.PartialSuccessMethods()) > 1 {
+		method = dataprovider.SSHLoginMethodKeyAndPassword
+	}
+	if user, err = dataprovider.CheckKeyboardInteractiveTOTP(conn.User(), client); err == nil {
+		sshPerm, err = loginUser(user, method, "", conn)
+	}
+	updateLoginMetrics(conn, method, err)
+	return sshPerm, err
+}
+
 func updateLoginMetrics(conn ssh.ConnMetadata, method string, err error) {
 	metrics.AddLoginAttempt(method)
 	ip := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
 	if err != nil {
 		logger.ConnectionFailedLog(conn.User(), ip, method, common.ProtocolSSH, err.Error())
 	}
-	metrics.AddLoginResult(method, err)
+	metrics.AddLoginResult(method, common.ProtocolSSH, common.GetUsernameForLoginMetrics(conn.User(), err), err)
 	dataprovider.ExecutePostLoginHook(conn.User(), method, ip, common.ProtocolSSH, err)
 }
@@ -224,6 +224,8 @@ func TestMain(m *testing.M) {
 		logger.WarnToConsole("unable to save trusted CA user key: %v", err)
 	}
 	sftpdConf.TrustedUserCAKeys = append(sftpdConf.TrustedUserCAKeys, trustedCAUserKey)
+	sftpdConf.DeniedClientVersions = []string{"^SSH-2\\.0-TestScanner", "BadBot"}
+	sftpdConf.AllowedClientVersions = []string{"BadBot_2"}
 
 	go func() {
 		logger.Debug(logSender, "", "initializing SFTP server with config %+v", sftpdConf)
@@ -362,6 +364,54 @@ func TestBasicSFTPHandling(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLoginGroupSettings(t *testing.T) {
+	usePubKey := false
+	group, _, err := httpd.AddGroup(dataprovider.Group{
+		Name:       "sftp_group",
+		QuotaFiles: 1,
+		Permissions: map[string][]string{
+			"/":    {dataprovider.PermAny},
+			"/sub": {dataprovider.PermListItems},
+		},
+	}, http.StatusOK)
+	assert.NoError(t, err)
+	u := getTestUser(usePubKey)
+	u.Permissions = nil
+	u.Groups = []string{group.Name}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("sub")
+		assert.NoError(t, err)
+		// no upload permission inherited for /sub
+		err = sftpUploadFile(testFilePath, path.Join("sub", testFileName), testFileSize, client)
+		assert.Error(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		// the quota files limit is inherited too
+		err = sftpUploadFile(testFilePath, testFileName+"1", testFileSize, client)
+		assert.Error(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveGroup(group, http.StatusOK)
+	assert.NoError(t, err)
+	// without groups the user has no permissions for the root directory
+	_, err = getSftpClient(user, usePubKey)
+	assert.Error(t, err)
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestOpenReadWrite(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
@@ -589,6 +639,94 @@ func TestUploadResume(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCryptFs(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.FsConfig.Provider = dataprovider.CryptedFilesystemProvider
+	u.FsConfig.CryptConfig.Passphrase.Payload = "crypt passphrase"
+	u.FsConfig.CryptConfig.Passphrase.Status = vfs.SecretStatusPlain
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		// more than a DARE package
+		testFileSize := int64(131073)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		info, err := client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, testFileSize, info.Size())
+		}
+		// the file is stored encrypted
+		info, err = os.Stat(filepath.Join(user.GetHomeDir(), testFileName))
+		if assert.NoError(t, err) {
+			assert.Greater(t, info.Size(), testFileSize)
+		}
+		initialHash, err := computeHashForFile(sha256.New(), testFilePath)
+		assert.NoError(t, err)
+		storedHash, err := computeHashForFile(sha256.New(), filepath.Join(user.GetHomeDir(), testFileName))
+		assert.NoError(t, err)
+		assert.NotEqual(t, initialHash, storedHash)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		downloadedFileHash, err := computeHashForFile(sha256.New(), localDownloadPath)
+		assert.NoError(t, err)
+		assert.Equal(t, initialHash, downloadedFileHash)
+		// the quota scan uses the decrypted size
+		_, err = httpd.StartQuotaScan(user, http.StatusAccepted)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			scans, _, err := httpd.GetQuotaScans(http.StatusOK)
+			if err == nil {
+				return len(scans) == 0
+			}
+			return false
+		}, 1*time.Second, 50*time.Millisecond)
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, user.UsedQuotaFiles)
+		assert.Equal(t, testFileSize, user.UsedQuotaSize)
+		// upload resume is not supported
+		err = sftpUploadResumeFile(testFilePath, testFileName, testFileSize+1, false, client)
+		assert.Error(t, err)
+		// overwrite with a smaller file
+		err = createTestFile(testFilePath, 100)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, 100, client)
+		assert.NoError(t, err)
+		err = sftpDownloadFile(testFileName, localDownloadPath, 100, client)
+		assert.NoError(t, err)
+		files, err := client.ReadDir("/")
+		if assert.NoError(t, err) && assert.Len(t, files, 1) {
+			assert.Equal(t, int64(100), files[0].Size())
+		}
+		// truncate to 0
+		err = client.Truncate(testFileName, 0)
+		assert.NoError(t, err)
+		info, err = client.Stat(testFileName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(0), info.Size())
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, 0, client)
+		assert.NoError(t, err)
+		err = client.Truncate(testFileName, 10)
+		assert.Error(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestDirCommands(t *testing.T) {
 	usePubKey := false
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
@@ -1085,6 +1223,53 @@ func TestLoginUserCert(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLoginUserCertNotEnrolled(t *testing.T) {
+	u := getTestUser(true)
+	u.PublicKeys = []string{testPubKey1}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	// the certificate is signed from a trusted CA and the username is a valid principal,
+	// the certificate is not added to the user public keys
+	signer, err := getSignerForUserCert([]byte(testCertValid))
+	assert.NoError(t, err)
+	client, err := getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if assert.NoError(t, err) {
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+	signer, err = getSignerForUserCert([]byte(testCertUntrustedCA))
+	assert.NoError(t, err)
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if !assert.Error(t, err) {
+		client.Close()
+	}
+	signer, err = getSignerForUserCert([]byte(testCertOtherSourceAddress))
+	assert.NoError(t, err)
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if !assert.Error(t, err) {
+		client.Close()
+	}
+	// a disabled user cannot login
+	user.Status = 0
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	signer, err = getSignerForUserCert([]byte(testCertValid))
+	assert.NoError(t, err)
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if !assert.Error(t, err) {
+		client.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	// the user does not exist
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer)}, "")
+	if !assert.Error(t, err) {
+		client.Close()
+	}
+}
+
 func TestMultiStepLoginKeyAndPwd(t *testing.T) {
 	u := getTestUser(true)
 	u.Password = defaultPassword
@@ -1248,6 +1433,35 @@ func TestMultiStepLoginCertAndPwd(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLoginClientVersion(t *testing.T) {
+	usePubKey := true
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	assert.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	assert.NoError(t, err)
+	for _, version := range []string{"SSH-2.0-TestScanner_1.0", "SSH-2.0-Client BadBot_1.0", "SSH-2.0-Client BadBot_2.0",
+		"SSH-2.0-UnknownClient"} {
+		config := &ssh.ClientConfig{
+			User: user.Username,
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				return nil
+			},
+			Auth:          []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			ClientVersion: version,
+		}
+		conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+		if strings.Contains(version, "_1.0") {
+			assert.Error(t, err, "client version %#v must be denied", version)
+		} else if assert.NoError(t, err, "client version %#v must be allowed", version) {
+			conn.Close()
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestLoginUserStatus(t *testing.T) {
 	usePubKey := true
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
@@ -1359,6 +1573,129 @@ func TestLoginWithDatabaseCredentials(t *testing.T) {
 	assert.NoError(t, dataprovider.Initialize(providerConf, configDir))
 }
 
+func TestLoginLockout(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
+	assert.NoError(t, err)
+	_, _, err = httpd.GetUserLoginLockout(user, http.StatusForbidden)
+	assert.NoError(t, err)
+	_, err = httpd.ResetUserLoginLockout(user, http.StatusForbidden)
+	assert.NoError(t, err)
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	providerConf.LoginLockout.MaxFailures = 2
+	providerConf.LoginLockout.LockDuration = 0
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.Error(t, err)
+	providerConf.LoginLockout.LockDuration = 10
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.NoError(t, err)
+
+	status, _, err := httpd.GetUserLoginLockout(user, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, user.Username, status.Username)
+	assert.Equal(t, 0, status.Failures)
+	assert.False(t, status.Locked)
+	// a wrong password followed by a successful login resets the counter
+	wrongPwdUser := user
+	wrongPwdUser.Password = "wrong password"
+	_, err = getSftpClient(wrongPwdUser, false)
+	assert.Error(t, err)
+	status, _, err = httpd.GetUserLoginLockout(user, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, status.Failures)
+	assert.Greater(t, status.LastFailure, int64(0))
+	assert.False(t, status.Locked)
+	client, err := getSftpClient(user, false)
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicSFTP(client))
+		client.Close()
+	}
+	status, _, err = httpd.GetUserLoginLockout(user, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, status.Failures)
+	// failed public key logins are not counted
+	_, err = getSftpClient(user, true)
+	assert.Error(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = getSftpClient(wrongPwdUser, false)
+		assert.Error(t, err)
+	}
+	status, _, err = httpd.GetUserLoginLockout(user, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, status.Failures)
+	assert.True(t, status.Locked)
+	assert.Greater(t, status.LockedUntil, status.LastFailure)
+	// the right password is rejected while the user is locked
+	_, err = getSftpClient(user, false)
+	assert.Error(t, err)
+	_, err = dataprovider.CheckUserAndPass(user.Username, defaultPassword, "127.0.0.1", common.ProtocolSSH)
+	assert.EqualError(t, err, dataprovider.ErrLoginLocked.Error())
+	// the failures are stored inside the data provider
+	if providerConf.Driver != dataprovider.MemoryDataProviderName {
+		assert.NoError(t, dataprovider.Close())
+		assert.NoError(t, dataprovider.Initialize(providerConf, configDir))
+		status, _, err = httpd.GetUserLoginLockout(user, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, status.Failures)
+		assert.True(t, status.Locked)
+	}
+	// the failures are reset by the admin
+	_, err = httpd.ResetUserLoginLockout(user, http.StatusOK)
+	assert.NoError(t, err)
+	status, _, err = httpd.GetUserLoginLockout(user, http.StatusOK)
+	assert.NoError(t, err)
+	assert.False(t, status.Locked)
+	client, err = getSftpClient(user, false)
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicSFTP(client))
+		client.Close()
+	}
+	// wrong TOTP codes are counted, the right password does not reset the failures
+	provisioning, _, err := httpd.GenerateUserTOTP(user, http.StatusOK)
+	assert.NoError(t, err)
+	code, err := utils.GetTOTPCode(provisioning.Secret, time.Now())
+	assert.NoError(t, err)
+	_, err = httpd.EnableUserTOTP(user, code, http.StatusOK)
+	assert.NoError(t, err)
+	wrongTOTPAuth := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		return []string{"000000"}, nil
+	})
+	for i := 0; i < 2; i++ {
+		client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.Password(defaultPassword), wrongTOTPAuth}, "")
+		if !assert.Error(t, err, "password login with an invalid TOTP code must fail") {
+			client.Close()
+		}
+	}
+	status, _, err = httpd.GetUserLoginLockout(user, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, status.Failures)
+	assert.True(t, status.Locked)
+	_, err = dataprovider.CheckKeyboardInteractiveTOTP(user.Username, func(user, instruction string, questions []string,
+		echos []bool) ([]string, error) {
+		return []string{code}, nil
+	})
+	assert.EqualError(t, err, dataprovider.ErrLoginLocked.Error())
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, _, err = httpd.GetUserLoginLockout(user, http.StatusNotFound)
+	assert.NoError(t, err)
+	_, err = httpd.ResetUserLoginLockout(user, http.StatusNotFound)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.NoError(t, err)
+}
+
 func TestLoginInvalidFs(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
@@ -1392,6 +1729,46 @@ func TestLoginInvalidFs(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLoginUnresolvedSecret(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.FsConfig.Provider = dataprovider.S3FilesystemProvider
+	u.FsConfig.S3Config.Bucket = "test"
+	u.FsConfig.S3Config.Region = "us-east-1"
+	u.FsConfig.S3Config.AccessKey = "access-key"
+	u.FsConfig.S3Config.AccessSecret = vfs.Secret{
+		Status:  vfs.SecretStatusAWSSecretsManager,
+		Payload: "arn:aws:secretsmanager:us-east-1:123456789012:secret:sftpgo",
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.SecretStatusAWSSecretsManager, user.FsConfig.S3Config.AccessSecret.Status)
+	assert.Equal(t, u.FsConfig.S3Config.AccessSecret.Payload, user.FsConfig.S3Config.AccessSecret.Payload)
+	// the reference is updated
+	user.FsConfig.S3Config.AccessSecret.Payload = "sftpgo-s3#secret"
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Equal(t, vfs.SecretStatusAWSSecretsManager, user.FsConfig.S3Config.AccessSecret.Status)
+	assert.Equal(t, "sftpgo-s3#secret", user.FsConfig.S3Config.AccessSecret.Payload)
+	// AWS Secrets Manager is not configured, the secret cannot be resolved:
+	// the login must succeed while the filesystem operations must fail
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		_, err = client.ReadDir(".")
+		assert.Error(t, err)
+		_, err = client.Create(testFileName)
+		assert.Error(t, err)
+		err = client.Mkdir("adir")
+		assert.Error(t, err)
+	}
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestDeniedProtocols(t *testing.T) {
 	u := getTestUser(true)
 	u.Filters.DeniedProtocols = []string{common.ProtocolSSH}
@@ -1416,6 +1793,43 @@ func TestDeniedProtocols(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestAccessTimes(t *testing.T) {
+	now := time.Now().UTC()
+	u := getTestUser(true)
+	u.Filters.AccessTimes = []dataprovider.AccessTimeFilter{
+		{
+			WeekDays: []int{(int(now.Weekday()) + 1) % 7},
+			Start:    "00:00",
+			End:      "24:00",
+			TimeZone: "UTC",
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, true)
+	if !assert.Error(t, err, "login outside the access times must fail") {
+		client.Close()
+	}
+	user.Filters.AccessTimes = append(user.Filters.AccessTimes, dataprovider.AccessTimeFilter{
+		WeekDays: []int{int(now.Weekday())},
+		Start:    "00:00",
+		End:      "24:00",
+		TimeZone: "UTC",
+	})
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, true)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestDeniedLoginMethods(t *testing.T) {
 	u := getTestUser(true)
 	u.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodPublicKey, dataprovider.LoginMethodPassword}
@@ -1578,17 +1992,197 @@ func TestLoginKeyboardInteractiveAuth(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestPreLoginScript(t *testing.T) {
+func TestLoginKeyboardInteractiveAuthRounds(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
 	}
-	usePubKey := true
-	u := getTestUser(usePubKey)
-	err := dataprovider.Close()
-	assert.NoError(t, err)
-	err = config.LoadConfig(configDir, "")
+	user, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
 	assert.NoError(t, err)
-	providerConf := config.GetProviderConf()
+	rounds := `[{"instruction":"step 1","questions":["Password: "],"echos":[false]},` +
+		`{"instruction":"step 2","questions":["OTP: ","Backup code: "],"echos":[false,true]},` +
+		`{"instruction":"step 3","questions":["Accept the policy? "],"echos":[true]}]`
+	content := []byte("#!/bin/sh\n\n")
+	content = append(content, []byte(fmt.Sprintf("echo '{\"rounds\":%v}'\n", rounds))...)
+	content = append(content, []byte("read ANSWER1\nread ANSWER2\nread ANSWER3\nread ANSWER4\n")...)
+	content = append(content, []byte("if test \"$ANSWER4\" = \"yes\"; then\n  echo '{\"auth_result\":1}'\n")...)
+	content = append(content, []byte("else\n  echo '{\"auth_result\":-1}'\nfi\n")...)
+	err = ioutil.WriteFile(keyIntAuthPath, content, os.ModePerm)
+	assert.NoError(t, err)
+	var instructions []string
+	var allEchos [][]bool
+	getRoundsAuth := func(policyAnswer string) ssh.AuthMethod {
+		instructions = nil
+		allEchos = nil
+		return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			instructions = append(instructions, instruction)
+			allEchos = append(allEchos, echos)
+			answers := make([]string, len(questions))
+			for idx := range questions {
+				answers[idx] = "answer"
+			}
+			if instruction == "step 3" {
+				answers[0] = policyAnswer
+			}
+			return answers, nil
+		})
+	}
+	client, err := getCustomAuthSftpClient(user, []ssh.AuthMethod{getRoundsAuth("yes")}, "")
+	if assert.NoError(t, err) {
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+	assert.Equal(t, []string{"step 1", "step 2", "step 3"}, instructions)
+	assert.Equal(t, [][]bool{{false}, {false, true}, {true}}, allEchos)
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{getRoundsAuth("no")}, "")
+	if !assert.Error(t, err, "keyboard interactive auth must fail the policy was not accepted") {
+		client.Close()
+	}
+	// questions and echos mismatch inside a round
+	rounds = `[{"questions":["Password: "],"echos":[false]},{"questions":["OTP: "],"echos":[]}]`
+	err = ioutil.WriteFile(keyIntAuthPath, []byte(fmt.Sprintf("#!/bin/sh\n\necho '{\"rounds\":%v}'\n", rounds)),
+		os.ModePerm)
+	assert.NoError(t, err)
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{getRoundsAuth("yes")}, "")
+	if !assert.Error(t, err, "keyboard interactive auth must fail, invalid round") {
+		client.Close()
+	}
+	// rounds cannot be used with check_password
+	rounds = `[{"questions":["Password: "],"echos":[false]}]`
+	err = ioutil.WriteFile(keyIntAuthPath, []byte(fmt.Sprintf("#!/bin/sh\n\necho '{\"rounds\":%v,\"check_password\":1}'\n",
+		rounds)), os.ModePerm)
+	assert.NoError(t, err)
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{getRoundsAuth("yes")}, "")
+	if !assert.Error(t, err, "keyboard interactive auth must fail, check_password is not supported with rounds") {
+		client.Close()
+	}
+	err = ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), os.ModePerm)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestLoginWithTOTP(t *testing.T) {
+	u := getTestUser(true)
+	u.Password = defaultPassword
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	provisioning, _, err := httpd.GenerateUserTOTP(user, http.StatusOK)
+	assert.NoError(t, err)
+	code, err := utils.GetTOTPCode(provisioning.Secret, time.Now())
+	assert.NoError(t, err)
+	_, err = httpd.EnableUserTOTP(user, code, http.StatusOK)
+	assert.NoError(t, err)
+	getTOTPAuth := func(answer string) ssh.AuthMethod {
+		return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return []string{answer}, nil
+		})
+	}
+	// the code for the previous period is refused if the skew is 0
+	assert.NoError(t, dataprovider.Close())
+	providerConf := config.GetProviderConf()
+	providerConf.TOTPSkew = -1
+	assert.Error(t, dataprovider.Initialize(providerConf, configDir))
+	providerConf.TOTPSkew = 0
+	assert.NoError(t, dataprovider.Initialize(providerConf, configDir))
+	prevCode, err := utils.GetTOTPCode(provisioning.Secret, time.Now().Add(-utils.TOTPPeriod*time.Second))
+	assert.NoError(t, err)
+	client, err := getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.Password(defaultPassword), getTOTPAuth(prevCode)}, "")
+	if !assert.Error(t, err, "the code for the previous period must be refused if the skew is 0") {
+		client.Close()
+	}
+	assert.NoError(t, dataprovider.Close())
+	assert.NoError(t, config.LoadConfig(configDir, ""))
+	providerConf = config.GetProviderConf()
+	assert.NoError(t, dataprovider.Initialize(providerConf, configDir))
+
+	client, err = getSftpClient(user, false)
+	if !assert.Error(t, err, "password login without TOTP code must fail") {
+		client.Close()
+	}
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.Password(defaultPassword), getTOTPAuth("000000")}, "")
+	if !assert.Error(t, err, "password login with an invalid TOTP code must fail") {
+		client.Close()
+	}
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.Password(defaultPassword), getTOTPAuth(code)}, "")
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicSFTP(client))
+		client.Close()
+	}
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.Password(defaultPassword), getTOTPAuth(code)}, "")
+	if !assert.Error(t, err, "a TOTP code can be used only once") {
+		client.Close()
+	}
+	// the code for the previous period is refused after using the code for the current one
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.Password(defaultPassword), getTOTPAuth(prevCode)}, "")
+	if !assert.Error(t, err, "a TOTP code older than the last used one must be refused") {
+		client.Close()
+	}
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.Password(defaultPassword),
+		getTOTPAuth(provisioning.RecoveryCodes[0])}, "")
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicSFTP(client))
+		client.Close()
+	}
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.Password(defaultPassword),
+		getTOTPAuth(provisioning.RecoveryCodes[0])}, "")
+	if !assert.Error(t, err, "a recovery code can be used only once") {
+		client.Close()
+	}
+	// public key authentication is not affected
+	client, err = getSftpClient(user, true)
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicSFTP(client))
+		client.Close()
+	}
+	// the TOTP code is required after the password in multi-step authentication too
+	user.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodPublicKey, dataprovider.LoginMethodPassword,
+		dataprovider.SSHLoginMethodKeyboardInteractive, dataprovider.SSHLoginMethodKeyAndKeyboardInt}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	assert.NoError(t, err)
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer), ssh.Password(defaultPassword)}, "")
+	if !assert.Error(t, err, "multi-step login without TOTP code must fail") {
+		client.Close()
+	}
+	nextCode, err := utils.GetTOTPCode(provisioning.Secret, time.Now().Add(utils.TOTPPeriod*time.Second))
+	assert.NoError(t, err)
+	client, err = getCustomAuthSftpClient(user, []ssh.AuthMethod{ssh.PublicKeys(signer), ssh.Password(defaultPassword),
+		getTOTPAuth(nextCode)}, "")
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicSFTP(client))
+		client.Close()
+	}
+	// TOTP not required for SSH
+	user.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodKeyAndKeyboardInt}
+	user.Filters.TOTPProtocols = []string{common.ProtocolFTP}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, false)
+	if assert.NoError(t, err) {
+		assert.NoError(t, checkBasicSFTP(client))
+		client.Close()
+	}
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestPreLoginScript(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	err := dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
 	err = ioutil.WriteFile(preLoginPath, getPreLoginScriptContent(u, false), os.ModePerm)
 	assert.NoError(t, err)
 	providerConf.PreLoginHook = preLoginPath
@@ -1722,6 +2316,56 @@ func TestPostConnectHook(t *testing.T) {
 	common.Config.PostConnectHook = ""
 }
 
+func TestPreDownloadHook(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	preDownloadPath := filepath.Join(homeBasePath, "predownload.sh")
+	common.Config.PreDownloadHook = preDownloadPath
+
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(preDownloadPath, getPostConnectScriptContent(0), os.ModePerm)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		// uploads are not affected
+		err = ioutil.WriteFile(preDownloadPath, getPostConnectScriptContent(1), os.ModePerm)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), common.ErrDownloadDenied.Error())
+		}
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	err = os.Remove(preDownloadPath)
+	assert.NoError(t, err)
+
+	common.Config.PreDownloadHook = ""
+}
+
 func TestCheckPwdHook(t *testing.T) {
 	if runtime.GOOS == osWindows {
 		t.Skip("this test is not available on Windows")
@@ -2120,38 +2764,67 @@ func TestLoginExternalAuthErrors(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func TestQuotaDisabledError(t *testing.T) {
+func TestLoginAuthBackendsFallback(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := false
+	u := getTestUser(usePubKey)
 	err := dataprovider.Close()
 	assert.NoError(t, err)
 	err = config.LoadConfig(configDir, "")
 	assert.NoError(t, err)
 	providerConf := config.GetProviderConf()
-	providerConf.TrackQuota = 0
+	providerConf.AuthBackends = []string{dataprovider.AuthBackendExternalHook}
 	err = dataprovider.Initialize(providerConf, configDir)
+	assert.Error(t, err, "an external auth hook is required")
+	err = ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, false, ""), os.ModePerm)
 	assert.NoError(t, err)
-	usePubKey := false
-	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1
+	providerConf.ExternalAuthHook = extAuthPath
+	providerConf.AuthBackends = []string{dataprovider.AuthBackendProvider, "unknown"}
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.Error(t, err)
+	providerConf.AuthBackends = []string{dataprovider.AuthBackendProvider, dataprovider.AuthBackendProvider}
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.Error(t, err)
+	providerConf.AuthBackends = []string{dataprovider.AuthBackendProvider, dataprovider.AuthBackendExternalHook}
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.NoError(t, err)
+
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	assert.NoError(t, err)
-	client, err := getSftpClient(user, usePubKey)
+	client, err := getSftpClient(u, usePubKey)
 	if assert.NoError(t, err) {
 		defer client.Close()
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
-		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileName+"1", testFileSize, client)
-		assert.NoError(t, err)
-		err = client.Rename(testFileName+"1", testFileName+".rename")
-		assert.NoError(t, err)
-		err = os.Remove(testFilePath)
-		assert.NoError(t, err)
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+	// the external hook accepts any password for this user but the data provider
+	// knows the user and rejects the invalid password, so the chain must stop
+	u.Password = "invalid password"
+	client, err = getSftpClient(u, usePubKey)
+	if !assert.Error(t, err, "login with an invalid password must fail") {
+		client.Close()
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
+	// now the data provider declines and the external hook is consulted
+	client, err = getSftpClient(u, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+	// both backends decline
+	u.Username = defaultUsername + "1"
+	client, err = getSftpClient(u, usePubKey)
+	if !assert.Error(t, err, "login with an unknown user must fail") {
+		client.Close()
+	}
+	users, _, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	assert.NoError(t, err)
+	if assert.Len(t, users, 1) {
+		_, err = httpd.RemoveUser(users[0], http.StatusOK)
+		assert.NoError(t, err)
+	}
 	err = os.RemoveAll(user.GetHomeDir())
 	assert.NoError(t, err)
 
@@ -2162,37 +2835,308 @@ func TestQuotaDisabledError(t *testing.T) {
 	providerConf = config.GetProviderConf()
 	err = dataprovider.Initialize(providerConf, configDir)
 	assert.NoError(t, err)
+	err = os.Remove(extAuthPath)
+	assert.NoError(t, err)
 }
 
-func TestMaxSessions(t *testing.T) {
+func TestLoginAuthBackendsHookReject(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
 	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.Username += "1"
-	u.MaxSessions = 1
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	err := dataprovider.Close()
 	assert.NoError(t, err)
-	client, err := getSftpClient(user, usePubKey)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	err = ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, false, ""), os.ModePerm)
+	assert.NoError(t, err)
+	providerConf.ExternalAuthHook = extAuthPath
+	providerConf.AuthBackends = []string{dataprovider.AuthBackendExternalHook, dataprovider.AuthBackendProvider}
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.NoError(t, err)
+
+	client, err := getSftpClient(u, usePubKey)
 	if assert.NoError(t, err) {
 		defer client.Close()
 		assert.NoError(t, checkBasicSFTP(client))
-		c, err := getSftpClient(user, usePubKey)
-		if !assert.Error(t, err, "max sessions exceeded, new login should not succeed") {
-			c.Close()
-		}
 	}
+	users, _, err := httpd.GetUsers(0, 0, u.Username, http.StatusOK)
+	assert.NoError(t, err)
+	if !assert.Len(t, users, 1) {
+		return
+	}
+	user := users[0]
+	assert.Equal(t, dataprovider.AuthBackendExternalHook, user.AuthBackend)
+	user.MaxSessions = 2
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Equal(t, dataprovider.AuthBackendExternalHook, user.AuthBackend)
+	// the hook rejects the user, the stored copy must not be used by the provider backend
+	err = ioutil.WriteFile(extAuthPath, []byte("#!/bin/sh\n\necho '{\"username\":\"\"}'\n"), os.ModePerm)
+	assert.NoError(t, err)
+	client, err = getSftpClient(u, usePubKey)
+	if !assert.Error(t, err, "login rejected by the external hook must fail") {
+		client.Close()
+	}
+	// the hook declines, the provider backend declines the users created by the hook too
+	err = ioutil.WriteFile(extAuthPath, []byte("#!/bin/sh\n\necho '{\"username\":\"\",\"decline\":true}'\n"), os.ModePerm)
+	assert.NoError(t, err)
+	client, err = getSftpClient(u, usePubKey)
+	if !assert.Error(t, err, "login declined by the external hook must fail for users created by the hook") {
+		client.Close()
+	}
+	// the users added using the REST API are authenticated by the provider backend
+	localUser := getTestUser(usePubKey)
+	localUser.Username = defaultUsername + "1"
+	localUser.AuthBackend = dataprovider.AuthBackendExternalHook
+	localUser, _, err = httpd.AddUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Empty(t, localUser.AuthBackend)
+	client, err = getSftpClient(localUser, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+	}
+
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(localUser, http.StatusOK)
+	assert.NoError(t, err)
 	err = os.RemoveAll(user.GetHomeDir())
 	assert.NoError(t, err)
+	err = os.RemoveAll(localUser.GetHomeDir())
+	assert.NoError(t, err)
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.NoError(t, err)
+	err = os.Remove(extAuthPath)
+	assert.NoError(t, err)
 }
 
-func TestQuotaFileReplace(t *testing.T) {
+func TestDownloadVolumeLimit(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1000
+	u.Filters.DownloadVolumeLimit = 100000
+	u.Filters.DownloadVolumePeriod = dataprovider.DownloadVolumePeriodMonth
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	assert.NoError(t, err)
-	err = os.RemoveAll(user.GetHomeDir())
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		// the second download exceeds the limit and it is aborted
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.Error(t, err)
+		// the limit is reached, the download is denied
+		_, err = client.Open(testFileName)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), common.ErrDownloadLimitReached.Error())
+		}
+		// uploads are still allowed
+		err = sftpUploadFile(testFilePath, testFileName+"1", testFileSize, client)
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, u.Filters.DownloadVolumeLimit, user.UsedDownloadVolume)
+	assert.Equal(t, user.GetDownloadVolumePeriodStart(time.Now()), user.DownloadVolumePeriodStart)
+	assert.Equal(t, int64(0), user.GetRemainingDownloadVolume(time.Now()))
+	// updating the user must preserve the downloaded volume
+	user.Filters.DownloadVolumeLimit = 200000
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	assert.Equal(t, u.Filters.DownloadVolumeLimit, user.UsedDownloadVolume)
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(testFileName, localDownloadPath, 65535, client)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestUploadAutoCreateDirs(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = sftpUploadFile(testFilePath, path.Join("/incoming", "sub", testFileName), testFileSize, client)
+		if assert.Error(t, err) {
+			assert.True(t, os.IsNotExist(err))
+		}
+	}
+	user.Filters.AutoCreateDirs = []string{"/incoming"}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = sftpUploadFile(testFilePath, path.Join("/incoming", "sub", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		info, err := client.Stat(path.Join("/incoming", "sub"))
+		if assert.NoError(t, err) {
+			assert.True(t, info.IsDir())
+		}
+		// auto creation is not enabled outside the configured directory
+		err = sftpUploadFile(testFilePath, path.Join("/other", testFileName), testFileSize, client)
+		assert.Error(t, err)
+	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestDisconnectOnCredentialsChange(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+		user.Password = "new " + defaultPassword
+		user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return common.Connections.GetActiveSessions(defaultUsername) == 0
+		}, 1*time.Second, 50*time.Millisecond)
+		assert.Error(t, checkBasicSFTP(client))
+	}
+	user.Password = defaultPassword
+	user.Filters.KeepSessionsOnCredentialsChange = true
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+		user.Password = "new " + defaultPassword
+		user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+		assert.NoError(t, err)
+		assert.NoError(t, checkBasicSFTP(client))
+		// disabling the account always closes the active sessions
+		user.Status = 0
+		user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			return common.Connections.GetActiveSessions(defaultUsername) == 0
+		}, 1*time.Second, 50*time.Millisecond)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestQuotaDisabledError(t *testing.T) {
+	err := dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf := config.GetProviderConf()
+	providerConf.TrackQuota = 0
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.NoError(t, err)
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName+"1", testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Rename(testFileName+"1", testFileName+".rename")
+		assert.NoError(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+
+	err = dataprovider.Close()
+	assert.NoError(t, err)
+	err = config.LoadConfig(configDir, "")
+	assert.NoError(t, err)
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	assert.NoError(t, err)
+}
+
+func TestMaxSessions(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Username += "1"
+	u.MaxSessions = 1
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		assert.NoError(t, checkBasicSFTP(client))
+		c, err := getSftpClient(user, usePubKey)
+		if !assert.Error(t, err, "max sessions exceeded, new login should not succeed") {
+			c.Close()
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestQuotaFileReplace(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1000
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
 	assert.NoError(t, err)
 	testFileSize := int64(65535)
 	testFilePath := filepath.Join(homeBasePath, testFileName)
@@ -2554,7 +3498,636 @@ func TestBandwidthAndConnections(t *testing.T) {
 		assert.Eventually(t, func() bool { return len(common.Connections.GetStats()) == 0 }, 1*time.Second, 50*time.Millisecond)
 		err = os.Remove(testFilePath)
 		assert.NoError(t, err)
-		err = os.Remove(localDownloadPath)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+//nolint:dupl
+func TestPatternsFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFileSize := int64(131072)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName+".zip", testFileSize, client)
+		assert.NoError(t, err)
+	}
+	user.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		{
+			Path:            "/",
+			AllowedPatterns: []string{"*.zIp"},
+			DeniedPatterns:  []string{},
+		},
+	}
+	_, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.Error(t, err)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.Error(t, err)
+		err = client.Rename(testFileName, testFileName+"1")
+		assert.Error(t, err)
+		err = client.Remove(testFileName)
+		assert.Error(t, err)
+		err = sftpDownloadFile(testFileName+".zip", localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Mkdir("dir.zip")
+		assert.NoError(t, err)
+		err = client.Rename("dir.zip", "dir1.zip")
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	err = os.Remove(localDownloadPath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestUploadNameRegexFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.UploadNameAllowedRegex = []string{`^[a-z_]+\.csv$`, `\.part$`}
+	u.Filters.UploadNameDeniedRegex = []string{`\.tmp\.part$`}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFileSize := int64(65535)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.Error(t, err)
+		err = sftpUploadFile(testFilePath, "data.tmp.part", testFileSize, client)
+		assert.Error(t, err)
+		err = sftpUploadFile(testFilePath, "data.part", testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Rename("data.part", "Data.csv")
+		assert.Error(t, err)
+		err = client.Rename("data.part", "data.tmp.part")
+		assert.Error(t, err)
+		err = client.Rename("data.part", "data.csv")
+		assert.NoError(t, err)
+		// downloads are not affected
+		err = sftpDownloadFile("data.csv", localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		// directories are not affected
+		err = client.Mkdir("dir")
+		assert.NoError(t, err)
+		err = client.Rename("dir", "dir1")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("dir1", "sub_file.csv"), testFileSize, client)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	err = os.Remove(localDownloadPath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestUploadOrderFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.UploadOrder = []dataprovider.UploadOrderFilter{
+		{
+			Path:          "/intake",
+			SentinelFile:  "manifest.json",
+			RequiredFiles: []string{testFileName},
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFileSize := int64(65535)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("intake")
+		assert.NoError(t, err)
+		// the sentinel cannot be uploaded before the required files
+		err = sftpUploadFile(testFilePath, path.Join("intake", "manifest.json"), testFileSize, client)
+		assert.Error(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("intake", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("intake", testFileName+"1"), testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("intake", "manifest.json"), testFileSize, client)
+		assert.NoError(t, err)
+		// now the folder is locked
+		err = sftpUploadFile(testFilePath, path.Join("intake", testFileName+"2"), testFileSize, client)
+		assert.Error(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("intake", testFileName), testFileSize, client)
+		assert.Error(t, err)
+		// the sentinel can be overwritten
+		err = sftpUploadFile(testFilePath, path.Join("intake", "manifest.json"), testFileSize, client)
+		assert.NoError(t, err)
+		// the rule does not apply to sub directories and to other directories
+		err = client.Mkdir(path.Join("intake", "sub"))
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("intake", "sub", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		// removing the sentinel unlocks the directory
+		err = client.Remove(path.Join("intake", "manifest.json"))
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("intake", testFileName+"2"), testFileSize, client)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestUploadOrderRename(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.UploadOrder = []dataprovider.UploadOrderFilter{
+		{
+			Path:          "/intake",
+			SentinelFile:  "manifest.json",
+			RequiredFiles: []string{testFileName},
+		},
+		{
+			Path:          "/batch",
+			SentinelFile:  "manifest.json",
+			RequiredFiles: []string{testFileName},
+		},
+		{
+			Path:          "/dest/batch",
+			SentinelFile:  "manifest.json",
+			RequiredFiles: []string{testFileName},
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFileSize := int64(65535)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		for _, name := range []string{testFileName, testFileName + "1", "manifest.json", "manifest1.json"} {
+			err = sftpUploadFile(testFilePath, name, testFileSize, client)
+			assert.NoError(t, err)
+		}
+		err = client.Mkdir("intake")
+		assert.NoError(t, err)
+		// moving the sentinel before the required files must fail
+		err = client.Rename("manifest.json", path.Join("intake", "manifest.json"))
+		assert.Error(t, err)
+		err = client.Rename(testFileName, path.Join("intake", testFileName))
+		assert.NoError(t, err)
+		// the required file cannot become the sentinel
+		err = client.Rename(path.Join("intake", testFileName), path.Join("intake", "manifest.json"))
+		assert.Error(t, err)
+		err = client.Rename("manifest.json", path.Join("intake", "manifest.json"))
+		assert.NoError(t, err)
+		// now the folder is locked
+		err = client.Rename(testFileName+"1", path.Join("intake", testFileName+"1"))
+		assert.Error(t, err)
+		_, err = client.Stat(testFileName + "1")
+		assert.NoError(t, err)
+		// a moved directory must contain the required files together with the sentinel
+		err = client.Mkdir("stage")
+		assert.NoError(t, err)
+		err = client.Mkdir(path.Join("stage", "batch"))
+		assert.NoError(t, err)
+		err = client.Rename("manifest1.json", path.Join("stage", "batch", "manifest.json"))
+		assert.NoError(t, err)
+		err = client.Rename(path.Join("stage", "batch"), "batch")
+		assert.Error(t, err)
+		err = client.Rename("stage", "dest")
+		assert.Error(t, err)
+		err = client.Rename(testFileName+"1", path.Join("stage", "batch", testFileName))
+		assert.NoError(t, err)
+		err = client.Rename("stage", "dest")
+		assert.NoError(t, err)
+		_, err = client.Stat(path.Join("dest", "batch", "manifest.json"))
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestPathSchemaFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.PathSchemas = []dataprovider.PathSchemaFilter{
+		{
+			Path:   "/intake",
+			Schema: "{customer}/{year}",
+			Variables: map[string][]string{
+				"customer": {"acme"},
+				"year":     {"^[0-9]{4}$"},
+			},
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFileSize := int64(65535)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("intake")
+		assert.NoError(t, err)
+		err = client.Mkdir(path.Join("intake", "initech"))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), common.ErrPathSchemaMismatch.Error())
+		}
+		err = client.Mkdir(path.Join("intake", "acme"))
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("intake", "acme", testFileName), testFileSize, client)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), common.ErrPathSchemaMismatch.Error())
+		}
+		err = client.Mkdir(path.Join("intake", "acme", "21"))
+		assert.Error(t, err)
+		err = client.Mkdir(path.Join("intake", "acme", "2021"))
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("intake", "acme", "2021", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Mkdir(path.Join("intake", "acme", "2021", "sub"))
+		assert.Error(t, err)
+		err = client.Rename(path.Join("intake", "acme", "2021", testFileName), path.Join("intake", testFileName))
+		assert.Error(t, err)
+		err = client.Rename(path.Join("intake", "acme", "2021", testFileName), testFileName)
+		assert.NoError(t, err)
+		// paths outside the configured directory are not affected
+		err = client.Mkdir("other")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("other", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestDiskSpaceCheck(t *testing.T) {
+	usePubKey := true
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	assert.NoError(t, err)
+	common.Config.DiskSpaceChecks = []common.DiskSpaceCheck{
+		{
+			Path:         user.GetHomeDir(),
+			MinFreeSpace: math.MaxInt64 / 2,
+		},
+	}
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), common.ErrInsufficientDiskSpace.Error())
+		}
+		_, err = client.Stat(testFileName)
+		assert.Error(t, err)
+		common.Config.DiskSpaceChecks[0].MinFreeSpace = 0
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+	}
+	common.Config.DiskSpaceChecks = nil
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestDirectoryFilesLimitFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.DirectoryFilesLimits = []dataprovider.DirectoryFilesLimitFilter{
+		{
+			Path:     "/inbox",
+			MaxFiles: 1,
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFileSize := int64(65535)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("inbox")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("inbox", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		// overwrite is allowed
+		err = sftpUploadFile(testFilePath, path.Join("inbox", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("inbox", testFileName+"1"), testFileSize, client)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), common.ErrDirectoryFilesLimit.Error())
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Rename(testFileName, path.Join("inbox", testFileName+"1"))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), common.ErrDirectoryFilesLimit.Error())
+		}
+		err = client.Rename(path.Join("inbox", testFileName), path.Join("inbox", testFileName+"1"))
+		assert.NoError(t, err)
+		// sub directories have their own limit
+		err = client.Mkdir(path.Join("inbox", "sub"))
+		assert.NoError(t, err)
+		err = client.Rename(testFileName, path.Join("inbox", "sub", testFileName))
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestMaxDownloadFileSize(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	testFileSize := int64(65535)
+	u.Filters.MaxDownloadFileSize = testFileSize
+	u.Filters.DownloadSizeLimits = []dataprovider.DownloadSizeLimitFilter{
+		{
+			Path:        "/unlimited",
+			MaxFileSize: 0,
+		},
+		{
+			Path:        "/small",
+			MaxFileSize: 100,
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		// a file at the limit can be downloaded
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		// a file above the limit can be uploaded, listed and renamed but not downloaded
+		err = appendToTestFile(testFilePath, 1)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize+1, client)
+		assert.NoError(t, err)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize+1, client)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), common.ErrDownloadSizeExceeded.Error())
+		}
+		err = client.Rename(testFileName, testFileName+"1")
+		assert.NoError(t, err)
+		_, err = client.Stat(testFileName + "1")
+		assert.NoError(t, err)
+		// the directory limits override the user limit
+		for _, dir := range []string{"unlimited", "small"} {
+			err = client.Mkdir(dir)
+			assert.NoError(t, err)
+			err = sftpUploadFile(testFilePath, path.Join(dir, testFileName), testFileSize+1, client)
+			assert.NoError(t, err)
+		}
+		err = sftpDownloadFile(path.Join("unlimited", testFileName), localDownloadPath, testFileSize+1, client)
+		assert.NoError(t, err)
+		err = sftpDownloadFile(path.Join("small", testFileName), localDownloadPath, testFileSize+1, client)
+		assert.Error(t, err)
+		err = client.Remove(path.Join("small", testFileName))
+		assert.NoError(t, err)
+		// SCP downloads are limited too
+		if len(scpPath) > 0 {
+			remoteDownPath := fmt.Sprintf("%v@127.0.0.1:%v", user.Username, "/"+testFileName+"1")
+			err = scpDownload(localDownloadPath, remoteDownPath, false, false)
+			assert.Error(t, err)
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	err = os.Remove(localDownloadPath)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestMaxUploadDuration(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.MaxUploadDuration = 1
+	u.Filters.UploadDurationLimits = []dataprovider.UploadDurationLimitFilter{
+		{
+			Path:        "/steady",
+			MaxDuration: 1,
+			MinRate:     1,
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	data := make([]byte, 65535)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = client.Mkdir("steady")
+		assert.NoError(t, err)
+		// the allowed duration is extended based on the uploaded size
+		f, err := client.Create(path.Join("steady", testFileName))
+		if assert.NoError(t, err) {
+			_, err = f.Write(data)
+			assert.NoError(t, err)
+			time.Sleep(1500 * time.Millisecond)
+			_, err = f.Write(data)
+			assert.NoError(t, err)
+			err = f.Close()
+			assert.NoError(t, err)
+		}
+		info, err := client.Stat(path.Join("steady", testFileName))
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(2*len(data)), info.Size())
+		}
+		// a stalled upload is aborted and the partial file removed
+		f, err = client.Create(testFileName)
+		if assert.NoError(t, err) {
+			_, err = f.Write(data)
+			assert.NoError(t, err)
+			time.Sleep(1500 * time.Millisecond)
+			_, err = f.Write(data)
+			assert.Error(t, err)
+			f.Close()
+		}
+		assert.Eventually(t, func() bool { return len(common.Connections.GetStats()) == 0 }, 1*time.Second, 50*time.Millisecond)
+		files, err := ioutil.ReadDir(user.GetHomeDir())
+		assert.NoError(t, err)
+		if assert.Len(t, files, 1) {
+			assert.Equal(t, "steady", files[0].Name())
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestTextTransforms(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.QuotaSize = 6553600
+	u.Filters.TextTransforms = []dataprovider.TextTransformFilter{
+		{
+			Path:        "/",
+			Extensions:  []string{".edi"},
+			LineEndings: vfs.TextLineEndingsLF,
+			StripBOM:    true,
+		},
+		{
+			Path:        "/crlf",
+			Extensions:  []string{".txt"},
+			LineEndings: vfs.TextLineEndingsCRLF,
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		// big enough to be sent using several, possibly out of order, write requests
+		crlfContent := "\xEF\xBB\xBF" + strings.Repeat("UNB+UNOA:1+SENDER+RECEIVER\r\n", 20000)
+		lfContent := strings.Repeat("UNB+UNOA:1+SENDER+RECEIVER\n", 20000)
+		err = client.Mkdir("crlf")
+		assert.NoError(t, err)
+		uploads := []struct {
+			name     string
+			content  string
+			expected string
+		}{
+			{"file.edi", crlfContent, lfContent},
+			{"file.bin", crlfContent, crlfContent},
+			{"crlf/file.txt", lfContent, strings.ReplaceAll(lfContent, "\n", "\r\n")},
+			{"crlf/file.edi", crlfContent, crlfContent},
+		}
+		expectedQuotaSize := int64(0)
+		for _, upload := range uploads {
+			f, err := client.Create(upload.name)
+			if assert.NoError(t, err) {
+				_, err = f.ReadFrom(strings.NewReader(upload.content))
+				assert.NoError(t, err)
+				err = f.Close()
+				assert.NoError(t, err)
+			}
+			data, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), upload.name))
+			assert.NoError(t, err)
+			assert.Equal(t, upload.expected, string(data), "unexpected content for file %#v", upload.name)
+			expectedQuotaSize += int64(len(upload.expected))
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		assert.NoError(t, err)
+		assert.Equal(t, len(uploads), user.UsedQuotaFiles)
+		assert.Equal(t, expectedQuotaSize, user.UsedQuotaSize)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.MaxOpenFiles = 2
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		f1, err := client.Create("file1")
+		assert.NoError(t, err)
+		// an open handle counts even if no data is transferred
+		_, err = client.Create("file2")
+		assert.NoError(t, err)
+		stats := common.Connections.GetStats()
+		if assert.Len(t, stats, 1) {
+			assert.Equal(t, 2, stats[0].OpenFiles)
+		}
+		_, err = client.Create("file3")
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), common.ErrTooManyOpenFiles.Error())
+		}
+		_, err = client.Open("file1")
+		assert.Error(t, err)
+		err = f1.Close()
+		assert.NoError(t, err)
+		_, err = client.Create("file3")
+		assert.NoError(t, err)
+		// close the session without closing the files
+		client.Close()
+		assert.Eventually(t, func() bool {
+			return len(common.Connections.GetStats()) == 0
+		}, 1*time.Second, 50*time.Millisecond)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		f1, err := client.Open("file1")
+		assert.NoError(t, err)
+		f2, err := client.Open("file2")
+		assert.NoError(t, err)
+		err = f1.Close()
+		assert.NoError(t, err)
+		err = f2.Close()
 		assert.NoError(t, err)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
@@ -2563,58 +4136,113 @@ func TestBandwidthAndConnections(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-//nolint:dupl
-func TestPatternsFilters(t *testing.T) {
+func TestMaxConcurrentTransfers(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
+	u.Filters.MaxConcurrentUploads = 1
+	u.Filters.MaxConcurrentDownloads = 1
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	assert.NoError(t, err)
-	testFileSize := int64(131072)
-	testFilePath := filepath.Join(homeBasePath, testFileName)
-	localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
-	client, err := getSftpClient(user, usePubKey)
+	client1, err := getSftpClient(user, usePubKey)
 	if assert.NoError(t, err) {
-		defer client.Close()
-		err = createTestFile(testFilePath, testFileSize)
-		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		assert.NoError(t, err)
-		err = sftpUploadFile(testFilePath, testFileName+".zip", testFileSize, client)
-		assert.NoError(t, err)
+		defer client1.Close()
+		client2, err := getSftpClient(user, usePubKey)
+		if assert.NoError(t, err) {
+			defer client2.Close()
+			f1, err := client1.Create("file1")
+			assert.NoError(t, err)
+			// the limit applies to all the sessions
+			_, err = client2.Create("file2")
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), common.ErrTooManyUploads.Error())
+			}
+			// downloads are limited independently
+			_, err = f1.Write([]byte("data"))
+			assert.NoError(t, err)
+			err = f1.Close()
+			assert.NoError(t, err)
+			f2, err := client2.Create("file2")
+			assert.NoError(t, err)
+			r1, err := client1.Open("file1")
+			assert.NoError(t, err)
+			_, err = client2.Open("file1")
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), common.ErrTooManyDownloads.Error())
+			}
+			err = r1.Close()
+			assert.NoError(t, err)
+			r1, err = client2.Open("file1")
+			assert.NoError(t, err)
+			err = r1.Close()
+			assert.NoError(t, err)
+			err = f2.Close()
+			assert.NoError(t, err)
+		}
 	}
-	user.Filters.FilePatterns = []dataprovider.PatternsFilter{
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestWriteModeFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.WriteModes = []dataprovider.WriteModeFilter{
 		{
-			Path:            "/",
-			AllowedPatterns: []string{"*.zIp"},
-			DeniedPatterns:  []string{},
+			Path:          "/",
+			AppendOnly:    []string{".log"},
+			OverwriteOnly: []string{"*.csv"},
+		},
+		{
+			Path: "/sub",
+			// files in this directory have no restrictions
+			OverwriteOnly: []string{"*.dat"},
 		},
 	}
-	_, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	assert.NoError(t, err)
-	client, err = getSftpClient(user, usePubKey)
+	testFileSize := int64(65535)
+	appendDataSize := int64(65535)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	client, err := getSftpClient(user, usePubKey)
 	if assert.NoError(t, err) {
 		defer client.Close()
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		assert.Error(t, err)
-		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		// new files can always be created
+		err = sftpUploadFile(testFilePath, "app.LOG", testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, "data.csv", testFileSize, client)
+		assert.NoError(t, err)
+		err = appendToTestFile(testFilePath, appendDataSize)
+		assert.NoError(t, err)
+		// append-only files cannot be overwritten or truncated
+		err = sftpUploadFile(testFilePath, "app.LOG", testFileSize+appendDataSize, client)
 		assert.Error(t, err)
-		err = client.Rename(testFileName, testFileName+"1")
+		err = client.Truncate("app.LOG", 0)
 		assert.Error(t, err)
-		err = client.Remove(testFileName)
+		err = sftpUploadResumeFile(testFilePath, "app.LOG", testFileSize+appendDataSize, false, client)
+		assert.NoError(t, err)
+		// overwrite-only files cannot be appended
+		err = sftpUploadResumeFile(testFilePath, "data.csv", testFileSize+appendDataSize, false, client)
 		assert.Error(t, err)
-		err = sftpDownloadFile(testFileName+".zip", localDownloadPath, testFileSize, client)
+		err = sftpUploadFile(testFilePath, "data.csv", testFileSize+appendDataSize, client)
 		assert.NoError(t, err)
-		err = client.Mkdir("dir.zip")
+		// the most specific filter wins
+		err = client.Mkdir("sub")
 		assert.NoError(t, err)
-		err = client.Rename("dir.zip", "dir1.zip")
+		err = sftpUploadFile(testFilePath, path.Join("sub", "app.log"), testFileSize+appendDataSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("sub", "app.log"), testFileSize+appendDataSize, client)
+		assert.NoError(t, err)
+		err = client.Truncate(path.Join("sub", "app.log"), 0)
 		assert.NoError(t, err)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	assert.NoError(t, err)
 	err = os.Remove(testFilePath)
 	assert.NoError(t, err)
-	err = os.Remove(localDownloadPath)
-	assert.NoError(t, err)
 	err = os.RemoveAll(user.GetHomeDir())
 	assert.NoError(t, err)
 }
@@ -2791,6 +4419,53 @@ func TestVirtualFolders(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestPathPlaceholders(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.HomeDir = filepath.Join(homeBasePath, "%username%_%uid%")
+	u.UID = 1000
+	mappedPath := filepath.Join(os.TempDir(), "placeholders", "%username%")
+	vdirPath := "/vdir"
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		BaseVirtualFolder: vfs.BaseVirtualFolder{
+			MappedPath: mappedPath,
+		},
+		VirtualPath: vdirPath,
+	})
+	resolvedHomeDir := filepath.Join(homeBasePath, defaultUsername+"_1000")
+	resolvedMappedPath := filepath.Join(os.TempDir(), "placeholders", defaultUsername)
+	err := os.MkdirAll(resolvedMappedPath, os.ModePerm)
+	assert.NoError(t, err)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, u.HomeDir, user.HomeDir)
+	assert.Equal(t, resolvedHomeDir, user.GetHomeDir())
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFileSize := int64(65535)
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		assert.FileExists(t, filepath.Join(resolvedHomeDir, testFileName))
+		assert.FileExists(t, filepath.Join(resolvedMappedPath, testFileName))
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveFolder(vfs.BaseVirtualFolder{MappedPath: mappedPath}, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(resolvedHomeDir)
+	assert.NoError(t, err)
+	err = os.RemoveAll(filepath.Join(os.TempDir(), "placeholders"))
+	assert.NoError(t, err)
+}
+
 func TestVirtualFoldersQuotaLimit(t *testing.T) {
 	usePubKey := false
 	u1 := getTestUser(usePubKey)
@@ -5049,6 +6724,39 @@ func TestPermUpload(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestPermUploadPattern(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermDownload}
+	u.Permissions["/*.csv"] = []string{dataprovider.PermListItems, dataprovider.PermUpload}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.Error(t, err, "file upload without permission should not succeed")
+		err = sftpUploadFile(testFilePath, "file.csv", testFileSize, client)
+		assert.NoError(t, err)
+		// only upload is allowed for csv files
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile("file.csv", localDownloadPath, testFileSize, client)
+		assert.Error(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestPermOverwrite(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
@@ -5077,6 +6785,70 @@ func TestPermOverwrite(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRequireRenamePermission(t *testing.T) {
+	u := getTestUser(true)
+	u.Permissions["/intake"] = []string{dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload,
+		dataprovider.PermDelete, dataprovider.PermCreateDirs}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, true)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = client.Mkdir("/intake")
+		assert.NoError(t, err)
+		err = sftpUploadFile(testFilePath, path.Join("/intake", testFileName), testFileSize, client)
+		assert.NoError(t, err)
+		// delete and upload permissions allow to rename
+		err = client.Rename(path.Join("/intake", testFileName), path.Join("/intake", testFileName+"_1"))
+		assert.NoError(t, err)
+		err = client.Rename(path.Join("/intake", testFileName+"_1"), path.Join("/intake", testFileName))
+		assert.NoError(t, err)
+	}
+	user.Filters.RequireRenamePermission = true
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	client, err = getSftpClient(user, true)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		err = client.Rename(path.Join("/intake", testFileName), path.Join("/intake", testFileName+"_1"))
+		assert.Error(t, err)
+		// a move requires the rename permission on both source and target
+		err = client.Rename(path.Join("/intake", testFileName), path.Join("/", testFileName))
+		assert.Error(t, err)
+		err = client.Mkdir(path.Join("/intake", "sub"))
+		assert.NoError(t, err)
+		err = client.Rename(path.Join("/intake", "sub"), path.Join("/intake", "sub1"))
+		assert.Error(t, err)
+		err = client.Mkdir("/dir")
+		assert.NoError(t, err)
+		err = client.Rename("/dir", "/intake/dir")
+		assert.Error(t, err)
+		// uploads, downloads and deletes are still allowed
+		err = sftpUploadFile(testFilePath, path.Join("/intake", testFileName+"_1"), testFileSize, client)
+		assert.NoError(t, err)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = sftpDownloadFile(path.Join("/intake", testFileName), localDownloadPath, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Remove(path.Join("/intake", testFileName))
+		assert.NoError(t, err)
+		// the rename permission on the root directory is enough outside the intake directory
+		err = client.Rename("/dir", "/dir1")
+		assert.NoError(t, err)
+		err = os.Remove(localDownloadPath)
+		assert.NoError(t, err)
+	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestPermDelete(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
@@ -5175,6 +6947,63 @@ func TestPermRenameOverwrite(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestPermUploadOnly(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/dropbox"] = []string{dataprovider.PermUploadOnly}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		defer client.Close()
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		localDownloadPath := filepath.Join(homeBasePath, testDLFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		assert.NoError(t, err)
+		err = client.Mkdir("dropbox")
+		assert.NoError(t, err)
+		dropboxFile := path.Join("dropbox", testFileName)
+		err = sftpUploadFile(testFilePath, dropboxFile, 0, client)
+		assert.NoError(t, err)
+		assert.FileExists(t, filepath.Join(user.GetHomeDir(), "dropbox", testFileName))
+		// overwrite, download, list, rename and delete are not allowed
+		err = sftpUploadFile(testFilePath, dropboxFile, 0, client)
+		assert.Error(t, err)
+		err = sftpDownloadFile(dropboxFile, localDownloadPath, testFileSize, client)
+		assert.Error(t, err)
+		_, err = client.ReadDir("dropbox")
+		assert.Error(t, err)
+		_, err = client.Stat(dropboxFile)
+		assert.Error(t, err)
+		err = client.Rename(dropboxFile, testFileName)
+		assert.Error(t, err)
+		err = client.Rename(dropboxFile, dropboxFile+".rename")
+		assert.Error(t, err)
+		err = client.Remove(dropboxFile)
+		assert.Error(t, err)
+		err = client.Mkdir(path.Join("dropbox", "subdir"))
+		assert.Error(t, err)
+		// moving a new file inside the drop box is allowed
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Rename(testFileName, path.Join("dropbox", testFileName+".moved"))
+		assert.NoError(t, err)
+		assert.FileExists(t, filepath.Join(user.GetHomeDir(), "dropbox", testFileName+".moved"))
+		// but not over an existing file
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		assert.NoError(t, err)
+		err = client.Rename(testFileName, dropboxFile)
+		assert.Error(t, err)
+		err = os.Remove(testFilePath)
+		assert.NoError(t, err)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestPermCreateDirs(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
@@ -5812,6 +7641,43 @@ func TestUserPerms(t *testing.T) {
 	assert.True(t, user.HasPerm(dataprovider.PermDownload, "/p/1/test/file.dat"))
 }
 
+func TestUserPatternPerms(t *testing.T) {
+	user := getTestUser(true)
+	user.Permissions = make(map[string][]string)
+	user.Permissions["/"] = []string{dataprovider.PermAny}
+	user.Permissions["/incoming"] = []string{dataprovider.PermListItems}
+	user.Permissions["/incoming/*.csv"] = []string{dataprovider.PermListItems, dataprovider.PermUpload}
+	user.Permissions["/incoming/report*.csv"] = []string{dataprovider.PermListItems, dataprovider.PermDownload}
+	user.Permissions["/incoming/*"] = []string{dataprovider.PermListItems, dataprovider.PermCreateDirs}
+	user.Permissions["/incoming/sub"] = []string{dataprovider.PermListItems, dataprovider.PermDelete}
+	user.Permissions["/data/*/private"] = []string{dataprovider.PermListItems}
+	// plain directory keys are still supported
+	assert.True(t, user.HasPerm(dataprovider.PermDelete, "/"))
+	assert.False(t, user.HasPerm(dataprovider.PermUpload, "/incoming"))
+	assert.True(t, user.HasFilePerm(dataprovider.PermUpload, "/file.txt"))
+	// the most specific pattern wins
+	assert.True(t, user.HasFilePerm(dataprovider.PermUpload, "/incoming/file.csv"))
+	assert.False(t, user.HasFilePerm(dataprovider.PermDownload, "/incoming/file.csv"))
+	assert.True(t, user.HasFilePerm(dataprovider.PermDownload, "incoming/report1.csv"))
+	assert.False(t, user.HasFilePerm(dataprovider.PermUpload, "/incoming/report1.csv"))
+	assert.True(t, user.HasFilePerm(dataprovider.PermCreateDirs, "/incoming/file.txt"))
+	assert.False(t, user.HasFilePerm(dataprovider.PermUpload, "/incoming/file.txt"))
+	// plain directory keys take precedence over patterns matching the same dir
+	assert.True(t, user.HasPerm(dataprovider.PermDelete, "/incoming/sub"))
+	assert.False(t, user.HasPerm(dataprovider.PermCreateDirs, "/incoming/sub"))
+	assert.True(t, user.HasPerm(dataprovider.PermCreateDirs, "/incoming/other"))
+	assert.True(t, user.HasPerm(dataprovider.PermCreateDirs, "/incoming/other/dir"))
+	// patterns do not match across directories, the parent dir permissions apply
+	assert.True(t, user.HasFilePerm(dataprovider.PermDelete, "/incoming/sub/file.csv"))
+	assert.False(t, user.HasFilePerm(dataprovider.PermUpload, "/incoming/sub/file.csv"))
+	assert.False(t, user.HasPerm(dataprovider.PermDownload, "/data/user1/private"))
+	assert.True(t, user.HasPerm(dataprovider.PermDownload, "/data/user1/public"))
+	assert.True(t, user.HasPermissionsInside("/data"))
+	assert.True(t, user.HasPermissionsInside("/data/user1"))
+	assert.False(t, user.HasPermissionsInside("/data/user1/public"))
+	assert.False(t, user.HasPermissionsInside("/other"))
+}
+
 //nolint:dupl
 func TestFilterFilePatterns(t *testing.T) {
 	user := getTestUser(true)
@@ -6117,6 +7983,80 @@ func TestSSHCommands(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestAllowedExecCommands(t *testing.T) {
+	if runtime.GOOS == osWindows {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Filters.AllowedExecCommands = []string{"/bin/pwd", "/usr/bin/env", "/bin/false", "^/bin/echo [a-z]+$", "^[invalid"}
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	assert.NoError(t, err)
+	u.Filters.AllowedExecCommands = u.Filters.AllowedExecCommands[:4]
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Len(t, user.Filters.AllowedExecCommands, 4)
+	// the commands are never executed as the service user
+	_, err = runSSHCommand("/bin/pwd", user, usePubKey)
+	assert.Error(t, err, "allowed commands for a user without uid and gid must fail")
+	if os.Getuid() != 0 {
+		// the user credentials can be set only if SFTPGo runs as root
+		_, err = httpd.RemoveUser(user, http.StatusOK)
+		assert.NoError(t, err)
+		err = os.RemoveAll(user.GetHomeDir())
+		assert.NoError(t, err)
+		t.Skip("the allowed exec commands can be tested only as root")
+	}
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+	user.UID = 1000
+	user.GID = 1000
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	// create the home dir with the user's uid and gid
+	client, err := getSftpClient(user, usePubKey)
+	if assert.NoError(t, err) {
+		client.Close()
+	}
+
+	out, err := runSSHCommand("/bin/pwd", user, usePubKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, user.GetHomeDir()+"\n", string(out))
+	}
+	out, err = runSSHCommand("/usr/bin/env", user, usePubKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, fmt.Sprintf("HOME=%v\nUSER=%v\n", user.GetHomeDir(), user.Username), string(out))
+	}
+	out, err = runSSHCommand("/bin/echo hello", user, usePubKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello\n", string(out))
+	}
+	_, err = runSSHCommand("/bin/echo hello; /bin/pwd", user, usePubKey)
+	assert.Error(t, err, "command not allowed must fail")
+	_, err = runSSHCommand("/bin/echo Hello", user, usePubKey)
+	assert.Error(t, err, "command not allowed must fail")
+	_, err = runSSHCommand("/bin/pwd -P", user, usePubKey)
+	assert.Error(t, err, "command not allowed must fail")
+	_, err = runSSHCommand("/bin/false", user, usePubKey)
+	assert.Error(t, err)
+
+	user.Filters.AllowedExecCommands = []string{"pwd"}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	_, err = runSSHCommand("pwd", user, usePubKey)
+	assert.NoError(t, err, "pwd is handled as built-in command")
+	user.Filters.AllowedExecCommands = []string{"uname"}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	_, err = runSSHCommand("uname", user, usePubKey)
+	assert.Error(t, err, "the executable must be an absolute path")
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestSSHFileHash(t *testing.T) {
 	usePubKey := true
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
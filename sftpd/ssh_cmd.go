@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime/debug"
 	"strings"
 	"sync"
@@ -78,6 +79,16 @@ func processSSHCommand(payload []byte, connection *Connection, enabledSSHCommand
 				go sshCommand.handle() //nolint:errcheck
 				return true
 			}
+		} else if err == nil && connection.User.IsExecCommandAllowed(msg.Command) {
+			connection.command = msg.Command
+			connection.SetProtocol(common.ProtocolSSH)
+			sshCommand := sshCommand{
+				command:    name,
+				connection: connection,
+				args:       args,
+			}
+			go sshCommand.handleAllowedExecCommand() //nolint:errcheck
+			return true
 		} else {
 			connection.Log(logger.LevelInfo, "ssh command not enabled/supported: %#v", name)
 		}
@@ -118,6 +129,117 @@ func (c *sshCommand) handle() (err error) {
 	return
 }
 
+// handleAllowedExecCommand executes a command line explicitly allowed for the user.
+// The command is executed without a shell, inside the user home directory, using
+// the user's uid/gid and a minimal environment
+func (c *sshCommand) handleAllowedExecCommand() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(logSender, "", "panic in handle allowed exec command: %#v stack strace: %v", r, string(debug.Stack()))
+			err = common.ErrGenericFailure
+		}
+	}()
+	common.Connections.Add(c.connection)
+	defer common.Connections.Remove(c.connection.GetID())
+
+	c.connection.UpdateLastActivity()
+	if !vfs.IsLocalOsFs(c.connection.Fs) {
+		return c.sendExecErrorResponse(errUnsupportedConfig)
+	}
+	if !filepath.IsAbs(c.command) {
+		return c.sendExecErrorResponse(fmt.Errorf("the executable %#v must be an absolute path", c.command))
+	}
+	homeDir := c.connection.User.GetHomeDir()
+	uid := c.connection.User.GetUID()
+	gid := c.connection.User.GetGID()
+	if err := checkExecCredentials(uid, gid); err != nil {
+		c.connection.Log(logger.LevelWarn, "allowed command %#v refused: %v", c.command, err)
+		return c.sendExecErrorResponse(errUnsupportedConfig)
+	}
+	cmd := exec.Command(c.command, c.args...)
+	cmd.Dir = homeDir
+	cmd.Env = []string{
+		fmt.Sprintf("HOME=%v", homeDir),
+		fmt.Sprintf("USER=%v", c.connection.User.Username),
+	}
+	cmd = wrapCmd(cmd, uid, gid)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return c.sendExecErrorResponse(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return c.sendExecErrorResponse(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return c.sendExecErrorResponse(err)
+	}
+	c.connection.Log(logger.LevelInfo, "executing allowed command %#v, args: %v, dir: %#v, uid: %v, gid: %v, env: %v",
+		c.command, c.args, homeDir, uid, gid, cmd.Env)
+	err = cmd.Start()
+	if err != nil {
+		return c.sendExecErrorResponse(err)
+	}
+
+	go func() {
+		defer stdin.Close()
+		_, e := io.Copy(stdin, c.connection.channel)
+		c.connection.Log(logger.LevelDebug, "allowed command %#v, copy to stdin ended, err: %v", c.connection.command, e)
+	}()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, e := io.Copy(c.connection.channel.(ssh.Channel).Stderr(), stderr)
+		c.connection.Log(logger.LevelDebug, "allowed command %#v, copy from stderr ended, err: %v", c.connection.command, e)
+	}()
+	go func() {
+		defer wg.Done()
+		_, e := io.Copy(c.connection.channel, stdout)
+		c.connection.Log(logger.LevelDebug, "allowed command %#v, copy from stdout ended, err: %v", c.connection.command, e)
+		if e != nil {
+			killerr := cmd.Process.Kill()
+			c.connection.Log(logger.LevelDebug, "allowed command %#v killed after write error, kill error: %v",
+				c.connection.command, killerr)
+		}
+	}()
+	wg.Wait()
+	err = cmd.Wait()
+	c.sendExecExitStatus(err)
+	return err
+}
+
+func (c *sshCommand) sendExecErrorResponse(err error) error {
+	c.connection.channel.(ssh.Channel).Stderr().Write([]byte(fmt.Sprintf("%v: %v\n", c.command, err))) //nolint:errcheck
+	c.sendExecExitStatus(err)
+	return err
+}
+
+func (c *sshCommand) sendExecExitStatus(err error) {
+	status := uint32(0)
+	if err != nil {
+		status = uint32(1)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			status = uint32(exitErr.ExitCode())
+		}
+		c.connection.Log(logger.LevelWarn, "allowed command failed: %#v user: %v exit status: %v err: %v",
+			c.connection.command, c.connection.User.Username, status, err)
+	} else {
+		logger.CommandLog(sshCommandLogSender, "", "", c.connection.User.Username, "", c.connection.ID,
+			common.ProtocolSSH, c.connection.User.GetUID(), c.connection.User.GetGID(), "", "", c.connection.command, -1)
+	}
+	exitStatus := sshSubsystemExitStatus{
+		Status: status,
+	}
+	c.connection.channel.(ssh.Channel).SendRequest("exit-status", false, ssh.Marshal(&exitStatus)) //nolint:errcheck
+	c.connection.channel.Close()
+	metrics.SSHCommandCompleted(err)
+	common.SSHCommandActionNotification(&c.connection.User, "", "", c.command, err)
+}
+
 func (c *sshCommand) handeSFTPGoCopy() error {
 	if !vfs.IsLocalOsFs(c.connection.Fs) {
 		return c.sendErrorResponse(errUnsupportedConfig)
@@ -147,6 +269,9 @@ func (c *sshCommand) handeSFTPGoCopy() error {
 	filesNum := 0
 	filesSize := int64(0)
 	if fi.IsDir() {
+		if err = c.connection.CheckRecursionLimits(fsSourcePath); err != nil {
+			return c.sendErrorResponse(err)
+		}
 		filesNum, filesSize, err = c.connection.Fs.GetDirSize(fsSourcePath)
 		if err != nil {
 			return c.sendErrorResponse(err)
@@ -160,7 +285,7 @@ func (c *sshCommand) handeSFTPGoCopy() error {
 			return c.sendErrorResponse(err)
 		}
 	} else if fi.Mode().IsRegular() {
-		if !c.connection.User.IsFileAllowed(sshDestPath) {
+		if !c.connection.User.IsFileAllowed(sshDestPath) || !c.connection.User.IsUploadNameAllowed(sshDestPath) {
 			err := errors.New("unsupported copy destination: this file is not allowed")
 			return c.sendErrorResponse(err)
 		}
@@ -206,6 +331,9 @@ func (c *sshCommand) handeSFTPGoRemove() error {
 	filesNum := 0
 	filesSize := int64(0)
 	if fi.IsDir() {
+		if err = c.connection.CheckRecursionLimits(fsDestPath); err != nil {
+			return c.sendErrorResponse(err)
+		}
 		filesNum, filesSize, err = c.connection.Fs.GetDirSize(fsDestPath)
 		if err != nil {
 			return c.sendErrorResponse(err)
@@ -569,7 +697,7 @@ func (c *sshCommand) checkRecursiveCopyPermissions(fsSourcePath, fsDestPath, ssh
 		dataprovider.PermUpload,
 	}
 
-	err := c.connection.Fs.Walk(fsSourcePath, func(walkedPath string, info os.FileInfo, err error) error {
+	err := c.connection.Walk(fsSourcePath, func(walkedPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
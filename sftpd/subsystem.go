@@ -8,6 +8,7 @@ import (
 
 	"github.com/drakkan/sftpgo/common"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 type subsystemChannel struct {
@@ -40,6 +41,9 @@ func ServeSubSystemConnection(user dataprovider.User, connectionID string, reade
 	if err != nil {
 		return err
 	}
+	if err = vfs.CheckHomeMarker(fs, user.FsConfig.HomeMarker); err != nil {
+		return err
+	}
 	fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
 	dataprovider.UpdateLastLogin(user) //nolint:errcheck
 
@@ -92,7 +92,12 @@ func newTransfer(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter,
 func (t *transfer) ReadAt(p []byte, off int64) (n int, err error) {
 	t.Connection.UpdateLastActivity()
 
-	n, err = t.readerAt.ReadAt(p, off)
+	size, err := t.ReserveDownloadVolume(len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err = t.readerAt.ReadAt(p[:size], off)
+	t.ReleaseDownloadVolume(size - n)
 	atomic.AddInt64(&t.BytesSent, int64(n))
 
 	if err != nil && err != io.EOF {
@@ -116,6 +121,7 @@ func (t *transfer) WriteAt(p []byte, off int64) (n int, err error) {
 	}
 
 	n, err = t.writerAt.WriteAt(p, off)
+	t.UpdateChecksum(p[:n], off)
 	atomic.AddInt64(&t.BytesReceived, int64(n))
 
 	if t.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&t.BytesReceived) > t.MaxWriteSize {
@@ -224,7 +230,8 @@ func (t *transfer) copyFromReaderToWriter(dst io.Writer, src io.Reader) (int64,
 	}
 	t.ErrTransfer = err
 	if written > 0 || err != nil {
-		metrics.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.GetType(), t.ErrTransfer)
+		metrics.TransferCompleted(atomic.LoadInt64(&t.BytesSent), atomic.LoadInt64(&t.BytesReceived), t.GetType(),
+			t.Connection.GetProtocol(), t.Connection.GetUsername(), t.ErrTransfer)
 	}
 	return written, err
 }
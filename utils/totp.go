@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters, they are the defaults defined in RFC 6238 and they are
+// the only ones supported by most authenticator apps
+const (
+	TOTPDigits     = 6
+	TOTPPeriod     = 30
+	totpSecretSize = 20
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random base32 encoded TOTP secret
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// GetTOTPCode returns the TOTP code for the given base32 encoded secret at the given time
+func GetTOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+	return getHOTPCode(key, uint64(t.Unix()/TOTPPeriod)), nil
+}
+
+// ValidateTOTPCode returns true if the given code is valid for the base32 encoded secret
+// at the given time. The codes for the skew periods before and after the current one are
+// accepted too, to allow for clock skew. The time step for the matching code is returned,
+// so the callers can refuse to accept the same code more than once
+func ValidateTOTPCode(secret, code string, t time.Time, skew int) (int64, bool) {
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return 0, false
+	}
+	counter := t.Unix() / TOTPPeriod
+	for i := -skew; i <= skew; i++ {
+		expected := getHOTPCode(key, uint64(counter+int64(i)))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// GetTOTPProvisioningURL returns the otpauth URL for the given secret, authenticator
+// apps can import it directly or from a QR code
+func GetTOTPProvisioningURL(issuer, accountName, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%v", TOTPDigits))
+	v.Set("period", fmt.Sprintf("%v", TOTPPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + accountName,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// getHOTPCode implements the HOTP algorithm as defined in RFC 4226
+func getHOTPCode(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:]) //nolint:errcheck
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, value%1000000)
+}
@@ -2,6 +2,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
@@ -10,6 +11,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"database/sql/driver"
 	"encoding/hex"
 	"encoding/pem"
 	"errors"
@@ -23,6 +25,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -42,6 +45,16 @@ func IsStringInSlice(obj string, list []string) bool {
 	return false
 }
 
+// IsIntInSlice searches an int in a slice and returns true if the int is found
+func IsIntInSlice(obj int, list []int) bool {
+	for _, v := range list {
+		if v == obj {
+			return true
+		}
+	}
+	return false
+}
+
 // IsStringPrefixInSlice searches a string prefix in a slice and returns true
 // if a matching prefix is found
 func IsStringPrefixInSlice(obj string, list []string) bool {
@@ -381,3 +394,18 @@ func createDirPathIfMissing(file string, perm os.FileMode) error {
 	}
 	return nil
 }
+
+// IsTransientNetworkError returns true if the given error is a temporary network
+// error, such as a refused or reset connection or a timeout, that could not happen
+// again if the operation is retried
+func IsTransientNetworkError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -5,6 +5,7 @@ package vfs
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -20,6 +21,7 @@ import (
 	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/eikenb/pipeat"
 
 	"github.com/drakkan/sftpgo/logger"
@@ -27,12 +29,24 @@ import (
 	"github.com/drakkan/sftpgo/version"
 )
 
-const azureDefaultEndpoint = "blob.core.windows.net"
+const (
+	azureDefaultEndpoint         = "blob.core.windows.net"
+	azureStorageResource         = "https://storage.azure.com/"
+	azureActiveDirectoryEndpoint = "https://login.microsoftonline.com/"
+)
 
 // max time of an azure web request response window (whether or not data is flowing)
 // this is the same value used in rclone
 var maxTryTimeout = time.Hour * 24 * 365
 
+// azTokens caches the Azure AD token providers by managed identity client ID
+var azTokens = struct {
+	sync.Mutex
+	tokens map[string]*adal.ServicePrincipalToken
+}{
+	tokens: make(map[string]*adal.ServicePrincipalToken),
+}
+
 // AzureBlobFs is a Fs implementation for Azure Blob storage.
 type AzureBlobFs struct {
 	connectionID   string
@@ -54,8 +68,8 @@ func NewAzBlobFs(connectionID, localTempDir string, config AzBlobFsConfig) (Fs,
 		connectionID:   connectionID,
 		localTempDir:   localTempDir,
 		config:         config,
-		ctxTimeout:     30 * time.Second,
-		ctxLongTimeout: 300 * time.Second,
+		ctxTimeout:     getMetadataTimeout(),
+		ctxLongTimeout: getLongMetadataTimeout(),
 	}
 	if err := ValidateAzBlobFsConfig(&fs.config); err != nil {
 		return fs, err
@@ -104,7 +118,13 @@ func NewAzBlobFs(connectionID, localTempDir string, config AzBlobFsConfig) (Fs,
 		return fs, nil
 	}
 
-	credential, err := azblob.NewSharedKeyCredential(fs.config.AccountName, fs.config.AccountKey.Payload)
+	var credential azblob.Credential
+	var err error
+	if fs.config.UseManagedIdentity {
+		credential, err = getAzTokenCredential(fs.config.ManagedIdentityClientID)
+	} else {
+		credential, err = azblob.NewSharedKeyCredential(fs.config.AccountName, fs.config.AccountKey.Payload)
+	}
 	if err != nil {
 		return fs, fmt.Errorf("invalid credentials: %v", err)
 	}
@@ -138,6 +158,9 @@ func (fs *AzureBlobFs) Name() string {
 	if fs.config.SASURL != "" {
 		return fmt.Sprintf("Azure Blob SAS URL %#v", fs.config.Container)
 	}
+	if fs.config.UseManagedIdentity {
+		return fmt.Sprintf("Azure Blob managed identity container %#v", fs.config.Container)
+	}
 	return fmt.Sprintf("Azure Blob container %#v", fs.config.Container)
 }
 
@@ -165,7 +188,10 @@ func (fs *AzureBlobFs) Stat(name string) (os.FileInfo, error) {
 	if err == nil {
 		isDir := (attrs.ContentType() == dirMimeType)
 		metrics.AZListObjectsCompleted(nil)
-		return NewFileInfo(name, isDir, attrs.ContentLength(), attrs.LastModified(), false), nil
+		info := NewFileInfo(name, isDir, attrs.ContentLength(), attrs.LastModified(), false)
+		info.etag = string(attrs.ETag())
+		info.metadata = getAzureMetadata(attrs.NewMetadata())
+		return info, nil
 	}
 	if !fs.IsNotExist(err) {
 		return nil, err
@@ -194,8 +220,11 @@ func (fs *AzureBlobFs) Open(name string, offset int64) (File, *pipeat.PipeReader
 	}
 	blobBlockURL := fs.containerURL.NewBlockBlobURL(name)
 	ctx, cancelFn := context.WithCancel(context.Background())
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
 	blobDownloadResponse, err := blobBlockURL.Download(ctx, offset, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
 	if err != nil {
+		watchdog.stop()
+		err = watchdog.getError(err)
 		r.Close()
 		w.Close()
 		cancelFn()
@@ -207,9 +236,11 @@ func (fs *AzureBlobFs) Open(name string, offset int64) (File, *pipeat.PipeReader
 
 	go func() {
 		defer cancelFn()
+		defer watchdog.stop()
 		defer body.Close()
 
-		n, err := io.Copy(w, body)
+		n, err := io.Copy(watchdog.wrapWriter(w), body)
+		err = watchdog.getError(err)
 		w.CloseWithError(err) //nolint:errcheck
 		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
 		metrics.AZTransferCompleted(n, 1, err)
@@ -239,8 +270,10 @@ func (fs *AzureBlobFs) Create(name string, flag int) (File, *PipeWriter, func(),
 		headers.ContentType = contentType
 	}
 
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
 	go func() {
 		defer cancelFn()
+		defer watchdog.stop()
 
 		/*uploadOptions := azblob.UploadStreamToBlockBlobOptions{
 			BufferSize:      int(fs.config.UploadPartSize),
@@ -251,7 +284,9 @@ func (fs *AzureBlobFs) Create(name string, flag int) (File, *PipeWriter, func(),
 		// if we shutdown Azurite while uploading it hangs, so we use our own wrapper for
 		// the low level functions
 		_, err := azblob.UploadStreamToBlockBlob(ctx, r, blobBlockURL, uploadOptions)*/
-		err := fs.handleMultipartUpload(ctx, r, blobBlockURL, headers)
+		body, hasher := newHashingReader(watchdog.wrapReader(r), md5.New(), 0)
+		err := fs.handleMultipartUpload(ctx, body, blobBlockURL, headers, hasher)
+		err = watchdog.getError(err)
 		r.CloseWithError(err) //nolint:errcheck
 		p.Done(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, r.GetReadedBytes(), err)
@@ -393,6 +428,19 @@ func (*AzureBlobFs) Truncate(name string, size int64) error {
 // a list of directory entries.
 func (fs *AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 	var result []os.FileInfo
+	err := fs.ReadDirPages(dirname, func(page []os.FileInfo) bool {
+		result = append(result, page...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReadDirPages reads the directory named by dirname and calls fn for
+// each page of directory entries. The listing stops if fn returns false
+func (fs *AzureBlobFs) ReadDirPages(dirname string, fn func(page []os.FileInfo) bool) error {
 	// dirname must be already cleaned
 	prefix := ""
 	if dirname != "" && dirname != "." {
@@ -411,7 +459,7 @@ func (fs *AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 		listBlob, err := fs.containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{
 			Details: azblob.BlobListingDetails{
 				Copy:             false,
-				Metadata:         false,
+				Metadata:         true,
 				Snapshots:        false,
 				UncommittedBlobs: false,
 				Deleted:          false,
@@ -420,9 +468,10 @@ func (fs *AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 		})
 		if err != nil {
 			metrics.AZListObjectsCompleted(err)
-			return nil, err
+			return err
 		}
 		marker = listBlob.NextMarker
+		var result []os.FileInfo
 		for _, blobPrefix := range listBlob.Segment.BlobPrefixes {
 			// we don't support prefixes == "/" this will be sent if a key starts with "/"
 			if blobPrefix.Name == "/" {
@@ -453,12 +502,18 @@ func (fs *AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 					prefixes[name] = true
 				}
 			}
-			result = append(result, NewFileInfo(name, isDir, size, blobInfo.Properties.LastModified, false))
+			info := NewFileInfo(name, isDir, size, blobInfo.Properties.LastModified, false)
+			info.etag = string(blobInfo.Properties.Etag)
+			info.metadata = getAzureMetadata(blobInfo.Metadata)
+			result = append(result, info)
+		}
+		if len(result) > 0 && !fn(result) {
+			break
 		}
 	}
 
 	metrics.AZListObjectsCompleted(nil)
-	return result, nil
+	return nil
 }
 
 // IsUploadResumeSupported returns true if upload resume is supported.
@@ -623,7 +678,7 @@ func (fs *AzureBlobFs) Walk(root string, walkFn filepath.WalkFunc) error {
 		listBlob, err := fs.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
 			Details: azblob.BlobListingDetails{
 				Copy:             false,
-				Metadata:         false,
+				Metadata:         true,
 				Snapshots:        false,
 				UncommittedBlobs: false,
 				Deleted:          false,
@@ -647,7 +702,9 @@ func (fs *AzureBlobFs) Walk(root string, walkFn filepath.WalkFunc) error {
 			if blobInfo.Properties.ContentLength != nil {
 				blobSize = *blobInfo.Properties.ContentLength
 			}
-			err = walkFn(blobInfo.Name, NewFileInfo(blobInfo.Name, isDir, blobSize, blobInfo.Properties.LastModified, false), nil)
+			info := NewFileInfo(blobInfo.Name, isDir, blobSize, blobInfo.Properties.LastModified, false)
+			info.metadata = getAzureMetadata(blobInfo.Metadata)
+			err = walkFn(blobInfo.Name, info, nil)
 			if err != nil {
 				return err
 			}
@@ -676,6 +733,44 @@ func (fs *AzureBlobFs) ResolvePath(virtualPath string) (string, error) {
 	return fs.Join(fs.config.KeyPrefix, strings.TrimPrefix(virtualPath, "/")), nil
 }
 
+func (fs *AzureBlobFs) checkHomeMarker(mode int) error {
+	if fs.config.KeyPrefix == "" {
+		return nil
+	}
+	_, err := fs.headObject(fs.config.KeyPrefix)
+	if err == nil {
+		return nil
+	}
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	return createMissingHomeMarker(fs, mode, fs.config.KeyPrefix)
+}
+
+// SetObjectMetadata adds the specified custom metadata to the named object.
+// Azure Blob Storage replaces all the metadata, so the existing ones are read
+// first and the update fails if the blob changes in the meantime
+func (fs *AzureBlobFs) SetObjectMetadata(name string, metadata map[string]string) error {
+	attrs, err := fs.headObject(name)
+	if err != nil {
+		return err
+	}
+	md := attrs.NewMetadata()
+	for k, v := range metadata {
+		// Azure Blob Storage returns lowercase keys
+		md[strings.ToLower(k)] = v
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	_, err = fs.containerURL.NewBlobURL(name).SetMetadata(ctx, md, azblob.BlobAccessConditions{
+		ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+			IfMatch: attrs.ETag(),
+		},
+	})
+	return err
+}
+
 func (fs *AzureBlobFs) headObject(name string) (*azblob.BlobGetPropertiesResponse, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
@@ -695,6 +790,11 @@ func (fs *AzureBlobFs) GetMimeType(name string) (string, error) {
 	return response.ContentType(), nil
 }
 
+// GetSignedURL returns ErrVfsUnsupported, signed URLs are not supported for this filesystem
+func (*AzureBlobFs) GetSignedURL(name string, expiration time.Duration) (string, error) {
+	return "", ErrVfsUnsupported
+}
+
 func (fs *AzureBlobFs) isEqual(key string, virtualName string) bool {
 	if key == virtualName {
 		return true
@@ -708,6 +808,67 @@ func (fs *AzureBlobFs) isEqual(key string, virtualName string) bool {
 	return false
 }
 
+// getAzServicePrincipalToken returns the token provider for the service principal
+// defined using the AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET
+// environment variables, if all of them are set, otherwise for the managed identity.
+// The token providers are cached and shared between all the connections
+func getAzServicePrincipalToken(clientID string) (*adal.ServicePrincipalToken, error) {
+	azTokens.Lock()
+	defer azTokens.Unlock()
+
+	if spt, ok := azTokens.tokens[clientID]; ok {
+		return spt, nil
+	}
+	var spt *adal.ServicePrincipalToken
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	envClientID := os.Getenv("AZURE_CLIENT_ID")
+	clientSecret := os.Getenv("AZURE_CLIENT_SECRET")
+	if tenantID != "" && envClientID != "" && clientSecret != "" {
+		oauthConfig, err := adal.NewOAuthConfig(azureActiveDirectoryEndpoint, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		spt, err = adal.NewServicePrincipalToken(*oauthConfig, envClientID, clientSecret, azureStorageResource)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		spt, err = adal.NewServicePrincipalTokenFromManagedIdentity(azureStorageResource, &adal.ManagedIdentityOptions{
+			ClientID: clientID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	azTokens.tokens[clientID] = spt
+	return spt, nil
+}
+
+// getAzTokenCredential returns an Azure AD token credential, the token is
+// refreshed in background before it expires
+func getAzTokenCredential(clientID string) (azblob.Credential, error) {
+	spt, err := getAzServicePrincipalToken(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if err := spt.EnsureFresh(); err != nil {
+		return nil, fmt.Errorf("unable to get an Azure AD token: %w", err)
+	}
+	token := spt.Token()
+	return azblob.NewTokenCredential(token.AccessToken, func(credential azblob.TokenCredential) time.Duration {
+		if err := spt.EnsureFresh(); err != nil {
+			logger.Warn("azblob", "", "unable to refresh the Azure AD token, client id %#v: %v", clientID, err)
+			// retry later, the current token could still be valid
+			return time.Minute
+		}
+		token := spt.Token()
+		credential.SetToken(token.AccessToken)
+		// EnsureFresh refreshes the token if it expires within the next 5 minutes
+		return time.Until(token.Expires()) - 4*time.Minute
+	}), nil
+}
+
 func (fs *AzureBlobFs) setConfigDefaults() {
 	if fs.config.Endpoint == "" {
 		fs.config.Endpoint = azureDefaultEndpoint
@@ -764,8 +925,11 @@ func (fs *AzureBlobFs) hasContents(name string) (bool, error) {
 	return result, err
 }
 
+// handleMultipartUpload uploads the given reader using blocks. If an hasher is provided, the integrity
+// check is enabled: each block is sent with its MD5 and it is validated by the service, the MD5 for
+// the whole content is computed while reading and stored as blob property
 func (fs *AzureBlobFs) handleMultipartUpload(ctx context.Context, reader io.Reader, blockBlobURL azblob.BlockBlobURL,
-	httpHeaders azblob.BlobHTTPHeaders) error {
+	httpHeaders azblob.BlobHTTPHeaders, hasher *hashingReader) error {
 	partSize := fs.config.UploadPartSize
 	guard := make(chan struct{}, fs.config.UploadConcurrency)
 	blockCtxTimeout := time.Duration(fs.config.UploadPartSize/(1024*1024)) * time.Minute
@@ -818,8 +982,14 @@ func (fs *AzureBlobFs) handleMultipartUpload(ctx context.Context, reader io.Read
 			innerCtx, cancelFn := context.WithDeadline(poolCtx, time.Now().Add(blockCtxTimeout))
 			defer cancelFn()
 
-			_, err := blockBlobURL.StageBlock(innerCtx, blockID, bufferReader, azblob.LeaseAccessConditions{}, nil)
+			var blockMD5 []byte
+			if hasher != nil {
+				sum := md5.Sum(buf[:bufSize])
+				blockMD5 = sum[:]
+			}
+			_, err := blockBlobURL.StageBlock(innerCtx, blockID, bufferReader, azblob.LeaseAccessConditions{}, blockMD5)
 			if err != nil {
+				err = fs.getUploadError(blockID, err)
 				errOnce.Do(func() {
 					poolError = err
 					fsLog(fs, logger.LevelDebug, "multipart upload error: %v", poolError)
@@ -839,11 +1009,26 @@ func (fs *AzureBlobFs) handleMultipartUpload(ctx context.Context, reader io.Read
 		return poolError
 	}
 
+	if hasher != nil {
+		httpHeaders.ContentMD5 = hasher.getMD5()
+	}
 	_, err := blockBlobURL.CommitBlockList(ctx, blocks, httpHeaders, azblob.Metadata{}, azblob.BlobAccessConditions{},
 		azblob.AccessTierType(fs.config.AccessTier), nil)
 	return err
 }
 
+// getUploadError returns an integrity check error if the service rejected a block
+// because its content does not match the provided MD5
+func (fs *AzureBlobFs) getUploadError(blockID string, err error) error {
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		if storageErr.ServiceCode() == azblob.ServiceCodeMd5Mismatch {
+			fsLog(fs, logger.LevelWarn, "upload integrity check failed, block %#v rejected by the service: MD5 mismatch", blockID)
+			return fmt.Errorf("%v: MD5 mismatch for block %#v", ErrIntegrityCheckFailed, blockID)
+		}
+	}
+	return err
+}
+
 // copied from rclone
 func (fs *AzureBlobFs) readFill(r io.Reader, buf []byte) (n int, err error) {
 	var nn int
@@ -917,3 +1102,13 @@ func (b *bufferAllocator) free() {
 	b.available = nil
 	b.finalized = true
 }
+
+// getAzureMetadata returns the given metadata as map, an empty map means that
+// the metadata were requested and the blob has none
+func getAzureMetadata(metadata azblob.Metadata) map[string]string {
+	result := make(map[string]string)
+	for k, v := range metadata {
+		result[k] = v
+	}
+	return result
+}
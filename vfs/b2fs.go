@@ -0,0 +1,1140 @@
+// +build !nob2
+
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/version"
+)
+
+const (
+	b2DefaultEndpoint = "https://api.backblazeb2.com"
+	b2APIPath         = "/b2api/v2/"
+	// used if B2 does not return a recommended part size
+	b2DefaultChunkSize = 100 * 1024 * 1024
+	b2MaxListCount     = 1000
+	b2ActionUpload     = "upload"
+	b2ActionFolder     = "folder"
+)
+
+// B2Fs is a Fs implementation for Backblaze B2 Cloud Storage.
+// It uses the B2 native API, the account is authorized on the first request
+type B2Fs struct {
+	connectionID   string
+	localTempDir   string
+	config         B2FsConfig
+	client         *http.Client
+	ctxTimeout     time.Duration
+	ctxLongTimeout time.Duration
+	mu             sync.Mutex
+	auth           b2Auth
+	bucketID       string
+}
+
+type b2Auth struct {
+	AccountID           string `json:"accountId"`
+	AuthorizationToken  string `json:"authorizationToken"`
+	APIURL              string `json:"apiUrl"`
+	DownloadURL         string `json:"downloadUrl"`
+	RecommendedPartSize int64  `json:"recommendedPartSize"`
+	Allowed             struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+type b2File struct {
+	FileID          string            `json:"fileId"`
+	FileName        string            `json:"fileName"`
+	ContentLength   int64             `json:"contentLength"`
+	ContentType     string            `json:"contentType"`
+	ContentSha1     string            `json:"contentSha1"`
+	FileInfo        map[string]string `json:"fileInfo"`
+	Action          string            `json:"action"`
+	UploadTimestamp int64             `json:"uploadTimestamp"`
+}
+
+type b2UploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// b2Error is the error returned by the B2 API
+type b2Error struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("B2 error, status: %v, code: %v, message: %v", e.Status, e.Code, e.Message)
+}
+
+func init() {
+	version.AddFeature("+b2")
+}
+
+// NewB2Fs returns a B2Fs object that allows to interact with Backblaze B2 Cloud Storage
+func NewB2Fs(connectionID, localTempDir string, config B2FsConfig) (Fs, error) {
+	fs := &B2Fs{
+		connectionID:   connectionID,
+		localTempDir:   localTempDir,
+		config:         config,
+		client:         &http.Client{},
+		ctxTimeout:     getMetadataTimeout(),
+		ctxLongTimeout: getLongMetadataTimeout(),
+	}
+	if err := ValidateB2FsConfig(&fs.config); err != nil {
+		return fs, err
+	}
+	if fs.config.ApplicationKey.IsEncrypted() {
+		err := fs.config.ApplicationKey.Decrypt()
+		if err != nil {
+			return fs, err
+		}
+	}
+	if fs.config.Endpoint == "" {
+		fs.config.Endpoint = b2DefaultEndpoint
+	}
+	fs.config.Endpoint = strings.TrimSuffix(fs.config.Endpoint, "/")
+	fs.config.UploadChunkSize *= 1024 * 1024
+	return fs, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *B2Fs) Name() string {
+	return fmt.Sprintf("B2Fs bucket %#v", fs.config.Bucket)
+}
+
+// ConnectionID returns the connection ID associated to this Fs implementation
+func (fs *B2Fs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *B2Fs) Stat(name string) (os.FileInfo, error) {
+	if name == "/" || name == "." {
+		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+		defer cancelFn()
+
+		if _, err := fs.getBucketID(ctx); err != nil {
+			return nil, err
+		}
+		return NewFileInfo(name, true, 0, time.Now(), false), nil
+	}
+	if "/"+fs.config.KeyPrefix == name+"/" {
+		return NewFileInfo(name, true, 0, time.Now(), false), nil
+	}
+	file, err := fs.getFile(name)
+	if err == nil {
+		info := NewFileInfo(name, false, file.ContentLength, getB2ModTime(file), false)
+		info.etag = getB2ETag(file)
+		info.metadata = getB2Metadata(file)
+		return info, nil
+	}
+	if !fs.IsNotExist(err) {
+		return nil, err
+	}
+	// a directory exists if there is a placeholder for it or at least a file inside it
+	hasFiles, err := fs.hasFiles(name)
+	if err != nil {
+		return nil, err
+	}
+	if hasFiles {
+		return NewFileInfo(name, true, 0, time.Now(), false), nil
+	}
+	return nil, getB2NotFoundError(name)
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *B2Fs) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+// Open opens the named file for reading
+func (fs *B2Fs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
+	body, err := fs.download(ctx, name, offset)
+	if err != nil {
+		watchdog.stop()
+		err = watchdog.getError(err)
+		r.Close()
+		w.Close()
+		cancelFn()
+		return nil, nil, nil, err
+	}
+	go func() {
+		defer cancelFn()
+		defer watchdog.stop()
+		defer body.Close()
+
+		n, err := io.Copy(watchdog.wrapWriter(w), body)
+		err = watchdog.getError(err)
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+		metrics.B2TransferCompleted(n, 1, err)
+	}()
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing.
+// Files smaller than the upload chunk size are uploaded using a single request,
+// bigger files are uploaded as B2 large files, one chunk at a time.
+// B2 verifies the SHA1 checksum sent for each request
+func (fs *B2Fs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+	ctx, cancelFn := context.WithCancel(context.Background())
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
+	go func() {
+		defer cancelFn()
+		defer watchdog.stop()
+
+		var contentType string
+		if flag == -1 {
+			contentType = dirMimeType
+		} else {
+			contentType = mime.TypeByExtension(path.Ext(name))
+		}
+		if contentType == "" {
+			contentType = "b2/x-auto"
+		}
+		n, err := fs.upload(ctx, name, contentType, watchdog.wrapReader(r))
+		err = watchdog.getError(err)
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
+		metrics.B2TransferCompleted(n, 0, err)
+	}()
+	return nil, p, cancelFn, nil
+}
+
+// Rename renames (moves) source to target.
+// We don't support renaming non empty directories since we should
+// rename all the contents too and this could take long time: think
+// about directories with thousands of files, for each file we should
+// execute a copy file call.
+// B2 can copy files up to 5GB using a single request, renaming bigger
+// files is not supported
+func (fs *B2Fs) Rename(source, target string) error {
+	if source == target {
+		return nil
+	}
+	fi, err := fs.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		hasContents, err := fs.hasContents(source)
+		if err != nil {
+			return err
+		}
+		if hasContents {
+			return fmt.Errorf("Cannot rename non empty directory: %#v", source)
+		}
+		if !strings.HasSuffix(source, "/") {
+			source += "/"
+		}
+		if !strings.HasSuffix(target, "/") {
+			target += "/"
+		}
+	}
+	file, err := fs.getFile(source)
+	if err != nil {
+		if fi.IsDir() && fs.IsNotExist(err) {
+			// the directory exists only as a prefix, nothing to rename
+			return nil
+		}
+		return err
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	err = fs.apiCall(ctx, "b2_copy_file", map[string]string{
+		"sourceFileId":      file.FileID,
+		"fileName":          getB2FileName(target),
+		"metadataDirective": "COPY",
+	}, nil)
+	metrics.B2CopyObjectCompleted(err)
+	if err != nil {
+		return err
+	}
+	return fs.deleteFile(file)
+}
+
+// SetObjectMetadata adds the specified custom metadata to the named file.
+// B2 file info cannot be updated, so the file is copied over itself replacing them
+// and the previous version is removed: as for Rename, this does not work for files
+// bigger than 5GB
+func (fs *B2Fs) SetObjectMetadata(name string, metadata map[string]string) error {
+	file, err := fs.getFile(name)
+	if err != nil {
+		return err
+	}
+	fileInfo := make(map[string]string)
+	for k, v := range file.FileInfo {
+		fileInfo[k] = v
+	}
+	for k, v := range metadata {
+		fileInfo[k] = v
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	err = fs.apiCall(ctx, "b2_copy_file", map[string]interface{}{
+		"sourceFileId":      file.FileID,
+		"fileName":          file.FileName,
+		"metadataDirective": "REPLACE",
+		"contentType":       file.ContentType,
+		"fileInfo":          fileInfo,
+	}, nil)
+	metrics.B2CopyObjectCompleted(err)
+	if err != nil {
+		return err
+	}
+	if err = fs.deleteFile(file); err != nil {
+		// the latest version has the new metadata, the previous one is only wasted space
+		fsLog(fs, logger.LevelWarn, "unable to remove the previous version for file %#v: %v", name, err)
+	}
+	return nil
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs *B2Fs) Remove(name string, isDir bool) error {
+	if isDir {
+		hasContents, err := fs.hasContents(name)
+		if err != nil {
+			return err
+		}
+		if hasContents {
+			return fmt.Errorf("Cannot remove non empty directory: %#v", name)
+		}
+		if !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+	}
+	file, err := fs.getFile(name)
+	if err != nil {
+		return err
+	}
+	return fs.deleteFile(file)
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs *B2Fs) Mkdir(name string) error {
+	_, err := fs.Stat(name)
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	_, w, _, err := fs.Create(name, -1)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Symlink creates source as a symbolic link to target.
+func (*B2Fs) Symlink(source, target string) error {
+	return ErrVfsUnsupported
+}
+
+// Readlink returns the destination of the named symbolic link
+func (*B2Fs) Readlink(name string) (string, error) {
+	return "", ErrVfsUnsupported
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (*B2Fs) Chown(name string, uid int, gid int) error {
+	return ErrVfsUnsupported
+}
+
+// Chmod changes the mode of the named file to mode.
+func (*B2Fs) Chmod(name string, mode os.FileMode) error {
+	return ErrVfsUnsupported
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (*B2Fs) Chtimes(name string, atime, mtime time.Time) error {
+	return ErrVfsUnsupported
+}
+
+// Truncate changes the size of the named file.
+// Truncate by path is not supported, while truncating an opened
+// file is handled inside base transfer
+func (*B2Fs) Truncate(name string, size int64) error {
+	return ErrVfsUnsupported
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *B2Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	var result []os.FileInfo
+	err := fs.ReadDirPages(dirname, func(page []os.FileInfo) bool {
+		result = append(result, page...)
+		return true
+	})
+	return result, err
+}
+
+// ReadDirPages reads the directory named by dirname and calls fn for
+// each page of directory entries. The listing stops if fn returns false
+func (fs *B2Fs) ReadDirPages(dirname string, fn func(page []os.FileInfo) bool) error {
+	// dirname must be already cleaned
+	prefix := getB2DirPrefix(dirname)
+	prefixes := make(map[string]bool)
+
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	return fs.listFiles(ctx, prefix, "/", func(files []b2File) bool {
+		var result []os.FileInfo
+		for _, file := range files {
+			name := strings.TrimPrefix(file.FileName, prefix)
+			isDir := strings.HasSuffix(name, "/")
+			name = strings.TrimSuffix(name, "/")
+			if name == "" {
+				continue
+			}
+			switch file.Action {
+			case b2ActionFolder:
+				if _, ok := prefixes[name]; ok {
+					continue
+				}
+				prefixes[name] = true
+				result = append(result, NewFileInfo(name, true, 0, time.Now(), false))
+			case b2ActionUpload:
+				if isDir {
+					if _, ok := prefixes[name]; ok {
+						continue
+					}
+					prefixes[name] = true
+				}
+				info := NewFileInfo(name, isDir, file.ContentLength, getB2ModTime(file), false)
+				info.etag = getB2ETag(file)
+				info.metadata = getB2Metadata(file)
+				result = append(result, info)
+			}
+		}
+		if len(result) == 0 {
+			return true
+		}
+		return fn(result)
+	})
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// SFTP Resume is not supported on B2
+func (*B2Fs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// B2 uploads are already atomic, we don't need to upload to a temporary
+// file
+func (*B2Fs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (*B2Fs) IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	if b2Err, ok := err.(*b2Error); ok {
+		return b2Err.Status == http.StatusNotFound
+	}
+	return strings.Contains(err.Error(), "404")
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (*B2Fs) IsPermission(err error) bool {
+	if err == nil {
+		return false
+	}
+	if b2Err, ok := err.(*b2Error); ok {
+		return b2Err.Status == http.StatusUnauthorized || b2Err.Status == http.StatusForbidden
+	}
+	return strings.Contains(err.Error(), "403")
+}
+
+// IsNotSupported returns true if the error indicate an unsupported operation
+func (*B2Fs) IsNotSupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrVfsUnsupported
+}
+
+// CheckRootPath creates the specified local root directory if it does not exists
+func (fs *B2Fs) CheckRootPath(username string, uid int, gid int) bool {
+	// we need a local directory for temporary files
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, nil)
+	return osFs.CheckRootPath(username, uid, gid)
+}
+
+// ScanRootDirContents returns the number of files contained in the bucket,
+// and their size
+func (fs *B2Fs) ScanRootDirContents() (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
+	defer cancelFn()
+
+	err := fs.listFiles(ctx, fs.config.KeyPrefix, "", func(files []b2File) bool {
+		for _, file := range files {
+			if file.Action != b2ActionUpload {
+				continue
+			}
+			if strings.HasSuffix(file.FileName, "/") && file.ContentLength == 0 {
+				continue
+			}
+			numFiles++
+			size += file.ContentLength
+		}
+		return true
+	})
+	return numFiles, size, err
+}
+
+// GetDirSize returns the number of files and the size for a folder
+// including any subfolders
+func (*B2Fs) GetDirSize(dirname string) (int, int64, error) {
+	return 0, 0, ErrVfsUnsupported
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+// B2 uploads are already atomic, we never call this method for B2
+func (*B2Fs) GetAtomicUploadPath(name string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTPGo users
+func (fs *B2Fs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !strings.HasPrefix(rel, "/") {
+		return "/" + rel
+	}
+	if fs.config.KeyPrefix != "" {
+		if !strings.HasPrefix(rel, "/"+fs.config.KeyPrefix) {
+			rel = "/"
+		}
+		rel = path.Clean("/" + strings.TrimPrefix(rel, "/"+fs.config.KeyPrefix))
+	}
+	return rel
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root. The result are unordered
+func (fs *B2Fs) Walk(root string, walkFn filepath.WalkFunc) error {
+	prefix := getB2DirPrefix(root)
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	err := fs.listFiles(ctx, prefix, "", func(files []b2File) bool {
+		for _, file := range files {
+			if file.Action != b2ActionUpload {
+				continue
+			}
+			isDir := strings.HasSuffix(file.FileName, "/")
+			name := path.Clean(file.FileName)
+			if name == "/" || name == "." {
+				continue
+			}
+			info := NewFileInfo(name, isDir, file.ContentLength, getB2ModTime(file), false)
+			info.metadata = getB2Metadata(file)
+			err := walkFn(fs.Join("/", file.FileName), info, nil)
+			if err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	walkFn(root, NewFileInfo(root, true, 0, time.Now(), false), err) //nolint:errcheck
+
+	return err
+}
+
+// Join joins any number of path elements into a single path
+func (*B2Fs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// HasVirtualFolders returns true if folders are emulated
+func (*B2Fs) HasVirtualFolders() bool {
+	return true
+}
+
+// ResolvePath returns the matching filesystem path for the specified virtual path
+func (fs *B2Fs) ResolvePath(virtualPath string) (string, error) {
+	if !path.IsAbs(virtualPath) {
+		virtualPath = path.Clean("/" + virtualPath)
+	}
+	return fs.Join("/", fs.config.KeyPrefix, virtualPath), nil
+}
+
+// GetMimeType returns the content type
+func (fs *B2Fs) GetMimeType(name string) (string, error) {
+	file, err := fs.getFile(name)
+	if err != nil {
+		return "", err
+	}
+	return file.ContentType, nil
+}
+
+// GetSignedURL returns ErrVfsUnsupported, signed URLs are not supported for this filesystem
+func (*B2Fs) GetSignedURL(name string, expiration time.Duration) (string, error) {
+	return "", ErrVfsUnsupported
+}
+
+func (fs *B2Fs) checkHomeMarker(mode int) error {
+	if fs.config.KeyPrefix == "" {
+		return nil
+	}
+	_, err := fs.getFile(fs.config.KeyPrefix)
+	if err == nil {
+		return nil
+	}
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	return createMissingHomeMarker(fs, mode, fs.config.KeyPrefix)
+}
+
+// getFile returns the latest version of the file with the specified name
+func (fs *B2Fs) getFile(name string) (b2File, error) {
+	fileName := getB2FileName(name)
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	var result b2File
+	found := false
+	err := fs.listFileNames(ctx, map[string]interface{}{
+		"startFileName": fileName,
+		"prefix":        fileName,
+		"maxFileCount":  1,
+	}, func(files []b2File) bool {
+		for _, file := range files {
+			if file.FileName == fileName && file.Action == b2ActionUpload {
+				result = file
+				found = true
+			}
+		}
+		return false
+	})
+	if err == nil && !found {
+		err = getB2NotFoundError(name)
+	}
+	return result, err
+}
+
+// hasFiles returns true if there is at least a file, a directory placeholder included,
+// with the specified name as prefix
+func (fs *B2Fs) hasFiles(name string) (bool, error) {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	found := false
+	err := fs.listFileNames(ctx, map[string]interface{}{
+		"prefix":       getB2DirPrefix(name),
+		"maxFileCount": 1,
+	}, func(files []b2File) bool {
+		found = len(files) > 0
+		return false
+	})
+	return found, err
+}
+
+// hasContents returns true if the specified directory is not empty
+func (fs *B2Fs) hasContents(name string) (bool, error) {
+	prefix := getB2DirPrefix(name)
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	hasContents := false
+	err := fs.listFileNames(ctx, map[string]interface{}{
+		"prefix":       prefix,
+		"maxFileCount": 2,
+	}, func(files []b2File) bool {
+		for _, file := range files {
+			if file.FileName != prefix {
+				hasContents = true
+			}
+		}
+		return false
+	})
+	return hasContents, err
+}
+
+func (fs *B2Fs) deleteFile(file b2File) error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	err := fs.apiCall(ctx, "b2_delete_file_version", map[string]string{
+		"fileName": file.FileName,
+		"fileId":   file.FileID,
+	}, nil)
+	metrics.B2DeleteObjectCompleted(err)
+	return err
+}
+
+// listFiles lists the files with the specified prefix and calls fn for each page of results
+func (fs *B2Fs) listFiles(ctx context.Context, prefix, delimiter string, fn func(files []b2File) bool) error {
+	request := map[string]interface{}{
+		"prefix":       prefix,
+		"maxFileCount": b2MaxListCount,
+	}
+	if delimiter != "" {
+		request["delimiter"] = delimiter
+	}
+	return fs.listFileNames(ctx, request, fn)
+}
+
+func (fs *B2Fs) listFileNames(ctx context.Context, request map[string]interface{}, fn func(files []b2File) bool) error {
+	bucketID, err := fs.getBucketID(ctx)
+	if err != nil {
+		return err
+	}
+	request["bucketId"] = bucketID
+	for {
+		var response struct {
+			Files        []b2File `json:"files"`
+			NextFileName *string  `json:"nextFileName"`
+		}
+		err = fs.apiCall(ctx, "b2_list_file_names", request, &response)
+		metrics.B2ListObjectsCompleted(err)
+		if err != nil {
+			return err
+		}
+		if !fn(response.Files) || response.NextFileName == nil {
+			return nil
+		}
+		request["startFileName"] = *response.NextFileName
+	}
+}
+
+func (fs *B2Fs) download(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	auth, err := fs.authorize(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	downloadURL := fmt.Sprintf("%v/file/%v/%v", auth.DownloadURL, url.PathEscape(fs.config.Bucket),
+		escapeB2FileName(getB2FileName(name)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+	}
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		return nil, getB2ResponseError(resp)
+	}
+	return resp.Body, nil
+}
+
+// upload stores the data read from reader and returns the number of bytes read
+func (fs *B2Fs) upload(ctx context.Context, name, contentType string, reader io.Reader) (int64, error) {
+	auth, err := fs.authorize(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	bucketID, err := fs.getBucketID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	fileName := getB2FileName(name)
+	chunkSize := fs.config.UploadChunkSize
+	if chunkSize == 0 {
+		chunkSize = auth.RecommendedPartSize
+	}
+	if chunkSize <= 0 {
+		chunkSize = b2DefaultChunkSize
+	}
+	br := bufio.NewReader(reader)
+	buf := make([]byte, chunkSize)
+	n, err := io.ReadFull(br, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), fs.uploadFile(ctx, bucketID, fileName, contentType, buf[:n])
+	}
+	if err != nil {
+		return int64(n), err
+	}
+	if _, err = br.Peek(1); err == io.EOF {
+		// a large file requires at least two parts
+		return int64(n), fs.uploadFile(ctx, bucketID, fileName, contentType, buf[:n])
+	}
+	return fs.uploadLargeFile(ctx, bucketID, fileName, contentType, br, buf)
+}
+
+func (fs *B2Fs) uploadFile(ctx context.Context, bucketID, fileName, contentType string, data []byte) error {
+	var err error
+	// the upload is retried once using a new upload URL, as suggested in the B2 docs
+	for attempt := 0; attempt < 2; attempt++ {
+		var uploadURL b2UploadURL
+		err = fs.apiCall(ctx, "b2_get_upload_url", map[string]string{"bucketId": bucketID}, &uploadURL)
+		if err != nil {
+			return err
+		}
+		err = fs.sendData(ctx, uploadURL, data, map[string]string{
+			"X-Bz-File-Name": escapeB2FileName(fileName),
+			"Content-Type":   contentType,
+		}, nil)
+		if !isB2UploadRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (fs *B2Fs) uploadLargeFile(ctx context.Context, bucketID, fileName, contentType string, reader io.Reader,
+	buf []byte,
+) (int64, error) {
+	var file b2File
+	err := fs.apiCall(ctx, "b2_start_large_file", map[string]string{
+		"bucketId":    bucketID,
+		"fileName":    fileName,
+		"contentType": contentType,
+	}, &file)
+	if err != nil {
+		return 0, err
+	}
+	var uploadURL b2UploadURL
+	var partSha1Array []string
+	var readed int64
+	n := len(buf)
+	eof := false
+	for partNumber := 1; n > 0; partNumber++ {
+		readed += int64(n)
+		sha1sum, err := fs.uploadPart(ctx, file.FileID, &uploadURL, partNumber, buf[:n])
+		if err != nil {
+			fs.cancelLargeFile(file.FileID)
+			return readed, err
+		}
+		partSha1Array = append(partSha1Array, sha1sum)
+		if eof {
+			break
+		}
+		// we must not read again after EOF, the pipe reader would return the last data again
+		n, err = io.ReadFull(reader, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			fs.cancelLargeFile(file.FileID)
+			return readed, err
+		}
+	}
+	err = fs.apiCall(ctx, "b2_finish_large_file", map[string]interface{}{
+		"fileId":        file.FileID,
+		"partSha1Array": partSha1Array,
+	}, nil)
+	if err != nil {
+		fs.cancelLargeFile(file.FileID)
+	}
+	return readed, err
+}
+
+func (fs *B2Fs) uploadPart(ctx context.Context, fileID string, uploadURL *b2UploadURL, partNumber int, data []byte) (string, error) {
+	sum := sha1.Sum(data)
+	sha1sum := hex.EncodeToString(sum[:])
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if uploadURL.UploadURL == "" {
+			err = fs.apiCall(ctx, "b2_get_upload_part_url", map[string]string{"fileId": fileID}, uploadURL)
+			if err != nil {
+				return sha1sum, err
+			}
+		}
+		err = fs.sendData(ctx, *uploadURL, data, map[string]string{
+			"X-Bz-Part-Number": strconv.Itoa(partNumber),
+		}, sum[:])
+		if !isB2UploadRetryable(err) {
+			return sha1sum, err
+		}
+		// get a new upload part URL and retry
+		uploadURL.UploadURL = ""
+	}
+	return sha1sum, err
+}
+
+func (fs *B2Fs) cancelLargeFile(fileID string) {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	err := fs.apiCall(ctx, "b2_cancel_large_file", map[string]string{"fileId": fileID}, nil)
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to cancel the unfinished large file %#v: %v", fileID, err)
+	}
+}
+
+func (fs *B2Fs) sendData(ctx context.Context, uploadURL b2UploadURL, data []byte, headers map[string]string, sum []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if sum == nil {
+		s := sha1.Sum(data)
+		sum = s[:]
+	}
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Authorization", uploadURL.AuthorizationToken)
+	req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return getB2ResponseError(resp)
+	}
+	io.Copy(ioutil.Discard, resp.Body) //nolint:errcheck
+	return nil
+}
+
+// apiCall calls the specified B2 API and decodes the JSON response into result, if not nil.
+// If the authorization token is expired the account is authorized again and the request is retried
+func (fs *B2Fs) apiCall(ctx context.Context, name string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		auth, err := fs.authorize(ctx, attempt > 0)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.APIURL+b2APIPath+name, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		err = fs.doRequest(req, result)
+		if attempt == 0 && isB2AuthTokenExpired(err) {
+			fsLog(fs, logger.LevelDebug, "authorization token expired, authorizing the account again")
+			continue
+		}
+		return err
+	}
+}
+
+// authorize returns the account authorization, a new authorization is requested
+// if there is no cached one or if force is true
+func (fs *B2Fs) authorize(ctx context.Context, force bool) (b2Auth, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !force && fs.auth.AuthorizationToken != "" {
+		return fs.auth, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fs.config.Endpoint+b2APIPath+"b2_authorize_account", nil)
+	if err != nil {
+		return b2Auth{}, err
+	}
+	req.SetBasicAuth(fs.config.AccountID, fs.config.ApplicationKey.Payload)
+	var auth b2Auth
+	if err := fs.doRequest(req, &auth); err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to authorize the account: %v", err)
+		return b2Auth{}, err
+	}
+	fs.auth = auth
+	return auth, nil
+}
+
+func (fs *B2Fs) getBucketID(ctx context.Context) (string, error) {
+	auth, err := fs.authorize(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	fs.mu.Lock()
+	bucketID := fs.bucketID
+	fs.mu.Unlock()
+	if bucketID != "" {
+		return bucketID, nil
+	}
+	// application keys restricted to a bucket cannot list the buckets
+	if auth.Allowed.BucketName == fs.config.Bucket && auth.Allowed.BucketID != "" {
+		bucketID = auth.Allowed.BucketID
+	} else {
+		var response struct {
+			Buckets []struct {
+				BucketID   string `json:"bucketId"`
+				BucketName string `json:"bucketName"`
+			} `json:"buckets"`
+		}
+		err = fs.apiCall(ctx, "b2_list_buckets", map[string]string{
+			"accountId":  auth.AccountID,
+			"bucketName": fs.config.Bucket,
+		}, &response)
+		if err != nil {
+			return "", err
+		}
+		for _, bucket := range response.Buckets {
+			if bucket.BucketName == fs.config.Bucket {
+				bucketID = bucket.BucketID
+			}
+		}
+		if bucketID == "" {
+			return "", &b2Error{
+				Status:  http.StatusNotFound,
+				Code:    "not_found",
+				Message: fmt.Sprintf("bucket %#v not found", fs.config.Bucket),
+			}
+		}
+	}
+	fs.mu.Lock()
+	fs.bucketID = bucketID
+	fs.mu.Unlock()
+	return bucketID, nil
+}
+
+func (fs *B2Fs) doRequest(req *http.Request, result interface{}) error {
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return getB2ResponseError(resp)
+	}
+	if result == nil {
+		io.Copy(ioutil.Discard, resp.Body) //nolint:errcheck
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func getB2ResponseError(resp *http.Response) error {
+	b2Err := &b2Error{}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil || json.Unmarshal(body, b2Err) != nil || b2Err.Code == "" {
+		b2Err.Code = "unknown"
+		b2Err.Message = strings.TrimSpace(string(body))
+	}
+	b2Err.Status = resp.StatusCode
+	return b2Err
+}
+
+func getB2NotFoundError(name string) error {
+	return &b2Error{
+		Status:  http.StatusNotFound,
+		Code:    "not_found",
+		Message: fmt.Sprintf("file %#v not found", name),
+	}
+}
+
+func isB2AuthTokenExpired(err error) bool {
+	if b2Err, ok := err.(*b2Error); ok {
+		return b2Err.Status == http.StatusUnauthorized && (b2Err.Code == "expired_auth_token" || b2Err.Code == "bad_auth_token")
+	}
+	return false
+}
+
+// isB2UploadRetryable returns true if the upload must be retried using a new upload URL
+func isB2UploadRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if b2Err, ok := err.(*b2Error); ok {
+		return b2Err.Status == http.StatusUnauthorized || b2Err.Status == http.StatusRequestTimeout ||
+			b2Err.Status >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// getB2FileName returns the B2 file name for the specified filesystem path
+func getB2FileName(name string) string {
+	return strings.TrimPrefix(name, "/")
+}
+
+// getB2DirPrefix returns the B2 file name prefix for the contents of the specified directory
+func getB2DirPrefix(name string) string {
+	if name == "/" || name == "." || name == "" {
+		return ""
+	}
+	prefix := getB2FileName(name)
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// escapeB2FileName percent-encodes each path segment of the specified file name
+func escapeB2FileName(fileName string) string {
+	segments := strings.Split(fileName, "/")
+	for idx, segment := range segments {
+		segments[idx] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func getB2ModTime(file b2File) time.Time {
+	return time.Unix(0, file.UploadTimestamp*int64(time.Millisecond))
+}
+
+// getB2Metadata returns the custom file info for the specified file, the listings
+// always include them so an empty map means that the file has none
+func getB2Metadata(file b2File) map[string]string {
+	if file.FileInfo == nil {
+		return make(map[string]string)
+	}
+	return file.FileInfo
+}
+
+// getB2ETag returns the SHA1 checksum for the specified file, if available.
+// B2 does not store a checksum for the whole large files
+func getB2ETag(file b2File) string {
+	if file.ContentSha1 == "" || file.ContentSha1 == "none" {
+		return ""
+	}
+	return strings.TrimPrefix(file.ContentSha1, "unverified:")
+}
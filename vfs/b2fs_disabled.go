@@ -0,0 +1,18 @@
+// +build nob2
+
+package vfs
+
+import (
+	"errors"
+
+	"github.com/drakkan/sftpgo/version"
+)
+
+func init() {
+	version.AddFeature("-b2")
+}
+
+// NewB2Fs returns an error, Backblaze B2 is disabled
+func NewB2Fs(connectionID, localTempDir string, config B2FsConfig) (Fs, error) {
+	return nil, errors.New("Backblaze B2 disabled at build time")
+}
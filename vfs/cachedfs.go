@@ -0,0 +1,566 @@
+package vfs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+)
+
+const (
+	cacheFileSuffix     = ".sftpgocache"
+	cacheTempFileSuffix = ".sftpgocache.tmp"
+)
+
+// fileCaches contains the local caches, the same cache directory can be shared among multiple users
+var fileCaches = fileCacheRegistry{
+	caches: make(map[string]*fileCache),
+}
+
+// CacheConfig defines the configuration for the local read-through cache.
+// It is supported for Cloud Storage backends only
+type CacheConfig struct {
+	// absolute path to the local directory where the downloaded objects are stored.
+	// Empty means disabled
+	Path string `json:"path,omitempty"`
+	// maximum size, as bytes, for the cached objects. The least recently used objects
+	// are removed to make room for new ones
+	MaxSize int64 `json:"max_size,omitempty"`
+	// objects bigger than this size, as bytes, are never cached. 0 means MaxSize
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+	// cached objects are considered fresh for this number of seconds and they are served
+	// without getting their attributes from the storage backend. Once expired they are
+	// validated again before the next read. 0 means that the objects are validated before each read
+	TTL int `json:"ttl,omitempty"`
+}
+
+// IsEnabled returns true if the local cache is enabled
+func (c *CacheConfig) IsEnabled() bool {
+	return c.Path != ""
+}
+
+// ValidateCacheConfig returns nil if the specified cache config is valid, otherwise an error
+func ValidateCacheConfig(config *CacheConfig) error {
+	config.Path = strings.TrimSpace(config.Path)
+	if config.Path == "" {
+		config.MaxSize = 0
+		config.MaxFileSize = 0
+		config.TTL = 0
+		return nil
+	}
+	if !filepath.IsAbs(config.Path) {
+		return fmt.Errorf("invalid cache path %#v, it must be an absolute path", config.Path)
+	}
+	config.Path = filepath.Clean(config.Path)
+	if config.MaxSize <= 0 {
+		return fmt.Errorf("invalid cache max size: %v", config.MaxSize)
+	}
+	if config.MaxFileSize < 0 || config.MaxFileSize > config.MaxSize {
+		return fmt.Errorf("invalid cache max file size: %v, it must be between 0 and the cache max size", config.MaxFileSize)
+	}
+	if config.TTL < 0 {
+		return fmt.Errorf("invalid cache ttl: %v", config.TTL)
+	}
+	return nil
+}
+
+// CachedFs is a Fs wrapper that stores the downloaded objects inside a local directory
+// and serves the subsequent reads from there.
+// Before each read the cached object is validated against the ETag, or the size and
+// the modification time if no ETag is available, reported by the storage backend,
+// so a stale object is never served, unless a TTL is configured: in this case the
+// objects validated within the TTL are served without contacting the storage backend.
+// Uploads, renames, removals and truncations invalidate the cached object for the affected path
+type CachedFs struct {
+	Fs
+	localTempDir string
+	maxFileSize  int64
+	ttl          time.Duration
+	cache        *fileCache
+}
+
+// NewCachedFs returns a CachedFs wrapping the specified Cloud Storage Fs
+func NewCachedFs(fs Fs, localTempDir string, config CacheConfig) (Fs, error) {
+	cache, err := fileCaches.get(config.Path, config.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	maxFileSize := config.MaxFileSize
+	if maxFileSize == 0 {
+		maxFileSize = config.MaxSize
+	}
+	return &CachedFs{
+		Fs:           fs,
+		localTempDir: localTempDir,
+		maxFileSize:  maxFileSize,
+		ttl:          time.Duration(config.TTL) * time.Second,
+		cache:        cache,
+	}, nil
+}
+
+// Open opens the named file for reading
+func (fs *CachedFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	key := fs.getCacheKey(name)
+	if fs.ttl > 0 {
+		if f := fs.cache.openFresh(key, fs.ttl); f != nil {
+			metrics.FsCacheAccessed(true)
+			return fs.serveFromCache(f, name, offset)
+		}
+	}
+	info, err := fs.Fs.Stat(name)
+	if err != nil || info.IsDir() || info.Size() > fs.maxFileSize {
+		return fs.Fs.Open(name, offset)
+	}
+	if f := fs.cache.open(key, info); f != nil {
+		metrics.FsCacheAccessed(true)
+		return fs.serveFromCache(f, name, offset)
+	}
+	metrics.FsCacheAccessed(false)
+	tmp, err := fs.cache.createTemp()
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to create cache file for %#v: %v", name, err)
+		return fs.Fs.Open(name, offset)
+	}
+	file, reader, cancelFn, err := fs.Fs.Open(name, 0)
+	if err != nil || file != nil {
+		fs.cache.removeTemp(tmp)
+		if file != nil {
+			file.Close()
+			cancelFn()
+			return nil, nil, nil, ErrVfsUnsupported
+		}
+		return file, reader, cancelFn, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		fs.cache.removeTemp(tmp)
+		reader.Close()
+		cancelFn()
+		return nil, nil, nil, err
+	}
+	download := fs.cache.startDownload(key)
+
+	go func() {
+		n, err := readThrough(w, tmp, reader, offset)
+		reader.Close()
+		w.CloseWithError(err) //nolint:errcheck
+		if err == nil && n != info.Size() {
+			err = fmt.Errorf("size mismatch, expected: %v, downloaded: %v", info.Size(), n)
+		}
+		cached, err := fs.cache.finishDownload(download, tmp, info, n, err)
+		fsLog(fs, logger.LevelDebug, "read-through completed, path: %#v, offset: %v, size: %v, cached: %v, err: %v",
+			name, offset, n, cached, err)
+	}()
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing.
+// The cached object is invalidated before and after the upload, the objects read while
+// the upload is in progress are not added to the cache
+func (fs *CachedFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	key := fs.getCacheKey(name)
+	fs.cache.startUpload(key)
+	file, writer, cancelFn, err := fs.Fs.Create(name, flag)
+	if err != nil || writer == nil {
+		fs.cache.finishUpload(key)
+		return file, writer, cancelFn, err
+	}
+	writer.addCloseHook(func() {
+		fs.cache.finishUpload(key)
+	})
+	return file, writer, cancelFn, err
+}
+
+// Rename renames (moves) source to target
+func (fs *CachedFs) Rename(source, target string) error {
+	fs.cache.invalidate(fs.getCacheKey(source))
+	fs.cache.invalidate(fs.getCacheKey(target))
+	return fs.Fs.Rename(source, target)
+}
+
+// SetObjectMetadata adds the specified custom metadata to the named object.
+// The object contents do not change, so the cached object is still valid
+func (fs *CachedFs) SetObjectMetadata(name string, metadata map[string]string) error {
+	if setter, ok := fs.Fs.(ObjectMetadataSetter); ok {
+		return setter.SetObjectMetadata(name, metadata)
+	}
+	return ErrVfsUnsupported
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs *CachedFs) Remove(name string, isDir bool) error {
+	fs.cache.invalidate(fs.getCacheKey(name))
+	return fs.Fs.Remove(name, isDir)
+}
+
+// Truncate changes the size of the named file
+func (fs *CachedFs) Truncate(name string, size int64) error {
+	fs.cache.invalidate(fs.getCacheKey(name))
+	return fs.Fs.Truncate(name, size)
+}
+
+// ReadDirPages reads the directory named by dirname and calls fn for
+// each page of directory entries. The listing stops if fn returns false
+func (fs *CachedFs) ReadDirPages(dirname string, fn func(page []os.FileInfo) bool) error {
+	return ReadDirPages(fs.Fs, dirname, fn)
+}
+
+func (fs *CachedFs) serveFromCache(f *os.File, name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+
+	go func() {
+		defer f.Close()
+
+		_, err := f.Seek(offset, io.SeekStart)
+		var n int64
+		if err == nil {
+			n, err = io.Copy(w, f)
+		}
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "read from cache completed, path: %#v, offset: %v, size: %v, err: %v",
+			name, offset, n, err)
+	}()
+	return nil, r, func() {}, nil
+}
+
+// getCacheKey returns the cache key for the given name, the Fs name is included
+// so different buckets can share the same cache directory
+func (fs *CachedFs) getCacheKey(name string) string {
+	h := sha256.Sum256([]byte(fs.Name() + "\x00" + name))
+	return hex.EncodeToString(h[:])
+}
+
+// readThrough copies the whole object from src to the cache file and the
+// contents starting from the given offset to dst
+func readThrough(dst io.Writer, cacheFile *os.File, src io.Reader, offset int64) (int64, error) {
+	buf := make([]byte, 32768)
+	var n int64
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			if _, errWrite := cacheFile.Write(buf[:nr]); errWrite != nil {
+				return n, errWrite
+			}
+			data := buf[:nr]
+			if n < offset {
+				skip := offset - n
+				if skip > int64(nr) {
+					skip = int64(nr)
+				}
+				data = data[skip:]
+			}
+			if len(data) > 0 {
+				if _, errWrite := dst.Write(data); errWrite != nil {
+					return n, errWrite
+				}
+			}
+			n += int64(nr)
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+type cacheEntry struct {
+	key     string
+	etag    string
+	size    int64
+	modTime time.Time
+	// last time the cached object was validated against the storage backend
+	validatedAt time.Time
+}
+
+// isValidFor returns true if the cached object matches the object described by info
+func (e *cacheEntry) isValidFor(info os.FileInfo) bool {
+	if e.size != info.Size() {
+		return false
+	}
+	etag := getETag(info)
+	if e.etag != "" && etag != "" {
+		return e.etag == etag
+	}
+	return e.modTime.Equal(info.ModTime())
+}
+
+// cacheDownload tracks an object that is being downloaded to the cache.
+// An object invalidated while it is downloaded, or uploaded while it is downloaded,
+// will not be added to the cache
+type cacheDownload struct {
+	key         string
+	invalidated bool
+}
+
+// fileCache is a size bounded, least recently used, cache for the objects
+// stored inside a local directory
+type fileCache struct {
+	sync.Mutex
+	dir       string
+	maxSize   int64
+	size      int64
+	lru       *list.List
+	entries   map[string]*list.Element
+	downloads map[string][]*cacheDownload
+	// number of uploads in progress for each key
+	uploads map[string]int
+}
+
+func newFileCache(dir string, maxSize int64) (*fileCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// the cached objects are not validated after a restart, remove the leftovers
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range files {
+		if strings.HasSuffix(info.Name(), cacheFileSuffix) || strings.HasSuffix(info.Name(), cacheTempFileSuffix) {
+			os.Remove(filepath.Join(dir, info.Name())) //nolint:errcheck
+		}
+	}
+	return &fileCache{
+		dir:       dir,
+		maxSize:   maxSize,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+		downloads: make(map[string][]*cacheDownload),
+		uploads:   make(map[string]int),
+	}, nil
+}
+
+func (c *fileCache) getPath(key string) string {
+	return filepath.Join(c.dir, key+cacheFileSuffix)
+}
+
+// open returns the cached file for the given key or nil if the
+// object is not cached or the cached object is stale
+func (c *fileCache) open(key string, info os.FileInfo) *os.File {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.isValidFor(info) {
+		c.removeElement(elem)
+		return nil
+	}
+	f := c.openElement(elem)
+	if f != nil {
+		entry.validatedAt = time.Now()
+	}
+	return f
+}
+
+// openFresh returns the cached file for the given key if it was validated
+// within the given ttl, otherwise nil
+func (c *fileCache) openFresh(key string, ttl time.Duration) *os.File {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Since(elem.Value.(*cacheEntry).validatedAt) > ttl {
+		return nil
+	}
+	return c.openElement(elem)
+}
+
+func (c *fileCache) openElement(elem *list.Element) *os.File {
+	// the file can be removed while it is read, the open descriptor is still valid
+	f, err := os.Open(c.getPath(elem.Value.(*cacheEntry).key))
+	if err != nil {
+		c.removeElement(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return f
+}
+
+func (c *fileCache) createTemp() (*os.File, error) {
+	f, err := ioutil.TempFile(c.dir, "*"+cacheTempFileSuffix)
+	if err != nil && os.IsNotExist(err) {
+		// the cache directory was removed after the cache creation
+		if err = os.MkdirAll(c.dir, 0700); err == nil {
+			f, err = ioutil.TempFile(c.dir, "*"+cacheTempFileSuffix)
+		}
+	}
+	return f, err
+}
+
+func (c *fileCache) removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name()) //nolint:errcheck
+}
+
+func (c *fileCache) startDownload(key string) *cacheDownload {
+	c.Lock()
+	defer c.Unlock()
+
+	download := &cacheDownload{key: key}
+	c.downloads[key] = append(c.downloads[key], download)
+	return download
+}
+
+// finishDownload adds the downloaded object to the cache if the download succeeded
+// and the object was not invalidated in the meantime. It returns true if the object
+// was added to the cache
+func (c *fileCache) finishDownload(download *cacheDownload, tmp *os.File, info os.FileInfo, size int64, err error) (bool, error) {
+	errClose := tmp.Close()
+	if err == nil {
+		err = errClose
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	downloads := c.downloads[download.key]
+	for idx, d := range downloads {
+		if d == download {
+			downloads = append(downloads[:idx], downloads[idx+1:]...)
+			break
+		}
+	}
+	if len(downloads) == 0 {
+		delete(c.downloads, download.key)
+	} else {
+		c.downloads[download.key] = downloads
+	}
+	if err != nil || download.invalidated || c.uploads[download.key] > 0 || size > c.maxSize {
+		os.Remove(tmp.Name()) //nolint:errcheck
+		return false, err
+	}
+	if elem, ok := c.entries[download.key]; ok {
+		c.removeElement(elem)
+	}
+	if err = os.Rename(tmp.Name(), c.getPath(download.key)); err != nil {
+		os.Remove(tmp.Name()) //nolint:errcheck
+		return false, err
+	}
+	c.entries[download.key] = c.lru.PushFront(&cacheEntry{
+		key:         download.key,
+		etag:        getETag(info),
+		size:        size,
+		modTime:     info.ModTime(),
+		validatedAt: time.Now(),
+	})
+	c.size += size
+	for c.size > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+	return true, nil
+}
+
+// startUpload invalidates the cached object for the given key and tracks the upload,
+// the objects downloaded until the upload ends are not added to the cache
+func (c *fileCache) startUpload(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.uploads[key]++
+	c.invalidateLocked(key)
+}
+
+// finishUpload invalidates again the cached object for the given key, the downloads
+// started while the upload was in progress could read the previous object
+func (c *fileCache) finishUpload(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.uploads[key]--
+	if c.uploads[key] <= 0 {
+		delete(c.uploads, key)
+	}
+	c.invalidateLocked(key)
+}
+
+// invalidate removes the cached object for the given key
+func (c *fileCache) invalidate(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.invalidateLocked(key)
+}
+
+func (c *fileCache) invalidateLocked(key string) {
+	for _, download := range c.downloads[key] {
+		download.invalidated = true
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *fileCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	os.Remove(c.getPath(entry.key)) //nolint:errcheck
+}
+
+type fileCacheRegistry struct {
+	sync.Mutex
+	caches map[string]*fileCache
+}
+
+// get returns the cache for the given directory, the cache is created if missing.
+// The max size is updated, if changed, to match the most recent config
+func (r *fileCacheRegistry) get(dir string, maxSize int64) (*fileCache, error) {
+	if dir == "" {
+		return nil, errors.New("cache path is required")
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	cache, ok := r.caches[dir]
+	if !ok {
+		var err error
+		cache, err = newFileCache(dir, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		r.caches[dir] = cache
+		return cache, nil
+	}
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.maxSize = maxSize
+	for cache.size > cache.maxSize {
+		cache.removeElement(cache.lru.Back())
+	}
+	return cache, nil
+}
+
+// getETag returns the ETag for the given file info, if available
+func getETag(info os.FileInfo) string {
+	if fi, ok := info.(interface{ ETag() string }); ok {
+		return fi.ETag()
+	}
+	return ""
+}
@@ -0,0 +1,455 @@
+package vfs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	compressionMarker = "sftpgo"
+	// metadata keys are valid for all the supported Cloud Storage backends,
+	// Azure Blob Storage does not allow hyphens
+	compressionMetadataKey     = "sftpgo_compression"
+	compressionMetadataValue   = "gzip"
+	compressionSizeMetadataKey = "sftpgo_uncompressed_size"
+)
+
+// Supported quota basis for compressed files
+const (
+	// the quota is updated using the uncompressed size, this is what users see
+	CompressionQuotaBasisLogical = iota
+	// the quota is updated using the size of the stored, compressed, objects
+	CompressionQuotaBasisPhysical
+)
+
+// CompressionConfig defines the configuration for the transparent compression at rest.
+// It is supported for Cloud Storage backends only
+type CompressionConfig struct {
+	// files with these, case insensitive, extensions are gzip compressed on upload
+	// and decompressed on download. For example ".txt", ".csv"
+	Extensions []string `json:"extensions,omitempty"`
+	// Paths limits the compression to the files inside these virtual folders, for example
+	// "/logs". The files inside the whole filesystem are compressed if empty
+	Paths []string `json:"paths,omitempty"`
+	// QuotaBasis defines the size to use for quota accounting: 0 means the uncompressed
+	// size, 1 means the stored, compressed, size. Incremental updates and quota scans
+	// always use the same basis
+	QuotaBasis int `json:"quota_basis,omitempty"`
+}
+
+// IsEnabled returns true if compression is enabled for at least one extension
+func (c *CompressionConfig) IsEnabled() bool {
+	return len(c.Extensions) > 0
+}
+
+// ValidateCompressionConfig returns nil if the specified compression config is valid, otherwise an error
+func ValidateCompressionConfig(config *CompressionConfig) error {
+	var extensions []string
+	for _, ext := range config.Extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") || strings.ContainsAny(ext, "/\\*?") {
+			return fmt.Errorf("invalid compression extension %#v", ext)
+		}
+		extensions = append(extensions, ext)
+	}
+	config.Extensions = extensions
+	var paths []string
+	for _, p := range config.Paths {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !path.IsAbs(p) {
+			return fmt.Errorf("invalid compression path %#v, it must be an absolute virtual path", p)
+		}
+		paths = append(paths, path.Clean(p))
+	}
+	config.Paths = paths
+	if config.QuotaBasis != CompressionQuotaBasisLogical && config.QuotaBasis != CompressionQuotaBasisPhysical {
+		return fmt.Errorf("invalid compression quota basis: %v", config.QuotaBasis)
+	}
+	return nil
+}
+
+// CompressedFs is a Fs wrapper that transparently compresses, using gzip, the files
+// matching the configured extensions and folders.
+// The compressed objects contain a marker inside the gzip header, so files uploaded before
+// enabling compression are served as they are. The compression marker and the uncompressed
+// size are stored as object metadata when the upload completes, so stat/list report the
+// uncompressed size without reading the objects. If a listing does not include the object
+// metadata, as for S3, a metadata request is needed for each listed compressible file.
+// Reads starting from an offset will re-read the object from the start and discard
+// the unneeded bytes
+type CompressedFs struct {
+	Fs
+	localTempDir string
+	extensions   []string
+	paths        []string
+	quotaBasis   int
+}
+
+// NewCompressedFs returns a CompressedFs wrapping the specified Cloud Storage Fs
+func NewCompressedFs(fs Fs, localTempDir string, config CompressionConfig) Fs {
+	return &CompressedFs{
+		Fs:           fs,
+		localTempDir: localTempDir,
+		extensions:   config.Extensions,
+		paths:        config.Paths,
+		quotaBasis:   config.QuotaBasis,
+	}
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *CompressedFs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.getFileInfo(name, info), nil
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *CompressedFs) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Lstat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.getFileInfo(name, info), nil
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *CompressedFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	result, err := fs.Fs.ReadDir(dirname)
+	if err != nil {
+		return result, err
+	}
+	for idx, info := range result {
+		result[idx] = fs.getFileInfo(fs.Join(dirname, info.Name()), info)
+	}
+	return result, nil
+}
+
+// ReadDirPages reads the directory named by dirname and calls fn for
+// each page of directory entries. The listing stops if fn returns false
+func (fs *CompressedFs) ReadDirPages(dirname string, fn func(page []os.FileInfo) bool) error {
+	return ReadDirPages(fs.Fs, dirname, func(page []os.FileInfo) bool {
+		for idx, info := range page {
+			page[idx] = fs.getFileInfo(fs.Join(dirname, info.Name()), info)
+		}
+		return fn(page)
+	})
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their size using the configured quota basis
+func (fs *CompressedFs) ScanRootDirContents() (int, int64, error) {
+	if fs.quotaBasis == CompressionQuotaBasisPhysical {
+		return fs.Fs.ScanRootDirContents()
+	}
+	root, err := fs.ResolvePath("/")
+	if err != nil {
+		return 0, 0, err
+	}
+	numFiles := 0
+	size := int64(0)
+	err = fs.Fs.Walk(root, func(walkedPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		numFiles++
+		size += GetSizeForQuota(fs.getFileInfo(walkedPath, info))
+		return nil
+	})
+	return numFiles, size, err
+}
+
+// Open opens the named file for reading
+func (fs *CompressedFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	if !fs.isCompressible(name) {
+		return fs.Fs.Open(name, offset)
+	}
+	file, reader, cancelFn, err := fs.Fs.Open(name, 0)
+	if err != nil || file != nil {
+		if file != nil {
+			file.Close()
+			cancelFn()
+			return nil, nil, nil, ErrVfsUnsupported
+		}
+		return file, reader, cancelFn, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		reader.Close()
+		cancelFn()
+		return nil, nil, nil, err
+	}
+
+	go func() {
+		n, err := fs.decompress(w, reader, offset)
+		reader.Close()
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "decompression completed, path: %#v, offset: %v, size: %v, err: %v",
+			name, offset, n, err)
+	}()
+	return nil, r, cancelFn, nil
+}
+
+// GetSignedURL returns ErrVfsUnsupported for compressible files, the stored
+// objects could be compressed
+func (fs *CompressedFs) GetSignedURL(name string, expiration time.Duration) (string, error) {
+	if fs.isCompressible(name) {
+		return "", ErrVfsUnsupported
+	}
+	return fs.Fs.GetSignedURL(name, expiration)
+}
+
+// Rename renames (moves) source to target.
+// The files to decompress are selected by extension, so a file compressed by SFTPGo
+// cannot be renamed to a name without a compressed extension, otherwise it would be
+// served as stored. Renaming a file to a compressed extension is safe, the objects
+// without our marker are served as they are
+func (fs *CompressedFs) Rename(source, target string) error {
+	if fs.isCompressible(source) && !fs.isCompressible(target) {
+		info, err := fs.Fs.Stat(source)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if _, ok := getUncompressedSize(getObjectMetadata(info)); ok {
+				fsLog(fs, logger.LevelInfo, "unable to rename the compressed file %#v to %#v, the target extension "+
+					"is not compressed", source, target)
+				return ErrVfsUnsupported
+			}
+		}
+	}
+	return fs.Fs.Rename(source, target)
+}
+
+// Create creates or opens the named file for writing.
+// The compression metadata are stored after the upload, if this fails the uploaded object
+// is removed, otherwise it would be reported using the compressed size
+func (fs *CompressedFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	if flag == -1 || !fs.isCompressible(name) {
+		return fs.Fs.Create(name, flag)
+	}
+	setter, ok := fs.Fs.(ObjectMetadataSetter)
+	if !ok {
+		return nil, nil, nil, ErrVfsUnsupported
+	}
+	file, writer, cancelFn, err := fs.Fs.Create(name, flag)
+	if err != nil || file != nil {
+		if file != nil {
+			file.Close()
+			cancelFn()
+			return nil, nil, nil, ErrVfsUnsupported
+		}
+		return file, writer, cancelFn, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		cancelFn()
+		writer.Close() //nolint:errcheck
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+
+	go func() {
+		n, err := fs.compress(writer, r)
+		if err != nil {
+			cancelFn()
+		}
+		errClose := writer.Close()
+		if err == nil {
+			err = errClose
+		}
+		if err == nil {
+			err = setter.SetObjectMetadata(name, map[string]string{
+				compressionMetadataKey:     compressionMetadataValue,
+				compressionSizeMetadataKey: strconv.FormatInt(n, 10),
+			})
+			if err != nil {
+				fsLog(fs, logger.LevelWarn, "unable to set the compression metadata for %#v: %v", name, err)
+				if errRemove := fs.Fs.Remove(name, false); errRemove != nil {
+					fsLog(fs, logger.LevelWarn, "unable to remove object %#v without compression metadata: %v",
+						name, errRemove)
+				}
+			}
+		}
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "compression completed, path: %#v, uncompressed size: %v, err: %v",
+			name, n, err)
+	}()
+	return nil, p, cancelFn, nil
+}
+
+func (fs *CompressedFs) compress(dst io.Writer, src io.Reader) (int64, error) {
+	gz := gzip.NewWriter(dst)
+	gz.Comment = compressionMarker
+	n, err := io.Copy(gz, src)
+	if err != nil {
+		return n, err
+	}
+	return n, gz.Close()
+}
+
+func (fs *CompressedFs) decompress(dst io.Writer, src io.Reader, offset int64) (int64, error) {
+	br := bufio.NewReader(src)
+	var reader io.Reader = br
+	if isCompressedByUs(br) {
+		gzReader, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, err
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	}
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+			return 0, err
+		}
+	}
+	return io.Copy(dst, reader)
+}
+
+func (fs *CompressedFs) getFileInfo(name string, info os.FileInfo) os.FileInfo {
+	if info.IsDir() || !fs.isCompressible(name) {
+		return info
+	}
+	metadata := getObjectMetadata(info)
+	if metadata == nil {
+		// the listing does not include the object metadata
+		stat, err := fs.Fs.Stat(name)
+		if err != nil {
+			return info
+		}
+		metadata = getObjectMetadata(stat)
+	}
+	size, ok := getUncompressedSize(metadata)
+	if !ok {
+		return info
+	}
+	quotaSize := size
+	if fs.quotaBasis == CompressionQuotaBasisPhysical {
+		quotaSize = info.Size()
+	}
+	return &compressedFileInfo{
+		FileInfo:  info,
+		size:      size,
+		quotaSize: quotaSize,
+	}
+}
+
+func (fs *CompressedFs) isCompressible(name string) bool {
+	toMatch := strings.ToLower(name)
+	hasExtension := false
+	for _, ext := range fs.extensions {
+		if strings.HasSuffix(toMatch, ext) {
+			hasExtension = true
+			break
+		}
+	}
+	if !hasExtension {
+		return false
+	}
+	if len(fs.paths) == 0 {
+		return true
+	}
+	virtualPath := fs.GetRelativePath(name)
+	for _, p := range fs.paths {
+		if p == "/" || virtualPath == p || strings.HasPrefix(virtualPath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompressedByUs checks the gzip header for our marker without consuming the reader,
+// objects uploaded before enabling compression are served as they are
+func isCompressedByUs(br *bufio.Reader) bool {
+	// fixed header size (10 bytes) + comment + null terminator
+	header, err := br.Peek(10 + len(compressionMarker) + 1)
+	if err != nil {
+		return false
+	}
+	// gzip magic and deflate method, the only flag set is FCOMMENT
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3] != 0x10 {
+		return false
+	}
+	return string(header[10:]) == compressionMarker+"\x00"
+}
+
+// getObjectMetadata returns the custom metadata for the given file info,
+// nil if they are not available
+func getObjectMetadata(info os.FileInfo) map[string]string {
+	if fi, ok := info.(interface{ Metadata() map[string]string }); ok {
+		return fi.Metadata()
+	}
+	return nil
+}
+
+// getUncompressedSize returns the uncompressed size stored inside the given
+// metadata and true if the object was compressed by SFTPGo
+func getUncompressedSize(metadata map[string]string) (int64, bool) {
+	if getMetadataValue(metadata, compressionMetadataKey) != compressionMetadataValue {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(getMetadataValue(metadata, compressionSizeMetadataKey), 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// getMetadataValue returns the value for the given key, the keys are case insensitive
+// since some backends, for example S3, return them canonicalized
+func getMetadataValue(metadata map[string]string, key string) string {
+	if val, ok := metadata[key]; ok {
+		return val
+	}
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// GetSizeForQuota returns the size to use for quota accounting for the given file info.
+// This is the size reported by the file info for any file not compressed by SFTPGo
+func GetSizeForQuota(info os.FileInfo) int64 {
+	if fi, ok := info.(*compressedFileInfo); ok {
+		return fi.quotaSize
+	}
+	return info.Size()
+}
+
+type compressedFileInfo struct {
+	os.FileInfo
+	size      int64
+	quotaSize int64
+}
+
+// Size returns the uncompressed size
+func (fi *compressedFileInfo) Size() int64 {
+	return fi.size
+}
@@ -0,0 +1,359 @@
+package vfs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/eikenb/pipeat"
+	"github.com/minio/sio"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	// cryptFsName is the name for the local Fs implementation with encryption support
+	cryptFsName = "cryptfs"
+	version10   = byte(0x10)
+	nonceV10Len = 32
+	// version byte + random nonce
+	headerV10Size = nonceV10Len + 1
+)
+
+// CryptFsConfig defines the configuration to store local files as encrypted
+type CryptFsConfig struct {
+	// the per-file encryption keys are derived from this passphrase
+	Passphrase Secret `json:"passphrase,omitempty"`
+}
+
+// ValidateCryptFsConfig returns nil if the specified crypt fs config is valid, otherwise an error
+func ValidateCryptFsConfig(config *CryptFsConfig) error {
+	if config.Passphrase.IsEmpty() {
+		return errors.New("invalid passphrase")
+	}
+	if !config.Passphrase.IsValidInput() {
+		return errors.New("passphrase cannot be empty or invalid")
+	}
+	if config.Passphrase.IsEncrypted() && !config.Passphrase.IsValid() {
+		return errors.New("invalid encrypted passphrase")
+	}
+	return nil
+}
+
+// CryptFs is a local Fs implementation that stores the files encrypted at rest.
+// Each file starts with a header containing the format version and a random nonce,
+// the nonce is used to derive the file key from the configured passphrase.
+// The file contents are encrypted using the DARE format: data is split in 64KB
+// packages authenticated using AES-256-GCM or ChaCha20-Poly1305, so reads starting
+// from an offset only need to decrypt the packages containing the requested data.
+// Upload resume and truncate to a size greater than 0 are not supported
+type CryptFs struct {
+	*OsFs
+	localTempDir string
+	masterKey    []byte
+}
+
+// NewCryptFs returns a CryptFs object that stores the files inside the specified
+// root directory encrypted using the configured passphrase
+func NewCryptFs(connectionID, rootDir string, config CryptFsConfig) (Fs, error) {
+	if err := ValidateCryptFsConfig(&config); err != nil {
+		return nil, err
+	}
+	if config.Passphrase.IsEncrypted() {
+		if err := config.Passphrase.Decrypt(); err != nil {
+			return nil, err
+		}
+	}
+	fs := &CryptFs{
+		OsFs: &OsFs{
+			name:         cryptFsName,
+			connectionID: connectionID,
+			rootDir:      ToOSPath(rootDir),
+		},
+		localTempDir: ToOSPath(rootDir),
+		masterKey:    []byte(config.Passphrase.Payload),
+	}
+	return fs, nil
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *CryptFs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.OsFs.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.getFileInfo(info), nil
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *CryptFs) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.OsFs.Lstat(name)
+	if err != nil {
+		return info, err
+	}
+	return fs.getFileInfo(info), nil
+}
+
+// Open opens the named file for reading
+func (fs *CryptFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	f, key, err := fs.getFileAndEncryptionKey(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+
+	go func() {
+		n, err := fs.decryptAt(w, f, key, offset)
+		f.Close()
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "decryption completed, path: %#v, offset: %v, size: %v, err: %v",
+			name, offset, n, err)
+	}()
+	return nil, r, nil, nil
+}
+
+// Create creates or opens the named file for writing.
+// The file is always truncated, the whole content must be uploaded again
+func (fs *CryptFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nonce := make([]byte, nonceV10Len)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	key, err := fs.deriveKey(nonce)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	if _, err := f.Write(append([]byte{version10}, nonce...)); err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+
+	go func() {
+		n, err := sio.Encrypt(f, r, fs.getSIOConfig(key))
+		errClose := f.Close()
+		if err == nil {
+			err = errClose
+		}
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "encryption completed, path: %#v, size: %v, err: %v", name, n, err)
+	}()
+	return nil, p, nil, nil
+}
+
+// Truncate changes the size of the named file.
+// Truncate by path is supported only to truncate a file to 0 bytes, the encrypted
+// empty file is the header only
+func (fs *CryptFs) Truncate(name string, size int64) error {
+	if size != 0 {
+		return ErrVfsUnsupported
+	}
+	_, w, _, err := fs.Create(name, 0)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *CryptFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := fs.OsFs.ReadDir(dirname)
+	if err != nil {
+		return list, err
+	}
+	for idx, info := range list {
+		list[idx] = fs.getFileInfo(info)
+	}
+	return list, nil
+}
+
+// IsUploadResumeSupported returns false, an encrypted file cannot be appended
+func (*CryptFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns false, the files are written using a pipe
+func (*CryptFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their decrypted size
+func (fs *CryptFs) ScanRootDirContents() (int, int64, error) {
+	return fs.GetDirSize(fs.rootDir)
+}
+
+// GetDirSize returns the number of files and the decrypted size for a folder
+// including any subfolders
+func (fs *CryptFs) GetDirSize(dirname string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	isDir, err := IsDirectory(fs, dirname)
+	if err == nil && isDir {
+		err = filepath.Walk(dirname, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info != nil && info.Mode().IsRegular() {
+				size += fs.getFileInfo(info).Size()
+				numFiles++
+			}
+			return err
+		})
+	}
+	return numFiles, size, err
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root. The reported file sizes are the decrypted ones
+func (fs *CryptFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if info != nil {
+			info = fs.getFileInfo(info)
+		}
+		return walkFn(path, info, err)
+	})
+}
+
+// GetMimeType returns the content type detected from the decrypted data
+func (fs *CryptFs) GetMimeType(name string) (string, error) {
+	f, key, err := fs.getFileAndEncryptionKey(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	reader, err := sio.DecryptReader(f, fs.getSIOConfig(key))
+	if err != nil {
+		return "", err
+	}
+	var buf [512]byte
+	n, err := io.ReadFull(reader, buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// getFileAndEncryptionKey opens the named file, reads its header and returns
+// the file, positioned after the header, and the key to decrypt it
+func (fs *CryptFs) getFileAndEncryptionKey(name string) (*os.File, [32]byte, error) {
+	var key [32]byte
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, key, err
+	}
+	header := make([]byte, headerV10Size)
+	if _, err = io.ReadFull(f, header); err != nil {
+		f.Close()
+		return nil, key, fmt.Errorf("unable to read the header for the encrypted file %#v: %w", name, err)
+	}
+	if header[0] != version10 {
+		f.Close()
+		return nil, key, fmt.Errorf("unsupported encryption version %v for file %#v", header[0], name)
+	}
+	key, err = fs.deriveKey(header[1:])
+	if err != nil {
+		f.Close()
+		return nil, key, err
+	}
+	return f, key, nil
+}
+
+func (fs *CryptFs) deriveKey(nonce []byte) ([32]byte, error) {
+	var key [32]byte
+	kdf := hkdf.New(sha256.New, fs.masterKey, nonce, nil)
+	_, err := io.ReadFull(kdf, key[:])
+	return key, err
+}
+
+func (*CryptFs) getSIOConfig(key [32]byte) sio.Config {
+	return sio.Config{
+		MinVersion: sio.Version20,
+		MaxVersion: sio.Version20,
+		Key:        key[:],
+	}
+}
+
+// decryptAt writes the decrypted data starting from the specified offset,
+// only the packages including the requested data are decrypted
+func (fs *CryptFs) decryptAt(dst io.Writer, f *os.File, key [32]byte, offset int64) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	encryptedSize := info.Size() - headerV10Size
+	if encryptedSize == 0 {
+		// empty file, only the header is stored
+		return 0, nil
+	}
+	size, err := sio.DecryptedSize(uint64(encryptedSize))
+	if err != nil {
+		return 0, err
+	}
+	if offset >= int64(size) {
+		return 0, nil
+	}
+	if offset == 0 {
+		return sio.Decrypt(dst, f, fs.getSIOConfig(key))
+	}
+	readerAt, err := sio.DecryptReaderAt(io.NewSectionReader(f, headerV10Size, encryptedSize), fs.getSIOConfig(key))
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, io.NewSectionReader(readerAt, offset, int64(size)-offset))
+}
+
+// getFileInfo returns a FileInfo reporting the decrypted size for regular files
+func (fs *CryptFs) getFileInfo(info os.FileInfo) os.FileInfo {
+	if !info.Mode().IsRegular() {
+		return info
+	}
+	size := int64(0)
+	if info.Size() > headerV10Size {
+		decryptedSize, err := sio.DecryptedSize(uint64(info.Size() - headerV10Size))
+		if err != nil {
+			fsLog(fs, logger.LevelWarn, "unable to get the decrypted size for file %#v: %v", info.Name(), err)
+		} else {
+			size = int64(decryptedSize)
+		}
+	}
+	return &cryptFileInfo{
+		FileInfo: info,
+		size:     size,
+	}
+}
+
+// cryptFileInfo is a FileInfo that reports the decrypted size of an encrypted file
+type cryptFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+// Size returns the decrypted size for the file
+func (fi *cryptFileInfo) Size() int64 {
+	return fi.size
+}
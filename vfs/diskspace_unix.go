@@ -0,0 +1,15 @@
+// +build !windows
+
+package vfs
+
+import "golang.org/x/sys/unix"
+
+// GetAvailableDiskSize returns the space, in bytes, available to unprivileged
+// users on the filesystem containing the specified path
+func GetAvailableDiskSize(dirPath string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dirPath, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil //nolint:unconvert
+}
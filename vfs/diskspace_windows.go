@@ -0,0 +1,17 @@
+package vfs
+
+import "golang.org/x/sys/windows"
+
+// GetAvailableDiskSize returns the space, in bytes, available to the current
+// user on the volume containing the specified path
+func GetAvailableDiskSize(dirPath string) (int64, error) {
+	p, err := windows.UTF16PtrFromString(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	var freeBytes uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &freeBytes, nil, nil); err != nil {
+		return 0, err
+	}
+	return int64(freeBytes), nil
+}
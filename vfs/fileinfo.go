@@ -12,6 +12,8 @@ type FileInfo struct {
 	sizeInBytes int64
 	modTime     time.Time
 	mode        os.FileMode
+	etag        string
+	metadata    map[string]string
 }
 
 // NewFileInfo creates file info.
@@ -53,6 +55,17 @@ func (fi FileInfo) ModTime() time.Time {
 	return fi.modTime
 }
 
+// ETag returns the entity tag reported by the Cloud Storage backend, if any
+func (fi FileInfo) ETag() string {
+	return fi.etag
+}
+
+// Metadata returns the custom metadata reported by the Cloud Storage backend.
+// It returns nil if the metadata were not requested, S3 listings do not include them
+func (fi FileInfo) Metadata() map[string]string {
+	return fi.metadata
+}
+
 // IsDir provides the abbreviation for Mode().IsDir()
 func (fi FileInfo) IsDir() bool {
 	return fi.mode&os.ModeDir != 0
@@ -21,6 +21,8 @@ type BaseVirtualFolder struct {
 	LastQuotaUpdate int64 `json:"last_quota_update"`
 	// list of usernames associated with this virtual folder
 	Users []string `json:"users,omitempty"`
+	// Custom metadata as key/value pairs. SFTPGo stores them but never interprets them
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 // GetUsersAsString returns the list of users as comma separated string
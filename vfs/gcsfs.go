@@ -19,6 +19,7 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/eikenb/pipeat"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
@@ -29,7 +30,7 @@ import (
 )
 
 var (
-	gcsDefaultFieldsSelection = []string{"Name", "Size", "Deleted", "Updated", "ContentType"}
+	gcsDefaultFieldsSelection = []string{"Name", "Size", "Deleted", "Updated", "ContentType", "Metadata"}
 )
 
 // GCSFs is a Fs implementation for Google Cloud Storage.
@@ -40,6 +41,8 @@ type GCSFs struct {
 	svc            *storage.Client
 	ctxTimeout     time.Duration
 	ctxLongTimeout time.Duration
+	// explicit credentials, used to sign URLs
+	credentials []byte
 }
 
 func init() {
@@ -53,8 +56,8 @@ func NewGCSFs(connectionID, localTempDir string, config GCSFsConfig) (Fs, error)
 		connectionID:   connectionID,
 		localTempDir:   localTempDir,
 		config:         config,
-		ctxTimeout:     30 * time.Second,
-		ctxLongTimeout: 300 * time.Second,
+		ctxTimeout:     getMetadataTimeout(),
+		ctxLongTimeout: getLongMetadataTimeout(),
 	}
 	if err = ValidateGCSFsConfig(&fs.config, fs.config.CredentialFile); err != nil {
 		return fs, err
@@ -67,7 +70,8 @@ func NewGCSFs(connectionID, localTempDir string, config GCSFsConfig) (Fs, error)
 		if err != nil {
 			return fs, err
 		}
-		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsJSON([]byte(fs.config.Credentials.Payload)))
+		fs.credentials = []byte(fs.config.Credentials.Payload)
+		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsJSON(fs.credentials))
 	} else {
 		var creds []byte
 		creds, err = ioutil.ReadFile(fs.config.CredentialFile)
@@ -83,7 +87,8 @@ func NewGCSFs(connectionID, localTempDir string, config GCSFsConfig) (Fs, error)
 		if err != nil {
 			return fs, err
 		}
-		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsJSON([]byte(secret.Payload)))
+		fs.credentials = []byte(secret.Payload)
+		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsJSON(fs.credentials))
 	}
 	return fs, err
 }
@@ -117,7 +122,10 @@ func (fs *GCSFs) Stat(name string) (os.FileInfo, error) {
 		objSize := attrs.Size
 		objectModTime := attrs.Updated
 		isDir := attrs.ContentType == dirMimeType || strings.HasSuffix(attrs.Name, "/")
-		return NewFileInfo(name, isDir, objSize, objectModTime, false), nil
+		info := NewFileInfo(name, isDir, objSize, objectModTime, false)
+		info.etag = attrs.Etag
+		info.metadata = getGCSMetadata(attrs)
+		return info, nil
 	}
 	if !fs.IsNotExist(err) {
 		return result, err
@@ -191,12 +199,15 @@ func (fs *GCSFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, fu
 	bkt := fs.svc.Bucket(fs.config.Bucket)
 	obj := bkt.Object(name)
 	ctx, cancelFn := context.WithCancel(context.Background())
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
 	objectReader, err := obj.NewRangeReader(ctx, offset, -1)
 	if err == nil && offset > 0 && objectReader.Attrs.ContentEncoding == "gzip" {
 		err = fmt.Errorf("Range request is not possible for gzip content encoding, requested offset %v", offset)
 		objectReader.Close()
 	}
 	if err != nil {
+		watchdog.stop()
+		err = watchdog.getError(err)
 		r.Close()
 		w.Close()
 		cancelFn()
@@ -204,8 +215,11 @@ func (fs *GCSFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, fu
 	}
 	go func() {
 		defer cancelFn()
+		defer watchdog.stop()
 		defer objectReader.Close()
-		n, err := io.Copy(w, objectReader)
+
+		n, err := io.Copy(watchdog.wrapWriter(w), objectReader)
+		err = watchdog.getError(err)
 		w.CloseWithError(err) //nolint:errcheck
 		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
 		metrics.GCSTransferCompleted(n, 1, err)
@@ -236,14 +250,24 @@ func (fs *GCSFs) Create(name string, flag int) (File, *PipeWriter, func(), error
 	if fs.config.StorageClass != "" {
 		objectWriter.ObjectAttrs.StorageClass = fs.config.StorageClass
 	}
+	if fs.config.KMSKeyName != "" {
+		objectWriter.ObjectAttrs.KMSKeyName = fs.config.KMSKeyName
+	}
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
 	go func() {
 		defer cancelFn()
+		defer watchdog.stop()
 
-		n, err := io.Copy(objectWriter, r)
+		body, hasher := newHashingReader(watchdog.wrapReader(r), newCRC32CHash(), 0)
+		n, err := io.Copy(objectWriter, body)
 		closeErr := objectWriter.Close()
 		if err == nil {
 			err = closeErr
 		}
+		err = watchdog.getError(err)
+		if err == nil && hasher != nil {
+			err = fs.checkUploadIntegrity(name, objectWriter.Attrs(), hasher)
+		}
 		r.CloseWithError(err) //nolint:errcheck
 		p.Done(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
@@ -282,6 +306,9 @@ func (fs *GCSFs) Rename(source, target string) error {
 	if fs.config.StorageClass != "" {
 		copier.StorageClass = fs.config.StorageClass
 	}
+	if fs.config.KMSKeyName != "" {
+		copier.DestinationKMSKeyName = fs.config.KMSKeyName
+	}
 	var contentType string
 	if fi.IsDir() {
 		contentType = dirMimeType
@@ -291,6 +318,7 @@ func (fs *GCSFs) Rename(source, target string) error {
 	if contentType != "" {
 		copier.ContentType = contentType
 	}
+	copier.Metadata = getObjectMetadata(fi)
 	_, err = copier.Run(ctx)
 	metrics.GCSCopyObjectCompleted(err)
 	if err != nil {
@@ -371,6 +399,17 @@ func (*GCSFs) Truncate(name string, size int64) error {
 // ReadDir reads the directory named by dirname and returns
 // a list of directory entries.
 func (fs *GCSFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	var result []os.FileInfo
+	err := fs.ReadDirPages(dirname, func(page []os.FileInfo) bool {
+		result = append(result, page...)
+		return true
+	})
+	return result, err
+}
+
+// ReadDirPages reads the directory named by dirname and calls fn for
+// each page of directory entries. The listing stops if fn returns false
+func (fs *GCSFs) ReadDirPages(dirname string, fn func(page []os.FileInfo) bool) error {
 	var result []os.FileInfo
 	// dirname must be already cleaned
 	prefix := fs.getPrefix(dirname)
@@ -378,7 +417,7 @@ func (fs *GCSFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 	query := &storage.Query{Prefix: prefix, Delimiter: "/"}
 	err := query.SetAttrSelection(gcsDefaultFieldsSelection)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	prefixes := make(map[string]bool)
@@ -388,13 +427,21 @@ func (fs *GCSFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 	bkt := fs.svc.Bucket(fs.config.Bucket)
 	it := bkt.Objects(ctx, query)
 	for {
+		// the iterator fetches a new page when the buffered items are consumed
+		if len(result) > 0 && it.PageInfo().Remaining() == 0 {
+			if !fn(result) {
+				metrics.GCSListObjectsCompleted(nil)
+				return nil
+			}
+			result = nil
+		}
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
 			metrics.GCSListObjectsCompleted(err)
-			return result, err
+			return err
 		}
 		if attrs.Prefix != "" {
 			name, _ := fs.resolve(attrs.Prefix, prefix)
@@ -425,11 +472,16 @@ func (fs *GCSFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 				prefixes[name] = true
 			}
 			fi := NewFileInfo(name, isDir, attrs.Size, attrs.Updated, false)
+			fi.etag = attrs.Etag
+			fi.metadata = getGCSMetadata(attrs)
 			result = append(result, fi)
 		}
 	}
 	metrics.GCSListObjectsCompleted(nil)
-	return result, nil
+	if len(result) > 0 {
+		fn(result)
+	}
+	return nil
 }
 
 // IsUploadResumeSupported returns true if upload resume is supported.
@@ -601,7 +653,9 @@ func (fs *GCSFs) Walk(root string, walkFn filepath.WalkFunc) error {
 		if attrs.ContentType == dirMimeType {
 			isDir = true
 		}
-		err = walkFn(attrs.Name, NewFileInfo(name, isDir, attrs.Size, attrs.Updated, false), nil)
+		fi := NewFileInfo(name, isDir, attrs.Size, attrs.Updated, false)
+		fi.metadata = getGCSMetadata(attrs)
+		err = walkFn(attrs.Name, fi, nil)
 		if err != nil {
 			return err
 		}
@@ -727,6 +781,52 @@ func (fs *GCSFs) getPrefixForStat(name string) string {
 	return prefix
 }
 
+func (fs *GCSFs) checkHomeMarker(mode int) error {
+	if fs.config.KeyPrefix == "" {
+		return nil
+	}
+	_, err := fs.headObject(fs.config.KeyPrefix)
+	if err == nil {
+		return nil
+	}
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	return createMissingHomeMarker(fs, mode, fs.config.KeyPrefix)
+}
+
+// checkUploadIntegrity compares the CRC32C of the uploaded object with the one computed
+// while uploading. The object is removed if they don't match
+func (fs *GCSFs) checkUploadIntegrity(name string, attrs *storage.ObjectAttrs, hasher *hashingReader) error {
+	if attrs == nil {
+		fsLog(fs, logger.LevelDebug, "integrity check skipped for %#v, no object attributes available", name)
+		return nil
+	}
+	expected := hasher.getCRC32C()
+	if expected == attrs.CRC32C {
+		return nil
+	}
+	fsLog(fs, logger.LevelWarn, "upload integrity check failed for %#v, expected CRC32C: %v, stored CRC32C: %v, removing the object",
+		name, expected, attrs.CRC32C)
+	if errRemove := fs.Remove(name, false); errRemove != nil {
+		fsLog(fs, logger.LevelWarn, "unable to remove object %#v after integrity check failure: %v", name, errRemove)
+	}
+	return getIntegrityCheckError(name, fmt.Sprintf("CRC32C %v", expected), fmt.Sprintf("CRC32C %v", attrs.CRC32C))
+}
+
+// SetObjectMetadata adds the specified custom metadata to the named object
+func (fs *GCSFs) SetObjectMetadata(name string, metadata map[string]string) error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	obj := fs.svc.Bucket(fs.config.Bucket).Object(name)
+	// the metadata are patched, the existing keys not included are preserved
+	_, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: metadata,
+	})
+	return err
+}
+
 func (fs *GCSFs) headObject(name string) (*storage.ObjectAttrs, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
@@ -746,3 +846,45 @@ func (fs *GCSFs) GetMimeType(name string) (string, error) {
 	}
 	return attrs.ContentType, nil
 }
+
+// GetSignedURL returns a V4 signed URL to download the named object without
+// further authentication until the specified expiration.
+// Signing requires service account credentials including a private key
+func (fs *GCSFs) GetSignedURL(name string, expiration time.Duration) (string, error) {
+	credentials := fs.credentials
+	if fs.config.AutomaticCredentials > 0 {
+		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+		defer cancelFn()
+
+		defaultCredentials, err := google.FindDefaultCredentials(ctx, storage.ScopeReadOnly)
+		if err != nil {
+			return "", err
+		}
+		credentials = defaultCredentials.JSON
+	}
+	if len(credentials) == 0 {
+		return "", fmt.Errorf("%w: signed URLs require service account credentials including a private key",
+			ErrVfsUnsupported)
+	}
+	jwtConfig, err := google.JWTConfigFromJSON(credentials)
+	if err != nil || jwtConfig.Email == "" || len(jwtConfig.PrivateKey) == 0 {
+		return "", fmt.Errorf("%w: signed URLs require service account credentials including a private key",
+			ErrVfsUnsupported)
+	}
+	return storage.SignedURL(fs.config.Bucket, name, &storage.SignedURLOptions{
+		GoogleAccessID: jwtConfig.Email,
+		PrivateKey:     jwtConfig.PrivateKey,
+		Method:         http.MethodGet,
+		Expires:        time.Now().Add(expiration),
+		Scheme:         storage.SigningSchemeV4,
+	})
+}
+
+// getGCSMetadata returns the custom metadata for the given attributes, an empty
+// map means that the metadata were requested and the object has none
+func getGCSMetadata(attrs *storage.ObjectAttrs) map[string]string {
+	if attrs.Metadata == nil {
+		return make(map[string]string)
+	}
+	return attrs.Metadata
+}
@@ -0,0 +1,64 @@
+package vfs
+
+import (
+	"errors"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+// Supported home marker modes for Cloud Storage backends.
+// The home marker is an empty directory object for the configured key prefix
+const (
+	// no check is done
+	HomeMarkerDisabled = iota
+	// the home marker is created on login if missing
+	HomeMarkerCreate
+	// the login fails if the home marker is missing
+	HomeMarkerRequired
+)
+
+// ErrHomeMarkerNotFound defines the error returned if the home marker is required and it is missing
+var ErrHomeMarkerNotFound = errors.New("home marker not found")
+
+// homeMarkerChecker is implemented by the Cloud Storage backends
+type homeMarkerChecker interface {
+	checkHomeMarker(mode int) error
+}
+
+// IsValidHomeMarkerMode returns true if the specified home marker mode is supported
+func IsValidHomeMarkerMode(mode int) bool {
+	return mode == HomeMarkerDisabled || mode == HomeMarkerCreate || mode == HomeMarkerRequired
+}
+
+// CheckHomeMarker checks the home marker for the given filesystem using the specified mode.
+// It is a no-op for filesystems without a key prefix, such as the local one
+func CheckHomeMarker(fs Fs, mode int) error {
+	if mode == HomeMarkerDisabled {
+		return nil
+	}
+	if compressedFs, ok := fs.(*CompressedFs); ok {
+		fs = compressedFs.Fs
+	}
+	if cachedFs, ok := fs.(*CachedFs); ok {
+		fs = cachedFs.Fs
+	}
+	if checker, ok := fs.(homeMarkerChecker); ok {
+		return checker.checkHomeMarker(mode)
+	}
+	return nil
+}
+
+// createMissingHomeMarker creates the home marker with the given key if the mode allows it
+func createMissingHomeMarker(fs Fs, mode int, key string) error {
+	if mode != HomeMarkerCreate {
+		fsLog(fs, logger.LevelWarn, "required home marker %#v not found", key)
+		return ErrHomeMarkerNotFound
+	}
+	_, w, _, err := fs.Create(key, -1)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	fsLog(fs, logger.LevelInfo, "home marker %#v not found, created, err: %v", key, err)
+	return err
+}
@@ -0,0 +1,139 @@
+package vfs
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrIntegrityCheckFailed defines the error for an upload whose stored data
+// does not match the data sent to the Cloud Storage backend
+var ErrIntegrityCheckFailed = errors.New("upload integrity check failed")
+
+var (
+	uploadIntegrityCheck int32
+	s3ETagRegex          = regexp.MustCompile(`^[0-9a-f]{32}(-[0-9]+)?$`)
+	crc32cTable          = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// SetUploadIntegrityCheck enables or disables the post-upload integrity check
+// for Cloud Storage backends. The check applies to the uploads started after this call
+func SetUploadIntegrityCheck(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&uploadIntegrityCheck, value)
+}
+
+func isUploadIntegrityCheckEnabled() bool {
+	return atomic.LoadInt32(&uploadIntegrityCheck) == 1
+}
+
+// hashingReader computes the hash of the data read from the wrapped reader.
+// If partSize is greater than 0 the MD5 hash for each part is computed too,
+// this is required to compute the ETag for S3 multipart uploads
+type hashingReader struct {
+	reader    io.Reader
+	hash      hash.Hash
+	partSize  int64
+	partHash  hash.Hash
+	partBytes int64
+	partSums  [][]byte
+}
+
+// newHashingReader returns a reader computing the hash of the read data or
+// the given reader itself if the upload integrity check is disabled
+func newHashingReader(reader io.Reader, h hash.Hash, partSize int64) (io.Reader, *hashingReader) {
+	if !isUploadIntegrityCheckEnabled() {
+		return reader, nil
+	}
+	r := &hashingReader{
+		reader:   reader,
+		hash:     h,
+		partSize: partSize,
+	}
+	if partSize > 0 {
+		r.partHash = md5.New()
+	}
+	return r, r
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.hash.Write(p[:n]) //nolint:errcheck
+		if r.partSize > 0 {
+			r.updatePartSums(p[:n])
+		}
+	}
+	return n, err
+}
+
+func (r *hashingReader) updatePartSums(data []byte) {
+	for len(data) > 0 {
+		toWrite := r.partSize - r.partBytes
+		if int64(len(data)) < toWrite {
+			toWrite = int64(len(data))
+		}
+		r.partHash.Write(data[:toWrite]) //nolint:errcheck
+		r.partBytes += toWrite
+		data = data[toWrite:]
+		if r.partBytes == r.partSize {
+			r.partSums = append(r.partSums, r.partHash.Sum(nil))
+			r.partHash.Reset()
+			r.partBytes = 0
+		}
+	}
+}
+
+func (r *hashingReader) getMD5() []byte {
+	return r.hash.Sum(nil)
+}
+
+func (r *hashingReader) getCRC32C() uint32 {
+	return r.hash.(hash.Hash32).Sum32()
+}
+
+// normalizeS3ETag removes the surrounding quotes from the given ETag
+func normalizeS3ETag(etag string) string {
+	return strings.ToLower(strings.Trim(etag, `"`))
+}
+
+// getS3ETag returns the expected ETag computed using the same algorithm as the given
+// ETag: the plain MD5 for single part uploads or the MD5 of the concatenated part MD5s,
+// followed by the number of parts, for multipart uploads.
+// The returned bool is false if the given ETag is not comparable, for example
+// for objects encrypted using SSE-C
+func (r *hashingReader) getS3ETag(etag string) (string, bool) {
+	if !s3ETagRegex.MatchString(etag) {
+		return "", false
+	}
+	if !strings.Contains(etag, "-") {
+		return hex.EncodeToString(r.getMD5()), true
+	}
+	partSums := r.partSums
+	if r.partBytes > 0 || len(partSums) == 0 {
+		partSums = append(partSums, r.partHash.Sum(nil))
+	}
+	h := md5.New()
+	for _, sum := range partSums {
+		h.Write(sum) //nolint:errcheck
+	}
+	return fmt.Sprintf("%v-%v", hex.EncodeToString(h.Sum(nil)), len(partSums)), true
+}
+
+func newCRC32CHash() hash.Hash32 {
+	return crc32.New(crc32cTable)
+}
+
+func getIntegrityCheckError(name, expected, actual string) error {
+	return fmt.Errorf("%v for %#v: expected %v, stored %v", ErrIntegrityCheckFailed, name, expected, actual)
+}
@@ -30,13 +30,20 @@ type OsFs struct {
 	virtualFolders []VirtualFolder
 }
 
-// NewOsFs returns an OsFs object that allows to interact with local Os filesystem
+// NewOsFs returns an OsFs object that allows to interact with local Os filesystem.
+// The root dir and the mapped paths can use any separator, they are translated
+// to the separator of the running OS
 func NewOsFs(connectionID, rootDir string, virtualFolders []VirtualFolder) Fs {
+	var folders []VirtualFolder
+	for _, v := range virtualFolders {
+		v.MappedPath = ToOSPath(v.MappedPath)
+		folders = append(folders, v)
+	}
 	return &OsFs{
 		name:           osFsName,
 		connectionID:   connectionID,
-		rootDir:        rootDir,
-		virtualFolders: virtualFolders,
+		rootDir:        ToOSPath(rootDir),
+		virtualFolders: folders,
 	}
 }
 
@@ -473,3 +480,8 @@ func (fs *OsFs) GetMimeType(name string) (string, error) {
 	_, err = f.Seek(0, io.SeekStart)
 	return ctype, err
 }
+
+// GetSignedURL returns ErrVfsUnsupported, signed URLs are not supported for this filesystem
+func (*OsFs) GetSignedURL(name string, expiration time.Duration) (string, error) {
+	return "", ErrVfsUnsupported
+}
@@ -4,18 +4,24 @@ package vfs
 
 import (
 	"context"
+	"crypto/md5"
 	"errors"
 	"fmt"
+	"io"
 	"mime"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -35,6 +41,22 @@ type S3Fs struct {
 	svc            *s3.S3
 	ctxTimeout     time.Duration
 	ctxLongTimeout time.Duration
+	// decoded SSE-C key, if any
+	sseCustomerKey string
+}
+
+const (
+	s3DefaultRoleSessionName = "SFTPGo"
+	// the assumed role credentials are refreshed when they expire within this window
+	s3RoleExpiryWindow = 5 * time.Minute
+)
+
+// s3RoleCredentials caches the credentials for the assumed roles
+var s3RoleCredentials = struct {
+	sync.Mutex
+	creds map[string]*credentials.Credentials
+}{
+	creds: make(map[string]*credentials.Credentials),
 }
 
 func init() {
@@ -48,8 +70,8 @@ func NewS3Fs(connectionID, localTempDir string, config S3FsConfig) (Fs, error) {
 		connectionID:   connectionID,
 		localTempDir:   localTempDir,
 		config:         config,
-		ctxTimeout:     30 * time.Second,
-		ctxLongTimeout: 300 * time.Second,
+		ctxTimeout:     getMetadataTimeout(),
+		ctxLongTimeout: getLongMetadataTimeout(),
 	}
 	if err := ValidateS3FsConfig(&fs.config); err != nil {
 		return fs, err
@@ -68,11 +90,34 @@ func NewS3Fs(connectionID, localTempDir string, config S3FsConfig) (Fs, error) {
 		awsConfig.Credentials = credentials.NewStaticCredentials(fs.config.AccessKey, fs.config.AccessSecret.Payload, "")
 	}
 
+	if !fs.config.SSECustomerKey.IsEmpty() {
+		if fs.config.SSECustomerKey.IsEncrypted() {
+			if err := fs.config.SSECustomerKey.Decrypt(); err != nil {
+				return fs, err
+			}
+		}
+		key, err := decodeS3SSECustomerKey(fs.config.SSECustomerKey.Payload)
+		if err != nil {
+			return fs, err
+		}
+		fs.sseCustomerKey = key
+	}
+
+	if fs.config.RoleARN != "" {
+		creds, err := getS3RoleCredentials(*awsConfig, &fs.config)
+		if err != nil {
+			return fs, err
+		}
+		awsConfig.Credentials = creds
+	}
+
 	if fs.config.Endpoint != "" {
 		awsConfig.Endpoint = aws.String(fs.config.Endpoint)
 		awsConfig.S3ForcePathStyle = aws.Bool(true)
 	}
 
+	setS3RetryConfig(awsConfig, &fs.config)
+
 	if fs.config.UploadPartSize == 0 {
 		fs.config.UploadPartSize = s3manager.DefaultUploadPartSize
 	} else {
@@ -94,6 +139,73 @@ func NewS3Fs(connectionID, localTempDir string, config S3FsConfig) (Fs, error) {
 	return fs, nil
 }
 
+// setS3RetryConfig applies the configured retry policy and request timeout, if any.
+// The SDK retries the failed requests, so each part of multipart uploads and downloads
+// is retried on its own and not the whole object
+func setS3RetryConfig(awsConfig *aws.Config, config *S3FsConfig) {
+	if config.MaxRetries != 0 || config.RetryBaseDelay > 0 {
+		retryer := client.DefaultRetryer{
+			NumMaxRetries: client.DefaultRetryerMaxNumRetries,
+		}
+		if config.MaxRetries > 0 {
+			retryer.NumMaxRetries = config.MaxRetries
+		} else if config.MaxRetries < 0 {
+			retryer.NumMaxRetries = 0
+		}
+		if config.RetryBaseDelay > 0 {
+			retryer.MinRetryDelay = time.Duration(config.RetryBaseDelay) * time.Millisecond
+		}
+		awsConfig.Retryer = retryer
+	}
+	if config.RequestTimeout > 0 {
+		awsConfig.HTTPClient = &http.Client{
+			Timeout: time.Duration(config.RequestTimeout) * time.Second,
+		}
+	}
+}
+
+// getS3RoleCredentials returns the credentials for the configured role. The role is assumed
+// using the credentials in the given config, if any, or the default credentials chain.
+// The credentials are cached and shared between the connections with the same configuration.
+// The SDK refreshes them, before they expire, when a request is signed, so the in-flight
+// transfers are not affected
+func getS3RoleCredentials(awsConfig aws.Config, config *S3FsConfig) (*credentials.Credentials, error) {
+	sessionName := config.RoleSessionName
+	if sessionName == "" {
+		sessionName = s3DefaultRoleSessionName
+	}
+	var accessSecret string
+	if awsConfig.Credentials != nil {
+		accessSecret = config.AccessSecret.Payload
+	}
+	cacheKey := strings.Join([]string{config.Region, config.AccessKey, accessSecret, config.RoleARN,
+		config.ExternalID, sessionName}, "\x00")
+
+	s3RoleCredentials.Lock()
+	defer s3RoleCredentials.Unlock()
+
+	if creds, ok := s3RoleCredentials.creds[cacheKey]; ok {
+		return creds, nil
+	}
+	// the custom endpoint, if any, is for S3 only, STS uses the default one
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	creds := stscreds.NewCredentials(sess, config.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = sessionName
+		if config.ExternalID != "" {
+			p.ExternalID = aws.String(config.ExternalID)
+		}
+		p.ExpiryWindow = s3RoleExpiryWindow
+	})
+	s3RoleCredentials.creds[cacheKey] = creds
+	return creds, nil
+}
+
 // Name returns the name for the Fs implementation
 func (fs *S3Fs) Name() string {
 	return fmt.Sprintf("S3Fs bucket %#v", fs.config.Bucket)
@@ -121,7 +233,10 @@ func (fs *S3Fs) Stat(name string) (os.FileInfo, error) {
 	if err == nil {
 		objSize := *obj.ContentLength
 		objectModTime := *obj.LastModified
-		return NewFileInfo(name, false, objSize, objectModTime, false), nil
+		info := NewFileInfo(name, false, objSize, objectModTime, false)
+		info.etag = normalizeS3ETag(aws.StringValue(obj.ETag))
+		info.metadata = aws.StringValueMap(obj.Metadata)
+		return info, nil
 	}
 	if !fs.IsNotExist(err) {
 		return result, err
@@ -154,9 +269,10 @@ func (fs *S3Fs) getStatCompat(name string) (os.FileInfo, error) {
 	defer cancelFn()
 
 	err := fs.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket:    aws.String(fs.config.Bucket),
-		Prefix:    aws.String(prefix),
-		Delimiter: aws.String("/"),
+		Bucket:       aws.String(fs.config.Bucket),
+		Prefix:       aws.String(prefix),
+		Delimiter:    aws.String("/"),
+		RequestPayer: fs.getRequestPayer(),
 	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 		for _, p := range page.CommonPrefixes {
 			if fs.isEqual(p.Prefix, name) {
@@ -199,14 +315,21 @@ func (fs *S3Fs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, fun
 	if offset > 0 {
 		streamRange = aws.String(fmt.Sprintf("bytes=%v-", offset))
 	}
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
 
 	go func() {
 		defer cancelFn()
-		n, err := downloader.DownloadWithContext(ctx, w, &s3.GetObjectInput{
-			Bucket: aws.String(fs.config.Bucket),
-			Key:    aws.String(name),
-			Range:  streamRange,
+		defer watchdog.stop()
+
+		n, err := downloader.DownloadWithContext(ctx, watchdog.wrapWriterAt(w), &s3.GetObjectInput{
+			Bucket:               aws.String(fs.config.Bucket),
+			Key:                  aws.String(name),
+			Range:                streamRange,
+			RequestPayer:         fs.getRequestPayer(),
+			SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+			SSECustomerKey:       fs.getSSECustomerKey(),
 		})
+		err = fs.checkSSECustomerKeyError(watchdog.getError(err))
 		w.CloseWithError(err) //nolint:errcheck
 		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
 		metrics.S3TransferCompleted(n, 1, err)
@@ -223,8 +346,11 @@ func (fs *S3Fs) Create(name string, flag int) (File, *PipeWriter, func(), error)
 	p := NewPipeWriter(w)
 	ctx, cancelFn := context.WithCancel(context.Background())
 	uploader := s3manager.NewUploaderWithClient(fs.svc)
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
 	go func() {
 		defer cancelFn()
+		defer watchdog.stop()
+
 		key := name
 		var contentType string
 		if flag == -1 {
@@ -232,16 +358,33 @@ func (fs *S3Fs) Create(name string, flag int) (File, *PipeWriter, func(), error)
 		} else {
 			contentType = mime.TypeByExtension(path.Ext(name))
 		}
+		var body io.Reader
+		var hasher *hashingReader
+		if fs.config.SSEEncryption == S3SSEKMS || fs.sseCustomerKey != "" {
+			// the ETag of the objects encrypted using SSE-KMS or SSE-C is not an MD5 digest of their data
+			body = watchdog.wrapReader(r)
+		} else {
+			body, hasher = newHashingReader(watchdog.wrapReader(r), md5.New(), fs.config.UploadPartSize)
+		}
 		response, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-			Bucket:       aws.String(fs.config.Bucket),
-			Key:          aws.String(key),
-			Body:         r,
-			StorageClass: utils.NilIfEmpty(fs.config.StorageClass),
-			ContentType:  utils.NilIfEmpty(contentType),
+			Bucket:               aws.String(fs.config.Bucket),
+			Key:                  aws.String(key),
+			Body:                 body,
+			StorageClass:         utils.NilIfEmpty(fs.config.StorageClass),
+			ContentType:          utils.NilIfEmpty(contentType),
+			RequestPayer:         fs.getRequestPayer(),
+			ServerSideEncryption: utils.NilIfEmpty(fs.config.SSEEncryption),
+			SSEKMSKeyId:          utils.NilIfEmpty(fs.config.SSEKMSKeyID),
+			SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+			SSECustomerKey:       fs.getSSECustomerKey(),
 		}, func(u *s3manager.Uploader) {
 			u.Concurrency = fs.config.UploadConcurrency
 			u.PartSize = fs.config.UploadPartSize
 		})
+		err = fs.checkSSECustomerKeyError(watchdog.getError(err))
+		if err == nil && hasher != nil {
+			err = fs.checkUploadIntegrity(key, hasher)
+		}
 		r.CloseWithError(err) //nolint:errcheck
 		p.Done(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, response: %v, readed bytes: %v, err: %+v",
@@ -260,7 +403,6 @@ func (fs *S3Fs) Create(name string, flag int) (File, *PipeWriter, func(), error)
 // multipart copy or wait for this pull request to be merged:
 //
 // https://github.com/aws/aws-sdk-go/pull/2653
-//
 func (fs *S3Fs) Rename(source, target string) error {
 	if source == target {
 		return nil
@@ -294,19 +436,71 @@ func (fs *S3Fs) Rename(source, target string) error {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 	_, err = fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
-		Bucket:       aws.String(fs.config.Bucket),
-		CopySource:   aws.String(copySource),
-		Key:          aws.String(target),
-		StorageClass: utils.NilIfEmpty(fs.config.StorageClass),
-		ContentType:  utils.NilIfEmpty(contentType),
+		Bucket:               aws.String(fs.config.Bucket),
+		CopySource:           aws.String(copySource),
+		Key:                  aws.String(target),
+		StorageClass:         utils.NilIfEmpty(fs.config.StorageClass),
+		ContentType:          utils.NilIfEmpty(contentType),
+		RequestPayer:         fs.getRequestPayer(),
+		ServerSideEncryption: utils.NilIfEmpty(fs.config.SSEEncryption),
+		SSEKMSKeyId:          utils.NilIfEmpty(fs.config.SSEKMSKeyID),
+		// the source object is decrypted and the copy is encrypted using the same key
+		CopySourceSSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		CopySourceSSECustomerKey:       fs.getSSECustomerKey(),
+		SSECustomerAlgorithm:           fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:                 fs.getSSECustomerKey(),
 	})
 	metrics.S3CopyObjectCompleted(err)
 	if err != nil {
-		return err
+		return fs.checkSSECustomerKeyError(err)
 	}
 	return fs.Remove(source, fi.IsDir())
 }
 
+// SetObjectMetadata adds the specified custom metadata to the named object.
+// S3 metadata cannot be updated, so the object is copied over itself replacing
+// them: as for Rename, this does not work for files bigger than 5GB
+func (fs *S3Fs) SetObjectMetadata(name string, metadata map[string]string) error {
+	obj, err := fs.headObject(name)
+	if err != nil {
+		return err
+	}
+	objMetadata := make(map[string]*string)
+	for k, v := range obj.Metadata {
+		objMetadata[k] = v
+	}
+	for key, val := range metadata {
+		// the returned keys are canonicalized
+		for k := range objMetadata {
+			if strings.EqualFold(k, key) {
+				delete(objMetadata, k)
+			}
+		}
+		objMetadata[key] = aws.String(val)
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	_, err = fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:               aws.String(fs.config.Bucket),
+		CopySource:           aws.String(fs.Join(fs.config.Bucket, name)),
+		Key:                  aws.String(name),
+		Metadata:             objMetadata,
+		MetadataDirective:    aws.String(s3.MetadataDirectiveReplace),
+		StorageClass:         utils.NilIfEmpty(fs.config.StorageClass),
+		ContentType:          obj.ContentType,
+		RequestPayer:         fs.getRequestPayer(),
+		ServerSideEncryption: utils.NilIfEmpty(fs.config.SSEEncryption),
+		SSEKMSKeyId:          utils.NilIfEmpty(fs.config.SSEKMSKeyID),
+		// the source object is decrypted and the copy is encrypted using the same key
+		CopySourceSSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		CopySourceSSECustomerKey:       fs.getSSECustomerKey(),
+		SSECustomerAlgorithm:           fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:                 fs.getSSECustomerKey(),
+	})
+	metrics.S3CopyObjectCompleted(err)
+	return fs.checkSSECustomerKeyError(err)
+}
+
 // Remove removes the named file or (empty) directory.
 func (fs *S3Fs) Remove(name string, isDir bool) error {
 	if isDir {
@@ -324,8 +518,9 @@ func (fs *S3Fs) Remove(name string, isDir bool) error {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 	_, err := fs.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(fs.config.Bucket),
-		Key:    aws.String(name),
+		Bucket:       aws.String(fs.config.Bucket),
+		Key:          aws.String(name),
+		RequestPayer: fs.getRequestPayer(),
 	})
 	metrics.S3DeleteObjectCompleted(err)
 	return err
@@ -383,6 +578,16 @@ func (*S3Fs) Truncate(name string, size int64) error {
 // a list of directory entries.
 func (fs *S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
 	var result []os.FileInfo
+	err := fs.ReadDirPages(dirname, func(page []os.FileInfo) bool {
+		result = append(result, page...)
+		return true
+	})
+	return result, err
+}
+
+// ReadDirPages reads the directory named by dirname and calls fn for
+// each page of directory entries. The listing stops if fn returns false
+func (fs *S3Fs) ReadDirPages(dirname string, fn func(page []os.FileInfo) bool) error {
 	// dirname must be already cleaned
 	prefix := ""
 	if dirname != "/" && dirname != "." {
@@ -397,10 +602,12 @@ func (fs *S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 	err := fs.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket:    aws.String(fs.config.Bucket),
-		Prefix:    aws.String(prefix),
-		Delimiter: aws.String("/"),
+		Bucket:       aws.String(fs.config.Bucket),
+		Prefix:       aws.String(prefix),
+		Delimiter:    aws.String("/"),
+		RequestPayer: fs.getRequestPayer(),
 	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		var result []os.FileInfo
 		for _, p := range page.CommonPrefixes {
 			// prefixes have a trailing slash
 			name, _ := fs.resolve(p.Prefix, prefix)
@@ -426,12 +633,17 @@ func (fs *S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
 				}
 				prefixes[name] = true
 			}
-			result = append(result, NewFileInfo(name, (isDir && objectSize == 0), objectSize, objectModTime, false))
+			info := NewFileInfo(name, (isDir && objectSize == 0), objectSize, objectModTime, false)
+			info.etag = normalizeS3ETag(aws.StringValue(fileObject.ETag))
+			result = append(result, info)
 		}
-		return true
+		if len(result) == 0 {
+			return true
+		}
+		return fn(result)
 	})
 	metrics.S3ListObjectsCompleted(err)
-	return result, err
+	return err
 }
 
 // IsUploadResumeSupported returns true if upload resume is supported.
@@ -504,8 +716,9 @@ func (fs *S3Fs) ScanRootDirContents() (int, int64, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
 	defer cancelFn()
 	err := fs.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket: aws.String(fs.config.Bucket),
-		Prefix: aws.String(fs.config.KeyPrefix),
+		Bucket:       aws.String(fs.config.Bucket),
+		Prefix:       aws.String(fs.config.KeyPrefix),
+		RequestPayer: fs.getRequestPayer(),
 	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 		for _, fileObject := range page.Contents {
 			isDir := strings.HasSuffix(*fileObject.Key, "/")
@@ -565,8 +778,9 @@ func (fs *S3Fs) Walk(root string, walkFn filepath.WalkFunc) error {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 	err := fs.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket: aws.String(fs.config.Bucket),
-		Prefix: aws.String(prefix),
+		Bucket:       aws.String(fs.config.Bucket),
+		Prefix:       aws.String(prefix),
+		RequestPayer: fs.getRequestPayer(),
 	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 		for _, fileObject := range page.Contents {
 			objectSize := *fileObject.Size
@@ -634,6 +848,15 @@ func (fs *S3Fs) isEqual(s3Key *string, virtualName string) bool {
 	return false
 }
 
+// getRequestPayer returns the value for the x-amz-request-payer header,
+// nil if the bucket is not configured as "Requester Pays"
+func (fs *S3Fs) getRequestPayer() *string {
+	if fs.config.RequesterPays {
+		return aws.String(s3.RequestPayerRequester)
+	}
+	return nil
+}
+
 func (fs *S3Fs) checkIfBucketExists() error {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
@@ -656,9 +879,10 @@ func (fs *S3Fs) hasContents(name string) (bool, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 	results, err := fs.svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket:  aws.String(fs.config.Bucket),
-		Prefix:  aws.String(prefix),
-		MaxKeys: &maxResults,
+		Bucket:       aws.String(fs.config.Bucket),
+		Prefix:       aws.String(prefix),
+		MaxKeys:      &maxResults,
+		RequestPayer: fs.getRequestPayer(),
 	})
 	metrics.S3ListObjectsCompleted(err)
 	if err != nil {
@@ -676,15 +900,90 @@ func (fs *S3Fs) hasContents(name string) (bool, error) {
 	return false, nil
 }
 
+func (fs *S3Fs) checkHomeMarker(mode int) error {
+	if fs.config.KeyPrefix == "" {
+		return nil
+	}
+	_, err := fs.headObject(fs.config.KeyPrefix)
+	if err == nil {
+		return nil
+	}
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	return createMissingHomeMarker(fs, mode, fs.config.KeyPrefix)
+}
+
+// checkUploadIntegrity compares the ETag of the uploaded object with the one computed
+// while uploading. The object is removed if they don't match
+func (fs *S3Fs) checkUploadIntegrity(name string, hasher *hashingReader) error {
+	obj, err := fs.headObject(name)
+	if err != nil {
+		return err
+	}
+	etag := normalizeS3ETag(aws.StringValue(obj.ETag))
+	expected, ok := hasher.getS3ETag(etag)
+	if !ok {
+		fsLog(fs, logger.LevelDebug, "integrity check skipped for %#v, the ETag %#v is not comparable", name, etag)
+		return nil
+	}
+	if expected == etag {
+		return nil
+	}
+	fsLog(fs, logger.LevelWarn, "upload integrity check failed for %#v, expected ETag: %v, stored ETag: %v, removing the object",
+		name, expected, etag)
+	if errRemove := fs.Remove(name, false); errRemove != nil {
+		fsLog(fs, logger.LevelWarn, "unable to remove object %#v after integrity check failure: %v", name, errRemove)
+	}
+	return getIntegrityCheckError(name, expected, etag)
+}
+
 func (fs *S3Fs) headObject(name string) (*s3.HeadObjectOutput, error) {
 	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
 	defer cancelFn()
 	obj, err := fs.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(fs.config.Bucket),
-		Key:    aws.String(name),
+		Bucket:               aws.String(fs.config.Bucket),
+		Key:                  aws.String(name),
+		RequestPayer:         fs.getRequestPayer(),
+		SSECustomerAlgorithm: fs.getSSECustomerAlgorithm(),
+		SSECustomerKey:       fs.getSSECustomerKey(),
 	})
 	metrics.S3HeadObjectCompleted(err)
-	return obj, err
+	return obj, fs.checkSSECustomerKeyError(err)
+}
+
+func (fs *S3Fs) getSSECustomerAlgorithm() *string {
+	if fs.sseCustomerKey == "" {
+		return nil
+	}
+	return aws.String(S3SSEAES256)
+}
+
+func (fs *S3Fs) getSSECustomerKey() *string {
+	return utils.NilIfEmpty(fs.sseCustomerKey)
+}
+
+// checkSSECustomerKeyError returns a more meaningful error if SSE-C is configured
+// and S3 refused the request. The SDK computes the key MD5 digest itself, so a
+// rejected request usually means the object was encrypted using a different key
+// or without SSE-C
+func (fs *S3Fs) checkSSECustomerKeyError(err error) error {
+	if err == nil || fs.sseCustomerKey == "" || fs.IsNotExist(err) {
+		return err
+	}
+	var code int
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		code = reqErr.StatusCode()
+	} else if aerr, ok := err.(awserr.Error); ok {
+		// multipart upload failures wrap the failed request error
+		if reqErr, ok := aerr.OrigErr().(awserr.RequestFailure); ok {
+			code = reqErr.StatusCode()
+		}
+	}
+	if code == http.StatusBadRequest || code == http.StatusForbidden {
+		return fmt.Errorf("%w: %v", ErrSSECustomerKeyMismatch, err)
+	}
+	return err
 }
 
 // GetMimeType returns the content type
@@ -695,3 +994,18 @@ func (fs *S3Fs) GetMimeType(name string) (string, error) {
 	}
 	return *obj.ContentType, err
 }
+
+// GetSignedURL returns a presigned URL to download the named object without
+// further authentication until the specified expiration
+func (fs *S3Fs) GetSignedURL(name string, expiration time.Duration) (string, error) {
+	if fs.sseCustomerKey != "" {
+		// the key should be sent as request header, we cannot share it inside an URL
+		return "", errors.New("signed URLs are not supported for objects encrypted using SSE-C")
+	}
+	req, _ := fs.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:       aws.String(fs.config.Bucket),
+		Key:          aws.String(name),
+		RequestPayer: fs.getRequestPayer(),
+	})
+	return req.Presign(expiration)
+}
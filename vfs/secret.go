@@ -7,7 +7,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
 
 	"github.com/drakkan/sftpgo/utils"
 )
@@ -22,15 +24,118 @@ const (
 	SecretStatusAES256GCM SecretStatus = "AES-256-GCM"
 	// SecretStatusRedacted means the secret is redacted
 	SecretStatusRedacted SecretStatus = "Redacted"
+	// SecretStatusVaultTransit means the secret is encrypted using the HashiCorp Vault transit engine
+	SecretStatusVaultTransit SecretStatus = "VaultTransit"
+	// SecretStatusVaultKV means the secret is stored inside a HashiCorp Vault KV store
+	// and the payload is the path of the secret inside the store
+	SecretStatusVaultKV SecretStatus = "VaultKV"
+	// SecretStatusAWSSecretsManager means the payload is a reference, the ARN or the name,
+	// to a secret stored inside AWS Secrets Manager. The secret value is fetched at runtime
+	SecretStatusAWSSecretsManager SecretStatus = "AWSSecretsManager"
+	// SecretStatusAzureKeyVault means the secret is stored inside Azure Key Vault, the payload
+	// is the name of the secret and the key its version
+	SecretStatusAzureKeyVault SecretStatus = "AzureKeyVault"
 )
 
 var (
 	errWrongSecretStatus   = errors.New("wrong secret status")
 	errMalformedCiphertext = errors.New("malformed ciphertext")
 	errInvalidSecret       = errors.New("invalid secret")
-	validSecretStatuses    = []string{SecretStatusPlain, SecretStatusAES256GCM, SecretStatusRedacted}
+	validSecretStatuses    = []string{SecretStatusPlain, SecretStatusAES256GCM, SecretStatusRedacted,
+		SecretStatusVaultTransit, SecretStatusVaultKV, SecretStatusAWSSecretsManager, SecretStatusAzureKeyVault}
+	encryptedSecretStatuses = []string{SecretStatusAES256GCM, SecretStatusVaultTransit, SecretStatusVaultKV,
+		SecretStatusAWSSecretsManager, SecretStatusAzureKeyVault}
+	// for these statuses the payload is a reference to a secret managed outside SFTPGo
+	referenceSecretStatuses = []string{SecretStatusAWSSecretsManager}
+	// for these statuses the secret value is fetched from an external secrets store each time
+	// the secret is used, a failure returns a SecretResolutionError
+	resolvedSecretStatuses = []string{SecretStatusAWSSecretsManager, SecretStatusAzureKeyVault}
 )
 
+// SecretResolutionError is returned if a secret referencing an external
+// secrets store cannot be resolved
+type SecretResolutionError struct {
+	err error
+}
+
+func (e *SecretResolutionError) Error() string {
+	return fmt.Sprintf("unable to resolve secret: %v", e.err)
+}
+
+// Unwrap returns the underlying error
+func (e *SecretResolutionError) Unwrap() error {
+	return e.err
+}
+
+// IsSecretResolutionError returns true if the given error, or an error it wraps,
+// is a SecretResolutionError
+func IsSecretResolutionError(err error) bool {
+	var resolutionErr *SecretResolutionError
+	return errors.As(err, &resolutionErr)
+}
+
+// SecretProvider defines the interface for the backends used to encrypt and decrypt secrets
+type SecretProvider interface {
+	// Name returns the provider name
+	Name() string
+	// EncryptedStatus returns the status for the secrets encrypted using this provider
+	EncryptedStatus() SecretStatus
+	// Encrypt encrypts the given plain text payload and returns the encrypted payload
+	// and the key, if any, required to decrypt it
+	Encrypt(payload, additionalData string) (string, string, error)
+	// Decrypt returns the plain text for the given encrypted payload
+	Decrypt(payload, key, additionalData string) (string, error)
+}
+
+var (
+	secretProvidersMu    sync.RWMutex
+	activeSecretProvider SecretProvider = &localSecretProvider{}
+	secretProviders                     = map[SecretStatus]SecretProvider{
+		SecretStatusAES256GCM: activeSecretProvider,
+	}
+)
+
+// SetSecretProvider sets the provider to use to encrypt new secrets.
+// The secrets previously encrypted using other providers, including
+// the local one, can still be decrypted
+func SetSecretProvider(provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+
+	secretProviders[provider.EncryptedStatus()] = provider
+	activeSecretProvider = provider
+}
+
+// RegisterSecretProvider registers a provider used only to decrypt, or resolve,
+// the secrets with its status. The provider used to encrypt new secrets is unchanged
+func RegisterSecretProvider(provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+
+	secretProviders[provider.EncryptedStatus()] = provider
+}
+
+// GetSecretProvider returns the provider used to encrypt new secrets
+func GetSecretProvider() SecretProvider {
+	secretProvidersMu.RLock()
+	defer secretProvidersMu.RUnlock()
+
+	return activeSecretProvider
+}
+
+func getSecretProviderForStatus(status SecretStatus) (SecretProvider, error) {
+	secretProvidersMu.RLock()
+	defer secretProvidersMu.RUnlock()
+
+	if provider, ok := secretProviders[status]; ok {
+		return provider, nil
+	}
+	if utils.IsStringInSlice(status, encryptedSecretStatuses) {
+		return nil, fmt.Errorf("no secret provider configured for status %#v", status)
+	}
+	return nil, errWrongSecretStatus
+}
+
 // Secret defines the struct used to store confidential data
 type Secret struct {
 	Status         SecretStatus `json:"status,omitempty"`
@@ -55,7 +160,13 @@ func GetSecretFromCompatString(secret string) (Secret, error) {
 // This isn't a pointer receiver because we don't want to pass
 // a pointer to html template
 func (s *Secret) IsEncrypted() bool {
-	return s.Status == SecretStatusAES256GCM
+	return utils.IsStringInSlice(s.Status, encryptedSecretStatuses)
+}
+
+// IsReference returns true if the secret payload is a reference to a secret
+// stored inside an external secrets store, such as AWS Secrets Manager
+func (s *Secret) IsReference() bool {
+	return utils.IsStringInSlice(s.Status, referenceSecretStatuses)
 }
 
 // IsPlain returns true if the secret is in plain text
@@ -90,10 +201,15 @@ func (s *Secret) IsValid() bool {
 	if !s.IsValidInput() {
 		return false
 	}
-	if s.Status == SecretStatusAES256GCM {
+	switch s.Status {
+	case SecretStatusAES256GCM:
 		if len(s.Key) != 64 {
 			return false
 		}
+	case SecretStatusVaultTransit, SecretStatusVaultKV, SecretStatusAzureKeyVault:
+		if s.Key == "" {
+			return false
+		}
 	}
 	return true
 }
@@ -115,95 +231,128 @@ func (s *Secret) Hide() {
 	s.AdditionalData = ""
 }
 
-// deriveKey is a weak method of deriving a key but it is still better than using the key as it is.
-// We should use a KMS in future
-func (s *Secret) deriveKey(key []byte) []byte {
-	var combined []byte
-	combined = append(combined, key...)
-	if s.AdditionalData != "" {
-		combined = append(combined, []byte(s.AdditionalData)...)
-	}
-	combined = append(combined, key...)
-	hash := sha256.Sum256(combined)
-	return hash[:]
-}
-
-// Encrypt encrypts a plain text Secret object
+// Encrypt encrypts a plain text Secret object using the configured secret provider
 func (s *Secret) Encrypt() error {
 	if s.Payload == "" {
 		return errInvalidSecret
 	}
 	switch s.Status {
 	case SecretStatusPlain:
-		key := make([]byte, 32)
-		if _, err := io.ReadFull(rand.Reader, key); err != nil {
-			return err
-		}
-		block, err := aes.NewCipher(s.deriveKey(key))
-		if err != nil {
-			return err
-		}
-		gcm, err := cipher.NewGCM(block)
+		provider := GetSecretProvider()
+		payload, key, err := provider.Encrypt(s.Payload, s.AdditionalData)
 		if err != nil {
 			return err
 		}
-		nonce := make([]byte, gcm.NonceSize())
-		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-			return err
-		}
-		var aad []byte
-		if s.AdditionalData != "" {
-			aad = []byte(s.AdditionalData)
-		}
-		ciphertext := gcm.Seal(nonce, nonce, []byte(s.Payload), aad)
-		s.Key = hex.EncodeToString(key)
-		s.Payload = hex.EncodeToString(ciphertext)
-		s.Status = SecretStatusAES256GCM
+		s.Key = key
+		s.Payload = payload
+		s.Status = provider.EncryptedStatus()
 		return nil
 	default:
 		return errWrongSecretStatus
 	}
 }
 
-// Decrypt decrypts a Secret object
+// Decrypt decrypts a Secret object using the provider that encrypted it.
+// Secrets fetched from an external secrets store, such as AWS Secrets Manager
+// or Azure Key Vault, are resolved and a SecretResolutionError is returned on failure
 func (s *Secret) Decrypt() error {
-	switch s.Status {
-	case SecretStatusAES256GCM:
-		encrypted, err := hex.DecodeString(s.Payload)
-		if err != nil {
-			return err
+	provider, err := getSecretProviderForStatus(s.Status)
+	if err == nil {
+		var plaintext string
+		plaintext, err = provider.Decrypt(s.Payload, s.Key, s.AdditionalData)
+		if err == nil {
+			s.Status = SecretStatusPlain
+			s.Payload = plaintext
+			s.Key = ""
+			s.AdditionalData = ""
+			return nil
 		}
-		key, err := hex.DecodeString(s.Key)
-		if err != nil {
-			return err
-		}
-		block, err := aes.NewCipher(s.deriveKey(key))
-		if err != nil {
-			return err
-		}
-		gcm, err := cipher.NewGCM(block)
-		if err != nil {
-			return err
-		}
-		nonceSize := gcm.NonceSize()
-		if len(encrypted) < nonceSize {
-			return errMalformedCiphertext
-		}
-		nonce, ciphertext := encrypted[:nonceSize], encrypted[nonceSize:]
-		var aad []byte
-		if s.AdditionalData != "" {
-			aad = []byte(s.AdditionalData)
-		}
-		plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
-		if err != nil {
-			return err
-		}
-		s.Status = SecretStatusPlain
-		s.Payload = string(plaintext)
-		s.Key = ""
-		s.AdditionalData = ""
-		return nil
-	default:
-		return errWrongSecretStatus
 	}
+	if utils.IsStringInSlice(s.Status, resolvedSecretStatuses) {
+		return &SecretResolutionError{err: err}
+	}
+	return err
+}
+
+// localSecretProvider encrypts secrets using AES-256-GCM and a random key
+// stored alongside the secret. This is the default provider
+type localSecretProvider struct{}
+
+func (*localSecretProvider) Name() string {
+	return "Local"
+}
+
+func (*localSecretProvider) EncryptedStatus() SecretStatus {
+	return SecretStatusAES256GCM
+}
+
+func (*localSecretProvider) Encrypt(payload, additionalData string) (string, string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", "", err
+	}
+	block, err := aes.NewCipher(deriveKey(key, additionalData))
+	if err != nil {
+		return "", "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", err
+	}
+	var aad []byte
+	if additionalData != "" {
+		aad = []byte(additionalData)
+	}
+	ciphertext := gcm.Seal(nonce, nonce, []byte(payload), aad)
+	return hex.EncodeToString(ciphertext), hex.EncodeToString(key), nil
+}
+
+func (*localSecretProvider) Decrypt(payload, key, additionalData string) (string, error) {
+	encrypted, err := hex.DecodeString(payload)
+	if err != nil {
+		return "", err
+	}
+	decodedKey, err := hex.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(deriveKey(decodedKey, additionalData))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(encrypted) < nonceSize {
+		return "", errMalformedCiphertext
+	}
+	nonce, ciphertext := encrypted[:nonceSize], encrypted[nonceSize:]
+	var aad []byte
+	if additionalData != "" {
+		aad = []byte(additionalData)
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// deriveKey is a weak method of deriving a key but it is still better than using the key as it is.
+// Use an external secret provider, such as HashiCorp Vault, for stronger guarantees
+func deriveKey(key []byte, additionalData string) []byte {
+	var combined []byte
+	combined = append(combined, key...)
+	if additionalData != "" {
+		combined = append(combined, []byte(additionalData)...)
+	}
+	combined = append(combined, key...)
+	hash := sha256.Sum256(combined)
+	return hash[:]
 }
@@ -0,0 +1,656 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/version"
+)
+
+const (
+	sftpFsLogSender    = "sftpfs"
+	sftpConnectTimeout = 10 * time.Second
+	// pooled connections not used for this time are closed
+	sftpConnIdleTimeout   = 5 * time.Minute
+	sftpConnCheckInterval = time.Minute
+)
+
+var sftpConnections = &sftpConnectionsCache{
+	items: make(map[string]*sftpConnection),
+}
+
+// SFTPFs is a Fs implementation for an upstream SFTP server.
+// The SSH connections are pooled, the sessions that use the same upstream
+// configuration, and so the same SFTPGo user, share a single connection
+type SFTPFs struct {
+	connectionID string
+	// local directory for the pipe files
+	localTempDir string
+	config       SFTPFsConfig
+	conn         *sftpConnection
+}
+
+func init() {
+	version.AddFeature("+sftpfs")
+}
+
+// NewSFTPFs returns an SFTPFs object that allows to interact with an upstream SFTP server.
+// The connection is established here, so invalid credentials or a host key not
+// included in the allowed fingerprints will fail the login
+func NewSFTPFs(connectionID, localTempDir string, config SFTPFsConfig) (Fs, error) {
+	fs := &SFTPFs{
+		connectionID: connectionID,
+		localTempDir: localTempDir,
+		config:       config,
+	}
+	if err := ValidateSFTPFsConfig(&fs.config); err != nil {
+		return fs, err
+	}
+	// the key is computed before decrypting the secrets, the encrypted secrets
+	// include the SFTPGo username as additional data
+	key, err := getSFTPConnectionKey(fs.config)
+	if err != nil {
+		return fs, err
+	}
+	if fs.config.Password.IsEncrypted() {
+		if err := fs.config.Password.Decrypt(); err != nil {
+			return fs, err
+		}
+	}
+	if fs.config.PrivateKey.IsEncrypted() {
+		if err := fs.config.PrivateKey.Decrypt(); err != nil {
+			return fs, err
+		}
+	}
+	fs.conn = sftpConnections.get(key, fs.config)
+	_, err = fs.conn.getClient()
+	if err != nil {
+		fsLog(fs, logger.LevelWarn, "unable to connect to the upstream SFTP server: %v", err)
+	}
+	return fs, err
+}
+
+// Name returns the name for the Fs implementation
+func (fs *SFTPFs) Name() string {
+	return fmt.Sprintf("SFTPFs %v@%v", fs.config.Username, fs.config.Endpoint)
+}
+
+// ConnectionID returns the connection ID associated to this Fs implementation
+func (fs *SFTPFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *SFTPFs) Stat(name string) (os.FileInfo, error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Stat(name)
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs *SFTPFs) Lstat(name string) (os.FileInfo, error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Lstat(name)
+}
+
+// Open opens the named file for reading
+func (fs *SFTPFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, err := client.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if offset > 0 {
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	cancelFn := getSFTPFileCancelFn(f)
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
+	fs.conn.addTransfer()
+	go func() {
+		defer fs.conn.removeTransfer()
+		defer watchdog.stop()
+		defer cancelFn()
+
+		n, err := io.Copy(watchdog.wrapWriter(w), f)
+		err = watchdog.getError(err)
+		w.CloseWithError(err) //nolint:errcheck
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+	}()
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing.
+// Existing files are truncated, upload resume is not supported
+func (fs *SFTPFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, err := client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	p := NewPipeWriter(w)
+	cancelFn := getSFTPFileCancelFn(f)
+	watchdog := newTransferWatchdog(getTransferIdleTimeout(), cancelFn)
+	fs.conn.addTransfer()
+	go func() {
+		defer fs.conn.removeTransfer()
+		defer watchdog.stop()
+
+		n, err := f.ReadFrom(watchdog.wrapReader(r))
+		err = watchdog.getError(err)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		r.CloseWithError(err) //nolint:errcheck
+		p.Done(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
+	}()
+	return nil, p, cancelFn, nil
+}
+
+// Rename renames (moves) source to target.
+// The POSIX rename extension is used, if supported by the upstream server,
+// so an existing target file is replaced as for the local filesystem
+func (fs *SFTPFs) Rename(source, target string) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(source, target)
+	}
+	return client.Rename(source, target)
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs *SFTPFs) Remove(name string, isDir bool) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	if isDir {
+		return client.RemoveDirectory(name)
+	}
+	return client.Remove(name)
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs *SFTPFs) Mkdir(name string) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Mkdir(name)
+}
+
+// Symlink creates source as a symbolic link to target.
+func (fs *SFTPFs) Symlink(source, target string) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Symlink(source, target)
+}
+
+// Readlink returns the destination of the named symbolic link
+// as absolute virtual path
+func (fs *SFTPFs) Readlink(name string) (string, error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return "", err
+	}
+	p, err := client.ReadLink(name)
+	if err != nil {
+		return p, err
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(path.Dir(name), p)
+	}
+	return fs.GetRelativePath(p), nil
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (fs *SFTPFs) Chown(name string, uid int, gid int) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Chown(name, uid, gid)
+}
+
+// Chmod changes the mode of the named file to mode
+func (fs *SFTPFs) Chmod(name string, mode os.FileMode) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file
+func (fs *SFTPFs) Chtimes(name string, atime, mtime time.Time) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Chtimes(name, atime, mtime)
+}
+
+// Truncate changes the size of the named file
+func (fs *SFTPFs) Truncate(name string, size int64) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return err
+	}
+	return client.Truncate(name, size)
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs *SFTPFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadDir(dirname)
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// Uploads are written sequentially to the upstream server, resume is not supported
+func (*SFTPFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+func (*SFTPFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (*SFTPFs) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (*SFTPFs) IsPermission(err error) bool {
+	if os.IsPermission(err) {
+		return true
+	}
+	return isSFTPStatusError(err, uint32(sftp.ErrSSHFxPermissionDenied))
+}
+
+// IsNotSupported returns true if the error indicate an unsupported operation
+func (*SFTPFs) IsNotSupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	return err == ErrVfsUnsupported || isSFTPStatusError(err, uint32(sftp.ErrSSHFxOpUnsupported))
+}
+
+// CheckRootPath creates the specified local root directory, needed for temporary
+// files, and the upstream prefix if they do not exist
+func (fs *SFTPFs) CheckRootPath(username string, uid int, gid int) bool {
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, nil)
+	if !osFs.CheckRootPath(username, uid, gid) {
+		return false
+	}
+	if fs.config.Prefix == "/" {
+		return true
+	}
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return false
+	}
+	if _, err = client.Stat(fs.config.Prefix); fs.IsNotExist(err) {
+		err = client.MkdirAll(fs.config.Prefix)
+		fsLog(fs, logger.LevelDebug, "prefix %#v for user %#v does not exist, try to create, mkdir error: %v",
+			fs.config.Prefix, username, err)
+	}
+	return err == nil
+}
+
+// ScanRootDirContents returns the number of files contained in the prefix
+// directory and their size
+func (fs *SFTPFs) ScanRootDirContents() (int, int64, error) {
+	return fs.GetDirSize(fs.config.Prefix)
+}
+
+// GetDirSize returns the number of files and the size for a folder
+// including any subfolders
+func (fs *SFTPFs) GetDirSize(dirname string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	isDir, err := IsDirectory(fs, dirname)
+	if err == nil && isDir {
+		err = fs.Walk(dirname, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info != nil && info.Mode().IsRegular() {
+				size += info.Size()
+				numFiles++
+			}
+			return err
+		})
+	}
+	return numFiles, size, err
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+// Atomic uploads are not supported, we never call this method for SFTPFs
+func (*SFTPFs) GetAtomicUploadPath(name string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTPGo users
+func (fs *SFTPFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !path.IsAbs(rel) {
+		return "/" + rel
+	}
+	if fs.config.Prefix != "/" {
+		if rel != fs.config.Prefix && !strings.HasPrefix(rel, fs.config.Prefix+"/") {
+			return "/"
+		}
+		rel = path.Clean("/" + strings.TrimPrefix(rel, fs.config.Prefix))
+	}
+	return rel
+}
+
+// Walk walks the file tree rooted at root, calling walkFn for each file or
+// directory in the tree, including root
+func (fs *SFTPFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	walker := client.Walk(root)
+	for walker.Step() {
+		info := walker.Stat()
+		if err := walkFn(walker.Path(), info, walker.Err()); err != nil {
+			if err == filepath.SkipDir && info != nil && info.IsDir() {
+				walker.SkipDir()
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Join joins any number of path elements into a single path
+func (*SFTPFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// HasVirtualFolders returns true if folders are emulated
+func (*SFTPFs) HasVirtualFolders() bool {
+	return false
+}
+
+// ResolvePath returns the matching filesystem path for the specified virtual path
+func (fs *SFTPFs) ResolvePath(virtualPath string) (string, error) {
+	if !path.IsAbs(virtualPath) {
+		virtualPath = path.Clean("/" + virtualPath)
+	}
+	return fs.Join(fs.config.Prefix, virtualPath), nil
+}
+
+// GetMimeType returns the content type
+func (fs *SFTPFs) GetMimeType(name string) (string, error) {
+	client, err := fs.conn.getClient()
+	if err != nil {
+		return "", err
+	}
+	f, err := client.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var buf [512]byte
+	n, err := io.ReadFull(f, buf[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// GetSignedURL returns ErrVfsUnsupported, signed URLs are not supported for this filesystem
+func (*SFTPFs) GetSignedURL(name string, expiration time.Duration) (string, error) {
+	return "", ErrVfsUnsupported
+}
+
+// sftpConnection is a pooled connection to an upstream SFTP server.
+// A broken connection is established again on the next request
+type sftpConnection struct {
+	config SFTPFsConfig
+	// unix timestamp in nanoseconds
+	lastActivity    int64
+	activeTransfers int32
+	mu              sync.Mutex
+	sshClient       *ssh.Client
+	sftpClient      *sftp.Client
+}
+
+func (c *sftpConnection) getClient() (*sftp.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	if c.sftpClient != nil {
+		return c.sftpClient, nil
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c.sftpClient, nil
+}
+
+func (c *sftpConnection) connect() error {
+	clientConfig := &ssh.ClientConfig{
+		User:            c.config.Username,
+		HostKeyCallback: c.checkHostKey,
+		Timeout:         sftpConnectTimeout,
+		ClientVersion:   "SSH-2.0-SFTPGo",
+	}
+	if c.config.PrivateKey.Payload != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(c.config.PrivateKey.Payload))
+		if err != nil {
+			return fmt.Errorf("unable to parse the private key: %v", err)
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if c.config.Password.Payload != "" {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(c.config.Password.Payload))
+	}
+	sshClient, err := ssh.Dial("tcp", c.config.Endpoint, clientConfig)
+	if err != nil {
+		return fmt.Errorf("unable to connect to the SFTP server %#v: %v", c.config.Endpoint, err)
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return fmt.Errorf("unable to start the SFTP session on %#v: %v", c.config.Endpoint, err)
+	}
+	c.sshClient = sshClient
+	c.sftpClient = sftpClient
+	go c.wait(sshClient)
+	logger.Debug(sftpFsLogSender, "", "connected to the SFTP server %#v as user %#v", c.config.Endpoint, c.config.Username)
+	return nil
+}
+
+// wait resets the clients when the SSH connection is closed
+func (c *sftpConnection) wait(sshClient *ssh.Client) {
+	err := sshClient.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sshClient == sshClient {
+		logger.Debug(sftpFsLogSender, "", "connection to the SFTP server %#v closed: %v", c.config.Endpoint, err)
+		c.sftpClient.Close()
+		c.sshClient = nil
+		c.sftpClient = nil
+	}
+}
+
+func (c *sftpConnection) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if len(c.config.Fingerprints) == 0 {
+		return nil
+	}
+	fp := ssh.FingerprintSHA256(key)
+	if utils.IsStringInSlice(fp, c.config.Fingerprints) {
+		return nil
+	}
+	return fmt.Errorf("host key verification failed for %#v, fingerprint %#v is not allowed", hostname, fp)
+}
+
+func (c *sftpConnection) addTransfer() {
+	atomic.AddInt32(&c.activeTransfers, 1)
+}
+
+func (c *sftpConnection) removeTransfer() {
+	atomic.AddInt32(&c.activeTransfers, -1)
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *sftpConnection) isIdle(maxIdle time.Duration) bool {
+	if atomic.LoadInt32(&c.activeTransfers) > 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity))) > maxIdle
+}
+
+func (c *sftpConnection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sshClient != nil {
+		c.sftpClient.Close()
+		c.sshClient.Close()
+		c.sshClient = nil
+		c.sftpClient = nil
+	}
+}
+
+type sftpConnectionsCache struct {
+	sync.Mutex
+	items     map[string]*sftpConnection
+	checkOnce sync.Once
+}
+
+func (c *sftpConnectionsCache) get(key string, config SFTPFsConfig) *sftpConnection {
+	c.checkOnce.Do(func() {
+		go c.checkIdleConnections()
+	})
+
+	c.Lock()
+	defer c.Unlock()
+
+	if conn, ok := c.items[key]; ok {
+		return conn
+	}
+	conn := &sftpConnection{
+		config:       config,
+		lastActivity: time.Now().UnixNano(),
+	}
+	c.items[key] = conn
+	return conn
+}
+
+func (c *sftpConnectionsCache) checkIdleConnections() {
+	for range time.Tick(sftpConnCheckInterval) {
+		c.removeIdle(sftpConnIdleTimeout)
+	}
+}
+
+func (c *sftpConnectionsCache) removeIdle(maxIdle time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	for key, conn := range c.items {
+		if conn.isIdle(maxIdle) {
+			conn.close()
+			delete(c.items, key)
+		}
+	}
+}
+
+// getSFTPConnectionKey returns the key for the connections pool.
+// The connections are shared between the filesystems with the same configuration
+func getSFTPConnectionKey(config SFTPFsConfig) (string, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// getSFTPFileCancelFn returns a function that closes the specified file,
+// this way a running transfer is aborted
+func getSFTPFileCancelFn(f *sftp.File) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.Close()
+		})
+	}
+}
+
+func isSFTPStatusError(err error, code uint32) bool {
+	var statusErr *sftp.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code == code
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Supported line endings for text transforms, empty means the line endings are preserved
+const (
+	TextLineEndingsLF   = "lf"
+	TextLineEndingsCRLF = "crlf"
+)
+
+// maxTextTransformPendingSize defines the maximum size, as bytes, for the out of order
+// writes that we keep in memory while waiting for the missing data
+const maxTextTransformPendingSize = 8 * 1024 * 1024
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// IsValidTextLineEndings returns true if the specified line endings are supported
+func IsValidTextLineEndings(lineEndings string) bool {
+	return lineEndings == "" || lineEndings == TextLineEndingsLF || lineEndings == TextLineEndingsCRLF
+}
+
+// textTransformer is an io.Writer that converts the line endings and optionally
+// strips the UTF-8 BOM from the data written to it. The data is processed as it
+// arrives, only the bytes needed to detect the BOM or a CRLF sequence spanning
+// two writes are held back until the next write or the final flush
+type textTransformer struct {
+	w           io.Writer
+	lineEndings string
+	stripBOM    bool
+	bomChecked  bool
+	head        []byte
+	pendingCR   bool
+	lastByteCR  bool
+	buf         bytes.Buffer
+}
+
+func newTextTransformer(w io.Writer, lineEndings string, stripBOM bool) *textTransformer {
+	return &textTransformer{
+		w:           w,
+		lineEndings: lineEndings,
+		stripBOM:    stripBOM,
+		bomChecked:  !stripBOM,
+	}
+}
+
+// Write converts and writes p. It always returns len(p) on success, the converted
+// size can be different
+func (t *textTransformer) Write(p []byte) (int, error) {
+	data := p
+	if !t.bomChecked {
+		t.head = append(t.head, p...)
+		if len(t.head) < len(utf8BOM) && bytes.HasPrefix(utf8BOM, t.head) {
+			return len(p), nil
+		}
+		t.bomChecked = true
+		data = bytes.TrimPrefix(t.head, utf8BOM)
+		t.head = nil
+	}
+	if err := t.convert(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the bytes held back, it must be called once all the data is written
+func (t *textTransformer) Flush() error {
+	if !t.bomChecked {
+		t.bomChecked = true
+		if err := t.convert(t.head); err != nil {
+			return err
+		}
+		t.head = nil
+	}
+	if t.pendingCR {
+		t.pendingCR = false
+		_, err := t.w.Write([]byte{'\r'})
+		return err
+	}
+	return nil
+}
+
+func (t *textTransformer) convert(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if t.lineEndings == "" {
+		_, err := t.w.Write(data)
+		return err
+	}
+	t.buf.Reset()
+	for _, b := range data {
+		switch t.lineEndings {
+		case TextLineEndingsLF:
+			if t.pendingCR {
+				t.pendingCR = false
+				if b != '\n' {
+					// a lone CR is not a line ending we convert
+					t.buf.WriteByte('\r')
+				}
+			}
+			if b == '\r' {
+				t.pendingCR = true
+				continue
+			}
+			t.buf.WriteByte(b)
+		case TextLineEndingsCRLF:
+			if b == '\n' && !t.lastByteCR {
+				t.buf.WriteByte('\r')
+			}
+			t.lastByteCR = b == '\r'
+			t.buf.WriteByte(b)
+		}
+	}
+	_, err := t.w.Write(t.buf.Bytes())
+	return err
+}
+
+// textTransformFile is a File wrapper that applies a text transform to the uploaded data.
+// The converted data is written sequentially to the wrapped file, writes ahead of the
+// current offset are kept in memory, up to a limit, until the missing data arrives.
+// Writes behind the current offset, seeks and truncations are not supported
+type textTransformFile struct {
+	File
+	sync.Mutex
+	transformer *textTransformer
+	offset      int64
+	pending     map[int64][]byte
+	pendingSize int
+	err         error
+}
+
+// NewTextTransformFile returns a File that converts the line endings and optionally strips
+// the UTF-8 BOM from the data written to the specified file. The specified file must be
+// empty and the data must be written starting from offset 0
+func NewTextTransformFile(file File, lineEndings string, stripBOM bool) File {
+	return &textTransformFile{
+		File:        file,
+		transformer: newTextTransformer(file, lineEndings, stripBOM),
+		pending:     make(map[int64][]byte),
+	}
+}
+
+// Write writes len(p) bytes after the data written so far
+func (f *textTransformFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.writeAt(p, f.offset)
+}
+
+// WriteAt writes len(p) bytes at the specified offset of the original, not converted, data
+func (f *textTransformFile) WriteAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.writeAt(p, off)
+}
+
+func (f *textTransformFile) writeAt(p []byte, off int64) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if off < f.offset {
+		return 0, fmt.Errorf("unable to write at offset %v, text transforms require sequential writes, current offset: %v",
+			off, f.offset)
+	}
+	if off > f.offset {
+		if _, ok := f.pending[off]; ok || f.pendingSize+len(p) > maxTextTransformPendingSize {
+			f.err = errors.New("too many out of order writes for a text transform")
+			return 0, f.err
+		}
+		data := make([]byte, len(p))
+		copy(data, p)
+		f.pending[off] = data
+		f.pendingSize += len(data)
+		return len(p), nil
+	}
+	if _, err := f.transformer.Write(p); err != nil {
+		f.err = err
+		return 0, err
+	}
+	f.offset += int64(len(p))
+	for {
+		data, ok := f.pending[f.offset]
+		if !ok {
+			break
+		}
+		delete(f.pending, f.offset)
+		f.pendingSize -= len(data)
+		if _, err := f.transformer.Write(data); err != nil {
+			f.err = err
+			return 0, err
+		}
+		f.offset += int64(len(data))
+	}
+	return len(p), nil
+}
+
+// Seek only supports getting the current offset or seeking to it
+func (f *textTransformFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if (whence == io.SeekStart && offset == f.offset) || (whence == io.SeekCurrent && offset == 0) {
+		return f.offset, nil
+	}
+	return 0, ErrVfsUnsupported
+}
+
+// Truncate is not supported for text transforms
+func (f *textTransformFile) Truncate(size int64) error {
+	return ErrVfsUnsupported
+}
+
+// Close writes any data held back by the transform and closes the wrapped file
+func (f *textTransformFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	err := f.err
+	if err == nil && len(f.pending) > 0 {
+		err = fmt.Errorf("incomplete upload, %v out of order writes after offset %v", len(f.pending), f.offset)
+	}
+	if err == nil {
+		err = f.transformer.Flush()
+	}
+	errClose := f.File.Close()
+	if err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTransferStalled defines the error for a Cloud Storage transfer canceled
+// because no data was transferred within the configured idle timeout
+var ErrTransferStalled = errors.New("transfer stalled: no data transferred within the configured idle timeout")
+
+// BackendTimeouts defines the timeouts for the operations on Cloud Storage backends.
+// A stalled backend will fail the operation with a timeout error instead of hanging
+type BackendTimeouts struct {
+	// Timeout, in seconds, for metadata operations such as stat, list, rename, remove.
+	// 0 means the default (30 seconds)
+	Metadata int `json:"metadata" mapstructure:"metadata"`
+	// Timeout, in seconds, for long running metadata operations such as the recursive
+	// listing needed for quota scans. 0 means the default (300 seconds)
+	LongMetadata int `json:"long_metadata" mapstructure:"long_metadata"`
+	// Idle timeout, in seconds, for data transfers. A transfer is canceled if no data
+	// is transferred for this time. There is no limit for the total transfer time so
+	// legitimately long transfers are not affected. 0 means disabled
+	TransferIdle int `json:"transfer_idle" mapstructure:"transfer_idle"`
+}
+
+var (
+	backendTimeouts BackendTimeouts
+	timeoutsMutex   sync.RWMutex
+)
+
+// SetBackendTimeouts sets the timeouts for Cloud Storage backends.
+// The timeouts apply to the filesystems created after this call
+func SetBackendTimeouts(timeouts BackendTimeouts) {
+	timeoutsMutex.Lock()
+	defer timeoutsMutex.Unlock()
+
+	backendTimeouts = timeouts
+}
+
+func getMetadataTimeout() time.Duration {
+	timeoutsMutex.RLock()
+	defer timeoutsMutex.RUnlock()
+
+	if backendTimeouts.Metadata > 0 {
+		return time.Duration(backendTimeouts.Metadata) * time.Second
+	}
+	return 30 * time.Second
+}
+
+func getLongMetadataTimeout() time.Duration {
+	timeoutsMutex.RLock()
+	defer timeoutsMutex.RUnlock()
+
+	if backendTimeouts.LongMetadata > 0 {
+		return time.Duration(backendTimeouts.LongMetadata) * time.Second
+	}
+	return 300 * time.Second
+}
+
+func getTransferIdleTimeout() time.Duration {
+	timeoutsMutex.RLock()
+	defer timeoutsMutex.RUnlock()
+
+	return time.Duration(backendTimeouts.TransferIdle) * time.Second
+}
+
+// transferWatchdog cancels a transfer if no data is transferred within the idle timeout
+type transferWatchdog struct {
+	lastActivity int64
+	stalled      int32
+	timeout      time.Duration
+	cancelFn     func()
+	done         chan bool
+	stopOnce     sync.Once
+}
+
+// newTransferWatchdog returns a started watchdog or nil if the idle timeout is disabled.
+// All the methods are safe to call on a nil watchdog
+func newTransferWatchdog(timeout time.Duration, cancelFn func()) *transferWatchdog {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &transferWatchdog{
+		lastActivity: time.Now().UnixNano(),
+		timeout:      timeout,
+		cancelFn:     cancelFn,
+		done:         make(chan bool),
+	}
+	go w.run()
+	return w
+}
+
+func (w *transferWatchdog) run() {
+	interval := w.timeout / 4
+	if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&w.lastActivity))) > w.timeout {
+				atomic.StoreInt32(&w.stalled, 1)
+				w.cancelFn()
+				return
+			}
+		}
+	}
+}
+
+func (w *transferWatchdog) touch() {
+	if w == nil {
+		return
+	}
+	atomic.StoreInt64(&w.lastActivity, time.Now().UnixNano())
+}
+
+func (w *transferWatchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.stopOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+// getError returns ErrTransferStalled if the transfer was canceled by the watchdog,
+// otherwise the given error
+func (w *transferWatchdog) getError(err error) error {
+	if w == nil || err == nil {
+		return err
+	}
+	if atomic.LoadInt32(&w.stalled) == 1 {
+		return ErrTransferStalled
+	}
+	return err
+}
+
+// wrapReader returns a reader that signals the transferred data to the watchdog
+func (w *transferWatchdog) wrapReader(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &watchdogReader{reader: r, watchdog: w}
+}
+
+// wrapWriter returns a writer that signals the transferred data to the watchdog
+func (w *transferWatchdog) wrapWriter(writer io.Writer) io.Writer {
+	if w == nil {
+		return writer
+	}
+	return &watchdogWriter{writer: writer, watchdog: w}
+}
+
+// wrapWriterAt returns a writer at that signals the transferred data to the watchdog
+func (w *transferWatchdog) wrapWriterAt(writer io.WriterAt) io.WriterAt {
+	if w == nil {
+		return writer
+	}
+	return &watchdogWriterAt{writer: writer, watchdog: w}
+}
+
+type watchdogReader struct {
+	reader   io.Reader
+	watchdog *transferWatchdog
+}
+
+func (r *watchdogReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.watchdog.touch()
+	}
+	return n, err
+}
+
+type watchdogWriter struct {
+	writer   io.Writer
+	watchdog *transferWatchdog
+}
+
+func (w *watchdogWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	if n > 0 {
+		w.watchdog.touch()
+	}
+	return n, err
+}
+
+type watchdogWriterAt struct {
+	writer   io.WriterAt
+	watchdog *transferWatchdog
+}
+
+func (w *watchdogWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.writer.WriteAt(p, off)
+	if n > 0 {
+		w.watchdog.touch()
+	}
+	return n, err
+}
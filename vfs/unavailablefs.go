@@ -0,0 +1,202 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/eikenb/pipeat"
+)
+
+// UnavailableFs is the Fs returned if the configured storage backend cannot be
+// initialized, for example because its credentials cannot be resolved.
+// The user can login but every filesystem operation fails with the initialization error
+type UnavailableFs struct {
+	connectionID string
+	name         string
+	localTempDir string
+	err          error
+}
+
+// NewUnavailableFs returns an Fs that fails every operation with the given error
+func NewUnavailableFs(connectionID, localTempDir, name string, err error) Fs {
+	return &UnavailableFs{
+		connectionID: connectionID,
+		name:         name,
+		localTempDir: localTempDir,
+		err:          err,
+	}
+}
+
+// Name returns the name for the Fs implementation
+func (fs *UnavailableFs) Name() string {
+	return fs.name + " (unavailable)"
+}
+
+// ConnectionID returns the connection ID associated to this Fs implementation
+func (fs *UnavailableFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns the initialization error
+func (fs *UnavailableFs) Stat(name string) (os.FileInfo, error) {
+	return nil, fs.err
+}
+
+// Lstat returns the initialization error
+func (fs *UnavailableFs) Lstat(name string) (os.FileInfo, error) {
+	return nil, fs.err
+}
+
+// Open returns the initialization error
+func (fs *UnavailableFs) Open(name string, offset int64) (File, *pipeat.PipeReaderAt, func(), error) {
+	return nil, nil, nil, fs.err
+}
+
+// Create returns the initialization error
+func (fs *UnavailableFs) Create(name string, flag int) (File, *PipeWriter, func(), error) {
+	return nil, nil, nil, fs.err
+}
+
+// Rename returns the initialization error
+func (fs *UnavailableFs) Rename(source, target string) error {
+	return fs.err
+}
+
+// Remove returns the initialization error
+func (fs *UnavailableFs) Remove(name string, isDir bool) error {
+	return fs.err
+}
+
+// Mkdir returns the initialization error
+func (fs *UnavailableFs) Mkdir(name string) error {
+	return fs.err
+}
+
+// Symlink returns the initialization error
+func (fs *UnavailableFs) Symlink(source, target string) error {
+	return fs.err
+}
+
+// Chown returns the initialization error
+func (fs *UnavailableFs) Chown(name string, uid int, gid int) error {
+	return fs.err
+}
+
+// Chmod returns the initialization error
+func (fs *UnavailableFs) Chmod(name string, mode os.FileMode) error {
+	return fs.err
+}
+
+// Chtimes returns the initialization error
+func (fs *UnavailableFs) Chtimes(name string, atime, mtime time.Time) error {
+	return fs.err
+}
+
+// Truncate returns the initialization error
+func (fs *UnavailableFs) Truncate(name string, size int64) error {
+	return fs.err
+}
+
+// ReadDir returns the initialization error
+func (fs *UnavailableFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return nil, fs.err
+}
+
+// Readlink returns the initialization error
+func (fs *UnavailableFs) Readlink(name string) (string, error) {
+	return "", fs.err
+}
+
+// IsUploadResumeSupported returns false
+func (*UnavailableFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns false
+func (*UnavailableFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// CheckRootPath creates the local directory used for temporary files
+func (fs *UnavailableFs) CheckRootPath(username string, uid int, gid int) bool {
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, nil)
+	return osFs.CheckRootPath(username, uid, gid)
+}
+
+// ResolvePath returns the cleaned virtual path, no file can be accessed anyway
+func (*UnavailableFs) ResolvePath(virtualPath string) (string, error) {
+	if !path.IsAbs(virtualPath) {
+		virtualPath = path.Clean("/" + virtualPath)
+	}
+	return virtualPath, nil
+}
+
+// IsNotExist returns false, the initialization error is not a not found error
+func (*UnavailableFs) IsNotExist(err error) bool {
+	return false
+}
+
+// IsPermission returns false
+func (*UnavailableFs) IsPermission(err error) bool {
+	return false
+}
+
+// IsNotSupported returns true if the error indicate an unsupported operation
+func (*UnavailableFs) IsNotSupported(err error) bool {
+	return err == ErrVfsUnsupported
+}
+
+// ScanRootDirContents returns the initialization error
+func (fs *UnavailableFs) ScanRootDirContents() (int, int64, error) {
+	return 0, 0, fs.err
+}
+
+// GetDirSize returns the initialization error
+func (fs *UnavailableFs) GetDirSize(dirname string) (int, int64, error) {
+	return 0, 0, fs.err
+}
+
+// GetAtomicUploadPath returns an empty path, atomic uploads are not supported
+func (*UnavailableFs) GetAtomicUploadPath(name string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir
+func (*UnavailableFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !strings.HasPrefix(rel, "/") {
+		return "/" + rel
+	}
+	return rel
+}
+
+// Walk returns the initialization error
+func (fs *UnavailableFs) Walk(root string, walkFn filepath.WalkFunc) error {
+	return fs.err
+}
+
+// Join joins any number of path elements into a single path
+func (*UnavailableFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// HasVirtualFolders returns false
+func (*UnavailableFs) HasVirtualFolders() bool {
+	return false
+}
+
+// GetMimeType returns the initialization error
+func (fs *UnavailableFs) GetMimeType(name string) (string, error) {
+	return "", fs.err
+}
+
+// GetSignedURL returns the initialization error
+func (fs *UnavailableFs) GetSignedURL(name string, expiration time.Duration) (string, error) {
+	return "", fs.err
+}
@@ -2,13 +2,16 @@
 package vfs
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"time"
@@ -21,7 +24,29 @@ import (
 
 const dirMimeType = "inode/directory"
 
-var validAzAccessTier = []string{"", "Archive", "Hot", "Cool"}
+// S3 server-side encryption algorithms
+const (
+	S3SSEAES256 = "AES256"
+	S3SSEKMS    = "aws:kms"
+)
+
+// Cloudflare R2 endpoints are account specific, jurisdiction specific endpoints
+// such as "<account_id>.eu.r2.cloudflarestorage.com" are allowed too
+const (
+	s3R2EndpointFormat = "https://%v.r2.cloudflarestorage.com"
+	s3R2EndpointSuffix = ".r2.cloudflarestorage.com"
+)
+
+var (
+	validAzAccessTier      = []string{"", "Archive", "Hot", "Cool"}
+	validS3SSEEncryptions  = []string{"", S3SSEAES256, S3SSEKMS}
+	s3RoleSessionNameRegex = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+	s3R2AccountIDRegex     = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	gcsKMSKeyNameRegex     = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+	// R2 rejects any region other than "auto", "us-east-1" is accepted as an alias
+	validS3R2Regions        = []string{"auto", "us-east-1"}
+	validS3R2StorageClasses = []string{"", "STANDARD", "STANDARD_IA"}
+)
 
 // Fs defines the interface for filesystem backends
 type Fs interface {
@@ -56,6 +81,7 @@ type Fs interface {
 	Join(elem ...string) string
 	HasVirtualFolders() bool
 	GetMimeType(name string) (string, error)
+	GetSignedURL(name string, expiration time.Duration) (string, error)
 }
 
 // File defines an interface representing a SFTPGo file
@@ -71,9 +97,50 @@ type File interface {
 	Truncate(size int64) error
 }
 
+// DirPagesReader is implemented by the Fs that can return a directory listing
+// one page at a time, as the pages are fetched from the storage backend
+type DirPagesReader interface {
+	// ReadDirPages reads the directory named by dirname and calls fn for each
+	// page of directory entries. The listing stops if fn returns false
+	ReadDirPages(dirname string, fn func(page []os.FileInfo) bool) error
+}
+
+// ObjectMetadataSetter is implemented by the Fs that can store custom metadata
+// with the objects
+type ObjectMetadataSetter interface {
+	// SetObjectMetadata adds the specified custom metadata to the named object,
+	// the existing metadata with different keys are preserved
+	SetObjectMetadata(name string, metadata map[string]string) error
+}
+
+// IsDirPagesSupported returns true if the specified Fs can list a directory one page at a time
+func IsDirPagesSupported(fs Fs) bool {
+	_, ok := fs.(DirPagesReader)
+	return ok
+}
+
+// ReadDirPages reads the directory named by dirname and calls fn for each page of
+// directory entries. If the specified Fs does not implement DirPagesReader, fn is
+// called once with the whole listing
+func ReadDirPages(fs Fs, dirname string, fn func(page []os.FileInfo) bool) error {
+	if reader, ok := fs.(DirPagesReader); ok {
+		return reader.ReadDirPages(dirname, fn)
+	}
+	result, err := fs.ReadDir(dirname)
+	if err != nil {
+		return err
+	}
+	fn(result)
+	return nil
+}
+
 // ErrVfsUnsupported defines the error for an unsupported VFS operation
 var ErrVfsUnsupported = errors.New("Not supported")
 
+// ErrSSECustomerKeyMismatch defines the error returned if S3 refuses a request using
+// the configured SSE-C key
+var ErrSSECustomerKeyMismatch = errors.New("the object is encrypted using a different SSE-C key or it is not encrypted using SSE-C")
+
 // QuotaCheckResult defines the result for a quota check
 type QuotaCheckResult struct {
 	HasSpace     bool
@@ -126,6 +193,39 @@ type S3FsConfig struct {
 	UploadPartSize int64 `json:"upload_part_size,omitempty"`
 	// How many parts are uploaded in parallel
 	UploadConcurrency int `json:"upload_concurrency,omitempty"`
+	// Set to true to access a "Requester Pays" bucket. The requester, and so the
+	// configured credentials, will be charged for the requests and the data transfer
+	RequesterPays bool `json:"requester_pays,omitempty"`
+	// Server-side encryption to request for the uploaded objects: empty (or "none")
+	// to use the bucket default, "AES256" for SSE-S3 or "aws:kms" for SSE-KMS
+	SSEEncryption string `json:"sse_encryption,omitempty"`
+	// The KMS key ID, alias or ARN to use for SSE-KMS. Required if SSEEncryption is "aws:kms"
+	SSEKMSKeyID string `json:"sse_kms_key_id,omitempty"`
+	// Optional ARN of an IAM role to assume using STS. The role is assumed using the configured
+	// access key/secret, if any, or the default credentials chain, for example the instance role.
+	// The temporary credentials are automatically refreshed before they expire
+	RoleARN string `json:"role_arn,omitempty"`
+	// Optional external ID to use when assuming the role
+	ExternalID string `json:"external_id,omitempty"`
+	// Optional session name to use when assuming the role. Default is "SFTPGo"
+	RoleSessionName string `json:"role_session_name,omitempty"`
+	// Cloudflare account ID. If set the configuration is validated for Cloudflare R2:
+	// the endpoint is derived from the account ID if empty, the region defaults to
+	// "auto" and the settings not supported by R2 are rejected
+	R2AccountID string `json:"r2_account_id,omitempty"`
+	// Maximum number of retries for failed requests, for example for transient network
+	// errors, server errors or throttling. 0 means the default (3), -1 disables retries
+	MaxRetries int `json:"max_retries,omitempty"`
+	// Minimum delay, as milliseconds, before the first retry, it grows exponentially for
+	// the following retries. 0 means the default (30 ms)
+	RetryBaseDelay int `json:"retry_base_delay,omitempty"`
+	// Timeout, as seconds, for each request to the storage, including reading the response
+	// body. Multipart transfers use a request for each part. 0 means no timeout
+	RequestTimeout int `json:"request_timeout,omitempty"`
+	// Customer-provided key for SSE-C, the plain value is the base64 encoding of a 256-bit key.
+	// The key is sent with every request that reads or writes the objects contents, the
+	// objects uploaded using a key can only be read providing the same key
+	SSECustomerKey Secret `json:"sse_customer_key,omitempty"`
 }
 
 // GCSFsConfig defines the configuration for Google Cloud Storage based filesystem
@@ -143,6 +243,10 @@ type GCSFsConfig struct {
 	// 0 explicit, 1 automatic
 	AutomaticCredentials int    `json:"automatic_credentials,omitempty"`
 	StorageClass         string `json:"storage_class,omitempty"`
+	// Optional Cloud KMS key used to encrypt the created and copied objects, in the format
+	// "projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>".
+	// If empty the bucket default encryption is used
+	KMSKeyName string `json:"kms_key_name,omitempty"`
 }
 
 // AzBlobFsConfig defines the configuration for Azure Blob Storage based filesystem
@@ -180,6 +284,56 @@ type AzBlobFsConfig struct {
 	UseEmulator bool `json:"use_emulator,omitempty"`
 	// Blob Access Tier
 	AccessTier string `json:"access_tier,omitempty"`
+	// Set to true to authenticate using an Azure AD token instead of the account key
+	// or the SAS URL. The token is obtained for the service principal defined using the
+	// AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET environment variables,
+	// if set, otherwise using the managed identity assigned to the SFTPGo host.
+	// The account name is required
+	UseManagedIdentity bool `json:"use_managed_identity,omitempty"`
+	// Client ID for a user assigned managed identity, leave blank to use the
+	// system assigned one
+	ManagedIdentityClientID string `json:"managed_identity_client_id,omitempty"`
+}
+
+// B2FsConfig defines the configuration for Backblaze B2 Cloud Storage based filesystem
+type B2FsConfig struct {
+	Bucket string `json:"bucket,omitempty"`
+	// KeyPrefix is similar to a chroot directory for local filesystem.
+	// If specified then the SFTPGo user will only see files that starts
+	// with this prefix and so you can restrict access to a specific
+	// folder. The prefix, if not empty, must not start with "/" and must
+	// end with "/".
+	// If empty the whole bucket contents will be available
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	// The application key ID, or the master key ID
+	AccountID string `json:"account_id,omitempty"`
+	// The application key is stored encrypted (AES-256-GCM)
+	ApplicationKey Secret `json:"application_key,omitempty"`
+	// Optional endpoint. Default is "https://api.backblazeb2.com"
+	Endpoint string `json:"endpoint,omitempty"`
+	// The chunk size (in MB) for large file uploads. Files smaller than this size
+	// are uploaded using a single request. If this value is set to zero, the part
+	// size recommended by B2 will be used. The minimum allowed value is 5.
+	UploadChunkSize int64 `json:"upload_chunk_size,omitempty"`
+}
+
+// SFTPFsConfig defines the configuration for SFTP based filesystem.
+// The files are stored on an upstream SFTP server
+type SFTPFsConfig struct {
+	// Upstream server address as host:port, port 22 is used if omitted
+	Endpoint string `json:"endpoint,omitempty"`
+	Username string `json:"username,omitempty"`
+	// The password and the private key are stored encrypted (AES-256-GCM).
+	// At least one of them is required
+	Password   Secret `json:"password,omitempty"`
+	PrivateKey Secret `json:"private_key,omitempty"`
+	// SHA256 fingerprints, for example "SHA256:...", allowed for the upstream server
+	// host key. If empty any host key is accepted
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	// Prefix is similar to a chroot directory for local filesystem.
+	// If specified then the SFTPGo user will only see the contents of this
+	// upstream directory. It must be an absolute path, default is "/"
+	Prefix string `json:"prefix,omitempty"`
 }
 
 // PipeWriter defines a wrapper for pipeat.PipeWriterAt.
@@ -187,6 +341,8 @@ type PipeWriter struct {
 	writer *pipeat.PipeWriterAt
 	err    error
 	done   chan bool
+	// functions to execute after the upload ends, before returning from Close
+	closeHooks []func()
 }
 
 // NewPipeWriter initializes a new PipeWriter
@@ -202,9 +358,17 @@ func NewPipeWriter(w *pipeat.PipeWriterAt) *PipeWriter {
 func (p *PipeWriter) Close() error {
 	p.writer.Close() //nolint:errcheck // the returned error is always null
 	<-p.done
+	for _, fn := range p.closeHooks {
+		fn()
+	}
 	return p.err
 }
 
+// addCloseHook adds a function to execute after the upload ends
+func (p *PipeWriter) addCloseHook(fn func()) {
+	p.closeHooks = append(p.closeHooks, fn)
+}
+
 // Done unlocks other goroutines waiting on Close().
 // It must be called when the upload ends
 func (p *PipeWriter) Done(err error) {
@@ -231,6 +395,28 @@ func IsDirectory(fs Fs, path string) (bool, error) {
 	return fileInfo.IsDir(), err
 }
 
+// ToCanonicalPath returns the OS independent form for a local filesystem path,
+// both "/" and "\" are accepted as separator and converted to "/".
+// The canonical form is used to store paths, for example inside backups
+func ToCanonicalPath(p string) string {
+	return strings.ReplaceAll(p, "\\", "/")
+}
+
+// ToOSPath converts a local filesystem path, stored using any separator,
+// to the separator of the running OS
+func ToOSPath(p string) string {
+	if p == "" {
+		return p
+	}
+	return filepath.Clean(filepath.FromSlash(ToCanonicalPath(p)))
+}
+
+// HasMixedSeparators returns true if the specified local filesystem path uses both
+// "/" and "\" as separator, such paths are ambiguous and so they are refused
+func HasMixedSeparators(p string) bool {
+	return strings.Contains(p, "/") && strings.Contains(p, "\\")
+}
+
 // IsLocalOsFs returns true if fs is the local filesystem implementation
 func IsLocalOsFs(fs Fs) bool {
 	return fs.Name() == osFsName
@@ -257,6 +443,9 @@ func ValidateS3FsConfig(config *S3FsConfig) error {
 	if config.Bucket == "" {
 		return errors.New("bucket cannot be empty")
 	}
+	if err := checkS3R2Config(config); err != nil {
+		return err
+	}
 	if config.Region == "" {
 		return errors.New("region cannot be empty")
 	}
@@ -278,9 +467,158 @@ func ValidateS3FsConfig(config *S3FsConfig) error {
 	if config.UploadConcurrency < 0 || config.UploadConcurrency > 64 {
 		return fmt.Errorf("invalid upload concurrency: %v", config.UploadConcurrency)
 	}
+	if err := checkS3RetryConfig(config); err != nil {
+		return err
+	}
+	if err := checkS3RoleConfig(config); err != nil {
+		return err
+	}
+	return checkS3SSEConfig(config)
+}
+
+func checkS3RetryConfig(config *S3FsConfig) error {
+	if config.MaxRetries < -1 || config.MaxRetries > 20 {
+		return fmt.Errorf("invalid max_retries %v, it must be between -1 and 20", config.MaxRetries)
+	}
+	if config.RetryBaseDelay < 0 || config.RetryBaseDelay > 60000 {
+		return fmt.Errorf("invalid retry_base_delay %v, it must be between 0 and 60000 (ms)", config.RetryBaseDelay)
+	}
+	if config.RequestTimeout < 0 || config.RequestTimeout > 3600 {
+		return fmt.Errorf("invalid request_timeout %v, it must be between 0 and 3600 (seconds)", config.RequestTimeout)
+	}
 	return nil
 }
 
+// checkS3R2Config applies the Cloudflare R2 defaults and rejects the settings
+// not supported by R2. Path-style addressing is always used with a custom endpoint
+func checkS3R2Config(config *S3FsConfig) error {
+	config.R2AccountID = strings.ToLower(strings.TrimSpace(config.R2AccountID))
+	if config.R2AccountID == "" {
+		return nil
+	}
+	if !s3R2AccountIDRegex.MatchString(config.R2AccountID) {
+		return fmt.Errorf("invalid r2_account_id %#v, it must be the 32 hex characters Cloudflare account ID", config.R2AccountID)
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = fmt.Sprintf(s3R2EndpointFormat, config.R2AccountID)
+	} else if err := checkS3R2Endpoint(config.Endpoint, config.R2AccountID); err != nil {
+		return err
+	}
+	if config.Region == "" {
+		config.Region = validS3R2Regions[0]
+	}
+	if !utils.IsStringInSlice(config.Region, validS3R2Regions) {
+		return fmt.Errorf("invalid region %#v for Cloudflare R2, valid values: %v", config.Region,
+			strings.Join(validS3R2Regions, ", "))
+	}
+	if config.AccessKey == "" {
+		return errors.New("access_key and access_secret are required for Cloudflare R2")
+	}
+	if config.RoleARN != "" {
+		return errors.New("role_arn is not supported for Cloudflare R2")
+	}
+	if config.RequesterPays {
+		return errors.New("requester_pays is not supported for Cloudflare R2")
+	}
+	if config.SSEEncryption != "" && config.SSEEncryption != "none" {
+		return errors.New("sse_encryption is not supported for Cloudflare R2, objects are always encrypted at rest")
+	}
+	if !utils.IsStringInSlice(config.StorageClass, validS3R2StorageClasses) {
+		return fmt.Errorf("invalid storage_class %#v for Cloudflare R2, valid values: %v", config.StorageClass,
+			strings.Join(validS3R2StorageClasses[1:], ", "))
+	}
+	return nil
+}
+
+func checkS3R2Endpoint(endpoint, accountID string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %#v for Cloudflare R2: %v", endpoint, err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("invalid endpoint %#v for Cloudflare R2, https is required", endpoint)
+	}
+	if !strings.HasPrefix(u.Host, accountID+".") || !strings.HasSuffix(u.Host, s3R2EndpointSuffix) {
+		return fmt.Errorf("invalid endpoint %#v for Cloudflare R2, it does not match the account ID, expected %#v",
+			endpoint, fmt.Sprintf(s3R2EndpointFormat, accountID))
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return fmt.Errorf("invalid endpoint %#v for Cloudflare R2, the bucket must not be included in the endpoint", endpoint)
+	}
+	return nil
+}
+
+func checkS3RoleConfig(config *S3FsConfig) error {
+	config.RoleARN = strings.TrimSpace(config.RoleARN)
+	if config.RoleARN == "" {
+		if config.ExternalID != "" || config.RoleSessionName != "" {
+			return errors.New("external_id and role_session_name require role_arn")
+		}
+		return nil
+	}
+	if !strings.HasPrefix(config.RoleARN, "arn:") || !strings.Contains(config.RoleARN, ":role/") {
+		return fmt.Errorf("invalid role_arn %#v", config.RoleARN)
+	}
+	if config.ExternalID != "" && (len(config.ExternalID) < 2 || len(config.ExternalID) > 1224) {
+		return errors.New("external_id must be between 2 and 1224 characters")
+	}
+	if config.RoleSessionName != "" && !s3RoleSessionNameRegex.MatchString(config.RoleSessionName) {
+		return fmt.Errorf("invalid role_session_name %#v", config.RoleSessionName)
+	}
+	return nil
+}
+
+func checkS3SSEConfig(config *S3FsConfig) error {
+	if config.SSEEncryption == "none" {
+		config.SSEEncryption = ""
+	}
+	if !utils.IsStringInSlice(config.SSEEncryption, validS3SSEEncryptions) {
+		return fmt.Errorf("invalid sse_encryption %#v, valid values: \"none, %v\"", config.SSEEncryption,
+			strings.Join(validS3SSEEncryptions[1:], ", "))
+	}
+	config.SSEKMSKeyID = strings.TrimSpace(config.SSEKMSKeyID)
+	if config.SSEEncryption == S3SSEKMS && config.SSEKMSKeyID == "" {
+		return errors.New("sse_kms_key_id is required for aws:kms encryption")
+	}
+	if config.SSEEncryption != S3SSEKMS && config.SSEKMSKeyID != "" {
+		return errors.New("sse_kms_key_id can be used for aws:kms encryption only")
+	}
+	return checkS3SSECustomerKey(config)
+}
+
+func checkS3SSECustomerKey(config *S3FsConfig) error {
+	if config.SSECustomerKey.IsEmpty() {
+		return nil
+	}
+	if config.SSECustomerKey.IsEncrypted() && !config.SSECustomerKey.IsValid() {
+		return errors.New("invalid encrypted sse_customer_key")
+	}
+	if !config.SSECustomerKey.IsValidInput() {
+		return errors.New("invalid sse_customer_key")
+	}
+	if config.SSEEncryption != "" {
+		return errors.New("sse_customer_key cannot be used together with sse_encryption")
+	}
+	if config.SSECustomerKey.IsPlain() {
+		if _, err := decodeS3SSECustomerKey(config.SSECustomerKey.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeS3SSECustomerKey decodes the given base64 encoded SSE-C key and checks its length
+func decodeS3SSECustomerKey(encodedKey string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid sse_customer_key, it must be base64 encoded: %v", err)
+	}
+	if len(key) != 32 {
+		return "", fmt.Errorf("invalid sse_customer_key, the decoded key must be 32 bytes long, got %v", len(key))
+	}
+	return string(key), nil
+}
+
 // ValidateGCSFsConfig returns nil if the specified GCS config is valid, otherwise an error
 func ValidateGCSFsConfig(config *GCSFsConfig, credentialsFilePath string) error {
 	if config.Bucket == "" {
@@ -298,6 +636,11 @@ func ValidateGCSFsConfig(config *GCSFsConfig, credentialsFilePath string) error
 	if config.Credentials.IsEncrypted() && !config.Credentials.IsValid() {
 		return errors.New("invalid encrypted credentials")
 	}
+	config.KMSKeyName = strings.TrimSpace(config.KMSKeyName)
+	if config.KMSKeyName != "" && !gcsKMSKeyNameRegex.MatchString(config.KMSKeyName) {
+		return fmt.Errorf("invalid kms_key_name %#v, the expected format is \"projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>\"",
+			config.KMSKeyName)
+	}
 	if !config.Credentials.IsValidInput() && config.AutomaticCredentials == 0 {
 		fi, err := os.Stat(credentialsFilePath)
 		if err != nil {
@@ -312,6 +655,9 @@ func ValidateGCSFsConfig(config *GCSFsConfig, credentialsFilePath string) error
 
 // ValidateAzBlobFsConfig returns nil if the specified Azure Blob config is valid, otherwise an error
 func ValidateAzBlobFsConfig(config *AzBlobFsConfig) error {
+	if err := checkAzBlobAuthMethod(config); err != nil {
+		return err
+	}
 	if config.SASURL != "" {
 		_, err := url.Parse(config.SASURL)
 		return err
@@ -319,11 +665,20 @@ func ValidateAzBlobFsConfig(config *AzBlobFsConfig) error {
 	if config.Container == "" {
 		return errors.New("container cannot be empty")
 	}
-	if config.AccountName == "" || !config.AccountKey.IsValidInput() {
-		return errors.New("credentials cannot be empty or invalid")
-	}
-	if config.AccountKey.IsEncrypted() && !config.AccountKey.IsValid() {
-		return errors.New("invalid encrypted account_key")
+	if config.UseManagedIdentity {
+		if config.AccountName == "" {
+			return errors.New("account_name is required to use a managed identity")
+		}
+		if config.UseEmulator {
+			return errors.New("managed identity cannot be used with the emulator")
+		}
+	} else {
+		if config.AccountName == "" || !config.AccountKey.IsValidInput() {
+			return errors.New("credentials cannot be empty or invalid")
+		}
+		if config.AccountKey.IsEncrypted() && !config.AccountKey.IsValid() {
+			return errors.New("invalid encrypted account_key")
+		}
 	}
 	if config.KeyPrefix != "" {
 		if strings.HasPrefix(config.KeyPrefix, "/") {
@@ -346,6 +701,116 @@ func ValidateAzBlobFsConfig(config *AzBlobFsConfig) error {
 	return nil
 }
 
+// checkAzBlobAuthMethod returns an error if not exactly one of account key,
+// SAS URL and managed identity is configured
+func checkAzBlobAuthMethod(config *AzBlobFsConfig) error {
+	authMethods := 0
+	if !config.AccountKey.IsEmpty() {
+		authMethods++
+	}
+	if config.SASURL != "" {
+		authMethods++
+	}
+	if config.UseManagedIdentity {
+		authMethods++
+	}
+	if authMethods == 0 {
+		return errors.New("credentials cannot be empty or invalid")
+	}
+	if authMethods > 1 {
+		return errors.New("only one of account_key, sas_url and use_managed_identity can be set")
+	}
+	if config.ManagedIdentityClientID != "" && !config.UseManagedIdentity {
+		return errors.New("managed_identity_client_id requires use_managed_identity")
+	}
+	return nil
+}
+
+// ValidateB2FsConfig returns nil if the specified B2 config is valid, otherwise an error
+func ValidateB2FsConfig(config *B2FsConfig) error {
+	if config.Bucket == "" {
+		return errors.New("bucket cannot be empty")
+	}
+	if config.AccountID == "" || config.ApplicationKey.IsEmpty() || !config.ApplicationKey.IsValidInput() {
+		return errors.New("credentials cannot be empty or invalid")
+	}
+	if config.ApplicationKey.IsEncrypted() && !config.ApplicationKey.IsValid() {
+		return errors.New("invalid encrypted application_key")
+	}
+	if config.KeyPrefix != "" {
+		if strings.HasPrefix(config.KeyPrefix, "/") {
+			return errors.New("key_prefix cannot start with /")
+		}
+		config.KeyPrefix = path.Clean(config.KeyPrefix)
+		if !strings.HasSuffix(config.KeyPrefix, "/") {
+			config.KeyPrefix += "/"
+		}
+	}
+	if config.UploadChunkSize != 0 && (config.UploadChunkSize < 5 || config.UploadChunkSize > 5000) {
+		return errors.New("upload_chunk_size cannot be != 0, lower than 5 (MB) or greater than 5000 (MB)")
+	}
+	if config.Endpoint != "" {
+		u, err := url.Parse(config.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid endpoint %#v", config.Endpoint)
+		}
+	}
+	return nil
+}
+
+// ValidateSFTPFsConfig returns nil if the specified SFTP config is valid, otherwise an error
+func ValidateSFTPFsConfig(config *SFTPFsConfig) error {
+	if config.Endpoint == "" {
+		return errors.New("endpoint cannot be empty")
+	}
+	if !strings.Contains(config.Endpoint, ":") {
+		config.Endpoint += ":22"
+	}
+	if _, _, err := net.SplitHostPort(config.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint %#v: %v", config.Endpoint, err)
+	}
+	if config.Username == "" {
+		return errors.New("username cannot be empty")
+	}
+	if config.Password.IsEmpty() && config.PrivateKey.IsEmpty() {
+		return errors.New("credentials cannot be empty")
+	}
+	if !config.Password.IsEmpty() && !config.Password.IsValidInput() {
+		return errors.New("invalid password")
+	}
+	if config.Password.IsEncrypted() && !config.Password.IsValid() {
+		return errors.New("invalid encrypted password")
+	}
+	if !config.PrivateKey.IsEmpty() && !config.PrivateKey.IsValidInput() {
+		return errors.New("invalid private key")
+	}
+	if config.PrivateKey.IsEncrypted() && !config.PrivateKey.IsValid() {
+		return errors.New("invalid encrypted private key")
+	}
+	var fingerprints []string
+	for _, fp := range config.Fingerprints {
+		fp = strings.TrimSpace(fp)
+		if fp == "" {
+			continue
+		}
+		if !strings.HasPrefix(fp, "SHA256:") {
+			return fmt.Errorf("invalid fingerprint %#v, only SHA256 fingerprints are supported", fp)
+		}
+		if !utils.IsStringInSlice(fp, fingerprints) {
+			fingerprints = append(fingerprints, fp)
+		}
+	}
+	config.Fingerprints = fingerprints
+	if config.Prefix == "" {
+		config.Prefix = "/"
+	}
+	if !path.IsAbs(config.Prefix) {
+		return fmt.Errorf("invalid prefix %#v, it must be an absolute path", config.Prefix)
+	}
+	config.Prefix = path.Clean(config.Prefix)
+	return nil
+}
+
 // SetPathPermissions calls fs.Chown.
 // It does nothing for local filesystem on windows
 func SetPathPermissions(fs Fs, path string, uid int, gid int) {
@@ -2,11 +2,15 @@ package webdavd
 
 import (
 	"context"
+	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"mime"
+	"net/http"
 	"os"
 	"path"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -29,6 +33,9 @@ type webDavFile struct {
 	startOffset int64
 	isFinished  bool
 	readTryed   int32
+	remoteAddr  string
+	// set for the files opened for reading, used to report the quota properties
+	connection *Connection
 }
 
 func newWebDavFile(baseTransfer *common.BaseTransfer, pipeWriter *vfs.PipeWriter, pipeReader *pipeat.PipeReaderAt) *webDavFile {
@@ -79,6 +86,40 @@ func (fi *webDavFileInfo) ContentType(ctx context.Context) (string, error) {
 	return "", webdav.ErrNotImplemented
 }
 
+// ETag implements webdav.ETager interface.
+// The entity tag reported by the Cloud Storage backend is used if available, so conditional
+// requests are evaluated against the same value the backend uses for the object
+func (fi *webDavFileInfo) ETag(ctx context.Context) (string, error) {
+	if info, ok := fi.FileInfo.(interface{ ETag() string }); ok {
+		if etag := strings.Trim(info.ETag(), `"`); etag != "" {
+			return fmt.Sprintf(`"%v"`, etag), nil
+		}
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+// DeadProps implements webdav.DeadPropsHolder interface.
+// The RFC 4331 quota properties are not supported as live properties by the
+// webdav package, so they are reported here
+func (f *webDavFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	if f.connection == nil {
+		return nil, nil
+	}
+	return f.connection.getQuotaProperties(f.GetVirtualPath()), nil
+}
+
+// Patch implements webdav.DeadPropsHolder interface.
+// Dead properties cannot be stored, so all the patches are forbidden
+func (f *webDavFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
 // Readdir reads directory entries from the handle
 func (f *webDavFile) Readdir(count int) ([]os.FileInfo, error) {
 	if !f.Connection.User.HasPerm(dataprovider.PermListItems, f.GetVirtualPath()) {
@@ -136,7 +177,7 @@ func (f *webDavFile) Read(p []byte) (n int, err error) {
 		return 0, errTransferAborted
 	}
 	if atomic.LoadInt32(&f.readTryed) == 0 {
-		if !f.Connection.User.HasPerm(dataprovider.PermDownload, path.Dir(f.GetVirtualPath())) {
+		if !f.Connection.User.HasFilePerm(dataprovider.PermDownload, f.GetVirtualPath()) {
 			return 0, f.Connection.GetPermissionDeniedError()
 		}
 
@@ -144,6 +185,20 @@ func (f *webDavFile) Read(p []byte) (n int, err error) {
 			f.Connection.Log(logger.LevelWarn, "reading file %#v is not allowed", f.GetVirtualPath())
 			return 0, f.Connection.GetPermissionDeniedError()
 		}
+		if err := f.Connection.CheckDownloadVolumeLimit(); err != nil {
+			return 0, err
+		}
+		if err := f.Connection.CheckDownloadFileSize(f.GetFsPath(), f.GetVirtualPath(), nil); err != nil {
+			return 0, f.Connection.GetGenericError(err)
+		}
+		// the transfer is created when the file is opened, also to get its metadata,
+		// so the limit is checked on the first read
+		if err := f.CheckConcurrentTransfersLimit(); err != nil {
+			return 0, f.Connection.GetGenericError(err)
+		}
+		if err := f.Connection.CheckPreDownloadHook(f.GetFsPath(), f.GetVirtualPath(), f.remoteAddr, f.info); err != nil {
+			return 0, f.Connection.GetGenericError(err)
+		}
 		atomic.StoreInt32(&f.readTryed, 1)
 	}
 
@@ -170,7 +225,12 @@ func (f *webDavFile) Read(p []byte) (n int, err error) {
 		}
 	}
 
-	n, err = f.reader.Read(p)
+	size, err := f.ReserveDownloadVolume(len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err = f.reader.Read(p[:size])
+	f.ReleaseDownloadVolume(size - n)
 	atomic.AddInt64(&f.BytesSent, int64(n))
 
 	if err != nil && err != io.EOF {
@@ -190,6 +250,7 @@ func (f *webDavFile) Write(p []byte) (n int, err error) {
 	f.Connection.UpdateLastActivity()
 
 	n, err = f.writer.Write(p)
+	f.UpdateChecksum(p[:n], f.MinWriteOffset+atomic.LoadInt64(&f.BytesReceived))
 	atomic.AddInt64(&f.BytesReceived, int64(n))
 
 	if f.MaxWriteSize > 0 && err == nil && atomic.LoadInt64(&f.BytesReceived) > f.MaxWriteSize {
@@ -260,7 +321,7 @@ func (f *webDavFile) Seek(offset int64, whence int) (int64, error) {
 				f.TransferError(err)
 				return 0, err
 			}
-			startByte = f.info.Size() - offset
+			startByte = f.info.Size() + offset
 		}
 
 		_, r, cancelFn, err := f.Fs.Open(f.GetFsPath(), startByte)
@@ -2,10 +2,17 @@ package webdavd
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/eikenb/pipeat"
 	"golang.org/x/net/webdav"
@@ -17,10 +24,24 @@ import (
 	"github.com/drakkan/sftpgo/vfs"
 )
 
+// webDavUnlimitedQuotaBytes is the available space reported for users without
+// quota restrictions, clients do not support "unlimited" values
+const webDavUnlimitedQuotaBytes = int64(1) << 50 // 1 PiB
+
+var (
+	quotaAvailableBytesName = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedBytesName      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
 // Connection details for a WebDav connection.
 type Connection struct {
 	*common.BaseConnection
 	request *http.Request
+	quotaMu sync.Mutex
+	// RFC 4331 quota properties, computed once for each quota domain.
+	// The map key is the mapped path for virtual folders with their own quota,
+	// empty for the user quota
+	quotaProps map[string]map[xml.Name]webdav.Property
 }
 
 // GetClientVersion returns the connected client's version.
@@ -107,7 +128,38 @@ func (c *Connection) Stat(ctx context.Context, name string) (os.FileInfo, error)
 		c.Log(logger.LevelDebug, "error running stat on path %#v: %+v", p, err)
 		return nil, c.GetFsError(err)
 	}
-	return fi, err
+	return &webDavFileInfo{
+		FileInfo:    fi,
+		Fs:          c.Fs,
+		virtualPath: name,
+		fsPath:      p,
+	}, nil
+}
+
+// isPropfindAllowed returns false if a depth infinity PROPFIND for the given
+// directory exceeds the recursion limits defined for the user
+func (c *Connection) isPropfindAllowed(ctx context.Context, name, depth string) bool {
+	if !c.User.HasRecursionLimits() {
+		return true
+	}
+	// RFC4918, section 9.1: a missing Depth header must be treated as infinity
+	if depth != "" && !strings.EqualFold(depth, "infinity") {
+		return true
+	}
+	fi, err := c.Stat(ctx, name)
+	if err != nil || !fi.IsDir() {
+		// the error, if any, will be returned by the webdav handler
+		return true
+	}
+	p, err := c.Fs.ResolvePath(utils.CleanPath(name))
+	if err != nil {
+		return true
+	}
+	if err = c.CheckRecursionLimits(p); err == common.ErrRecursionLimit {
+		c.Log(logger.LevelInfo, "depth infinity PROPFIND for %#v denied: %v", name, err)
+		return false
+	}
+	return true
 }
 
 // RemoveAll removes path and any children it contains.
@@ -169,14 +221,84 @@ func (c *Connection) getFile(fsPath, virtualPath string) (webdav.File, error) {
 	baseTransfer := common.NewBaseTransfer(file, c.BaseConnection, cancelFn, fsPath, virtualPath, common.TransferDownload,
 		0, 0, 0, false, c.Fs)
 
-	return newWebDavFile(baseTransfer, nil, r), nil
+	davFile := newWebDavFile(baseTransfer, nil, r)
+	davFile.remoteAddr = c.GetRemoteAddress()
+	davFile.connection = c
+	return davFile, nil
+}
+
+// getQuotaProperties returns the RFC 4331 quota properties for the specified virtual path.
+// The used bytes are read from the quota tracking, the available bytes are computed
+// from the quota limit. Nil is returned if the used quota cannot be read
+func (c *Connection) getQuotaProperties(virtualPath string) map[xml.Name]webdav.Property {
+	quotaKey := ""
+	quotaSize := c.User.QuotaSize
+	vfolder, err := c.User.GetVirtualFolderForPath(virtualPath)
+	if err == nil && !vfolder.IsIncludedInUserQuota() {
+		quotaKey = vfolder.MappedPath
+		quotaSize = vfolder.QuotaSize
+	}
+
+	c.quotaMu.Lock()
+	defer c.quotaMu.Unlock()
+
+	if props, ok := c.quotaProps[quotaKey]; ok {
+		return props
+	}
+	var usedSize int64
+	if quotaKey != "" {
+		_, usedSize, err = dataprovider.GetUsedVirtualFolderQuota(quotaKey)
+	} else {
+		_, usedSize, err = dataprovider.GetUsedQuota(c.User.Username)
+	}
+	if err != nil {
+		c.Log(logger.LevelWarn, "unable to get the used quota for path %#v: %v", virtualPath, err)
+		return nil
+	}
+	availableSize := webDavUnlimitedQuotaBytes
+	if quotaSize > 0 {
+		availableSize = quotaSize - usedSize
+		if availableSize < 0 {
+			availableSize = 0
+		}
+	}
+	props := map[xml.Name]webdav.Property{
+		quotaAvailableBytesName: {
+			XMLName:  quotaAvailableBytesName,
+			InnerXML: []byte(strconv.FormatInt(availableSize, 10)),
+		},
+		quotaUsedBytesName: {
+			XMLName:  quotaUsedBytesName,
+			InnerXML: []byte(strconv.FormatInt(usedSize, 10)),
+		},
+	}
+	if c.quotaProps == nil {
+		c.quotaProps = make(map[string]map[xml.Name]webdav.Property)
+	}
+	c.quotaProps[quotaKey] = props
+	return props
 }
 
 func (c *Connection) putFile(fsPath, virtualPath string) (webdav.File, error) {
-	if !c.User.IsFileAllowed(virtualPath) {
+	if !c.User.IsFileAllowed(virtualPath) || !c.User.IsUploadNameAllowed(virtualPath) {
 		c.Log(logger.LevelWarn, "writing file %#v is not allowed", virtualPath)
 		return nil, c.GetPermissionDeniedError()
 	}
+	if err := c.IsUploadOrderAllowed(virtualPath); err != nil {
+		return nil, err
+	}
+	if err := c.IsPathSchemaAllowed(virtualPath, false); err != nil {
+		return nil, err
+	}
+	if err := c.CheckDirectoryFilesLimit(virtualPath); err != nil {
+		return nil, err
+	}
+	if err := c.CheckDiskSpace(fsPath, 0); err != nil {
+		return nil, err
+	}
+	if err := c.CheckConcurrentTransfersLimit(common.TransferUpload); err != nil {
+		return nil, c.GetGenericError(err)
+	}
 
 	filePath := fsPath
 	if common.Config.IsAtomicUploadEnabled() && c.Fs.IsAtomicUploadSupported() {
@@ -185,9 +307,12 @@ func (c *Connection) putFile(fsPath, virtualPath string) (webdav.File, error) {
 
 	stat, statErr := c.Fs.Lstat(fsPath)
 	if (statErr == nil && stat.Mode()&os.ModeSymlink != 0) || c.Fs.IsNotExist(statErr) {
-		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(virtualPath)) {
+		if !c.User.HasFilePerm(dataprovider.PermUpload, virtualPath) {
 			return nil, c.GetPermissionDeniedError()
 		}
+		if err := c.CheckUploadDir(virtualPath); err != nil {
+			return nil, err
+		}
 		return c.handleUploadToNewFile(fsPath, filePath, virtualPath)
 	}
 
@@ -202,11 +327,15 @@ func (c *Connection) putFile(fsPath, virtualPath string) (webdav.File, error) {
 		return nil, c.GetOpUnsupportedError()
 	}
 
-	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(virtualPath)) {
+	if !c.User.HasFilePerm(dataprovider.PermOverwrite, virtualPath) {
 		return nil, c.GetPermissionDeniedError()
 	}
+	// WebDAV PUT always overwrites existing files
+	if err := c.IsWriteModeAllowed(virtualPath, false); err != nil {
+		return nil, err
+	}
 
-	return c.handleUploadToExistingFile(fsPath, filePath, stat.Size(), virtualPath)
+	return c.handleUploadToExistingFile(fsPath, filePath, vfs.GetSizeForQuota(stat), virtualPath)
 }
 
 func (c *Connection) handleUploadToNewFile(resolvedPath, filePath, requestPath string) (webdav.File, error) {
@@ -228,6 +357,7 @@ func (c *Connection) handleUploadToNewFile(resolvedPath, filePath, requestPath s
 
 	baseTransfer := common.NewBaseTransfer(file, c.BaseConnection, cancelFn, resolvedPath, requestPath,
 		common.TransferUpload, 0, 0, maxWriteSize, true, c.Fs)
+	c.setExpectedChecksum(baseTransfer)
 
 	return newWebDavFile(baseTransfer, w, nil), nil
 }
@@ -278,6 +408,7 @@ func (c *Connection) handleUploadToExistingFile(resolvedPath, filePath string, f
 
 	baseTransfer := common.NewBaseTransfer(file, c.BaseConnection, cancelFn, resolvedPath, requestPath,
 		common.TransferUpload, 0, initialSize, maxWriteSize, false, c.Fs)
+	c.setExpectedChecksum(baseTransfer)
 
 	return newWebDavFile(baseTransfer, w, nil), nil
 }
@@ -292,7 +423,7 @@ func (c *Connection) removeDirTree(fsPath, virtualPath string) error {
 	var dirsToRemove []objectMapping
 	var filesToRemove []objectMapping
 
-	err := c.Fs.Walk(fsPath, func(walkedPath string, info os.FileInfo, err error) error {
+	err := c.Walk(fsPath, func(walkedPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -389,3 +520,41 @@ func (c *Connection) orderDirsToRemove(dirsToRemove []objectMapping) []objectMap
 
 	return orderedDirs
 }
+
+// setExpectedChecksum sets the expected checksum for the upload, if the client sent one
+func (c *Connection) setExpectedChecksum(transfer *common.BaseTransfer) {
+	if c.request == nil {
+		return
+	}
+	checksum, err := getExpectedChecksum(c.request)
+	if err == nil && checksum != "" {
+		err = transfer.SetExpectedChecksum(checksum)
+	}
+	if err != nil {
+		// invalid checksums are rejected before starting the upload
+		c.Log(logger.LevelWarn, "unable to set the expected checksum: %v", err)
+	}
+}
+
+// getExpectedChecksum returns the expected SHA-256 checksum, as hex string, sent
+// by the client using the "OC-Checksum" or the RFC 3230 "Digest" header, if any
+func getExpectedChecksum(r *http.Request) (string, error) {
+	// OC-Checksum: SHA256:<hex>, more checksums can be separated by spaces
+	for _, value := range strings.Fields(r.Header.Get("OC-Checksum")) {
+		if idx := strings.Index(value, ":"); idx > 0 && strings.EqualFold(value[:idx], "SHA256") {
+			return common.ParseSHA256Checksum(value[idx+1:])
+		}
+	}
+	// Digest: SHA-256=<base64>, more digests can be separated by commas
+	for _, value := range strings.Split(r.Header.Get("Digest"), ",") {
+		value = strings.TrimSpace(value)
+		if idx := strings.Index(value, "="); idx > 0 && strings.EqualFold(value[:idx], "SHA-256") {
+			decoded, err := base64.StdEncoding.DecodeString(value[idx+1:])
+			if err != nil || len(decoded) != sha256.Size {
+				return "", fmt.Errorf("invalid SHA-256 digest %#v", value)
+			}
+			return hex.EncodeToString(decoded), nil
+		}
+	}
+	return "", nil
+}
@@ -13,6 +13,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -634,7 +635,7 @@ func TestTransferSeek(t *testing.T) {
 
 	davFile = newWebDavFile(baseTransfer, nil, nil)
 	davFile.Fs = newMockOsFs(nil, true, fs.ConnectionID(), user.GetHomeDir(), nil)
-	res, err = davFile.Seek(2, io.SeekEnd)
+	res, err = davFile.Seek(-2, io.SeekEnd)
 	assert.NoError(t, err)
 	assert.Equal(t, int64(5), res)
 
@@ -643,7 +644,7 @@ func TestTransferSeek(t *testing.T) {
 
 	davFile = newWebDavFile(baseTransfer, nil, nil)
 	davFile.Fs = newMockOsFs(nil, true, fs.ConnectionID(), user.GetHomeDir(), nil)
-	res, err = davFile.Seek(2, io.SeekEnd)
+	res, err = davFile.Seek(-2, io.SeekEnd)
 	assert.True(t, os.IsNotExist(err))
 	assert.Equal(t, int64(0), res)
 
@@ -653,6 +654,99 @@ func TestTransferSeek(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+type etagFileInfo struct {
+	os.FileInfo
+	etag string
+}
+
+func (fi etagFileInfo) ETag() string {
+	return fi.etag
+}
+
+func TestETag(t *testing.T) {
+	modTime := time.Now()
+	info := vfs.NewFileInfo(testFile, false, 10, modTime, false)
+	fi := &webDavFileInfo{
+		FileInfo: etagFileInfo{FileInfo: info, etag: `"backend-etag"`},
+	}
+	etag, err := fi.ETag(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, `"backend-etag"`, etag)
+	assert.Equal(t, `"backend-etag"`, getETag(context.Background(), fi))
+	// no entity tag from the backend, the webdav handler will use its own
+	fi.FileInfo = etagFileInfo{FileInfo: info}
+	_, err = fi.ETag(context.Background())
+	assert.EqualError(t, err, webdav.ErrNotImplemented.Error())
+	fi.FileInfo = info
+	_, err = fi.ETag(context.Background())
+	assert.EqualError(t, err, webdav.ErrNotImplemented.Error())
+	assert.Equal(t, fmt.Sprintf(`"%x%x"`, modTime.UnixNano(), int64(10)), getETag(context.Background(), fi))
+}
+
+func TestZeroLengthRanges(t *testing.T) {
+	modTime := time.Now()
+	info := &webDavFileInfo{
+		FileInfo: etagFileInfo{FileInfo: vfs.NewFileInfo(testFile, false, 10, modTime, false), etag: "backend-etag"},
+	}
+	emptyInfo := &webDavFileInfo{
+		FileInfo: vfs.NewFileInfo(testFile, false, 0, modTime, false),
+	}
+	s := &webDavServer{
+		config: &Configuration{},
+	}
+	for _, reject := range []bool{false, true} {
+		s.config.RejectZeroLengthRanges = reject
+
+		req, err := http.NewRequest(http.MethodGet, "/"+testFile, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Range", "bytes=100-")
+		rr := httptest.NewRecorder()
+		assert.True(t, s.handleZeroLengthRange(rr, req, info))
+		assert.Equal(t, "bytes=100-", req.Header.Get("Range"))
+
+		req.Header.Set("Range", "bytes=-0, 2-3")
+		assert.True(t, s.handleZeroLengthRange(rr, req, info))
+		assert.Equal(t, "bytes=2-3", req.Header.Get("Range"))
+
+		for _, fi := range []os.FileInfo{info, emptyInfo} {
+			for _, rangeHeader := range []string{"bytes=-0", "bytes=-00,-0"} {
+				req.Header.Set("Range", rangeHeader)
+				rr = httptest.NewRecorder()
+				if reject {
+					assert.False(t, s.handleZeroLengthRange(rr, req, fi))
+					assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rr.Code)
+					assert.Equal(t, fmt.Sprintf("bytes */%v", fi.Size()), rr.Header().Get("Content-Range"))
+				} else {
+					assert.True(t, s.handleZeroLengthRange(rr, req, fi))
+					assert.Empty(t, req.Header.Get("Range"))
+				}
+			}
+		}
+		req.Header.Set("Range", "bytes=0-")
+		rr = httptest.NewRecorder()
+		assert.Equal(t, !reject, s.handleZeroLengthRange(rr, req, emptyInfo))
+		// the If-Range condition does not match, the Range header must be ignored
+		req.Header.Set("Range", "bytes=-0")
+		req.Header.Set("If-Range", `"mismatch"`)
+		rr = httptest.NewRecorder()
+		assert.True(t, s.handleZeroLengthRange(rr, req, info))
+		assert.Empty(t, req.Header.Get("Range"))
+		req.Header.Set("Range", "bytes=-0")
+		req.Header.Set("If-Range", modTime.Add(-time.Hour).UTC().Format(http.TimeFormat))
+		rr = httptest.NewRecorder()
+		assert.True(t, s.handleZeroLengthRange(rr, req, info))
+		assert.Empty(t, req.Header.Get("Range"))
+		// matching If-Range conditions, using the backend ETag and the modification time
+		for _, ifRange := range []string{`"backend-etag"`, modTime.UTC().Format(http.TimeFormat)} {
+			req.Header.Set("Range", "bytes=-0")
+			req.Header.Set("If-Range", ifRange)
+			rr = httptest.NewRecorder()
+			assert.Equal(t, !reject, s.handleZeroLengthRange(rr, req, info))
+		}
+		req.Header.Del("If-Range")
+	}
+}
+
 func TestBasicUsersCache(t *testing.T) {
 	username := "webdav_internal_test"
 	password := "pwd"
@@ -942,3 +1036,84 @@ func TestMimeCache(t *testing.T) {
 	mtype = cache.getMimeFromCache(".jpg")
 	assert.Equal(t, "", mtype)
 }
+
+func TestLockManager(t *testing.T) {
+	manager := newLockManager(LocksConfig{
+		DefaultTimeout: 7200,
+		MaxTimeout:     60,
+	})
+	assert.Equal(t, 60*time.Second, manager.defaultTimeout)
+	assert.Equal(t, 60*time.Second, manager.maxTimeout)
+	manager = newLockManager(LocksConfig{})
+	assert.Equal(t, defaultLockTimeout*time.Second, manager.defaultTimeout)
+	assert.Equal(t, defaultMaxLockTimeout*time.Second, manager.maxTimeout)
+	assert.Equal(t, manager.defaultTimeout, manager.getLockDuration(-1))
+	assert.Equal(t, manager.maxTimeout, manager.getLockDuration(24*time.Hour))
+	assert.Equal(t, 10*time.Second, manager.getLockDuration(10*time.Second))
+
+	req, err := http.NewRequest("LOCK", "/user/file", nil)
+	assert.NoError(t, err)
+	manager.normalizeTimeoutHeader(req)
+	assert.Equal(t, "Second-600", req.Header.Get("Timeout"))
+	req.Header.Set("Timeout", "Infinite, Second-4100000000")
+	manager.normalizeTimeoutHeader(req)
+	assert.Equal(t, "Second-600", req.Header.Get("Timeout"))
+	req.Header.Set("Timeout", "Second-99999999999999999999")
+	manager.normalizeTimeoutHeader(req)
+	assert.Equal(t, "Second-3600", req.Header.Get("Timeout"))
+	req.Header.Set("Timeout", "Second-30")
+	manager.normalizeTimeoutHeader(req)
+	assert.Equal(t, "Second-30", req.Header.Get("Timeout"))
+	req.Header.Set("Timeout", "invalid")
+	manager.normalizeTimeoutHeader(req)
+	assert.Equal(t, "invalid", req.Header.Get("Timeout"))
+
+	ls := manager.getLockSystem("user1")
+	assert.Same(t, ls, manager.getLockSystem("user1"))
+	otherLs := manager.getLockSystem("user2")
+	assert.NotSame(t, ls, otherLs)
+
+	now := time.Now()
+	token, err := ls.Create(now, webdav.LockDetails{
+		Root:      "/file",
+		Duration:  -1,
+		ZeroDepth: true,
+	})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, lockTokenPrefix))
+	_, err = ls.Create(now, webdav.LockDetails{
+		Root:     "/file",
+		Duration: time.Minute,
+	})
+	assert.EqualError(t, err, webdav.ErrLocked.Error())
+	release, err := ls.Confirm(now, "/file", "", webdav.Condition{Token: token})
+	if assert.NoError(t, err) {
+		release()
+	}
+	_, err = ls.Confirm(now, "/file", "", webdav.Condition{Token: "1"})
+	assert.EqualError(t, err, webdav.ErrConfirmationFailed.Error())
+	// the same path for another user is not locked
+	otherToken, err := otherLs.Create(now, webdav.LockDetails{
+		Root:     "/file",
+		Duration: time.Minute,
+	})
+	assert.NoError(t, err)
+	assert.NotEqual(t, token, otherToken)
+	details, err := ls.Refresh(now, token, 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, manager.maxTimeout, details.Duration)
+	_, err = ls.Refresh(now, "1", time.Minute)
+	assert.EqualError(t, err, webdav.ErrNoSuchLock.Error())
+	// the lock expires after the max timeout
+	expired := now.Add(manager.maxTimeout + time.Second)
+	_, err = ls.Confirm(expired, "/file", "", webdav.Condition{Token: token})
+	assert.EqualError(t, err, webdav.ErrConfirmationFailed.Error())
+	_, err = ls.Create(expired, webdav.LockDetails{
+		Root:     "/file",
+		Duration: time.Minute,
+	})
+	assert.NoError(t, err)
+	userLs := ls.(*userLockSystem)
+	assert.Len(t, userLs.tokens, 1)
+	assert.EqualError(t, ls.Unlock(expired, token), webdav.ErrNoSuchLock.Error())
+}
@@ -0,0 +1,233 @@
+package webdavd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	lockTokenPrefix       = "opaquelocktoken:"
+	defaultLockTimeout    = 600
+	defaultMaxLockTimeout = 3600
+)
+
+// LocksConfig defines the timeouts for the WebDAV locks
+type LocksConfig struct {
+	// Timeout, as seconds, for the locks requested without a timeout or with an infinite one.
+	// 0 means the default, 600 seconds
+	DefaultTimeout int `json:"default_timeout" mapstructure:"default_timeout"`
+	// Maximum timeout, as seconds, for a lock. Longer timeouts requested by the clients are
+	// reduced to this value. 0 means the default, 3600 seconds
+	MaxTimeout int `json:"max_timeout" mapstructure:"max_timeout"`
+}
+
+func (c *LocksConfig) getTimeouts() (time.Duration, time.Duration) {
+	defaultTimeout := c.DefaultTimeout
+	if defaultTimeout <= 0 {
+		defaultTimeout = defaultLockTimeout
+	}
+	maxTimeout := c.MaxTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = defaultMaxLockTimeout
+	}
+	if defaultTimeout > maxTimeout {
+		defaultTimeout = maxTimeout
+	}
+	return time.Duration(defaultTimeout) * time.Second, time.Duration(maxTimeout) * time.Second
+}
+
+// lockManager keeps the locks for each user in memory, the locks are not tied to the
+// users cache so they are preserved if a cached user expires or the cache is disabled.
+// The locks are lost on restart and they are not shared among multiple SFTPGo instances
+type lockManager struct {
+	sync.Mutex
+	defaultTimeout time.Duration
+	maxTimeout     time.Duration
+	systems        map[string]*userLockSystem
+}
+
+var locks = newLockManager(LocksConfig{})
+
+func newLockManager(config LocksConfig) *lockManager {
+	defaultTimeout, maxTimeout := config.getTimeouts()
+	return &lockManager{
+		defaultTimeout: defaultTimeout,
+		maxTimeout:     maxTimeout,
+		systems:        make(map[string]*userLockSystem),
+	}
+}
+
+// getLockSystem returns the lock system for the specified user, the locks are keyed by
+// the resource path inside the user's namespace
+func (m *lockManager) getLockSystem(username string) webdav.LockSystem {
+	m.Lock()
+	defer m.Unlock()
+
+	ls, ok := m.systems[username]
+	if !ok {
+		ls = &userLockSystem{
+			ls:      webdav.NewMemLS(),
+			manager: m,
+			tokens:  make(map[string]lockToken),
+		}
+		m.systems[username] = ls
+	}
+	return ls
+}
+
+// getLockDuration returns the duration to use for a lock with the requested one
+func (m *lockManager) getLockDuration(duration time.Duration) time.Duration {
+	if duration <= 0 {
+		return m.defaultTimeout
+	}
+	if duration > m.maxTimeout {
+		return m.maxTimeout
+	}
+	return duration
+}
+
+// normalizeTimeoutHeader replaces the Timeout header for a LOCK request with the enforced
+// timeout, this way the lock timeout returned to the client is the effective one.
+// Invalid headers are left unchanged and so they are rejected by the WebDAV handler
+func (m *lockManager) normalizeTimeoutHeader(r *http.Request) {
+	timeout := strings.TrimSpace(r.Header.Get("Timeout"))
+	if i := strings.IndexByte(timeout, ','); i >= 0 {
+		timeout = strings.TrimSpace(timeout[:i])
+	}
+	var duration time.Duration
+	if timeout != "" && timeout != "Infinite" {
+		if !strings.HasPrefix(timeout, "Second-") {
+			return
+		}
+		seconds, err := strconv.ParseUint(timeout[len("Second-"):], 10, 32)
+		if err != nil {
+			if numErr, ok := err.(*strconv.NumError); !ok || numErr.Err != strconv.ErrRange {
+				return
+			}
+			duration = m.maxTimeout
+		} else {
+			duration = time.Duration(seconds) * time.Second
+		}
+	}
+	r.Header.Set("Timeout", fmt.Sprintf("Second-%d", int64(m.getLockDuration(duration)/time.Second)))
+}
+
+type lockToken struct {
+	internal  string
+	expiresAt time.Time
+}
+
+// userLockSystem wraps the in memory lock system to enforce the lock timeouts and to
+// use unique URIs as lock tokens, as required by RFC 4918
+type userLockSystem struct {
+	mu      sync.Mutex
+	ls      webdav.LockSystem
+	manager *lockManager
+	// lock tokens returned to the clients mapped to the in memory lock system ones
+	tokens map[string]lockToken
+}
+
+func (s *userLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	s.mu.Lock()
+	mapped := make([]webdav.Condition, 0, len(conditions))
+	for _, c := range conditions {
+		if c.Token != "" {
+			if token, ok := s.tokens[c.Token]; ok {
+				c.Token = token.internal
+			} else {
+				// unknown or expired token, it must not match any lock
+				c.Token = lockTokenPrefix + "unknown"
+			}
+		}
+		mapped = append(mapped, c)
+	}
+	s.mu.Unlock()
+
+	return s.ls.Confirm(now, name0, name1, mapped...)
+}
+
+func (s *userLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Duration = s.manager.getLockDuration(details.Duration)
+	internal, err := s.ls.Create(now, details)
+	if err != nil {
+		return "", err
+	}
+	token, err := newLockToken()
+	if err != nil {
+		s.ls.Unlock(now, internal) //nolint:errcheck
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeExpiredTokens(now)
+	s.tokens[token] = lockToken{
+		internal:  internal,
+		expiresAt: now.Add(details.Duration),
+	}
+	return token, nil
+}
+
+func (s *userLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	duration = s.manager.getLockDuration(duration)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[token]
+	if !ok {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	details, err := s.ls.Refresh(now, t.internal, duration)
+	if err != nil {
+		if err == webdav.ErrNoSuchLock {
+			delete(s.tokens, token)
+		}
+		return details, err
+	}
+	t.expiresAt = now.Add(duration)
+	s.tokens[token] = t
+	return details, nil
+}
+
+func (s *userLockSystem) Unlock(now time.Time, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[token]
+	if !ok {
+		return webdav.ErrNoSuchLock
+	}
+	err := s.ls.Unlock(now, t.internal)
+	if err == nil || err == webdav.ErrNoSuchLock {
+		delete(s.tokens, token)
+	}
+	return err
+}
+
+func (s *userLockSystem) removeExpiredTokens(now time.Time) {
+	for token, t := range s.tokens {
+		if !now.Before(t.expiresAt) {
+			delete(s.tokens, token)
+		}
+	}
+}
+
+// newLockToken returns a lock token using the "opaquelocktoken" URI scheme
+// and a random UUID, see RFC 4918 Appendix C
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%v%x-%x-%x-%x-%x", lockTokenPrefix, b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
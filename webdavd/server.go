@@ -6,9 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,6 +23,7 @@ import (
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 var (
@@ -30,6 +33,9 @@ var (
 	xRealIP       = http.CanonicalHeaderKey("X-Real-IP")
 )
 
+const propfindFiniteDepthError = `<?xml version="1.0" encoding="utf-8"?>
+<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`
+
 type webDavServer struct {
 	config  *Configuration
 	certMgr *common.CertManager
@@ -122,6 +128,14 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !isCached {
+		if err = vfs.CheckHomeMarker(fs, user.FsConfig.HomeMarker); err != nil {
+			logger.Warn(logSender, connectionID, "cannot login user %#v, home marker check failed: %v", user.Username, err)
+			updateLoginMetrics(user.Username, r.RemoteAddr, err)
+			http.Error(w, common.ErrConnectionDenied.Error(), http.StatusForbidden)
+			return
+		}
+	}
 
 	updateLoginMetrics(user.Username, r.RemoteAddr, err)
 
@@ -141,19 +155,62 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		dataprovider.UpdateLastLogin(user) //nolint:errcheck
 	}
 
+	if r.Method == http.MethodPut && user.Filters.MaxUploadFileSize > 0 && r.ContentLength > user.Filters.MaxUploadFileSize {
+		// the size is known up front, we can reject the upload before reading the body
+		connection.Log(logger.LevelInfo, "denying upload of %v bytes, the max allowed file size is %v bytes",
+			r.ContentLength, user.Filters.MaxUploadFileSize)
+		http.Error(w, common.ErrQuotaExceeded.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		if _, err := getExpectedChecksum(r); err != nil {
+			connection.Log(logger.LevelInfo, "denying upload with invalid checksum: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	prefix := path.Join("/", user.Username)
-	// see RFC4918, section 9.4
-	if r.Method == http.MethodGet {
+	if r.Method == http.MethodGet || (r.Method == http.MethodHead && r.Header.Get("Range") != "") {
 		p := strings.TrimPrefix(path.Clean(r.URL.Path), prefix)
 		info, err := connection.Stat(ctx, p)
 		if err == nil && info.IsDir() {
-			r.Method = "PROPFIND"
-			if r.Header.Get("Depth") == "" {
-				r.Header.Add("Depth", "1")
+			// see RFC4918, section 9.4
+			if r.Method == http.MethodGet {
+				r.Method = "PROPFIND"
+				if r.Header.Get("Depth") == "" {
+					r.Header.Add("Depth", "1")
+				}
 			}
+		} else if err == nil && !s.handleZeroLengthRange(w, r.WithContext(ctx), info) {
+			return
+		}
+	}
+
+	if r.Method == http.MethodPut && r.ContentLength > 0 {
+		// the size is known up front, we can check the available disk space before reading the body
+		fsPath, err := connection.Fs.ResolvePath(strings.TrimPrefix(path.Clean(r.URL.Path), prefix))
+		if err == nil && connection.CheckDiskSpace(fsPath, r.ContentLength) != nil {
+			http.Error(w, common.ErrInsufficientDiskSpace.Error(), http.StatusInsufficientStorage)
+			return
 		}
 	}
 
+	if r.Method == "LOCK" {
+		// the WebDAV handler replies with the requested timeout, we enforce the configured limits here
+		locks.normalizeTimeoutHeader(r)
+	}
+
+	if r.Method == "PROPFIND" && !connection.isPropfindAllowed(ctx, strings.TrimPrefix(path.Clean(r.URL.Path), prefix),
+		r.Header.Get("Depth")) {
+		// see RFC4918, section 9.1
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(propfindFiniteDepthError)) //nolint:errcheck
+		return
+	}
+
 	handler := webdav.Handler{
 		Prefix:     prefix,
 		FileSystem: connection,
@@ -163,6 +220,38 @@ func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler.ServeHTTP(w, r.WithContext(ctx))
 }
 
+// handleZeroLengthRange removes the zero-length suffix ranges, such as "bytes=-0", from the
+// Range header: they cannot select any byte but net/http serves them as partial content with
+// an invalid Content-Range. If the remaining ranges cannot select any byte, because there are
+// none or because the file is empty, the Range header is ignored and the whole file is sent or,
+// if configured, a 416 status code is returned.
+// It returns false if the response was already sent
+func (s *webDavServer) handleZeroLengthRange(w http.ResponseWriter, r *http.Request, info os.FileInfo) bool {
+	rangeHeader := r.Header.Get("Range")
+	if !strings.HasPrefix(rangeHeader, "bytes=") {
+		return true
+	}
+	var ranges []string
+	for _, ra := range strings.Split(strings.TrimPrefix(rangeHeader, "bytes="), ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" || isZeroLengthSuffixRange(ra) {
+			continue
+		}
+		ranges = append(ranges, ra)
+	}
+	if len(ranges) > 0 && info.Size() > 0 {
+		r.Header.Set("Range", "bytes="+strings.Join(ranges, ","))
+		return true
+	}
+	if !s.config.RejectZeroLengthRanges || !isIfRangeMatching(r, info) {
+		r.Header.Del("Range")
+		return true
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size()))
+	http.Error(w, "invalid range: failed to overlap", http.StatusRequestedRangeNotSatisfiable)
+	return false
+}
+
 func (s *webDavServer) authenticate(r *http.Request) (dataprovider.User, bool, webdav.LockSystem, error) {
 	var user dataprovider.User
 	var err error
@@ -177,7 +266,7 @@ func (s *webDavServer) authenticate(r *http.Request) (dataprovider.User, bool, w
 			dataprovider.RemoveCachedWebDAVUser(username)
 		} else {
 			if len(password) > 0 && cachedUser.Password == password {
-				return cachedUser.User, true, cachedUser.LockSystem, nil
+				return cachedUser.User, true, locks.getLockSystem(username), nil
 			}
 			updateLoginMetrics(username, r.RemoteAddr, dataprovider.ErrInvalidCredentials)
 			return user, false, nil, dataprovider.ErrInvalidCredentials
@@ -188,19 +277,17 @@ func (s *webDavServer) authenticate(r *http.Request) (dataprovider.User, bool, w
 		updateLoginMetrics(username, r.RemoteAddr, err)
 		return user, false, nil, err
 	}
-	lockSystem := webdav.NewMemLS()
 	if password != "" {
 		cachedUser := &dataprovider.CachedUser{
-			User:       user,
-			Password:   password,
-			LockSystem: lockSystem,
+			User:     user,
+			Password: password,
 		}
 		if s.config.Cache.Users.ExpirationTime > 0 {
 			cachedUser.Expiration = time.Now().Add(time.Duration(s.config.Cache.Users.ExpirationTime) * time.Minute)
 		}
 		dataprovider.CacheWebDAVUser(cachedUser, s.config.Cache.Users.MaxSize)
 	}
-	return user, false, lockSystem, err
+	return user, false, locks.getLockSystem(user.Username), err
 }
 
 func (s *webDavServer) validateUser(user dataprovider.User, r *http.Request) (string, error) {
@@ -299,6 +386,40 @@ func updateLoginMetrics(username, remoteAddress string, err error) {
 	if err != nil {
 		logger.ConnectionFailedLog(username, ip, dataprovider.LoginMethodPassword, common.ProtocolWebDAV, err.Error())
 	}
-	metrics.AddLoginResult(dataprovider.LoginMethodPassword, err)
+	metrics.AddLoginResult(dataprovider.LoginMethodPassword, common.ProtocolWebDAV,
+		common.GetUsernameForLoginMetrics(username, err), err)
 	dataprovider.ExecutePostLoginHook(username, dataprovider.LoginMethodPassword, ip, common.ProtocolWebDAV, err)
 }
+
+func isZeroLengthSuffixRange(ra string) bool {
+	if !strings.HasPrefix(ra, "-") {
+		return false
+	}
+	length, err := strconv.ParseInt(strings.TrimPrefix(ra, "-"), 10, 64)
+	return err == nil && length == 0
+}
+
+// isIfRangeMatching returns true if the request has no If-Range header or if its
+// entity tag or date matches the given file, see RFC 7233, section 3.2
+func isIfRangeMatching(r *http.Request, info os.FileInfo) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		// weak entity tags never match using the strong comparison
+		return ifRange == getETag(r.Context(), info)
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && t.Unix() == info.ModTime().Unix()
+}
+
+// getETag returns the same entity tag sent by the WebDAV handler for the given file
+func getETag(ctx context.Context, info os.FileInfo) string {
+	if fi, ok := info.(webdav.ETager); ok {
+		if etag, err := fi.ETag(ctx); err == nil {
+			return etag
+		}
+	}
+	return fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size())
+}
@@ -68,6 +68,12 @@ type Configuration struct {
 	Cors Cors `json:"cors" mapstructure:"cors"`
 	// Cache configuration
 	Cache Cache `json:"cache" mapstructure:"cache"`
+	// Range requests that cannot select any byte, such as a zero-length suffix range ("bytes=-0")
+	// or any range for an empty file, are served as full downloads by default, ignoring the Range
+	// header. Set to true to reply with a 416 (Range Not Satisfiable) status code instead
+	RejectZeroLengthRanges bool `json:"reject_zero_length_ranges" mapstructure:"reject_zero_length_ranges"`
+	// Locks configuration
+	Locks LocksConfig `json:"locks" mapstructure:"locks"`
 }
 
 // Initialize configures and starts the WebDav server
@@ -81,6 +87,7 @@ func (c *Configuration) Initialize(configDir string) error {
 	if !c.Cache.MimeTypes.Enabled {
 		mimeTypeCache.maxSize = 0
 	}
+	locks = newLockManager(c.Locks)
 	server, err = newServer(c, configDir)
 	if err != nil {
 		return err
@@ -1,12 +1,17 @@
 package webdavd_test
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -14,12 +19,14 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/studio-b12/gowebdav"
 
 	"github.com/drakkan/sftpgo/common"
@@ -674,6 +681,177 @@ func TestDeniedProtocols(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestQuotaProperties(t *testing.T) {
+	u := getTestUser()
+	u.QuotaSize = 1048576
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFileSize := int64(65535)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client := getWebDavClient(user)
+	err = uploadFile(testFilePath, testFileName, testFileSize, client)
+	assert.NoError(t, err)
+	propfindBody := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop>` +
+		`<D:quota-available-bytes/><D:quota-used-bytes/></D:prop></D:propfind>`
+	getQuotaProps := func(username, password string) string {
+		req, err := http.NewRequest("PROPFIND", fmt.Sprintf("http://%v/%v/", webDavServerAddr, username),
+			bytes.NewBufferString(propfindBody))
+		assert.NoError(t, err)
+		req.SetBasicAuth(username, password)
+		req.Header.Set("Depth", "0")
+		resp, err := httpclient.GetHTTPClient().Do(req)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(body)
+	}
+	body := getQuotaProps(user.Username, defaultPassword)
+	assert.Contains(t, body, fmt.Sprintf("quota-used-bytes>%v<", testFileSize))
+	assert.Contains(t, body, fmt.Sprintf("quota-available-bytes>%v<", u.QuotaSize-testFileSize))
+	// without quota restrictions a large available size is reported
+	user.QuotaSize = 0
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	body = getQuotaProps(user.Username, defaultPassword)
+	assert.Contains(t, body, "quota-available-bytes>1125899906842624<")
+	assert.Contains(t, body, "quota-used-bytes>")
+
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestDiskSpaceCheck(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
+	assert.NoError(t, err)
+	common.Config.DiskSpaceChecks = []common.DiskSpaceCheck{
+		{
+			Path:         user.GetHomeDir(),
+			MinFreeSpace: math.MaxInt64 / 2,
+		},
+	}
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client := getWebDavClient(user)
+	err = uploadFile(testFilePath, testFileName, testFileSize, client)
+	assert.Error(t, err)
+	// uploads with a declared size are rejected before streaming
+	remotePath := fmt.Sprintf("http://%v/%v/%v", webDavServerAddr, user.Username, testFileName)
+	req, err := http.NewRequest(http.MethodPut, remotePath, bytes.NewBuffer(make([]byte, testFileSize)))
+	if assert.NoError(t, err) {
+		req.SetBasicAuth(user.Username, defaultPassword)
+		resp, err := httpclient.GetHTTPClient().Do(req)
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+			err = resp.Body.Close()
+			assert.NoError(t, err)
+		}
+	}
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), testFileName))
+	assert.True(t, os.IsNotExist(err))
+	common.Config.DiskSpaceChecks[0].MinFreeSpace = 0
+	err = uploadFile(testFilePath, testFileName, testFileSize, client)
+	assert.NoError(t, err)
+
+	common.Config.DiskSpaceChecks = nil
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestLocks(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
+	assert.NoError(t, err)
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	assert.NoError(t, err)
+	client := getWebDavClient(user)
+	err = uploadFile(testFilePath, testFileName, testFileSize, client)
+	assert.NoError(t, err)
+
+	httpClient := httpclient.GetHTTPClient()
+	remotePath := fmt.Sprintf("http://%v/%v/%v", webDavServerAddr, user.Username, testFileName)
+	doRequest := func(method string, body io.Reader, headers map[string]string) (int, http.Header, string) {
+		req, err := http.NewRequest(method, remotePath, body)
+		if !assert.NoError(t, err) {
+			return 0, nil, ""
+		}
+		req.SetBasicAuth(user.Username, defaultPassword)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := httpClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, nil, ""
+		}
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, resp.Header, string(respBody)
+	}
+	lockInfo := `<?xml version="1.0" encoding="utf-8"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:locktype><D:write/></D:locktype><D:owner>test</D:owner></D:lockinfo>`
+	// infinite locks get the default timeout
+	status, headers, body := doRequest("LOCK", strings.NewReader(lockInfo), map[string]string{"Timeout": "Infinite"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "Second-600")
+	lockToken := headers.Get("Lock-Token")
+	assert.True(t, strings.HasPrefix(lockToken, "<opaquelocktoken:"), lockToken)
+	// the resource is locked, writes without the lock token must fail
+	status, _, _ = doRequest(http.MethodPut, bytes.NewBuffer(make([]byte, 10)), nil)
+	assert.Equal(t, http.StatusLocked, status)
+	status, _, _ = doRequest(http.MethodDelete, nil, nil)
+	assert.Equal(t, http.StatusLocked, status)
+	// a second exclusive lock must fail
+	status, _, _ = doRequest("LOCK", strings.NewReader(lockInfo), nil)
+	assert.Equal(t, http.StatusLocked, status)
+	// locks are not tied to the users cache
+	dataprovider.RemoveCachedWebDAVUser(user.Username)
+	ifHeader := map[string]string{"If": fmt.Sprintf("(%v)", lockToken)}
+	status, _, _ = doRequest(http.MethodPut, bytes.NewBuffer(make([]byte, 10)), ifHeader)
+	assert.Equal(t, http.StatusCreated, status)
+	// an unknown token must not match
+	status, _, _ = doRequest(http.MethodPut, bytes.NewBuffer(make([]byte, 10)),
+		map[string]string{"If": "(<opaquelocktoken:7c2b3d4e-0000-4000-8000-000000000000>)"})
+	assert.Equal(t, http.StatusPreconditionFailed, status)
+	// refresh the lock, the requested timeout exceeds the maximum allowed
+	status, _, body = doRequest("LOCK", nil, map[string]string{
+		"If":      fmt.Sprintf("(%v)", lockToken),
+		"Timeout": "Second-100000",
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "Second-3600")
+
+	status, _, _ = doRequest("UNLOCK", nil, map[string]string{"Lock-Token": lockToken})
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _, _ = doRequest("UNLOCK", nil, map[string]string{"Lock-Token": lockToken})
+	assert.Equal(t, http.StatusConflict, status)
+	status, _, _ = doRequest(http.MethodDelete, nil, nil)
+	assert.Equal(t, http.StatusNoContent, status)
+
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestQuotaLimits(t *testing.T) {
 	u := getTestUser()
 	u.QuotaFiles = 1
@@ -770,6 +948,20 @@ func TestUploadMaxSize(t *testing.T) {
 	assert.NoError(t, err)
 	err = uploadFile(testFilePath1, testFileName1, testFileSize1, client)
 	assert.Error(t, err)
+	// uploads with a declared size bigger than the allowed one are rejected before streaming
+	remotePath := fmt.Sprintf("http://%v/%v/%v", webDavServerAddr, user.Username, testFileName+"_new")
+	req, err := http.NewRequest(http.MethodPut, remotePath, bytes.NewBuffer(make([]byte, testFileSize1)))
+	if assert.NoError(t, err) {
+		req.SetBasicAuth(user.Username, defaultPassword)
+		resp, err := httpclient.GetHTTPClient().Do(req)
+		if assert.NoError(t, err) {
+			assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+			err = resp.Body.Close()
+			assert.NoError(t, err)
+		}
+	}
+	_, err = os.Stat(filepath.Join(user.GetHomeDir(), testFileName+"_new"))
+	assert.True(t, os.IsNotExist(err))
 
 	err = os.Remove(testFilePath)
 	assert.NoError(t, err)
@@ -781,6 +973,51 @@ func TestUploadMaxSize(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestUploadChecksum(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(), http.StatusOK)
+	assert.NoError(t, err)
+	content := []byte("checksum test content")
+	sum := sha256.Sum256(content)
+	put := func(name string, headers map[string]string) int {
+		remotePath := fmt.Sprintf("http://%v/%v/%v", webDavServerAddr, user.Username, name)
+		req, err := http.NewRequest(http.MethodPut, remotePath, bytes.NewBuffer(content))
+		require.NoError(t, err)
+		req.SetBasicAuth(user.Username, defaultPassword)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := httpclient.GetHTTPClient().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	statusCode := put("file1", map[string]string{"OC-Checksum": "MD5:abcd SHA256:" + hex.EncodeToString(sum[:])})
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.FileExists(t, filepath.Join(user.GetHomeDir(), "file1"))
+	statusCode = put("file2", map[string]string{"Digest": "MD5=abcd, SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])})
+	assert.Equal(t, http.StatusCreated, statusCode)
+	assert.FileExists(t, filepath.Join(user.GetHomeDir(), "file2"))
+	// checksum mismatch
+	otherSum := sha256.Sum256([]byte("other content"))
+	statusCode = put("file3", map[string]string{"OC-Checksum": "SHA256:" + hex.EncodeToString(otherSum[:])})
+	assert.NotEqual(t, http.StatusCreated, statusCode)
+	assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), "file3"))
+	statusCode = put("file4", map[string]string{"Digest": "SHA-256=" + base64.StdEncoding.EncodeToString(otherSum[:])})
+	assert.NotEqual(t, http.StatusCreated, statusCode)
+	assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), "file4"))
+	// invalid checksums are rejected before the upload
+	statusCode = put("file5", map[string]string{"OC-Checksum": "SHA256:invalid"})
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	statusCode = put("file5", map[string]string{"Digest": "SHA-256=invalid"})
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+	assert.NoFileExists(t, filepath.Join(user.GetHomeDir(), "file5"))
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestClientClose(t *testing.T) {
 	u := getTestUser()
 	u.UploadBandwidth = 64
@@ -984,6 +1221,151 @@ func TestBytesRangeRequests(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestCryptFsRangeRequests(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.Provider = dataprovider.CryptedFilesystemProvider
+	u.FsConfig.CryptConfig.Passphrase.Payload = "crypt passphrase"
+	u.FsConfig.CryptConfig.Passphrase.Status = vfs.SecretStatusPlain
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	// the data is encrypted in 64KB packages, use more than two packages
+	fileContent := make([]byte, 150000)
+	_, err = rand.Read(fileContent)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(testFilePath, fileContent, os.ModePerm)
+	assert.NoError(t, err)
+	client := getWebDavClient(user)
+	err = uploadFile(testFilePath, testFileName, int64(len(fileContent)), client)
+	assert.NoError(t, err)
+	info, err := client.Stat(testFileName)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(len(fileContent)), info.Size())
+	}
+	remotePath := fmt.Sprintf("http://%v/%v/%v", webDavServerAddr, user.Username, testFileName)
+	req, err := http.NewRequest(http.MethodGet, remotePath, nil)
+	if assert.NoError(t, err) {
+		httpClient := httpclient.GetHTTPClient()
+		req.SetBasicAuth(user.Username, defaultPassword)
+		req.Header.Set("Range", "bytes=70000-")
+		resp, err := httpClient.Do(req)
+		if assert.NoError(t, err) {
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			bodyBytes, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, fileContent[70000:], bodyBytes)
+		}
+		// this range crosses a package boundary
+		req.Header.Set("Range", "bytes=65530-65545")
+		resp, err = httpClient.Do(req)
+		if assert.NoError(t, err) {
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			bodyBytes, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, fileContent[65530:65546], bodyBytes)
+		}
+	}
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
+func TestConditionalRangeRequests(t *testing.T) {
+	u := getTestUser()
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	testFileName := "test_file.txt"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	fileContent := []byte("test file contents")
+	err = ioutil.WriteFile(testFilePath, fileContent, os.ModePerm)
+	assert.NoError(t, err)
+	client := getWebDavClient(user)
+	err = uploadFile(testFilePath, testFileName, int64(len(fileContent)), client)
+	assert.NoError(t, err)
+	emptyFileName := "empty_file.txt"
+	err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), emptyFileName), nil, os.ModePerm)
+	assert.NoError(t, err)
+
+	httpClient := httpclient.GetHTTPClient()
+	doRequest := func(method, fileName, rangeHeader, ifRange string) (*http.Response, string) {
+		remotePath := fmt.Sprintf("http://%v/%v/%v", webDavServerAddr, user.Username, fileName)
+		req, err := http.NewRequest(method, remotePath, nil)
+		assert.NoError(t, err)
+		req.SetBasicAuth(user.Username, defaultPassword)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+		resp, err := httpClient.Do(req)
+		if !assert.NoError(t, err) {
+			return &http.Response{}, ""
+		}
+		defer resp.Body.Close()
+		bodyBytes, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(bodyBytes)
+	}
+
+	resp, _ := doRequest(http.MethodHead, testFileName, "", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	lastModified := resp.Header.Get("Last-Modified")
+	assert.NotEmpty(t, lastModified)
+
+	resp, body := doRequest(http.MethodGet, testFileName, "bytes=100-", "")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	assert.NotEqual(t, string(fileContent), body)
+	assert.Equal(t, fmt.Sprintf("bytes */%v", len(fileContent)), resp.Header.Get("Content-Range"))
+	resp, body = doRequest(http.MethodGet, testFileName, "bytes=10-", "")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("bytes 10-%v/%v", len(fileContent)-1, len(fileContent)), resp.Header.Get("Content-Range"))
+	assert.Equal(t, "contents", body)
+	resp, body = doRequest(http.MethodGet, testFileName, "bytes=-8", "")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "contents", body)
+	// If-Range matching the ETag or the modification time
+	for _, ifRange := range []string{etag, lastModified} {
+		resp, body = doRequest(http.MethodGet, testFileName, "bytes=5-8", ifRange)
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "file", body)
+	}
+	// If-Range mismatch, the full file must be returned
+	for _, ifRange := range []string{`"mismatch"`, "W/" + etag, "Mon, 02 Jan 2006 15:04:05 GMT"} {
+		resp, body = doRequest(http.MethodGet, testFileName, "bytes=5-8", ifRange)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, string(fileContent), body)
+	}
+	// zero-length ranges are ignored
+	resp, body = doRequest(http.MethodGet, testFileName, "bytes=-0", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Range"))
+	assert.Equal(t, string(fileContent), body)
+	resp, body = doRequest(http.MethodGet, testFileName, "bytes=-0,5-8", "")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "file", body)
+	resp, _ = doRequest(http.MethodHead, testFileName, "bytes=-0", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body = doRequest(http.MethodGet, emptyFileName, "bytes=0-", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+
+	err = os.Remove(testFilePath)
+	assert.NoError(t, err)
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestGETAsPROPFIND(t *testing.T) {
 	u := getTestUser()
 	subDir1 := "/sub1"
@@ -1047,6 +1429,71 @@ func TestGETAsPROPFIND(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRecursionLimits(t *testing.T) {
+	u := getTestUser()
+	u.Filters.MaxRecursionDepth = 2
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	assert.NoError(t, err)
+	client := getWebDavClient(user)
+	err = client.MkdirAll(path.Join("/a", "b", "c", "d"), os.ModePerm)
+	assert.NoError(t, err)
+	httpClient := httpclient.GetHTTPClient()
+	rootPath := fmt.Sprintf("http://%v/%v/", webDavServerAddr, user.Username)
+	for _, depth := range []string{"infinity", ""} {
+		req, err := http.NewRequest("PROPFIND", rootPath, nil)
+		if assert.NoError(t, err) {
+			req.SetBasicAuth(u.Username, u.Password)
+			if depth != "" {
+				req.Header.Set("Depth", depth)
+			}
+			resp, err := httpClient.Do(req)
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+				body, err := ioutil.ReadAll(resp.Body)
+				assert.NoError(t, err)
+				assert.Contains(t, string(body), "propfind-finite-depth")
+				resp.Body.Close()
+			}
+		}
+	}
+	for _, p := range []string{rootPath, rootPath + "a/b/"} {
+		depth := "1"
+		if p != rootPath {
+			depth = "infinity"
+		}
+		req, err := http.NewRequest("PROPFIND", p, nil)
+		if assert.NoError(t, err) {
+			req.SetBasicAuth(u.Username, u.Password)
+			req.Header.Set("Depth", depth)
+			resp, err := httpClient.Do(req)
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+				resp.Body.Close()
+			}
+		}
+	}
+	err = client.RemoveAll("/a")
+	assert.Error(t, err)
+	_, err = client.Stat(path.Join("/a", "b", "c", "d"))
+	assert.NoError(t, err)
+	// now limit the entries
+	user.Filters.MaxRecursionDepth = 10
+	user.Filters.MaxRecursionEntries = 1
+	user, _, err = httpd.UpdateUser(user, http.StatusOK, "")
+	assert.NoError(t, err)
+	err = client.RemoveAll(path.Join("/a", "b"))
+	assert.Error(t, err)
+	err = client.RemoveAll(path.Join("/a", "b", "c"))
+	assert.NoError(t, err)
+	err = client.RemoveAll("/a")
+	assert.NoError(t, err)
+
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	assert.NoError(t, err)
+	err = os.RemoveAll(user.GetHomeDir())
+	assert.NoError(t, err)
+}
+
 func TestStat(t *testing.T) {
 	u := getTestUser()
 	u.Permissions["/subdir"] = []string{dataprovider.PermUpload, dataprovider.PermListItems, dataprovider.PermDownload}